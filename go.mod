@@ -5,18 +5,29 @@ go 1.15
 require (
 	github.com/Rican7/retry v0.1.0
 	github.com/canonical/go-dqlite v1.8.0
+	github.com/denisenkom/go-mssqldb v0.12.0
 	github.com/go-sql-driver/mysql v1.6.0
+	github.com/klauspost/compress v1.13.6
 	github.com/lib/pq v1.10.2
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 	github.com/onsi/gomega v1.27.3
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/rancher/wrangler v0.8.3
 	github.com/sirupsen/logrus v1.7.0
 	github.com/urfave/cli v1.21.0
+	go.etcd.io/bbolt v1.3.6
 	go.etcd.io/etcd v0.0.0-20191023171146-3cf2f69b5738
 	go.etcd.io/etcd/api/v3 v3.5.0
 	go.etcd.io/etcd/client/pkg/v3 v3.5.0
 	go.etcd.io/etcd/client/v3 v3.5.0
 	go.etcd.io/etcd/server/v3 v3.5.0
+	go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc v0.20.0
+	go.opentelemetry.io/otel v0.20.0
+	go.opentelemetry.io/otel/oteltest v0.20.0
+	go.opentelemetry.io/otel/trace v0.20.0
+	go.uber.org/goleak v1.1.10
 	google.golang.org/grpc v1.38.0
+	modernc.org/sqlite v1.11.2
 )
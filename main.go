@@ -2,9 +2,25 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/rancher/kine/pkg/backup"
+	"github.com/rancher/kine/pkg/bench"
+	"github.com/rancher/kine/pkg/drivers/generic"
 	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/inspect"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/migrate"
+	"github.com/rancher/kine/pkg/replicate"
+	"github.com/rancher/kine/pkg/server"
+	"github.com/rancher/kine/pkg/tls"
 	"github.com/rancher/wrangler/pkg/signals"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -22,47 +38,714 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:        "listen-address",
+			Usage:       "Address to listen on, or a comma separated list of addresses; https addresses are served with TLS",
 			Value:       "tcp://0.0.0.0:2379",
 			Destination: &config.Listener,
 		},
+		cli.StringFlag{
+			Name:        "server-cert-file",
+			Usage:       "Certificate that https listen addresses are served with",
+			Destination: &config.ServerTLSConfig.CertFile,
+		},
+		cli.StringFlag{
+			Name:        "server-key-file",
+			Usage:       "Key for the certificate that https listen addresses are served with",
+			Destination: &config.ServerTLSConfig.KeyFile,
+		},
+		cli.StringFlag{
+			Name:        "client-ca-file",
+			Usage:       "CA that the certificates clients of https listen addresses present are verified with",
+			Destination: &config.ServerTLSConfig.ClientCAFile,
+		},
+		cli.BoolFlag{
+			Name:        "require-client-cert",
+			Usage:       "Reject clients of https listen addresses that do not present a certificate signed by the client CA",
+			Destination: &config.ServerTLSConfig.RequireClientCert,
+		},
 		cli.StringFlag{
 			Name:        "endpoint",
 			Usage:       "Storage endpoint (default is sqlite)",
 			Destination: &config.Endpoint,
 		},
+		cli.StringSliceFlag{
+			Name:  "read-endpoint",
+			Usage: "Storage endpoint of a read replica that lists and counts are read from, may be given more than once",
+		},
 		cli.StringFlag{
 			Name:        "ca-file",
 			Usage:       "CA cert for DB connection",
-			Destination: &config.CAFile,
+			Destination: &config.BackendTLSConfig.CAFile,
 		},
 		cli.StringFlag{
 			Name:        "cert-file",
 			Usage:       "Certificate for DB connection",
-			Destination: &config.CertFile,
+			Destination: &config.BackendTLSConfig.CertFile,
 		},
 		cli.StringFlag{
 			Name:        "key-file",
 			Usage:       "Key file for DB connection",
-			Destination: &config.KeyFile,
+			Destination: &config.BackendTLSConfig.KeyFile,
+		},
+		cli.BoolFlag{
+			Name:        "skip-verify",
+			Usage:       "Encrypt the DB connection without verifying the certificate of the DB",
+			Destination: &config.BackendTLSConfig.SkipVerify,
+		},
+		cli.DurationFlag{
+			Name:        "compact-interval",
+			Usage:       "Interval between automatic compactions, 0 to disable",
+			Value:       5 * time.Minute,
+			Destination: &config.CompactInterval,
+		},
+		cli.Int64Flag{
+			Name:        "compact-min-retain",
+			Usage:       "Number of revisions retained by automatic compaction",
+			Value:       1000,
+			Destination: &config.CompactMinRetain,
+		},
+		cli.BoolFlag{
+			Name:        "compact-gc",
+			Usage:       "Remove the rows that no read can return, left behind by interrupted compactions, after every automatic compaction",
+			Destination: &config.CompactGC,
+		},
+		cli.StringSliceFlag{
+			Name:  "compact-prefix-retention",
+			Usage: "Retention of the history of a prefix trimmed by automatic compaction, as prefix=revisions or prefix=duration, such as /registry/events/=1h (may be repeated)",
+		},
+		cli.StringFlag{
+			Name:        "name",
+			Usage:       "Name of the member returned by member list",
+			Destination: &config.Name,
+		},
+		cli.StringSliceFlag{
+			Name:  "advertise-client-urls",
+			Usage: "Client urls of the member returned by member list (defaults to the listen address)",
+		},
+		cli.StringSliceFlag{
+			Name:  "advertise-peer-urls",
+			Usage: "Peer urls of the member returned by member list (defaults to the client urls)",
+		},
+		cli.DurationFlag{
+			Name:        "health-check-interval",
+			Usage:       "Interval at which the health service probes the database",
+			Value:       5 * time.Second,
+			Destination: &config.HealthCheckInterval,
+		},
+		cli.DurationFlag{
+			Name:        "health-check-timeout",
+			Usage:       "Time a database probe may take before the health service reports not serving",
+			Value:       time.Second,
+			Destination: &config.HealthCheckTimeout,
+		},
+		cli.DurationFlag{
+			Name:        "watch-progress-notify-interval",
+			Usage:       "Interval between progress notifications on watches that requested them",
+			Value:       5 * time.Second,
+			Destination: &config.NotifyInterval,
+		},
+		cli.IntFlag{
+			Name:        "max-response-bytes",
+			Usage:       "Size above which watch responses are split into fragments, on watches that allow it",
+			Value:       1.5 * 1024 * 1024,
+			Destination: &config.MaxResponseBytes,
+		},
+		cli.IntFlag{
+			Name:        "max-request-bytes",
+			Usage:       "Size above which write requests are rejected as too large, unlimited if negative",
+			Value:       1.5 * 1024 * 1024,
+			Destination: &config.MaxRequestBytes,
+		},
+		cli.Int64Flag{
+			Name:        "quota-backend-bytes",
+			Usage:       "Database size above which writes are rejected with a NOSPACE alarm (0 disables the quota)",
+			Destination: &config.QuotaBackendBytes,
+		},
+		cli.BoolFlag{
+			Name:        "read-only",
+			Usage:       "Start in read-only mode, rejecting writes while serving reads and watches; SIGUSR1 toggles the mode",
+			Destination: &config.ReadOnly,
+		},
+		cli.BoolFlag{
+			Name:        "disable-watch-sharing",
+			Usage:       "Give every watch a watch of the database of its own, rather than sharing one between the watches of the same key and filters",
+			Destination: &config.DisableWatchSharing,
+		},
+		cli.IntFlag{
+			Name:        "max-concurrent-lists",
+			Usage:       "Number of expensive lists, of whole ranges or with limits above the list limit threshold, that run at once (0 disables the limit)",
+			Destination: &config.MaxConcurrentLists,
+		},
+		cli.DurationFlag{
+			Name:        "list-queue-timeout",
+			Usage:       "Time expensive lists over the concurrency limit wait for a slot before they are rejected",
+			Value:       5 * time.Second,
+			Destination: &config.ListQueueTimeout,
+		},
+		cli.Int64Flag{
+			Name:        "list-limit-threshold",
+			Usage:       "Limit of the lists above which they are expensive, as lists of whole ranges are",
+			Value:       500,
+			Destination: &config.ListLimitThreshold,
+		},
+		cli.Float64Flag{
+			Name:        "list-rate-limit",
+			Usage:       "Number of expensive lists per second that each client, by certificate common name or host, may start (0 disables the limit)",
+			Destination: &config.ListRateLimit,
+		},
+		cli.IntFlag{
+			Name:        "list-rate-burst",
+			Usage:       "Number of expensive lists that each client may start at once under the list rate limit, which defaults to the rate",
+			Destination: &config.ListRateBurst,
+		},
+		cli.DurationFlag{
+			Name:        "poll-interval",
+			Usage:       "Interval at which the database is polled for new events",
+			Value:       time.Second,
+			Destination: &config.PollInterval,
+		},
+		cli.Int64Flag{
+			Name:        "poll-batch-size",
+			Usage:       "Number of rows read from the database per poll",
+			Value:       500,
+			Destination: &config.PollBatchSize,
+		},
+		cli.IntFlag{
+			Name:        "watch-buffer-size",
+			Usage:       "Number of event batches buffered for each watch before it is canceled for being too slow",
+			Value:       100,
+			Destination: &config.WatchBufferSize,
+		},
+		cli.StringFlag{
+			Name:        "table-name",
+			Usage:       "Name of the table of the log in SQL databases, for several kine sharing a database",
+			Value:       "kine",
+			Destination: &config.TableName,
+		},
+		cli.StringFlag{
+			Name:        "schema-name",
+			Usage:       "Schema of the tables in Postgres, CockroachDB and SQL Server databases, the default schema if empty",
+			Destination: &config.SchemaName,
+		},
+		cli.DurationFlag{
+			Name:        "sqlite-busy-timeout",
+			Usage:       "How long sqlite waits on a locked database before failing",
+			Destination: &config.SQLite.BusyTimeout,
+		},
+		cli.StringFlag{
+			Name:        "sqlite-journal-mode",
+			Usage:       "sqlite journal mode (DELETE, TRUNCATE, PERSIST, MEMORY, WAL, OFF)",
+			Destination: &config.SQLite.JournalMode,
+		},
+		cli.StringFlag{
+			Name:        "sqlite-synchronous",
+			Usage:       "sqlite synchronous level (OFF, NORMAL, FULL, EXTRA)",
+			Destination: &config.SQLite.Synchronous,
+		},
+		cli.IntFlag{
+			Name:        "sqlite-wal-autocheckpoint",
+			Usage:       "Number of WAL pages after which sqlite checkpoints automatically, negative to disable",
+			Destination: &config.SQLite.WALAutoCheckpoint,
+		},
+		cli.DurationFlag{
+			Name:        "sqlite-setup-timeout",
+			Usage:       "How long creating the tables of the sqlite database is retried while it is not ready",
+			Value:       5 * time.Minute,
+			Destination: &config.SQLite.SetupTimeout,
+		},
+		cli.IntFlag{
+			Name:        "datastore-max-open-connections",
+			Usage:       "Maximum number of connections open to the database, unlimited if negative, default of the driver if zero",
+			Destination: &config.ConnectionPoolConfig.MaxOpen,
+		},
+		cli.IntFlag{
+			Name:        "datastore-max-idle-connections",
+			Usage:       "Maximum number of idle connections kept open to the database, none if negative, default of the driver if zero",
+			Destination: &config.ConnectionPoolConfig.MaxIdle,
+		},
+		cli.DurationFlag{
+			Name:        "datastore-connection-max-lifetime",
+			Usage:       "Time connections to the database are reused for, forever if negative, default of the driver if zero",
+			Destination: &config.ConnectionPoolConfig.MaxLifetime,
+		},
+		cli.DurationFlag{
+			Name:        "datastore-read-timeout",
+			Usage:       "Timeout of SQL statements for point reads, disabled if negative, 10s if zero",
+			Destination: &config.StatementTimeouts.Read,
+		},
+		cli.DurationFlag{
+			Name:        "datastore-list-timeout",
+			Usage:       "Timeout of SQL statements for lists, disabled if negative, 30s if zero",
+			Destination: &config.StatementTimeouts.List,
+		},
+		cli.DurationFlag{
+			Name:        "datastore-write-timeout",
+			Usage:       "Timeout of SQL statements for writes, disabled if negative, 10s if zero",
+			Destination: &config.StatementTimeouts.Write,
+		},
+		cli.DurationFlag{
+			Name:        "datastore-compact-timeout",
+			Usage:       "Timeout of SQL statements for compaction and defragment, disabled if negative, 10m if zero",
+			Destination: &config.StatementTimeouts.Compact,
+		},
+		cli.DurationFlag{
+			Name:        "slow-query-threshold",
+			Usage:       "Duration above which SQL statements are logged as slow, disabled if zero",
+			Destination: &config.SlowQueryThreshold,
+		},
+		cli.BoolFlag{
+			Name:        "estimate-counts",
+			Usage:       "Estimate the counts of keys from the statistics of sqlite, postgres and mysql databases rather than counting them exactly",
+			Destination: &config.EstimateCounts,
+		},
+		cli.StringFlag{
+			Name:        "metrics-bind-address",
+			Usage:       "Address to serve Prometheus metrics on at /metrics, disabled if empty",
+			Destination: &config.MetricsListener,
+		},
+		cli.StringFlag{
+			Name:        "audit-log-file",
+			Usage:       "File to record creates, updates and deletes of keys in, reopened on SIGHUP, disabled if empty",
+			Destination: &config.AuditLogFile,
+		},
+		cli.Int64Flag{
+			Name:        "audit-log-max-size",
+			Usage:       "Size in bytes above which the audit log is rotated, unlimited if zero",
+			Destination: &config.AuditLogMaxSize,
+		},
+		cli.BoolFlag{
+			Name:        "compress-values",
+			Usage:       "Compress values with zstd before storing them; compressed values are read back whether or not it is set",
+			Destination: &config.CompressValues,
+		},
+		cli.BoolFlag{
+			Name:        "verify",
+			Usage:       "Check that the stored revisions of the database fit the history of their keys before starting, and refuse to start if any does not",
+			Destination: &config.VerifyOnStart,
+		},
+		cli.DurationFlag{
+			Name:        "quiesce-timeout",
+			Usage:       "Longest that writes are held once quiesced, by SIGUSR2 or a POST to /debug/quiesce of the metrics listener, before they are resumed; SIGUSR2 again or a POST to /debug/resume resumes them sooner",
+			Value:       time.Minute,
+			Destination: &config.QuiesceTimeout,
 		},
 		cli.BoolFlag{Name: "debug"},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: "Format of the logs, text or json; json logs carry the fields of each entry, such as the rpc, key prefix, revision and duration of requests, as keys of their own",
+			Value: logging.FormatText,
+		},
 	}
 	app.Action = run
+	app.Commands = []cli.Command{
+		{
+			Name:      "restore",
+			Usage:     "Recreate the database of the endpoint from a snapshot, read from stdin if the file is -",
+			ArgsUsage: "SNAPSHOT",
+			Action:    restore,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Replace the keys the database holds already, rather than refusing to restore into it",
+				},
+			},
+		},
+		{
+			Name:      "backup",
+			Usage:     "Write a snapshot of the database of the endpoint while it is served, to stdout if the file is -",
+			ArgsUsage: "SNAPSHOT",
+			Action:    backupSnapshot,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "portable",
+					Usage:       "Write sqlite databases row by row, so that the snapshot restores into any backend rather than only into sqlite",
+					Destination: &config.SQLite.PortableSnapshots,
+				},
+			},
+		},
+		{
+			Name:      "migrate",
+			Usage:     "Copy the keys of the endpoint while it is served into the empty database of another endpoint, with revisions above those of the endpoint",
+			ArgsUsage: "DESTINATION",
+			Action:    migrateKeys,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "follow",
+					Usage: "Replay the writes made to the endpoint after the copy until none is made for this long, as once it is switched to read-only mode; not replayed if zero",
+				},
+				cli.Int64Flag{
+					Name:  "batch-size",
+					Usage: "Number of keys copied together",
+					Value: migrate.DefaultBatchSize,
+				},
+			},
+		},
+		{
+			Name:      "replicate",
+			Usage:     "Replicate the writes of the endpoint to an etcd-compatible endpoint, such as a standby kine, continuously and from its last checkpoint when restarted",
+			ArgsUsage: "TARGET",
+			Action:    replicateKeys,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "checkpoint-key",
+					Usage: "Key of the endpoint that the revision replicated up to is kept at",
+					Value: replicate.DefaultCheckpointKey,
+				},
+				cli.DurationFlag{
+					Name:  "checkpoint-interval",
+					Usage: "Interval at which the revision replicated up to is written",
+					Value: replicate.DefaultCheckpointInterval,
+				},
+				cli.Int64Flag{
+					Name:  "batch-size",
+					Usage: "Number of keys read together when the target is resynced",
+					Value: replicate.DefaultBatchSize,
+				},
+				cli.StringFlag{
+					Name:  "target-ca-file",
+					Usage: "CA cert for the connection to the target",
+				},
+				cli.StringFlag{
+					Name:  "target-cert-file",
+					Usage: "Certificate for the connection to the target",
+				},
+				cli.StringFlag{
+					Name:  "target-key-file",
+					Usage: "Key file for the connection to the target",
+				},
+			},
+		},
+		{
+			Name:      "import",
+			Usage:     "Import the current keys of an etcd snapshot, as etcdctl snapshot save writes it, into the empty database of the endpoint",
+			ArgsUsage: "SNAPSHOT",
+			Action:    importSnapshot,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "prefix",
+					Usage: "Only import the keys that start with this prefix",
+				},
+				cli.Int64Flag{
+					Name:  "batch-size",
+					Usage: "Number of keys imported together",
+					Value: migrate.DefaultBatchSize,
+				},
+			},
+		},
+		{
+			Name:      "history",
+			Usage:     "Write the revisions of a key that the database of the endpoint stores to stdout as JSON, for debugging",
+			ArgsUsage: "KEY",
+			Action:    keyHistory,
+			Flags: []cli.Flag{
+				cli.Int64Flag{
+					Name:  "revision",
+					Usage: "Only write the revision of the key at this revision",
+				},
+				cli.BoolFlag{
+					Name:  "values",
+					Usage: "Write the values of the revisions as well, base64 encoded",
+				},
+			},
+		},
+		{
+			Name:   "verify",
+			Usage:  "Check that the stored revisions of the database of the endpoint fit the history of their keys, and list those that do not",
+			Action: verify,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "repair",
+					Usage: "Delete the orphaned tombstones, the deletes of keys with no earlier revision stored, which are missing either way",
+				},
+			},
+		},
+		{
+			Name:   "gc",
+			Usage:  "Remove the rows of the database of the endpoint that no read can return any more, left behind by interrupted compactions and crashes, and list them by kind",
+			Action: gc,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only count the rows and estimate their size, without removing them",
+				},
+			},
+		},
+		{
+			Name:   "bench",
+			Usage:  "Serve the endpoint on a local port and drive it with a load modeled on the kube-apiserver, writing the latencies of each operation to stdout as JSON",
+			Action: benchmark,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "keys",
+					Usage: "Number of keys created before the load starts",
+					Value: bench.DefaultConfig().Keys,
+				},
+				cli.IntFlag{
+					Name:  "prefixes",
+					Usage: "Number of prefixes the keys are spread across",
+					Value: bench.DefaultConfig().Prefixes,
+				},
+				cli.IntFlag{
+					Name:  "value-size",
+					Usage: "Size of the values in bytes",
+					Value: bench.DefaultConfig().ValueSize,
+				},
+				cli.DurationFlag{
+					Name:  "duration",
+					Usage: "How long the load runs for once the keys are created",
+					Value: bench.DefaultConfig().Duration,
+				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Usage: "Number of clients creating and updating keys",
+					Value: bench.DefaultConfig().Concurrency,
+				},
+				cli.IntFlag{
+					Name:  "update-rate",
+					Usage: "Updates per second, across the clients",
+					Value: bench.DefaultConfig().UpdateRate,
+				},
+				cli.IntFlag{
+					Name:  "watches",
+					Usage: "Number of watches of the prefixes",
+					Value: bench.DefaultConfig().Watches,
+				},
+				cli.DurationFlag{
+					Name:  "list-interval",
+					Usage: "Interval at which a prefix is listed in full and counted",
+					Value: bench.DefaultConfig().ListInterval,
+				},
+				cli.IntFlag{
+					Name:  "burst-size",
+					Usage: "Number of keys created in each burst",
+					Value: bench.DefaultConfig().BurstSize,
+				},
+				cli.DurationFlag{
+					Name:  "burst-interval",
+					Usage: "Interval between bursts of creates",
+					Value: bench.DefaultConfig().BurstInterval,
+				},
+			},
+		},
+	}
 
 	if err := app.Run(os.Args); err != nil {
 		logrus.Fatal(err)
 	}
 }
 
+func restore(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("restore takes the snapshot file as its only argument")
+	}
+
+	in := os.Stdin
+	if path := c.Args().First(); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	ctx := signals.SetupSignalHandler(context.Background())
+	return endpoint.Restore(ctx, config, in, c.Bool("force"))
+}
+
+func backupSnapshot(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("backup takes the snapshot file as its only argument")
+	}
+
+	ctx := signals.SetupSignalHandler(context.Background())
+	if path := c.Args().First(); path != "-" {
+		return backup.WriteFile(ctx, config, path)
+	}
+	return backup.Write(ctx, config, os.Stdout)
+}
+
+func migrateKeys(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("migrate takes the destination endpoint as its only argument")
+	}
+
+	destination := config
+	destination.Endpoint = c.Args().First()
+	destination.ReadEndpoints = nil
+	ctx := signals.SetupSignalHandler(context.Background())
+	_, err := migrate.Migrate(ctx, migrate.Config{
+		Source:      config,
+		Destination: destination,
+		BatchSize:   c.Int64("batch-size"),
+		Follow:      c.Duration("follow"),
+	})
+	return err
+}
+
+func replicateKeys(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("replicate takes the comma-separated endpoints of the target as its only argument")
+	}
+
+	ctx := signals.SetupSignalHandler(context.Background())
+	return replicate.Replicate(ctx, replicate.Config{
+		Source: config,
+		Target: endpoint.ETCDConfig{
+			Endpoints: strings.Split(c.Args().First(), ","),
+			TLSConfig: tls.Config{
+				CAFile:   c.String("target-ca-file"),
+				CertFile: c.String("target-cert-file"),
+				KeyFile:  c.String("target-key-file"),
+			},
+		},
+		CheckpointKey:      c.String("checkpoint-key"),
+		CheckpointInterval: c.Duration("checkpoint-interval"),
+		BatchSize:          c.Int64("batch-size"),
+	})
+}
+
+func importSnapshot(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("import takes the etcd snapshot file as its only argument")
+	}
+
+	ctx := signals.SetupSignalHandler(context.Background())
+	_, err := migrate.Import(ctx, migrate.ImportConfig{
+		Snapshot:    c.Args().First(),
+		Destination: config,
+		Prefix:      c.String("prefix"),
+		BatchSize:   c.Int64("batch-size"),
+	})
+	return err
+}
+
+func keyHistory(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("history takes the key as its only argument")
+	}
+
+	ctx := signals.SetupSignalHandler(context.Background())
+	history, err := inspect.KeyHistory(ctx, config, c.Args().First(), c.Int64("revision"), c.Bool("values"))
+	if err != nil {
+		return err
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	return out.Encode(history)
+}
+
+func verify(c *cli.Context) error {
+	if c.NArg() != 0 {
+		return fmt.Errorf("verify takes no arguments")
+	}
+
+	ctx := signals.SetupSignalHandler(context.Background())
+	inconsistencies, err := endpoint.Verify(ctx, config, c.Bool("repair"))
+	if err != nil {
+		return err
+	}
+	var remaining int
+	for _, i := range inconsistencies {
+		fmt.Println(i)
+		if !i.Repaired {
+			remaining++
+		}
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%d revisions do not fit the history of their keys", remaining)
+	}
+	return nil
+}
+
+func gc(c *cli.Context) error {
+	if c.NArg() != 0 {
+		return fmt.Errorf("gc takes no arguments")
+	}
+
+	ctx := signals.SetupSignalHandler(context.Background())
+	garbage, err := endpoint.GC(ctx, config, c.Bool("dry-run"))
+	if err != nil {
+		return err
+	}
+	for _, g := range garbage {
+		fmt.Println(g)
+	}
+	return nil
+}
+
+func benchmark(c *cli.Context) error {
+	if c.NArg() != 0 {
+		return fmt.Errorf("bench takes no arguments")
+	}
+
+	// kine is served on a free local port for the benchmark alone
+	kineConfig := config
+	kineConfig.Listener = ""
+	ctx := signals.SetupSignalHandler(context.Background())
+	result, err := bench.Run(ctx, bench.Config{
+		Kine:          kineConfig,
+		Keys:          c.Int("keys"),
+		Prefixes:      c.Int("prefixes"),
+		ValueSize:     c.Int("value-size"),
+		Duration:      c.Duration("duration"),
+		Concurrency:   c.Int("concurrency"),
+		UpdateRate:    c.Int("update-rate"),
+		Watches:       c.Int("watches"),
+		ListInterval:  c.Duration("list-interval"),
+		BurstSize:     c.Int("burst-size"),
+		BurstInterval: c.Duration("burst-interval"),
+	})
+	if err != nil {
+		return err
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	return out.Encode(result)
+}
+
 func run(c *cli.Context) error {
 	if c.Bool("debug") {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
+	if err := logging.SetFormat(logrus.StandardLogger(), c.String("log-format")); err != nil {
+		return err
+	}
+	config.ClientURLs = c.StringSlice("advertise-client-urls")
+	config.PeerURLs = c.StringSlice("advertise-peer-urls")
+	config.ReadEndpoints = c.StringSlice("read-endpoint")
+	for _, s := range c.StringSlice("compact-prefix-retention") {
+		retention, err := generic.ParsePrefixRetention(s)
+		if err != nil {
+			return err
+		}
+		config.PrefixRetention = append(config.PrefixRetention, retention)
+	}
 	ctx := signals.SetupSignalHandler(context.Background())
-	_, err := endpoint.Listen(ctx, config)
+	etcdConfig, err := endpoint.Listen(ctx, config)
 	if err != nil {
 		return err
 	}
-	<-ctx.Done()
-	return ctx.Err()
+
+	toggleReadOnly := make(chan os.Signal, 1)
+	signal.Notify(toggleReadOnly, syscall.SIGUSR1)
+	defer signal.Stop(toggleReadOnly)
+	toggleQuiesce := make(chan os.Signal, 1)
+	signal.Notify(toggleQuiesce, syscall.SIGUSR2)
+	defer signal.Stop(toggleQuiesce)
+	for {
+		select {
+		case <-toggleReadOnly:
+			etcdConfig.SetReadOnly(!etcdConfig.ReadOnly())
+		case <-toggleQuiesce:
+			err := etcdConfig.Resume()
+			if errors.Is(err, server.ErrNotQuiesced) {
+				err = etcdConfig.Quiesce(ctx)
+			}
+			if err != nil {
+				logrus.Errorf("Failed to toggle the quiesce of writes: %v", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
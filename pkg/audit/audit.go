@@ -0,0 +1,193 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rancher/kine/pkg/logging"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// BufferSize is the number of events buffered for writing. Events recorded
+// while the buffer is full are dropped, so that a slow writer never holds up
+// writes to the database.
+const BufferSize = 1024
+
+const (
+	Create = "create"
+	Update = "update"
+	Delete = "delete"
+)
+
+// Event is a line of the audit log, recording a write to a key. The values
+// of keys are never recorded.
+type Event struct {
+	Time         time.Time `json:"time"`
+	Operation    string    `json:"operation"`
+	Key          string    `json:"key"`
+	Revision     int64     `json:"revision"`
+	PrevRevision int64     `json:"prevRevision,omitempty"`
+	Lease        int64     `json:"lease,omitempty"`
+	// Client is the common name of the certificate the client presented, and
+	// Address the address it connected from. Both are empty for writes made
+	// by kine itself, such as the deletion of keys whose lease expired.
+	Client  string `json:"client,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+// Log writes events as lines of JSON, in the order they are recorded. They
+// are written asynchronously by a goroutine of its own.
+type Log struct {
+	w      io.Writer
+	events chan *Event
+	done   chan struct{}
+
+	// reopen is notified to reopen the file of the log, if it writes to one
+	reopen chan os.Signal
+
+	// closed is set once the log is closed, after which events are dropped
+	closedLock sync.RWMutex
+	closed     bool
+	closeErr   error
+
+	logger logging.Logger
+}
+
+// New returns a log that writes to w. Failures to write are logged to the
+// logger, or to the standard logger of logrus if it is nil.
+func New(w io.Writer, logger logging.Logger) *Log {
+	return start(w, nil, logger)
+}
+
+// Open returns a log that appends to the file at path. The file is reopened
+// on SIGHUP, so that it can be rotated by moving it away. If maxSize is not
+// zero, the file is also rotated once it grows past maxSize bytes, by
+// renaming it with the suffix .1, replacing the previous one. Failures to
+// write are logged as they are by New.
+func Open(path string, maxSize int64, logger logging.Logger) (*Log, error) {
+	f, err := openFile(path, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	reopen := make(chan os.Signal, 1)
+	signal.Notify(reopen, syscall.SIGHUP)
+	return start(f, reopen, logger), nil
+}
+
+func start(w io.Writer, reopen chan os.Signal, logger logging.Logger) *Log {
+	l := &Log{
+		w:      w,
+		events: make(chan *Event, BufferSize),
+		done:   make(chan struct{}),
+		reopen: reopen,
+		logger: logging.OrDefault(logger),
+	}
+	go l.run()
+	return l
+}
+
+// Record records a write to the key at the revision, made by the client of
+// the rpc that ctx belongs to.
+func (l *Log) Record(ctx context.Context, operation, key string, revision, prevRevision, lease int64) {
+	event := &Event{
+		Time:         time.Now().UTC(),
+		Operation:    operation,
+		Key:          key,
+		Revision:     revision,
+		PrevRevision: prevRevision,
+		Lease:        lease,
+	}
+	event.Client, event.Address = Identity(ctx)
+
+	l.closedLock.RLock()
+	defer l.closedLock.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.events <- event:
+	default:
+		l.logger.Warnf("Audit log buffer is full, dropping %s of %s at revision %d", operation, key, revision)
+	}
+}
+
+// Close writes the events recorded so far and closes the log, and the file
+// it writes to if it was opened with Open.
+func (l *Log) Close() error {
+	l.closedLock.Lock()
+	if !l.closed {
+		l.closed = true
+		if l.reopen != nil {
+			signal.Stop(l.reopen)
+		}
+		close(l.events)
+	}
+	l.closedLock.Unlock()
+
+	<-l.done
+	return l.closeErr
+}
+
+// run writes each event with a single write, so that a file is only rotated
+// between lines.
+func (l *Log) run() {
+	defer close(l.done)
+
+	for {
+		select {
+		case event, ok := <-l.events:
+			if !ok {
+				if f, ok := l.w.(*file); ok {
+					l.closeErr = f.close()
+				}
+				return
+			}
+			line, err := json.Marshal(event)
+			if err == nil {
+				_, err = l.w.Write(append(line, '\n'))
+			}
+			if err != nil {
+				l.logger.Errorf("Failed to write audit log: %v", err)
+			}
+		case <-l.reopen:
+			if f, ok := l.w.(*file); ok {
+				if err := f.open(); err != nil {
+					l.logger.Errorf("Failed to reopen audit log: %v", err)
+				} else {
+					l.logger.Infof("Reopened audit log %s", f.path)
+				}
+			}
+		}
+	}
+}
+
+// Identity returns the common name of the client certificate and the
+// address of the client of the rpc that ctx belongs to.
+func Identity(ctx context.Context) (string, string) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", ""
+	}
+	var address string
+	if p.Addr != nil {
+		address = p.Addr.String()
+	}
+	return commonName(p.AuthInfo), address
+}
+
+// commonName returns the common name of the certificate the client presented
+// over TLS, if any.
+func commonName(authInfo credentials.AuthInfo) string {
+	info, ok := authInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return ""
+	}
+	return info.State.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,67 @@
+package audit
+
+import (
+	"os"
+)
+
+// file is the file of a log opened with Open. It is only used by the
+// goroutine of the log.
+type file struct {
+	path    string
+	maxSize int64
+
+	f    *os.File
+	size int64
+}
+
+func openFile(path string, maxSize int64) (*file, error) {
+	f := &file{path: path, maxSize: maxSize}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file at the path, which is a new one if the previous one
+// was moved away, and closes the previous one. If it cannot be opened, the
+// previous one is kept.
+func (f *file) open() error {
+	out, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := out.Stat()
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if f.f != nil {
+		f.f.Close()
+	}
+	f.f, f.size = out, info.Size()
+	return nil
+}
+
+// rotate moves the file away to the path with the suffix .1 and opens a new
+// one.
+func (f *file) rotate() error {
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *file) close() error {
+	return f.f.Close()
+}
@@ -0,0 +1,65 @@
+// Package backup takes backups of the database of a kine storage endpoint
+// while it is served, by connecting to the database directly rather than to
+// kine.
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/kine/pkg/endpoint"
+)
+
+// Write writes a snapshot of the database of the storage endpoint of the
+// config to w, in the format of the snapshot rpc, which endpoint.Restore
+// restores. The snapshot is consistent as of the revision it records: the
+// rows are read in one transaction pinned to the revision, or a sqlite
+// database is copied with VACUUM INTO, while writes go on. The snapshot ends
+// with its checksum. Bolt databases are locked by the kine that serves them,
+// so they are backed up with the snapshot rpc instead.
+func Write(ctx context.Context, config endpoint.Config, w io.Writer) error {
+	// the backend is not started, but the database it opened is watched
+	// until ctx is done
+	ctx, cancel := context.WithCancel(ctx)
+	backend, err := endpoint.NewBackend(ctx, config)
+	if err != nil {
+		cancel()
+		return err
+	}
+	defer func() {
+		cancel()
+		backend.Close()
+	}()
+	return errors.Wrap(backend.Snapshot(ctx, w), "taking snapshot")
+}
+
+// WriteFile writes a snapshot as Write does to the file at path, which is
+// only replaced once the snapshot is complete and synced, so that a failed
+// backup never leaves a partial snapshot behind in place of a good one.
+func WriteFile(ctx context.Context, config endpoint.Config, path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := Write(ctx, config, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("replace %s: %w", path, err)
+	}
+	return nil
+}
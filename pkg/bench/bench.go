@@ -0,0 +1,513 @@
+// Package bench drives kine with a load modeled on the traffic of the
+// kube-apiserver, through the gRPC listener of kine as the apiserver reaches
+// it, and reports the latencies of each kind of request, so that the
+// backends can be compared and regressions tracked.
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/kine/pkg/endpoint"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// The operations that results report. Seed is the creates of the keys
+// before the load starts, and watch the delay from the writes to the events
+// that the watches get of them.
+const (
+	OpSeed   = "seed"
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpList   = "list"
+	OpCount  = "count"
+	OpWatch  = "watch"
+)
+
+// listPageSize is the limit of the pages that lists read, which is that of
+// the lists of the apiserver.
+const listPageSize = 500
+
+// keyPrefix is the prefix of the keys written by benchmarks.
+const keyPrefix = "/bench/"
+
+// Config is the load of a benchmark. Zero settings are those of
+// DefaultConfig. Durations are written as nanoseconds in JSON, as
+// encoding/json writes them.
+type Config struct {
+	// Kine is the config that kine is started with. Its listener defaults to
+	// a free local port. The keys are written under /bench/, which should
+	// not hold any keys before.
+	Kine endpoint.Config `json:"-"`
+	// Keys is the number of keys created before the load starts, spread
+	// evenly across Prefixes prefixes, with values of ValueSize bytes.
+	Keys      int `json:"keys"`
+	Prefixes  int `json:"prefixes"`
+	ValueSize int `json:"valueSize"`
+	// Duration is how long the load runs for, once the keys are created.
+	Duration time.Duration `json:"duration"`
+	// Concurrency is the number of clients that create the keys, update
+	// them and create the keys of bursts. The keys are updated at
+	// UpdateRate updates per second in total.
+	Concurrency int `json:"concurrency"`
+	UpdateRate  int `json:"updateRate"`
+	// Watches is the number of watches, of the prefixes in turn.
+	Watches int `json:"watches"`
+	// ListInterval is the interval at which a prefix is listed in full, in
+	// pages, and counted.
+	ListInterval time.Duration `json:"listInterval"`
+	// BurstSize keys are created every BurstInterval, as when a deployment
+	// is scaled up.
+	BurstSize     int           `json:"burstSize"`
+	BurstInterval time.Duration `json:"burstInterval"`
+}
+
+// DefaultConfig returns the load that benchmarks run unless their config
+// sets another.
+func DefaultConfig() Config {
+	return Config{
+		Keys:          1000,
+		Prefixes:      10,
+		ValueSize:     1024,
+		Duration:      30 * time.Second,
+		Concurrency:   10,
+		UpdateRate:    100,
+		Watches:       10,
+		ListInterval:  5 * time.Second,
+		BurstSize:     100,
+		BurstInterval: 10 * time.Second,
+	}
+}
+
+// withDefaults returns the config with its zero settings replaced by those
+// of DefaultConfig.
+func (c Config) withDefaults() Config {
+	defaults := DefaultConfig()
+	for _, setting := range []struct {
+		value    *int
+		fallback int
+	}{
+		{&c.Keys, defaults.Keys},
+		{&c.Prefixes, defaults.Prefixes},
+		{&c.ValueSize, defaults.ValueSize},
+		{&c.Concurrency, defaults.Concurrency},
+		{&c.UpdateRate, defaults.UpdateRate},
+		{&c.Watches, defaults.Watches},
+		{&c.BurstSize, defaults.BurstSize},
+	} {
+		if *setting.value <= 0 {
+			*setting.value = setting.fallback
+		}
+	}
+	for _, setting := range []struct {
+		value    *time.Duration
+		fallback time.Duration
+	}{
+		{&c.Duration, defaults.Duration},
+		{&c.ListInterval, defaults.ListInterval},
+		{&c.BurstInterval, defaults.BurstInterval},
+	} {
+		if *setting.value <= 0 {
+			*setting.value = setting.fallback
+		}
+	}
+	if c.Kine.Listener == "" {
+		c.Kine.Listener = "http://127.0.0.1:0"
+	}
+	return c
+}
+
+// Result is the result of a benchmark.
+type Result struct {
+	Config Config `json:"config"`
+	// Seconds is how long the load ran for, and SeedSeconds how long the
+	// keys took to create before.
+	Seconds     float64 `json:"seconds"`
+	SeedSeconds float64 `json:"seedSeconds"`
+	// Operations are the results of each operation, by the names of the Op
+	// constants.
+	Operations map[string]*Operation `json:"operations"`
+	// DBSizeBefore and DBSizeAfter are the sizes of the database before the
+	// keys are created and once the load has run.
+	DBSizeBefore int64 `json:"dbSizeBefore"`
+	DBSizeAfter  int64 `json:"dbSizeAfter"`
+}
+
+// Operation is the result of an operation of a benchmark.
+type Operation struct {
+	Count     int64   `json:"count"`
+	Errors    int64   `json:"errors"`
+	PerSecond float64 `json:"perSecond"`
+	// Latency is in milliseconds.
+	Latency Latency `json:"latencyMs"`
+}
+
+// Latency is the distribution of the latencies of an operation, in
+// milliseconds.
+type Latency struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// Run starts kine with the config, drives it with the load of the config
+// and returns the results, once kine is shut down again. Run stops the load
+// early once ctx is done, and returns the results of what ran.
+func Run(ctx context.Context, config Config) (*Result, error) {
+	config = config.withDefaults()
+	kineCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	etcdConfig, err := endpoint.Listen(kineCtx, config.Kine)
+	if err != nil {
+		return nil, errors.Wrap(err, "starting kine")
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		etcdConfig.Shutdown(shutdownCtx)
+	}()
+
+	tlsConfig, err := etcdConfig.TLSConfig.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   etcdConfig.Endpoints,
+		DialTimeout: 5 * time.Second,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to kine")
+	}
+	defer client.Close()
+
+	b := &benchmark{
+		config:    config,
+		client:    client,
+		endpoint:  etcdConfig.Endpoints[0],
+		revisions: make([]int64, config.Keys),
+		ops:       map[string]*recorder{},
+	}
+	for _, op := range []string{OpSeed, OpCreate, OpUpdate, OpList, OpCount, OpWatch} {
+		b.ops[op] = &recorder{}
+	}
+	return b.run(ctx)
+}
+
+// benchmark is a benchmark that runs.
+type benchmark struct {
+	config   Config
+	client   *clientv3.Client
+	endpoint string
+	ops      map[string]*recorder
+	// revisions are the mod revisions of the keys, which each updater keeps
+	// for the keys it updates.
+	revisions []int64
+	bursts    int64
+}
+
+func (b *benchmark) run(ctx context.Context) (*Result, error) {
+	result := &Result{Config: b.config}
+	status, err := b.client.Status(ctx, b.endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading the size of the database")
+	}
+	result.DBSizeBefore = status.DbSize
+
+	start := time.Now()
+	b.parallel(b.config.Keys, func(i int) {
+		b.revisions[i] = b.create(ctx, OpSeed, b.key(i))
+	})
+	result.SeedSeconds = time.Since(start).Seconds()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	resp, err := b.client.Get(ctx, keyPrefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return nil, errors.Wrap(err, "reading the revision")
+	}
+
+	// requests are made with ctx rather than the context of the load, so
+	// that those running once it is done complete
+	loadCtx, cancel := context.WithTimeout(ctx, b.config.Duration)
+	defer cancel()
+	watchCtx, cancelWatches := context.WithCancel(ctx)
+	defer cancelWatches()
+	var watches, load sync.WaitGroup
+	for i := 0; i < b.config.Watches; i++ {
+		watches.Add(1)
+		go func(prefix string) {
+			defer watches.Done()
+			b.watch(watchCtx, prefix, resp.Header.Revision+1)
+		}(b.prefix(i % b.config.Prefixes))
+	}
+	start = time.Now()
+	for i := 0; i < b.config.Concurrency; i++ {
+		load.Add(1)
+		go func(worker int) {
+			defer load.Done()
+			b.update(ctx, loadCtx, worker)
+		}(i)
+	}
+	load.Add(2)
+	go func() {
+		defer load.Done()
+		b.list(ctx, loadCtx)
+	}()
+	go func() {
+		defer load.Done()
+		b.burst(ctx, loadCtx)
+	}()
+	load.Wait()
+	elapsed := time.Since(start)
+	cancelWatches()
+	watches.Wait()
+
+	result.Seconds = elapsed.Seconds()
+	result.Operations = map[string]*Operation{}
+	for name, recorder := range b.ops {
+		seconds := result.Seconds
+		if name == OpSeed {
+			seconds = result.SeedSeconds
+		}
+		result.Operations[name] = recorder.operation(seconds)
+	}
+	if status, err = b.client.Status(ctx, b.endpoint); err != nil {
+		return nil, errors.Wrap(err, "reading the size of the database")
+	}
+	result.DBSizeAfter = status.DbSize
+	return result, nil
+}
+
+func (b *benchmark) prefix(i int) string {
+	return fmt.Sprintf("%s%03d/", keyPrefix, i)
+}
+
+func (b *benchmark) key(i int) string {
+	return fmt.Sprintf("%s%08d", b.prefix(i%b.config.Prefixes), i)
+}
+
+// value returns a value of the configured size, which starts with the time
+// it is written at, so that watches can tell how long their events took.
+func (b *benchmark) value() string {
+	size := b.config.ValueSize
+	if size < 8 {
+		size = 8
+	}
+	value := make([]byte, size)
+	binary.BigEndian.PutUint64(value, uint64(time.Now().UnixNano()))
+	for i := 8; i < size; i++ {
+		value[i] = 'v'
+	}
+	return string(value)
+}
+
+// parallel calls fn for each i below n, split across the clients.
+func (b *benchmark) parallel(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	for worker := 0; worker < b.config.Concurrency; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := worker; i < n; i += b.config.Concurrency {
+				fn(i)
+			}
+		}(worker)
+	}
+	wg.Wait()
+}
+
+// create creates the key as the apiserver does, and returns its revision.
+func (b *benchmark) create(ctx context.Context, op, key string) int64 {
+	start := time.Now()
+	resp, err := b.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, b.value())).
+		Commit()
+	if err == nil && !resp.Succeeded {
+		err = fmt.Errorf("key %s exists", key)
+	}
+	b.ops[op].record(time.Since(start), err)
+	if err != nil {
+		return 0
+	}
+	return resp.Header.Revision
+}
+
+// update updates the keys of the worker in turn at its share of the update
+// rate, as the apiserver does, until loadCtx is done. Updates that lose a
+// race, or follow a failed create, pick up the revision of the key.
+func (b *benchmark) update(ctx, loadCtx context.Context, worker int) {
+	interval := time.Duration(b.config.Concurrency) * time.Second / time.Duration(b.config.UpdateRate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := worker; ; i += b.config.Concurrency {
+		if i >= b.config.Keys {
+			i = worker
+			if i >= b.config.Keys {
+				return
+			}
+		}
+		select {
+		case <-loadCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		key := b.key(i)
+		start := time.Now()
+		resp, err := b.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", b.revisions[i])).
+			Then(clientv3.OpPut(key, b.value())).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		switch {
+		case err != nil:
+		case resp.Succeeded:
+			b.revisions[i] = resp.Header.Revision
+		default:
+			err = fmt.Errorf("key %s was modified", key)
+			if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+				b.revisions[i] = kvs[0].ModRevision
+			}
+		}
+		b.ops[OpUpdate].record(time.Since(start), err)
+	}
+}
+
+// list lists a prefix in pages and counts it at the list interval, as the
+// apiserver does for its lists and its object count metrics, until loadCtx
+// is done.
+func (b *benchmark) list(ctx, loadCtx context.Context) {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker(b.config.ListInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-loadCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		prefix := b.prefix(random.Intn(b.config.Prefixes))
+		end := clientv3.GetPrefixRangeEnd(prefix)
+		start := time.Now()
+		var err error
+		for key := prefix; ; {
+			var resp *clientv3.GetResponse
+			resp, err = b.client.Get(ctx, key, clientv3.WithRange(end), clientv3.WithLimit(listPageSize))
+			if err != nil || !resp.More || len(resp.Kvs) == 0 {
+				break
+			}
+			key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+		}
+		b.ops[OpList].record(time.Since(start), err)
+
+		start = time.Now()
+		_, err = b.client.Get(ctx, prefix, clientv3.WithRange(end), clientv3.WithCountOnly())
+		b.ops[OpCount].record(time.Since(start), err)
+	}
+}
+
+// burst creates a burst of keys across the clients at the burst interval,
+// until loadCtx is done.
+func (b *benchmark) burst(ctx, loadCtx context.Context) {
+	ticker := time.NewTicker(b.config.BurstInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-loadCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		burst := atomic.AddInt64(&b.bursts, 1)
+		b.parallel(b.config.BurstSize, func(i int) {
+			b.create(ctx, OpCreate, fmt.Sprintf("%sburst-%d-%d", b.prefix(i%b.config.Prefixes), burst, i))
+		})
+	}
+}
+
+// watch watches the prefix from the revision until ctx is done, recording
+// the delay of the events of writes.
+func (b *benchmark) watch(ctx context.Context, prefix string, revision int64) {
+	for resp := range b.client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(revision)) {
+		if err := resp.Err(); err != nil {
+			if ctx.Err() == nil {
+				b.ops[OpWatch].record(0, err)
+			}
+			continue
+		}
+		now := time.Now()
+		for _, event := range resp.Events {
+			if event.Type != mvccpb.PUT || len(event.Kv.Value) < 8 {
+				continue
+			}
+			written := time.Unix(0, int64(binary.BigEndian.Uint64(event.Kv.Value)))
+			b.ops[OpWatch].record(now.Sub(written), nil)
+		}
+	}
+}
+
+// recorder records the latencies of an operation.
+type recorder struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int64
+}
+
+func (r *recorder) record(latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errors++
+		return
+	}
+	r.latencies = append(r.latencies, latency)
+}
+
+// operation returns the result of the operation, over the seconds it ran
+// for.
+func (r *recorder) operation(seconds float64) *Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	op := &Operation{
+		Count:  int64(len(r.latencies)),
+		Errors: r.errors,
+	}
+	if seconds > 0 {
+		op.PerSecond = float64(op.Count) / seconds
+	}
+	if len(r.latencies) == 0 {
+		return op
+	}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	percentile := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(r.latencies)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return milliseconds(r.latencies[i])
+	}
+	op.Latency = Latency{
+		P50: percentile(0.5),
+		P90: percentile(0.9),
+		P99: percentile(0.99),
+		Max: milliseconds(r.latencies[len(r.latencies)-1]),
+	}
+	return op
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
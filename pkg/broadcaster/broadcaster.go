@@ -7,8 +7,15 @@ import (
 
 type ConnectFunc func() (chan interface{}, error)
 
+const defaultBufferSize = 100
+
 type Broadcaster struct {
 	sync.Mutex
+	// BufferSize is the number of items buffered for each subscriber. A
+	// subscriber that falls further behind is dropped, by closing its channel,
+	// so that it does not hold up the others. Defaults to 100.
+	BufferSize int
+
 	running bool
 	subs    map[chan interface{}]struct{}
 }
@@ -23,7 +30,11 @@ func (b *Broadcaster) Subscribe(ctx context.Context, connect ConnectFunc) (<-cha
 		}
 	}
 
-	sub := make(chan interface{}, 100)
+	size := b.BufferSize
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	sub := make(chan interface{}, size)
 	if b.subs == nil {
 		b.subs = map[chan interface{}]struct{}{}
 	}
@@ -36,6 +47,19 @@ func (b *Broadcaster) Subscribe(ctx context.Context, connect ConnectFunc) (<-cha
 	return sub, nil
 }
 
+// QueueDepth returns the number of items buffered for all subscribers that
+// they have not received yet.
+func (b *Broadcaster) QueueDepth() int {
+	b.Lock()
+	defer b.Unlock()
+
+	depth := 0
+	for sub := range b.subs {
+		depth += len(sub)
+	}
+	return depth
+}
+
 func (b *Broadcaster) unsub(sub chan interface{}, lock bool) {
 	if lock {
 		b.Lock()
@@ -67,8 +91,9 @@ func (b *Broadcaster) stream(input chan interface{}) {
 			select {
 			case sub <- item:
 			default:
-				// Slow consumer, drop
-				go b.unsub(sub, true)
+				// Slow consumer, drop. This is done right away, so that the
+				// consumer does not get any later items after missing this one.
+				b.unsub(sub, false)
 			}
 		}
 		b.Unlock()
@@ -0,0 +1,293 @@
+// Package bolt is a backend that keeps the log in an embedded bbolt
+// database, for single node use without a database server or cgo.
+package bolt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/broadcaster"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/metrics"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	defaultPath = "./db/state.bolt"
+
+	// openTimeout is how long opening the database waits for another
+	// process to release its lock on the file.
+	openTimeout = 10 * time.Second
+)
+
+// The rows of the log are stored in the revisions bucket under their
+// revision, which the sequence of the bucket hands out. The names bucket
+// holds a bucket for every key with the revisions of its rows, so that the
+// row of a key current at any revision is found without reading the others.
+var (
+	revisionsBucket = []byte("revisions")
+	namesBucket     = []byte("names")
+	leasesBucket    = []byte("leases")
+	metaBucket      = []byte("meta")
+
+	compactRevisionKey = []byte("compactRevision")
+	// trimRevisionsKey holds the generic.TrimRevisions of the prefixes that
+	// are retained for less than the rest of the keyspace, as JSON.
+	trimRevisionsKey = []byte("trimRevisions")
+
+	buckets = [][]byte{revisionsBucket, namesBucket, leasesBucket, metaBucket}
+)
+
+// Log is a log on a bbolt database. Writes are serialized by bbolt, so
+// revisions are handed out in the order their writes are committed, and
+// watches are told of commits in-process rather than polling for them.
+type Log struct {
+	config      generic.Config
+	path        string
+	broadcaster broadcaster.Broadcaster
+	ctx         context.Context
+	notify      chan struct{}
+	// revisionClock tells the revisions that were current as of the
+	// compactions since the compactor started, for the prefixes whose
+	// history is kept for a duration. It is only used by the compactor.
+	revisionClock *generic.RevisionClock
+
+	// dbLock is held for reading while the database is in use, and for
+	// writing while it is replaced by a defragmented copy.
+	dbLock sync.RWMutex
+	db     *bbolt.DB
+
+	// quiesced holds the write transaction that Quiesce holds writes with,
+	// and the timer that resumes them, while writes are quiesced. quiescing
+	// is set while Quiesce waits for the writes in flight.
+	quiesceLock sync.Mutex
+	quiescing   bool
+	quiesced    *quiesced
+}
+
+// New returns a backend on the bbolt database at the path of the data source
+// name, which is created if it does not exist yet.
+func New(ctx context.Context, dataSourceName string, config generic.Config) (server.Backend, error) {
+	log, err := NewLog(dataSourceName, config)
+	if err != nil {
+		return nil, err
+	}
+	return logstructured.New(log), nil
+}
+
+// NewLog opens the log on the bbolt database at the path of the data source
+// name. It accepts the poll-batch-size parameter, which sets the number of
+// events read at once for watches.
+func NewLog(dataSourceName string, config generic.Config) (*Log, error) {
+	path, err := config.ParseDSN(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if i := strings.Index(path, "?"); i >= 0 {
+		return nil, fmt.Errorf("unknown bolt parameters %q", path[i+1:])
+	}
+	if path == "" {
+		path = defaultPath
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		config:        config,
+		path:          path,
+		notify:        make(chan struct{}, 1),
+		revisionClock: generic.NewRevisionClock(config.GetPrefixRetention()),
+		db:            db,
+	}
+	l.broadcaster.BufferSize = config.GetWatchBufferSize()
+	return l, nil
+}
+
+// GetLogger returns the logger of the config of the log.
+func (l *Log) GetLogger() logging.Logger {
+	return l.config.GetLogger()
+}
+
+func open(path string) (*bbolt.DB, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (l *Log) Start(ctx context.Context) error {
+	l.ctx = ctx
+	if registerer := l.config.GetMetricsRegisterer(); registerer != nil {
+		metrics.Register(l.config.GetLogger(), registerer, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "watch",
+			Name:      "queue_depth",
+			Help:      "Number of event batches queued for watches and not yet read by them.",
+		}, func() float64 {
+			return float64(l.broadcaster.QueueDepth())
+		}))
+	}
+	if l.config.GetCompactInterval() > 0 {
+		go l.compactor()
+	}
+	return nil
+}
+
+// Close closes the database. The log must have been stopped by canceling the
+// context it was started with.
+func (l *Log) Close() error {
+	l.dbLock.Lock()
+	defer l.dbLock.Unlock()
+	return l.db.Close()
+}
+
+type txKey struct{}
+
+// view calls fn with the transaction started by Txn if the context carries
+// one, and with a read-only transaction otherwise.
+func (l *Log) view(ctx context.Context, fn func(tx *bbolt.Tx) error) error {
+	if tx, ok := ctx.Value(txKey{}).(*bbolt.Tx); ok {
+		return fn(tx)
+	}
+
+	l.dbLock.RLock()
+	defer l.dbLock.RUnlock()
+	return l.db.View(fn)
+}
+
+// update is like view, but calls fn with a read-write transaction, and tells
+// the watches of what fn wrote once it is committed.
+func (l *Log) update(ctx context.Context, fn func(tx *bbolt.Tx) error) error {
+	if tx, ok := ctx.Value(txKey{}).(*bbolt.Tx); ok {
+		return fn(tx)
+	}
+
+	if err := l.updateDB(fn); err != nil {
+		return err
+	}
+	l.notifyWatches()
+	return nil
+}
+
+func (l *Log) updateDB(fn func(tx *bbolt.Tx) error) error {
+	l.dbLock.RLock()
+	defer l.dbLock.RUnlock()
+	return l.db.Update(fn)
+}
+
+// Txn calls fn with a context in which all reads and writes happen in a
+// single read-write transaction, which is committed if fn returns nil and
+// rolled back otherwise. Calls to Txn with a context that already carries a
+// transaction reuse that transaction. The transaction holds the only write
+// lock of the database, so fn must not wait on writes made elsewhere.
+func (l *Log) Txn(ctx context.Context, fn func(ctx context.Context) error) error {
+	return l.update(ctx, func(tx *bbolt.Tx) error {
+		return fn(context.WithValue(ctx, txKey{}, tx))
+	})
+}
+
+// notifyWatches wakes the watches up to read the events of a commit. Commits
+// made while they are still reading are picked up on their next read.
+func (l *Log) notifyWatches() {
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (l *Log) CurrentRevision(ctx context.Context) (rev int64, err error) {
+	err = l.view(ctx, func(tx *bbolt.Tx) error {
+		rev = currentRevision(tx)
+		return nil
+	})
+	return rev, err
+}
+
+func (l *Log) CompactRevision(ctx context.Context) (compact int64, err error) {
+	err = l.view(ctx, func(tx *bbolt.Tx) error {
+		compact = compactRevision(tx)
+		return nil
+	})
+	return compact, err
+}
+
+// RaiseRevision raises the current revision to the given one if it is lower,
+// by raising the sequence of the revisions bucket, and compacts the revisions
+// up to it.
+func (l *Log) RaiseRevision(ctx context.Context, revision int64) (current int64, err error) {
+	err = l.update(ctx, func(tx *bbolt.Tx) error {
+		current = currentRevision(tx)
+		if current >= revision {
+			return nil
+		}
+		current = revision
+		if err := tx.Bucket(revisionsBucket).SetSequence(uint64(revision)); err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(compactRevisionKey, revKey(revision))
+	})
+	return current, err
+}
+
+// currentRevision returns the revision of the last row written, which is
+// kept as the sequence of the revisions bucket even once the row is
+// compacted away.
+func currentRevision(tx *bbolt.Tx) int64 {
+	return int64(tx.Bucket(revisionsBucket).Sequence())
+}
+
+func compactRevision(tx *bbolt.Tx) int64 {
+	v := tx.Bucket(metaBucket).Get(compactRevisionKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return keyRev(v)
+}
+
+func (l *Log) DbSize(ctx context.Context) (size int64, err error) {
+	err = l.view(ctx, func(tx *bbolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return size, err
+}
+
+// DbSizeInUse returns the size of the database without the pages that are
+// free for reuse.
+func (l *Log) DbSizeInUse(ctx context.Context) (size int64, err error) {
+	err = l.view(ctx, func(tx *bbolt.Tx) error {
+		stats := tx.DB().Stats()
+		size = tx.Size() - int64(stats.FreePageN)*int64(tx.DB().Info().PageSize)
+		return nil
+	})
+	return size, err
+}
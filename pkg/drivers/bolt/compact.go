@@ -0,0 +1,180 @@
+package bolt
+
+import (
+	"context"
+	"time"
+
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+// compactBatchSize is the number of revisions compacted per transaction, so
+// that writes are not held up for long by large compactions.
+const compactBatchSize = 1000
+
+func (l *Log) compactor() {
+	t := time.NewTicker(l.config.GetCompactInterval())
+	defer t.Stop()
+	nextEnd, _ := l.CurrentRevision(l.ctx)
+	l.revisionClock.Record(time.Now(), nextEnd)
+
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		currentRev, err := l.CurrentRevision(l.ctx)
+		if err != nil {
+			l.config.GetLogger().Errorf("failed to get current revision: %v", err)
+			continue
+		}
+
+		// compact up to the revision that was current on the previous run,
+		// leaving the configured number of revisions, and then trim the
+		// prefixes that are retained for less
+		end := nextEnd - l.config.GetCompactMinRetain()
+		nextEnd = currentRev
+
+		_, err = l.Compact(l.ctx, end)
+		switch {
+		case err == nil:
+			if l.config.GetCompactGC() {
+				if _, err := l.GC(l.ctx, false); err != nil {
+					l.config.GetLogger().Errorf("failed to collect garbage: %v", err)
+				}
+			}
+		case err != server.ErrCompacted:
+			l.config.GetLogger().Errorf("failed to compact to revision %d: %v", end, err)
+			continue
+		}
+		if err := l.trimPrefixes(currentRev); err != nil {
+			l.config.GetLogger().Errorf("failed to trim prefixes: %v", err)
+		}
+	}
+}
+
+// Compact removes all rows that were superseded or deleted at or before the
+// given revision, and then records it as the compact revision. It returns the
+// number of rows removed, or server.ErrCompacted or server.ErrFutureRev if the
+// revision is already compacted or has not been written yet.
+func (l *Log) Compact(ctx context.Context, revision int64) (int64, error) {
+	var compactRev, currentRev int64
+	err := l.view(ctx, func(tx *bbolt.Tx) error {
+		compactRev = compactRevision(tx)
+		currentRev = currentRevision(tx)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if revision <= compactRev {
+		return 0, server.ErrCompacted
+	}
+	if revision > currentRev {
+		return 0, server.ErrFutureRev
+	}
+
+	start := time.Now()
+	var deleted int64
+	for batchStart := compactRev; batchStart < revision; batchStart += compactBatchSize {
+		batchEnd := batchStart + compactBatchSize
+		if batchEnd > revision {
+			batchEnd = revision
+		}
+		err := l.updateDB(func(tx *bbolt.Tx) error {
+			n, err := compact(tx, "", batchStart, batchEnd)
+			deleted += n
+			return err
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	// only record the new compact revision once all rows up to it are gone, so
+	// that an interrupted compaction is redone from the previous revision
+	err = l.updateDB(func(tx *bbolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(compactRevisionKey, revKey(revision))
+	})
+	if err != nil {
+		return deleted, err
+	}
+
+	l.config.GetLogger().Infof("COMPACT revision %d => %d, deleted=%d, duration=%v", compactRev, revision, deleted, time.Since(start))
+	return deleted, nil
+}
+
+// compact deletes the rows that the rows of the keys with the prefix after
+// start and up to end superseded, as well as the delete rows among them, and
+// returns the number of rows deleted. The empty prefix compacts all keys.
+// Create rows do not supersede the rows of their previous revision, which is
+// a delete row of the key or no row at all.
+func compact(tx *bbolt.Tx, prefix string, start, end int64) (int64, error) {
+	var superseded []int64
+	nameStart, nameEnd := prefixRange(prefix)
+	c := tx.Bucket(revisionsBucket).Cursor()
+	for k, v := c.Seek(revKey(start + 1)); k != nil && keyRev(k) <= end; k, v = c.Next() {
+		r, err := decodeRow(keyRev(k), v)
+		if err != nil {
+			return 0, err
+		}
+		if !inRange(r.name, nameStart, nameEnd) {
+			continue
+		}
+		if !r.created && r.prevRevision != 0 {
+			superseded = append(superseded, r.prevRevision)
+		}
+		if r.deleted {
+			superseded = append(superseded, r.id)
+		}
+	}
+
+	var deleted int64
+	for _, rev := range superseded {
+		ok, err := deleteRow(tx, rev)
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// deleteRow deletes the row of the revision along with its entry in the
+// names bucket, and the bucket of its key once it holds no other rows. It
+// reports whether there was a row to delete.
+func deleteRow(tx *bbolt.Tx, rev int64) (bool, error) {
+	revisions := tx.Bucket(revisionsBucket)
+	key := revKey(rev)
+	v := revisions.Get(key)
+	if v == nil {
+		return false, nil
+	}
+	r, err := decodeRow(rev, v)
+	if err != nil {
+		return false, err
+	}
+	// the name is copied, as it is read from the row that is deleted
+	name := copyBytes(r.name)
+	if err := revisions.Delete(key); err != nil {
+		return false, err
+	}
+
+	names := tx.Bucket(namesBucket)
+	keyRevisions := names.Bucket(name)
+	if keyRevisions == nil {
+		return true, nil
+	}
+	if err := keyRevisions.Delete(key); err != nil {
+		return true, err
+	}
+	if k, _ := keyRevisions.Cursor().First(); k == nil {
+		return true, names.DeleteBucket(name)
+	}
+	return true, nil
+}
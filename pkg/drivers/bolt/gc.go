@@ -0,0 +1,135 @@
+package bolt
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+// gcBatchSize is the number of rows that GC removes per transaction, so that
+// writes are not held up for long by large collections.
+const gcBatchSize = 1000
+
+// GC lists the rows at or below the compact revision that no read can return,
+// as LogStructured.GC describes and the SQL drivers find them, and unless
+// dryRun is set deletes them in transactions of gcBatchSize rows.
+func (l *Log) GC(ctx context.Context, dryRun bool) ([]server.Garbage, error) {
+	var (
+		garbage []server.Garbage
+		revs    []int64
+	)
+	err := l.view(ctx, func(tx *bbolt.Tx) error {
+		garbage = []server.Garbage{
+			{Kind: server.GarbageTombstone},
+			{Kind: server.GarbageSuperseded},
+			{Kind: server.GarbageDeletedKey},
+		}
+		revs = nil
+		compact := compactRevision(tx)
+		names := tx.Bucket(namesBucket)
+		return names.ForEach(func(name, _ []byte) error {
+			keyRevisions := names.Bucket(name)
+			if keyRevisions == nil {
+				return nil
+			}
+			found, err := gcKey(tx, keyRevisions, compact)
+			for _, r := range found {
+				for i := range garbage {
+					if garbage[i].Kind == r.kind {
+						garbage[i].Rows++
+						garbage[i].Bytes += r.size
+					}
+				}
+				revs = append(revs, r.id)
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun || len(revs) == 0 {
+		return garbage, nil
+	}
+	for start := 0; start < len(revs); start += gcBatchSize {
+		end := start + gcBatchSize
+		if end > len(revs) {
+			end = len(revs)
+		}
+		err := l.updateDB(func(tx *bbolt.Tx) error {
+			for _, rev := range revs[start:end] {
+				if _, err := deleteRow(tx, rev); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete garbage: %w", err)
+		}
+	}
+	for i := range garbage {
+		garbage[i].Removed = garbage[i].Rows > 0
+	}
+	l.config.GetLogger().Infof("GC deleted %d rows", len(revs))
+	return garbage, nil
+}
+
+// gcRow is a row that GC removes.
+type gcRow struct {
+	id   int64
+	kind server.GarbageKind
+	size int64
+}
+
+// gcKey returns the rows of a key at or below the compact revision that no
+// read can return: its deletes, and the rows before its last one, or before
+// a delete of it. Rows that a row above the compact revision follows are left
+// alone, as the SQL drivers leave them.
+func gcKey(tx *bbolt.Tx, keyRevisions *bbolt.Bucket, compact int64) ([]gcRow, error) {
+	rows := tx.Bucket(revisionsBucket)
+	var (
+		below    []*row
+		followed = map[int64]bool{}
+	)
+	err := keyRevisions.ForEach(func(k, _ []byte) error {
+		r, err := decodeRow(keyRev(k), rows.Get(k))
+		if err != nil {
+			return fmt.Errorf("revision %d: %w", keyRev(k), err)
+		}
+		if r.id <= compact {
+			below = append(below, r)
+		} else if !r.created {
+			followed[r.prevRevision] = true
+		}
+		return nil
+	})
+	if err != nil || len(below) == 0 {
+		return nil, err
+	}
+
+	last := below[len(below)-1]
+	var found []gcRow
+	for _, r := range below {
+		kind := server.GarbageSuperseded
+		switch {
+		case followed[r.id]:
+			continue
+		case r.deleted:
+			kind = server.GarbageTombstone
+		case last.deleted:
+			kind = server.GarbageDeletedKey
+		case r == last:
+			continue
+		}
+		found = append(found, gcRow{
+			id:   r.id,
+			kind: kind,
+			size: int64(len(r.name) + len(r.value) + len(r.oldValue)),
+		})
+	}
+	return found, nil
+}
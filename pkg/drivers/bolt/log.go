@@ -0,0 +1,486 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+// prefixRange returns the range of the names of the keys with the given
+// prefix, as the SQL drivers do. The range of the empty prefix is that of all
+// keys, and has no end.
+func prefixRange(prefix string) (start, end []byte) {
+	if prefix == "" {
+		return nil, nil
+	}
+	if strings.HasSuffix(prefix, "/") {
+		return []byte(prefix), []byte(prefix[0:len(prefix)-1] + "0")
+	}
+	return []byte(prefix), []byte(prefix + "\x00")
+}
+
+// isRange reports whether the prefix covers a range of keys rather than a
+// single one, as the empty prefix and those that end with a slash do.
+func isRange(prefix string) bool {
+	return prefix == "" || strings.HasSuffix(prefix, "/")
+}
+
+// inRange reports whether the name lies within a range from prefixRange.
+func inRange(name, start, end []byte) bool {
+	return bytes.Compare(name, start) >= 0 && (end == nil || bytes.Compare(name, end) < 0)
+}
+
+// listStartKey returns the key after which a list of the given prefix
+// continues, or "" if it starts at the beginning of the prefix.
+func listStartKey(prefix, startKey string) string {
+	if !isRange(prefix) || prefix == startKey {
+		return ""
+	}
+	return startKey
+}
+
+// rowAt returns the row of the key in the names bucket that was current at
+// the revision, or the latest row if the revision is zero. It returns nil if
+// the key had no row yet.
+func rowAt(tx *bbolt.Tx, keyRevisions *bbolt.Bucket, revision int64) (*row, error) {
+	c := keyRevisions.Cursor()
+	var k []byte
+	if revision == 0 {
+		k, _ = c.Last()
+	} else if k, _ = c.Seek(revKey(revision + 1)); k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	if k == nil {
+		return nil, nil
+	}
+
+	v := tx.Bucket(revisionsBucket).Get(k)
+	if v == nil {
+		return nil, errCorruptRow
+	}
+	return decodeRow(keyRev(k), v)
+}
+
+// forEachKey calls fn with the rows of the keys with the given prefix that
+// were current at the revision, or of all keys if the prefix is empty, in
+// the order of their names, until fn returns false. Only the keys after the
+// start key are passed if it is set, and deleted keys only if includeDeleted
+// is set.
+func forEachKey(tx *bbolt.Tx, prefix, startKey string, revision int64, includeDeleted bool, filter server.RevisionFilter, fn func(r *row) bool) error {
+	start, end := prefixRange(prefix)
+	if startKey != "" {
+		start = []byte(startKey)
+	}
+
+	names := tx.Bucket(namesBucket)
+	c := names.Cursor()
+	for k, _ := c.Seek(start); k != nil && inRange(k, start, end); k, _ = c.Next() {
+		if startKey != "" && bytes.Equal(k, start) {
+			continue
+		}
+		keyRevisions := names.Bucket(k)
+		if keyRevisions == nil {
+			continue
+		}
+		r, err := rowAt(tx, keyRevisions, revision)
+		if err != nil {
+			return err
+		}
+		if r == nil || (r.deleted && !includeDeleted) || !r.matches(filter) {
+			continue
+		}
+		if !fn(r) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *Log) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted, keysOnly bool, filter server.RevisionFilter) (rev int64, events []*server.Event, err error) {
+	startKey = listStartKey(prefix, startKey)
+	err = l.view(ctx, func(tx *bbolt.Tx) error {
+		rev = currentRevision(tx)
+		if startKey != "" && revision == 0 {
+			// a continued list is always read at a revision, so that the
+			// start key can be compared against the keys of that revision
+			revision = rev
+		}
+
+		// a list at a revision that was compacted away returns the compact
+		// revision along with the error
+		compact, err := trimmedCompactRevision(tx, prefix, compactRevision(tx))
+		if err != nil {
+			return err
+		}
+		if revision > 0 && revision < compact {
+			rev = compact
+			return server.ErrCompacted
+		}
+		if revision > rev {
+			return server.ErrFutureRev
+		}
+
+		return forEachKey(tx, prefix, startKey, revision, includeDeleted, filter, func(r *row) bool {
+			events = append(events, r.event(keysOnly, false))
+			return limit <= 0 || int64(len(events)) < limit
+		})
+	})
+	if err != nil {
+		return rev, nil, err
+	}
+	return rev, events, nil
+}
+
+func (l *Log) Count(ctx context.Context, prefix, startKey string, revision int64, filter server.RevisionFilter) (rev, count int64, err error) {
+	startKey = listStartKey(prefix, startKey)
+	err = l.view(ctx, func(tx *bbolt.Tx) error {
+		rev = currentRevision(tx)
+		if startKey != "" && revision == 0 {
+			revision = rev
+		}
+		return forEachKey(tx, prefix, startKey, revision, false, filter, func(*row) bool {
+			count++
+			return true
+		})
+	})
+	return rev, count, err
+}
+
+// after returns up to limit rows of the keys with the given prefix written
+// after the revision, or of all keys if the prefix is empty, along with the
+// compact and current revisions. The old values are only read if prevKV is
+// set.
+func after(tx *bbolt.Tx, prefix string, revision, limit int64, prevKV bool) (compact, rev int64, events []*server.Event, err error) {
+	start, end := prefixRange(prefix)
+	c := tx.Bucket(revisionsBucket).Cursor()
+	for k, v := c.Seek(revKey(revision + 1)); k != nil; k, v = c.Next() {
+		r, err := decodeRow(keyRev(k), v)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if !inRange(r.name, start, end) {
+			continue
+		}
+		events = append(events, r.event(false, prevKV))
+		if limit > 0 && int64(len(events)) >= limit {
+			break
+		}
+	}
+	compact, err = trimmedCompactRevision(tx, prefix, compactRevision(tx))
+	return compact, currentRevision(tx), events, err
+}
+
+// After returns the events of the keys with the given prefix after the
+// revision. Their previous values are only read for watches that want them.
+func (l *Log) After(ctx context.Context, prefix string, revision, limit int64) (rev int64, events []*server.Event, err error) {
+	err = l.view(ctx, func(tx *bbolt.Tx) error {
+		var compact int64
+		compact, rev, events, err = after(tx, prefix, revision, limit, server.IsPrevKVWatch(ctx))
+		if err != nil {
+			return err
+		}
+		if revision > 0 && revision < compact {
+			rev = compact
+			return server.ErrCompacted
+		}
+		return nil
+	})
+	if err != nil {
+		return rev, nil, err
+	}
+	return rev, events, nil
+}
+
+// AfterBatches is like After, but reads the events in batches of the poll
+// batch size, each in a transaction of its own, and passes each batch to fn
+// once it is read. It returns the current revision once all events are
+// passed on, or the compact revision along with server.ErrCompacted if the
+// events after a batch were compacted before they were read.
+func (l *Log) AfterBatches(ctx context.Context, prefix string, revision int64, fn func(events []*server.Event) error) (int64, error) {
+	batchSize := l.config.GetPollBatchSize()
+	start := revision
+	for {
+		var (
+			compact, rev int64
+			events       []*server.Event
+		)
+		err := l.view(ctx, func(tx *bbolt.Tx) (err error) {
+			compact, rev, events, err = after(tx, prefix, start, batchSize, server.IsPrevKVWatch(ctx))
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		if start > 0 && start < compact {
+			return compact, server.ErrCompacted
+		}
+
+		if len(events) > 0 {
+			if err := fn(events); err != nil {
+				return 0, err
+			}
+		}
+		if int64(len(events)) < batchSize {
+			return rev, nil
+		}
+		start = events[len(events)-1].KV.ModRevision
+	}
+}
+
+// Version returns the number of rows of the key between its creation and
+// the given revision. As the count is taken from the rows still stored, it
+// restarts at 1 once older revisions of the key are compacted.
+func (l *Log) Version(ctx context.Context, key string, createRevision, modRevision int64) (version int64, err error) {
+	err = l.view(ctx, func(tx *bbolt.Tx) error {
+		version = countVersion(tx, key, createRevision, modRevision)
+		return nil
+	})
+	return version, err
+}
+
+// Versions sets the version of each key value at its revision, as Version
+// counts it, reading all of them in a single transaction.
+func (l *Log) Versions(ctx context.Context, kvs []*server.KeyValue) error {
+	return l.view(ctx, func(tx *bbolt.Tx) error {
+		for _, kv := range kvs {
+			kv.Version = countVersion(tx, kv.Key, kv.CreateRevision, kv.ModRevision)
+		}
+		return nil
+	})
+}
+
+// countVersion counts the rows of the key between the revisions.
+func countVersion(tx *bbolt.Tx, key string, createRevision, modRevision int64) (version int64) {
+	keyRevisions := tx.Bucket(namesBucket).Bucket([]byte(key))
+	if keyRevisions == nil {
+		return 0
+	}
+	c := keyRevisions.Cursor()
+	for k, _ := c.Seek(revKey(createRevision)); k != nil && keyRev(k) <= modRevision; k, _ = c.Next() {
+		version++
+	}
+	return version
+}
+
+// History returns the current and compact revisions, and the rows of the key
+// that are still stored, or only its row at the revision if it is not zero.
+func (l *Log) History(ctx context.Context, key string, revision int64, values bool) (rev, compact int64, revisions []*server.KeyRevision, err error) {
+	err = l.view(ctx, func(tx *bbolt.Tx) error {
+		rev, compact = currentRevision(tx), compactRevision(tx)
+		keyRevisions := tx.Bucket(namesBucket).Bucket([]byte(key))
+		if keyRevisions == nil {
+			return nil
+		}
+		rows := tx.Bucket(revisionsBucket)
+		return keyRevisions.ForEach(func(k, _ []byte) error {
+			if revision != 0 && keyRev(k) != revision {
+				return nil
+			}
+			r, err := decodeRow(keyRev(k), rows.Get(k))
+			if err != nil {
+				return err
+			}
+			kr := &server.KeyRevision{
+				Revision:       r.id,
+				CreateRevision: r.currentCreateRevision(),
+				PrevRevision:   r.prevRevision,
+				Create:         r.created,
+				Delete:         r.deleted,
+				Lease:          r.lease,
+				ValueSize:      int64(len(r.value)),
+			}
+			if values {
+				kr.Value = copyBytes(r.value)
+			}
+			revisions = append(revisions, kr)
+			return nil
+		})
+	})
+	return rev, compact, revisions, err
+}
+
+// Append writes the event as the next row of the log. It fails with
+// server.ErrKeyExists if the event does not follow the current row of its
+// key: creates need the key to be missing or deleted, and other events need
+// the current row to be the previous revision of the event.
+func (l *Log) Append(ctx context.Context, event *server.Event) (rev int64, err error) {
+	r := &row{
+		created: event.Create,
+		deleted: event.Delete,
+	}
+	if event.KV != nil {
+		r.name = []byte(event.KV.Key)
+		r.createRevision = event.KV.CreateRevision
+		r.lease = event.KV.Lease
+		r.value = event.KV.Value
+	}
+	if event.PrevKV != nil {
+		r.prevRevision = event.PrevKV.ModRevision
+		r.oldValue = event.PrevKV.Value
+	}
+
+	err = l.update(ctx, func(tx *bbolt.Tx) (err error) {
+		rev, err = insert(tx, r)
+		return err
+	})
+	return rev, err
+}
+
+// insert writes the row under the next revision, and returns the revision.
+func insert(tx *bbolt.Tx, r *row) (int64, error) {
+	names := tx.Bucket(namesBucket)
+	var current *row
+	if keyRevisions := names.Bucket(r.name); keyRevisions != nil {
+		var err error
+		if current, err = rowAt(tx, keyRevisions, 0); err != nil {
+			return 0, err
+		}
+	}
+	if r.created && current != nil && !current.deleted {
+		return 0, server.ErrKeyExists
+	}
+	if !r.created && (current == nil || current.id != r.prevRevision) {
+		return 0, server.ErrKeyExists
+	}
+
+	revisions := tx.Bucket(revisionsBucket)
+	seq, err := revisions.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	r.id = int64(seq)
+	key := revKey(r.id)
+	if err := revisions.Put(key, r.encode()); err != nil {
+		return 0, err
+	}
+
+	keyRevisions, err := names.CreateBucketIfNotExists(r.name)
+	if err != nil {
+		return 0, err
+	}
+	if err := keyRevisions.Put(key, nil); err != nil {
+		return 0, err
+	}
+	return r.id, nil
+}
+
+// LeaseKeys returns the names of all current keys attached to the given lease.
+func (l *Log) LeaseKeys(ctx context.Context, lease int64) (keys []string, err error) {
+	err = l.view(ctx, func(tx *bbolt.Tx) error {
+		return forEachKey(tx, "", "", 0, false, server.RevisionFilter{}, func(r *row) bool {
+			if r.lease == lease {
+				keys = append(keys, string(r.name))
+			}
+			return true
+		})
+	})
+	return keys, err
+}
+
+// RevokeLease deletes all current keys attached to the given lease in a
+// single transaction, returning the number of keys deleted.
+func (l *Log) RevokeLease(ctx context.Context, lease int64) (deleted int64, err error) {
+	err = l.update(ctx, func(tx *bbolt.Tx) error {
+		deleted = 0
+		var rows []*row
+		err := forEachKey(tx, "", "", 0, false, server.RevisionFilter{}, func(r *row) bool {
+			if r.lease == lease {
+				rows = append(rows, r)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, r := range rows {
+			_, err := insert(tx, &row{
+				name:           r.name,
+				deleted:        true,
+				createRevision: r.currentCreateRevision(),
+				prevRevision:   r.id,
+				lease:          r.lease,
+				value:          r.value,
+				oldValue:       r.value,
+			})
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+func (l *Log) Leases(ctx context.Context) (leases []*server.Lease, err error) {
+	err = l.view(ctx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(leasesBucket).ForEach(func(k, v []byte) error {
+			ttl, grantedAt, keepAlive, err := decodeLease(v)
+			if err != nil {
+				return err
+			}
+			leases = append(leases, &server.Lease{
+				ID:            keyRev(k),
+				TTL:           ttl,
+				GrantedAt:     time.Unix(grantedAt, 0),
+				LastKeepAlive: time.Unix(keepAlive, 0),
+			})
+			return nil
+		})
+	})
+	return leases, err
+}
+
+func (l *Log) CreateLease(ctx context.Context, lease *server.Lease) error {
+	return l.updateLeases(ctx, func(leases *bbolt.Bucket) error {
+		return leases.Put(revKey(lease.ID), encodeLease(&server.Lease{
+			TTL:           lease.TTL,
+			GrantedAt:     lease.GrantedAt,
+			LastKeepAlive: lease.GrantedAt,
+		}))
+	})
+}
+
+func (l *Log) KeepAliveLease(ctx context.Context, id int64, at time.Time) error {
+	return l.updateLeases(ctx, func(leases *bbolt.Bucket) error {
+		v := leases.Get(revKey(id))
+		if v == nil {
+			return nil
+		}
+		ttl, grantedAt, _, err := decodeLease(v)
+		if err != nil {
+			return err
+		}
+		return leases.Put(revKey(id), encodeLease(&server.Lease{
+			TTL:           ttl,
+			GrantedAt:     time.Unix(grantedAt, 0),
+			LastKeepAlive: at,
+		}))
+	})
+}
+
+func (l *Log) DeleteLease(ctx context.Context, id int64) error {
+	return l.updateLeases(ctx, func(leases *bbolt.Bucket) error {
+		return leases.Delete(revKey(id))
+	})
+}
+
+// updateLeases calls fn with the leases bucket in a read-write transaction.
+// Leases are not part of the log, so watches are not told of their writes.
+func (l *Log) updateLeases(ctx context.Context, fn func(leases *bbolt.Bucket) error) error {
+	update := func(tx *bbolt.Tx) error {
+		return fn(tx.Bucket(leasesBucket))
+	}
+	if tx, ok := ctx.Value(txKey{}).(*bbolt.Tx); ok {
+		return update(tx)
+	}
+	return l.updateDB(update)
+}
@@ -0,0 +1,78 @@
+package bolt
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+// PrefixStats groups the rows of each key by the prefix of the first two
+// segments of its name, as the SQL drivers group them.
+func (l *Log) PrefixStats(ctx context.Context) ([]server.PrefixStat, error) {
+	var stats []server.PrefixStat
+	err := l.view(ctx, func(tx *bbolt.Tx) error {
+		byPrefix := map[string]*server.PrefixStat{}
+		rows := tx.Bucket(revisionsBucket)
+		names := tx.Bucket(namesBucket)
+		err := names.ForEach(func(name, _ []byte) error {
+			keyRevisions := names.Bucket(name)
+			if keyRevisions == nil {
+				return nil
+			}
+			prefix := namePrefix(string(name))
+			stat, ok := byPrefix[prefix]
+			if !ok {
+				stat = &server.PrefixStat{Prefix: prefix}
+				byPrefix[prefix] = stat
+			}
+			var last *row
+			err := keyRevisions.ForEach(func(k, _ []byte) error {
+				r, err := decodeRow(keyRev(k), rows.Get(k))
+				if err != nil {
+					return fmt.Errorf("revision %d: %w", keyRev(k), err)
+				}
+				stat.Rows++
+				stat.RowBytes += int64(len(r.name) + len(r.value) + len(r.oldValue))
+				last = r
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if last != nil && !last.deleted {
+				stat.Keys++
+				stat.Bytes += int64(len(last.value))
+			}
+			return nil
+		})
+		for _, stat := range byPrefix {
+			stats = append(stats, *stat)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Prefix < stats[j].Prefix
+	})
+	return stats, nil
+}
+
+// namePrefix returns the name up to and including its third slash, or the
+// empty string if it has fewer.
+func namePrefix(name string) string {
+	end := 0
+	for i := 0; i < 3; i++ {
+		slash := strings.Index(name[end:], "/")
+		if slash < 0 {
+			return ""
+		}
+		end += slash + 1
+	}
+	return name[:end]
+}
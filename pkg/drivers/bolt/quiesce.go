@@ -0,0 +1,120 @@
+package bolt
+
+import (
+	"context"
+	"time"
+
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+// quiesced is the state of writes held by Quiesce.
+type quiesced struct {
+	tx    *bbolt.Tx
+	timer *time.Timer
+	at    time.Time
+}
+
+// Quiesce starts a write transaction, once those in flight have committed,
+// which holds all other writes until Resume is called or the quiesce timeout
+// has passed, while reads and watches are served from read-only transactions
+// as usual. bbolt syncs the file as each write commits, so the file is whole
+// as it is once quiesced. The wait for the writes in flight ends with ctx,
+// and another Quiesce or a Resume meanwhile fails rather than waiting on it.
+func (l *Log) Quiesce(ctx context.Context) error {
+	l.quiesceLock.Lock()
+	if l.quiescing || l.quiesced != nil {
+		l.quiesceLock.Unlock()
+		return server.ErrQuiesced
+	}
+	l.quiescing = true
+	l.quiesceLock.Unlock()
+	defer func() {
+		l.quiesceLock.Lock()
+		l.quiescing = false
+		l.quiesceLock.Unlock()
+	}()
+
+	start := time.Now()
+	tx, err := l.beginWrite(ctx)
+	if err != nil {
+		return err
+	}
+
+	l.quiesceLock.Lock()
+	defer l.quiesceLock.Unlock()
+	timeout := l.config.GetQuiesceTimeout()
+	q := &quiesced{tx: tx, at: time.Now()}
+	q.timer = time.AfterFunc(timeout, func() {
+		l.quiesceLock.Lock()
+		defer l.quiesceLock.Unlock()
+		// the writes were resumed, and maybe quiesced again, before the
+		// timer could stop
+		if l.quiesced != q {
+			return
+		}
+		l.config.GetLogger().Warnf("Resuming writes that were quiesced for longer than %s", timeout)
+		l.resume()
+	})
+	l.quiesced = q
+	l.config.GetLogger().Infof("Quiesced writes in %s, for up to %s", time.Since(start), timeout)
+	return nil
+}
+
+// beginWrite starts a write transaction, with the database lock held for
+// reading until resume, or returns the error of ctx if it is done first. A
+// transaction started after that is rolled back right away.
+func (l *Log) beginWrite(ctx context.Context) (*bbolt.Tx, error) {
+	type begun struct {
+		tx  *bbolt.Tx
+		err error
+	}
+	result := make(chan begun)
+	abandoned := make(chan struct{})
+	go func() {
+		l.dbLock.RLock()
+		tx, err := l.db.Begin(true)
+		if err != nil {
+			l.dbLock.RUnlock()
+		}
+		select {
+		case result <- begun{tx: tx, err: err}:
+		case <-abandoned:
+			if err == nil {
+				tx.Rollback()
+				l.dbLock.RUnlock()
+			}
+		}
+	}()
+
+	select {
+	case b := <-result:
+		return b.tx, b.err
+	case <-ctx.Done():
+		close(abandoned)
+		return nil, ctx.Err()
+	}
+}
+
+// Resume releases the writes held by Quiesce.
+func (l *Log) Resume() error {
+	l.quiesceLock.Lock()
+	defer l.quiesceLock.Unlock()
+	if l.quiesced == nil {
+		return server.ErrNotQuiesced
+	}
+	l.quiesced.timer.Stop()
+	l.resume()
+	return nil
+}
+
+// resume rolls back the transaction of Quiesce, with the quiesce lock held.
+func (l *Log) resume() {
+	q := l.quiesced
+	l.quiesced = nil
+	if err := q.tx.Rollback(); err != nil {
+		l.config.GetLogger().Errorf("Failed to end the transaction that quiesced writes: %v", err)
+	}
+	l.dbLock.RUnlock()
+	l.config.GetLogger().Infof("Resumed writes quiesced for %s", time.Since(q.at))
+}
@@ -0,0 +1,196 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/rancher/kine/pkg/server"
+)
+
+// errCorruptRow is returned for rows or leases that do not decode.
+var errCorruptRow = errors.New("bolt: corrupt row")
+
+const (
+	flagCreated byte = 1 << iota
+	flagDeleted
+)
+
+// row is a row of the log, as the rows of the kine table of the SQL
+// drivers. Rows decoded in a transaction share their name and values with
+// the database, so they must not be used once it ends.
+type row struct {
+	id             int64
+	name           []byte
+	created        bool
+	deleted        bool
+	createRevision int64
+	prevRevision   int64
+	lease          int64
+	value          []byte
+	oldValue       []byte
+}
+
+// revKey returns the key of a revision, which sorts the same as the revision.
+func revKey(rev int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(rev))
+	return key
+}
+
+func keyRev(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key))
+}
+
+// encode returns the row as the value stored under its revision. The id is
+// not included, as it is the key.
+func (r *row) encode() []byte {
+	buf := make([]byte, 1+6*binary.MaxVarintLen64+len(r.name)+len(r.value)+len(r.oldValue))
+	var flags byte
+	if r.created {
+		flags |= flagCreated
+	}
+	if r.deleted {
+		flags |= flagDeleted
+	}
+	buf[0] = flags
+	n := 1
+	n += putBytes(buf[n:], r.name)
+	n += binary.PutVarint(buf[n:], r.createRevision)
+	n += binary.PutVarint(buf[n:], r.prevRevision)
+	n += binary.PutVarint(buf[n:], r.lease)
+	n += putBytes(buf[n:], r.value)
+	n += putBytes(buf[n:], r.oldValue)
+	return buf[:n]
+}
+
+func putBytes(buf, b []byte) int {
+	n := binary.PutUvarint(buf, uint64(len(b)))
+	return n + copy(buf[n:], b)
+}
+
+// decodeRow decodes the row stored under the revision id.
+func decodeRow(id int64, buf []byte) (*row, error) {
+	if len(buf) == 0 {
+		return nil, errCorruptRow
+	}
+	d := decoder{buf: buf[1:]}
+	r := &row{
+		id:      id,
+		created: buf[0]&flagCreated != 0,
+		deleted: buf[0]&flagDeleted != 0,
+	}
+	r.name = d.bytes()
+	r.createRevision = d.varint()
+	r.prevRevision = d.varint()
+	r.lease = d.varint()
+	r.value = d.bytes()
+	r.oldValue = d.bytes()
+	return r, d.err
+}
+
+// event returns the event of the row, with copies of its values. The values
+// are left out of keys only lists, and the old value unless prevKV is set.
+func (r *row) event(keysOnly, prevKV bool) *server.Event {
+	event := &server.Event{
+		Create: r.created,
+		Delete: r.deleted,
+		KV: &server.KeyValue{
+			Key:            string(r.name),
+			CreateRevision: r.createRevision,
+			ModRevision:    r.id,
+			Lease:          r.lease,
+		},
+		PrevKV: &server.KeyValue{
+			ModRevision: r.prevRevision,
+		},
+	}
+	if !keysOnly {
+		event.KV.Value = copyBytes(r.value)
+		if prevKV {
+			event.PrevKV.Value = copyBytes(r.oldValue)
+		}
+	}
+
+	if event.Create {
+		event.KV.CreateRevision = event.KV.ModRevision
+		event.PrevKV = nil
+	}
+	return event
+}
+
+// currentCreateRevision returns the revision at which the key of the row was
+// created, which create rows do not store.
+func (r *row) currentCreateRevision() int64 {
+	if r.created {
+		return r.id
+	}
+	return r.createRevision
+}
+
+// matches reports whether the row lies within the bounds of the filter.
+func (r *row) matches(filter server.RevisionFilter) bool {
+	createRevision := r.currentCreateRevision()
+	return (filter.MinModRevision == 0 || r.id >= filter.MinModRevision) &&
+		(filter.MaxModRevision == 0 || r.id <= filter.MaxModRevision) &&
+		(filter.MinCreateRevision == 0 || createRevision >= filter.MinCreateRevision) &&
+		(filter.MaxCreateRevision == 0 || createRevision <= filter.MaxCreateRevision)
+}
+
+func copyBytes(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+// encodeLease returns the value stored under the id of a lease.
+func encodeLease(lease *server.Lease) []byte {
+	buf := make([]byte, 3*binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, lease.TTL)
+	n += binary.PutVarint(buf[n:], lease.GrantedAt.Unix())
+	n += binary.PutVarint(buf[n:], lease.LastKeepAlive.Unix())
+	return buf[:n]
+}
+
+// decodeLease returns the ttl, grant time and last keepalive time of a
+// lease, in seconds since the unix epoch.
+func decodeLease(buf []byte) (ttl, grantedAt, keepAlive int64, err error) {
+	d := decoder{buf: buf}
+	ttl = d.varint()
+	grantedAt = d.varint()
+	keepAlive = d.varint()
+	return ttl, grantedAt, keepAlive, d.err
+}
+
+// decoder reads varints and length prefixed bytes, keeping the first error.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errCorruptRow
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	if d.err != nil {
+		return nil
+	}
+	l, n := binary.Uvarint(d.buf)
+	if n <= 0 || uint64(len(d.buf)-n) < l {
+		d.err = errCorruptRow
+		return nil
+	}
+	b := d.buf[n : n+int(l)]
+	d.buf = d.buf[n+int(l):]
+	return b
+}
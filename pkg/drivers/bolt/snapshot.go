@@ -0,0 +1,228 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"go.etcd.io/bbolt"
+)
+
+// Snapshot writes a copy of the database to w, read in one transaction so
+// that it is consistent while the log keeps serving reads and writes, followed
+// by its SHA-256 so that a truncated or corrupt snapshot is detected before
+// anything is restored. The copy is a bbolt database, so the snapshot only
+// restores into the bolt backend.
+func (l *Log) Snapshot(ctx context.Context, w io.Writer) error {
+	h := sha256.New()
+	err := l.view(ctx, func(tx *bbolt.Tx) error {
+		_, err := tx.WriteTo(io.MultiWriter(w, h))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(h.Sum(nil))
+	return err
+}
+
+// Restore copies the log and the leases of a snapshot made by Snapshot into
+// the database in a single transaction, keeping their revisions. The
+// database must not hold any rows yet, unless force is set, in which case
+// they are replaced by those of the snapshot. The current revision is then
+// raised strictly above the revisions of the snapshot and of the database
+// before, as the generic dialect does.
+func (l *Log) Restore(ctx context.Context, r io.Reader, force bool) error {
+	err := l.view(ctx, func(tx *bbolt.Tx) error {
+		if k, _ := tx.Bucket(revisionsBucket).Cursor().First(); k != nil && !force {
+			return fmt.Errorf("cannot restore into a database that already holds rows unless forced")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "kine-restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/snapshot.bolt"
+	if err := writeSnapshotFile(path, r); err != nil {
+		return err
+	}
+
+	snapshot, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: openTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("not a bolt snapshot: %w", err)
+	}
+	defer snapshot.Close()
+
+	var revision, raised int64
+	err = snapshot.View(func(src *bbolt.Tx) error {
+		if src.Bucket(revisionsBucket) == nil {
+			return fmt.Errorf("not a bolt snapshot of kine")
+		}
+		revision = currentRevision(src)
+		return l.updateDB(func(dst *bbolt.Tx) error {
+			previous := currentRevision(dst)
+			if force {
+				if err := clearBuckets(dst); err != nil {
+					return err
+				}
+			}
+			if err := copyBuckets(dst, src); err != nil {
+				return err
+			}
+			raised = revision
+			if previous > raised {
+				raised = previous
+			}
+			raised++
+			return dst.Bucket(revisionsBucket).SetSequence(uint64(raised))
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	l.config.GetLogger().Infof("Restored bolt snapshot at revision %d, with the current revision raised to %d", revision, raised)
+	return nil
+}
+
+// clearBuckets empties the buckets of the log, recreating them.
+func clearBuckets(tx *bbolt.Tx) error {
+	for _, name := range buckets {
+		if err := tx.DeleteBucket(name); err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSnapshotFile writes the database of the snapshot to a file at path,
+// once its checksum has been verified.
+func writeSnapshotFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	if size < sha256.Size {
+		return fmt.Errorf("snapshot is truncated")
+	}
+	size -= sha256.Size
+
+	h := sha256.New()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(h, f, size); err != nil {
+		return err
+	}
+	sum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(f, sum); err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, h.Sum(nil)) {
+		return fmt.Errorf("snapshot checksum mismatch, it is truncated or corrupt")
+	}
+
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Defragment rewrites the database into a new file without its free pages,
+// and replaces the database with it. Reads and writes wait until it is done.
+func (l *Log) Defragment(ctx context.Context) error {
+	l.dbLock.Lock()
+	defer l.dbLock.Unlock()
+
+	path := l.path + ".defrag"
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return err
+	}
+	err = l.db.View(func(src *bbolt.Tx) error {
+		return db.Update(func(dst *bbolt.Tx) error {
+			return copyBuckets(dst, src)
+		})
+	})
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	if err := l.db.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	// the database is opened again even if it could not be replaced, so that
+	// the log keeps working on the old one
+	renameErr := os.Rename(path, l.path)
+	if l.db, err = open(l.path); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+// copyBuckets copies the buckets of the log from src into dst.
+func copyBuckets(dst, src *bbolt.Tx) error {
+	for _, name := range buckets {
+		srcBucket := src.Bucket(name)
+		if srcBucket == nil {
+			continue
+		}
+		dstBucket, err := dst.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		if err := copyBucket(dstBucket, srcBucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBucket copies the keys, nested buckets and sequence of src into dst.
+func copyBucket(dst, src *bbolt.Bucket) error {
+	// keys are copied in order, so pages are filled up rather than split
+	dst.FillPercent = 0.9
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		// the revisions of keys are stored without values, so nested
+		// buckets are told apart by looking them up
+		srcChild := src.Bucket(k)
+		if srcChild == nil {
+			return dst.Put(k, v)
+		}
+		dstChild, err := dst.CreateBucketIfNotExists(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(dstChild, srcChild)
+	})
+}
@@ -0,0 +1,97 @@
+package bolt
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"go.etcd.io/bbolt"
+)
+
+// trimPrefixes trims the history of the prefixes that are retained for less
+// than the rest of the keyspace, up to the revision that each keeps at the
+// current revision, as the SQL drivers trim them. The trim revisions are
+// raised before the rows are deleted, so that the watches and lists from the
+// revisions being deleted are answered as compacted.
+func (l *Log) trimPrefixes(currentRev int64) error {
+	retention := l.config.GetPrefixRetention()
+	if len(retention) == 0 {
+		return nil
+	}
+	now := time.Now()
+	l.revisionClock.Record(now, currentRev)
+
+	var (
+		raise generic.TrimRevisions
+		from  map[string]int64
+	)
+	err := l.updateDB(func(tx *bbolt.Tx) error {
+		compact := compactRevision(tx)
+		trims, err := trimRevisions(tx)
+		if err != nil {
+			return err
+		}
+		raise, from = generic.TrimTargets(retention, trims, compact, currentRev, l.revisionClock, now)
+		if len(raise) == 0 {
+			return nil
+		}
+		for prefix, revision := range raise {
+			trims[prefix] = revision
+		}
+		for prefix, revision := range trims {
+			if revision <= compact {
+				delete(trims, prefix)
+			}
+		}
+		value, err := json.Marshal(trims)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(trimRevisionsKey, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range retention {
+		target, ok := raise[r.Prefix]
+		if !ok {
+			continue
+		}
+		start := time.Now()
+		var deleted int64
+		for batchStart := from[r.Prefix]; batchStart < target; batchStart += compactBatchSize {
+			batchEnd := batchStart + compactBatchSize
+			if batchEnd > target {
+				batchEnd = target
+			}
+			err := l.updateDB(func(tx *bbolt.Tx) error {
+				n, err := compact(tx, r.Prefix, batchStart, batchEnd)
+				deleted += n
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		l.config.GetLogger().Infof("COMPACT %s revision %d => %d, deleted=%d, duration=%v", r.Prefix, from[r.Prefix], target, deleted, time.Since(start))
+	}
+	return nil
+}
+
+// trimRevisions returns the revisions up to which the history of prefixes was
+// trimmed.
+func trimRevisions(tx *bbolt.Tx) (generic.TrimRevisions, error) {
+	return generic.ParseTrimRevisions(tx.Bucket(metaBucket).Get(trimRevisionsKey))
+}
+
+// trimmedCompactRevision returns the revision up to which the history of the
+// keys with the prefix, or of the key, may be gone: the compact revision, or
+// the trim revision of a prefix that the keys overlap if it is later.
+func trimmedCompactRevision(tx *bbolt.Tx, prefix string, compact int64) (int64, error) {
+	trims, err := trimRevisions(tx)
+	if err != nil {
+		return 0, err
+	}
+	return trims.CompactRevision(prefix, compact), nil
+}
@@ -0,0 +1,128 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+// Verify checks the rows of each key, in a single transaction, and returns
+// those that do not fit the history of their keys, as LogStructured.Verify
+// describes. If repair is set the orphaned tombstones are deleted in the same
+// transaction.
+func (l *Log) Verify(ctx context.Context, repair bool) (inconsistencies []server.Inconsistency, err error) {
+	run := l.view
+	if repair {
+		run = l.update
+	}
+	err = run(ctx, func(tx *bbolt.Tx) error {
+		inconsistencies = nil
+		current, compact := currentRevision(tx), compactRevision(tx)
+		if compact > current {
+			inconsistencies = append(inconsistencies, server.Inconsistency{
+				Kind:         server.InconsistencyCompactRevision,
+				Revision:     compact,
+				PrevRevision: current,
+			})
+		}
+
+		var orphans []int64
+		names := tx.Bucket(namesBucket)
+		err := names.ForEach(func(name, _ []byte) error {
+			keyRevisions := names.Bucket(name)
+			if keyRevisions == nil {
+				return nil
+			}
+			found, orphaned, err := verifyKey(tx, keyRevisions, string(name), compact)
+			inconsistencies = append(inconsistencies, found...)
+			orphans = append(orphans, orphaned...)
+			return err
+		})
+		if err != nil || !repair {
+			return err
+		}
+
+		for _, rev := range orphans {
+			if _, err := deleteRow(tx, rev); err != nil {
+				return fmt.Errorf("failed to delete orphaned tombstone %d: %w", rev, err)
+			}
+		}
+		for i := range inconsistencies {
+			if inconsistencies[i].Kind == server.InconsistencyOrphanedTombstone {
+				inconsistencies[i].Repaired = true
+			}
+		}
+		if len(orphans) > 0 {
+			l.GetLogger().Warnf("Deleted %d orphaned tombstones", len(orphans))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inconsistencies, nil
+}
+
+// verifyKey checks the rows of a key in order, and returns those that do not
+// fit its history, and the revisions of its orphaned tombstones. Every row
+// must follow a different revision, and the rows above the compact revision
+// must follow the row they name, as the SQL drivers check.
+func verifyKey(tx *bbolt.Tx, keyRevisions *bbolt.Bucket, name string, compact int64) (inconsistencies []server.Inconsistency, orphans []int64, err error) {
+	rows := tx.Bucket(revisionsBucket)
+	followed := map[int64]int64{}
+	var earlier int
+	err = keyRevisions.ForEach(func(k, _ []byte) error {
+		r, err := decodeRow(keyRev(k), rows.Get(k))
+		if err != nil {
+			return fmt.Errorf("revision %d of %s: %w", keyRev(k), name, err)
+		}
+		defer func() { earlier++ }()
+
+		i := server.Inconsistency{Key: name, Revision: r.id, PrevRevision: r.prevRevision}
+		if other, ok := followed[r.prevRevision]; ok {
+			fork := i
+			fork.Kind = server.InconsistencyFork
+			fork.Other = other
+			inconsistencies = append(inconsistencies, fork)
+		} else {
+			followed[r.prevRevision] = r.id
+		}
+		if r.id <= compact {
+			return nil
+		}
+
+		var prev *row
+		if v := rows.Get(revKey(r.prevRevision)); v != nil {
+			if prev, err = decodeRow(r.prevRevision, v); err != nil {
+				return fmt.Errorf("revision %d: %w", r.prevRevision, err)
+			}
+		}
+		sameKey := prev != nil && bytes.Equal(prev.name, r.name)
+		switch {
+		case r.created && r.deleted:
+			i.Kind = server.InconsistencyCreatedAndDeleted
+		case r.created:
+			if !sameKey || prev.deleted {
+				return nil
+			}
+			i.Kind = server.InconsistencyCreateOverKey
+		case prev == nil && r.deleted && earlier == 0:
+			i.Kind = server.InconsistencyOrphanedTombstone
+			orphans = append(orphans, r.id)
+		case prev == nil:
+			i.Kind = server.InconsistencyMissingPrev
+		case !sameKey:
+			i.Kind = server.InconsistencyOtherKey
+		case prev.deleted:
+			i.Kind = server.InconsistencyAfterDelete
+		default:
+			return nil
+		}
+		inconsistencies = append(inconsistencies, i)
+		return nil
+	})
+	return inconsistencies, orphans, err
+}
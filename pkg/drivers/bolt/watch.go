@@ -0,0 +1,105 @@
+package bolt
+
+import (
+	"context"
+	"strings"
+
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+func (l *Log) Watch(ctx context.Context, prefix string) <-chan server.WatchEvents {
+	res := make(chan server.WatchEvents, l.config.GetWatchBufferSize())
+	values, err := l.broadcaster.Subscribe(ctx, l.startWatch)
+	if err != nil {
+		return nil
+	}
+
+	checkPrefix := isRange(prefix)
+	go func() {
+		defer close(res)
+		for i := range values {
+			// batches without matching events are passed on as well, as they
+			// still advance the revision of the watch
+			res <- filter(i.([]*server.Event), checkPrefix, prefix)
+		}
+
+		// the broadcaster drops subscribers that fall too far behind
+		if ctx.Err() == nil && l.ctx.Err() == nil {
+			l.config.GetLogger().Warnf("WATCH %s dropped for falling behind", prefix)
+			res <- server.WatchEvents{Err: server.ErrWatchTooSlow}
+		}
+	}()
+
+	return res
+}
+
+func filter(events []*server.Event, checkPrefix bool, prefix string) server.WatchEvents {
+	filtered := make([]*server.Event, 0, len(events))
+	for _, event := range events {
+		if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+			filtered = append(filtered, event)
+		}
+	}
+
+	return server.WatchEvents{
+		Revision: events[len(events)-1].KV.ModRevision,
+		Events:   filtered,
+	}
+}
+
+// startWatch starts reading the events of commits for the watches, from the
+// current revision on. Events before it are read by the watches themselves.
+func (l *Log) startWatch() (chan interface{}, error) {
+	rev, err := l.CurrentRevision(l.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(chan interface{})
+	go l.read(c, rev)
+	return c, nil
+}
+
+// read broadcasts the events written after the revision in batches of the
+// poll batch size, each time it is told of a commit. As bbolt commits one
+// write transaction at a time, the revisions of the events it reads never
+// have gaps.
+func (l *Log) read(result chan interface{}, last int64) {
+	defer close(result)
+
+	batchSize := l.config.GetPollBatchSize()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-l.notify:
+		}
+
+		for {
+			// the events are shared between all watches, so the previous
+			// values are read for those that want them
+			var events []*server.Event
+			err := l.view(l.ctx, func(tx *bbolt.Tx) (err error) {
+				_, _, events, err = after(tx, "", last, batchSize, true)
+				return err
+			})
+			if err != nil {
+				if l.ctx.Err() != nil {
+					return
+				}
+				l.config.GetLogger().Errorf("fail to list latest changes: %v", err)
+				break
+			}
+			if len(events) == 0 {
+				break
+			}
+
+			last = events[len(events)-1].KV.ModRevision
+			result <- events
+			if int64(len(events)) < batchSize {
+				break
+			}
+		}
+	}
+}
@@ -22,10 +22,11 @@ import (
 	"github.com/canonical/go-dqlite/driver"
 	"github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
+	"github.com/rancher/kine/pkg/drivers/generic"
 	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/logging"
 	"github.com/rancher/kine/pkg/server"
 	"github.com/rancher/kine/pkg/tls"
-	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -47,7 +48,6 @@ type opts struct {
 	driverName string // If not empty, use a pre-registered dqlite driver
 
 	compactInterval time.Duration
-	pollInterval    time.Duration
 }
 
 func AddPeers(ctx context.Context, nodeStore client.NodeStore, additionalPeers ...client.NodeInfo) error {
@@ -78,8 +78,8 @@ outer:
 	return nil
 }
 
-func New(ctx context.Context, datasourceName string, tlsInfo tls.Config) (server.Backend, error) {
-	logrus.Printf("New kine for dqlite.")
+func New(ctx context.Context, datasourceName string, tlsInfo tls.Config, config generic.Config) (server.Backend, error) {
+	config.GetLogger().Infof("New kine for dqlite.")
 	opts, err := parseOpts(datasourceName)
 	if err != nil {
 		return nil, err
@@ -99,10 +99,10 @@ func New(ctx context.Context, datasourceName string, tlsInfo tls.Config) (server
 		return nil, errors.Wrap(err, "add peers")
 	}
 
-	logrus.Printf("DriverName is %s.", opts.driverName)
+	config.GetLogger().Infof("DriverName is %s.", opts.driverName)
 	if opts.driverName == "" {
 		opts.driverName = "dqlite"
-		dial, err := getDialer(tlsInfo)
+		dial, err := getDialer(config.GetLogger(), tlsInfo)
 		if err != nil {
 			return nil, err
 		}
@@ -116,11 +116,11 @@ func New(ctx context.Context, datasourceName string, tlsInfo tls.Config) (server
 		sql.Register(opts.driverName, d)
 	}
 
-	backend, generic, err := sqlite.NewVariant(ctx, opts.driverName, opts.dsn)
+	backend, generic, err := sqlite.NewVariant(ctx, opts.driverName, opts.dsn, sqlite.Config{}, config)
 	if err != nil {
 		return nil, errors.Wrap(err, "sqlite client")
 	}
-	if err := migrate(ctx, generic.DB); err != nil {
+	if err := migrate(ctx, generic); err != nil {
 		return nil, errors.Wrap(err, "failed to migrate DB from sqlite")
 	}
 
@@ -162,12 +162,13 @@ func New(ctx context.Context, datasourceName string, tlsInfo tls.Config) (server
 		return err
 	}
 
-	generic.CompactInterval = opts.compactInterval
-	generic.PollInterval = opts.pollInterval
+	if opts.compactInterval != 0 {
+		generic.CompactInterval = opts.compactInterval
+	}
 	return backend, nil
 }
 
-func getDialer(tlsInfo tls.Config) (driver.Option, error) {
+func getDialer(logger logging.Logger, tlsInfo tls.Config) (driver.Option, error) {
 	dial := client.DefaultDialFunc
 	if (tlsInfo.CertFile != "" && tlsInfo.KeyFile == "") || (tlsInfo.KeyFile != "" && tlsInfo.CertFile == "") {
 		return nil, errors.New("both TLS certificate and key must be given")
@@ -190,13 +191,16 @@ func getDialer(tlsInfo tls.Config) (driver.Option, error) {
 
 		config := app.SimpleDialTLSConfig(cert, pool)
 		dial = client.DialFuncWithTLS(dial, config)
-		logrus.Printf("dial set to DialFuncWithTLS")
+		logger.Infof("dial set to DialFuncWithTLS")
 	}
 	return driver.WithDialFunc(dial), nil
 }
 
-func migrate(ctx context.Context, newDB *sql.DB) (exitErr error) {
-	row := newDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM kine")
+// migrate copies the rows of the sqlite database that kine used before
+// dqlite, in the default location, into the table of the dialect.
+func migrate(ctx context.Context, dialect *generic.Generic) (exitErr error) {
+	newDB := dialect.DB
+	row := newDB.QueryRowContext(ctx, dialect.Render("SELECT COUNT(*) FROM kine"))
 	var count int64
 	if err := row.Scan(&count); err != nil {
 		return err
@@ -217,7 +221,7 @@ func migrate(ctx context.Context, newDB *sql.DB) (exitErr error) {
 
 	oldData, err := oldDB.QueryContext(ctx, "SELECT id, name, created, deleted, create_revision, prev_revision, lease, value, old_value FROM kine")
 	if err != nil {
-		logrus.Errorf("failed to find old data to migrate: %v", err)
+		dialect.Logger.Errorf("failed to find old data to migrate: %v", err)
 		return nil
 	}
 	defer oldData.Close()
@@ -250,7 +254,7 @@ func migrate(ctx context.Context, newDB *sql.DB) (exitErr error) {
 			return err
 		}
 
-		if _, err := newDB.ExecContext(ctx, "INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value) values(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		if _, err := newDB.ExecContext(ctx, dialect.Render("INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value) values(?, ?, ?, ?, ?, ?, ?, ?, ?)"),
 			row...); err != nil {
 			return err
 		}
@@ -313,13 +317,6 @@ func parseOpts(dsn string) (opts, error) {
 			}
 			result.compactInterval = d
 			delete(values, k)
-		case "poll-interval":
-			d, err := time.ParseDuration(vs[0])
-			if err != nil {
-				return opts{}, fmt.Errorf("failed to parse poll-interval duration value %q: %w", vs[0], err)
-			}
-			result.pollInterval = d
-			delete(values, k)
 		}
 	}
 
@@ -0,0 +1,119 @@
+package generic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rancher/kine/pkg/server"
+)
+
+var (
+	// duplicateRevisionsSQL lists the rows that replace the same previous
+	// revision of a key, which the unique index over the names and previous
+	// revisions rejects. Old versions of kine could write them when creates
+	// or updates of a key raced.
+	duplicateRevisionsSQL = `
+		SELECT kv.name, kv.prev_revision, COUNT(*) AS duplicates, MAX(kv.id) AS latest
+		FROM kine AS kv
+		GROUP BY kv.name, kv.prev_revision
+		HAVING COUNT(*) > 1`
+
+	// deleteDuplicateRevisionsSQL deletes the rows for which a row of the
+	// same key with a higher id replaces the same previous revision, keeping
+	// the latest write of each race. The rows are selected through a derived
+	// table, as MySQL does not allow a subquery on the table being deleted
+	// from.
+	deleteDuplicateRevisionsSQL = `
+		DELETE FROM kine
+		WHERE id IN (
+			SELECT dups.id FROM (
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE EXISTS (
+					SELECT 1
+					FROM kine AS kh
+					WHERE kh.name = kd.name AND kh.prev_revision = kd.prev_revision AND kh.id > kd.id
+				)
+			) AS dups
+		)`
+)
+
+// CreateUniqueIndex runs create, which creates the unique index over the
+// names and previous revisions of the rows. If the index is rejected because
+// rows of the database violate it, the duplicates are resolved with
+// ResolveDuplicateRevisions and the index is created again.
+func (d *Generic) CreateUniqueIndex(ctx context.Context, create func() error) error {
+	err := create()
+	if err == nil || d.TranslateErr == nil || !errors.Is(d.TranslateErr(err), server.ErrKeyExists) {
+		return err
+	}
+
+	d.Logger.Warnf("Rows of the %s table replace the same revision of a key, resolving them before creating the unique index: %v", d.Table(), err)
+	if err := d.ResolveDuplicateRevisions(ctx); err != nil {
+		return err
+	}
+	return create()
+}
+
+// ResolveDuplicateRevisions deletes the rows that replace the same previous
+// revision of a key as a later row of the key, in a single transaction, so
+// that the unique index over the names and previous revisions can be
+// created. The current row of a key is always the latest one, so it is never
+// deleted. The duplicates are logged before they are deleted.
+func (d *Generic) ResolveDuplicateRevisions(ctx context.Context) error {
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, d.Render(duplicateRevisionsSQL))
+	if err != nil {
+		return fmt.Errorf("failed to list duplicate revisions: %w", err)
+	}
+	var groups int
+	for rows.Next() {
+		var (
+			name                 string
+			prevRevision         int64
+			duplicates, latestID int64
+		)
+		if err := rows.Scan(&name, &prevRevision, &duplicates, &latestID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to list duplicate revisions: %w", err)
+		}
+		groups++
+		d.Logger.Warnf("Key %s has %d rows replacing revision %d, keeping revision %d", name, duplicates, prevRevision, latestID)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return fmt.Errorf("failed to list duplicate revisions: %w", err)
+	}
+	rows.Close()
+
+	result, err := tx.ExecContext(ctx, d.Render(deleteDuplicateRevisionsSQL))
+	if err != nil {
+		return fmt.Errorf("failed to delete duplicate revisions: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete duplicate revisions: %w", err)
+	}
+
+	// kine that write to the database in the meantime could leave duplicates
+	// that are not resolved; creating the index would fail on them again
+	var remaining int64
+	if err := tx.QueryRowContext(ctx, d.Render(`SELECT COUNT(*) FROM (`+duplicateRevisionsSQL+`) AS remaining`)).Scan(&remaining); err != nil {
+		return fmt.Errorf("failed to count duplicate revisions: %w", err)
+	}
+	if remaining > 0 {
+		return fmt.Errorf("failed to resolve duplicate revisions: %d keys still have rows replacing the same revision", remaining)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete duplicate revisions: %w", err)
+	}
+	d.Logger.Warnf("Deleted %d duplicate rows of %d keys from the %s table", deleted, groups, d.Table())
+	return nil
+}
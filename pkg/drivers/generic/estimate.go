@@ -0,0 +1,45 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+)
+
+// countRowsSQL counts the rows of all revisions of a range of keys, which
+// the index over the names answers alone. It is formatted with the query of
+// the current revision.
+var countRowsSQL = `
+	SELECT (%s), COUNT(*)
+	FROM kine AS kv
+	WHERE kv.name >= ? AND kv.name < ?`
+
+// estimateCount estimates the number of current keys in the range of names
+// from the number of its rows, scaled by the share of distinct names among
+// the rows of the table that the statistics of the database estimate. The
+// keys of a range are thus counted without finding the latest row of each,
+// at the price of counting deleted keys until they are compacted. It
+// returns false if there are no statistics to estimate from, for the keys
+// to be counted exactly.
+func (d *Generic) estimateCount(ctx context.Context, start, end string) (int64, int64, bool) {
+	var rows, names sql.NullInt64
+	if err := d.queryRowRead(ctx, d.EstimateCountSQL, nil).Scan(&rows, &names); err != nil {
+		if err != sql.ErrNoRows {
+			d.Logger.Debugf("Failed to read the statistics of the %s table, counting keys exactly: %v", d.Table(), err)
+		}
+		return 0, 0, false
+	}
+	if rows.Int64 <= 0 || names.Int64 <= 0 {
+		return 0, 0, false
+	}
+
+	var rev sql.NullInt64
+	var rangeRows int64
+	if err := d.queryRowRead(ctx, d.countRowsSQL, nil, d.nameArg(start), d.nameArg(end)).Scan(&rev, &rangeRows); err != nil {
+		d.Logger.Debugf("Failed to count the rows of a range of the %s table, counting keys exactly: %v", d.Table(), err)
+		return 0, 0, false
+	}
+	if names.Int64 >= rows.Int64 {
+		return rev.Int64, rangeRows, true
+	}
+	return rev.Int64, rangeRows * names.Int64 / rows.Int64, true
+}
@@ -0,0 +1,114 @@
+package generic
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// gcBatchSize is the number of rows that GC removes per transaction, so that
+// writes are not held up for long by large collections.
+const gcBatchSize = 500
+
+// gcRowsSQL lists the rows at or below the compact revision that no read can
+// return, with their size and whether the last row of their key at or below
+// the compact revision is a delete: the deletes, and the rows before the last
+// one of their key, or before a delete of it. Rows that a row above the
+// compact revision follows are left alone, as those are read as the previous
+// values of keys. It is formatted with the function that returns the size of
+// a value and the compact revision.
+var gcRowsSQL = `
+	SELECT kv.id, kv.deleted, COALESCE(%[1]s(kv.name), 0) + COALESCE(%[1]s(kv.value), 0) + COALESCE(%[1]s(kv.old_value), 0), lkv.deleted
+	FROM kine AS kv
+		JOIN kine AS lkv
+			ON lkv.id = (
+				SELECT MAX(mkv.id)
+				FROM kine AS mkv
+				WHERE mkv.name = kv.name AND mkv.id <= %[2]s)
+	WHERE kv.name != 'compact_rev_key'
+		AND kv.id <= %[2]s
+		AND (kv.deleted != 0 OR lkv.deleted != 0 OR kv.id < lkv.id)
+		AND NOT EXISTS (
+			SELECT 1
+			FROM kine AS nkv
+			WHERE nkv.name = kv.name AND nkv.prev_revision = kv.id AND nkv.created = 0 AND nkv.id > %[2]s)
+	ORDER BY kv.id ASC`
+
+// GC lists the rows at or below the compact revision that no read can
+// return, as LogStructured.GC describes, and unless dryRun is set deletes
+// them in transactions of gcBatchSize rows. A GC that is interrupted leaves
+// the rest for the next.
+func (d *Generic) GC(ctx context.Context, dryRun bool) ([]server.Garbage, error) {
+	compact := "COALESCE((" + verifyCompactRevisionSQL + "), 0)"
+	rows, err := d.DB.QueryContext(ctx, d.Render(fmt.Sprintf(gcRowsSQL, d.LengthSQL, compact)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list garbage: %w", err)
+	}
+	garbage := []server.Garbage{
+		{Kind: server.GarbageTombstone},
+		{Kind: server.GarbageSuperseded},
+		{Kind: server.GarbageDeletedKey},
+	}
+	var ids []int64
+	for rows.Next() {
+		var (
+			id, size            int64
+			deleted, keyDeleted bool
+		)
+		if err := rows.Scan(&id, &deleted, &size, &keyDeleted); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to list garbage: %w", err)
+		}
+		g := &garbage[1]
+		switch {
+		case deleted:
+			g = &garbage[0]
+		case keyDeleted:
+			g = &garbage[2]
+		}
+		g.Rows++
+		g.Bytes += size
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("failed to list garbage: %w", err)
+	}
+	rows.Close()
+
+	if dryRun || len(ids) == 0 {
+		return garbage, nil
+	}
+	for start := 0; start < len(ids); start += gcBatchSize {
+		end := start + gcBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := d.deleteRows(ctx, ids[start:end]); err != nil {
+			return nil, fmt.Errorf("failed to delete garbage: %w", err)
+		}
+	}
+	for i := range garbage {
+		garbage[i].Removed = garbage[i].Rows > 0
+	}
+	logging.WithFields(d.Logger, logging.Fields{"rows": len(ids)}).Infof("GC deleted %d rows from the %s table", len(ids), d.Table())
+	return garbage, nil
+}
+
+// deleteRows deletes the rows of the ids in a single transaction.
+func (d *Generic) deleteRows(ctx context.Context, ids []int64) error {
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, d.DeleteSQL, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
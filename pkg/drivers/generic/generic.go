@@ -3,21 +3,34 @@ package generic
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/Rican7/retry/jitter"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/server"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	columns = "kv.id as theid, kv.name, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, kv.value, kv.old_value"
 
+	// valueColumns are the columns of rows read without their old values,
+	// which are only needed for the previous values of watch events. The old
+	// value is replaced by NULL so that the rows scan the same as full rows.
+	valueColumns = "kv.id as theid, kv.name, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, kv.value, NULL as old_value"
+
+	// keyColumns are the columns of a keys only list. The values are replaced
+	// by NULL so that the rows scan the same as full rows.
+	keyColumns = "kv.id as theid, kv.name, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, NULL as value, NULL as old_value"
+
 	revSQL = `
 		SELECT MAX(rkv.id) AS id
 		FROM kine AS rkv`
@@ -28,60 +41,207 @@ var (
 		WHERE crkv.name = 'compact_rev_key'
 		ORDER BY crkv.id DESC LIMIT 1`
 
-	listSQL = fmt.Sprintf(`
+	// revisionFilterSQL restricts a list or count to the keys whose mod and
+	// create revisions lie within the bounds of a server.RevisionFilter. A
+	// bound of zero is not applied.
+	revisionFilterSQL = `
+			AND (? = 0 OR kv.id >= ?)
+			AND (? = 0 OR kv.id <= ?)
+			AND (? = 0 OR CASE WHEN kv.created = 1 THEN kv.id ELSE kv.create_revision END >= ?)
+			AND (? = 0 OR CASE WHEN kv.created = 1 THEN kv.id ELSE kv.create_revision END <= ?)`
+
+	// listSQL lists the current rows of a range of keys, formatted with the
+	// selected columns. Lists never read the old values, as a range returns
+	// no previous values. The rows of the range are scanned in the order of
+	// their names from the (name, id) index, which also tells whether a row
+	// was replaced, so that only the rows that are current are read from
+	// the table. The rows are joined with a cross join, which sqlite reads
+	// in the order of the statement once it is the latest join, and other
+	// databases treat as any inner join.
+	listSQL = `
+		SELECT %s
+		FROM kine AS mkv
+			LEFT JOIN kine AS mkv2
+				ON mkv.name = mkv2.name
+				AND mkv.id < mkv2.id
+			CROSS JOIN kine AS kv
+		WHERE mkv2.name IS NULL
+			AND mkv.name >= ? AND mkv.name < ?
+			AND kv.id = mkv.id
+			AND (? = 1 OR kv.deleted = 0)` + revisionFilterSQL + `
+		ORDER BY mkv.name ASC
+	`
+
+	// listRevisionSQL lists the rows of a range of keys that were current at
+	// a revision, ignoring any row written after it, as listSQL does. It is
+	// formatted with the selected columns and the comparison against the
+	// start of the range, so that a list can be continued after the last key
+	// of a previous page.
+	listRevisionSQL = `
+		SELECT %s
+		FROM kine AS mkv
+			LEFT JOIN kine AS mkv2
+				ON mkv.name = mkv2.name
+				AND mkv.id < mkv2.id
+				AND mkv2.id <= ?
+			CROSS JOIN kine AS kv
+		WHERE mkv2.name IS NULL
+			AND mkv.name %s ? AND mkv.name < ?
+			AND mkv.id <= ?
+			AND kv.id = mkv.id
+			AND (? = 1 OR kv.deleted = 0)` + revisionFilterSQL + `
+		ORDER BY mkv.name ASC
+	`
+
+	// countSQL counts the current keys in a range. The latest row of each
+	// key is found from the (name, id) index alone, in a single pass over
+	// the range, and only its fixed size columns are read to tell whether it
+	// is a delete; the values are never read.
+	countSQL = fmt.Sprintf(`
+		SELECT (%s), COUNT(kv.id)
+		FROM (
+			SELECT MAX(mkv.id) AS id
+			FROM kine AS mkv
+			WHERE mkv.name >= ? AND mkv.name < ?
+			GROUP BY mkv.name
+		) AS maxkv
+			JOIN kine AS kv
+				ON kv.id = maxkv.id
+		WHERE (? = 1 OR kv.deleted = 0)
+			%s`, revSQL, revisionFilterSQL)
+
+	// countRevisionSQL is like countSQL, but counts the keys that were
+	// current at a revision. It is formatted with the comparison against the
+	// start of the range, as listRevisionSQL.
+	countRevisionSQL = `
+		SELECT (%s), COUNT(kv.id)
+		FROM (
+			SELECT MAX(mkv.id) AS id
+			FROM kine AS mkv
+			WHERE mkv.name %s ? AND mkv.name < ?
+				AND mkv.id <= ?
+			GROUP BY mkv.name
+		) AS maxkv
+			JOIN kine AS kv
+				ON kv.id = maxkv.id
+		WHERE (? = 1 OR kv.deleted = 0)` + revisionFilterSQL
+
+	// afterPrefixSQL lists the rows of a range of keys written after a
+	// revision, formatted with the selected columns.
+	afterPrefixSQL = `
 		SELECT %s
 		FROM kine AS kv
-			LEFT JOIN kine kv2 
+		WHERE 
+			kv.name >= ? AND kv.name < ?
+			AND kv.id > ?
+		ORDER BY kv.id ASC`
+
+	// afterSQL lists the rows written after a revision, formatted with the
+	// selected columns.
+	afterSQL = `
+		SELECT %s
+			FROM kine AS kv
+			WHERE kv.id > ?
+			ORDER BY kv.id ASC
+	`
+
+	// leaseKeysSQL lists the current, non-deleted keys attached to a lease.
+	leaseKeysSQL = `
+		SELECT kv.name
+		FROM kine AS kv
+			LEFT JOIN kine kv2
 				ON kv.name = kv2.name
 				AND kv.id < kv2.id
 		WHERE kv2.name IS NULL
-			AND kv.name >= ? AND kv.name < ?
-			AND (? OR kv.deleted = 0)
-			%%s
-		ORDER BY kv.id ASC
-	`, columns)
-
-	// FIXME this query doesn't seem sound.
-	revisionAfterSQL = fmt.Sprintf(`
-			SELECT *
-			FROM (
-				SELECT %s
-				FROM kine AS kv
-				JOIN (
-					SELECT MAX(mkv.id) AS id
-					FROM kine AS mkv
-					WHERE mkv.name >= ? AND mkv.name < ?
-						AND mkv.id <= ?
-						AND mkv.id > (
-							SELECT ikv.id
-							FROM kine AS ikv
-							WHERE
-								ikv.name = ? AND
-								ikv.id <= ?
-							ORDER BY ikv.id DESC
-							LIMIT 1
-						)
-					GROUP BY mkv.name
-				) AS maxkv
-					ON maxkv.id = kv.id
-				WHERE
-					? OR kv.deleted = 0
-			) AS lkv
-			ORDER BY lkv.theid ASC
-		`, columns)
+			AND kv.deleted = 0
+			AND kv.lease = ?
+		ORDER BY kv.name ASC`
 
+	// versionSQL counts the rows of a key since it was created.
+	versionSQL = `
+		SELECT COUNT(*)
+		FROM kine AS kv
+		WHERE kv.name = ?
+			AND kv.id >= ?
+			AND kv.id <= ?`
+
+	// keyRevisionsSQL lists the revisions of the keys within a range of names
+	// and revisions, from which the versions of many keys are counted at once.
+	keyRevisionsSQL = `
+		SELECT kv.name, kv.id
+		FROM kine AS kv
+		WHERE kv.name >= ? AND kv.name <= ?
+			AND kv.id >= ? AND kv.id <= ?`
+
+	// historySQL lists the rows of a key, or only the row at a revision if
+	// it is not zero, formatted with the size of the value and the value
+	// column, which is NULL where the values are not read.
+	historySQL = `
+		SELECT kv.id, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, %s, %s
+		FROM kine AS kv
+		WHERE kv.name = ?
+			AND (? = 0 OR kv.id = ?)
+		ORDER BY kv.id ASC`
+
+	// revokeLeaseSQL writes a delete for every current key attached to a
+	// lease in a single statement, so that either all or none of the keys are
+	// deleted.
+	revokeLeaseSQL = `
+		INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+		SELECT
+			kv.name,
+			0,
+			1,
+			CASE WHEN kv.created = 1 THEN kv.id ELSE kv.create_revision END,
+			kv.id,
+			kv.lease,
+			kv.value,
+			kv.value
+		FROM kine AS kv
+			LEFT JOIN kine kv2
+				ON kv.name = kv2.name
+				AND kv.id < kv2.id
+		WHERE kv2.name IS NULL
+			AND kv.deleted = 0
+			AND kv.lease = ?
+		ORDER BY kv.name ASC`
+
+	// compactSQL deletes every row that was superseded by an update or delete
+	// within a revision range, as well as the delete tombstones themselves.
+	// Create rows reference the revision current at the time of creation in
+	// prev_revision rather than a prior row, so they are skipped.
+	compactSQL = `
+		DELETE FROM kine AS kv
+		WHERE
+			kv.id IN (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.created = 0 AND
+					kp.prev_revision != 0 AND
+					kp.id <= ? AND
+					kp.id > ?
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= ? AND
+					kd.id > ?
+			)`
+
+	// revisionIntervalSQL selects the compact revision and the current
+	// revision. Both are taken with MAX rather than a limit, which not all
+	// databases support.
 	revisionIntervalSQL = `
 		SELECT (
-			SELECT crkv.prev_revision 
+			SELECT MAX(crkv.prev_revision)
 			FROM kine AS crkv
 			WHERE crkv.name = 'compact_rev_key'
-			ORDER BY prev_revision
-			DESC LIMIT 1
 		) AS low, (
-			SELECT id
+			SELECT MAX(id)
 			FROM kine
-			ORDER BY id
-			DESC LIMIT 1
 		) AS high`
 )
 
@@ -96,10 +256,167 @@ type ErrRetry func(error) bool
 type TranslateErr func(error) error
 type ErrCode func(error) string
 
+// Listen returns a channel of revisions of rows as they are inserted, by any
+// client of the database. It is closed once ctx is done.
+type Listen func(ctx context.Context) (<-chan int64, error)
+
+// SnapshotFile copies the database to a new file at path, for dialects that
+// snapshot by copying the database file.
+type SnapshotFile func(ctx context.Context, path string) error
+
+// RestoreFile copies the rows of the database file at path, made by a
+// SnapshotFile, into the database, in a transaction that runs before ahead
+// of the copy and after once it is done.
+type RestoreFile func(ctx context.Context, path string, before, after func(ctx context.Context, tx *sql.Tx) error) error
+
+// FlushFile writes all that was committed to the database into its main file,
+// for dialects that keep the database in local files, so that a copy of the
+// file taken while writes are quiesced holds them.
+type FlushFile func(ctx context.Context) error
+
+// Config holds the settings shared by all drivers built on the generic dialect.
+type Config struct {
+	// CompactInterval is interval between database compactions performed by kine.
+	// Automatic compaction is disabled when it is zero.
+	CompactInterval time.Duration
+	// CompactMinRetain is the number of revisions kept by automatic compaction.
+	// Defaults to 1000.
+	CompactMinRetain int64
+	// CompactGC removes the rows that no read can return, as GC does, after
+	// every automatic compaction. Such rows are only left behind by
+	// compactions that were interrupted, so they are not looked for by
+	// default.
+	CompactGC bool
+	// PrefixRetention are the prefixes whose history automatic compaction
+	// trims earlier than that of the rest of the keyspace.
+	PrefixRetention []PrefixRetention
+	// PollInterval is the interval at which kine polls the database for new
+	// events, when it is not told of them first. It is an upper bound on the
+	// latency of watches for writes made by other kine instances on the same
+	// database. Defaults to 1 second.
+	PollInterval time.Duration
+	// PollBatchSize is the number of rows read from the database per poll.
+	// Defaults to 500.
+	PollBatchSize int64
+	// WatchBufferSize is the number of event batches buffered for each watch
+	// before it is canceled for being too slow. Defaults to 100.
+	WatchBufferSize int
+	// SlowQueryThreshold is the duration above which SQL statements are
+	// logged as slow. Slow statements are not logged when it is zero.
+	SlowQueryThreshold time.Duration
+	// MetricsRegisterer is the registerer that the metrics of the SQL
+	// statements and of watches are registered with. Metrics are not
+	// collected when it is nil.
+	MetricsRegisterer prometheus.Registerer
+	// TracerProvider provides the tracer that SQL statements are traced
+	// with. They are not traced when it is nil.
+	TracerProvider trace.TracerProvider
+	// Logger is the logger of the database and of the backend on it.
+	// Defaults to the standard logger of logrus.
+	Logger logging.Logger
+	// ConnectionPoolConfig sets the pool of connections to the database.
+	ConnectionPoolConfig ConnectionPoolConfig
+	// StatementTimeouts are the timeouts of statements, by the kind of
+	// operation they run for.
+	StatementTimeouts StatementTimeouts
+	// TableName is the name of the table of the log, so that several kine
+	// can share a database. The table of the leases and the indexes are
+	// named after it. Defaults to kine.
+	TableName string
+	// SchemaName is the schema that the tables are created in, for the
+	// databases that have schemas. The default schema of the connection is
+	// used when it is empty.
+	SchemaName string
+	// PasswordFunc returns the password of every new connection to the
+	// database, for the drivers that support it. The password of the data
+	// source name is used when it is nil.
+	PasswordFunc PasswordFunc
+	// ReadDataSourceNames are the data source names of read replicas of the
+	// database, for the drivers that support them. Lists and counts are read
+	// from them as long as the replicas keep up, while writes, compaction and
+	// polling stay on the primary.
+	ReadDataSourceNames []string
+	// EstimateCounts estimates the counts of current keys from the
+	// statistics of the database, for the drivers that support it, rather
+	// than counting them exactly. It is meant for callers that tolerate
+	// approximate counts of huge tables.
+	EstimateCounts bool
+	// QuiesceTimeout is the longest that Quiesce holds writes for, after
+	// which they are resumed if Resume was not called. Defaults to 1 minute.
+	QuiesceTimeout time.Duration
+}
+
+// ParseDSN applies the poll-interval and poll-batch-size parameters of the
+// data source name to the config, and returns the data source name without
+// them. Values set in the data source name must be positive.
+func (c *Config) ParseDSN(dataSourceName string) (string, error) {
+	parts := strings.SplitN(dataSourceName, "?", 2)
+	if len(parts) == 1 {
+		return dataSourceName, c.Validate()
+	}
+
+	// the other parameters are passed on untouched, as drivers differ in how
+	// they decode them
+	var params []string
+	for _, param := range strings.Split(parts[1], "&") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 || (kv[0] != "poll-interval" && kv[0] != "poll-batch-size") {
+			params = append(params, param)
+			continue
+		}
+
+		v, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to parse %s", kv[0])
+		}
+		switch kv[0] {
+		case "poll-interval":
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return "", fmt.Errorf("failed to parse poll-interval duration value %q: %w", v, err)
+			}
+			if d <= 0 {
+				return "", fmt.Errorf("poll-interval must be positive, got %q", v)
+			}
+			c.PollInterval = d
+		case "poll-batch-size":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return "", fmt.Errorf("failed to parse poll-batch-size value %q: %w", v, err)
+			}
+			if n <= 0 {
+				return "", fmt.Errorf("poll-batch-size must be positive, got %q", v)
+			}
+			c.PollBatchSize = n
+		}
+	}
+
+	if len(params) == 0 {
+		return parts[0], c.Validate()
+	}
+	return parts[0] + "?" + strings.Join(params, "&"), c.Validate()
+}
+
+// Validate checks that the settings of the config are not negative, and that
+// the table and schema names are valid. Zero settings are replaced by their
+// defaults.
+func (c *Config) Validate() error {
+	if c.PollInterval < 0 {
+		return fmt.Errorf("poll interval must not be negative, got %s", c.PollInterval)
+	}
+	if c.PollBatchSize < 0 {
+		return fmt.Errorf("poll batch size must not be negative, got %d", c.PollBatchSize)
+	}
+	return c.validateNames()
+}
+
 type Generic struct {
 	sync.Mutex
+	Config
 
 	LockWrites                    bool
+	CompactBatchSize              int64
+	CompactBatchDelay             time.Duration
 	LastInsertID                  bool
 	DB                            *sql.DB
 	GetCurrentSQL                 string
@@ -108,15 +425,33 @@ type Generic struct {
 	RevisionSQL                   string
 	ListRevisionStartSQL          string
 	GetRevisionAfterSQL           string
+	GetCurrentKeysSQL             string
+	ListRevisionStartKeysSQL      string
+	GetRevisionAfterKeysSQL       string
 	CountSQL                      string
 	countSQLPrepared              *sql.Stmt
+	CountRevisionSQL              string
+	CountRevisionAfterSQL         string
 	AfterSQLPrefix                string
 	afterSQLPrefixPrepared        *sql.Stmt
 	AfterSQL                      string
+	AfterSQLPrefixNoOldValue      string
+	AfterNoOldValueSQL            string
 	DeleteSQL                     string
 	deleteSQLPrepared             *sql.Stmt
 	UpdateCompactSQL              string
 	updateCompactSQLPrepared      *sql.Stmt
+	CompactSQL                    string
+	LeaseKeysSQL                  string
+	VersionSQL                    string
+	KeyRevisionsSQL               string
+	HistorySQL                    string
+	HistoryNoValueSQL             string
+	RevokeLeaseSQL                string
+	ListLeasesSQL                 string
+	InsertLeaseSQL                string
+	KeepAliveLeaseSQL             string
+	DeleteLeaseSQL                string
 	InsertSQL                     string
 	insertSQLPrepared             *sql.Stmt
 	FillSQL                       string
@@ -125,20 +460,80 @@ type Generic struct {
 	insertLastInsertIDSQLPrepared *sql.Stmt
 	GetSizeSQL                    string
 	getSizeSQLPrepared            *sql.Stmt
-	Retry                         ErrRetry
-	TranslateErr                  TranslateErr
-	ErrCode                       ErrCode
-
-	// CompactInterval is interval between database compactions performed by kine.
-	CompactInterval time.Duration
-	// PollInterval is the event poll interval used by kine.
-	PollInterval time.Duration
-}
-
-func configureConnectionPooling(db *sql.DB) {
-	db.SetMaxIdleConns(5)
-	db.SetMaxOpenConns(5)
-	db.SetConnMaxLifetime(60 * time.Second)
+	GetSizeInUseSQL               string
+	DefragmentSQL                 string
+	SnapshotSQL                   string
+	ResetSequenceSQL              string
+	// EstimateCountSQL selects the estimated number of rows of the table
+	// and of distinct names in it, from the statistics of the database.
+	// Counts are exact for dialects without it, or while the statistics
+	// are missing.
+	EstimateCountSQL string
+	countRowsSQL     string
+	// RaiseSequenceSQL raises the id sequence so that the next id is higher
+	// than a revision, if it is not already. It is formatted with the
+	// revision and the id after it.
+	RaiseSequenceSQL string
+	// LimitSQL is the clause appended to ordered lists to limit their rows,
+	// formatted with the limit. Defaults to a LIMIT clause.
+	LimitSQL string
+	// LengthSQL is the function that returns the size in bytes of binary
+	// values. Defaults to LENGTH.
+	LengthSQL string
+	// PrefixSQL is the expression of the prefix of kv.name up to and
+	// including its third slash, such as /registry/pods/, or of the empty
+	// string for names with fewer slashes. Defaults to one of SUBSTR and
+	// INSTR.
+	PrefixSQL string
+	// TrimSQL deletes the rows of a range of names that CompactSQL deletes,
+	// with the arguments of CompactSQL each followed by the start and end of
+	// the range.
+	TrimSQL                string
+	trimRevisionsSQL       string
+	lockTrimRevisionsSQL   string
+	updateTrimRevisionsSQL string
+	// BinaryNames passes the names of keys to statements as bytes, for
+	// dialects that store them in binary columns, so that keys that are not
+	// valid UTF-8 are stored and compared as they are.
+	BinaryNames  bool
+	SnapshotFile SnapshotFile
+	RestoreFile  RestoreFile
+	FlushFile    FlushFile
+	Retry        ErrRetry
+	TranslateErr TranslateErr
+	ErrCode      ErrCode
+	// ConnectionErrCodes maps the codes, as returned by ErrCode, of errors
+	// that mean the connection to the database was lost or refused, to
+	// whether the statement is known not to have been run, in which case
+	// writes are retried too. Errors of the network and driver.ErrBadConn are
+	// recognized for all dialects.
+	ConnectionErrCodes map[string]bool
+	Listen             Listen
+	// MaxRetryBackoff is the longest wait between the retries of a statement
+	// that failed with an error of Retry. The wait doubles from 2ms with each
+	// retry up to it, and stays at 2ms if it is not set.
+	MaxRetryBackoff time.Duration
+
+	// currentRevisionSQL and revisionIntervalSQL are the statements that
+	// read the current and compact revisions, and revisionMarkSQL and
+	// markRevisionSQL those that read and write the revision mark, rendered
+	// for the table.
+	currentRevisionSQL  string
+	revisionIntervalSQL string
+	revisionMarkSQL     string
+	markRevisionSQL     string
+
+	pool           ConnectionPoolConfig
+	replicas       []*replica
+	nextReplica    uint32
+	metricsOnce    sync.Once
+	sqlMetrics     *sqlMetrics
+	statementsLock sync.Mutex
+	statements     map[string]string
+	quiesceLock    sync.Mutex
+	quiescing      bool
+	quiesced       *time.Timer
+	quiescedAt     time.Time
 }
 
 func q(sql, param string, numbered bool) string {
@@ -157,34 +552,44 @@ func q(sql, param string, numbered bool) string {
 	})
 }
 
-func (d *Generic) Migrate(ctx context.Context) {
+// Migrate copies the latest values of the keys of the key_value table of old
+// versions of kine into the kine table, if there is a key_value table with
+// keys and the kine table is still empty. Once the kine table is filled it
+// does nothing, so it is safe to run it on every start. A copy that fails is
+// returned as an error rather than leaving kine to start without the keys.
+func (d *Generic) Migrate(ctx context.Context) error {
 	var (
 		count     = 0
 		countKV   = d.queryRow(ctx, "SELECT COUNT(*) FROM key_value")
-		countKine = d.queryRow(ctx, "SELECT COUNT(*) FROM kine")
+		countKine = d.queryRow(ctx, d.Render("SELECT COUNT(*) FROM kine"))
 	)
 
+	// databases without a key_value table have nothing to migrate
 	if err := countKV.Scan(&count); err != nil || count == 0 {
-		return
+		return nil
 	}
 
-	if err := countKine.Scan(&count); err != nil || count != 0 {
-		return
+	if err := countKine.Scan(&count); err != nil {
+		return fmt.Errorf("failed to count the rows of the kine table: %w", err)
+	}
+	if count != 0 {
+		return nil
 	}
 
-	logrus.Infof("Migrating content from old table")
-	_, err := d.execute(ctx,
+	d.Logger.Infof("Migrating content from old table")
+	_, err := d.execute(ctx, d.Render(
 		`INSERT INTO kine(deleted, create_revision, prev_revision, name, value, created, lease)
 					SELECT 0, 0, 0, kv.name, kv.value, 1, CASE WHEN kv.ttl > 0 THEN 15 ELSE 0 END
 					FROM key_value kv
-						WHERE kv.id IN (SELECT MAX(kvd.id) FROM key_value kvd GROUP BY kvd.name)`)
+						WHERE kv.id IN (SELECT MAX(kvd.id) FROM key_value kvd GROUP BY kvd.name)`))
 	if err != nil {
-		logrus.Errorf("Migration failed: %v", err)
+		return fmt.Errorf("failed to migrate the key_value table: %w", err)
 	}
+	return nil
 }
 
-func openAndTest(driverName, dataSourceName string) (*sql.DB, error) {
-	db, err := sql.Open(driverName, dataSourceName)
+func openAndTest(open func() (*sql.DB, error)) (*sql.DB, error) {
+	db, err := open()
 	if err != nil {
 		return nil, err
 	}
@@ -199,19 +604,36 @@ func openAndTest(driverName, dataSourceName string) (*sql.DB, error) {
 	return db, nil
 }
 
-func Open(ctx context.Context, driverName, dataSourceName string, paramCharacter string, numbered bool) (*Generic, error) {
+// Open opens the database and returns the dialect for it, with the statements
+// rendered for the table and schema of the config.
+func Open(ctx context.Context, driverName, dataSourceName string, config Config, paramCharacter string, numbered bool) (*Generic, error) {
+	return open(ctx, func() (*sql.DB, error) {
+		return sql.Open(driverName, dataSourceName)
+	}, config, paramCharacter, numbered)
+}
+
+// OpenConnector is like Open, but establishes database connections through the
+// given connector instead of a driver name and data source name.
+func OpenConnector(ctx context.Context, connector driver.Connector, config Config, paramCharacter string, numbered bool) (*Generic, error) {
+	return open(ctx, func() (*sql.DB, error) {
+		return sql.OpenDB(connector), nil
+	}, config, paramCharacter, numbered)
+}
+
+func open(ctx context.Context, openDB func() (*sql.DB, error), config Config, paramCharacter string, numbered bool) (*Generic, error) {
 	var (
 		db  *sql.DB
 		err error
 	)
+	config.Logger = logging.OrDefault(config.Logger)
 
 	for i := 0; i < 300; i++ {
-		db, err = openAndTest(driverName, dataSourceName)
+		db, err = openAndTest(openDB)
 		if err == nil {
 			break
 		}
 
-		logrus.Errorf("failed to ping connection: %v", err)
+		config.Logger.Errorf("failed to ping connection: %v", err)
 		select {
 		case <-ctx.Done():
 			return nil, ctx.Err()
@@ -219,10 +641,21 @@ func Open(ctx context.Context, driverName, dataSourceName string, paramCharacter
 		}
 	}
 
-	configureConnectionPooling(db)
+	poolConfig := configureConnectionPooling(config.Logger, db, config.ConnectionPoolConfig)
+
+	d := &Generic{
+		Config:    config,
+		DB:        db,
+		pool:      poolConfig,
+		LimitSQL:  "LIMIT %d",
+		LengthSQL: "LENGTH",
+		PrefixSQL: prefixSQL,
 
-	return &Generic{
-		DB: db,
+		currentRevisionSQL:  revSQL,
+		revisionIntervalSQL: revisionIntervalSQL,
+		revisionMarkSQL:     revisionMarkSQL,
+		markRevisionSQL:     q(markRevisionSQL, paramCharacter, numbered),
+		countRowsSQL:        q(fmt.Sprintf(countRowsSQL, revSQL), paramCharacter, numbered),
 
 		GetRevisionSQL: q(fmt.Sprintf(`
 			SELECT
@@ -230,35 +663,58 @@ func Open(ctx context.Context, driverName, dataSourceName string, paramCharacter
 			FROM kine kv
 			WHERE kv.id = ?`, columns), paramCharacter, numbered),
 
-		GetCurrentSQL:        q(fmt.Sprintf(listSQL, ""), paramCharacter, numbered),
-		ListRevisionStartSQL: q(fmt.Sprintf(listSQL, "AND kv.id <= ?"), paramCharacter, numbered),
-		GetRevisionAfterSQL:  q(revisionAfterSQL, paramCharacter, numbered),
+		GetCurrentSQL:        q(fmt.Sprintf(listSQL, valueColumns), paramCharacter, numbered),
+		ListRevisionStartSQL: q(fmt.Sprintf(listRevisionSQL, valueColumns, ">="), paramCharacter, numbered),
+		GetRevisionAfterSQL:  q(fmt.Sprintf(listRevisionSQL, valueColumns, ">"), paramCharacter, numbered),
 
-		CountSQL: q(fmt.Sprintf(`
-			SELECT (%s), COUNT(*)
-			FROM (
-				%s
-			) c`, revSQL, fmt.Sprintf(listSQL, "")), paramCharacter, numbered),
+		GetCurrentKeysSQL:        q(fmt.Sprintf(listSQL, keyColumns), paramCharacter, numbered),
+		ListRevisionStartKeysSQL: q(fmt.Sprintf(listRevisionSQL, keyColumns, ">="), paramCharacter, numbered),
+		GetRevisionAfterKeysSQL:  q(fmt.Sprintf(listRevisionSQL, keyColumns, ">"), paramCharacter, numbered),
 
-		AfterSQLPrefix: q(fmt.Sprintf(`
-			SELECT %s
-			FROM kine AS kv
-			WHERE 
-				kv.name >= ? AND kv.name < ?
-				AND kv.id > ?
-			ORDER BY kv.id ASC`, columns), paramCharacter, numbered),
+		CountSQL:              q(countSQL, paramCharacter, numbered),
+		CountRevisionSQL:      q(fmt.Sprintf(countRevisionSQL, revSQL, ">="), paramCharacter, numbered),
+		CountRevisionAfterSQL: q(fmt.Sprintf(countRevisionSQL, revSQL, ">"), paramCharacter, numbered),
 
-		AfterSQL: q(fmt.Sprintf(`
-			SELECT %s
-				FROM kine AS kv
-				WHERE kv.id > ?
-				ORDER BY kv.id ASC
-		`, columns), paramCharacter, numbered),
+		AfterSQLPrefix:           q(fmt.Sprintf(afterPrefixSQL, columns), paramCharacter, numbered),
+		AfterSQL:                 q(fmt.Sprintf(afterSQL, columns), paramCharacter, numbered),
+		AfterSQLPrefixNoOldValue: q(fmt.Sprintf(afterPrefixSQL, valueColumns), paramCharacter, numbered),
+		AfterNoOldValueSQL:       q(fmt.Sprintf(afterSQL, valueColumns), paramCharacter, numbered),
 
 		DeleteSQL: q(`
 			DELETE FROM kine AS kv
 			WHERE kv.id = ?`, paramCharacter, numbered),
 
+		CompactSQL: q(compactSQL, paramCharacter, numbered),
+
+		TrimSQL:                q(trimSQL, paramCharacter, numbered),
+		trimRevisionsSQL:       trimRevisionsSQL,
+		lockTrimRevisionsSQL:   lockTrimRevisionsSQL,
+		updateTrimRevisionsSQL: q(updateTrimRevisionsSQL, paramCharacter, numbered),
+
+		LeaseKeysSQL:    q(leaseKeysSQL, paramCharacter, numbered),
+		VersionSQL:      q(versionSQL, paramCharacter, numbered),
+		KeyRevisionsSQL: q(keyRevisionsSQL, paramCharacter, numbered),
+		RevokeLeaseSQL:  q(revokeLeaseSQL, paramCharacter, numbered),
+
+		HistorySQL:        q(fmt.Sprintf(historySQL, "COALESCE(LENGTH(kv.value), 0)", "kv.value"), paramCharacter, numbered),
+		HistoryNoValueSQL: q(fmt.Sprintf(historySQL, "COALESCE(LENGTH(kv.value), 0)", "NULL"), paramCharacter, numbered),
+
+		ListLeasesSQL: `
+			SELECT id, ttl, granted_at, last_keepalive
+			FROM kine_leases`,
+
+		InsertLeaseSQL: q(`INSERT INTO kine_leases(id, ttl, granted_at, last_keepalive)
+			VALUES(?, ?, ?, ?)`, paramCharacter, numbered),
+
+		KeepAliveLeaseSQL: q(`
+			UPDATE kine_leases
+			SET last_keepalive = ?
+			WHERE id = ?`, paramCharacter, numbered),
+
+		DeleteLeaseSQL: q(`
+			DELETE FROM kine_leases
+			WHERE id = ?`, paramCharacter, numbered),
+
 		UpdateCompactSQL: q(`
 			UPDATE kine
 			SET prev_revision = ?
@@ -272,7 +728,35 @@ func Open(ctx context.Context, driverName, dataSourceName string, paramCharacter
 
 		FillSQL: q(`INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
 			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`, paramCharacter, numbered),
-	}, err
+
+		SnapshotSQL: q(fmt.Sprintf(`
+			SELECT %s
+			FROM kine AS kv
+			WHERE kv.id <= ?
+			ORDER BY kv.id ASC`, columns), paramCharacter, numbered),
+	}
+	d.render()
+	return d, err
+}
+
+// render renders the statements of the dialect for the table and schema of
+// its config. Dialects render the statements they set themselves.
+func (d *Generic) render() {
+	for _, sql := range []*string{
+		&d.GetCurrentSQL, &d.GetRevisionSQL, &d.ListRevisionStartSQL, &d.GetRevisionAfterSQL,
+		&d.GetCurrentKeysSQL, &d.ListRevisionStartKeysSQL, &d.GetRevisionAfterKeysSQL,
+		&d.CountSQL, &d.CountRevisionSQL, &d.CountRevisionAfterSQL,
+		&d.AfterSQLPrefix, &d.AfterSQL, &d.AfterSQLPrefixNoOldValue, &d.AfterNoOldValueSQL,
+		&d.DeleteSQL, &d.UpdateCompactSQL, &d.CompactSQL,
+		&d.TrimSQL, &d.trimRevisionsSQL, &d.lockTrimRevisionsSQL, &d.updateTrimRevisionsSQL,
+		&d.LeaseKeysSQL, &d.VersionSQL, &d.KeyRevisionsSQL, &d.HistorySQL, &d.HistoryNoValueSQL, &d.RevokeLeaseSQL,
+		&d.ListLeasesSQL, &d.InsertLeaseSQL, &d.KeepAliveLeaseSQL, &d.DeleteLeaseSQL,
+		&d.InsertSQL, &d.FillSQL, &d.InsertLastInsertIDSQL, &d.SnapshotSQL,
+		&d.currentRevisionSQL, &d.revisionIntervalSQL, &d.revisionMarkSQL, &d.markRevisionSQL,
+		&d.countRowsSQL,
+	} {
+		*sql = d.Render(*sql)
+	}
 }
 
 func (d *Generic) Prepare() error {
@@ -328,34 +812,58 @@ func (d *Generic) Prepare() error {
 	return nil
 }
 
+// keyspaceEnd ends the range of the empty prefix. It is the largest code
+// point, whose encoding sorts after the names of all keys.
+const keyspaceEnd = "\U0010FFFF"
+
+// getPrefixRange returns the range of names that a prefix covers: all keys
+// below the prefix if it ends with a slash, all keys if it is empty, and only
+// the key itself otherwise, as names are compared bytewise and the key
+// followed by a NUL byte is the next name after it.
 func getPrefixRange(prefix string) (start, end string) {
 	start = prefix
-	if strings.HasSuffix(prefix, "/") {
+	if prefix == "" {
+		end = keyspaceEnd
+	} else if strings.HasSuffix(prefix, "/") {
 		end = prefix[0:len(prefix)-1] + "0"
 	} else {
-		// we are using only readable characters
-		end = prefix + "\x01"
+		end = prefix + "\x00"
 	}
 
 	return start, end
 }
 
+// nameArg returns the name of a key as the argument of a statement, which is
+// passed as bytes to dialects with BinaryNames.
+func (d *Generic) nameArg(name string) interface{} {
+	if d.BinaryNames {
+		return []byte(name)
+	}
+	return name
+}
+
 func (d *Generic) query(ctx context.Context, sql string, args ...interface{}) (rows *sql.Rows, err error) {
 	i := uint(0)
+	start := time.Now()
+	var backoff time.Duration
 	defer func() {
+		d.observe(ctx, sql, args, start, nil, err)
 		if err != nil {
 			err = fmt.Errorf("query (try: %d): %w", i, err)
 		}
 	}()
 	for ; i < 500; i++ {
 		if i > 2 {
-			logrus.Debugf("QUERY (try: %d) %v : %s", i, args, Stripped(sql))
+			d.Logger.Debugf("QUERY (try: %d) %v : %s", i, args, Stripped(sql))
 		} else {
-			logrus.Tracef("QUERY (try: %d) %v : %s", i, args, Stripped(sql))
+			d.Logger.Tracef("QUERY (try: %d) %v : %s", i, args, Stripped(sql))
 		}
 		rows, err = d.DB.QueryContext(ctx, sql, args...)
 		if err != nil && d.Retry != nil && d.Retry(err) {
-			time.Sleep(jitter.Deviation(nil, 0.3)(2 * time.Millisecond))
+			d.retryWait(i)
+			continue
+		}
+		if d.reconnect(ctx, err, false, start, &backoff) {
 			continue
 		}
 		return rows, err
@@ -363,38 +871,81 @@ func (d *Generic) query(ctx context.Context, sql string, args ...interface{}) (r
 	return
 }
 
+// queryPrepared is like query, but runs the prepared statement. Dialects
+// that did not prepare their statements run the SQL instead.
 func (d *Generic) queryPrepared(ctx context.Context, sql string, prepared *sql.Stmt, args ...interface{}) (result *sql.Rows, err error) {
-	logrus.Tracef("QUERY %v : %s", args, Stripped(sql))
-	return prepared.QueryContext(ctx, args...)
+	if prepared == nil {
+		return d.query(ctx, sql, args...)
+	}
+	d.Logger.Tracef("QUERY %v : %s", args, Stripped(sql))
+	start := time.Now()
+	var backoff time.Duration
+	for {
+		result, err = prepared.QueryContext(ctx, args...)
+		if !d.reconnect(ctx, err, false, start, &backoff) {
+			break
+		}
+	}
+	d.observe(ctx, sql, args, start, nil, err)
+	return result, err
 }
 
 func (d *Generic) queryRow(ctx context.Context, sql string, args ...interface{}) (result *sql.Row) {
-	logrus.Tracef("QUERY ROW %v : %s", args, Stripped(sql))
-	return d.DB.QueryRowContext(ctx, sql, args...)
+	d.Logger.Tracef("QUERY ROW %v : %s", args, Stripped(sql))
+	start := time.Now()
+	var backoff time.Duration
+	for {
+		result = d.DB.QueryRowContext(ctx, sql, args...)
+		// inserts that return their id are queried for a row too, so these
+		// are only run again if they cannot have been run
+		if !d.reconnect(ctx, result.Err(), true, start, &backoff) {
+			break
+		}
+	}
+	d.observe(ctx, sql, args, start, nil, result.Err())
+	return result
 }
 
 func (d *Generic) queryRowPrepared(ctx context.Context, sql string, prepared *sql.Stmt, args ...interface{}) (result *sql.Row) {
-	logrus.Tracef("QUERY ROW %v : %s", args, Stripped(sql))
-	return prepared.QueryRowContext(ctx, args...)
+	if prepared == nil {
+		return d.queryRow(ctx, sql, args...)
+	}
+	d.Logger.Tracef("QUERY ROW %v : %s", args, Stripped(sql))
+	start := time.Now()
+	var backoff time.Duration
+	for {
+		result = prepared.QueryRowContext(ctx, args...)
+		if !d.reconnect(ctx, result.Err(), true, start, &backoff) {
+			break
+		}
+	}
+	d.observe(ctx, sql, args, start, nil, result.Err())
+	return result
 }
 
 func (d *Generic) queryInt64(ctx context.Context, sql string, args ...interface{}) (n int64, err error) {
 	i := uint(0)
+	start := time.Now()
+	var backoff time.Duration
 	defer func() {
+		d.observe(ctx, sql, args, start, nil, err)
 		if err != nil {
 			err = fmt.Errorf("query int64 (try: %d): %w", i, err)
 		}
 	}()
 	for ; i < 500; i++ {
 		if i > 2 {
-			logrus.Debugf("QUERY INT64 (try: %d) %v : %s", i, args, Stripped(sql))
+			d.Logger.Debugf("QUERY INT64 (try: %d) %v : %s", i, args, Stripped(sql))
 		} else {
-			logrus.Tracef("QUERY INT64 (try: %d) %v : %s", i, args, Stripped(sql))
+			d.Logger.Tracef("QUERY INT64 (try: %d) %v : %s", i, args, Stripped(sql))
 		}
 		row := d.DB.QueryRowContext(ctx, sql, args...)
 		err = row.Scan(&n)
 		if err != nil && d.Retry != nil && d.Retry(err) {
-			time.Sleep(jitter.Deviation(nil, 0.3)(2 * time.Millisecond))
+			d.retryWait(i)
+			continue
+		}
+		if d.reconnect(ctx, err, false, start, &backoff) {
 			continue
 		}
 		return n, err
@@ -404,7 +955,10 @@ func (d *Generic) queryInt64(ctx context.Context, sql string, args ...interface{
 
 func (d *Generic) execute(ctx context.Context, sql string, args ...interface{}) (result sql.Result, err error) {
 	i := uint(0)
+	start := time.Now()
+	var backoff time.Duration
 	defer func() {
+		d.observe(ctx, sql, args, start, result, err)
 		if err != nil {
 			err = fmt.Errorf("exec (try: %d): %w", i, err)
 		}
@@ -416,13 +970,16 @@ func (d *Generic) execute(ctx context.Context, sql string, args ...interface{})
 
 	for ; i < 500; i++ {
 		if i > 2 {
-			logrus.Debugf("EXEC (try: %d) %v : %s", i, args, Stripped(sql))
+			d.Logger.Debugf("EXEC (try: %d) %v : %s", i, args, Stripped(sql))
 		} else {
-			logrus.Tracef("EXEC (try: %d) %v : %s", i, args, Stripped(sql))
+			d.Logger.Tracef("EXEC (try: %d) %v : %s", i, args, Stripped(sql))
 		}
 		result, err = d.DB.ExecContext(ctx, sql, args...)
 		if err != nil && d.Retry != nil && d.Retry(err) {
-			time.Sleep(jitter.Deviation(nil, 0.3)(2 * time.Millisecond))
+			d.retryWait(i)
+			continue
+		}
+		if d.reconnect(ctx, err, true, start, &backoff) {
 			continue
 		}
 		return result, err
@@ -431,8 +988,14 @@ func (d *Generic) execute(ctx context.Context, sql string, args ...interface{})
 }
 
 func (d *Generic) executePrepared(ctx context.Context, sql string, prepared *sql.Stmt, args ...interface{}) (result sql.Result, err error) {
+	if prepared == nil {
+		return d.execute(ctx, sql, args...)
+	}
 	i := uint(0)
+	start := time.Now()
+	var backoff time.Duration
 	defer func() {
+		d.observe(ctx, sql, args, start, result, err)
 		if err != nil {
 			err = fmt.Errorf("exec (try: %d): %w", i, err)
 		}
@@ -444,13 +1007,16 @@ func (d *Generic) executePrepared(ctx context.Context, sql string, prepared *sql
 
 	for ; i < 500; i++ {
 		if i > 2 {
-			logrus.Debugf("EXEC (try: %d) %v : %s", i, args, Stripped(sql))
+			d.Logger.Debugf("EXEC (try: %d) %v : %s", i, args, Stripped(sql))
 		} else {
-			logrus.Tracef("EXEC (try: %d) %v : %s", i, args, Stripped(sql))
+			d.Logger.Tracef("EXEC (try: %d) %v : %s", i, args, Stripped(sql))
 		}
 		result, err = prepared.ExecContext(ctx, args...)
 		if err != nil && d.Retry != nil && d.Retry(err) {
-			time.Sleep(jitter.Deviation(nil, 0.3)(2 * time.Millisecond))
+			d.retryWait(i)
+			continue
+		}
+		if d.reconnect(ctx, err, true, start, &backoff) {
 			continue
 		}
 		return result, err
@@ -458,10 +1024,13 @@ func (d *Generic) executePrepared(ctx context.Context, sql string, prepared *sql
 	return
 }
 
-func (d *Generic) GetCompactRevision(ctx context.Context) (int64, int64, error) {
+func (d *Generic) GetCompactRevision(ctx context.Context) (_, _ int64, err error) {
+	ctx, deadline := withTimeout(ctx, d.readTimeout())
+	defer deadline.done(&err)
+
 	var compact, target sql.NullInt64
-	row := d.DB.QueryRow(revisionIntervalSQL)
-	err := row.Scan(&compact, &target)
+	row := d.DB.QueryRowContext(ctx, d.revisionIntervalSQL)
+	err = row.Scan(&compact, &target)
 	if err == sql.ErrNoRows {
 		return 0, 0, nil
 	}
@@ -469,90 +1038,411 @@ func (d *Generic) GetCompactRevision(ctx context.Context) (int64, int64, error)
 	return compact.Int64, target.Int64, err
 }
 
-func (d *Generic) SetCompactRevision(ctx context.Context, revision int64) error {
-	_, err := d.executePrepared(ctx, d.UpdateCompactSQL, d.updateCompactSQLPrepared, revision)
+func (d *Generic) SetCompactRevision(ctx context.Context, revision int64) (err error) {
+	ctx, deadline := withTimeout(ctx, d.compactTimeout())
+	defer deadline.done(&err)
+
+	_, err = d.executePrepared(ctx, d.UpdateCompactSQL, d.updateCompactSQLPrepared, revision)
 	return err
 }
 
-func (d *Generic) GetRevision(ctx context.Context, revision int64) (*sql.Rows, error) {
-	return d.queryPrepared(ctx, d.GetRevisionSQL, d.getRevisionSQLPrepared, revision)
+// Compact deletes rows superseded or deleted after the compactRev and up to
+// and including the targetRev, returning the number of rows deleted. Rows are
+// deleted in batches of CompactBatchSize revisions, pausing CompactBatchDelay
+// between batches so that other writers are not locked out for long. Each
+// batch is timed out on its own.
+func (d *Generic) Compact(ctx context.Context, compactRev, targetRev int64) (int64, error) {
+	var deleted int64
+	for start := compactRev; start < targetRev; {
+		end := start + d.GetCompactBatchSize()
+		if end > targetRev {
+			end = targetRev
+		}
+
+		result, err := d.compactBatch(ctx, start, end)
+		if err != nil {
+			return deleted, err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += rows
+		start = end
+
+		if start < targetRev {
+			select {
+			case <-ctx.Done():
+				return deleted, ctx.Err()
+			case <-time.After(d.GetCompactBatchDelay()):
+			}
+		}
+	}
+	return deleted, nil
+}
+
+func (d *Generic) compactBatch(ctx context.Context, start, end int64) (_ sql.Result, err error) {
+	ctx, deadline := withTimeout(ctx, d.compactTimeout())
+	defer deadline.done(&err)
+
+	return d.execute(ctx, d.CompactSQL, end, start, end, start)
+}
+
+func (d *Generic) GetRevision(ctx context.Context, revision int64) (*Rows, error) {
+	ctx, deadline := withTimeout(ctx, d.readTimeout())
+	return deadline.rows(d.queryPrepared(ctx, d.GetRevisionSQL, d.getRevisionSQLPrepared, revision))
 }
 
-func (d *Generic) DeleteRevision(ctx context.Context, revision int64) error {
-	_, err := d.executePrepared(ctx, d.DeleteSQL, d.deleteSQLPrepared, revision)
+func (d *Generic) DeleteRevision(ctx context.Context, revision int64) (err error) {
+	ctx, deadline := withTimeout(ctx, d.writeTimeout())
+	defer deadline.done(&err)
+
+	_, err = d.executePrepared(ctx, d.DeleteSQL, d.deleteSQLPrepared, revision)
 	return err
 }
 
-func (d *Generic) ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted bool) (*sql.Rows, error) {
+// ListCurrent lists the current rows of the keys with the given prefix. For a
+// keys only list the value columns are not read and scan as nil.
+func (d *Generic) ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted, keysOnly bool, filter server.RevisionFilter) (*Rows, error) {
+	ctx, deadline := withTimeout(ctx, d.listTimeoutOf(prefix))
+	sql, args := d.listCurrentQuery(prefix, limit, includeDeleted, keysOnly, filter)
+	return deadline.rows(d.queryRead(ctx, sql, args...))
+}
+
+// List is like ListCurrent, but lists the rows as of the given revision. If a
+// start key is given, only the keys after it are listed.
+func (d *Generic) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted, keysOnly bool, filter server.RevisionFilter) (*Rows, error) {
+	ctx, deadline := withTimeout(ctx, d.listTimeoutOf(prefix))
+	sql, args := d.listQuery(prefix, startKey, limit, revision, includeDeleted, keysOnly, filter)
+	return deadline.rows(d.queryRead(ctx, sql, args...))
+}
+
+// listTimeoutOf returns the timeout of listing the prefix, which is that of
+// a point read unless the prefix is empty or ends with a slash and lists a
+// range of keys.
+func (d *Generic) listTimeoutOf(prefix string) time.Duration {
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return d.listTimeout()
+	}
+	return d.readTimeout()
+}
+
+func (d *Generic) listCurrentQuery(prefix string, limit int64, includeDeleted, keysOnly bool, filter server.RevisionFilter) (string, []interface{}) {
 	sql := d.GetCurrentSQL
-	start, end := getPrefixRange(prefix)
-	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+	if keysOnly {
+		sql = d.GetCurrentKeysSQL
 	}
+	start, end := getPrefixRange(prefix)
+	sql = d.limit(sql, limit)
 
-	return d.query(ctx, sql, start, end, includeDeleted)
+	return sql, append([]interface{}{d.nameArg(start), d.nameArg(end), boolInt(includeDeleted)}, revisionFilterArgs(filter)...)
 }
 
-func (d *Generic) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (*sql.Rows, error) {
+func (d *Generic) listQuery(prefix, startKey string, limit, revision int64, includeDeleted, keysOnly bool, filter server.RevisionFilter) (string, []interface{}) {
 	start, end := getPrefixRange(prefix)
 	if startKey == "" {
 		sql := d.ListRevisionStartSQL
-		if limit > 0 {
-			sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+		if keysOnly {
+			sql = d.ListRevisionStartKeysSQL
 		}
-		return d.query(ctx, sql, start, end, revision, includeDeleted)
+		sql = d.limit(sql, limit)
+		return sql, append([]interface{}{revision, d.nameArg(start), d.nameArg(end), revision, boolInt(includeDeleted)}, revisionFilterArgs(filter)...)
 	}
 
 	sql := d.GetRevisionAfterSQL
-	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+	if keysOnly {
+		sql = d.GetRevisionAfterKeysSQL
+	}
+	sql = d.limit(sql, limit)
+	return sql, append([]interface{}{revision, d.nameArg(startKey), d.nameArg(end), revision, boolInt(includeDeleted)}, revisionFilterArgs(filter)...)
+}
+
+// limit appends the limit clause of the dialect to the ordered list, unless
+// the limit is zero.
+func (d *Generic) limit(sql string, limit int64) string {
+	if limit <= 0 {
+		return sql
 	}
-	return d.query(ctx, sql, start, end, revision, startKey, revision, includeDeleted)
+	return sql + " " + fmt.Sprintf(d.LimitSQL, limit)
 }
 
-func (d *Generic) Count(ctx context.Context, prefix string) (int64, int64, error) {
+// boolInt returns a boolean argument as 1 or 0, as not all databases compare
+// integers with booleans.
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// revisionFilterArgs returns the arguments of revisionFilterSQL.
+func revisionFilterArgs(filter server.RevisionFilter) []interface{} {
+	return []interface{}{
+		filter.MinModRevision, filter.MinModRevision,
+		filter.MaxModRevision, filter.MaxModRevision,
+		filter.MinCreateRevision, filter.MinCreateRevision,
+		filter.MaxCreateRevision, filter.MaxCreateRevision,
+	}
+}
+
+// Count returns the current revision and the number of keys with the given
+// prefix. If a revision is given the keys current at that revision are
+// counted, and if a start key is given only the keys after it. A start key
+// requires a revision.
+func (d *Generic) Count(ctx context.Context, prefix, startKey string, revision int64, filter server.RevisionFilter) (_, _ int64, err error) {
+	ctx, deadline := withTimeout(ctx, d.listTimeout())
+	defer deadline.done(&err)
+
 	var (
 		rev sql.NullInt64
 		id  int64
+		row *sql.Row
 	)
 
 	start, end := getPrefixRange(prefix)
+	if d.EstimateCounts && d.EstimateCountSQL != "" && revision == 0 && startKey == "" && filter == (server.RevisionFilter{}) {
+		if rev, count, ok := d.estimateCount(ctx, start, end); ok {
+			return rev, count, nil
+		}
+	}
 
-	row := d.queryRowPrepared(ctx, d.CountSQL, d.countSQLPrepared, start, end, false)
-	err := row.Scan(&rev, &id)
+	switch {
+	case revision == 0 && startKey == "":
+		args := append([]interface{}{d.nameArg(start), d.nameArg(end), 0}, revisionFilterArgs(filter)...)
+		row = d.queryRowRead(ctx, d.CountSQL, d.countSQLPrepared, args...)
+	case startKey == "":
+		args := append([]interface{}{d.nameArg(start), d.nameArg(end), revision, 0}, revisionFilterArgs(filter)...)
+		row = d.queryRowRead(ctx, d.CountRevisionSQL, nil, args...)
+	default:
+		args := append([]interface{}{d.nameArg(startKey), d.nameArg(end), revision, 0}, revisionFilterArgs(filter)...)
+		row = d.queryRowRead(ctx, d.CountRevisionAfterSQL, nil, args...)
+	}
+	err = row.Scan(&rev, &id)
 
 	return rev.Int64, id, err
 }
 
-func (d *Generic) CurrentRevision(ctx context.Context) (int64, error) {
+// LeaseKeys returns the names of all current keys attached to the given lease.
+func (d *Generic) LeaseKeys(ctx context.Context, lease int64) (_ []string, err error) {
+	ctx, deadline := withTimeout(ctx, d.listTimeout())
+	defer deadline.done(&err)
+
+	rows, err := d.query(ctx, d.LeaseKeysSQL, lease)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Version returns the number of revisions of a key between its creation and
+// the given revision. As the count is taken from the rows still in the
+// table, it restarts at 1 once older revisions of the key are compacted.
+func (d *Generic) Version(ctx context.Context, key string, createRevision, modRevision int64) (_ int64, err error) {
+	ctx, deadline := withTimeout(ctx, d.readTimeout())
+	defer deadline.done(&err)
+
+	return d.queryInt64(ctx, d.VersionSQL, d.nameArg(key), createRevision, modRevision)
+}
+
+// History lists the rows of a key, oldest first, or only its row at the
+// revision if it is not zero. The values are only read if values is set, and
+// scan as nil otherwise.
+func (d *Generic) History(ctx context.Context, key string, revision int64, values bool) (*Rows, error) {
+	ctx, deadline := withTimeout(ctx, d.listTimeout())
+	sql := d.HistoryNoValueSQL
+	if values {
+		sql = d.HistorySQL
+	}
+	return deadline.rows(d.query(ctx, sql, d.nameArg(key), revision, revision))
+}
+
+// Versions sets the version of each key value at its revision, as Version
+// counts it. The key values are expected in the order lists return them in,
+// so that the revisions of all keys are read in a single query over the
+// range of names from the first to the last one.
+func (d *Generic) Versions(ctx context.Context, kvs []*server.KeyValue) error {
+	return versions(ctx, kvs, d.Version, func(ctx context.Context, start, end string, minRev, maxRev int64) (*sql.Rows, error) {
+		return d.query(ctx, d.KeyRevisionsSQL, d.nameArg(start), d.nameArg(end), minRev, maxRev)
+	}, d.listTimeout())
+}
+
+// versions sets the versions of the key values from the revisions that
+// keyRevisions lists between the names and revisions given, within the
+// timeout. The version of a single key value, and of any key that the range
+// of names misses, is counted with version instead.
+func versions(ctx context.Context, kvs []*server.KeyValue,
+	version func(ctx context.Context, key string, createRevision, modRevision int64) (int64, error),
+	keyRevisions func(ctx context.Context, start, end string, minRev, maxRev int64) (*sql.Rows, error),
+	timeout time.Duration) (err error) {
+	if len(kvs) == 1 {
+		kvs[0].Version, err = version(ctx, kvs[0].Key, kvs[0].CreateRevision, kvs[0].ModRevision)
+		return err
+	} else if len(kvs) == 0 {
+		return nil
+	}
+	if err := countVersions(ctx, kvs, keyRevisions, timeout); err != nil {
+		return err
+	}
+
+	// every key value has a revision of its own key, so a zero version means
+	// its key was not listed
+	for _, kv := range kvs {
+		if kv.Version > 0 {
+			continue
+		}
+		if kv.Version, err = version(ctx, kv.Key, kv.CreateRevision, kv.ModRevision); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countVersions sets the version of each key value to the number of the
+// revisions of its key between its creation and its revision, as listed by
+// keyRevisions.
+func countVersions(ctx context.Context, kvs []*server.KeyValue, keyRevisions func(ctx context.Context, start, end string, minRev, maxRev int64) (*sql.Rows, error), timeout time.Duration) (err error) {
+	ctx, deadline := withTimeout(ctx, timeout)
+	defer deadline.done(&err)
+
+	minRev, maxRev := kvs[0].CreateRevision, kvs[0].ModRevision
+	byKey := make(map[string]*server.KeyValue, len(kvs))
+	for _, kv := range kvs {
+		if kv.CreateRevision < minRev {
+			minRev = kv.CreateRevision
+		}
+		if kv.ModRevision > maxRev {
+			maxRev = kv.ModRevision
+		}
+		kv.Version = 0
+		byKey[kv.Key] = kv
+	}
+
+	rows, err := keyRevisions(ctx, kvs[0].Key, kvs[len(kvs)-1].Key, minRev, maxRev)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			name string
+			id   int64
+		)
+		if err := rows.Scan(&name, &id); err != nil {
+			return err
+		}
+		if kv := byKey[name]; kv != nil && id >= kv.CreateRevision && id <= kv.ModRevision {
+			kv.Version++
+		}
+	}
+	return rows.Err()
+}
+
+// RevokeLease deletes all current keys attached to the given lease, returning
+// the number of keys deleted.
+func (d *Generic) RevokeLease(ctx context.Context, lease int64) (deleted int64, err error) {
+	ctx, deadline := withTimeout(ctx, d.writeTimeout())
+	defer deadline.done(&err)
+
+	if d.TranslateErr != nil {
+		defer func() {
+			if err != nil {
+				err = d.TranslateErr(err)
+			}
+		}()
+	}
+
+	result, err := d.execute(ctx, d.RevokeLeaseSQL, lease)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ListLeases returns the id, ttl, grant time and last keepalive time of all
+// stored leases. Times are in seconds since the unix epoch.
+func (d *Generic) ListLeases(ctx context.Context) (*Rows, error) {
+	ctx, deadline := withTimeout(ctx, d.listTimeout())
+	return deadline.rows(d.query(ctx, d.ListLeasesSQL))
+}
+
+func (d *Generic) InsertLease(ctx context.Context, id, ttl, grantedAt int64) (err error) {
+	ctx, deadline := withTimeout(ctx, d.writeTimeout())
+	defer deadline.done(&err)
+
+	_, err = d.execute(ctx, d.InsertLeaseSQL, id, ttl, grantedAt, grantedAt)
+	return err
+}
+
+func (d *Generic) KeepAliveLease(ctx context.Context, id, keepAlive int64) (err error) {
+	ctx, deadline := withTimeout(ctx, d.writeTimeout())
+	defer deadline.done(&err)
+
+	_, err = d.execute(ctx, d.KeepAliveLeaseSQL, keepAlive, id)
+	return err
+}
+
+func (d *Generic) DeleteLease(ctx context.Context, id int64) (err error) {
+	ctx, deadline := withTimeout(ctx, d.writeTimeout())
+	defer deadline.done(&err)
+
+	_, err = d.execute(ctx, d.DeleteLeaseSQL, id)
+	return err
+}
+
+func (d *Generic) CurrentRevision(ctx context.Context) (_ int64, err error) {
+	ctx, deadline := withTimeout(ctx, d.readTimeout())
+	defer deadline.done(&err)
+
 	var id int64
-	row := d.queryRow(ctx, revSQL)
-	err := row.Scan(&id)
+	row := d.queryRow(ctx, d.currentRevisionSQL)
+	err = row.Scan(&id)
 	if err == sql.ErrNoRows {
 		return 0, nil
 	}
 	return id, err
 }
 
-func (d *Generic) AfterPrefix(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error) {
+// AfterPrefix lists the rows of the keys with the given prefix written after
+// the revision. The old values are only read if prevKV is set, and scan as
+// nil otherwise.
+func (d *Generic) AfterPrefix(ctx context.Context, prefix string, rev, limit int64, prevKV bool) (*Rows, error) {
+	ctx, deadline := withTimeout(ctx, d.listTimeout())
 	start, end := getPrefixRange(prefix)
 	sql := d.AfterSQLPrefix
-	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+	if !prevKV {
+		sql = d.AfterSQLPrefixNoOldValue
 	}
-	return d.query(ctx, sql, start, end, rev)
+	sql = d.limit(sql, limit)
+	return deadline.rows(d.query(ctx, sql, d.nameArg(start), d.nameArg(end), rev))
 }
 
-func (d *Generic) After(ctx context.Context, rev, limit int64) (*sql.Rows, error) {
+// After is like AfterPrefix, but lists the rows of all keys.
+func (d *Generic) After(ctx context.Context, rev, limit int64, prevKV bool) (*Rows, error) {
+	ctx, deadline := withTimeout(ctx, d.listTimeout())
 	sql := d.AfterSQL
-	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+	if !prevKV {
+		sql = d.AfterNoOldValueSQL
 	}
-	return d.query(ctx, sql, rev)
+	sql = d.limit(sql, limit)
+	return deadline.rows(d.query(ctx, sql, rev))
 }
 
-func (d *Generic) Fill(ctx context.Context, revision int64) error {
-	_, err := d.executePrepared(ctx, d.FillSQL, d.fillSQLPrepared, revision, fmt.Sprintf("gap-%d", revision), 0, 1, 0, 0, 0, nil, nil)
+func (d *Generic) Fill(ctx context.Context, revision int64) (err error) {
+	ctx, deadline := withTimeout(ctx, d.writeTimeout())
+	defer deadline.done(&err)
+
+	_, err = d.executePrepared(ctx, d.FillSQL, d.fillSQLPrepared, revision, d.nameArg(fmt.Sprintf("gap-%d", revision)), 0, 1, 0, 0, 0, nil, nil)
 	return err
 }
 
@@ -561,6 +1451,9 @@ func (d *Generic) IsFill(key string) bool {
 }
 
 func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (id int64, err error) {
+	ctx, deadline := withTimeout(ctx, d.writeTimeout())
+	defer deadline.done(&err)
+
 	if d.TranslateErr != nil {
 		defer func() {
 			if err != nil {
@@ -579,23 +1472,26 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 	}
 
 	if d.LastInsertID {
-		row, err := d.executePrepared(ctx, d.InsertLastInsertIDSQL, d.insertLastInsertIDSQLPrepared, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+		row, err := d.executePrepared(ctx, d.InsertLastInsertIDSQL, d.insertLastInsertIDSQLPrepared, d.nameArg(key), cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
 		if err != nil {
 			return 0, err
 		}
 		return row.LastInsertId()
 	}
 
-	row := d.queryRowPrepared(ctx, d.InsertSQL, d.insertSQLPrepared, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+	row := d.queryRowPrepared(ctx, d.InsertSQL, d.insertSQLPrepared, d.nameArg(key), cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
 	err = row.Scan(&id)
 
 	return id, err
 }
 
-func (d *Generic) GetSize(ctx context.Context) (int64, error) {
+func (d *Generic) GetSize(ctx context.Context) (_ int64, err error) {
 	if d.GetSizeSQL == "" {
 		return 0, errors.New("driver does not support size reporting")
 	}
+	ctx, deadline := withTimeout(ctx, d.readTimeout())
+	defer deadline.done(&err)
+
 	var size int64
 	row := d.queryRowPrepared(ctx, d.GetSizeSQL, d.getSizeSQLPrepared)
 	if err := row.Scan(&size); err != nil {
@@ -604,16 +1500,126 @@ func (d *Generic) GetSize(ctx context.Context) (int64, error) {
 	return size, nil
 }
 
-func (d *Generic) GetCompactInterval() time.Duration {
-	if v := d.CompactInterval; v > 0 {
+// GetSizeInUse returns the part of the database size that holds data, which
+// is less than its size by the space that is free for reuse.
+func (d *Generic) GetSizeInUse(ctx context.Context) (_ int64, err error) {
+	if d.GetSizeInUseSQL == "" {
+		return 0, errors.New("driver does not support size in use reporting")
+	}
+	ctx, deadline := withTimeout(ctx, d.readTimeout())
+	defer deadline.done(&err)
+
+	var size int64
+	if err := d.queryRow(ctx, d.GetSizeInUseSQL).Scan(&size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Defragment returns the free space of the database to the operating system.
+// Writes are paused while it runs if they are serialized with LockWrites;
+// otherwise the database holds them off with its own locks.
+func (d *Generic) Defragment(ctx context.Context) (err error) {
+	if d.DefragmentSQL == "" {
+		return errors.New("driver does not support defragment")
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	ctx, deadline := withTimeout(ctx, d.compactTimeout())
+	defer deadline.done(&err)
+
+	d.Logger.Tracef("DEFRAGMENT : %s", Stripped(d.DefragmentSQL))
+	start := time.Now()
+	if _, err := d.DB.ExecContext(ctx, d.DefragmentSQL); err != nil {
+		// errors the dialect translates are returned as they are, so that
+		// clients see their status codes
+		if d.TranslateErr != nil {
+			if translated := d.TranslateErr(err); translated != err {
+				return translated
+			}
+		}
+		return fmt.Errorf("defragment: %w", err)
+	}
+	duration := time.Since(start)
+	logging.WithFields(d.Logger, logging.Fields{"duration": duration.Seconds()}).Infof("Defragmented database in %s", duration)
+	return nil
+}
+
+// Close closes the database and its read replicas, once the queries still
+// running have finished.
+func (d *Generic) Close() error {
+	err := d.DB.Close()
+	if replicaErr := d.closeReplicas(); err == nil {
+		err = replicaErr
+	}
+	return err
+}
+
+func (c Config) GetCompactInterval() time.Duration {
+	return c.CompactInterval
+}
+
+func (c Config) GetCompactMinRetain() int64 {
+	if v := c.CompactMinRetain; v > 0 {
+		return v
+	}
+	return 1000
+}
+
+func (c Config) GetCompactGC() bool {
+	return c.CompactGC
+}
+
+func (d *Generic) GetCompactBatchSize() int64 {
+	if v := d.CompactBatchSize; v > 0 {
+		return v
+	}
+	return 1000
+}
+
+func (d *Generic) GetCompactBatchDelay() time.Duration {
+	if v := d.CompactBatchDelay; v > 0 {
 		return v
 	}
-	return 5 * time.Minute
+	return 10 * time.Millisecond
 }
 
-func (d *Generic) GetPollInterval() time.Duration {
-	if v := d.PollInterval; v > 0 {
+func (c Config) GetPollInterval() time.Duration {
+	if v := c.PollInterval; v > 0 {
 		return v
 	}
 	return time.Second
 }
+
+// Notifications returns a channel of the revisions of inserted rows, or nil
+// if the database does not notify of inserts.
+func (d *Generic) Notifications(ctx context.Context) (<-chan int64, error) {
+	if d.Listen == nil {
+		return nil, nil
+	}
+	return d.Listen(ctx)
+}
+
+func (c Config) GetPollBatchSize() int64 {
+	if v := c.PollBatchSize; v > 0 {
+		return v
+	}
+	return 500
+}
+
+func (c Config) GetMetricsRegisterer() prometheus.Registerer {
+	return c.MetricsRegisterer
+}
+
+func (c Config) GetLogger() logging.Logger {
+	return logging.OrDefault(c.Logger)
+}
+
+func (c Config) GetWatchBufferSize() int {
+	if v := c.WatchBufferSize; v > 0 {
+		return v
+	}
+	return 100
+}
@@ -0,0 +1,96 @@
+package generic
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultTableName is the name of the table of the log, unless the config
+	// sets another one.
+	DefaultTableName = "kine"
+
+	// maxNameLength is the longest table or schema name. The longest name
+	// derived from the table name, of its unique index, has to stay within the
+	// 63 characters that Postgres allows.
+	maxNameLength = 32
+)
+
+var (
+	// namePattern matches the table and schema names that are accepted. Names
+	// are rendered into statements unquoted, so only lower case letters,
+	// digits and underscores are allowed, which no database folds or reads as
+	// anything but an identifier.
+	namePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+	// identifierPattern matches the identifiers that the statements of the
+	// dialects are written with: the tables and sequence, which are
+	// qualified by the schema, and the indexes, which live in the schema of
+	// their table.
+	identifierPattern = regexp.MustCompile(`\bkine(_leases|_id_seq|_name_index|_name_id_index|_name_prev_revision_uindex|_prev_revision_name_uindex)?\b`)
+)
+
+// validateNames checks that the table and schema names can be rendered into
+// statements as they are.
+func (c *Config) validateNames() error {
+	for _, name := range []struct {
+		kind, value string
+	}{
+		{"table", c.TableName},
+		{"schema", c.SchemaName},
+	} {
+		if name.value == "" {
+			continue
+		}
+		if len(name.value) > maxNameLength || !namePattern.MatchString(name.value) {
+			return fmt.Errorf("invalid %s name %q, must be up to %d lower case letters, digits and underscores, not starting with a digit", name.kind, name.value, maxNameLength)
+		}
+	}
+	return nil
+}
+
+// GetTableName returns the name of the table of the log, without its schema.
+func (c Config) GetTableName() string {
+	if c.TableName != "" {
+		return c.TableName
+	}
+	return DefaultTableName
+}
+
+// Table returns the name of the table of the log, qualified by its schema if
+// the config sets one.
+func (c Config) Table() string {
+	return c.qualify(c.GetTableName())
+}
+
+// DefaultNames reports whether the config names the default kine table in
+// the default schema.
+func (c Config) DefaultNames() bool {
+	return c.GetTableName() == DefaultTableName && c.SchemaName == ""
+}
+
+// Render returns the statement with the identifiers of the default kine
+// table, its leases table, sequence and indexes replaced by those of the
+// configured table and schema. Statements are returned as they are for the
+// defaults.
+func (c Config) Render(sql string) string {
+	if c.DefaultNames() {
+		return sql
+	}
+	table := c.GetTableName()
+	return identifierPattern.ReplaceAllStringFunc(sql, func(identifier string) string {
+		suffix := strings.TrimPrefix(identifier, DefaultTableName)
+		if strings.HasSuffix(suffix, "index") {
+			return table + suffix
+		}
+		return c.qualify(table + suffix)
+	})
+}
+
+func (c Config) qualify(name string) string {
+	if c.SchemaName == "" {
+		return name
+	}
+	return c.SchemaName + "." + name
+}
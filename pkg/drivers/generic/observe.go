@@ -0,0 +1,200 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer of the spans of SQL statements.
+const TracerName = "github.com/rancher/kine/pkg/drivers/generic"
+
+// otherStatement is the statement label of SQL that is not held by a field
+// of the Generic, such as the statements of migrations.
+const otherStatement = "other"
+
+// slowArgLength is the length that string arguments of slow statements are
+// truncated to in the log.
+const slowArgLength = 64
+
+// sqlMetrics are the metrics of the statements run on the database, labeled
+// with the name of the Generic field that holds their SQL.
+type sqlMetrics struct {
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+func newSQLMetrics(logger logging.Logger, registerer prometheus.Registerer) *sqlMetrics {
+	return &sqlMetrics{
+		duration: metrics.Register(logger, registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "sql",
+			Name:      "duration_seconds",
+			Help:      "Latency of SQL statements, including retries.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"statement"})).(*prometheus.HistogramVec),
+		errors: metrics.Register(logger, registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "sql",
+			Name:      "errors_total",
+			Help:      "Number of SQL statements that failed.",
+		}, []string{"statement"})).(*prometheus.CounterVec),
+	}
+}
+
+// metrics returns the metrics of the statements, or nil if they are not
+// collected. They are created on first use, once the driver has set the
+// config and the SQL of the Generic, along with those of the connection pool.
+func (d *Generic) metrics() *sqlMetrics {
+	d.metricsOnce.Do(func() {
+		if d.MetricsRegisterer != nil {
+			d.sqlMetrics = newSQLMetrics(d.Logger, d.MetricsRegisterer)
+			metrics.Register(d.Logger, d.MetricsRegisterer, poolCollector{db: d.DB, config: d.pool})
+		}
+	})
+	return d.sqlMetrics
+}
+
+// observe records the latency of the statement that started at start, and
+// whether it failed, logs it if it took longer than SlowQueryThreshold, and
+// traces it as a span of ctx. A query that found no rows did not fail. The
+// result is that of statements that were executed, and is nil for queries.
+func (d *Generic) observe(ctx context.Context, query string, args []interface{}, start time.Time, result sql.Result, err error) {
+	end := time.Now()
+	duration := end.Sub(start)
+	slow := d.SlowQueryThreshold > 0 && duration >= d.SlowQueryThreshold
+	m := d.metrics()
+	if m == nil && !slow && d.TracerProvider == nil {
+		return
+	}
+
+	name := d.statement(query)
+	if d.TracerProvider != nil {
+		d.trace(ctx, name, start, end, result, err)
+	}
+	if m != nil {
+		m.duration.WithLabelValues(name).Observe(duration.Seconds())
+		if err != nil && err != sql.ErrNoRows {
+			m.errors.WithLabelValues(name).Inc()
+		}
+	}
+	if slow {
+		d.logSlow(name, duration, args, result, err)
+	}
+}
+
+// logSlow logs the slow statement with its name, duration, arguments, the
+// prefix of the key it is run for and the rows it affected as fields of the
+// entry, along with the code of the error it failed with.
+func (d *Generic) logSlow(name string, duration time.Duration, args []interface{}, result sql.Result, err error) {
+	fields := logging.Fields{
+		"statement": name,
+		"duration":  duration.Seconds(),
+		"args":      slowArgs(args),
+	}
+	for _, arg := range args {
+		if key, ok := arg.(string); ok {
+			fields["key"] = logging.KeyPrefix(key)
+			break
+		}
+	}
+	if result != nil {
+		if rows, err := result.RowsAffected(); err == nil {
+			fields["rows"] = rows
+		}
+	}
+	if err != nil {
+		for key, value := range d.errorFields(err) {
+			fields[key] = value
+		}
+	}
+	logging.WithFields(d.Logger, fields).Warnf("Slow SQL statement %s took %s", name, duration)
+}
+
+// trace records the statement as a span that started at start and ended at
+// end.
+func (d *Generic) trace(ctx context.Context, name string, start, end time.Time, result sql.Result, err error) {
+	_, span := d.TracerProvider.Tracer(TracerName).Start(ctx, "SQL "+name,
+		trace.WithTimestamp(start),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("kine.sql.statement", name)),
+	)
+	if result != nil {
+		if rows, err := result.RowsAffected(); err == nil {
+			span.SetAttributes(attribute.Int64("kine.sql.rows_affected", rows))
+		}
+	}
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// slowArgs returns the arguments of a statement as they are logged. Values
+// are never logged, only their size, and keys are truncated.
+func slowArgs(args []interface{}) []interface{} {
+	logged := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case []byte:
+			logged[i] = fmt.Sprintf("<%d bytes>", len(arg))
+		case string:
+			if len(arg) > slowArgLength {
+				arg = arg[:slowArgLength] + "..."
+			}
+			logged[i] = arg
+		default:
+			logged[i] = arg
+		}
+	}
+	return logged
+}
+
+// statement returns the name of the field of the Generic that holds the SQL,
+// so that statements are known by names that are few and readable.
+func (d *Generic) statement(query string) string {
+	d.statementsLock.Lock()
+	defer d.statementsLock.Unlock()
+
+	if name, ok := d.statements[query]; ok {
+		return name
+	}
+	name := otherStatement
+	v := reflect.ValueOf(d).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath == "" && field.Type.Kind() == reflect.String && strings.Contains(field.Name, "SQL") && v.Field(i).String() == query {
+			name = field.Name
+			break
+		}
+	}
+	if d.statements == nil {
+		d.statements = map[string]string{}
+	}
+	d.statements[query] = name
+	return name
+}
+
+// errorFields returns the log fields of the error: the error, and its code
+// if the driver reports one for it. ErrCode returns the message of errors
+// that have no code, which is not logged twice.
+func (d *Generic) errorFields(err error) logging.Fields {
+	fields := logging.Fields{"error": err}
+	if d.ErrCode != nil {
+		if code := d.ErrCode(err); code != err.Error() {
+			fields["code"] = code
+		}
+	}
+	return fields
+}
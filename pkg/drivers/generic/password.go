@@ -0,0 +1,90 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+)
+
+// PasswordFunc returns the password that a new connection to the database
+// authenticates with. It is called for every connection, so that it can hand
+// out short lived tokens, such as those of AWS RDS IAM authentication.
+type PasswordFunc func(ctx context.Context) (password string, err error)
+
+// passwordConnector opens every connection with a data source name rendered
+// with a fresh password, rather than with one fixed when the pool was opened.
+type passwordConnector struct {
+	driver         driver.Driver
+	password       PasswordFunc
+	dataSourceName func(password string) (string, error)
+}
+
+// NewPasswordConnector returns a connector for the named driver that gets a
+// password from the func for every new connection, and connects with the
+// data source name that dataSourceName renders with it.
+func NewPasswordConnector(driverName string, password PasswordFunc, dataSourceName func(password string) (string, error)) (driver.Connector, error) {
+	// the driver is only looked up, nothing is connected to
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return &passwordConnector{
+		driver:         db.Driver(),
+		password:       password,
+		dataSourceName: dataSourceName,
+	}, nil
+}
+
+func (c *passwordConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	password, err := c.password(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the password of the connection: %w", err)
+	}
+	dataSourceName, err := c.dataSourceName(password)
+	if err != nil {
+		return nil, err
+	}
+	if driverCtx, ok := c.driver.(driver.DriverContext); ok {
+		connector, err := driverCtx.OpenConnector(dataSourceName)
+		if err != nil {
+			return nil, err
+		}
+		return connector.Connect(ctx)
+	}
+	return c.driver.Open(dataSourceName)
+}
+
+func (c *passwordConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// OpenPassword is like Open, but if the config has a password func, opens
+// connections with the data source name that dataSourceName renders with a
+// fresh password, instead of with the data source name as it is.
+func OpenPassword(ctx context.Context, driverName, dsn string, dataSourceName func(password string) (string, error), config Config, paramCharacter string, numbered bool) (*Generic, error) {
+	if config.PasswordFunc == nil {
+		return Open(ctx, driverName, dsn, config, paramCharacter, numbered)
+	}
+	connector, err := NewPasswordConnector(driverName, config.PasswordFunc, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	return OpenConnector(ctx, connector, config, paramCharacter, numbered)
+}
+
+// WithPassword returns the data source name rendered with a password from the
+// func of the config, or the data source name as it is if there is none. It
+// is for the connections that drivers make outside of the pool.
+func (c Config) WithPassword(ctx context.Context, dsn string, dataSourceName func(password string) (string, error)) (string, error) {
+	if c.PasswordFunc == nil {
+		return dsn, nil
+	}
+	password, err := c.PasswordFunc(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the password of the connection: %w", err)
+	}
+	return dataSourceName(password)
+}
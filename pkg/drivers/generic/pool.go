@@ -0,0 +1,145 @@
+package generic
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/metrics"
+)
+
+// ConnectionPoolConfig sets the pool of connections to the database. Fields
+// that are zero take the default of the dialect.
+type ConnectionPoolConfig struct {
+	// MaxOpen is the number of connections open at once, unlimited if it is
+	// negative.
+	MaxOpen int
+	// MaxIdle is the number of idle connections kept open for reuse, none if
+	// it is negative.
+	MaxIdle int
+	// MaxLifetime is how long connections are reused before they are closed,
+	// forever if it is negative.
+	MaxLifetime time.Duration
+}
+
+// DefaultConnectionPoolConfig is the pool of the dialects that do not have
+// defaults of their own.
+var DefaultConnectionPoolConfig = ConnectionPoolConfig{
+	MaxOpen:     5,
+	MaxIdle:     5,
+	MaxLifetime: 60 * time.Second,
+}
+
+// WithDefaults returns the config, with the fields that are zero set from
+// defaults.
+func (c ConnectionPoolConfig) WithDefaults(defaults ConnectionPoolConfig) ConnectionPoolConfig {
+	if c.MaxOpen == 0 {
+		c.MaxOpen = defaults.MaxOpen
+	}
+	if c.MaxIdle == 0 {
+		c.MaxIdle = defaults.MaxIdle
+	}
+	if c.MaxLifetime == 0 {
+		c.MaxLifetime = defaults.MaxLifetime
+	}
+	return c
+}
+
+// InEffect returns the config that the pool is configured with: that with
+// the fields that are zero set from DefaultConnectionPoolConfig, and no more
+// idle connections than open ones.
+func (c ConnectionPoolConfig) InEffect() ConnectionPoolConfig {
+	c = c.WithDefaults(DefaultConnectionPoolConfig)
+	if c.MaxIdle > c.MaxOpen && c.MaxOpen > 0 {
+		// the database would close the surplus anyway
+		c.MaxIdle = c.MaxOpen
+	}
+	return c
+}
+
+// configureConnectionPooling applies the config to the pool of the database,
+// and returns the config in effect.
+func configureConnectionPooling(logger logging.Logger, db *sql.DB, config ConnectionPoolConfig) ConnectionPoolConfig {
+	config = config.InEffect()
+	db.SetMaxOpenConns(config.MaxOpen)
+	db.SetMaxIdleConns(config.MaxIdle)
+	db.SetConnMaxLifetime(config.MaxLifetime)
+
+	maxOpen, maxLifetime := strconv.Itoa(config.MaxOpen), config.MaxLifetime.String()
+	if config.MaxOpen < 0 {
+		maxOpen = "unlimited"
+	}
+	if config.MaxLifetime < 0 {
+		maxLifetime = "forever"
+	}
+	logger.Infof("Configured database connection pool: max open %s, max idle %d, max lifetime %s", maxOpen, config.idle(), maxLifetime)
+	return config
+}
+
+// idle returns the number of idle connections kept open.
+func (c ConnectionPoolConfig) idle() int {
+	if c.MaxIdle < 0 {
+		return 0
+	}
+	return c.MaxIdle
+}
+
+var (
+	connectionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "sql", "connections"),
+		"Number of connections to the database, by whether they are in use or idle.",
+		[]string{"state"}, nil)
+	maxOpenConnectionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "sql", "max_open_connections"),
+		"Maximum number of connections open to the database at once, or zero if unlimited.",
+		nil, nil)
+	maxIdleConnectionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "sql", "max_idle_connections"),
+		"Maximum number of idle connections kept open to the database.",
+		nil, nil)
+	connectionMaxLifetimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "sql", "connection_max_lifetime_seconds"),
+		"Time connections to the database are reused for, or zero if forever.",
+		nil, nil)
+	connectionWaitsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "sql", "connection_waits_total"),
+		"Number of times a statement waited for a connection to the database.",
+		nil, nil)
+	connectionWaitDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "sql", "connection_wait_seconds_total"),
+		"Total time statements waited for a connection to the database.",
+		nil, nil)
+)
+
+// poolCollector collects the configuration and the stats of the pool of
+// connections to the database.
+type poolCollector struct {
+	db     *sql.DB
+	config ConnectionPoolConfig
+}
+
+func (c poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectionsDesc
+	ch <- maxOpenConnectionsDesc
+	ch <- maxIdleConnectionsDesc
+	ch <- connectionMaxLifetimeDesc
+	ch <- connectionWaitsDesc
+	ch <- connectionWaitDurationDesc
+}
+
+func (c poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.db.Stats()
+	ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(stats.InUse), "in_use")
+	ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(stats.Idle), "idle")
+	ch <- prometheus.MustNewConstMetric(maxOpenConnectionsDesc, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(maxIdleConnectionsDesc, prometheus.GaugeValue, float64(c.config.idle()))
+	var maxLifetime time.Duration
+	if c.config.MaxLifetime > 0 {
+		maxLifetime = c.config.MaxLifetime
+	}
+	ch <- prometheus.MustNewConstMetric(connectionMaxLifetimeDesc, prometheus.GaugeValue, maxLifetime.Seconds())
+	ch <- prometheus.MustNewConstMetric(connectionWaitsDesc, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(connectionWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds())
+}
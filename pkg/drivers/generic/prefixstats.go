@@ -0,0 +1,65 @@
+package generic
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rancher/kine/pkg/server"
+)
+
+// prefixSQL is the default PrefixSQL, which finds the third slash of the name
+// from the position of the second, and that from the position of the first.
+const prefixSQL = `CASE WHEN kv.name LIKE '%/%/%/%'
+	THEN SUBSTR(kv.name, 1,
+		INSTR(kv.name, '/')
+		+ INSTR(SUBSTR(kv.name, INSTR(kv.name, '/') + 1), '/')
+		+ INSTR(SUBSTR(kv.name, INSTR(kv.name, '/') + INSTR(SUBSTR(kv.name, INSTR(kv.name, '/') + 1), '/') + 1), '/'))
+	ELSE '' END`
+
+// prefixStatsSQL groups the rows by the prefix of their names, counting the
+// live keys, which are those whose last row is not a delete, and the size of
+// their values, and all the rows and their sizes. It is formatted with the
+// expression of the prefix and the function that returns the size of a value.
+var prefixStatsSQL = `
+	SELECT pkv.prefix, SUM(pkv.live), SUM(pkv.live * pkv.value_size), COUNT(*), SUM(pkv.row_size)
+	FROM (
+		SELECT %[1]s AS prefix,
+			CASE WHEN lkv.id IS NOT NULL AND kv.deleted = 0 THEN 1 ELSE 0 END AS live,
+			COALESCE(%[2]s(kv.value), 0) AS value_size,
+			COALESCE(%[2]s(kv.name), 0) + COALESCE(%[2]s(kv.value), 0) + COALESCE(%[2]s(kv.old_value), 0) AS row_size
+		FROM kine AS kv
+			LEFT JOIN (
+				SELECT MAX(mkv.id) AS id
+				FROM kine AS mkv
+				GROUP BY mkv.name) AS lkv
+				ON lkv.id = kv.id
+		WHERE kv.name != 'compact_rev_key') AS pkv
+	GROUP BY pkv.prefix
+	ORDER BY pkv.prefix`
+
+// PrefixStats groups the rows of the table by the prefix of the first two
+// segments of their names in a single statement, which scans the whole table.
+func (d *Generic) PrefixStats(ctx context.Context) (_ []server.PrefixStat, err error) {
+	ctx, deadline := withTimeout(ctx, d.listTimeout())
+	defer deadline.done(&err)
+
+	rows, err := d.DB.QueryContext(ctx, d.Render(fmt.Sprintf(prefixStatsSQL, d.PrefixSQL, d.LengthSQL)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to group prefixes: %w", err)
+	}
+	defer rows.Close()
+
+	var stats []server.PrefixStat
+	for rows.Next() {
+		var (
+			prefix []byte
+			stat   server.PrefixStat
+		)
+		if err := rows.Scan(&prefix, &stat.Keys, &stat.Bytes, &stat.Rows, &stat.RowBytes); err != nil {
+			return nil, err
+		}
+		stat.Prefix = string(prefix)
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
@@ -0,0 +1,120 @@
+package generic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/server"
+)
+
+func (c Config) GetQuiesceTimeout() time.Duration {
+	if v := c.QuiesceTimeout; v > 0 {
+		return v
+	}
+	return time.Minute
+}
+
+// Quiesce takes the lock that writes are serialized with, once the writes,
+// lease updates and compaction batches in flight have released it, and
+// flushes the database into its main file. Writes then wait until Resume is
+// called, or until the quiesce timeout has passed, while reads and watches
+// are served as usual. It is only supported by dialects that serialize writes
+// with LockWrites and flush their files. The wait for the writes in flight
+// ends with ctx, or with the write timeout, and another Quiesce or a Resume
+// meanwhile fails rather than waiting on it.
+func (d *Generic) Quiesce(ctx context.Context) (err error) {
+	if !d.LockWrites || d.FlushFile == nil {
+		return errors.New("driver does not support quiesce")
+	}
+
+	d.quiesceLock.Lock()
+	if d.quiescing || d.quiesced != nil {
+		d.quiesceLock.Unlock()
+		return server.ErrQuiesced
+	}
+	d.quiescing = true
+	d.quiesceLock.Unlock()
+	defer func() {
+		d.quiesceLock.Lock()
+		d.quiescing = false
+		d.quiesceLock.Unlock()
+	}()
+
+	start := time.Now()
+	ctx, deadline := withTimeout(ctx, d.writeTimeout())
+	defer deadline.done(&err)
+	if err := d.lockWrites(ctx); err != nil {
+		return fmt.Errorf("quiesce: %w", err)
+	}
+	if err := d.FlushFile(ctx); err != nil {
+		d.Unlock()
+		return fmt.Errorf("quiesce: %w", err)
+	}
+
+	d.quiesceLock.Lock()
+	defer d.quiesceLock.Unlock()
+	timeout := d.GetQuiesceTimeout()
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		d.quiesceLock.Lock()
+		defer d.quiesceLock.Unlock()
+		// the writes were resumed, and maybe quiesced again, before the
+		// timer could stop
+		if d.quiesced != timer {
+			return
+		}
+		d.Logger.Warnf("Resuming writes that were quiesced for longer than %s", timeout)
+		d.resume()
+	})
+	d.quiesced, d.quiescedAt = timer, time.Now()
+	duration := time.Since(start)
+	logging.WithFields(d.Logger, logging.Fields{"duration": duration.Seconds()}).Infof("Quiesced writes in %s, for up to %s", duration, timeout)
+	return nil
+}
+
+// lockWrites takes the lock that writes are serialized with, or returns the
+// error of ctx if it is done first. A lock taken after that is released
+// right away.
+func (d *Generic) lockWrites(ctx context.Context) error {
+	locked := make(chan struct{})
+	abandoned := make(chan struct{})
+	go func() {
+		d.Lock()
+		select {
+		case locked <- struct{}{}:
+		case <-abandoned:
+			d.Unlock()
+		}
+	}()
+
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		close(abandoned)
+		return ctx.Err()
+	}
+}
+
+// Resume releases the writes held by Quiesce.
+func (d *Generic) Resume() error {
+	d.quiesceLock.Lock()
+	defer d.quiesceLock.Unlock()
+	if d.quiesced == nil {
+		return server.ErrNotQuiesced
+	}
+	d.quiesced.Stop()
+	d.resume()
+	return nil
+}
+
+// resume releases the writes held by Quiesce, with the quiesce lock held.
+func (d *Generic) resume() {
+	duration := time.Since(d.quiescedAt)
+	d.quiesced = nil
+	d.Unlock()
+	logging.WithFields(d.Logger, logging.Fields{"duration": duration.Seconds()}).Infof("Resumed writes quiesced for %s", duration)
+}
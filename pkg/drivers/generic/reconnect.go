@@ -0,0 +1,85 @@
+package generic
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/rancher/kine/pkg/logging"
+)
+
+// Statements that fail because the connection to the database was lost are
+// run again on a new connection, as when the database restarts or fails
+// over, waiting reconnectBackoff before the first retry and twice as long
+// before each next one, up to maxReconnectBackoff, for reconnectTimeout at
+// most.
+const (
+	reconnectBackoff    = 50 * time.Millisecond
+	maxReconnectBackoff = 2 * time.Second
+	reconnectTimeout    = 30 * time.Second
+)
+
+// connectionError tells whether err means that the connection to the
+// database was lost or could not be made, and if so, whether the database
+// cannot have run the statement, because it was never sent or was refused.
+func (d *Generic) connectionError(err error) (lost, notRun bool) {
+	if err == nil {
+		return false, false
+	}
+	if d.ErrCode != nil {
+		if notRun, ok := d.ConnectionErrCodes[d.ErrCode(err)]; ok {
+			return true, notRun
+		}
+	}
+
+	switch {
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, syscall.ECONNREFUSED):
+		// drivers only return ErrBadConn for statements they did not send
+		return true, true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return true, false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true, false
+	}
+	return false, false
+}
+
+// reconnect reports whether a statement that started at start and failed
+// with err is run again because the connection to the database was lost,
+// after waiting for the backoff, which it doubles for the next retry. Reads
+// are run again whenever the connection was lost, but writes only if the
+// database cannot have run them. It gives up once ctx is done or the
+// statement has been retried for reconnectTimeout.
+func (d *Generic) reconnect(ctx context.Context, err error, write bool, start time.Time, backoff *time.Duration) bool {
+	lost, notRun := d.connectionError(err)
+	if !lost || (write && !notRun) || time.Since(start) > reconnectTimeout {
+		return false
+	}
+
+	switch {
+	case *backoff == 0:
+		*backoff = reconnectBackoff
+	case *backoff < maxReconnectBackoff:
+		*backoff *= 2
+		if *backoff > maxReconnectBackoff {
+			*backoff = maxReconnectBackoff
+		}
+	}
+	logging.WithFields(d.Logger, d.errorFields(err)).Warnf("Lost connection to the database, retrying in %s", *backoff)
+
+	timer := time.NewTimer(*backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,165 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/rancher/kine/pkg/logging"
+)
+
+// replicaDownInterval is how long a read replica that failed a read is not
+// read from, so that reads do not keep waiting on a replica that is gone.
+const replicaDownInterval = 10 * time.Second
+
+// replica is a read replica of the database, such as a streaming replica of
+// Postgres, that reads which tolerate its lag are answered by.
+type replica struct {
+	// rev is the latest revision the replica was seen to have caught up to,
+	// and downUntil the time in unix nanoseconds until which it is not read
+	// from. Both are accessed atomically.
+	rev       int64
+	downUntil int64
+
+	db *sql.DB
+}
+
+type replicaReadKey struct{}
+
+// WithReplicaRead marks reads of keys made with the returned context as
+// answerable by a read replica that has caught up to the revision, or by any
+// replica if the revision is zero. Reads with other contexts, and reads for
+// which no replica qualifies, are answered by the primary.
+func WithReplicaRead(ctx context.Context, revision int64) context.Context {
+	return context.WithValue(ctx, replicaReadKey{}, revision)
+}
+
+// OpenReplica opens the read replica at the data source name, with the same
+// connection pool as the primary database. If the config has a password
+// func, connections are opened with the data source name that dataSourceName
+// renders with a fresh password. The replica is not connected to until it is
+// read from, so a replica that is down does not keep kine from starting.
+func (d *Generic) OpenReplica(driverName, dsn string, dataSourceName func(password string) (string, error)) error {
+	var db *sql.DB
+	if d.PasswordFunc != nil {
+		connector, err := NewPasswordConnector(driverName, d.PasswordFunc, dataSourceName)
+		if err != nil {
+			return err
+		}
+		db = sql.OpenDB(connector)
+	} else {
+		var err error
+		if db, err = sql.Open(driverName, dsn); err != nil {
+			return err
+		}
+	}
+	configureConnectionPooling(d.Logger, db, d.pool)
+	d.replicas = append(d.replicas, &replica{db: db})
+	return nil
+}
+
+// HasReplicas reports whether reads may be answered by read replicas.
+func (d *Generic) HasReplicas() bool {
+	return len(d.replicas) > 0
+}
+
+// replicaFor returns a replica that reads made with ctx may be answered by,
+// taking turns between the replicas, or nil if they are answered by the
+// primary.
+func (d *Generic) replicaFor(ctx context.Context) *replica {
+	minRev, ok := ctx.Value(replicaReadKey{}).(int64)
+	if !ok || len(d.replicas) == 0 {
+		return nil
+	}
+
+	next := int(atomic.AddUint32(&d.nextReplica, 1))
+	now := time.Now().UnixNano()
+	for i := range d.replicas {
+		r := d.replicas[(next+i)%len(d.replicas)]
+		if atomic.LoadInt64(&r.downUntil) > now {
+			continue
+		}
+		if d.caughtUp(ctx, r, minRev) {
+			return r
+		}
+	}
+	return nil
+}
+
+// caughtUp reports whether the replica has caught up to the revision, which
+// is only queried if it was not seen to have caught up to it before.
+func (d *Generic) caughtUp(ctx context.Context, r *replica, minRev int64) bool {
+	if minRev == 0 || atomic.LoadInt64(&r.rev) >= minRev {
+		return true
+	}
+
+	var rev sql.NullInt64
+	if err := r.db.QueryRowContext(ctx, d.currentRevisionSQL).Scan(&rev); err != nil {
+		d.replicaFailed(ctx, r, err)
+		return false
+	}
+	raiseRevision(&r.rev, rev.Int64)
+	return rev.Int64 >= minRev
+}
+
+// replicaFailed takes the replica out of turn for replicaDownInterval after
+// it failed a read, unless the read failed because ctx is done.
+func (d *Generic) replicaFailed(ctx context.Context, r *replica, err error) {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	atomic.StoreInt64(&r.downUntil, time.Now().Add(replicaDownInterval).UnixNano())
+	logging.WithFields(d.Logger, d.errorFields(err)).Warnf("Read replica failed, reading from the primary for %s", replicaDownInterval)
+}
+
+// queryRead is like query, but runs the read on a replica if ctx allows it.
+// Reads that the replica fails are run on the primary instead.
+func (d *Generic) queryRead(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+	if r := d.replicaFor(ctx); r != nil {
+		start := time.Now()
+		rows, err := r.db.QueryContext(ctx, sql, args...)
+		d.observe(ctx, sql, args, start, nil, err)
+		if err == nil {
+			return rows, nil
+		}
+		d.replicaFailed(ctx, r, err)
+	}
+	return d.query(ctx, sql, args...)
+}
+
+// queryRowRead is like queryRowPrepared, but runs the read on a replica if
+// ctx allows it, as queryRead does.
+func (d *Generic) queryRowRead(ctx context.Context, sql string, prepared *sql.Stmt, args ...interface{}) *sql.Row {
+	if r := d.replicaFor(ctx); r != nil {
+		start := time.Now()
+		row := r.db.QueryRowContext(ctx, sql, args...)
+		d.observe(ctx, sql, args, start, nil, row.Err())
+		if row.Err() == nil {
+			return row
+		}
+		d.replicaFailed(ctx, r, row.Err())
+	}
+	return d.queryRowPrepared(ctx, sql, prepared, args...)
+}
+
+// closeReplicas closes the databases of the read replicas.
+func (d *Generic) closeReplicas() error {
+	var err error
+	for _, r := range d.replicas {
+		if closeErr := r.db.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func raiseRevision(addr *int64, rev int64) {
+	for {
+		old := atomic.LoadInt64(addr)
+		if rev <= old || atomic.CompareAndSwapInt64(addr, old, rev) {
+			return
+		}
+	}
+}
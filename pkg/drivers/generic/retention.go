@@ -0,0 +1,335 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrefixRetention overrides the retention of automatic compaction for the
+// keys with a prefix whose old revisions nobody reads, such as the events of
+// Kubernetes at /registry/events/, which churn enough to make up most of the
+// history. Their superseded rows and deletes are trimmed once they are older
+// than KeepRevisions revisions, or than KeepDuration, rather than once the
+// compaction of the whole keyspace passes them. Exactly one of the two is set,
+// and only retentions shorter than that of compaction trim anything.
+type PrefixRetention struct {
+	Prefix        string
+	KeepRevisions int64
+	KeepDuration  time.Duration
+}
+
+// ParsePrefixRetention parses a retention of the form prefix=revisions or
+// prefix=duration, such as /registry/events/=10000 or /registry/events/=1h.
+func ParsePrefixRetention(s string) (PrefixRetention, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return PrefixRetention{}, fmt.Errorf("prefix retention %q is not of the form prefix=revisions or prefix=duration", s)
+	}
+	r := PrefixRetention{Prefix: s[:i]}
+	keep := s[i+1:]
+	if revisions, err := strconv.ParseInt(keep, 10, 64); err == nil {
+		r.KeepRevisions = revisions
+	} else if duration, err := time.ParseDuration(keep); err == nil {
+		r.KeepDuration = duration
+	} else {
+		return PrefixRetention{}, fmt.Errorf("prefix retention %q keeps neither a number of revisions nor a duration", s)
+	}
+	return r, r.Validate()
+}
+
+// Validate reports whether the retention has a prefix and keeps either a
+// number of revisions or a duration.
+func (r PrefixRetention) Validate() error {
+	switch {
+	case r.Prefix == "":
+		return fmt.Errorf("prefix retention %s has no prefix", r)
+	case r.KeepRevisions < 0 || r.KeepDuration < 0:
+		return fmt.Errorf("prefix retention %s keeps a negative number of revisions or duration", r)
+	case (r.KeepRevisions > 0) == (r.KeepDuration > 0):
+		return fmt.Errorf("prefix retention %s must keep either a number of revisions or a duration", r)
+	}
+	return nil
+}
+
+func (r PrefixRetention) String() string {
+	if r.KeepDuration > 0 {
+		return r.Prefix + "=" + r.KeepDuration.String()
+	}
+	return r.Prefix + "=" + strconv.FormatInt(r.KeepRevisions, 10)
+}
+
+// TrimRevision returns the revision up to which the history of the prefix is
+// trimmed at the current revision and time, or zero if the clock has not yet
+// recorded a revision as old as the duration kept.
+func (r PrefixRetention) TrimRevision(current int64, clock *RevisionClock, now time.Time) int64 {
+	if r.KeepRevisions > 0 {
+		return current - r.KeepRevisions
+	}
+	return clock.At(now.Add(-r.KeepDuration))
+}
+
+// Overlaps reports whether the keys with the prefix, or the key, include keys
+// of the retention, which is the case for the keys below its prefix and for
+// the prefixes above it.
+func (r PrefixRetention) Overlaps(prefix string) bool {
+	return overlaps(prefix, r.Prefix)
+}
+
+func overlaps(a, b string) bool {
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// RevisionClock records the revisions that were current at the times they
+// were recorded, for the revision that was current a while ago. Recordings
+// older than its span are forgotten, but for the last of them. It is not safe
+// for concurrent use.
+type RevisionClock struct {
+	span    time.Duration
+	samples []revisionSample
+}
+
+type revisionSample struct {
+	at       time.Time
+	revision int64
+}
+
+// NewRevisionClock returns a clock that tells the revisions of up to the
+// longest duration that the retentions keep.
+func NewRevisionClock(retention []PrefixRetention) *RevisionClock {
+	c := &RevisionClock{}
+	for _, r := range retention {
+		if r.KeepDuration > c.span {
+			c.span = r.KeepDuration
+		}
+	}
+	return c
+}
+
+// Record records the revision as current at the time.
+func (c *RevisionClock) Record(now time.Time, revision int64) {
+	c.samples = append(c.samples, revisionSample{at: now, revision: revision})
+	horizon := now.Add(-c.span)
+	i := 0
+	for i+1 < len(c.samples) && !c.samples[i+1].at.After(horizon) {
+		i++
+	}
+	c.samples = c.samples[i:]
+}
+
+// At returns the last revision recorded at or before the time, or zero if
+// there is none.
+func (c *RevisionClock) At(t time.Time) int64 {
+	var revision int64
+	for _, sample := range c.samples {
+		if sample.at.After(t) {
+			break
+		}
+		revision = sample.revision
+	}
+	return revision
+}
+
+// TrimRevisions are the revisions up to which the history of prefixes was
+// trimmed, by prefix. They are kept as JSON in the value of the row of the
+// compact revision, so that all kine that share the database cancel the
+// watches of trimmed revisions.
+type TrimRevisions map[string]int64
+
+// CompactRevision returns the revision up to which the history of the keys
+// with the prefix, or of the key, may be gone: the trim revision of the
+// prefixes that it overlaps, or the compact revision if it is later.
+func (t TrimRevisions) CompactRevision(prefix string, compact int64) int64 {
+	for trimmed, revision := range t {
+		if revision > compact && overlaps(prefix, trimmed) {
+			compact = revision
+		}
+	}
+	return compact
+}
+
+// TrimTargets returns the trim revisions that the retentions raise at the
+// current revision and time, over the trim revisions and the compact revision,
+// along with the revisions that each prefix is trimmed from.
+func TrimTargets(retention []PrefixRetention, trims TrimRevisions, compact, current int64, clock *RevisionClock, now time.Time) (raise TrimRevisions, from map[string]int64) {
+	raise, from = TrimRevisions{}, map[string]int64{}
+	for _, r := range retention {
+		trimRev := compact
+		if rev := trims[r.Prefix]; rev > trimRev {
+			trimRev = rev
+		}
+		if target := r.TrimRevision(current, clock, now); target > trimRev {
+			raise[r.Prefix] = target
+			from[r.Prefix] = trimRev
+		}
+	}
+	return raise, from
+}
+
+// ParseTrimRevisions parses the trim revisions kept as JSON, or returns none
+// if the value is empty.
+func ParseTrimRevisions(value []byte) (TrimRevisions, error) {
+	trims := TrimRevisions{}
+	if len(value) == 0 {
+		return trims, nil
+	}
+	if err := json.Unmarshal(value, &trims); err != nil {
+		return nil, fmt.Errorf("failed to parse trim revisions: %w", err)
+	}
+	return trims, nil
+}
+
+var (
+	// trimSQL deletes the rows of a range of names that compactSQL deletes
+	// from the whole table.
+	trimSQL = `
+		DELETE FROM kine AS kv
+		WHERE
+			kv.id IN (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.created = 0 AND
+					kp.prev_revision != 0 AND
+					kp.id <= ? AND
+					kp.id > ? AND
+					kp.name >= ? AND
+					kp.name < ?
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= ? AND
+					kd.id > ? AND
+					kd.name >= ? AND
+					kd.name < ?
+			)`
+
+	trimRevisionsSQL = `
+		SELECT crkv.value
+		FROM kine AS crkv
+		WHERE crkv.name = 'compact_rev_key'`
+
+	// lockTrimRevisionsSQL locks the row of the compact revision, so that
+	// the trim revisions are read and raised by one kine at a time.
+	lockTrimRevisionsSQL = `
+		UPDATE kine
+		SET value = value
+		WHERE name = 'compact_rev_key'`
+
+	updateTrimRevisionsSQL = `
+		UPDATE kine
+		SET value = ?
+		WHERE name = 'compact_rev_key'`
+)
+
+// GetPrefixRetention returns the retentions of the prefixes that automatic
+// compaction trims earlier.
+func (c Config) GetPrefixRetention() []PrefixRetention {
+	return c.PrefixRetention
+}
+
+// GetTrimRevisions returns the revisions up to which the history of prefixes
+// was trimmed.
+func (d *Generic) GetTrimRevisions(ctx context.Context) (_ TrimRevisions, err error) {
+	ctx, deadline := withTimeout(ctx, d.readTimeout())
+	defer deadline.done(&err)
+
+	var value []byte
+	if err := d.queryRow(ctx, d.trimRevisionsSQL).Scan(&value); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return ParseTrimRevisions(value)
+}
+
+// RaiseTrimRevisions records the trim revisions of the prefixes that are
+// later than those recorded, and forgets those that the compact revision
+// passed, in a transaction that holds off the other kine that raise them. It
+// returns the trim revisions recorded.
+func (d *Generic) RaiseTrimRevisions(ctx context.Context, raise TrimRevisions, compact int64) (_ TrimRevisions, err error) {
+	ctx, deadline := withTimeout(ctx, d.writeTimeout())
+	defer deadline.done(&err)
+
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.execute(ctx, d.lockTrimRevisionsSQL); err != nil {
+		return nil, err
+	}
+	var value []byte
+	if err := tx.queryRow(ctx, d.trimRevisionsSQL).Scan(&value); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	trims, err := ParseTrimRevisions(value)
+	if err != nil {
+		return nil, err
+	}
+	for prefix, revision := range raise {
+		if revision > trims[prefix] {
+			trims[prefix] = revision
+		}
+	}
+	for prefix, revision := range trims {
+		if revision <= compact {
+			delete(trims, prefix)
+		}
+	}
+	if value, err = json.Marshal(trims); err != nil {
+		return nil, err
+	}
+	if _, err := tx.execute(ctx, d.updateTrimRevisionsSQL, value); err != nil {
+		return nil, err
+	}
+	return trims, tx.Commit()
+}
+
+// Trim deletes the rows of the keys with the prefix that compaction deletes,
+// after the trimRev and up to and including the targetRev, in batches of
+// CompactBatchSize revisions as Compact does. It returns the number of rows
+// deleted.
+func (d *Generic) Trim(ctx context.Context, prefix string, trimRev, targetRev int64) (int64, error) {
+	start, end := getPrefixRange(prefix)
+	var deleted int64
+	for batchStart := trimRev; batchStart < targetRev; {
+		batchEnd := batchStart + d.GetCompactBatchSize()
+		if batchEnd > targetRev {
+			batchEnd = targetRev
+		}
+
+		result, err := d.trimBatch(ctx, start, end, batchStart, batchEnd)
+		if err != nil {
+			return deleted, err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += rows
+		batchStart = batchEnd
+
+		if batchStart < targetRev {
+			select {
+			case <-ctx.Done():
+				return deleted, ctx.Err()
+			case <-time.After(d.GetCompactBatchDelay()):
+			}
+		}
+	}
+	return deleted, nil
+}
+
+func (d *Generic) trimBatch(ctx context.Context, nameStart, nameEnd string, start, end int64) (_ sql.Result, err error) {
+	ctx, deadline := withTimeout(ctx, d.compactTimeout())
+	defer deadline.done(&err)
+
+	return d.execute(ctx, d.TrimSQL, end, start, d.nameArg(nameStart), d.nameArg(nameEnd), end, start, d.nameArg(nameStart), d.nameArg(nameEnd))
+}
@@ -0,0 +1,33 @@
+package generic
+
+import (
+	"time"
+
+	"github.com/Rican7/retry/jitter"
+)
+
+// retryBackoff is the wait before the first retry of a statement that failed
+// with an error of the Retry hook of the dialect.
+const retryBackoff = 2 * time.Millisecond
+
+// retryWait waits before the next retry of a statement that failed with an
+// error of the Retry hook, after the given number of tries. The wait doubles
+// with each try up to MaxRetryBackoff, and stays at retryBackoff if that is
+// not set.
+func (d *Generic) retryWait(try uint) {
+	backoff := retryBackoff
+	for ; try > 0 && backoff < d.MaxRetryBackoff; try-- {
+		backoff *= 2
+	}
+	if d.MaxRetryBackoff > 0 && backoff > d.MaxRetryBackoff {
+		backoff = d.MaxRetryBackoff
+	}
+	time.Sleep(jitter.Deviation(nil, 0.3)(backoff))
+}
+
+// Retryable reports whether a statement or transaction that failed with err
+// can be run again from the start, as the database aborted it rather than
+// running it, such as to serialize it with others.
+func (d *Generic) Retryable(err error) bool {
+	return err != nil && d.Retry != nil && d.Retry(err)
+}
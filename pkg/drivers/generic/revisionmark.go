@@ -0,0 +1,66 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// The revision mark is the highest revision that kine is known to have
+// served. It is kept in the create revision of the compact_rev_key row,
+// which is updated in place and, being a created row, has no use for it
+// otherwise. Once rows are compacted away, the id sequence of some databases
+// falls back to the highest id left when they restart, or when the table is
+// truncated, so it is raised past the mark on start and revisions never go
+// backwards.
+var (
+	revisionMarkSQL = `
+		SELECT MAX(crkv.create_revision)
+		FROM kine crkv
+		WHERE crkv.name = 'compact_rev_key'`
+
+	markRevisionSQL = `
+		UPDATE kine
+		SET create_revision = ?
+		WHERE name = 'compact_rev_key' AND create_revision < ?`
+)
+
+// MarkRevision records the revision as served, unless a higher one is
+// recorded already.
+func (d *Generic) MarkRevision(ctx context.Context, revision int64) (err error) {
+	ctx, deadline := withTimeout(ctx, d.writeTimeout())
+	defer deadline.done(&err)
+
+	_, err = d.execute(ctx, d.markRevisionSQL, revision, revision)
+	return err
+}
+
+// RaiseSequence raises the id sequence past the revision mark if the rows
+// of the revisions up to it are gone, so that the next row gets a higher id
+// than any revision served before. Dialects without a RaiseSequenceSQL are
+// left as they are.
+func (d *Generic) RaiseSequence(ctx context.Context) (err error) {
+	ctx, deadline := withTimeout(ctx, d.writeTimeout())
+	defer deadline.done(&err)
+
+	var mark, current sql.NullInt64
+	if err := d.queryRow(ctx, d.revisionMarkSQL).Scan(&mark); err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read the revision mark: %w", err)
+	}
+	if err := d.queryRow(ctx, d.currentRevisionSQL).Scan(&current); err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read the current revision: %w", err)
+	}
+	if mark.Int64 <= current.Int64 {
+		return nil
+	}
+
+	if d.RaiseSequenceSQL == "" {
+		d.Logger.Warnf("Revision %d was served before, but the current revision is %d and the id sequence cannot be raised past it", mark.Int64, current.Int64)
+		return nil
+	}
+	if _, err := d.execute(ctx, fmt.Sprintf(d.RaiseSequenceSQL, mark.Int64, mark.Int64+1)); err != nil {
+		return fmt.Errorf("failed to raise the id sequence past revision %d: %w", mark.Int64, err)
+	}
+	d.Logger.Infof("Raised the id sequence past revision %d, which was served before the current revision %d", mark.Int64, current.Int64)
+	return nil
+}
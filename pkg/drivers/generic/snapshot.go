@@ -0,0 +1,426 @@
+package generic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// A snapshot is a header line, a body and the SHA-256 of the two, so that a
+// truncated or corrupt snapshot is detected before anything is restored. The
+// header is JSON and tells the format of the body: either the rows of the
+// kine tables as lines of JSON, which restore into any dialect, or a copy of
+// a sqlite database made with SnapshotFile, which restores with RestoreFile.
+const (
+	snapshotMagic   = "kine-snapshot"
+	snapshotVersion = 1
+
+	snapshotFormatRows   = "rows"
+	snapshotFormatSQLite = "sqlite"
+)
+
+type snapshotHeader struct {
+	Magic   string `json:"magic"`
+	Version int    `json:"version"`
+	Format  string `json:"format"`
+	// Revision is the revision of the snapshot. Copies of a sqlite database
+	// hold at least this revision, as writes are not paused while copying.
+	Revision int64 `json:"revision"`
+	// CompactRevision is the revision that the database was compacted to
+	// when the snapshot was started.
+	CompactRevision int64 `json:"compactRevision,omitempty"`
+}
+
+// snapshotRecord is a line of a snapshot in the rows format, holding either
+// a row of the kine table or a lease.
+type snapshotRecord struct {
+	Row   *snapshotRow   `json:"row,omitempty"`
+	Lease *snapshotLease `json:"lease,omitempty"`
+}
+
+type snapshotRow struct {
+	ID             int64  `json:"id"`
+	Name           string `json:"name"`
+	Created        int64  `json:"created"`
+	Deleted        int64  `json:"deleted"`
+	CreateRevision int64  `json:"createRevision"`
+	PrevRevision   int64  `json:"prevRevision"`
+	Lease          int64  `json:"lease"`
+	Value          []byte `json:"value"`
+	OldValue       []byte `json:"oldValue"`
+}
+
+type snapshotLease struct {
+	ID            int64 `json:"id"`
+	TTL           int64 `json:"ttl"`
+	GrantedAt     int64 `json:"grantedAt"`
+	LastKeepAlive int64 `json:"lastKeepAlive"`
+}
+
+// Snapshot writes a consistent snapshot of the database to w, while it keeps
+// serving reads and writes.
+func (d *Generic) Snapshot(ctx context.Context, w io.Writer) error {
+	revision, err := d.CurrentRevision(ctx)
+	if err != nil {
+		return err
+	}
+	compactRevision, _, err := d.GetCompactRevision(ctx)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	out := io.MultiWriter(w, h)
+
+	format := snapshotFormatRows
+	if d.SnapshotFile != nil {
+		format = snapshotFormatSQLite
+	}
+	header, err := json.Marshal(snapshotHeader{
+		Magic:           snapshotMagic,
+		Version:         snapshotVersion,
+		Format:          format,
+		Revision:        revision,
+		CompactRevision: compactRevision,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(append(header, '\n')); err != nil {
+		return err
+	}
+
+	if d.SnapshotFile != nil {
+		err = d.snapshotFile(ctx, out)
+	} else {
+		err = d.snapshotRows(ctx, out, revision)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(h.Sum(nil))
+	return err
+}
+
+func (d *Generic) snapshotFile(ctx context.Context, w io.Writer) error {
+	dir, err := os.MkdirTemp("", "kine-snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/snapshot.db"
+	if err := d.SnapshotFile(ctx, path); err != nil {
+		return fmt.Errorf("copy database: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// snapshotRows writes the rows up to the revision and the leases, read in
+// one transaction so that compactions do not change them while they are
+// read.
+func (d *Generic) snapshotRows(ctx context.Context, w io.Writer, revision int64) error {
+	tx, err := d.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	rows, err := tx.QueryContext(ctx, d.SnapshotSQL, revision)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row := &snapshotRow{}
+		if err := rows.Scan(&row.ID, &row.Name, &row.Created, &row.Deleted, &row.CreateRevision, &row.PrevRevision, &row.Lease, &row.Value, &row.OldValue); err != nil {
+			return err
+		}
+		if err := enc.Encode(snapshotRecord{Row: row}); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	leases, err := tx.QueryContext(ctx, d.ListLeasesSQL)
+	if err != nil {
+		return err
+	}
+	defer leases.Close()
+	for leases.Next() {
+		lease := &snapshotLease{}
+		if err := leases.Scan(&lease.ID, &lease.TTL, &lease.GrantedAt, &lease.LastKeepAlive); err != nil {
+			return err
+		}
+		if err := enc.Encode(snapshotRecord{Lease: lease}); err != nil {
+			return err
+		}
+	}
+	if err := leases.Err(); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Restore recreates the database from a snapshot. The checksum of the
+// snapshot is verified before anything is written. The database must not
+// hold any rows yet, unless force is set, in which case the rows and leases
+// it holds are replaced by those of the snapshot. The rows keep their ids,
+// and the current revision is then raised strictly above the revisions of
+// the snapshot and any served by the database before, so that clients never
+// see a revision they cached reused.
+func (d *Generic) Restore(ctx context.Context, r io.Reader, force bool) error {
+	dir, err := os.MkdirTemp("", "kine-restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// the snapshot is kept until its checksum at the end has been verified
+	f, err := os.Create(dir + "/snapshot")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	if size < sha256.Size {
+		return fmt.Errorf("snapshot is truncated")
+	}
+	size -= sha256.Size
+
+	h := sha256.New()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(h, f, size); err != nil {
+		return err
+	}
+	sum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(f, sum); err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, h.Sum(nil)) {
+		return fmt.Errorf("snapshot checksum mismatch, it is truncated or corrupt")
+	}
+	d.Logger.Infof("Verified the checksum of the snapshot of %d bytes", size)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	body := bufio.NewReader(io.LimitReader(f, size))
+	line, err := body.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("read snapshot header: %w", err)
+	}
+	var header snapshotHeader
+	if err := json.Unmarshal(line, &header); err != nil || header.Magic != snapshotMagic {
+		return fmt.Errorf("not a kine snapshot")
+	}
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+
+	var count int64
+	if err := d.queryRow(ctx, d.Render(`SELECT COUNT(*) FROM kine`)).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 && !force {
+		return fmt.Errorf("cannot restore into a database that already holds %d rows unless forced", count)
+	}
+
+	restore := &restore{d: d, header: header, force: force}
+	switch header.Format {
+	case snapshotFormatRows:
+		err = restore.rows(ctx, body)
+	case snapshotFormatSQLite:
+		err = restore.file(ctx, body, dir+"/snapshot.db")
+	default:
+		err = fmt.Errorf("unsupported snapshot format %q", header.Format)
+	}
+	if err != nil {
+		return err
+	}
+
+	d.Logger.Infof("Restored %s snapshot at revision %d, compacted to revision %d, with the current revision raised to %d", header.Format, header.Revision, header.CompactRevision, restore.revision)
+	return nil
+}
+
+// restoreProgressInterval is the interval between the logs of the rows
+// restored so far, for snapshots that take a while to restore.
+const restoreProgressInterval = 10 * time.Second
+
+// restore restores a snapshot in a single transaction, which clears the
+// database first if the restore is forced, and raises the current revision
+// once the rows of the snapshot are in.
+type restore struct {
+	d      *Generic
+	header snapshotHeader
+	force  bool
+
+	// previous is the highest revision of the database before it was
+	// cleared, and revision the current revision it was raised to.
+	previous int64
+	revision int64
+}
+
+func (r *restore) file(ctx context.Context, body io.Reader, path string) error {
+	if r.d.RestoreFile == nil {
+		return fmt.Errorf("snapshots of sqlite databases can only be restored into sqlite")
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	r.d.Logger.Infof("Copying the rows of the sqlite snapshot at revision %d", r.header.Revision)
+	return r.d.RestoreFile(ctx, path, r.before, r.after)
+}
+
+// rows inserts the rows and leases of the snapshot, keeping their ids so that
+// the revisions are unchanged.
+func (r *restore) rows(ctx context.Context, body *bufio.Reader) error {
+	d := r.d
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := r.before(ctx, tx); err != nil {
+		return err
+	}
+
+	var rows int64
+	logged := time.Now()
+	dec := json.NewDecoder(body)
+	for {
+		var record snapshotRecord
+		if err := dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read snapshot: %w", err)
+		}
+
+		switch {
+		case record.Row != nil:
+			row := record.Row
+			if _, err := tx.ExecContext(ctx, d.FillSQL, row.ID, d.nameArg(row.Name), row.Created, row.Deleted, row.CreateRevision, row.PrevRevision, row.Lease, row.Value, row.OldValue); err != nil {
+				return err
+			}
+			rows++
+		case record.Lease != nil:
+			lease := record.Lease
+			if _, err := tx.ExecContext(ctx, d.InsertLeaseSQL, lease.ID, lease.TTL, lease.GrantedAt, lease.LastKeepAlive); err != nil {
+				return err
+			}
+		}
+		if time.Since(logged) >= restoreProgressInterval {
+			d.Logger.Infof("Restored %d rows of the snapshot at revision %d so far", rows, r.header.Revision)
+			logged = time.Now()
+		}
+	}
+
+	if err := r.after(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// before clears the database if the restore is forced, recording the highest
+// revision it held or served.
+func (r *restore) before(ctx context.Context, tx *sql.Tx) error {
+	if !r.force {
+		return nil
+	}
+	d := r.d
+
+	var current, mark sql.NullInt64
+	if err := tx.QueryRowContext(ctx, d.currentRevisionSQL).Scan(&current); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err := tx.QueryRowContext(ctx, d.revisionMarkSQL).Scan(&mark); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	r.previous = highestRevision(current.Int64, mark.Int64)
+
+	for _, stmt := range []string{`DELETE FROM kine`, `DELETE FROM kine_leases`} {
+		if _, err := tx.ExecContext(ctx, d.Render(stmt)); err != nil {
+			return err
+		}
+	}
+	d.Logger.Infof("Cleared the database at revision %d to restore the snapshot into it", r.previous)
+	return nil
+}
+
+// after raises the current revision strictly above those of the snapshot,
+// its revision mark and the revisions of the database before it was
+// cleared, by filling the revision after the highest of them, which is also
+// recorded as the revision mark.
+func (r *restore) after(ctx context.Context, tx *sql.Tx) error {
+	d := r.d
+
+	var current, mark sql.NullInt64
+	if err := tx.QueryRowContext(ctx, d.currentRevisionSQL).Scan(&current); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err := tx.QueryRowContext(ctx, d.revisionMarkSQL).Scan(&mark); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	r.revision = highestRevision(current.Int64, mark.Int64, r.previous, r.header.Revision) + 1
+
+	if _, err := tx.ExecContext(ctx, d.FillSQL, r.revision, d.nameArg(fmt.Sprintf("gap-%d", r.revision)), 0, 1, 0, 0, 0, nil, nil); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, d.markRevisionSQL, r.revision, r.revision); err != nil {
+		return err
+	}
+	if d.ResetSequenceSQL != "" {
+		if _, err := tx.ExecContext(ctx, d.ResetSequenceSQL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func highestRevision(revisions ...int64) int64 {
+	var highest int64
+	for _, revision := range revisions {
+		if revision > highest {
+			highest = revision
+		}
+	}
+	return highest
+}
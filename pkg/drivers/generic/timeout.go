@@ -0,0 +1,136 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/rancher/kine/pkg/server"
+)
+
+// StatementTimeouts are the timeouts of statements by the kind of operation
+// they run for. Fields that are zero take the default, and statements of a
+// kind whose timeout is negative are not timed out.
+type StatementTimeouts struct {
+	// Read is the timeout of point reads of a key or of the revision.
+	// Defaults to 10 seconds.
+	Read time.Duration
+	// List is the timeout of queries for ranges of keys, events and leases.
+	// Defaults to 30 seconds.
+	List time.Duration
+	// Write is the timeout of the statements that write keys and leases.
+	// Defaults to 10 seconds.
+	Write time.Duration
+	// Compact is the timeout of compaction and defragment statements, which
+	// go through many rows. Defaults to 10 minutes.
+	Compact time.Duration
+}
+
+// DefaultStatementTimeouts are the timeouts of statements whose timeouts are
+// not configured.
+var DefaultStatementTimeouts = StatementTimeouts{
+	Read:    10 * time.Second,
+	List:    30 * time.Second,
+	Write:   10 * time.Second,
+	Compact: 10 * time.Minute,
+}
+
+// WithDefaults returns the timeouts, with the fields that are zero set from
+// defaults.
+func (t StatementTimeouts) WithDefaults(defaults StatementTimeouts) StatementTimeouts {
+	if t.Read == 0 {
+		t.Read = defaults.Read
+	}
+	if t.List == 0 {
+		t.List = defaults.List
+	}
+	if t.Write == 0 {
+		t.Write = defaults.Write
+	}
+	if t.Compact == 0 {
+		t.Compact = defaults.Compact
+	}
+	return t
+}
+
+func (d *Generic) readTimeout() time.Duration {
+	return d.StatementTimeouts.WithDefaults(DefaultStatementTimeouts).Read
+}
+
+func (d *Generic) listTimeout() time.Duration {
+	return d.StatementTimeouts.WithDefaults(DefaultStatementTimeouts).List
+}
+
+func (d *Generic) writeTimeout() time.Duration {
+	return d.StatementTimeouts.WithDefaults(DefaultStatementTimeouts).Write
+}
+
+func (d *Generic) compactTimeout() time.Duration {
+	return d.StatementTimeouts.WithDefaults(DefaultStatementTimeouts).Compact
+}
+
+// deadline bounds a statement by its timeout.
+type deadline struct {
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// withTimeout returns the context to run a statement in, which is done once
+// the timeout has passed, and the deadline to end it with once the
+// statement and the reading of its results are done.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, *deadline) {
+	s := &deadline{parent: ctx}
+	if timeout > 0 {
+		s.ctx, s.cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		s.ctx, s.cancel = context.WithCancel(ctx)
+	}
+	return s.ctx, s
+}
+
+// err returns server.ErrStatementTimeout in place of err if the statement
+// failed because it ran past its timeout, rather than because its caller
+// gave up on it.
+func (s *deadline) err(err error) error {
+	if err != nil && s.ctx.Err() == context.DeadlineExceeded && s.parent.Err() == nil {
+		return server.ErrStatementTimeout
+	}
+	return err
+}
+
+// done ends the statement, replacing the error it failed with as err does.
+func (s *deadline) done(err *error) {
+	*err = s.err(*err)
+	s.cancel()
+}
+
+// Rows are the results of a query, which end the statement that returned
+// them when they are closed.
+type Rows struct {
+	*sql.Rows
+	deadline *deadline
+}
+
+// rows returns the results of the query, or the error it failed with, which
+// end the statement.
+func (s *deadline) rows(rows *sql.Rows, err error) (*Rows, error) {
+	if err != nil {
+		s.done(&err)
+		return nil, err
+	}
+	return &Rows{Rows: rows, deadline: s}, nil
+}
+
+// Err returns the error the rows were read with, server.ErrStatementTimeout
+// if they were read past the timeout of their statement.
+func (r *Rows) Err() error {
+	return r.deadline.err(r.Rows.Err())
+}
+
+// Close closes the rows and ends their statement.
+func (r *Rows) Close() error {
+	err := r.Rows.Close()
+	r.deadline.cancel()
+	return err
+}
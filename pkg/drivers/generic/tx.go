@@ -0,0 +1,202 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rancher/kine/pkg/server"
+)
+
+// Tx is a database transaction on the kine table. It provides the subset of
+// the Generic methods needed to read and write keys, with all statements
+// executed in the same transaction.
+type Tx struct {
+	x       *sql.Tx
+	d       *Generic
+	locked  bool
+	release sync.Once
+}
+
+// BeginTx starts a new transaction. If writes are serialized with LockWrites,
+// the lock is held until the transaction is committed or rolled back.
+func (d *Generic) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	if d.LockWrites {
+		d.Lock()
+	}
+
+	d.Logger.Tracef("TX BEGIN")
+	var (
+		x       *sql.Tx
+		err     error
+		start   = time.Now()
+		backoff time.Duration
+	)
+	for {
+		x, err = d.DB.BeginTx(ctx, opts)
+		if !d.reconnect(ctx, err, true, start, &backoff) {
+			break
+		}
+	}
+	if err != nil {
+		if d.LockWrites {
+			d.Unlock()
+		}
+		return nil, err
+	}
+
+	return &Tx{
+		x:      x,
+		d:      d,
+		locked: d.LockWrites,
+	}, nil
+}
+
+// Commit commits the transaction.
+func (t *Tx) Commit() error {
+	t.d.Logger.Tracef("TX COMMIT")
+	defer t.unlock()
+	return t.x.Commit()
+}
+
+// Rollback aborts the transaction. It is safe to call after Commit, in which
+// case it does nothing.
+func (t *Tx) Rollback() error {
+	defer t.unlock()
+	if err := t.x.Rollback(); err != nil && err != sql.ErrTxDone {
+		return err
+	}
+	t.d.Logger.Tracef("TX ROLLBACK")
+	return nil
+}
+
+func (t *Tx) unlock() {
+	t.release.Do(func() {
+		if t.locked {
+			t.d.Unlock()
+		}
+	})
+}
+
+func (t *Tx) query(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+	t.d.Logger.Tracef("TX QUERY %v : %s", args, Stripped(sql))
+	start := time.Now()
+	rows, err := t.x.QueryContext(ctx, sql, args...)
+	t.d.observe(ctx, sql, args, start, nil, err)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	return rows, nil
+}
+
+func (t *Tx) queryRow(ctx context.Context, sql string, args ...interface{}) *sql.Row {
+	t.d.Logger.Tracef("TX QUERY ROW %v : %s", args, Stripped(sql))
+	start := time.Now()
+	row := t.x.QueryRowContext(ctx, sql, args...)
+	t.d.observe(ctx, sql, args, start, nil, row.Err())
+	return row
+}
+
+func (t *Tx) execute(ctx context.Context, sql string, args ...interface{}) (sql.Result, error) {
+	t.d.Logger.Tracef("TX EXEC %v : %s", args, Stripped(sql))
+	start := time.Now()
+	result, err := t.x.ExecContext(ctx, sql, args...)
+	t.d.observe(ctx, sql, args, start, result, err)
+	if err != nil {
+		return nil, fmt.Errorf("exec: %w", err)
+	}
+	return result, nil
+}
+
+func (t *Tx) GetCompactRevision(ctx context.Context) (_, _ int64, err error) {
+	ctx, deadline := withTimeout(ctx, t.d.readTimeout())
+	defer deadline.done(&err)
+
+	var compact, target sql.NullInt64
+	row := t.queryRow(ctx, t.d.revisionIntervalSQL)
+	err = row.Scan(&compact, &target)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+
+	return compact.Int64, target.Int64, err
+}
+
+func (t *Tx) CurrentRevision(ctx context.Context) (_ int64, err error) {
+	ctx, deadline := withTimeout(ctx, t.d.readTimeout())
+	defer deadline.done(&err)
+
+	var id int64
+	row := t.queryRow(ctx, t.d.currentRevisionSQL)
+	err = row.Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+func (t *Tx) ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted, keysOnly bool, filter server.RevisionFilter) (*Rows, error) {
+	ctx, deadline := withTimeout(ctx, t.d.listTimeoutOf(prefix))
+	sql, args := t.d.listCurrentQuery(prefix, limit, includeDeleted, keysOnly, filter)
+	return deadline.rows(t.query(ctx, sql, args...))
+}
+
+func (t *Tx) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted, keysOnly bool, filter server.RevisionFilter) (*Rows, error) {
+	ctx, deadline := withTimeout(ctx, t.d.listTimeoutOf(prefix))
+	sql, args := t.d.listQuery(prefix, startKey, limit, revision, includeDeleted, keysOnly, filter)
+	return deadline.rows(t.query(ctx, sql, args...))
+}
+
+func (t *Tx) Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (id int64, err error) {
+	ctx, deadline := withTimeout(ctx, t.d.writeTimeout())
+	defer deadline.done(&err)
+
+	if t.d.TranslateErr != nil {
+		defer func() {
+			if err != nil {
+				err = t.d.TranslateErr(err)
+			}
+		}()
+	}
+
+	cVal := 0
+	dVal := 0
+	if create {
+		cVal = 1
+	}
+	if delete {
+		dVal = 1
+	}
+
+	if t.d.LastInsertID {
+		row, err := t.execute(ctx, t.d.InsertLastInsertIDSQL, t.d.nameArg(key), cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+		if err != nil {
+			return 0, err
+		}
+		return row.LastInsertId()
+	}
+
+	row := t.queryRow(ctx, t.d.InsertSQL, t.d.nameArg(key), cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+	err = row.Scan(&id)
+
+	return id, err
+}
+
+func (t *Tx) Version(ctx context.Context, key string, createRevision, modRevision int64) (_ int64, err error) {
+	ctx, deadline := withTimeout(ctx, t.d.readTimeout())
+	defer deadline.done(&err)
+
+	var n int64
+	err = t.queryRow(ctx, t.d.VersionSQL, t.d.nameArg(key), createRevision, modRevision).Scan(&n)
+	return n, err
+}
+
+// Versions is like Generic.Versions, but reads the revisions in the
+// transaction.
+func (t *Tx) Versions(ctx context.Context, kvs []*server.KeyValue) error {
+	return versions(ctx, kvs, t.Version, func(ctx context.Context, start, end string, minRev, maxRev int64) (*sql.Rows, error) {
+		return t.query(ctx, t.d.KeyRevisionsSQL, t.d.nameArg(start), t.d.nameArg(end), minRev, maxRev)
+	}, t.d.listTimeout())
+}
@@ -0,0 +1,160 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/rancher/kine/pkg/server"
+)
+
+var (
+	// verifyCompactRevisionSQL is the compact revision, or NULL if none was
+	// recorded. It is read without a limit, which not all databases support
+	// in subqueries, as there is a single compact_rev_key row.
+	verifyCompactRevisionSQL = `
+		SELECT MAX(crkv.prev_revision)
+		FROM kine AS crkv
+		WHERE crkv.name = 'compact_rev_key'`
+
+	verifyRevisionsSQL = `
+		SELECT (` + revSQL + `), (` + verifyCompactRevisionSQL + `)`
+
+	// verifyRowsSQL lists the rows above the compact revision that do not
+	// follow the row they name as their previous revision: updates and
+	// deletes of a row that is missing, of another key or deleted, and
+	// creates of a key that exists at the row they follow, or that are
+	// flagged deleted too. Creates of a new key follow the current revision
+	// of the log, so only a row of the same key is checked. Compaction only
+	// deletes the previous rows of rows up to the compact revision, so the
+	// rows above it must find theirs. Each row is listed with the row it
+	// follows, if there is one, and the number of earlier rows of its key.
+	verifyRowsSQL = `
+		SELECT kv.id, kv.name, kv.created, kv.deleted, kv.prev_revision, pkv.id, pkv.name, (
+				SELECT COUNT(*)
+				FROM kine AS okv
+				WHERE okv.name = kv.name AND okv.id < kv.id)
+		FROM kine AS kv
+			LEFT JOIN kine AS pkv
+				ON pkv.id = kv.prev_revision
+		WHERE kv.name != 'compact_rev_key'
+			AND kv.id > COALESCE((` + verifyCompactRevisionSQL + `), 0)
+			AND (
+				(kv.created = 0 AND (pkv.id IS NULL OR pkv.name != kv.name OR pkv.deleted != 0))
+				OR (kv.created != 0 AND (kv.deleted != 0 OR (pkv.name = kv.name AND pkv.deleted = 0))))
+		ORDER BY kv.id ASC`
+
+	// verifyForksSQL lists the keys with rows that follow the same previous
+	// revision, with the first and the last of them, as duplicateRevisionsSQL
+	// does. The unique index over the names and previous revisions rejects
+	// them, so they are only found in databases where it is corrupt or was
+	// never created.
+	verifyForksSQL = `
+		SELECT kv.name, kv.prev_revision, MIN(kv.id), MAX(kv.id)
+		FROM kine AS kv
+		WHERE kv.name != 'compact_rev_key'
+		GROUP BY kv.name, kv.prev_revision
+		HAVING COUNT(*) > 1
+		ORDER BY MAX(kv.id) ASC`
+)
+
+// Verify checks the rows of the table, in a single transaction, and returns
+// those that do not fit the history of their keys, as LogStructured.Verify
+// describes. If repair is set the orphaned tombstones are deleted in the same
+// transaction.
+func (d *Generic) Verify(ctx context.Context, repair bool) ([]server.Inconsistency, error) {
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var inconsistencies []server.Inconsistency
+	var current, compact sql.NullInt64
+	if err := tx.QueryRowContext(ctx, d.Render(verifyRevisionsSQL)).Scan(&current, &compact); err != nil {
+		return nil, fmt.Errorf("failed to read revisions: %w", err)
+	}
+	if compact.Int64 > current.Int64 {
+		inconsistencies = append(inconsistencies, server.Inconsistency{
+			Kind:         server.InconsistencyCompactRevision,
+			Revision:     compact.Int64,
+			PrevRevision: current.Int64,
+		})
+	}
+
+	rows, err := tx.QueryContext(ctx, d.Render(verifyRowsSQL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify rows: %w", err)
+	}
+	var orphans []int64
+	for rows.Next() {
+		var (
+			i                server.Inconsistency
+			created, deleted bool
+			prevID           sql.NullInt64
+			prevName         sql.NullString
+			earlier          int64
+		)
+		if err := rows.Scan(&i.Revision, &i.Key, &created, &deleted, &i.PrevRevision, &prevID, &prevName, &earlier); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to verify rows: %w", err)
+		}
+		if d.IsFill(i.Key) {
+			continue
+		}
+		switch {
+		case created && deleted:
+			i.Kind = server.InconsistencyCreatedAndDeleted
+		case created:
+			i.Kind = server.InconsistencyCreateOverKey
+		case !prevID.Valid && deleted && earlier == 0:
+			i.Kind = server.InconsistencyOrphanedTombstone
+			orphans = append(orphans, i.Revision)
+			i.Repaired = repair
+		case !prevID.Valid:
+			i.Kind = server.InconsistencyMissingPrev
+		case prevName.String != i.Key:
+			i.Kind = server.InconsistencyOtherKey
+		default:
+			i.Kind = server.InconsistencyAfterDelete
+		}
+		inconsistencies = append(inconsistencies, i)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("failed to verify rows: %w", err)
+	}
+	rows.Close()
+
+	rows, err = tx.QueryContext(ctx, d.Render(verifyForksSQL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify forks: %w", err)
+	}
+	for rows.Next() {
+		i := server.Inconsistency{Kind: server.InconsistencyFork}
+		if err := rows.Scan(&i.Key, &i.PrevRevision, &i.Other, &i.Revision); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to verify forks: %w", err)
+		}
+		inconsistencies = append(inconsistencies, i)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("failed to verify forks: %w", err)
+	}
+	rows.Close()
+
+	if !repair || len(orphans) == 0 {
+		return inconsistencies, nil
+	}
+	for _, id := range orphans {
+		if _, err := tx.ExecContext(ctx, d.DeleteSQL, id); err != nil {
+			return nil, fmt.Errorf("failed to delete orphaned tombstone %d: %w", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to delete orphaned tombstones: %w", err)
+	}
+	d.Logger.Warnf("Deleted %d orphaned tombstones from the %s table", len(orphans), d.Table())
+	return inconsistencies, nil
+}
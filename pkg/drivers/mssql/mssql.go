@@ -0,0 +1,289 @@
+package mssql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/logstructured/sqllog"
+	"github.com/rancher/kine/pkg/server"
+	"github.com/rancher/kine/pkg/tls"
+)
+
+const (
+	defaultDSN = "sqlserver://sa@localhost:1433"
+	defaultDB  = "kubernetes"
+)
+
+var (
+	// the names are compared and ordered byte by byte, as they are for the
+	// other backends, rather than by the case insensitive default collation.
+	// Indexes over the names need SQL Server 2016 or later, which allows keys
+	// larger than 900 bytes.
+	schema = []string{
+		`IF OBJECT_ID('kine', 'U') IS NULL
+			CREATE TABLE kine
+			(
+				id BIGINT IDENTITY(1,1) PRIMARY KEY,
+				name NVARCHAR(630) COLLATE Latin1_General_BIN2,
+				created INTEGER,
+				deleted INTEGER,
+				create_revision BIGINT,
+				prev_revision BIGINT,
+				lease BIGINT,
+				value VARBINARY(MAX),
+				old_value VARBINARY(MAX)
+			)`,
+		createIndex("kine_name_index", "CREATE INDEX kine_name_index ON kine (name)"),
+		createIndex("kine_name_id_index", "CREATE INDEX kine_name_id_index ON kine (name, id)"),
+		createIndex("kine_name_prev_revision_uindex", "CREATE UNIQUE INDEX kine_name_prev_revision_uindex ON kine (name, prev_revision)"),
+		`IF OBJECT_ID('kine_leases', 'U') IS NULL
+			CREATE TABLE kine_leases
+			(
+				id BIGINT PRIMARY KEY,
+				ttl BIGINT NOT NULL,
+				granted_at BIGINT NOT NULL,
+				last_keepalive BIGINT NOT NULL
+			)`,
+	}
+)
+
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, config generic.Config) (server.Backend, error) {
+	dataSourceName, err := config.ParseDSN(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedDSN, err := prepareDSN(dataSourceName, tlsInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := createDBIfNotExist(parsedDSN); err != nil {
+		return nil, err
+	}
+
+	dialect, err := generic.Open(ctx, "sqlserver", parsedDSN, config, "@p", true)
+	if err != nil {
+		return nil, err
+	}
+	dialect.LimitSQL = "OFFSET 0 ROWS FETCH NEXT %d ROWS ONLY"
+	// only the tables of this kine are counted, as others may share the database
+	dialect.GetSizeSQL = dialect.Render(`
+		SELECT COALESCE(SUM(reserved_page_count), 0) * 8192
+		FROM sys.dm_db_partition_stats
+		WHERE object_id IN (OBJECT_ID('kine'), OBJECT_ID('kine_leases'))`)
+	dialect.GetSizeInUseSQL = dialect.Render(`
+		SELECT COALESCE(SUM(used_page_count), 0) * 8192
+		FROM sys.dm_db_partition_stats
+		WHERE object_id IN (OBJECT_ID('kine'), OBJECT_ID('kine_leases'))`)
+	dialect.DefragmentSQL = dialect.Render(`
+		ALTER INDEX ALL ON kine REBUILD;
+		ALTER INDEX ALL ON kine_leases REBUILD`)
+	// a reseeded identity hands out the id after the seed next
+	dialect.RaiseSequenceSQL = dialect.Render(`
+		IF IDENT_CURRENT('kine') < %[1]d
+			DBCC CHECKIDENT ('kine', RESEED, %[1]d)`)
+	// T-SQL returns the ids of inserted rows through an OUTPUT clause, and
+	// only inserts ids into an identity column while IDENTITY_INSERT is on.
+	// Rows inserted with their own id move the identity on past them, so the
+	// identity never needs to be reset after a restore.
+	dialect.InsertSQL = dialect.Render(`
+		INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+		OUTPUT INSERTED.id
+		VALUES(@p1, @p2, @p3, @p4, @p5, @p6, @p7, @p8)`)
+	dialect.FillSQL = dialect.Render(`
+		SET IDENTITY_INSERT kine ON;
+		INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+		VALUES(@p1, @p2, @p3, @p4, @p5, @p6, @p7, @p8, @p9);
+		SET IDENTITY_INSERT kine OFF`)
+	// T-SQL does not allow an alias on the table being deleted from.
+	dialect.DeleteSQL = dialect.Render(`
+		DELETE FROM kine
+		WHERE id = @p1`)
+	dialect.CompactSQL = dialect.Render(`
+		DELETE FROM kine
+		WHERE
+			id IN (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.created = 0 AND
+					kp.prev_revision != 0 AND
+					kp.id <= @p1 AND
+					kp.id > @p2
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= @p3 AND
+					kd.id > @p4
+			)`)
+	dialect.TrimSQL = dialect.Render(`
+		DELETE FROM kine
+		WHERE
+			id IN (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.created = 0 AND
+					kp.prev_revision != 0 AND
+					kp.id <= @p1 AND
+					kp.id > @p2 AND
+					kp.name >= @p3 AND
+					kp.name < @p4
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= @p5 AND
+					kd.id > @p6 AND
+					kd.name >= @p7 AND
+					kd.name < @p8
+			)`)
+	// T-SQL has no LENGTH for binary values
+	dialect.HistorySQL = dialect.Render(`
+		SELECT kv.id, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, COALESCE(DATALENGTH(kv.value), 0), kv.value
+		FROM kine AS kv
+		WHERE kv.name = @p1
+			AND (@p2 = 0 OR kv.id = @p3)
+		ORDER BY kv.id ASC`)
+	dialect.HistoryNoValueSQL = dialect.Render(`
+		SELECT kv.id, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, COALESCE(DATALENGTH(kv.value), 0), NULL
+		FROM kine AS kv
+		WHERE kv.name = @p1
+			AND (@p2 = 0 OR kv.id = @p3)
+		ORDER BY kv.id ASC`)
+	dialect.LengthSQL = "DATALENGTH"
+	dialect.PrefixSQL = `CASE WHEN kv.name LIKE '%/%/%/%' THEN LEFT(kv.name, CHARINDEX('/', kv.name, CHARINDEX('/', kv.name, CHARINDEX('/', kv.name) + 1) + 1)) ELSE '' END`
+	dialect.TranslateErr = translateErr
+	dialect.ErrCode = errCode
+
+	if err := setup(dialect); err != nil {
+		return nil, err
+	}
+
+	if err := dialect.Migrate(context.Background()); err != nil {
+		return nil, err
+	}
+	return logstructured.New(sqllog.New(dialect)), nil
+}
+
+// translateErr returns server.ErrKeyExists for violations of a unique
+// constraint or index, which are errors 2627 and 2601.
+func translateErr(err error) error {
+	var mssqlErr mssql.Error
+	if errors.As(err, &mssqlErr) && (mssqlErr.Number == 2627 || mssqlErr.Number == 2601) {
+		return server.ErrKeyExists
+	}
+	return err
+}
+
+func errCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var mssqlErr mssql.Error
+	if errors.As(err, &mssqlErr) {
+		return strconv.Itoa(int(mssqlErr.Number))
+	}
+	return err.Error()
+}
+
+// createIndex returns a statement that creates the index of the kine table,
+// unless it already exists.
+func createIndex(name, stmt string) string {
+	return `IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = '` + name + `' AND object_id = OBJECT_ID('kine')) ` + stmt
+}
+
+func setup(dialect *generic.Generic) error {
+	if dialect.SchemaName != "" {
+		// CREATE SCHEMA has to be the only statement of its batch
+		_, err := dialect.DB.Exec(`IF SCHEMA_ID('` + dialect.SchemaName + `') IS NULL EXEC('CREATE SCHEMA ` + dialect.SchemaName + `')`)
+		if err != nil {
+			return err
+		}
+	}
+	for _, stmt := range schema {
+		_, err := dialect.DB.Exec(dialect.Render(stmt))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createDBIfNotExist(dataSourceName string) error {
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	dbName := query.Get("database")
+
+	// the database is created from the master database of the server
+	query.Del("database")
+	u.RawQuery = query.Encode()
+	db, err := sql.Open("sqlserver", u.String())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`IF DB_ID(@p1) IS NULL CREATE DATABASE `+quoteName(dbName), dbName)
+	// another kine may have created the database since it was looked up
+	var mssqlErr mssql.Error
+	if errors.As(err, &mssqlErr) && mssqlErr.Number == 1801 {
+		return nil
+	}
+	return err
+}
+
+// quoteName quotes the name of a database as a T-SQL identifier.
+func quoteName(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+func prepareDSN(dataSourceName string, tlsInfo tls.Config) (string, error) {
+	if len(dataSourceName) == 0 {
+		dataSourceName = defaultDSN
+	} else {
+		dataSourceName = "sqlserver://" + dataSourceName
+	}
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	if query.Get("database") == "" {
+		query.Set("database", defaultDB)
+	}
+	// the driver verifies the certificate of the server against the CA, but
+	// does not present a client certificate
+	if err := tlsInfo.CheckFiles(); err != nil {
+		return "", err
+	}
+	if _, ok := query["certificate"]; tlsInfo.CAFile != "" && !tlsInfo.SkipVerify && !ok {
+		query.Set("certificate", tlsInfo.CAFile)
+	}
+	if _, ok := query["TrustServerCertificate"]; tlsInfo.SkipVerify && !ok {
+		query.Set("TrustServerCertificate", "true")
+	}
+	if _, ok := query["encrypt"]; (tlsInfo.CAFile != "" || tlsInfo.SkipVerify) && !ok {
+		query.Set("encrypt", "true")
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
@@ -4,9 +4,15 @@ import (
 	"context"
 	cryptotls "crypto/tls"
 	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/logging"
 	"github.com/rancher/kine/pkg/logstructured"
 	"github.com/rancher/kine/pkg/logstructured/sqllog"
 	"github.com/rancher/kine/pkg/server"
@@ -19,11 +25,22 @@ const (
 )
 
 var (
+	// connectionErrCodes are the codes of the errors of lost connections.
+	// MySQL rolls back the statements it was running when it shuts down or
+	// their connection is killed, while an invalid connection may have been
+	// lost after the statement was sent.
+	connectionErrCodes = map[string]bool{
+		"1040":                       true, // ER_CON_COUNT_ERROR
+		"1053":                       true, // ER_SERVER_SHUTDOWN
+		"1927":                       true, // ER_CONNECTION_KILLED
+		mysql.ErrInvalidConn.Error(): false,
+	}
+
 	schema = []string{
 		`create table if not exists kine
 			(
 				id INTEGER AUTO_INCREMENT,
-				name VARCHAR(630),
+				name VARBINARY(630),
 				created INTEGER,
 				deleted INTEGER,
 				create_revision INTEGER,
@@ -33,14 +50,48 @@ var (
 				old_value MEDIUMBLOB,
 				PRIMARY KEY (id)
 			);`,
+		`create table if not exists kine_leases
+			(
+				id BIGINT,
+				ttl BIGINT NOT NULL,
+				granted_at BIGINT NOT NULL,
+				last_keepalive BIGINT NOT NULL,
+				PRIMARY KEY (id)
+			);`,
 	}
+	// varcharNameSQL reports whether the name column is text, as in tables
+	// created by old versions of kine. Text is compared by the collation of
+	// the column, which may ignore case and trailing spaces, rather than
+	// bytewise, as etcd compares keys.
+	varcharNameSQL = `
+		SELECT COUNT(*)
+		FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = 'kine' AND column_name = 'name' AND data_type <> 'varbinary'`
+	// binaryNameSQL converts the name column to bytes, keeping the bytes of
+	// the names as they are encoded in its character set.
+	binaryNameSQL = "alter table kine modify column name VARBINARY(630)"
+
 	nameIdx     = "create index kine_name_index on kine (name)"
 	nameIDIdx   = "create index kine_name_id_index on kine (name,id)"
 	revisionIdx = "create unique index kine_name_prev_revision_uindex on kine (name, prev_revision)"
-	createDB    = "create database if not exists "
+
+	// optionPattern matches the character sets and collations that a
+	// database is created with, which cannot be passed as arguments.
+	optionPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
 )
 
-func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config) (server.Backend, error) {
+// createOptions are the character set and collation of the database that
+// kine creates, set by the db-encoding and db-collation parameters of the
+// data source name.
+type createOptions struct {
+	charset   string
+	collation string
+}
+
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, config generic.Config) (server.Backend, error) {
+	if err := tlsInfo.CheckFiles(); err != nil {
+		return nil, err
+	}
 	tlsConfig, err := tlsInfo.ClientConfig()
 	if err != nil {
 		return nil, err
@@ -50,57 +101,187 @@ func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config) (server
 		tlsConfig.MinVersion = cryptotls.VersionTLS11
 	}
 
-	parsedDSN, err := prepareDSN(dataSourceName, tlsConfig)
+	dataSourceName, err = config.ParseDSN(dataSourceName)
 	if err != nil {
 		return nil, err
 	}
+	if config.SchemaName != "" {
+		return nil, errors.New("mysql does not support schema names, set the database of the data source name instead")
+	}
 
-	if err := createDBIfNotExist(parsedDSN); err != nil {
+	parsedDSN, createOptions, err := prepareDSN(config.GetLogger(), dataSourceName, tlsConfig)
+	if err != nil {
 		return nil, err
 	}
 
-	dialect, err := generic.Open(ctx, "mysql", parsedDSN, "?", false)
+	createDSN, err := config.WithPassword(ctx, parsedDSN, withPassword(parsedDSN))
 	if err != nil {
 		return nil, err
 	}
-	dialect.LastInsertID = true
-	dialect.TranslateErr = func(err error) error {
-		if err, ok := err.(*mysql.MySQLError); ok && err.Number == 1062 {
-			return server.ErrKeyExists
+	if err := createDBIfNotExist(createDSN, createOptions); err != nil {
+		return nil, err
+	}
+
+	dialect, err := generic.OpenPassword(ctx, "mysql", parsedDSN, withPassword(parsedDSN), config, "?", false)
+	if err != nil {
+		return nil, err
+	}
+	for _, dsn := range config.ReadDataSourceNames {
+		replicaDSN, _, err := prepareDSN(config.GetLogger(), dsn, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := dialect.OpenReplica("mysql", replicaDSN, withPassword(replicaDSN)); err != nil {
+			return nil, err
 		}
-		return err
 	}
-	if err := setup(dialect.DB); err != nil {
+	dialect.LastInsertID = true
+	// only the tables of this kine are counted, as others may share the database
+	dialect.GetSizeSQL = dialect.Render(`
+		SELECT COALESCE(SUM(data_length + index_length + data_free), 0)
+		FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name IN ('kine', 'kine_leases')`)
+	dialect.GetSizeInUseSQL = dialect.Render(`
+		SELECT COALESCE(SUM(data_length + index_length), 0)
+		FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name IN ('kine', 'kine_leases')`)
+	dialect.DefragmentSQL = dialect.Render(`OPTIMIZE TABLE kine, kine_leases`)
+	dialect.PrefixSQL = `CASE WHEN kv.name LIKE '%/%/%/%' THEN CONCAT(SUBSTRING_INDEX(kv.name, '/', 3), '/') ELSE '' END`
+	// the auto increment counter of MySQL before 8.0 restarts at the highest
+	// id left, and it is never lowered below that by setting it
+	dialect.RaiseSequenceSQL = dialect.Render(`ALTER TABLE kine AUTO_INCREMENT = %[2]d`)
+	// MySQL does not allow a subquery on the table being deleted from, so
+	// the rows to compact are selected through a derived table instead.
+	dialect.CompactSQL = dialect.Render(`
+		DELETE kv FROM kine AS kv
+		INNER JOIN (
+			SELECT kp.prev_revision AS id
+			FROM kine AS kp
+			WHERE
+				kp.name != 'compact_rev_key' AND
+				kp.created = 0 AND
+				kp.prev_revision != 0 AND
+				kp.id <= ? AND
+				kp.id > ?
+			UNION
+			SELECT kd.id AS id
+			FROM kine AS kd
+			WHERE
+				kd.deleted != 0 AND
+				kd.id <= ? AND
+				kd.id > ?
+		) AS ks
+		ON kv.id = ks.id`)
+	dialect.TrimSQL = dialect.Render(`
+		DELETE kv FROM kine AS kv
+		INNER JOIN (
+			SELECT kp.prev_revision AS id
+			FROM kine AS kp
+			WHERE
+				kp.name != 'compact_rev_key' AND
+				kp.created = 0 AND
+				kp.prev_revision != 0 AND
+				kp.id <= ? AND
+				kp.id > ? AND
+				kp.name >= ? AND
+				kp.name < ?
+			UNION
+			SELECT kd.id AS id
+			FROM kine AS kd
+			WHERE
+				kd.deleted != 0 AND
+				kd.id <= ? AND
+				kd.id > ? AND
+				kd.name >= ? AND
+				kd.name < ?
+		) AS ks
+		ON kv.id = ks.id`)
+	// the cardinality of the index over the names is the number of
+	// distinct names
+	dialect.EstimateCountSQL = dialect.Render(`
+		SELECT t.table_rows, s.cardinality
+		FROM information_schema.tables t
+			JOIN information_schema.statistics s
+				ON s.table_schema = t.table_schema AND s.table_name = t.table_name AND s.index_name = 'kine_name_index' AND s.seq_in_index = 1
+		WHERE t.table_schema = DATABASE() AND t.table_name = 'kine'`)
+	dialect.BinaryNames = true
+	dialect.TranslateErr = translateErr
+	dialect.ErrCode = errCode
+	dialect.ConnectionErrCodes = connectionErrCodes
+	if err := setup(dialect); err != nil {
 		return nil, err
 	}
 
-	dialect.Migrate(context.Background())
+	if err := dialect.Migrate(context.Background()); err != nil {
+		return nil, err
+	}
 	return logstructured.New(sqllog.New(dialect)), nil
 }
 
-func setup(db *sql.DB) error {
+// translateErr returns server.ErrKeyExists for duplicate entries of a unique
+// index, which are error 1062, however the error is wrapped.
+func translateErr(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+		return server.ErrKeyExists
+	}
+	return err
+}
+
+func errCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return strconv.Itoa(int(mysqlErr.Number))
+	}
+	if errors.Is(err, mysql.ErrInvalidConn) {
+		return mysql.ErrInvalidConn.Error()
+	}
+	return err.Error()
+}
+
+func setup(dialect *generic.Generic) error {
 	for _, stmt := range schema {
-		_, err := db.Exec(stmt)
+		_, err := dialect.DB.Exec(dialect.Render(stmt))
 		if err != nil {
 			return err
 		}
 	}
+	var varchar int
+	if err := dialect.DB.QueryRow(dialect.Render(varcharNameSQL)).Scan(&varchar); err != nil {
+		return err
+	}
+	if varchar > 0 {
+		dialect.Logger.Infof("Converting the names of the %s table to bytes", dialect.Table())
+		if _, err := dialect.DB.Exec(dialect.Render(binaryNameSQL)); err != nil {
+			return fmt.Errorf("failed to convert the names of the %s table to bytes: %w", dialect.Table(), err)
+		}
+	}
 	// check if duplicate indexes
 	indexes := []string{
 		nameIdx,
-		nameIDIdx,
-		revisionIdx}
+		nameIDIdx}
 
 	for _, idx := range indexes {
-		err := createIndex(db, idx)
+		err := createIndex(dialect.DB, dialect.Render(idx))
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	// rows that old versions of kine left violating the unique index are
+	// resolved before it is created
+	return dialect.CreateUniqueIndex(context.Background(), func() error {
+		return createIndex(dialect.DB, dialect.Render(revisionIdx))
+	})
 }
 
-func createDBIfNotExist(dataSourceName string) error {
+// createDBIfNotExist creates the database of the data source name if
+// connecting to it fails because it does not exist. It is created over a
+// connection without a default database, with the same credentials. A
+// database created by another kine in the meantime is no error.
+func createDBIfNotExist(dataSourceName string, options createOptions) error {
 	config, err := mysql.ParseDSN(dataSourceName)
 	if err != nil {
 		return err
@@ -111,25 +292,51 @@ func createDBIfNotExist(dataSourceName string) error {
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(createDB + dbName)
+	defer db.Close()
+
+	var mysqlErr *mysql.MySQLError
+	if err := db.Ping(); !errors.As(err, &mysqlErr) || mysqlErr.Number != 1049 {
+		return err
+	}
+
+	config.DBName = ""
+	db, err = sql.Open("mysql", config.FormatDSN())
 	if err != nil {
-		if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1049 {
-			return err
-		}
-		config.DBName = ""
-		db, err = sql.Open("mysql", config.FormatDSN())
-		if err != nil {
-			return err
+		return err
+	}
+	defer db.Close()
+
+	stmt, err := createDBSQL(dbName, options)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(stmt)
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1007 {
+		return nil
+	}
+	return err
+}
+
+// createDBSQL returns the statement that creates the database with the
+// options, quoting its name.
+func createDBSQL(dbName string, options createOptions) (string, error) {
+	stmt := "CREATE DATABASE IF NOT EXISTS `" + strings.ReplaceAll(dbName, "`", "``") + "`"
+	if options.charset != "" {
+		if !optionPattern.MatchString(options.charset) {
+			return "", fmt.Errorf("invalid db-encoding %q", options.charset)
 		}
-		_, err = db.Exec(createDB + dbName)
-		if err != nil {
-			return err
+		stmt += " CHARACTER SET " + options.charset
+	}
+	if options.collation != "" {
+		if !optionPattern.MatchString(options.collation) {
+			return "", fmt.Errorf("invalid db-collation %q", options.collation)
 		}
+		stmt += " COLLATE " + options.collation
 	}
-	return nil
+	return stmt, nil
 }
 
-func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, error) {
+func prepareDSN(logger logging.Logger, dataSourceName string, tlsConfig *cryptotls.Config) (string, createOptions, error) {
 	if len(dataSourceName) == 0 {
 		dataSourceName = defaultUnixDSN
 		if tlsConfig != nil {
@@ -138,23 +345,64 @@ func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, err
 	}
 	config, err := mysql.ParseDSN(dataSourceName)
 	if err != nil {
-		return "", err
+		return "", createOptions{}, err
 	}
-	// setting up tlsConfig
+	// setting up tlsConfig, which overrides the tls parameter of the data
+	// source name
 	if tlsConfig != nil {
 		if err := mysql.RegisterTLSConfig("kine", tlsConfig); err != nil {
-			return "", err
+			return "", createOptions{}, err
 		}
 		config.TLSConfig = "kine"
 	}
+	logger.Infof("Connecting to mysql with TLS %s", tlsMode(config.TLSConfig, tlsConfig))
 	dbName := "kubernetes"
 	if len(config.DBName) > 0 {
 		dbName = config.DBName
 	}
 	config.DBName = dbName
+
+	// the driver would set the create options as system variables of the
+	// connection, so they are taken off the parameters
+	options := createOptions{
+		charset:   config.Params["db-encoding"],
+		collation: config.Params["db-collation"],
+	}
+	delete(config.Params, "db-encoding")
+	delete(config.Params, "db-collation")
 	parsedDSN := config.FormatDSN()
 
-	return parsedDSN, nil
+	return parsedDSN, options, nil
+}
+
+// withPassword returns a func that renders the data source name with the
+// password in place of its own. Tokens such as those of AWS RDS IAM
+// authentication are sent in clear text, which the data source name has to
+// allow with allowCleartextPasswords=true.
+func withPassword(dataSourceName string) func(password string) (string, error) {
+	return func(password string) (string, error) {
+		config, err := mysql.ParseDSN(dataSourceName)
+		if err != nil {
+			return "", err
+		}
+		config.Passwd = password
+		return config.FormatDSN(), nil
+	}
+}
+
+// tlsMode describes the TLS that connections are made with for the tls
+// parameter of the data source name.
+func tlsMode(name string, tlsConfig *cryptotls.Config) string {
+	switch {
+	case name == "kine" && tlsConfig.InsecureSkipVerify, name == "skip-verify":
+		return "without verifying the server"
+	case name == "preferred":
+		return "if the server supports it, without verifying the server"
+	case name == "" || name == "false":
+		return "disabled"
+	default:
+		return "verifying the server"
+	}
 }
 
 func createIndex(db *sql.DB, indexStmt string) error {
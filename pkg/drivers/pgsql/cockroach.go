@@ -0,0 +1,176 @@
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/logstructured/sqllog"
+	"github.com/rancher/kine/pkg/server"
+	"github.com/rancher/kine/pkg/tls"
+)
+
+const (
+	defaultCockroachDSN = "root@localhost:26257/"
+
+	// maxCockroachRetryBackoff is the longest wait between the retries of a
+	// statement that CockroachDB aborted.
+	maxCockroachRetryBackoff = 500 * time.Millisecond
+)
+
+// Rows get their ids from a sequence, so that revisions increase by one with
+// each write, as the log requires to tell missing revisions apart. The ids
+// are written next to each other, so that inserts all land on the range at
+// the end of the table, unless the table is hash sharded on them, which
+// spreads the inserts over the buckets of the hash.
+const (
+	idStrategySequence    = "sequence"
+	idStrategyHashSharded = "hash-sharded"
+)
+
+var (
+	// cockroachRetryErrCodes are the codes of the errors of statements and
+	// transactions that CockroachDB aborted, and that may be run again from
+	// the start.
+	cockroachRetryErrCodes = map[string]bool{
+		"40001": true, // serialization_failure
+		"40003": true, // statement_completion_unknown
+	}
+
+	cockroachSchema = []string{
+		`CREATE SEQUENCE IF NOT EXISTS kine_id_seq`,
+		`CREATE TABLE IF NOT EXISTS kine
+			(
+				id INT8 NOT NULL DEFAULT nextval('kine_id_seq'),
+				name VARCHAR(630),
+				created INT8,
+				deleted INT8,
+				create_revision INT8,
+				prev_revision INT8,
+				lease INT8,
+				value BYTES,
+				old_value BYTES,
+				%s
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_id_index ON kine (name,id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+		`CREATE TABLE IF NOT EXISTS kine_leases
+			(
+				id INT8 PRIMARY KEY,
+				ttl INT8 NOT NULL,
+				granted_at INT8 NOT NULL,
+				last_keepalive INT8 NOT NULL
+			)`,
+	}
+
+	cockroachPrimaryKeys = map[string]string{
+		idStrategySequence:    `PRIMARY KEY (id)`,
+		idStrategyHashSharded: `PRIMARY KEY (id) USING HASH`,
+	}
+)
+
+// NewCockroach returns a backend on CockroachDB, which speaks the postgres
+// protocol. Statements and transactions that CockroachDB aborts to
+// serialize them with others are retried, rather than failing the request.
+func NewCockroach(ctx context.Context, dataSourceName string, tlsInfo tls.Config, config generic.Config) (server.Backend, error) {
+	dataSourceName, err := config.ParseDSN(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	dataSourceName, idStrategy, ok := parseParam(dataSourceName, "id-strategy")
+	if !ok {
+		idStrategy = idStrategySequence
+	}
+	primaryKey, ok := cockroachPrimaryKeys[idStrategy]
+	if !ok {
+		return nil, fmt.Errorf("unknown id-strategy %q, must be %q or %q", idStrategy, idStrategySequence, idStrategyHashSharded)
+	}
+
+	if dataSourceName == "" {
+		dataSourceName = defaultCockroachDSN
+	}
+	parsedDSN, err := prepareDSN(config.GetLogger(), dataSourceName, tlsInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	createDSN, err := config.WithPassword(ctx, parsedDSN, withPassword(parsedDSN))
+	if err != nil {
+		return nil, err
+	}
+	if err := createCockroachDBIfNotExist(createDSN); err != nil {
+		return nil, err
+	}
+
+	dialect, err := generic.OpenPassword(ctx, "postgres", parsedDSN, withPassword(parsedDSN), config, "$", true)
+	if err != nil {
+		return nil, err
+	}
+	dialect.GetSizeSQL = `SELECT COALESCE(SUM(range_size), 0)::INT8 FROM [SHOW RANGES FROM CURRENT_CATALOG WITH DETAILS]`
+	// the versions of rows that were overwritten or deleted are not in use,
+	// but are only reclaimed by the garbage collection of CockroachDB
+	dialect.GetSizeInUseSQL = `SELECT COALESCE(SUM((span_stats->>'live_bytes')::INT8), 0)::INT8 FROM [SHOW RANGES FROM CURRENT_CATALOG WITH DETAILS]`
+	dialect.PrefixSQL = prefixSQL
+	// rows are restored with their ids, which the id sequence must follow
+	dialect.ResetSequenceSQL = dialect.Render(`SELECT setval('kine_id_seq', (SELECT COALESCE(MAX(id), 0) + 1 FROM kine), false)`)
+	dialect.RaiseSequenceSQL = dialect.Render(`SELECT setval('kine_id_seq', %[1]d) FROM kine_id_seq WHERE last_value <= %[1]d`)
+	dialect.TranslateErr = translateErr
+	dialect.ErrCode = errCode
+	dialect.ConnectionErrCodes = connectionErrCodes
+	dialect.Retry = func(err error) bool {
+		return cockroachRetryErrCodes[errCode(err)]
+	}
+	dialect.MaxRetryBackoff = maxCockroachRetryBackoff
+
+	if err := setupCockroach(dialect, primaryKey); err != nil {
+		return nil, err
+	}
+
+	return logstructured.New(sqllog.New(dialect)), nil
+}
+
+func setupCockroach(dialect *generic.Generic, primaryKey string) error {
+	if dialect.SchemaName != "" {
+		if _, err := dialect.DB.Exec("CREATE SCHEMA IF NOT EXISTS " + dialect.SchemaName); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range cockroachSchema {
+		if strings.Contains(stmt, "%s") {
+			stmt = fmt.Sprintf(stmt, primaryKey)
+		}
+		if _, err := dialect.DB.Exec(dialect.Render(stmt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createCockroachDBIfNotExist creates the database of the data source name.
+// CockroachDB accepts connections to databases that do not exist, so it is
+// created up front rather than when connecting fails.
+func createCockroachDBIfNotExist(dataSourceName string) error {
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return err
+	}
+
+	dbName := strings.SplitN(u.Path, "/", 2)[1]
+	u.Path = "/defaultdb"
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE DATABASE IF NOT EXISTS " + pq.QuoteIdentifier(dbName))
+	return err
+}
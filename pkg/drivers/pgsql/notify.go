@@ -0,0 +1,118 @@
+package pgsql
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/logging"
+)
+
+const (
+	// listenPingInterval is how often the LISTEN connection is checked, so that
+	// a connection that died quietly is reestablished.
+	listenPingInterval = 90 * time.Second
+)
+
+// notifyChannel returns the channel that inserts into the table of the log
+// are notified on, with the revision of the new row as payload. It is named
+// after the table, so that kine sharing a database are only told of their
+// own inserts.
+func notifyChannel(config generic.Config) string {
+	return config.Table()
+}
+
+// notifySchema returns the statements that install the trigger notifying of
+// inserts into the table of the log.
+func notifySchema(config generic.Config) []string {
+	var (
+		table    = config.Table()
+		function = table + "_notify"
+		trigger  = config.GetTableName() + "_notify"
+	)
+	return []string{
+		`CREATE OR REPLACE FUNCTION ` + function + `() RETURNS trigger AS $$
+			BEGIN
+				PERFORM pg_notify(` + pq.QuoteLiteral(notifyChannel(config)) + `, NEW.id::text);
+				RETURN NULL;
+			END;
+		$$ LANGUAGE plpgsql`,
+		`DO $$
+			BEGIN
+				IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = '` + trigger + `' AND tgrelid = '` + table + `'::regclass) THEN
+					CREATE TRIGGER ` + trigger + ` AFTER INSERT ON ` + table + `
+						FOR EACH ROW EXECUTE PROCEDURE ` + function + `();
+				END IF;
+			END
+		$$`,
+	}
+}
+
+// setupNotify installs the trigger that notifies of inserts. The trigger
+// notifies within the inserting transaction, so it works through connection
+// poolers such as PgBouncer too.
+func setupNotify(dialect *generic.Generic) error {
+	for _, stmt := range notifySchema(dialect.Config) {
+		if _, err := dialect.DB.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listen returns a function that listens for insert notifications on a
+// dedicated connection. Notifications are lost while the connection is down,
+// and LISTEN does not work at all through transaction pooling, which is
+// why kine keeps polling on its interval regardless.
+func listen(logger logging.Logger, dataSourceName, channel string) func(ctx context.Context) (<-chan int64, error) {
+	return func(ctx context.Context) (<-chan int64, error) {
+		listener := pq.NewListener(dataSourceName, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+			switch event {
+			case pq.ListenerEventDisconnected:
+				logger.Warnf("LISTEN connection lost, falling back to polling: %v", err)
+			case pq.ListenerEventReconnected:
+				logger.Infof("LISTEN connection reestablished")
+			}
+		})
+		if err := listener.Listen(channel); err != nil {
+			listener.Close()
+			return nil, err
+		}
+
+		result := make(chan int64, 100)
+		go func() {
+			defer close(result)
+			defer listener.Close()
+
+			ping := time.NewTicker(listenPingInterval)
+			defer ping.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ping.C:
+					go listener.Ping()
+				case n := <-listener.Notify:
+					// a nil notification follows a reconnect; whatever was
+					// missed in between is found by the next poll
+					if n == nil {
+						continue
+					}
+					rev, err := strconv.ParseInt(n.Extra, 10, 64)
+					if err != nil {
+						logger.Errorf("invalid insert notification %q: %v", n.Extra, err)
+						continue
+					}
+					select {
+					case result <- rev:
+					default:
+					}
+				}
+			}
+		}()
+		return result, nil
+	}
+}
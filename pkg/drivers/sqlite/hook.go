@@ -0,0 +1,86 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hookRetryDelay is how long after an insert was first notified it is
+// notified again. Commit hooks run just before the commit becomes visible to
+// other connections, so the first poll may not find the row yet.
+const hookRetryDelay = 10 * time.Millisecond
+
+// inserts passes on the revisions of inserts seen by update hooks to the
+// listeners of the database they were made on.
+var inserts = &insertListeners{
+	listeners: map[string]map[chan int64]struct{}{},
+}
+
+type insertListeners struct {
+	sync.Mutex
+	listeners map[string]map[chan int64]struct{}
+}
+
+// listen returns a channel of the revisions of inserts into the database,
+// which is closed once ctx is done.
+func (l *insertListeners) listen(ctx context.Context, key string) <-chan int64 {
+	l.Lock()
+	defer l.Unlock()
+
+	ch := make(chan int64, 100)
+	if l.listeners[key] == nil {
+		l.listeners[key] = map[chan int64]struct{}{}
+	}
+	l.listeners[key][ch] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		l.Lock()
+		defer l.Unlock()
+		delete(l.listeners[key], ch)
+		if len(l.listeners[key]) == 0 {
+			delete(l.listeners, key)
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+// notify passes the revision on to the listeners of the database, right away
+// and once more shortly after.
+func (l *insertListeners) notify(key string, rev int64) {
+	l.send(key, rev)
+	time.Sleep(hookRetryDelay)
+	l.send(key, rev)
+}
+
+func (l *insertListeners) send(key string, rev int64) {
+	l.Lock()
+	defer l.Unlock()
+	for ch := range l.listeners[key] {
+		select {
+		case ch <- rev:
+		default:
+		}
+	}
+}
+
+// hookKey returns the database file of the data source name, so that
+// connections to the same database share their inserts whether or not they
+// use a shared cache.
+func hookKey(dataSourceName string) string {
+	name := strings.TrimPrefix(strings.SplitN(dataSourceName, "?", 2)[0], "file:")
+	if name == "" || strings.HasPrefix(name, ":memory:") {
+		return name
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return name
+}
@@ -0,0 +1,163 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	journalModes      = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	synchronousLevels = []string{"OFF", "NORMAL", "FULL", "EXTRA", "0", "1", "2", "3"}
+)
+
+// Config holds sqlite settings that are applied with PRAGMA statements on
+// every connection opened by kine. Zero values leave the setting from the DSN,
+// or the sqlite default, in place.
+type Config struct {
+	// BusyTimeout is how long a connection waits on a locked database before
+	// failing with SQLITE_BUSY.
+	BusyTimeout time.Duration
+	// JournalMode is one of DELETE, TRUNCATE, PERSIST, MEMORY, WAL or OFF.
+	JournalMode string
+	// Synchronous is one of OFF, NORMAL, FULL or EXTRA.
+	Synchronous string
+	// WALAutoCheckpoint is the number of WAL pages after which a checkpoint is
+	// run automatically. A negative value disables automatic checkpoints.
+	WALAutoCheckpoint int
+	// DisableUpdateHook stops kine from hooking into its connections to learn
+	// of inserts right away, and leaves the polling to find them.
+	DisableUpdateHook bool
+	// SetupTimeout is how long creating the tables is retried while the
+	// database is not ready, such as while dqlite is still initializing.
+	// Defaults to five minutes.
+	SetupTimeout time.Duration
+	// PortableSnapshots snapshots the database row by row, as the other
+	// backends do, so that its snapshots restore into any backend rather
+	// than only into sqlite. Snapshots of either kind restore into sqlite.
+	PortableSnapshots bool
+}
+
+func (c Config) pragmas() ([]string, error) {
+	var pragmas []string
+
+	if c.BusyTimeout < 0 {
+		return nil, fmt.Errorf("invalid sqlite busy timeout %v", c.BusyTimeout)
+	} else if c.BusyTimeout > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA busy_timeout = %d", c.BusyTimeout.Milliseconds()))
+	}
+
+	if c.JournalMode != "" {
+		if !oneOf(c.JournalMode, journalModes) {
+			return nil, fmt.Errorf("invalid sqlite journal mode %q, must be one of %s", c.JournalMode, strings.Join(journalModes, ", "))
+		}
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA journal_mode = %s", strings.ToUpper(c.JournalMode)))
+	}
+
+	if c.Synchronous != "" {
+		if !oneOf(c.Synchronous, synchronousLevels) {
+			return nil, fmt.Errorf("invalid sqlite synchronous level %q, must be one of %s", c.Synchronous, strings.Join(synchronousLevels[:4], ", "))
+		}
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA synchronous = %s", strings.ToUpper(c.Synchronous)))
+	}
+
+	if c.WALAutoCheckpoint < 0 {
+		pragmas = append(pragmas, "PRAGMA wal_autocheckpoint = 0")
+	} else if c.WALAutoCheckpoint > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA wal_autocheckpoint = %d", c.WALAutoCheckpoint))
+	}
+
+	return pragmas, nil
+}
+
+// checkJournalMode verifies that the requested journal mode is in effect. sqlite
+// does not fail when a journal mode can't be enabled, for example WAL on a
+// read-only filesystem, it just keeps the previous mode.
+func (c Config) checkJournalMode(ctx context.Context, db *sql.DB) error {
+	if c.JournalMode == "" {
+		return nil
+	}
+
+	var mode string
+	if err := db.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&mode); err != nil {
+		return err
+	}
+	if !strings.EqualFold(mode, c.JournalMode) {
+		return fmt.Errorf("sqlite journal mode %s could not be enabled, database is using %s", strings.ToUpper(c.JournalMode), mode)
+	}
+	return nil
+}
+
+// pragmaConnector opens connections through the underlying driver and runs
+// the configured PRAGMA statements on each of them, as most sqlite settings
+// only apply to the connection they were issued on.
+type pragmaConnector struct {
+	driver  driver.Driver
+	dsn     string
+	pragmas []string
+}
+
+func newPragmaConnector(driverName, dataSourceName string, pragmas []string) (*pragmaConnector, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return &pragmaConnector{
+		driver:  db.Driver(),
+		dsn:     dataSourceName,
+		pragmas: pragmas,
+	}, nil
+}
+
+func (c *pragmaConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pragma := range c.pragmas {
+		if err := execConn(ctx, conn, pragma); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %w", pragma, err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (c *pragmaConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func execConn(ctx context.Context, conn driver.Conn, query string) error {
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		_, err := execer.ExecContext(ctx, query, nil)
+		return err
+	}
+
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	if execer, ok := stmt.(driver.StmtExecContext); ok {
+		_, err = execer.ExecContext(ctx, nil)
+		return err
+	}
+	return fmt.Errorf("driver does not support executing statements with a context")
+}
+
+func oneOf(value string, allowed []string) bool {
+	for _, a := range allowed {
+		if strings.EqualFold(value, a) {
+			return true
+		}
+	}
+	return false
+}
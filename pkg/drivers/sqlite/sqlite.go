@@ -1,27 +1,25 @@
-//go:build cgo
-// +build cgo
-
 package sqlite
 
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"os"
 	"time"
 
-	"github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 	"github.com/rancher/kine/pkg/drivers/generic"
 	"github.com/rancher/kine/pkg/logstructured"
 	"github.com/rancher/kine/pkg/logstructured/sqllog"
 	"github.com/rancher/kine/pkg/server"
-	"github.com/sirupsen/logrus"
-
-	// sqlite db driver
-	_ "github.com/mattn/go-sqlite3"
 )
 
 var (
+	// The names of keys are stored as text, which sqlite keeps as the bytes
+	// it is given, NUL bytes and invalid UTF-8 included, and compares with
+	// memcmp under its default binary collation, as etcd compares keys. Names
+	// stored as blobs would instead compare unequal to the text literals of
+	// the statements.
 	schema = []string{
 		`CREATE TABLE IF NOT EXISTS kine
 			(
@@ -36,16 +34,47 @@ var (
 				old_value BLOB
 			)`,
 		`CREATE INDEX IF NOT EXISTS kine_name_id_index ON kine (name,id)`,
-		`CREATE UNIQUE INDEX IF NOT EXISTS kine_prev_revision_name_uindex ON kine (prev_revision, name)`,
+		`CREATE TABLE IF NOT EXISTS kine_leases
+			(
+				id INTEGER PRIMARY KEY,
+				ttl INTEGER NOT NULL,
+				granted_at INTEGER NOT NULL,
+				last_keepalive INTEGER NOT NULL
+			)`,
 	}
+
+	// uniqueIndex is created once the tables are, after resolving the rows
+	// that old versions of kine left violating it.
+	uniqueIndex = `CREATE UNIQUE INDEX IF NOT EXISTS kine_prev_revision_name_uindex ON kine (prev_revision, name)`
+)
+
+// Setting up the database is retried with a backoff from setupBackoff up to
+// maxSetupBackoff, for defaultSetupTimeout unless the config sets another
+// timeout. Failed attempts are logged every setupLogInterval at most.
+const (
+	setupBackoff        = 100 * time.Millisecond
+	maxSetupBackoff     = 5 * time.Second
+	defaultSetupTimeout = 5 * time.Minute
+	setupLogInterval    = 30 * time.Second
 )
 
-func New(ctx context.Context, dataSourceName string) (server.Backend, error) {
-	backend, _, err := NewVariant(ctx, "sqlite3", dataSourceName)
+// DefaultConnectionPoolConfig is the pool of sqlite databases. Writers lock
+// the whole database, so writes are serialized by kine with LockWrites and
+// only one connection writes at a time, while the others serve reads. As
+// connections are local and each applies the pragmas when opened, they are
+// kept open for good.
+var DefaultConnectionPoolConfig = generic.ConnectionPoolConfig{
+	MaxOpen:     5,
+	MaxIdle:     5,
+	MaxLifetime: -1,
+}
+
+func New(ctx context.Context, dataSourceName string, config Config, genericConfig generic.Config) (server.Backend, error) {
+	backend, _, err := NewVariant(ctx, defaultDriverName, dataSourceName, config, genericConfig)
 	return backend, err
 }
 
-func NewVariant(ctx context.Context, driverName, dataSourceName string) (server.Backend, *generic.Generic, error) {
+func NewVariant(ctx context.Context, driverName, dataSourceName string, config Config, genericConfig generic.Config) (server.Backend, *generic.Generic, error) {
 	if dataSourceName == "" {
 		if err := os.MkdirAll("./db", 0700); err != nil {
 			return nil, nil, err
@@ -53,42 +82,99 @@ func NewVariant(ctx context.Context, driverName, dataSourceName string) (server.
 		dataSourceName = "./db/state.db?_journal=WAL&cache=shared"
 	}
 
-	dialect, err := generic.Open(ctx, driverName, dataSourceName, "?", false)
+	dataSourceName, err := genericConfig.ParseDSN(dataSourceName)
 	if err != nil {
 		return nil, nil, err
 	}
-	dialect.LastInsertID = true
-	dialect.TranslateErr = func(err error) error {
-		if err, ok := err.(sqlite3.Error); ok && err.ExtendedCode == sqlite3.ErrConstraintUnique {
-			return server.ErrKeyExists
+	if genericConfig.SchemaName != "" {
+		return nil, nil, errors.New("sqlite does not support schema names, the tables are always in the main database")
+	}
+
+	dataSourceName, err = prepareDSN(dataSourceName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pragmas, err := config.pragmas()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	genericConfig.ConnectionPoolConfig = genericConfig.ConnectionPoolConfig.WithDefaults(DefaultConnectionPoolConfig)
+	var dialect *generic.Generic
+	hookDriver, listen := updateHook(driverName, dataSourceName, config, genericConfig.GetTableName())
+	if len(pragmas) > 0 || hookDriver != nil {
+		connector, err := newPragmaConnector(driverName, dataSourceName, pragmas)
+		if err != nil {
+			return nil, nil, err
+		}
+		if hookDriver != nil {
+			connector.driver = hookDriver
+		}
+		dialect, err = generic.OpenConnector(ctx, connector, genericConfig, "?", false)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		dialect, err = generic.Open(ctx, driverName, dataSourceName, genericConfig, "?", false)
+		if err != nil {
+			return nil, nil, err
 		}
-		return err
 	}
-	dialect.GetSizeSQL = `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`
 
-	// this is the first SQL that will be executed on a new DB conn so
-	// loop on failure here because in the case of dqlite it could still be initializing
-	for i := 0; i < 300; i++ {
-		err = setup(dialect.DB)
-		if err == nil {
-			break
+	if err := config.checkJournalMode(ctx, dialect.DB); err != nil {
+		return nil, nil, err
+	}
+	for _, dsn := range genericConfig.ReadDataSourceNames {
+		replicaDSN, err := prepareDSN(dsn)
+		if err != nil {
+			return nil, nil, err
 		}
-		logrus.Errorf("failed to setup db: %v", err)
-		select {
-		case <-ctx.Done():
-			return nil, nil, ctx.Err()
-		case <-time.After(time.Second):
+		if err := dialect.OpenReplica(driverName, replicaDSN, nil); err != nil {
+			return nil, nil, err
 		}
-		time.Sleep(time.Second)
 	}
-	if err != nil {
+	dialect.LockWrites = true
+	dialect.LastInsertID = true
+	dialect.TranslateErr = translateErr
+	dialect.ErrCode = errCode
+	dialect.Listen = listen
+	dialect.GetSizeSQL = `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`
+	dialect.GetSizeInUseSQL = `SELECT (page_count - freelist_count) * page_size FROM pragma_page_count(), pragma_freelist_count(), pragma_page_size()`
+	dialect.DefragmentSQL = `VACUUM`
+	dialect.RaiseSequenceSQL = dialect.Render(`UPDATE sqlite_sequence SET seq = %[1]d WHERE name = 'kine' AND seq < %[1]d`)
+	// the statistics of an index start with the number of its rows, followed
+	// by the average number of rows per distinct name
+	dialect.EstimateCountSQL = dialect.Render(`
+		SELECT CAST(stat AS INTEGER), CAST(stat AS INTEGER) / MAX(CAST(substr(stat, instr(stat, ' ') + 1) AS INTEGER), 1)
+		FROM sqlite_stat1
+		WHERE tbl = 'kine' AND idx = 'kine_name_id_index'`)
+	if driverName == defaultDriverName {
+		// dqlite keeps its database on the cluster rather than in a local
+		// file, so it is snapshotted row by row instead
+		if !config.PortableSnapshots {
+			dialect.SnapshotFile = snapshotFile(dialect.DB)
+		}
+		dialect.RestoreFile = restoreFile(dialect)
+		dialect.FlushFile = flushFile(dialect.DB)
+	}
+
+	// this is the first SQL that will be executed on a new DB conn, which
+	// fails while dqlite is still initializing
+	if err := setupWithRetry(ctx, dialect, config.SetupTimeout); err != nil {
 		return nil, nil, errors.Wrap(err, "setup db")
 	}
-	//if err := setup(dialect.DB); err != nil {
-	//	return nil, nil, errors.Wrap(err, "setup db")
-	//}
+	if genericConfig.EstimateCounts {
+		// sqlite only gathers the statistics that counts are estimated
+		// from when it is told to
+		if _, err := dialect.DB.ExecContext(ctx, dialect.Render(`ANALYZE kine`)); err != nil {
+			dialect.Logger.Warnf("Failed to gather the statistics of the %s table, counting keys exactly: %v", dialect.Table(), err)
+		}
+	}
 
-	dialect.Migrate(context.Background())
+	if err := dialect.Migrate(context.Background()); err != nil {
+		return nil, nil, err
+	}
 	if err := dialect.Prepare(); err != nil {
 		return nil, nil, err
 	}
@@ -96,13 +182,136 @@ func NewVariant(ctx context.Context, driverName, dataSourceName string) (server.
 	return logstructured.New(sqllog.New(dialect)), dialect, nil
 }
 
-func setup(db *sql.DB) error {
+// snapshotFile copies the database to a new file with VACUUM INTO, which reads
+// it in a single transaction without blocking writers.
+func snapshotFile(db *sql.DB) generic.SnapshotFile {
+	return func(ctx context.Context, path string) error {
+		_, err := db.ExecContext(ctx, `VACUUM INTO ?`, path)
+		return err
+	}
+}
+
+// flushFile checkpoints the write-ahead log into the database file and
+// truncates it, retrying while readers of the log hold up the checkpoint. It
+// does nothing in the journal modes that write to the database file directly.
+func flushFile(db *sql.DB) generic.FlushFile {
+	return func(ctx context.Context) error {
+		for {
+			var busy, pages, checkpointed int
+			if err := db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &pages, &checkpointed); err != nil {
+				return err
+			}
+			if busy == 0 {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+}
+
+// restoreFile attaches the database file of a snapshot and copies its rows,
+// keeping their ids so that the revisions are unchanged.
+func restoreFile(dialect *generic.Generic) generic.RestoreFile {
+	return func(ctx context.Context, path string, before, after func(ctx context.Context, tx *sql.Tx) error) error {
+		// the snapshot is only attached to the connection that attached it
+		conn, err := dialect.DB.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS snapshot`, path); err != nil {
+			return err
+		}
+		defer conn.ExecContext(context.Background(), `DETACH DATABASE snapshot`)
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := before(ctx, tx); err != nil {
+			return err
+		}
+		for _, stmt := range []string{
+			`INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+				SELECT id, name, created, deleted, create_revision, prev_revision, lease, value, old_value
+				FROM snapshot.kine`,
+			`INSERT INTO kine_leases(id, ttl, granted_at, last_keepalive)
+				SELECT id, ttl, granted_at, last_keepalive
+				FROM snapshot.kine_leases`,
+		} {
+			if _, err := tx.ExecContext(ctx, dialect.Render(stmt)); err != nil {
+				return err
+			}
+		}
+		if err := after(ctx, tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+}
+
+// setupWithRetry runs setup until it succeeds, waiting setupBackoff after the
+// first failure and twice as long after each next one, up to
+// maxSetupBackoff. It gives up once the next retry would start after the
+// timeout, or the default setup timeout if it is not set, and right away on
+// errors that retrying will not get past. Failures are logged once every
+// setupLogInterval at most.
+func setupWithRetry(ctx context.Context, dialect *generic.Generic, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultSetupTimeout
+	}
+
+	var (
+		start   = time.Now()
+		backoff = setupBackoff
+		logged  time.Time
+	)
+	for attempt := 1; ; attempt++ {
+		err := setup(ctx, dialect)
+		if err == nil {
+			return nil
+		}
+		if permanentErr(err) {
+			return err
+		}
+		if time.Since(start)+backoff > timeout {
+			return fmt.Errorf("giving up after %d attempts in %s: %w", attempt, time.Since(start).Round(time.Millisecond), err)
+		}
+
+		if time.Since(logged) >= setupLogInterval {
+			dialect.Logger.Warnf("Database is not ready yet, retrying setup (attempt %d): %v", attempt, err)
+			logged = time.Now()
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > maxSetupBackoff {
+			backoff = maxSetupBackoff
+		}
+	}
+}
+
+func setup(ctx context.Context, dialect *generic.Generic) error {
 	for _, stmt := range schema {
-		_, err := db.Exec(stmt)
+		_, err := dialect.DB.ExecContext(ctx, dialect.Render(stmt))
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return dialect.CreateUniqueIndex(ctx, func() error {
+		_, err := dialect.DB.ExecContext(ctx, dialect.Render(uniqueIndex))
+		return err
+	})
 }
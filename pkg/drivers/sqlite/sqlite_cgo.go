@@ -0,0 +1,110 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/server"
+
+	// sqlite db driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const defaultDriverName = "sqlite3"
+
+// updateHook returns a driver that hooks into every connection it opens to
+// learn of inserts into the table of the log, and a function listening for them. The
+// inserts are shared with every kine in the process that opened the same
+// database, as hooks only see the changes of their own connection. Hooks are
+// not available for other drivers, such as dqlite.
+func updateHook(driverName, dataSourceName string, config Config, tableName string) (driver.Driver, generic.Listen) {
+	if driverName != defaultDriverName || config.DisableUpdateHook {
+		return nil, nil
+	}
+
+	// kine on other tables of the same database are not told of the inserts
+	key := hookKey(dataSourceName) + "#" + tableName
+	hookDriver := &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			// the hooks of a connection are called one at a time, from the
+			// goroutine using it
+			var pending int64
+			conn.RegisterUpdateHook(func(op int, database, table string, rowid int64) {
+				if op == sqlite3.SQLITE_INSERT && database == "main" && table == tableName && rowid > pending {
+					pending = rowid
+				}
+			})
+			conn.RegisterCommitHook(func() int {
+				if pending > 0 {
+					go inserts.notify(key, pending)
+					pending = 0
+				}
+				return 0
+			})
+			conn.RegisterRollbackHook(func() {
+				pending = 0
+			})
+			return nil
+		},
+	}
+
+	return hookDriver, func(ctx context.Context) (<-chan int64, error) {
+		return inserts.listen(ctx, key), nil
+	}
+}
+
+func translateErr(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch {
+		case sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique:
+			return server.ErrKeyExists
+		case sqliteErr.Code == sqlite3.ErrFull:
+			// the disk is full; a vacuum needs up to twice the database size
+			return server.ErrNoSpace
+		}
+	}
+	return err
+}
+
+func errCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return fmt.Sprint(sqliteErr.ExtendedCode)
+	}
+	return err.Error()
+}
+
+// permanentErr reports whether sqlite failed the statement in a way that
+// running it again will not get past, such as an invalid schema or a file
+// that is not a database. Busy and locked databases, and the errors of other
+// drivers such as those of a dqlite cluster that is still initializing, are
+// not permanent.
+func permanentErr(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code {
+	case sqlite3.ErrError, sqlite3.ErrPerm, sqlite3.ErrReadonly, sqlite3.ErrCorrupt,
+		sqlite3.ErrCantOpen, sqlite3.ErrMismatch, sqlite3.ErrAuth, sqlite3.ErrNotADB:
+		return true
+	}
+	return false
+}
+
+// prepareDSN returns the DSN unchanged, as go-sqlite3 understands the
+// connection parameters used by kine natively.
+func prepareDSN(dataSourceName string) (string, error) {
+	return dataSourceName, nil
+}
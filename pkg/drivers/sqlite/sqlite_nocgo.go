@@ -4,24 +4,107 @@
 package sqlite
 
 import (
-	"context"
-	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/rancher/kine/pkg/drivers/generic"
 	"github.com/rancher/kine/pkg/server"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
-var errNoCgo = errors.New("this binary is built without CGO, sqlite is disabled")
+const defaultDriverName = "sqlite"
 
-func New(ctx context.Context, dataSourceName string) (server.Backend, error) {
-	return nil, errNoCgo
+// pragmaParams maps the go-sqlite3 DSN parameters to the pragma they set, so
+// that DSNs written for the cgo driver keep working with modernc.org/sqlite.
+var pragmaParams = map[string]string{
+	"_auto_vacuum":  "auto_vacuum",
+	"_vacuum":       "auto_vacuum",
+	"_busy_timeout": "busy_timeout",
+	"_timeout":      "busy_timeout",
+	"_foreign_keys": "foreign_keys",
+	"_fk":           "foreign_keys",
+	"_journal_mode": "journal_mode",
+	"_journal":      "journal_mode",
+	"_locking_mode": "locking_mode",
+	"_locking":      "locking_mode",
+	"_synchronous":  "synchronous",
+	"_sync":         "synchronous",
 }
 
-func NewVariant(driverName, dataSourceName string) (server.Backend, *generic.Generic, error) {
-	return nil, nil, errNoCgo
+// updateHook returns nil, as modernc.org/sqlite does not expose update hooks.
+func updateHook(driverName, dataSourceName string, config Config, tableName string) (driver.Driver, generic.Listen) {
+	return nil, nil
 }
 
-func setup(db *sql.DB) error {
-	return errNoCgo
+func translateErr(err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch {
+		case sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+			return server.ErrKeyExists
+		case sqliteErr.Code()&0xff == sqlite3.SQLITE_FULL:
+			// the disk is full; a vacuum needs up to twice the database size
+			return server.ErrNoSpace
+		}
+	}
+	return err
+}
+
+func errCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return fmt.Sprint(sqliteErr.Code())
+	}
+	return err.Error()
+}
+
+// permanentErr reports whether sqlite failed the statement in a way that
+// running it again will not get past, as it does for the cgo driver.
+func permanentErr(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_ERROR, sqlite3.SQLITE_PERM, sqlite3.SQLITE_READONLY, sqlite3.SQLITE_CORRUPT,
+		sqlite3.SQLITE_CANTOPEN, sqlite3.SQLITE_MISMATCH, sqlite3.SQLITE_AUTH, sqlite3.SQLITE_NOTADB:
+		return true
+	}
+	return false
+}
+
+// prepareDSN rewrites go-sqlite3 style connection parameters such as
+// _journal=WAL into the _pragma=journal_mode(WAL) form expected by
+// modernc.org/sqlite. Parameters that are not recognized are passed through.
+func prepareDSN(dataSourceName string) (string, error) {
+	parts := strings.SplitN(dataSourceName, "?", 2)
+	if len(parts) == 1 {
+		return dataSourceName, nil
+	}
+
+	values, err := url.ParseQuery(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	for k, vs := range values {
+		pragma, ok := pragmaParams[k]
+		for _, v := range vs {
+			if ok {
+				params.Add("_pragma", fmt.Sprintf("%s(%s)", pragma, v))
+			} else {
+				params.Add(k, v)
+			}
+		}
+	}
+
+	return fmt.Sprintf("%s?%s", parts[0], params.Encode()), nil
 }
@@ -0,0 +1,251 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/tls"
+)
+
+// EffectiveConfig is the configuration that kine runs with, as it resolved
+// it from its Config: with the defaults applied to the settings that were
+// not set, and the secrets of the endpoints masked. It is logged as kine
+// starts, and served at /debug/config along with the metrics. Durations are
+// formatted as by time.Duration, and those that disable what they time, such
+// as a zero compact interval, as "disabled".
+type EffectiveConfig struct {
+	Driver          string   `json:"driver"`
+	Endpoint        string   `json:"endpoint"`
+	ReadEndpoints   []string `json:"readEndpoints,omitempty"`
+	Listeners       []string `json:"listeners"`
+	MetricsListener string   `json:"metricsListener,omitempty"`
+	// ServerTLS is none, tls, or mtls when the certificates of clients are
+	// verified, with RequireClientCert telling whether clients must present
+	// one.
+	ServerTLS         string `json:"serverTLS"`
+	RequireClientCert bool   `json:"requireClientCert,omitempty"`
+	// BackendTLS is none for the backends of files, dsn when the data source
+	// name alone sets TLS, and verify, skip-verify or mtls when the backend
+	// TLS config does.
+	BackendTLS string `json:"backendTLS"`
+	// ConnectionPool and StatementTimeouts are those of SQL databases.
+	ConnectionPool    *EffectivePool     `json:"connectionPool,omitempty"`
+	StatementTimeouts *EffectiveTimeouts `json:"statementTimeouts,omitempty"`
+	TableName         string             `json:"tableName,omitempty"`
+	SchemaName        string             `json:"schemaName,omitempty"`
+
+	CompactInterval  string `json:"compactInterval"`
+	CompactMinRetain int64  `json:"compactMinRetain"`
+	CompactGC        bool   `json:"compactGC"`
+	PollInterval     string `json:"pollInterval"`
+	PollBatchSize    int64  `json:"pollBatchSize"`
+	WatchBufferSize  int    `json:"watchBufferSize"`
+	WatchSharing     bool   `json:"watchSharing"`
+	// MaxConcurrentLists and ListRateLimit are zero when they do not limit
+	// expensive lists.
+	MaxConcurrentLists  int     `json:"maxConcurrentLists"`
+	ListQueueTimeout    string  `json:"listQueueTimeout"`
+	ListLimitThreshold  int64   `json:"listLimitThreshold"`
+	ListRateLimit       float64 `json:"listRateLimit"`
+	ListRateBurst       int     `json:"listRateBurst"`
+	NotifyInterval      string  `json:"notifyInterval"`
+	MaxRequestBytes     int     `json:"maxRequestBytes"`
+	MaxResponseBytes    int     `json:"maxResponseBytes"`
+	QuotaBackendBytes   int64   `json:"quotaBackendBytes"`
+	ReadOnly            bool    `json:"readOnly"`
+	SlowQueryThreshold  string  `json:"slowQueryThreshold"`
+	EstimateCounts      bool    `json:"estimateCounts"`
+	CompressValues      bool    `json:"compressValues"`
+	HealthCheckInterval string  `json:"healthCheckInterval"`
+	HealthCheckTimeout  string  `json:"healthCheckTimeout"`
+	AuditLog            string  `json:"auditLog,omitempty"`
+	PasswordFunc        bool    `json:"passwordFunc"`
+	Tracing             bool    `json:"tracing"`
+	VerifyOnStart       bool    `json:"verifyOnStart"`
+
+	// PrefixRetention lists the retentions as prefix=revisions or
+	// prefix=duration.
+	PrefixRetention []string `json:"prefixRetention,omitempty"`
+	// HookBufferSize is zero when no hooks are set.
+	HookBufferSize int `json:"hookBufferSize,omitempty"`
+	// QuiesceTimeout is the longest that writes are quiesced for.
+	QuiesceTimeout string `json:"quiesceTimeout"`
+}
+
+// EffectivePool is the pool of connections to a SQL database. MaxOpen is -1
+// when the open connections are not limited, and MaxLifetime is "forever"
+// when connections are reused for good.
+type EffectivePool struct {
+	MaxOpen     int    `json:"maxOpen"`
+	MaxIdle     int    `json:"maxIdle"`
+	MaxLifetime string `json:"maxLifetime"`
+}
+
+// EffectiveTimeouts are the timeouts of the statements of a SQL database,
+// "disabled" for the kinds of statements that are not timed out.
+type EffectiveTimeouts struct {
+	Read    string `json:"read"`
+	List    string `json:"list"`
+	Write   string `json:"write"`
+	Compact string `json:"compact"`
+}
+
+// newEffectiveConfig resolves the config that kine runs with from the config
+// of the driver and data source name, served at the urls.
+func newEffectiveConfig(config Config, driver, dsn string, urls []string) EffectiveConfig {
+	// the parameters of the data source name take precedence over those of
+	// the config; the backend started with them, so they parse
+	genericConfig := newGenericConfig(config, nil)
+	genericConfig.ParseDSN(dsn)
+	srv := serverConfig(config, nil, nil, nil).WithDefaults()
+
+	effective := EffectiveConfig{
+		Driver:              driver,
+		Endpoint:            RedactEndpoint(config.Endpoint),
+		Listeners:           urls,
+		MetricsListener:     config.MetricsListener,
+		ServerTLS:           "none",
+		RequireClientCert:   config.ServerTLSConfig.RequireClientCert,
+		BackendTLS:          backendTLSMode(driver, config.BackendTLSConfig),
+		CompactInterval:     formatDuration(genericConfig.GetCompactInterval(), "disabled"),
+		CompactMinRetain:    genericConfig.GetCompactMinRetain(),
+		CompactGC:           genericConfig.GetCompactGC(),
+		PollInterval:        formatDuration(genericConfig.GetPollInterval(), ""),
+		PollBatchSize:       genericConfig.GetPollBatchSize(),
+		WatchBufferSize:     genericConfig.GetWatchBufferSize(),
+		WatchSharing:        !config.DisableWatchSharing,
+		MaxConcurrentLists:  srv.MaxConcurrentLists,
+		ListQueueTimeout:    formatDuration(srv.ListQueueTimeout, ""),
+		ListLimitThreshold:  srv.ListLimitThreshold,
+		ListRateLimit:       srv.ListRateLimit,
+		ListRateBurst:       srv.ListRateBurst,
+		NotifyInterval:      formatDuration(srv.NotifyInterval, ""),
+		MaxRequestBytes:     srv.MaxRequestBytes,
+		MaxResponseBytes:    srv.MaxResponseBytes,
+		QuotaBackendBytes:   config.QuotaBackendBytes,
+		ReadOnly:            config.ReadOnly,
+		SlowQueryThreshold:  formatDuration(config.SlowQueryThreshold, "disabled"),
+		EstimateCounts:      config.EstimateCounts,
+		CompressValues:      config.CompressValues,
+		HealthCheckInterval: formatDuration(srv.HealthCheckInterval, ""),
+		HealthCheckTimeout:  formatDuration(srv.HealthCheckTimeout, ""),
+		AuditLog:            config.AuditLogFile,
+		PasswordFunc:        config.PasswordFunc != nil,
+		Tracing:             config.TracerProvider != nil,
+		VerifyOnStart:       config.VerifyOnStart,
+		QuiesceTimeout:      formatDuration(genericConfig.GetQuiesceTimeout(), ""),
+	}
+	if config.Hooks != nil {
+		effective.HookBufferSize = config.HookBufferSize
+		if effective.HookBufferSize <= 0 {
+			effective.HookBufferSize = logstructured.DefaultHookBufferSize
+		}
+	}
+	for _, r := range genericConfig.GetPrefixRetention() {
+		effective.PrefixRetention = append(effective.PrefixRetention, r.String())
+	}
+	for _, readEndpoint := range config.ReadEndpoints {
+		effective.ReadEndpoints = append(effective.ReadEndpoints, RedactEndpoint(readEndpoint))
+	}
+	for _, url := range urls {
+		if network, _ := networkAndAddress(url); network == "https" {
+			effective.ServerTLS = "tls"
+			if config.ServerTLSConfig.ClientCAFile != "" {
+				effective.ServerTLS = "mtls"
+			}
+		}
+	}
+	if config.AuditWriter != nil && effective.AuditLog == "" {
+		effective.AuditLog = "writer"
+	}
+
+	if driver == BoltBackend {
+		return effective
+	}
+	pool := genericConfig.ConnectionPoolConfig
+	if driver == SQLiteBackend {
+		pool = pool.WithDefaults(sqlite.DefaultConnectionPoolConfig)
+	}
+	pool = pool.InEffect()
+	if pool.MaxOpen < 0 {
+		pool.MaxOpen = -1
+	}
+	if pool.MaxIdle < 0 {
+		pool.MaxIdle = 0
+	}
+	effective.ConnectionPool = &EffectivePool{
+		MaxOpen:     pool.MaxOpen,
+		MaxIdle:     pool.MaxIdle,
+		MaxLifetime: formatDuration(pool.MaxLifetime, "forever"),
+	}
+	timeouts := genericConfig.StatementTimeouts.WithDefaults(generic.DefaultStatementTimeouts)
+	effective.StatementTimeouts = &EffectiveTimeouts{
+		Read:    formatDuration(timeouts.Read, "disabled"),
+		List:    formatDuration(timeouts.List, "disabled"),
+		Write:   formatDuration(timeouts.Write, "disabled"),
+		Compact: formatDuration(timeouts.Compact, "disabled"),
+	}
+	effective.TableName = genericConfig.GetTableName()
+	effective.SchemaName = genericConfig.SchemaName
+	return effective
+}
+
+// backendTLSMode returns how connections to the backend of the driver are
+// secured by its TLS config.
+func backendTLSMode(driver string, config tls.Config) string {
+	switch {
+	case driver == SQLiteBackend || driver == BoltBackend:
+		return "none"
+	case !config.Enabled():
+		return "dsn"
+	case config.SkipVerify:
+		return "skip-verify"
+	case config.CertFile != "":
+		return "mtls"
+	}
+	return "verify"
+}
+
+// formatDuration formats the duration, or returns off if it is not positive
+// and off is set.
+func formatDuration(d time.Duration, off string) string {
+	if d <= 0 && off != "" {
+		return off
+	}
+	return d.String()
+}
+
+// fields returns the settings of the config as log fields, by their JSON
+// names.
+func (c EffectiveConfig) fields() logging.Fields {
+	fields := logging.Fields{}
+	data, err := json.Marshal(c)
+	if err == nil {
+		err = json.Unmarshal(data, &fields)
+	}
+	if err != nil {
+		return logging.Fields{"error": err}
+	}
+	return fields
+}
+
+// logEffectiveConfig logs the config that kine runs with, as one entry with
+// a field for each setting.
+func logEffectiveConfig(log logging.Logger, config EffectiveConfig) {
+	logging.WithFields(log, config.fields()).Infof("Kine starting with the %s backend at %s", config.Driver, config.Endpoint)
+}
+
+// effectiveConfigHandler serves the config as JSON.
+func effectiveConfigHandler(config EffectiveConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		out := json.NewEncoder(w)
+		out.SetIndent("", "  ")
+		out.Encode(config)
+	})
+}
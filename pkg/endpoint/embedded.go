@@ -0,0 +1,206 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/audit"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/proxy/grpcproxy/adapter"
+)
+
+// embeddedKeepAliveTimeout is the time given to the keep alives of leases of
+// embedded clients, which the server answers in-process.
+const embeddedKeepAliveTimeout = time.Second
+
+// NewBackend returns the backend of the storage endpoint of the config,
+// without serving it. The backend is not started: it is started with Start,
+// and runs until the context of Start is done. Close then closes the
+// database, and the audit log of the config. The settings of the config
+// that concern the server and its listeners are ignored. Etcd endpoints have
+// no backend.
+func NewBackend(ctx context.Context, config Config) (server.Backend, error) {
+	driver, dsn := ParseStorageEndpoint(config.Endpoint)
+	if driver == ETCDBackend {
+		return nil, fmt.Errorf("etcd endpoints have no kine backend")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	var registerer prometheus.Registerer
+	if config.MetricsRegistry != nil {
+		registerer = config.MetricsRegistry
+	}
+	_, backend, err := newBackend(ctx, driver, dsn, config, registerer)
+	return backend, err
+}
+
+// StartPassiveBackend returns the backend of the storage endpoint of the
+// config, as NewBackend does, once it is started passively, so that it
+// neither expires keys nor leases that the kine serving its database keeps
+// alive, nor compacts it. It runs until ctx is done, and is closed with Close.
+func StartPassiveBackend(ctx context.Context, config Config) (server.Backend, error) {
+	config.CompactInterval = 0
+	backend, err := NewBackend(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := backend.Start(server.WithPassiveStart(ctx)); err != nil {
+		backend.Close()
+		return nil, err
+	}
+	return backend, nil
+}
+
+// newBackend returns the backend of the driver, writing to the audit log and
+// passing writes to the hooks of the config, and compressing values as it
+// sets.
+func newBackend(ctx context.Context, driver, dsn string, config Config, registerer prometheus.Registerer) (bool, server.Backend, error) {
+	leaderElect, backend, err := getKineStorageBackend(ctx, driver, dsn, config, registerer)
+	if err != nil {
+		return false, nil, errors.Wrap(err, "building kine")
+	}
+	auditLog, err := openAuditLog(config)
+	if err != nil {
+		backend.Close()
+		return false, nil, err
+	}
+	if l, ok := backend.(*logstructured.LogStructured); ok {
+		if auditLog != nil {
+			l.SetAuditLog(auditLog)
+		}
+		if config.Hooks != nil {
+			l.SetHooks(config.Hooks, config.HookBufferSize)
+		}
+		l.SetCompression(config.CompressValues)
+	}
+	if auditLog != nil {
+		backend = &auditedBackend{Backend: backend, auditLog: auditLog}
+	}
+	return leaderElect, backend, nil
+}
+
+// auditedBackend closes the audit log of a backend along with the backend.
+type auditedBackend struct {
+	server.Backend
+	auditLog *audit.Log
+}
+
+func (b *auditedBackend) Close() error {
+	err := b.Backend.Close()
+	if auditErr := b.auditLog.Close(); err == nil {
+		err = auditErr
+	}
+	return err
+}
+
+// Embedded is kine serving its storage endpoint in-process, to an etcd client
+// that calls the server directly rather than over gRPC. Requests are handled
+// by the same server as those of Listen, without being serialized, so they
+// behave alike; only the metrics of the rpcs are not collected.
+type Embedded struct {
+	client  *clientv3.Client
+	backend server.Backend
+	server  *server.KVServerBridge
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+	shutdown     func() error
+}
+
+// NewEmbedded starts kine on the storage endpoint of the config, without any
+// listener, and returns it once its backend is started. It runs until Close
+// is called or ctx is done. The settings of the config that concern the
+// listeners are ignored.
+func NewEmbedded(ctx context.Context, config Config) (*Embedded, error) {
+	// the backend runs until it is closed, or until the caller's context is
+	// done
+	ctx, cancel := context.WithCancel(ctx)
+	backend, err := NewBackend(ctx, config)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if config.VerifyOnStart {
+		if err := verifyBackend(ctx, logging.OrDefault(config.Logger), backend); err != nil {
+			cancel()
+			backend.Close()
+			return nil, err
+		}
+	}
+	if err := backend.Start(ctx); err != nil {
+		cancel()
+		backend.Close()
+		return nil, errors.Wrap(err, "starting kine backend")
+	}
+
+	var registerer prometheus.Registerer
+	if config.MetricsRegistry != nil {
+		registerer = config.MetricsRegistry
+	}
+	b := server.New(backend, serverConfig(config, config.ClientURLs, config.PeerURLs, registerer))
+
+	client := clientv3.NewCtxClient(ctx)
+	client.KV = clientv3.NewKVFromKVClient(adapter.KvServerToKvClient(b), client)
+	client.Watcher = clientv3.NewWatchFromWatchClient(adapter.WatchServerToWatchClient(b), client)
+	client.Lease = clientv3.NewLeaseFromLeaseClient(adapter.LeaseServerToLeaseClient(b), client, embeddedKeepAliveTimeout)
+	client.Maintenance = clientv3.NewMaintenanceFromMaintenanceClient(adapter.MaintenanceServerToMaintenanceClient(b), client)
+	client.Cluster = clientv3.NewClusterFromClusterClient(adapter.ClusterServerToClusterClient(b), client)
+
+	e := &Embedded{
+		client:  client,
+		backend: backend,
+		server:  b,
+		shutdown: func() error {
+			b.StopWatches()
+			// the client is done once its context is, so the error it
+			// returns says nothing
+			client.Close()
+			cancel()
+			return backend.Close()
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		e.Close()
+	}()
+	return e, nil
+}
+
+// Client returns the etcd client of kine, which is closed along with it.
+func (e *Embedded) Client() *clientv3.Client {
+	return e.client
+}
+
+// Backend returns the backend of kine, for callers that use the storage
+// layer directly.
+func (e *Embedded) Backend() server.Backend {
+	return e.backend
+}
+
+// SetReadOnly switches kine in or out of read-only mode, as
+// ETCDConfig.SetReadOnly does.
+func (e *Embedded) SetReadOnly(readOnly bool) {
+	e.server.SetReadOnly(readOnly)
+}
+
+// ReadOnly reports whether kine is in read-only mode.
+func (e *Embedded) ReadOnly() bool {
+	return e.server.ReadOnly()
+}
+
+// Close stops kine: it ends the watches of the client, closes the client,
+// stops the backend and closes the database.
+func (e *Embedded) Close() error {
+	e.shutdownOnce.Do(func() {
+		e.shutdownErr = e.shutdown()
+	})
+	return e.shutdownErr
+}
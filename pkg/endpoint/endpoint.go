@@ -3,101 +3,618 @@ package endpoint
 import (
 	"context"
 	"fmt"
+	"io"
+	"math"
 	"net"
+	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rancher/kine/pkg/audit"
+	"github.com/rancher/kine/pkg/drivers/bolt"
 	"github.com/rancher/kine/pkg/drivers/dqlite"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/drivers/mssql"
 	"github.com/rancher/kine/pkg/drivers/mysql"
 	"github.com/rancher/kine/pkg/drivers/pgsql"
 	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/logstructured"
 	"github.com/rancher/kine/pkg/server"
 	"github.com/rancher/kine/pkg/tls"
-	"github.com/sirupsen/logrus"
 	"go.etcd.io/etcd/server/v3/embed"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
 )
 
 const (
-	KineSocket      = "unix://kine.sock"
-	SQLiteBackend   = "sqlite"
-	DQLiteBackend   = "dqlite"
-	ETCDBackend     = "etcd3"
-	MySQLBackend    = "mysql"
-	PostgresBackend = "postgres"
+	KineSocket       = "unix://kine.sock"
+	SQLiteBackend    = "sqlite"
+	DQLiteBackend    = "dqlite"
+	ETCDBackend      = "etcd3"
+	MySQLBackend     = "mysql"
+	PostgresBackend  = "postgres"
+	CockroachBackend = "cockroachdb"
+	BoltBackend      = "bolt"
+	MSSQLBackend     = "mssql"
 )
 
 type Config struct {
 	GRPCServer *grpc.Server
-	Listener   string
-	Endpoint   string
+	// Listener is the address kine listens on, or a comma separated list of
+	// addresses. Addresses with the https scheme are served with TLS, using
+	// the certificate and key of ServerTLSConfig.
+	Listener string
+	Endpoint string
+	// ReadEndpoints are the endpoints of read replicas of the database of
+	// Endpoint, such as streaming replicas of Postgres, in the same form and
+	// of the same backend but without kine parameters. Lists and counts are
+	// read from them: serializable ones always, and linearizable ones once a
+	// replica has caught up to the latest revision kine has seen, falling
+	// back to the primary otherwise. Replicas that fail are not read from
+	// for a while. Only sqlite, Postgres and MySQL support read replicas.
+	ReadEndpoints []string
+	SQLite        sqlite.Config
 
-	tls.Config
+	// CompactInterval is the interval between automatic compactions, or zero
+	// to disable automatic compaction.
+	CompactInterval time.Duration
+	// CompactMinRetain is the number of revisions retained by automatic
+	// compaction.
+	CompactMinRetain int64
+	// CompactGC removes the rows that no read can return, as GC does, after
+	// every automatic compaction.
+	CompactGC bool
+	// PrefixRetention trims the history of the keys with a prefix, such as
+	// the events of Kubernetes, once it is older than their retention rather
+	// than CompactMinRetain, as part of automatic compaction.
+	PrefixRetention []generic.PrefixRetention
+	// NotifyInterval is the interval between progress notifications sent on
+	// watches that requested them.
+	NotifyInterval time.Duration
+	// MaxResponseBytes is the size above which watch responses are split into
+	// fragments, on watches that allow it.
+	MaxResponseBytes int
+	// MaxRequestBytes is the size above which write requests are rejected as
+	// too large, which defaults to the 1.5 MiB of etcd. Sizes are not limited
+	// if it is negative.
+	MaxRequestBytes int
+	// QuotaBackendBytes is the size of the database above which writes are
+	// rejected with a NOSPACE alarm, until it is compacted and defragmented
+	// back under the quota and the alarm is disarmed. Zero disables the quota.
+	QuotaBackendBytes int64
+	// ReadOnly starts kine in read-only mode, in which writes, lease grants
+	// and revocations and compactions are rejected, while reads, watches and
+	// lease keep alives are still served. SetReadOnly switches the mode at
+	// runtime. Leases that expire and the compactions of CompactInterval
+	// still write in read-only mode.
+	ReadOnly bool
+	// DisableWatchSharing gives every watch a watch of the database of its
+	// own. By default the watches of the same key and filters share one,
+	// which is polled and filtered once for all of them.
+	DisableWatchSharing bool
+	// MaxConcurrentLists is the number of expensive lists, of whole ranges or
+	// with limits above ListLimitThreshold, that run at once, with those over
+	// it waiting for up to ListQueueTimeout before they are rejected with
+	// ResourceExhausted. ListRateLimit is the number of expensive lists per
+	// second that each client may start, in bursts of up to ListRateBurst.
+	// Point reads, counts and smaller lists are never limited. Zero limits
+	// disable them, and the other settings take the defaults of the server.
+	MaxConcurrentLists int
+	ListQueueTimeout   time.Duration
+	ListLimitThreshold int64
+	ListRateLimit      float64
+	ListRateBurst      int
+	// Name, ClientURLs and PeerURLs describe the member returned by member
+	// list. ClientURLs default to the address kine listens on, and PeerURLs
+	// to ClientURLs.
+	Name       string
+	ClientURLs []string
+	PeerURLs   []string
+	// HealthCheckInterval is the interval at which the health service probes
+	// the database, and HealthCheckTimeout how long a probe may take before
+	// kine reports itself as not serving.
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	// WatchBufferSize is the number of event batches buffered for each watch
+	// before it is canceled for being too slow.
+	WatchBufferSize int
+	// PollInterval is the interval at which the database is polled for new
+	// events, and PollBatchSize the number of rows read per poll. They can
+	// also be set with the poll-interval and poll-batch-size parameters of
+	// the endpoint.
+	PollInterval  time.Duration
+	PollBatchSize int64
+	// SlowQueryThreshold is the duration above which SQL statements are
+	// logged as slow, or zero to not log them.
+	SlowQueryThreshold time.Duration
+	// EstimateCounts estimates the counts of keys from the statistics of
+	// SQL databases that keep them, rather than counting keys exactly.
+	EstimateCounts bool
+	// TableName and SchemaName are the table of the log in SQL databases and
+	// the schema it is created in, so that several kine can share a
+	// database. They default to the kine table in the default schema.
+	TableName  string
+	SchemaName string
+	// ConnectionPoolConfig sets the pool of connections to the database.
+	// Fields that are zero take the default of the driver: sqlite databases
+	// are written by a single connection at a time while the others serve
+	// reads, and other databases are limited to five connections reused for
+	// a minute.
+	ConnectionPoolConfig generic.ConnectionPoolConfig
+	// StatementTimeouts are the timeouts of SQL statements for point reads,
+	// lists, writes and compaction. Fields that are zero take the default,
+	// and negative ones disable the timeout.
+	StatementTimeouts generic.StatementTimeouts
+
+	// BackendTLSConfig holds the CA that the certificate of the database is
+	// verified with, and the certificate and key presented to it. With
+	// SkipVerify, connections are encrypted without verifying the database.
+	// It supplements the TLS parameters of the data source name, and its
+	// files are checked when the backend starts.
+	BackendTLSConfig tls.Config
+	// PasswordFunc returns the password that every new connection to a
+	// Postgres, CockroachDB or MySQL database authenticates with, in place of
+	// the password of the endpoint. It is for short lived tokens, such as
+	// those of AWS RDS IAM authentication, which a func built on
+	// rds/auth.BuildAuthToken of the AWS SDK hands out, or their Azure and
+	// Google Cloud equivalents.
+	PasswordFunc generic.PasswordFunc
+	// ServerTLSConfig holds the certificate and key that https listeners are
+	// served with, and the client CA that the certificates of clients are
+	// verified with. Its CA is the CA of the certificate, which the returned
+	// ETCDConfig trusts. As the returned ETCDConfig presents the certificate
+	// of the server as client certificate, when client certificates are
+	// required it must be signed by the client CA and allow client auth.
+	ServerTLSConfig tls.Config
+	// MetricsListener is the address that Prometheus metrics are served on
+	// over http at /metrics, such as 127.0.0.1:8080. Metrics are not served
+	// when it is empty.
+	MetricsListener string
+	// MetricsRegistry is the registry that the metrics are registered with.
+	// If it is nil and metrics are served, the instance registers them with
+	// a registry of its own. Metrics of rpcs are not collected when the
+	// GRPCServer is supplied by the caller.
+	MetricsRegistry *prometheus.Registry
+	// TracerProvider provides the tracers that rpcs, the ranges and
+	// transactions they run, and SQL statements are traced with. The trace
+	// context of rpcs is taken from their metadata, as W3C trace context and
+	// baggage. Nothing is traced when it is nil.
+	TracerProvider trace.TracerProvider
+	// AuditLogFile is the file that creates, updates and deletes of keys are
+	// recorded in, as lines of JSON holding the key, the revisions and the
+	// client, but not the value. The file is reopened on SIGHUP, and rotated
+	// once it grows past AuditLogMaxSize bytes unless that is zero.
+	// AuditWriter is written to instead when it is set. Nothing is recorded
+	// when neither is set.
+	AuditLogFile    string
+	AuditLogMaxSize int64
+	AuditWriter     io.Writer
+	// Hooks are passed the creates, updates and deletes of keys after they
+	// commit, through a buffer of HookBufferSize writes, which defaults to
+	// logstructured.DefaultHookBufferSize, for applications that embed kine
+	// to react to them in-process. See logstructured.Hooks for the
+	// guarantees of delivery and order.
+	Hooks          logstructured.Hooks
+	HookBufferSize int
+	// CompressValues compresses values with zstd before they are stored.
+	// Values stored compressed are read back whether or not it is set, so it
+	// can be turned off again at any time.
+	CompressValues bool
+	// VerifyOnStart checks the stored revisions of the database with Verify
+	// before the backend is started, and refuses to start if any does not fit
+	// the history of its key.
+	VerifyOnStart bool
+	// QuiesceTimeout is the longest that Quiesce holds writes for, after
+	// which they are resumed if Resume was not called. Defaults to 1 minute.
+	QuiesceTimeout time.Duration
+	// Logger is the logger of kine, of its servers and its backend, so that
+	// several kine in a process can log apart. Defaults to the standard
+	// logger of logrus.
+	Logger logging.Logger
 }
 
 type ETCDConfig struct {
 	Endpoints   []string
 	TLSConfig   tls.Config
 	LeaderElect bool
+
+	shutdown func(ctx context.Context) error
+	server   *server.KVServerBridge
+	backend  server.Backend
+}
+
+// Shutdown stops kine. It stops accepting connections, ends watch streams,
+// waits for the requests that are running to finish, stops the backend,
+// closes the database and removes unix sockets. Once ctx is done, the
+// connections left are closed without waiting for their requests. Shutdown
+// also starts once the context Listen was called with is done, in which case
+// the connections are closed right away. It does nothing for etcd endpoints.
+func (e ETCDConfig) Shutdown(ctx context.Context) error {
+	if e.shutdown == nil {
+		return nil
+	}
+	return e.shutdown(ctx)
+}
+
+// SetReadOnly switches kine in or out of read-only mode. It returns once the
+// writes in flight are done, so that the writes after it are all rejected.
+// It does nothing for etcd endpoints.
+func (e ETCDConfig) SetReadOnly(readOnly bool) {
+	if e.server != nil {
+		e.server.SetReadOnly(readOnly)
+	}
+}
+
+// ReadOnly reports whether kine is in read-only mode.
+func (e ETCDConfig) ReadOnly() bool {
+	return e.server != nil && e.server.ReadOnly()
+}
+
+// Quiesce holds the writes of kine, once those in flight have committed and
+// the database is flushed to its files, until Resume is called or the quiesce
+// timeout has passed, so that the volume of the database can be snapshotted
+// while reads and watches are served. Writes wait rather than fail while they
+// are held. It is supported by the sqlite and bolt backends, and returns
+// server.ErrQuiesced if writes are quiesced already.
+func (e ETCDConfig) Quiesce(ctx context.Context) error {
+	if e.backend == nil {
+		return fmt.Errorf("etcd endpoints have no kine backend")
+	}
+	return e.backend.Quiesce(ctx)
+}
+
+// Resume releases the writes held by Quiesce. It returns
+// server.ErrNotQuiesced if writes are not quiesced.
+func (e ETCDConfig) Resume() error {
+	if e.backend == nil {
+		return fmt.Errorf("etcd endpoints have no kine backend")
+	}
+	return e.backend.Resume()
+}
+
+// Backend returns the backend that kine serves, for callers that use the
+// storage layer directly. It is nil for etcd endpoints.
+func (e ETCDConfig) Backend() server.Backend {
+	return e.backend
 }
 
+// Listen starts kine with the config, as New does with WithConfig.
 func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
+	return New(ctx, WithConfig(config))
+}
+
+// listen starts kine with the validated config.
+func listen(ctx context.Context, config Config) (ETCDConfig, error) {
 	driver, dsn := ParseStorageEndpoint(config.Endpoint)
 	if driver == ETCDBackend {
 		return ETCDConfig{
 			Endpoints:   strings.Split(config.Endpoint, ","),
-			TLSConfig:   config.Config,
+			TLSConfig:   config.BackendTLSConfig,
 			LeaderElect: true,
 		}, nil
 	}
 
-	leaderelect, backend, err := getKineStorageBackend(ctx, driver, dsn, config)
+	log := logging.OrDefault(config.Logger)
+
+	// the backend runs until shutdown, which starts once the caller's context
+	// is done or when Shutdown is called
+	ctx, cancel := context.WithCancel(ctx)
+	registry := config.MetricsRegistry
+	if registry == nil && config.MetricsListener != "" {
+		registry = prometheus.NewRegistry()
+		registry.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	}
+	var registerer prometheus.Registerer
+	if registry != nil {
+		registerer = registry
+	}
+	leaderelect, backend, err := newBackend(ctx, driver, dsn, config, registerer)
 	if err != nil {
-		return ETCDConfig{}, errors.Wrap(err, "building kine")
+		cancel()
+		return ETCDConfig{}, err
+	}
+	stopBackend := func() error {
+		cancel()
+		return backend.Close()
 	}
 
+	if config.VerifyOnStart {
+		if err := verifyBackend(ctx, log, backend); err != nil {
+			stopBackend()
+			return ETCDConfig{}, err
+		}
+	}
 	if err := backend.Start(ctx); err != nil {
+		stopBackend()
 		return ETCDConfig{}, errors.Wrap(err, "starting kine backend")
 	}
 
-	listen := config.Listener
-	if listen == "" {
-		listen = KineSocket
+	var listens []string
+	for _, listen := range strings.Split(config.Listener, ",") {
+		if listen = strings.TrimSpace(listen); listen != "" {
+			listens = append(listens, listen)
+		}
+	}
+	if len(listens) == 0 {
+		listens = []string{KineSocket}
 	}
 
-	b := server.New(backend)
-	grpcServer := grpcServer(config)
-	b.Register(grpcServer)
+	var (
+		listeners []net.Listener
+		endpoints []string
+		urls      []string
+	)
+	// closing a unix listener also removes its socket
+	closeListeners := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	for _, listen := range listens {
+		listener, err := createListener(log, listen)
+		if err != nil {
+			closeListeners()
+			stopBackend()
+			return ETCDConfig{}, err
+		}
+		listeners = append(listeners, listener)
+		endpoints = append(endpoints, advertiseEndpoint(listen, listener))
+		urls = append(urls, listenerURL(listen, listener))
+	}
 
-	listener, err := createListener(listen)
-	if err != nil {
-		return ETCDConfig{}, err
+	clientURLs, peerURLs := config.ClientURLs, config.PeerURLs
+	if len(clientURLs) == 0 {
+		clientURLs = urls
+	}
+	if len(peerURLs) == 0 {
+		peerURLs = clientURLs
 	}
 
-	go func() {
-		if err := grpcServer.Serve(listener); err != nil {
-			logrus.Errorf("Kine server shutdown: %v", err)
+	effective := newEffectiveConfig(config, driver, dsn, urls)
+	logEffectiveConfig(log, effective)
+
+	b := server.New(backend, serverConfig(config, clientURLs, peerURLs, registerer))
+	hsrv := health.NewServer()
+	go b.HealthCheck(ctx, hsrv)
+
+	// every listener gets a server of its own, so that each can be served
+	// with or without TLS, unless the caller supplied the server to use for
+	// all of them
+	var servers []*grpc.Server
+	for i := range listeners {
+		if config.GRPCServer != nil && i > 0 {
+			servers = append(servers, config.GRPCServer)
+			continue
+		}
+		grpcServer, err := grpcServer(config, listens[i], b)
+		if err != nil {
+			closeListeners()
+			stopBackend()
+			return ETCDConfig{}, err
+		}
+		b.Register(grpcServer)
+		healthpb.RegisterHealthServer(grpcServer, hsrv)
+		servers = append(servers, grpcServer)
+	}
+
+	var metricsServer *http.Server
+	if config.MetricsListener != "" {
+		metricsServer, err = serveMetrics(log, config.MetricsListener, registry, effective, backend)
+		if err != nil {
+			closeListeners()
+			stopBackend()
+			return ETCDConfig{}, err
 		}
+	}
+
+	for i, listener := range listeners {
+		go func(grpcServer *grpc.Server, listener net.Listener) {
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Errorf("Kine server shutdown: %v", err)
+			}
+		}(servers[i], listener)
+	}
+
+	var (
+		shutdownOnce sync.Once
+		shutdownErr  error
+	)
+	shutdown := func(shutdownCtx context.Context) error {
+		shutdownOnce.Do(func() {
+			b.StopWatches()
+			hsrv.Shutdown()
+			stopServers(shutdownCtx, servers)
+			closeListeners()
+			if metricsServer != nil {
+				metricsServer.Close()
+			}
+			shutdownErr = stopBackend()
+		})
+		return shutdownErr
+	}
+	go func() {
 		<-ctx.Done()
-		grpcServer.Stop()
-		listener.Close()
+		shutdown(ctx)
 	}()
 
 	return ETCDConfig{
 		LeaderElect: leaderelect,
-		Endpoints:   []string{listen},
-		TLSConfig:   tls.Config{},
+		Endpoints:   endpoints,
+		TLSConfig:   clientTLSConfig(config, listens),
+		shutdown:    shutdown,
+		server:      b,
+		backend:     backend,
 	}, nil
 }
 
-func createListener(listen string) (ret net.Listener, rerr error) {
+// serverConfig returns the settings of the server of the config, which
+// reports the client and peer URLs as those of its member.
+func serverConfig(config Config, clientURLs, peerURLs []string, registerer prometheus.Registerer) server.Config {
+	return server.Config{
+		NotifyInterval:      config.NotifyInterval,
+		MaxResponseBytes:    config.MaxResponseBytes,
+		MaxRequestBytes:     config.MaxRequestBytes,
+		QuotaBackendBytes:   config.QuotaBackendBytes,
+		ReadOnly:            config.ReadOnly,
+		DisableWatchSharing: config.DisableWatchSharing,
+		MaxConcurrentLists:  config.MaxConcurrentLists,
+		ListQueueTimeout:    config.ListQueueTimeout,
+		ListLimitThreshold:  config.ListLimitThreshold,
+		ListRateLimit:       config.ListRateLimit,
+		ListRateBurst:       config.ListRateBurst,
+		MemberName:          config.Name,
+		ClientURLs:          clientURLs,
+		PeerURLs:            peerURLs,
+		HealthCheckInterval: config.HealthCheckInterval,
+		HealthCheckTimeout:  config.HealthCheckTimeout,
+		MetricsRegisterer:   registerer,
+		TracerProvider:      config.TracerProvider,
+		Logger:              config.Logger,
+	}
+}
+
+// stopServers stops the servers gracefully, waiting for their requests to
+// finish, until ctx is done; then it closes their connections forcibly.
+func stopServers(ctx context.Context, servers []*grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, grpcServer := range servers {
+			grpcServer.GracefulStop()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		for _, grpcServer := range servers {
+			grpcServer.Stop()
+		}
+		<-done
+	}
+}
+
+// clientTLSConfig returns the TLS config for clients of the listeners. If
+// any is served with TLS, clients trust the CA of the server certificate,
+// and present the server certificate if the server verifies clients.
+func clientTLSConfig(config Config, listens []string) tls.Config {
+	for _, listen := range listens {
+		if network, _ := networkAndAddress(listen); network != "https" {
+			continue
+		}
+		tlsConfig := tls.Config{CAFile: config.ServerTLSConfig.CAFile}
+		if config.ServerTLSConfig.ClientCAFile != "" {
+			tlsConfig.CertFile = config.ServerTLSConfig.CertFile
+			tlsConfig.KeyFile = config.ServerTLSConfig.KeyFile
+		}
+		return tlsConfig
+	}
+	return tls.Config{}
+}
+
+// Restore recreates the database of the storage endpoint from a snapshot
+// streamed by the snapshot rpc or written by the backup command, creating
+// its tables if they do not exist yet. The checksum of the snapshot is
+// verified before anything is written. The database must not hold any keys
+// yet, unless force is set, in which case they are replaced by those of the
+// snapshot. The current revision is raised strictly above the revisions of
+// the snapshot, so that the revisions clients cached are never reused.
+func Restore(ctx context.Context, config Config, r io.Reader, force bool) error {
+	driver, dsn := ParseStorageEndpoint(config.Endpoint)
+	if driver == ETCDBackend {
+		return fmt.Errorf("kine snapshots cannot be restored into etcd")
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	_, backend, err := getKineStorageBackend(ctx, driver, dsn, config, nil)
+	if err != nil {
+		return errors.Wrap(err, "building kine")
+	}
+	defer backend.Close()
+	return errors.Wrap(backend.Restore(ctx, r, force), "restoring snapshot")
+}
+
+// Verify checks the stored revisions of the database of the storage endpoint,
+// which may be served meanwhile, and returns those that do not fit the
+// history of their keys, as the Verify of the backend does. If repair is set
+// the orphaned tombstones are deleted.
+func Verify(ctx context.Context, config Config, repair bool) ([]server.Inconsistency, error) {
+	driver, dsn := ParseStorageEndpoint(config.Endpoint)
+	if driver == ETCDBackend {
+		return nil, fmt.Errorf("etcd endpoints have no kine backend")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	_, backend, err := getKineStorageBackend(ctx, driver, dsn, config, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "building kine")
+	}
+	defer backend.Close()
+	inconsistencies, err := backend.Verify(ctx, repair)
+	return inconsistencies, errors.Wrap(err, "verifying database")
+}
+
+// GC removes the rows of the database of the storage endpoint, which may be
+// served meanwhile, that no read can return any more, as the GC of the
+// backend does, and returns them by their kind. Nothing is removed if dryRun
+// is set.
+func GC(ctx context.Context, config Config, dryRun bool) ([]server.Garbage, error) {
+	driver, dsn := ParseStorageEndpoint(config.Endpoint)
+	if driver == ETCDBackend {
+		return nil, fmt.Errorf("etcd endpoints have no kine backend")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	_, backend, err := getKineStorageBackend(ctx, driver, dsn, config, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "building kine")
+	}
+	defer backend.Close()
+	garbage, err := backend.GC(ctx, dryRun)
+	return garbage, errors.Wrap(err, "collecting garbage")
+}
+
+// verifyBackend verifies the backend before it is started, logging the
+// revisions that do not fit the history of their keys, and fails if there
+// are any.
+func verifyBackend(ctx context.Context, log logging.Logger, backend server.Backend) error {
+	inconsistencies, err := backend.Verify(ctx, false)
+	if err != nil {
+		return errors.Wrap(err, "verifying database")
+	}
+	for _, i := range inconsistencies {
+		log.Errorf("Database is inconsistent: %s", i)
+	}
+	if len(inconsistencies) > 0 {
+		return fmt.Errorf("database is inconsistent: %d revisions do not fit the history of their keys", len(inconsistencies))
+	}
+	return nil
+}
+
+func createListener(log logging.Logger, listen string) (ret net.Listener, rerr error) {
 	network, address := networkAndAddress(listen)
 
 	if network == "unix" {
 		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
-			logrus.Warnf("failed to remove socket %s: %v", address, err)
+			log.Warnf("failed to remove socket %s: %v", address, err)
 		}
 		defer func() {
 			if err := os.Chmod(address, 0600); err != nil {
@@ -106,15 +623,101 @@ func createListener(listen string) (ret net.Listener, rerr error) {
 		}()
 	}
 
-	logrus.Infof("Kine listening on %s://%s", network, address)
+	log.Infof("Kine listening on %s://%s", network, address)
+	switch network {
+	case "http", "https":
+		// https listeners are served with TLS by their grpc server
+		network = "tcp"
+	}
 	return net.Listen(network, address)
 }
 
-func grpcServer(config Config) *grpc.Server {
+// listenerURL returns the url clients reach the listener at.
+func listenerURL(listen string, listener net.Listener) string {
+	network, _ := networkAndAddress(listen)
+	switch network {
+	case "unix", "https":
+		return network + "://" + listener.Addr().String()
+	}
+	return "http://" + listener.Addr().String()
+}
+
+// advertiseEndpoint returns the address as given, with the port the
+// listener was assigned if it asked for any free port.
+func advertiseEndpoint(listen string, listener net.Listener) string {
+	network, address := networkAndAddress(listen)
+	if network == "unix" {
+		return listen
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || port != "0" {
+		return listen
+	}
+	_, port, _ = net.SplitHostPort(listener.Addr().String())
+	return network + "://" + net.JoinHostPort(host, port)
+}
+
+// openAuditLog returns the audit log of the config, or nil if none is set.
+func openAuditLog(config Config) (*audit.Log, error) {
+	switch {
+	case config.AuditWriter != nil:
+		return audit.New(config.AuditWriter, config.Logger), nil
+	case config.AuditLogFile != "":
+		auditLog, err := audit.Open(config.AuditLogFile, config.AuditLogMaxSize, config.Logger)
+		return auditLog, errors.Wrap(err, "opening audit log")
+	}
+	return nil, nil
+}
+
+// serveMetrics serves the metrics of the registry at /metrics on the address,
+// the effective config at /debug/config, the stats of the prefixes of the
+// keys of the backend at /debug/prefixes, and quiesces and resumes the writes
+// of the backend on POSTs to /debug/quiesce and /debug/resume.
+func serveMetrics(log logging.Logger, address string, registry *prometheus.Registry, effective EffectiveConfig, backend server.Backend) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrap(err, "listening for metrics")
+	}
+	log.Infof("Kine serving metrics on http://%s/metrics", listener.Addr())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.Handle("/debug/config", effectiveConfigHandler(effective))
+	mux.Handle("/debug/prefixes", prefixStatsHandler(log, backend))
+	mux.Handle("/debug/quiesce", quiesceHandler(log, "quiesce", backend.Quiesce))
+	mux.Handle("/debug/resume", quiesceHandler(log, "resume", func(context.Context) error {
+		return backend.Resume()
+	}))
+	metricsServer := &http.Server{Handler: mux}
+	go func() {
+		if err := metricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Kine metrics server shutdown: %v", err)
+		}
+	}()
+	return metricsServer, nil
+}
+
+// grpcOverheadBytes is the room left in gRPC messages for the framing of the
+// largest request accepted, as etcd leaves it.
+const grpcOverheadBytes = 512 * 1024
+
+func grpcServer(config Config, listen string, b *server.KVServerBridge) (*grpc.Server, error) {
 	if config.GRPCServer != nil {
-		return config.GRPCServer
+		return config.GRPCServer, nil
+	}
+	unary := []grpc.UnaryServerInterceptor{b.UnaryServerInterceptor()}
+	stream := []grpc.StreamServerInterceptor{b.StreamServerInterceptor()}
+	if config.TracerProvider != nil {
+		opts := []otelgrpc.Option{
+			otelgrpc.WithTracerProvider(config.TracerProvider),
+			otelgrpc.WithPropagators(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})),
+		}
+		unary = append([]grpc.UnaryServerInterceptor{otelgrpc.UnaryServerInterceptor(opts...)}, unary...)
+		stream = append([]grpc.StreamServerInterceptor{otelgrpc.StreamServerInterceptor(opts...)}, stream...)
 	}
 	gopts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
 		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
 			MinTime:             embed.DefaultGRPCKeepAliveMinTime,
 			PermitWithoutStream: false,
@@ -123,27 +726,57 @@ func grpcServer(config Config) *grpc.Server {
 			Time:    embed.DefaultGRPCKeepAliveInterval,
 			Timeout: embed.DefaultGRPCKeepAliveTimeout,
 		}),
+		grpc.MaxRecvMsgSize(maxRecvMsgSize(config.MaxRequestBytes)),
+		grpc.MaxSendMsgSize(math.MaxInt32),
+	}
+
+	if network, _ := networkAndAddress(listen); network == "https" {
+		tlsConfig, err := config.ServerTLSConfig.ServerConfig(config.Logger)
+		if err != nil {
+			return nil, errors.Wrapf(err, "serving %s", listen)
+		}
+		gopts = append(gopts, grpc.Creds(credentials.NewTLS(tlsConfig)))
 	}
 
-	return grpc.NewServer(gopts...)
+	return grpc.NewServer(gopts...), nil
 }
 
-func getKineStorageBackend(ctx context.Context, driver, dsn string, cfg Config) (bool, server.Backend, error) {
+// maxRecvMsgSize returns the size of the largest gRPC message received, which
+// fits the largest request accepted.
+func maxRecvMsgSize(maxRequestBytes int) int {
+	switch {
+	case maxRequestBytes == 0:
+		return server.DefaultMaxRequestBytes + grpcOverheadBytes
+	case maxRequestBytes < 0 || maxRequestBytes > math.MaxInt32-grpcOverheadBytes:
+		return math.MaxInt32
+	}
+	return maxRequestBytes + grpcOverheadBytes
+}
+
+func getKineStorageBackend(ctx context.Context, driver, dsn string, cfg Config, registerer prometheus.Registerer) (bool, server.Backend, error) {
 	var (
-		backend     server.Backend
-		leaderElect = true
-		err         error
+		backend       server.Backend
+		leaderElect   = true
+		err           error
+		genericConfig = newGenericConfig(cfg, registerer)
 	)
 	switch driver {
 	case SQLiteBackend:
 		leaderElect = false
-		backend, err = sqlite.New(ctx, dsn)
+		backend, err = sqlite.New(ctx, dsn, cfg.SQLite, genericConfig)
 	case DQLiteBackend:
-		backend, err = dqlite.New(ctx, dsn, cfg.Config)
+		backend, err = dqlite.New(ctx, dsn, cfg.BackendTLSConfig, genericConfig)
 	case PostgresBackend:
-		backend, err = pgsql.New(ctx, dsn, cfg.Config)
+		backend, err = pgsql.New(ctx, dsn, cfg.BackendTLSConfig, genericConfig)
+	case CockroachBackend:
+		backend, err = pgsql.NewCockroach(ctx, dsn, cfg.BackendTLSConfig, genericConfig)
 	case MySQLBackend:
-		backend, err = mysql.New(ctx, dsn, cfg.Config)
+		backend, err = mysql.New(ctx, dsn, cfg.BackendTLSConfig, genericConfig)
+	case BoltBackend:
+		leaderElect = false
+		backend, err = bolt.New(ctx, dsn, genericConfig)
+	case MSSQLBackend:
+		backend, err = mssql.New(ctx, dsn, cfg.BackendTLSConfig, genericConfig)
 	default:
 		return false, nil, fmt.Errorf("storage backend is not defined")
 	}
@@ -151,6 +784,38 @@ func getKineStorageBackend(ctx context.Context, driver, dsn string, cfg Config)
 	return leaderElect, backend, err
 }
 
+// newGenericConfig returns the settings of the backend of the config, which
+// are shared by all drivers.
+func newGenericConfig(cfg Config, registerer prometheus.Registerer) generic.Config {
+	genericConfig := generic.Config{
+		CompactInterval:      cfg.CompactInterval,
+		CompactMinRetain:     cfg.CompactMinRetain,
+		CompactGC:            cfg.CompactGC,
+		PrefixRetention:      cfg.PrefixRetention,
+		QuiesceTimeout:       cfg.QuiesceTimeout,
+		WatchBufferSize:      cfg.WatchBufferSize,
+		PollInterval:         cfg.PollInterval,
+		PollBatchSize:        cfg.PollBatchSize,
+		SlowQueryThreshold:   cfg.SlowQueryThreshold,
+		EstimateCounts:       cfg.EstimateCounts,
+		MetricsRegisterer:    registerer,
+		TracerProvider:       cfg.TracerProvider,
+		ConnectionPoolConfig: cfg.ConnectionPoolConfig,
+		StatementTimeouts:    cfg.StatementTimeouts,
+		TableName:            cfg.TableName,
+		SchemaName:           cfg.SchemaName,
+		PasswordFunc:         cfg.PasswordFunc,
+		Logger:               cfg.Logger,
+	}
+	// the read endpoints and password func were validated against the
+	// backend with the rest of the config
+	for _, readEndpoint := range cfg.ReadEndpoints {
+		_, readDSN := ParseStorageEndpoint(readEndpoint)
+		genericConfig.ReadDataSourceNames = append(genericConfig.ReadDataSourceNames, readDSN)
+	}
+	return genericConfig
+}
+
 func ParseStorageEndpoint(storageEndpoint string) (string, string) {
 	network, address := networkAndAddress(storageEndpoint)
 	switch network {
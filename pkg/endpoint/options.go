@@ -0,0 +1,137 @@
+package endpoint
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/tls"
+)
+
+// Option sets a setting of the config that New starts kine with. Options
+// are applied in order, so later options override earlier ones.
+type Option func(*Config)
+
+// New starts kine with the config that the options set, once it is
+// validated, and returns the config that etcd clients connect to kine with.
+// Settings that no option sets keep their defaults. All the problems of the
+// config are reported at once, as a *ValidationError.
+func New(ctx context.Context, opts ...Option) (ETCDConfig, error) {
+	var config Config
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if err := config.Validate(); err != nil {
+		return ETCDConfig{}, err
+	}
+	return listen(ctx, config)
+}
+
+// WithConfig sets all the settings of the config, for callers of Listen
+// and for settings that have no option of their own. It is usually given
+// first, for the options after it to override its settings.
+func WithConfig(config Config) Option {
+	return func(c *Config) {
+		*c = config
+	}
+}
+
+// WithListener sets the addresses that kine listens on, replacing any
+// addresses set before.
+func WithListener(listeners ...string) Option {
+	return func(c *Config) {
+		c.Listener = strings.Join(listeners, ",")
+	}
+}
+
+// WithEndpoint sets the storage endpoint of kine, and the endpoints of the
+// read replicas of its database.
+func WithEndpoint(endpoint string, readEndpoints ...string) Option {
+	return func(c *Config) {
+		c.Endpoint = endpoint
+		c.ReadEndpoints = readEndpoints
+	}
+}
+
+// WithServerTLS sets the certificate and key that https listeners are served
+// with, and the client CA that clients are verified with.
+func WithServerTLS(config tls.Config) Option {
+	return func(c *Config) {
+		c.ServerTLSConfig = config
+	}
+}
+
+// WithBackendTLS sets the CA that the certificate of the database is
+// verified with, and the certificate and key presented to it.
+func WithBackendTLS(config tls.Config) Option {
+	return func(c *Config) {
+		c.BackendTLSConfig = config
+	}
+}
+
+// WithConnectionPool sets the pool of connections to the database.
+func WithConnectionPool(config generic.ConnectionPoolConfig) Option {
+	return func(c *Config) {
+		c.ConnectionPoolConfig = config
+	}
+}
+
+// WithCompaction sets the interval between automatic compactions, which
+// retain the given number of revisions. A zero interval disables them.
+func WithCompaction(interval time.Duration, minRetain int64) Option {
+	return func(c *Config) {
+		c.CompactInterval = interval
+		c.CompactMinRetain = minRetain
+	}
+}
+
+// WithPrefixRetention sets the retentions of the prefixes whose history
+// automatic compaction trims earlier than that of the rest of the keyspace.
+func WithPrefixRetention(retention ...generic.PrefixRetention) Option {
+	return func(c *Config) {
+		c.PrefixRetention = append(c.PrefixRetention, retention...)
+	}
+}
+
+// WithHooks sets the hooks that the writes of keys are passed to after they
+// commit, through a buffer of the given number of writes, or of
+// logstructured.DefaultHookBufferSize if it is not positive.
+func WithHooks(hooks logstructured.Hooks, bufferSize int) Option {
+	return func(c *Config) {
+		c.Hooks = hooks
+		c.HookBufferSize = bufferSize
+	}
+}
+
+// WithQuiesceTimeout sets the longest that Quiesce holds writes for.
+func WithQuiesceTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.QuiesceTimeout = timeout
+	}
+}
+
+// WithMetricsRegistry sets the registry that the metrics are registered
+// with.
+func WithMetricsRegistry(registry *prometheus.Registry) Option {
+	return func(c *Config) {
+		c.MetricsRegistry = registry
+	}
+}
+
+// WithMetricsListener sets the address that the metrics are served on.
+func WithMetricsListener(address string) Option {
+	return func(c *Config) {
+		c.MetricsListener = address
+	}
+}
+
+// WithLogger sets the logger of kine.
+func WithLogger(logger logging.Logger) Option {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
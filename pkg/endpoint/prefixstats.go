@@ -0,0 +1,27 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// prefixStatsHandler serves the stats of the prefixes of the keys of the
+// backend as JSON, which the backend caches briefly, as gathering them scans
+// all of its rows.
+func prefixStatsHandler(log logging.Logger, backend server.Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, err := backend.PrefixStats(r.Context())
+		if err != nil {
+			log.Errorf("Failed to gather the stats of key prefixes: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		out := json.NewEncoder(w)
+		out.SetIndent("", "  ")
+		out.Encode(stats)
+	})
+}
@@ -0,0 +1,33 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// quiesceHandler quiesces or resumes the writes of the backend with fn, as
+// told by action, on POSTs, answering with a conflict if they are quiesced or
+// resumed already.
+func quiesceHandler(log logging.Logger, action string, fn func(ctx context.Context) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := fn(r.Context()); err != nil {
+			if errors.Is(err, server.ErrQuiesced) || errors.Is(err, server.ErrNotQuiesced) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			log.Errorf("Failed to %s writes: %v", action, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,106 @@
+package endpoint
+
+import "strings"
+
+// redacted replaces the secrets of endpoints.
+const redacted = "xxxxx"
+
+// RedactEndpoint returns the endpoint with the passwords and other secrets
+// it holds masked, so that it can be logged: the password of the user
+// information of URLs, and of the user@host part of MySQL data source names,
+// and the values of parameters such as password, sslpassword or _auth_pass.
+// Etcd endpoints are lists of URLs, each of which is masked.
+func RedactEndpoint(endpoint string) string {
+	driver, _ := ParseStorageEndpoint(endpoint)
+	if driver == ETCDBackend {
+		urls := strings.Split(endpoint, ",")
+		for i, url := range urls {
+			urls[i] = redactDSN(ETCDBackend, url)
+		}
+		return strings.Join(urls, ",")
+	}
+	return redactDSN(driver, endpoint)
+}
+
+// redactDSN masks the secrets of an endpoint of the driver.
+func redactDSN(driver, endpoint string) string {
+	network, address := networkAndAddress(endpoint)
+	prefix := ""
+	if network != "" {
+		prefix = network + "://"
+	}
+
+	var userInfo, host, params string
+	switch driver {
+	case SQLiteBackend, DQLiteBackend, BoltBackend:
+		// the endpoints of files have no user information
+		host, params = splitParams(address)
+	case MySQLBackend:
+		// as the driver parses them, the password may hold any character,
+		// and ends at the last @ before the last slash
+		rest := address
+		if i := strings.LastIndex(address, "/"); i >= 0 {
+			rest = address[:i]
+		}
+		if i := strings.LastIndex(rest, "@"); i >= 0 {
+			userInfo, address = address[:i], address[i+1:]
+		}
+		host, params = splitParams(address)
+	default:
+		// the user information of URLs ends at the @ of their authority
+		authority := address
+		if i := strings.IndexAny(address, "/?"); i >= 0 {
+			authority = address[:i]
+		}
+		if i := strings.LastIndex(authority, "@"); i >= 0 {
+			userInfo, address = address[:i], address[i+1:]
+		}
+		host, params = splitParams(address)
+	}
+
+	if i := strings.Index(userInfo, ":"); i >= 0 {
+		userInfo = userInfo[:i+1] + redacted
+	}
+	if userInfo != "" {
+		userInfo += "@"
+	}
+	if params != "" {
+		params = "?" + redactParams(params)
+	}
+	return prefix + userInfo + host + params
+}
+
+// splitParams splits the address at its first question mark into the host
+// and path, and the parameters.
+func splitParams(address string) (string, string) {
+	parts := strings.SplitN(address, "?", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// redactParams masks the values of the parameters that hold secrets.
+func redactParams(params string) string {
+	pairs := strings.Split(params, "&")
+	for i, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 && secretParam(kv[0]) {
+			pairs[i] = kv[0] + "=" + redacted
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// secretParam reports whether the parameter of a data source name holds a
+// secret, such as the password of postgres sslpassword, or that of sqlite
+// _auth_pass, by its name.
+func secretParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range []string{"pass", "pwd", "secret", "token"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
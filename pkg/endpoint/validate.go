@@ -0,0 +1,90 @@
+package endpoint
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationError lists the problems of a config, which are all reported
+// at once rather than one at a time as kine starts.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid kine config: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate reports the settings of the config that conflict or cannot be
+// served, as a *ValidationError listing all of them, or nil if there are
+// none. Listen and New validate their config before starting anything.
+func (c Config) Validate() error {
+	var problems []string
+	problemf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	driver, _ := ParseStorageEndpoint(c.Endpoint)
+	switch driver {
+	case SQLiteBackend, DQLiteBackend, ETCDBackend, MySQLBackend, PostgresBackend, CockroachBackend, BoltBackend, MSSQLBackend:
+	default:
+		problemf("endpoint %q is of the unknown storage backend %s", RedactEndpoint(c.Endpoint), driver)
+	}
+	if len(c.ReadEndpoints) > 0 && driver != SQLiteBackend && driver != PostgresBackend && driver != MySQLBackend {
+		problemf("the %s backend does not support read endpoints", driver)
+	}
+	for _, readEndpoint := range c.ReadEndpoints {
+		if readDriver, _ := ParseStorageEndpoint(readEndpoint); readDriver != driver {
+			problemf("read endpoint %q is not of the %s backend of the endpoint", RedactEndpoint(readEndpoint), driver)
+		}
+	}
+	if c.PasswordFunc != nil && driver != PostgresBackend && driver != CockroachBackend && driver != MySQLBackend {
+		problemf("the %s backend does not support a password func", driver)
+	}
+	prefixes := map[string]bool{}
+	for _, r := range c.PrefixRetention {
+		if err := r.Validate(); err != nil {
+			problemf("%v", err)
+		}
+		if prefixes[r.Prefix] {
+			problemf("prefix %s has more than one retention", r.Prefix)
+		}
+		prefixes[r.Prefix] = true
+	}
+	if len(c.PrefixRetention) > 0 {
+		if driver == ETCDBackend {
+			problemf("the %s backend does not support prefix retention", driver)
+		} else if c.CompactInterval <= 0 {
+			problemf("prefix retention is applied by automatic compaction, which is disabled")
+		}
+	}
+
+	for _, listen := range strings.Split(c.Listener, ",") {
+		if listen = strings.TrimSpace(listen); listen == "" {
+			continue
+		}
+		switch network, _ := networkAndAddress(listen); network {
+		case "unix", "tcp", "http":
+		case "https":
+			if c.ServerTLSConfig.CertFile == "" || c.ServerTLSConfig.KeyFile == "" {
+				problemf("listener %s is served with TLS, which needs the certificate and key of the server TLS config", listen)
+			}
+			if c.GRPCServer != nil {
+				problemf("listener %s is served with TLS, which is not applied to a supplied gRPC server", listen)
+			}
+		default:
+			problemf("listener %q is not a unix, tcp, http or https address", listen)
+		}
+	}
+	if c.AuditLogMaxSize < 0 {
+		problemf("the audit log max size is negative")
+	}
+	if c.Hooks != nil && driver == ETCDBackend {
+		problemf("the %s backend does not support hooks", driver)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
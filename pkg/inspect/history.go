@@ -0,0 +1,79 @@
+// Package inspect reads what the database of a kine storage endpoint stores,
+// for debugging, by connecting to the database directly rather than to kine.
+package inspect
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rancher/kine/pkg/endpoint"
+)
+
+// History is the stored history of a key, as of the current revision.
+type History struct {
+	Key             string     `json:"key"`
+	Revision        int64      `json:"revision"`
+	CompactRevision int64      `json:"compactRevision"`
+	Revisions       []Revision `json:"revisions"`
+}
+
+// Revision is a stored revision of a key. The value is only set if the
+// values were asked for.
+type Revision struct {
+	Revision       int64  `json:"revision"`
+	CreateRevision int64  `json:"createRevision"`
+	PrevRevision   int64  `json:"prevRevision,omitempty"`
+	Create         bool   `json:"create,omitempty"`
+	Delete         bool   `json:"delete,omitempty"`
+	Lease          int64  `json:"lease,omitempty"`
+	ValueSize      int64  `json:"valueSize"`
+	Value          []byte `json:"value,omitempty"`
+}
+
+// KeyHistory returns the revisions of the key that the database of the
+// storage endpoint of the config still stores, oldest first. They go back to
+// the compact revision, and may include older revisions that compaction
+// kept. If the revision is not zero only the revision of the key at it is
+// returned, and an error if it is not stored. The values are only read if
+// values is set.
+func KeyHistory(ctx context.Context, config endpoint.Config, key string, revision int64, values bool) (*History, error) {
+	// the backend is not started, as only its database is read
+	ctx, cancel := context.WithCancel(ctx)
+	backend, err := endpoint.NewBackend(ctx, config)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	defer func() {
+		cancel()
+		backend.Close()
+	}()
+
+	rev, compact, revisions, err := backend.History(ctx, key, revision, values)
+	if err != nil {
+		return nil, err
+	}
+	if revision != 0 && len(revisions) == 0 {
+		return nil, fmt.Errorf("%s has no revision %d stored, the compact revision is %d", key, revision, compact)
+	}
+
+	history := &History{
+		Key:             key,
+		Revision:        rev,
+		CompactRevision: compact,
+		Revisions:       make([]Revision, 0, len(revisions)),
+	}
+	for _, r := range revisions {
+		history.Revisions = append(history.Revisions, Revision{
+			Revision:       r.Revision,
+			CreateRevision: r.CreateRevision,
+			PrevRevision:   r.PrevRevision,
+			Create:         r.Create,
+			Delete:         r.Delete,
+			Lease:          r.Lease,
+			ValueSize:      r.ValueSize,
+			Value:          r.Value,
+		})
+	}
+	return history, nil
+}
@@ -0,0 +1,143 @@
+// Package logging defines the logger that kine logs to, so that embedders
+// can route the logs of each kine instance to a logger of their own.
+package logging
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Formats of the logs of the kine command.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// keyPrefixLength is the length that the key prefixes of log fields are
+// truncated to.
+const keyPrefixLength = 64
+
+// Logger is the logger that kine logs to. It is implemented by
+// *logrus.Logger and *logrus.Entry, so a logger with fields of its own can
+// be given to tell kine instances apart.
+type Logger interface {
+	Tracef(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Fields are the structured fields of a log entry, such as the rpc, the key
+// prefix, the revision, the duration, the rows and the error code of a
+// request.
+type Fields map[string]interface{}
+
+// OrDefault returns the logger, or the standard logger of logrus if it is
+// nil, which is where kine logs unless it is given a logger.
+func OrDefault(logger Logger) Logger {
+	if logger == nil {
+		return logrus.StandardLogger()
+	}
+	return logger
+}
+
+// DebugEnabled reports whether the logger logs debug messages, for callers
+// that log many of them at once. Loggers other than those of logrus are
+// taken to log them.
+func DebugEnabled(logger Logger) bool {
+	switch l := logger.(type) {
+	case *logrus.Logger:
+		return l.IsLevelEnabled(logrus.DebugLevel)
+	case *logrus.Entry:
+		return l.Logger.IsLevelEnabled(logrus.DebugLevel)
+	}
+	return true
+}
+
+// WithFields returns a logger that adds the fields to the entries of the
+// logger. Loggers of logrus keep them as fields of the entry, which the JSON
+// formatter writes as keys of their own; other loggers get them appended to
+// the message as key=value pairs.
+func WithFields(logger Logger, fields Fields) Logger {
+	switch l := logger.(type) {
+	case *logrus.Logger:
+		return l.WithFields(logrus.Fields(fields))
+	case *logrus.Entry:
+		return l.WithFields(logrus.Fields(fields))
+	}
+	return fieldLogger{logger: logger, fields: formatFields(fields)}
+}
+
+// SetFormat sets the formatter of the logger to that of the format, text or
+// JSON.
+func SetFormat(logger *logrus.Logger, format string) error {
+	switch format {
+	case FormatText:
+		logger.SetFormatter(&logrus.TextFormatter{})
+	case FormatJSON:
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q, expected %s or %s", format, FormatText, FormatJSON)
+	}
+	return nil
+}
+
+// KeyPrefix returns the part of the key that is logged: the key up to its
+// last slash, truncated, so that the logs tell the resources apart without
+// holding the names of every object.
+func KeyPrefix(key string) string {
+	if i := strings.LastIndex(key, "/"); i > 0 {
+		key = key[:i+1]
+	}
+	if len(key) > keyPrefixLength {
+		key = key[:keyPrefixLength] + "..."
+	}
+	return key
+}
+
+// fieldLogger appends the fields to the messages of a logger that does not
+// keep fields of its own.
+type fieldLogger struct {
+	logger Logger
+	fields string
+}
+
+func (l fieldLogger) Tracef(format string, args ...interface{}) {
+	l.logger.Tracef("%s%s", fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l fieldLogger) Debugf(format string, args ...interface{}) {
+	l.logger.Debugf("%s%s", fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l fieldLogger) Infof(format string, args ...interface{}) {
+	l.logger.Infof("%s%s", fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l fieldLogger) Warnf(format string, args ...interface{}) {
+	l.logger.Warnf("%s%s", fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l fieldLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Errorf("%s%s", fmt.Sprintf(format, args...), l.fields)
+}
+
+// formatFields returns the fields as key=value pairs sorted by their keys,
+// each after a space.
+func formatFields(fields Fields) string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%v", key, fields[key])
+	}
+	return b.String()
+}
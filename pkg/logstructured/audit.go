@@ -0,0 +1,70 @@
+package logstructured
+
+import (
+	"context"
+
+	"github.com/rancher/kine/pkg/audit"
+)
+
+type auditKey struct{}
+
+// auditWrite is a write made in a transaction, which is only recorded in the
+// audit log and passed to the hooks once the transaction commits.
+type auditWrite struct {
+	operation    string
+	key          string
+	value        []byte
+	revision     int64
+	prevRevision int64
+	lease        int64
+}
+
+// SetAuditLog sets the log that successful creates, updates and deletes are
+// recorded in. It must be set before the backend is started.
+func (l *LogStructured) SetAuditLog(log *audit.Log) {
+	l.audit = log
+}
+
+func (l *LogStructured) recordWrite(ctx context.Context, operation, key string, value []byte, revision, prevRevision, lease int64) {
+	if l.audit == nil && l.hooks == nil {
+		return
+	}
+	w := auditWrite{operation, key, value, revision, prevRevision, lease}
+	if writes, ok := ctx.Value(auditKey{}).(*[]auditWrite); ok {
+		*writes = append(*writes, w)
+		return
+	}
+	l.commitWrite(ctx, w)
+}
+
+// commitWrite records the write in the audit log and passes it to the hooks.
+func (l *LogStructured) commitWrite(ctx context.Context, w auditWrite) {
+	if l.audit != nil {
+		l.audit.Record(ctx, w.operation, w.key, w.revision, w.prevRevision, w.lease)
+	}
+	if l.hooks != nil {
+		l.hooks.enqueue(w)
+	}
+}
+
+// auditTxn runs the transaction, recording its writes in the audit log and
+// passing them to the hooks in the order they were made once it commits.
+func (l *LogStructured) auditTxn(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(auditKey{}).(*[]auditWrite); ok || (l.audit == nil && l.hooks == nil) {
+		return l.log.Txn(ctx, fn)
+	}
+
+	// the log may run fn again if the database aborts the transaction, and
+	// only the writes of the run that commits are recorded
+	var writes []auditWrite
+	if err := l.log.Txn(context.WithValue(ctx, auditKey{}, &writes), func(ctx context.Context) error {
+		writes = writes[:0]
+		return fn(ctx)
+	}); err != nil {
+		return err
+	}
+	for _, w := range writes {
+		l.commitWrite(ctx, w)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package logstructured
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// compressedPrefix marks the values that are stored compressed with zstd.
+// Values without it are stored as they were written, so that compression
+// can be turned on and off at any time.
+var compressedPrefix = []byte("\x00kine-zstd\x00")
+
+// minCompressSize is the size below which values are stored as they are, as
+// compressing them saves too little.
+const minCompressSize = 256
+
+// compression compresses the values of the events appended to the log, and
+// decompresses those read back. The encoder and decoder are only made once
+// they are needed.
+type compression struct {
+	enabled bool
+
+	encoderOnce sync.Once
+	encoder     *zstd.Encoder
+	decoderOnce sync.Once
+	decoder     *zstd.Decoder
+	decoderErr  error
+}
+
+// SetCompression sets whether values are compressed with zstd before they
+// are stored. Values that were stored compressed are decompressed when they
+// are read whether or not it is set. It must be set before the backend is
+// started.
+func (l *LogStructured) SetCompression(enabled bool) {
+	l.compression.enabled = enabled
+}
+
+// append appends the event to the log with its values compressed. The event
+// itself is left as it is, as its values are returned to the caller.
+func (l *LogStructured) append(ctx context.Context, event *server.Event) (int64, error) {
+	if !l.compression.enabled {
+		return l.log.Append(ctx, event)
+	}
+	compressed := *event
+	compressed.KV = l.compression.compressKV(event.KV)
+	compressed.PrevKV = l.compression.compressKV(event.PrevKV)
+	return l.log.Append(ctx, &compressed)
+}
+
+func (c *compression) compressKV(kv *server.KeyValue) *server.KeyValue {
+	if kv == nil {
+		return nil
+	}
+	value := c.compress(kv.Value)
+	if len(value) == len(kv.Value) {
+		return kv
+	}
+	compressed := *kv
+	compressed.Value = value
+	return &compressed
+}
+
+// compress returns the value compressed, or the value itself if it is
+// already compressed or does not get smaller.
+func (c *compression) compress(value []byte) []byte {
+	if len(value) < minCompressSize || bytes.HasPrefix(value, compressedPrefix) {
+		return value
+	}
+	c.encoderOnce.Do(func() {
+		// the encoder only fails on invalid options
+		c.encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	})
+	dst := make([]byte, len(compressedPrefix), len(compressedPrefix)+len(value)/2)
+	copy(dst, compressedPrefix)
+	compressed := c.encoder.EncodeAll(value, dst)
+	if len(compressed) >= len(value) {
+		return value
+	}
+	return compressed
+}
+
+// decompress returns the value decompressed if it was stored compressed,
+// and the value itself otherwise.
+func (c *compression) decompress(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, compressedPrefix) {
+		return value, nil
+	}
+	c.decoderOnce.Do(func() {
+		c.decoder, c.decoderErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	})
+	if c.decoderErr != nil {
+		return nil, c.decoderErr
+	}
+	value, err := c.decoder.DecodeAll(value[len(compressedPrefix):], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing value: %w", err)
+	}
+	return value, nil
+}
+
+func (c *compression) decompressKV(kv *server.KeyValue) (*server.KeyValue, error) {
+	if kv == nil || !bytes.HasPrefix(kv.Value, compressedPrefix) {
+		return kv, nil
+	}
+	value, err := c.decompress(kv.Value)
+	if err != nil {
+		return nil, err
+	}
+	decompressed := *kv
+	decompressed.Value = value
+	return &decompressed, nil
+}
+
+// decompressEvents returns the events with their values decompressed. Watch
+// events are shared between watches, so events with compressed values are
+// copied rather than changed.
+func (c *compression) decompressEvents(events []*server.Event) ([]*server.Event, error) {
+	var result []*server.Event
+	for i, event := range events {
+		kv, err := c.decompressKV(event.KV)
+		if err != nil {
+			return nil, err
+		}
+		prevKV, err := c.decompressKV(event.PrevKV)
+		if err != nil {
+			return nil, err
+		}
+		if kv == event.KV && prevKV == event.PrevKV {
+			if result != nil {
+				result = append(result, event)
+			}
+			continue
+		}
+
+		if result == nil {
+			result = make([]*server.Event, i, len(events))
+			copy(result, events)
+		}
+		decompressed := *event
+		decompressed.KV = kv
+		decompressed.PrevKV = prevKV
+		result = append(result, &decompressed)
+	}
+	if result == nil {
+		return events, nil
+	}
+	return result, nil
+}
+
+// close releases the encoder and decoder, if they were made.
+func (c *compression) close() {
+	if c.encoder != nil {
+		c.encoder.Close()
+	}
+	if c.decoder != nil {
+		c.decoder.Close()
+	}
+}
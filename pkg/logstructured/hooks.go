@@ -0,0 +1,174 @@
+package logstructured
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rancher/kine/pkg/audit"
+)
+
+// DefaultHookBufferSize is the number of writes buffered for the hooks when
+// no buffer size is set.
+const DefaultHookBufferSize = 1000
+
+// hookReplayBatchSize is the number of rows read at a time when the writes
+// that did not fit the buffer are replayed from the log.
+const hookReplayBatchSize = 500
+
+// Hooks are told of the creates, updates and deletes that the backend
+// commits, for applications that embed kine to react to them in-process
+// rather than by watching it.
+//
+// The hooks are called one at a time, from a goroutine of their own, after
+// the writes commit and in the order in which they returned, which for writes
+// that are not concurrent is that of their revisions. The writes of a
+// transaction are passed once it commits. Writes are buffered for the hooks
+// rather than held up by them: once the buffer is full, the writes that do
+// not fit are replayed from the log after those buffered before them, along
+// with any written since by other kine that share its database. So every
+// write of the process is passed at least once, unless it was compacted
+// before it was replayed, and some may be passed more than once. Writes still
+// buffered when the backend stops are not passed.
+type Hooks interface {
+	// OnPut is called with the value of a key that was created or updated
+	// at the revision.
+	OnPut(key string, value []byte, revision int64)
+	// OnDelete is called for a key that was deleted at the revision.
+	OnDelete(key string, revision int64)
+}
+
+// hookQueue buffers the writes for the hooks.
+type hookQueue struct {
+	hooks    Hooks
+	writes   chan auditWrite
+	overflow chan struct{}
+
+	// missed is the earliest revision of the writes that did not fit the
+	// buffer since it was last replayed, or zero if there are none.
+	missedLock sync.Mutex
+	missed     int64
+}
+
+// SetHooks sets the hooks that successful creates, updates and deletes are
+// passed to, with a buffer of the given number of writes, or of
+// DefaultHookBufferSize if it is not positive. It must be set before the
+// backend is started.
+func (l *LogStructured) SetHooks(hooks Hooks, bufferSize int) {
+	if bufferSize <= 0 {
+		bufferSize = DefaultHookBufferSize
+	}
+	l.hooks = &hookQueue{
+		hooks:    hooks,
+		writes:   make(chan auditWrite, bufferSize),
+		overflow: make(chan struct{}, 1),
+	}
+}
+
+// enqueue buffers the write for the hooks, or records it as missed if the
+// buffer is full.
+func (q *hookQueue) enqueue(w auditWrite) {
+	select {
+	case q.writes <- w:
+		return
+	default:
+	}
+	q.missedLock.Lock()
+	if q.missed == 0 || w.revision < q.missed {
+		q.missed = w.revision
+	}
+	q.missedLock.Unlock()
+	select {
+	case q.overflow <- struct{}{}:
+	default:
+	}
+}
+
+// takeMissed returns the earliest revision of the writes missed, or zero if
+// there are none, and forgets them.
+func (q *hookQueue) takeMissed() int64 {
+	q.missedLock.Lock()
+	defer q.missedLock.Unlock()
+	missed := q.missed
+	q.missed = 0
+	return missed
+}
+
+// peekMissed returns the earliest revision of the writes missed, or zero if
+// there are none.
+func (q *hookQueue) peekMissed() int64 {
+	q.missedLock.Lock()
+	defer q.missedLock.Unlock()
+	return q.missed
+}
+
+// runHooks passes the buffered writes to the hooks until the context is
+// done, replaying the writes missed from the log once those buffered before
+// them were passed, or once the buffer runs empty.
+func (l *LogStructured) runHooks(ctx context.Context) {
+	q := l.hooks
+	// replayed is the revision up to which the writes were replayed, which
+	// buffered writes are not passed again
+	var replayed int64
+	for {
+		var w auditWrite
+		select {
+		case w = <-q.writes:
+		default:
+			if missed := q.takeMissed(); missed != 0 {
+				replayed = l.replayHooks(ctx, missed)
+				continue
+			}
+			select {
+			case w = <-q.writes:
+			case <-q.overflow:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if w.revision <= replayed {
+			continue
+		}
+		if missed := q.peekMissed(); missed != 0 && w.revision > missed {
+			replayed = l.replayHooks(ctx, q.takeMissed())
+			if w.revision <= replayed {
+				continue
+			}
+		}
+		if w.operation == audit.Delete {
+			q.hooks.OnDelete(w.key, w.revision)
+		} else {
+			q.hooks.OnPut(w.key, w.value, w.revision)
+		}
+	}
+}
+
+// replayHooks passes the writes of the log from the revision on to the hooks,
+// and returns the revision of the last one passed. Writes that were compacted
+// are not passed.
+func (l *LogStructured) replayHooks(ctx context.Context, revision int64) int64 {
+	l.logger.Warnf("hook buffer of %d writes overflowed, replaying the writes from revision %d", cap(l.hooks.writes), revision)
+	replayed := revision - 1
+	for {
+		_, events, err := l.log.After(ctx, "", replayed, hookReplayBatchSize)
+		if err == nil {
+			events, err = l.compression.decompressEvents(events)
+		}
+		if err != nil {
+			l.logger.Errorf("failed to replay the writes after revision %d to the hooks: %v", replayed, err)
+			return replayed
+		}
+		if len(events) == 0 {
+			return replayed
+		}
+		for _, event := range events {
+			if event.Delete {
+				l.hooks.hooks.OnDelete(event.KV.Key, event.KV.ModRevision)
+			} else {
+				l.hooks.hooks.OnPut(event.KV.Key, event.KV.Value, event.KV.ModRevision)
+			}
+			replayed = event.KV.ModRevision
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package logstructured
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/rancher/kine/pkg/server"
+)
+
+// lease is a lease granted through the lease API. Keys attached to a lease
+// are kept at least until the lease's deadline, which is pushed out by every
+// keepalive.
+type lease struct {
+	ttl      int64
+	deadline time.Time
+}
+
+// loadLeases refreshes the lease registry from the leases stored by the log,
+// so that leases survive restarts and leases granted or kept alive by the
+// other kine that share the database are known. Leases keep the later of
+// their deadlines in the registry and in the log, and those that were in the
+// registry before the leases were read but are no longer stored were revoked
+// or expired by another kine, and are forgotten. Leases whose deadline passed
+// while kine was not running are expired by the next TTL scan.
+func (l *LogStructured) loadLeases(ctx context.Context) error {
+	l.leasesLock.Lock()
+	known := make(map[int64]bool, len(l.leases))
+	for id := range l.leases {
+		known[id] = true
+	}
+	l.leasesLock.Unlock()
+
+	leases, err := l.log.Leases(ctx)
+	if err != nil {
+		return err
+	}
+
+	l.leasesLock.Lock()
+	defer l.leasesLock.Unlock()
+	l.leasesLoaded = time.Now()
+	for _, stored := range leases {
+		delete(known, stored.ID)
+		last := stored.GrantedAt
+		if stored.LastKeepAlive.After(last) {
+			last = stored.LastKeepAlive
+		}
+		deadline := ttlDeadline(last, stored.TTL)
+		if lease, ok := l.leases[stored.ID]; ok {
+			if deadline.After(lease.deadline) {
+				lease.deadline = deadline
+			}
+			continue
+		}
+		l.leases[stored.ID] = &lease{
+			ttl:      stored.TTL,
+			deadline: deadline,
+		}
+	}
+	for id := range known {
+		delete(l.leases, id)
+	}
+	return nil
+}
+
+// getLease returns a copy of the lease with the given ID, or false if the
+// lease is not in the registry.
+func (l *LogStructured) getLease(id int64) (lease, bool) {
+	l.leasesLock.Lock()
+	defer l.leasesLock.Unlock()
+	if lease, ok := l.leases[id]; ok {
+		return *lease, true
+	}
+	return lease{}, false
+}
+
+// lookupLease is like getLease, but refreshes the registry from the log if
+// the lease is not in it, as it may have been granted by another kine that
+// shares the database since the registry was last refreshed.
+func (l *LogStructured) lookupLease(ctx context.Context, id int64) (lease, bool, error) {
+	if lease, ok := l.getLease(id); ok {
+		return lease, true, nil
+	}
+	if err := l.loadLeases(ctx); err != nil {
+		return lease{}, false, err
+	}
+	lease, ok := l.getLease(id)
+	return lease, ok, nil
+}
+
+// leaseTTL returns the TTL in seconds of the lease with the given ID. Leases
+// that are not in the registry predate the lease API, and use their ID as
+// TTL.
+func (l *LogStructured) leaseTTL(id int64) int64 {
+	if lease, ok := l.getLease(id); ok {
+		return lease.ttl
+	}
+	return id
+}
+
+// expireLeases forgets all leases whose deadline has passed, except those
+// that still have keys attached which have not expired yet.
+func (l *LogStructured) expireLeases(ctx context.Context, now time.Time, inUse map[int64]bool) {
+	var expired []int64
+
+	l.leasesLock.Lock()
+	for id, lease := range l.leases {
+		if now.After(lease.deadline) && !inUse[id] {
+			delete(l.leases, id)
+			expired = append(expired, id)
+		}
+	}
+	l.leasesLock.Unlock()
+
+	for _, id := range expired {
+		if err := l.log.DeleteLease(ctx, id); err != nil {
+			l.logger.Errorf("failed to delete expired lease %d: %v", id, err)
+		}
+	}
+}
+
+func (l *LogStructured) LeaseGrant(ctx context.Context, id, ttl int64) (idRet int64, errRet error) {
+	defer func() {
+		l.logger.Debugf("LEASEGRANT %d, ttl=%d => id=%d, err=%v", id, ttl, idRet, errRet)
+	}()
+
+	l.leasesLock.Lock()
+	defer l.leasesLock.Unlock()
+
+	if id == 0 {
+		// the lease column is a 32 bit integer in some of the schemas
+		for id == 0 || l.leases[id] != nil {
+			id = rand.Int63n(math.MaxInt32) + 1
+		}
+	} else if l.leases[id] != nil {
+		return 0, server.ErrLeaseExist
+	}
+
+	now := time.Now()
+	err := l.log.CreateLease(ctx, &server.Lease{
+		ID:            id,
+		TTL:           ttl,
+		GrantedAt:     now,
+		LastKeepAlive: now,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	l.leases[id] = &lease{
+		ttl:      ttl,
+		deadline: ttlDeadline(now, ttl),
+	}
+	return id, nil
+}
+
+func (l *LogStructured) LeaseKeepAlive(ctx context.Context, id int64) (ttlRet int64, errRet error) {
+	defer func() {
+		l.logger.Debugf("LEASEKEEPALIVE %d => ttl=%d, err=%v", id, ttlRet, errRet)
+	}()
+
+	if _, ok, err := l.lookupLease(ctx, id); err != nil {
+		return 0, err
+	} else if !ok {
+		return -1, nil
+	}
+
+	// the keepalive is stored without holding the registry, so that a slow
+	// write does not hold up the other lease operations and the TTL scan
+	now := time.Now()
+	if err := l.log.KeepAliveLease(ctx, id, now); err != nil {
+		return 0, err
+	}
+
+	l.leasesLock.Lock()
+	defer l.leasesLock.Unlock()
+	lease := l.leases[id]
+	if lease == nil {
+		// revoked or expired while the keepalive was stored
+		return -1, nil
+	}
+	if deadline := ttlDeadline(now, lease.ttl); deadline.After(lease.deadline) {
+		lease.deadline = deadline
+	}
+	return lease.ttl, nil
+}
+
+func (l *LogStructured) LeaseTimeToLive(ctx context.Context, id int64, keys bool) (ttlRet, grantedRet int64, keysRet []string, errRet error) {
+	defer func() {
+		l.logger.Debugf("LEASETIMETOLIVE %d, keys=%v => ttl=%d, granted=%d, keys=%d, err=%v", id, keys, ttlRet, grantedRet, len(keysRet), errRet)
+	}()
+
+	lease, ok, err := l.lookupLease(ctx, id)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if !ok {
+		return 0, 0, nil, server.ErrLeaseNotFound
+	}
+
+	remaining := int64(math.Ceil(time.Until(lease.deadline).Seconds()))
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	if !keys {
+		return remaining, lease.ttl, nil, nil
+	}
+
+	leaseKeys, err := l.log.LeaseKeys(ctx, id)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return remaining, lease.ttl, leaseKeys, nil
+}
+
+func (l *LogStructured) LeaseRevoke(ctx context.Context, id int64) (revRet int64, errRet error) {
+	var deleted int64
+	defer func() {
+		l.adjustRevision(ctx, &revRet)
+		l.logger.Debugf("LEASEREVOKE %d => rev=%d, deleted=%d, err=%v", id, revRet, deleted, errRet)
+	}()
+
+	if _, ok, err := l.lookupLease(ctx, id); err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, server.ErrLeaseNotFound
+	}
+
+	deleted, err := l.log.RevokeLease(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	l.leasesLock.Lock()
+	delete(l.leases, id)
+	l.leasesLock.Unlock()
+
+	if err := l.log.DeleteLease(ctx, id); err != nil {
+		return 0, err
+	}
+
+	return l.log.CurrentRevision(ctx)
+}
+
+// Leases returns the leases stored by the log, with the keep alives of all
+// the instances sharing it, rather than the registry of this backend.
+func (l *LogStructured) Leases(ctx context.Context) ([]*server.Lease, error) {
+	return l.log.Leases(ctx)
+}
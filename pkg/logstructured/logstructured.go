@@ -2,31 +2,95 @@ package logstructured
 
 import (
 	"context"
+	"errors"
+	"io"
 	"sync"
 	"time"
 
+	"github.com/rancher/kine/pkg/audit"
+	"github.com/rancher/kine/pkg/logging"
 	"github.com/rancher/kine/pkg/server"
-	"github.com/sirupsen/logrus"
 )
 
+// prefixStatsTTL is how long the stats of the prefixes of keys are served
+// from the cache.
+const prefixStatsTTL = 10 * time.Second
+
 type Log interface {
 	Start(ctx context.Context) error
 	CurrentRevision(ctx context.Context) (int64, error)
-	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeletes bool) (int64, []*server.Event, error)
+	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeletes, keysOnly bool, filter server.RevisionFilter) (int64, []*server.Event, error)
 	After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error)
-	Watch(ctx context.Context, prefix string) <-chan []*server.Event
-	Count(ctx context.Context, prefix string) (int64, int64, error)
+	AfterBatches(ctx context.Context, prefix string, revision int64, fn func(events []*server.Event) error) (int64, error)
+	Watch(ctx context.Context, prefix string) <-chan server.WatchEvents
+	Count(ctx context.Context, prefix, startKey string, revision int64, filter server.RevisionFilter) (int64, int64, error)
 	Append(ctx context.Context, event *server.Event) (int64, error)
 	DbSize(ctx context.Context) (int64, error)
+	DbSizeInUse(ctx context.Context) (int64, error)
+	Defragment(ctx context.Context) error
+	Snapshot(ctx context.Context, w io.Writer) error
+	Restore(ctx context.Context, r io.Reader, force bool) error
+	Quiesce(ctx context.Context) error
+	Resume() error
+	Close() error
+	CompactRevision(ctx context.Context) (int64, error)
+	Compact(ctx context.Context, revision int64) (int64, error)
+	// RaiseRevision raises the current revision to the given one if it is
+	// lower, compacting the revisions up to it, and returns the current
+	// revision.
+	RaiseRevision(ctx context.Context, revision int64) (int64, error)
+	// History returns the current and compact revisions, and the stored
+	// revisions of the key in order, or only the one at the revision if it
+	// is not zero, with their values if values is set.
+	History(ctx context.Context, key string, revision int64, values bool) (int64, int64, []*server.KeyRevision, error)
+	// Verify returns the stored revisions that do not fit the history of
+	// their keys, repairing those it can if repair is set.
+	Verify(ctx context.Context, repair bool) ([]server.Inconsistency, error)
+	// GC returns the rows that no read can return any more, by their kind,
+	// removing them unless dryRun is set.
+	GC(ctx context.Context, dryRun bool) ([]server.Garbage, error)
+	// PrefixStats returns the keys and rows of each prefix of the first two
+	// segments of keys, in the order of the prefixes.
+	PrefixStats(ctx context.Context) ([]server.PrefixStat, error)
+	LeaseKeys(ctx context.Context, lease int64) ([]string, error)
+	Version(ctx context.Context, key string, createRevision, modRevision int64) (int64, error)
+	Versions(ctx context.Context, kvs []*server.KeyValue) error
+	RevokeLease(ctx context.Context, lease int64) (int64, error)
+	Leases(ctx context.Context) ([]*server.Lease, error)
+	CreateLease(ctx context.Context, lease *server.Lease) error
+	KeepAliveLease(ctx context.Context, id int64, at time.Time) error
+	DeleteLease(ctx context.Context, id int64) error
+	Txn(ctx context.Context, fn func(ctx context.Context) error) error
+	// GetLogger returns the logger of the log, which the backend logs to as
+	// well.
+	GetLogger() logging.Logger
 }
 
 type LogStructured struct {
-	log Log
+	log         Log
+	audit       *audit.Log
+	hooks       *hookQueue
+	compression compression
+	logger      logging.Logger
+
+	leasesLock sync.Mutex
+	leases     map[int64]*lease
+	// leasesLoaded is when the lease registry was last refreshed from the log.
+	leasesLoaded time.Time
+
+	// prefixStats are the stats of the prefixes of keys as of prefixStatsAt,
+	// which are served for up to prefixStatsTTL, as they take a scan of the
+	// whole log.
+	prefixStatsLock sync.Mutex
+	prefixStats     []server.PrefixStat
+	prefixStatsAt   time.Time
 }
 
 func New(log Log) *LogStructured {
 	return &LogStructured{
-		log: log,
+		log:    log,
+		logger: logging.OrDefault(log.GetLogger()),
+		leases: map[int64]*lease{},
 	}
 }
 
@@ -34,31 +98,43 @@ func (l *LogStructured) Start(ctx context.Context) error {
 	if err := l.log.Start(ctx); err != nil {
 		return err
 	}
+	if err := l.loadLeases(ctx); err != nil {
+		return err
+	}
 	l.Create(ctx, "/registry/health", []byte(`{"health":"true"}`), 0)
-	go l.ttl(ctx)
+	if l.hooks != nil {
+		go l.runHooks(ctx)
+	}
+	if !server.IsPassiveStart(ctx) {
+		go l.ttl(ctx)
+	}
 	return nil
 }
 
 func (l *LogStructured) Get(ctx context.Context, key, rangeEnd string, limit, revision int64) (revRet int64, kvRet *server.KeyValue, errRet error) {
 	defer func() {
 		l.adjustRevision(ctx, &revRet)
-		logrus.Debugf("GET %s, rev=%d => rev=%d, kv=%v, err=%v", key, revision, revRet, kvRet != nil, errRet)
+		l.logger.Debugf("GET %s, rev=%d => rev=%d, kv=%v, err=%v", key, revision, revRet, kvRet != nil, errRet)
 	}()
 
 	rev, event, err := l.get(ctx, key, rangeEnd, limit, revision, false)
 	if event == nil {
 		return rev, nil, err
 	}
+	if err == nil {
+		err = l.log.Versions(ctx, []*server.KeyValue{event.KV})
+	}
 	return rev, event.KV, err
 }
 
 func (l *LogStructured) get(ctx context.Context, key, rangeEnd string, limit, revision int64, includeDeletes bool) (int64, *server.Event, error) {
-	rev, events, err := l.log.List(ctx, key, rangeEnd, limit, revision, includeDeletes)
+	rev, events, err := l.log.List(ctx, key, rangeEnd, limit, revision, includeDeletes, false, server.RevisionFilter{})
 	if err == server.ErrCompacted {
-		// ignore compacted when getting by revision
-		err = nil
+		return rev, nil, err
+	} else if err != nil {
+		return 0, nil, err
 	}
-	if err != nil {
+	if events, err = l.compression.decompressEvents(events); err != nil {
 		return 0, nil, err
 	}
 	if revision != 0 {
@@ -83,7 +159,7 @@ func (l *LogStructured) adjustRevision(ctx context.Context, rev *int64) {
 func (l *LogStructured) Create(ctx context.Context, key string, value []byte, lease int64) (revRet int64, errRet error) {
 	defer func() {
 		l.adjustRevision(ctx, &revRet)
-		logrus.Debugf("CREATE %s, size=%d, lease=%d => rev=%d, err=%v", key, len(value), lease, revRet, errRet)
+		l.logger.Debugf("CREATE %s, size=%d, lease=%d => rev=%d, err=%v", key, len(value), lease, revRet, errRet)
 	}()
 
 	rev, prevEvent, err := l.get(ctx, key, "", 1, 0, true)
@@ -108,14 +184,21 @@ func (l *LogStructured) Create(ctx context.Context, key string, value []byte, le
 		createEvent.PrevKV = prevEvent.KV
 	}
 
-	revRet, errRet = l.log.Append(ctx, createEvent)
+	revRet, errRet = l.append(ctx, createEvent)
+	if errRet == nil {
+		var prevRevision int64
+		if prevEvent != nil {
+			prevRevision = prevEvent.KV.ModRevision
+		}
+		l.recordWrite(ctx, audit.Create, key, value, revRet, prevRevision, lease)
+	}
 	return
 }
 
 func (l *LogStructured) Delete(ctx context.Context, key string, revision int64) (revRet int64, kvRet *server.KeyValue, deletedRet bool, errRet error) {
 	defer func() {
 		l.adjustRevision(ctx, &revRet)
-		logrus.Debugf("DELETE %s, rev=%d => rev=%d, kv=%v, deleted=%v, err=%v", key, revision, revRet, kvRet != nil, deletedRet, errRet)
+		l.logger.Debugf("DELETE %s, rev=%d => rev=%d, kv=%v, deleted=%v, err=%v", key, revision, revRet, kvRet != nil, deletedRet, errRet)
 	}()
 
 	rev, event, err := l.get(ctx, key, "", 1, 0, true)
@@ -128,7 +211,7 @@ func (l *LogStructured) Delete(ctx context.Context, key string, revision int64)
 	}
 
 	if event.Delete {
-		return rev, event.KV, true, nil
+		return rev, nil, true, nil
 	}
 
 	if revision != 0 && event.KV.ModRevision != revision {
@@ -141,28 +224,77 @@ func (l *LogStructured) Delete(ctx context.Context, key string, revision int64)
 		PrevKV: event.KV,
 	}
 
-	rev, err = l.log.Append(ctx, deleteEvent)
-	if err != nil {
-		// If error on Append we assume it's a UNIQUE constraint error, so we fetch the latest (if we can)
-		// and return that the delete failed
+	rev, err = l.append(ctx, deleteEvent)
+	if errors.Is(err, server.ErrKeyExists) {
+		// the key was written concurrently, so the delete failed its compare
+		// against the latest row, which is returned if it can be read
 		latestRev, latestEvent, latestErr := l.get(ctx, key, "", 1, 0, true)
 		if latestErr != nil || latestEvent == nil {
 			return rev, event.KV, false, nil
 		}
 		return latestRev, latestEvent.KV, false, nil
+	} else if err != nil {
+		return 0, nil, false, err
 	}
+	l.recordWrite(ctx, audit.Delete, key, nil, rev, event.KV.ModRevision, event.KV.Lease)
 	return rev, event.KV, true, err
 }
 
-func (l *LogStructured) List(ctx context.Context, prefix, startKey string, limit, revision int64) (revRet int64, kvRet []*server.KeyValue, errRet error) {
+// DeleteRange deletes the live keys of the prefix after the start key in a
+// single transaction, writing a tombstone row for each, and returns the
+// revision of the last tombstone and the deleted keys in key order. The list
+// of the keys is made in the transaction, so a key written concurrently fails
+// its tombstone with ErrKeyExists rather than being deleted unseen.
+func (l *LogStructured) DeleteRange(ctx context.Context, prefix, startKey string) (revRet int64, kvsRet []*server.KeyValue, errRet error) {
 	defer func() {
-		logrus.Debugf("LIST %s, start=%s, limit=%d, rev=%d => rev=%d, kvs=%d, err=%v", prefix, startKey, limit, revision, revRet, len(kvRet), errRet)
+		l.adjustRevision(ctx, &revRet)
+		l.logger.Debugf("DELETERANGE %s, start=%s => rev=%d, deleted=%d, err=%v", prefix, startKey, revRet, len(kvsRet), errRet)
 	}()
 
-	rev, events, err := l.log.List(ctx, prefix, startKey, limit, revision, false)
+	err := l.auditTxn(ctx, func(ctx context.Context) error {
+		// the transaction may be run again if the database aborts it
+		revRet, kvsRet = 0, nil
+		rev, events, err := l.log.List(ctx, prefix, startKey, 0, 0, false, false, server.RevisionFilter{})
+		if err != nil {
+			return err
+		}
+		if events, err = l.compression.decompressEvents(events); err != nil {
+			return err
+		}
+
+		revRet = rev
+		for _, event := range events {
+			rev, err := l.append(ctx, &server.Event{
+				Delete: true,
+				KV:     event.KV,
+				PrevKV: event.KV,
+			})
+			if err != nil {
+				return err
+			}
+			l.recordWrite(ctx, audit.Delete, event.KV.Key, nil, rev, event.KV.ModRevision, event.KV.Lease)
+			revRet = rev
+			kvsRet = append(kvsRet, event.KV)
+		}
+		return nil
+	})
 	if err != nil {
 		return 0, nil, err
 	}
+	return revRet, kvsRet, nil
+}
+
+func (l *LogStructured) List(ctx context.Context, prefix, startKey string, limit, revision int64, keysOnly bool, filter server.RevisionFilter) (revRet int64, kvRet []*server.KeyValue, errRet error) {
+	defer func() {
+		l.logger.Debugf("LIST %s, start=%s, limit=%d, rev=%d, keysOnly=%v => rev=%d, kvs=%d, err=%v", prefix, startKey, limit, revision, keysOnly, revRet, len(kvRet), errRet)
+	}()
+
+	rev, events, err := l.log.List(ctx, prefix, startKey, limit, revision, false, keysOnly, filter)
+	if err == server.ErrCompacted {
+		return rev, nil, err
+	} else if err != nil {
+		return 0, nil, err
+	}
 	if revision == 0 && len(events) == 0 {
 		// if no revision is requested and no events are returned, then
 		// get the current revision and relist.  Relist is required because
@@ -172,34 +304,43 @@ func (l *LogStructured) List(ctx context.Context, prefix, startKey string, limit
 		if err != nil {
 			return 0, nil, err
 		}
-		return l.List(ctx, prefix, startKey, limit, currentRev)
+		return l.List(ctx, prefix, startKey, limit, currentRev, keysOnly, filter)
 	} else if revision != 0 {
 		rev = revision
 	}
+	if events, err = l.compression.decompressEvents(events); err != nil {
+		return 0, nil, err
+	}
 
 	kvs := make([]*server.KeyValue, 0, len(events))
 	for _, event := range events {
 		kvs = append(kvs, event.KV)
 	}
+	if err := l.log.Versions(ctx, kvs); err != nil {
+		return 0, nil, err
+	}
 	return rev, kvs, nil
 }
 
-func (l *LogStructured) Count(ctx context.Context, prefix string) (revRet int64, count int64, err error) {
+func (l *LogStructured) Count(ctx context.Context, prefix, startKey string, revision int64, filter server.RevisionFilter) (revRet int64, count int64, err error) {
 	defer func() {
-		logrus.Debugf("COUNT %s => rev=%d, count=%d, err=%v", prefix, revRet, count, err)
+		l.logger.Debugf("COUNT %s, start=%s, rev=%d => rev=%d, count=%d, err=%v", prefix, startKey, revision, revRet, count, err)
 	}()
-	rev, count, err := l.log.Count(ctx, prefix)
+	rev, count, err := l.log.Count(ctx, prefix, startKey, revision, filter)
 	if err != nil {
 		return 0, 0, err
 	}
 
+	if revision != 0 {
+		return revision, count, nil
+	}
 	if count == 0 {
 		// if count is zero, then so is revision, so now get the current revision and re-count at that revision
 		currentRev, err := l.log.CurrentRevision(ctx)
 		if err != nil {
 			return 0, 0, err
 		}
-		rev, rows, err := l.List(ctx, prefix, prefix, 1000, currentRev)
+		rev, rows, err := l.List(ctx, prefix, startKey, 1000, currentRev, true, filter)
 		return rev, int64(len(rows)), err
 	}
 	return rev, count, nil
@@ -212,7 +353,7 @@ func (l *LogStructured) Update(ctx context.Context, key string, value []byte, re
 		if kvRet != nil {
 			kvRev = kvRet.ModRevision
 		}
-		logrus.Debugf("UPDATE %s, value=%d, rev=%d, lease=%v => rev=%d, kvrev=%d, updated=%v, err=%v", key, len(value), revision, lease, revRet, kvRev, updateRet, errRet)
+		l.logger.Debugf("UPDATE %s, value=%d, rev=%d, lease=%v => rev=%d, kvrev=%d, updated=%v, err=%v", key, len(value), revision, lease, revRet, kvRev, updateRet, errRet)
 	}()
 
 	rev, event, err := l.get(ctx, key, "", 1, 0, false)
@@ -238,114 +379,111 @@ func (l *LogStructured) Update(ctx context.Context, key string, value []byte, re
 		PrevKV: event.KV,
 	}
 
-	rev, err = l.log.Append(ctx, updateEvent)
-	if err != nil {
-		rev, event, err := l.get(ctx, key, "", 1, 0, false)
-		if event == nil {
-			return rev, nil, false, err
+	rev, err = l.append(ctx, updateEvent)
+	if errors.Is(err, server.ErrKeyExists) {
+		// the key was written concurrently, so the update failed its compare
+		// against the latest row, which is returned; within a transaction
+		// that the conflict aborted it cannot be read, and the conflict is
+		// returned instead
+		latestRev, latestEvent, latestErr := l.get(ctx, key, "", 1, 0, false)
+		if latestErr != nil {
+			return 0, nil, false, err
+		}
+		if latestEvent == nil {
+			return latestRev, nil, false, nil
 		}
-		return rev, event.KV, false, err
+		return latestRev, latestEvent.KV, false, nil
+	} else if err != nil {
+		return 0, nil, false, err
 	}
 
 	updateEvent.KV.ModRevision = rev
-	return rev, updateEvent.KV, true, err
-}
-
-func (l *LogStructured) ttlEvents(ctx context.Context) chan *server.Event {
-	result := make(chan *server.Event)
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-
-	go func() {
-		wg.Wait()
-		close(result)
-	}()
-
-	go func() {
-		defer wg.Done()
-		rev, events, err := l.log.List(ctx, "/", "", 1000, 0, false)
-		for len(events) > 0 {
-			if err != nil {
-				logrus.Errorf("failed to read old events for ttl")
-				return
-			}
-
-			for _, event := range events {
-				if event.KV.Lease > 0 {
-					result <- event
-				}
-			}
-
-			_, events, err = l.log.List(ctx, "/", events[len(events)-1].KV.Key, 1000, rev, false)
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		for events := range l.log.Watch(ctx, "/") {
-			for _, event := range events {
-				if event.KV.Lease > 0 {
-					result <- event
-				}
-			}
-		}
-	}()
-
-	return result
+	l.recordWrite(ctx, audit.Update, key, value, rev, event.KV.ModRevision, lease)
+	return rev, updateEvent.PrevKV, true, err
 }
 
-func (l *LogStructured) ttl(ctx context.Context) {
-	// vary naive TTL support
-	mutex := &sync.Mutex{}
-	for event := range l.ttlEvents(ctx) {
-		go func(event *server.Event) {
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(time.Duration(event.KV.Lease) * time.Second):
-			}
-			mutex.Lock()
-			l.Delete(ctx, event.KV.Key, event.KV.ModRevision)
-			mutex.Unlock()
-		}(event)
-	}
-}
-
-func (l *LogStructured) Watch(ctx context.Context, prefix string, revision int64) <-chan []*server.Event {
-	logrus.Debugf("WATCH %s, revision=%d", prefix, revision)
+func (l *LogStructured) Watch(ctx context.Context, prefix string, revision int64) <-chan server.WatchEvents {
+	l.logger.Debugf("WATCH %s, revision=%d", prefix, revision)
 
 	// starting watching right away so we don't miss anything
 	ctx, cancel := context.WithCancel(ctx)
 	readChan := l.log.Watch(ctx, prefix)
 
-	// include the current revision in list
+	// include the current revision in list. A revision past the current one
+	// lists nothing, and the events up to it are dropped from those read
+	// below, so that the watch waits for the store to reach it; only those
+	// below the compact revision are reported as compacted
 	if revision > 0 {
 		revision -= 1
 	}
 
-	result := make(chan []*server.Event, 100)
+	result := make(chan server.WatchEvents, 100)
 
-	rev, kvs, err := l.log.After(ctx, prefix, revision, 0)
+	// the events below include every event up to the current revision, so
+	// once they are sent the watch has seen at least this far, which any
+	// revision the log knows of is a lower bound of
+	current, err := l.log.CurrentRevision(server.WithSerializableRead(ctx))
 	if err != nil {
-		logrus.Errorf("failed to list %s for revision %d", prefix, revision)
+		l.logger.Errorf("failed to get current revision for watch on %s: %v", prefix, err)
 		cancel()
 	}
 
-	logrus.Debugf("WATCH LIST key=%s rev=%d => rev=%d kvs=%d", prefix, revision, rev, len(kvs))
-
 	go func() {
-		lastRevision := revision
-		if len(kvs) > 0 {
-			lastRevision = rev
-		}
+		// the events are sent in batches as they are read, so that a watch
+		// catching up on many revisions does not hold all of them at once
+		var (
+			lastRevision = revision
+			progress     = current
+			sent         int
+		)
+		rev, err := l.log.AfterBatches(ctx, prefix, revision, func(events []*server.Event) error {
+			events, err := l.compression.decompressEvents(events)
+			if err != nil {
+				return err
+			}
+			if last := events[len(events)-1].KV.ModRevision; last > progress {
+				progress = last
+			}
+			sent += len(events)
+			result <- server.WatchEvents{Revision: events[len(events)-1].KV.ModRevision, Events: events}
+			return nil
+		})
+
+		l.logger.Debugf("WATCH LIST key=%s rev=%d => rev=%d kvs=%d", prefix, revision, rev, sent)
 
-		if len(kvs) > 0 {
-			result <- kvs
+		switch err {
+		case nil:
+			if sent > 0 {
+				lastRevision = rev
+			}
+			result <- server.WatchEvents{Revision: progress}
+		case server.ErrCompacted:
+			result <- server.WatchEvents{Revision: current, CompactRevision: rev}
+			cancel()
+		default:
+			l.logger.Errorf("failed to list %s for revision %d: %v", prefix, revision, err)
+			cancel()
 		}
 
 		// always ensure we fully read the channel
 		for i := range readChan {
-			result <- filter(i, lastRevision)
+			if i.Err != nil {
+				result <- i
+				continue
+			}
+			if i.Revision <= lastRevision {
+				continue
+			}
+			events, err := l.compression.decompressEvents(filter(i.Events, lastRevision))
+			if err != nil {
+				// the error ends the watch, and what is left of it is drained
+				result <- server.WatchEvents{Revision: i.Revision, Err: err}
+				cancel()
+				for range readChan {
+				}
+				break
+			}
+			result <- server.WatchEvents{Revision: i.Revision, Events: events}
 		}
 		close(result)
 		cancel()
@@ -365,3 +503,174 @@ func filter(events []*server.Event, rev int64) []*server.Event {
 func (l *LogStructured) DbSize(ctx context.Context) (int64, error) {
 	return l.log.DbSize(ctx)
 }
+
+func (l *LogStructured) DbSizeInUse(ctx context.Context) (int64, error) {
+	return l.log.DbSizeInUse(ctx)
+}
+
+func (l *LogStructured) Defragment(ctx context.Context) error {
+	return l.log.Defragment(ctx)
+}
+
+func (l *LogStructured) Quiesce(ctx context.Context) (errRet error) {
+	defer func() {
+		l.logger.Debugf("QUIESCE => err=%v", errRet)
+	}()
+	return l.log.Quiesce(ctx)
+}
+
+func (l *LogStructured) Resume() (errRet error) {
+	defer func() {
+		l.logger.Debugf("RESUME => err=%v", errRet)
+	}()
+	return l.log.Resume()
+}
+
+// Close closes the database. The backend must have been stopped by canceling
+// the context it was started with.
+func (l *LogStructured) Close() error {
+	defer l.compression.close()
+	return l.log.Close()
+}
+
+func (l *LogStructured) CurrentRevision(ctx context.Context) (int64, error) {
+	return l.log.CurrentRevision(ctx)
+}
+
+func (l *LogStructured) Snapshot(ctx context.Context, w io.Writer) error {
+	return l.log.Snapshot(ctx, w)
+}
+
+func (l *LogStructured) Restore(ctx context.Context, r io.Reader, force bool) error {
+	return l.log.Restore(ctx, r, force)
+}
+
+// RaiseRevision raises the current revision to the given one if it is lower,
+// so that the next write gets a higher revision, and returns the current
+// revision. The revisions up to it are compacted, as the log holds no history
+// of them.
+func (l *LogStructured) RaiseRevision(ctx context.Context, revision int64) (revRet int64, errRet error) {
+	defer func() {
+		l.logger.Debugf("RAISEREVISION %d => rev=%d, err=%v", revision, revRet, errRet)
+	}()
+	return l.log.RaiseRevision(ctx, revision)
+}
+
+// History returns the current and compact revisions, and the revisions of
+// the key that are still stored, oldest first, which go back to the compact
+// revision and may include older ones that compaction kept. If the revision
+// is not zero only the revision of the key at it is returned, if it is
+// stored. The values are only read if values is set, and are returned
+// decompressed.
+func (l *LogStructured) History(ctx context.Context, key string, revision int64, values bool) (revRet, compactRet int64, revisionsRet []*server.KeyRevision, errRet error) {
+	defer func() {
+		l.logger.Debugf("HISTORY %s, rev=%d, values=%v => rev=%d, compact=%d, revisions=%d, err=%v", key, revision, values, revRet, compactRet, len(revisionsRet), errRet)
+	}()
+
+	rev, compact, revisions, err := l.log.History(ctx, key, revision, values)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	for _, r := range revisions {
+		if r.Value == nil {
+			continue
+		}
+		if r.Value, err = l.compression.decompress(r.Value); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	return rev, compact, revisions, nil
+}
+
+// Verify checks that the stored revisions of each key above the compact
+// revision form a single chain, in which updates and deletes follow a
+// revision of the same key at which it exists and creates follow none, and
+// returns the revisions that do not. If repair is set the orphaned tombstones
+// are deleted, as the only inconsistency that can be repaired without
+// changing what is read, and are returned as repaired.
+func (l *LogStructured) Verify(ctx context.Context, repair bool) (inconsistenciesRet []server.Inconsistency, errRet error) {
+	defer func() {
+		l.logger.Debugf("VERIFY repair=%v => inconsistencies=%d, err=%v", repair, len(inconsistenciesRet), errRet)
+	}()
+	return l.log.Verify(ctx, repair)
+}
+
+// GC removes the rows at or below the compact revision that no read can
+// return: deletes, revisions superseded by a later one of their key, and the
+// revisions of keys deleted by then. Compaction removes them as it goes, so
+// they are only found where a compaction or kine was interrupted. Nothing is
+// removed if dryRun is set, and the rows are only counted.
+func (l *LogStructured) GC(ctx context.Context, dryRun bool) (garbageRet []server.Garbage, errRet error) {
+	defer func() {
+		l.logger.Debugf("GC dryRun=%v => garbage=%v, err=%v", dryRun, garbageRet, errRet)
+	}()
+	return l.log.GC(ctx, dryRun)
+}
+
+// PrefixStats returns the live keys and the stored rows of each prefix of the
+// first two segments of keys, such as /registry/pods/, with their sizes. The
+// stats are cached for prefixStatsTTL, and the callers that ask while they are
+// gathered wait for them.
+func (l *LogStructured) PrefixStats(ctx context.Context) (statsRet []server.PrefixStat, errRet error) {
+	defer func() {
+		l.logger.Debugf("PREFIXSTATS => prefixes=%d, err=%v", len(statsRet), errRet)
+	}()
+
+	l.prefixStatsLock.Lock()
+	defer l.prefixStatsLock.Unlock()
+	if l.prefixStats != nil && time.Since(l.prefixStatsAt) < prefixStatsTTL {
+		return l.prefixStats, nil
+	}
+	stats, err := l.log.PrefixStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if stats == nil {
+		stats = []server.PrefixStat{}
+	}
+	l.prefixStats, l.prefixStatsAt = stats, time.Now()
+	return stats, nil
+}
+
+func (l *LogStructured) CompactRevision(ctx context.Context) (int64, error) {
+	return l.log.CompactRevision(ctx)
+}
+
+func (l *LogStructured) Compact(ctx context.Context, revision int64) (revRet int64, errRet error) {
+	defer func() {
+		l.logger.Debugf("COMPACT %d => rev=%d, err=%v", revision, revRet, errRet)
+	}()
+	if _, err := l.log.Compact(ctx, revision); err != nil {
+		return 0, err
+	}
+	return l.log.CurrentRevision(ctx)
+}
+
+// Version returns the number of times the key was written since it was
+// created, or zero if it does not exist.
+func (l *LogStructured) Version(ctx context.Context, key string) (versionRet int64, errRet error) {
+	defer func() {
+		l.logger.Debugf("VERSION %s => version=%d, err=%v", key, versionRet, errRet)
+	}()
+
+	_, event, err := l.get(ctx, key, "", 1, 0, false)
+	if err != nil || event == nil {
+		return 0, err
+	}
+	return l.VersionOf(ctx, event.KV)
+}
+
+// VersionOf returns the version kv had at its revision, which counts the
+// writes to the key since it was created.
+func (l *LogStructured) VersionOf(ctx context.Context, kv *server.KeyValue) (int64, error) {
+	return l.log.Version(ctx, kv.Key, kv.CreateRevision, kv.ModRevision)
+}
+
+// Txn calls fn with a context in which all backend reads and writes happen
+// atomically. Events written in fn get consecutive revisions.
+func (l *LogStructured) Txn(ctx context.Context, fn func(ctx context.Context) error) (errRet error) {
+	defer func() {
+		l.logger.Debugf("TXN => err=%v", errRet)
+	}()
+	return l.auditTxn(ctx, fn)
+}
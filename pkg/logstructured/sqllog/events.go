@@ -0,0 +1,75 @@
+package sqllog
+
+import (
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// EventRows reads the events of rows one at a time, so that they can be
+// passed on as they are scanned rather than only once all rows are read.
+type EventRows struct {
+	rows  *generic.Rows
+	event *server.Event
+	err   error
+}
+
+// NewEventRows returns an EventRows reading the events of rows, which it
+// closes once it is closed itself.
+func NewEventRows(rows *generic.Rows) *EventRows {
+	return &EventRows{rows: rows}
+}
+
+// Next scans the next event, and reports whether there was one. Once it
+// returns false, Err returns the error that ended the rows, if any.
+func (e *EventRows) Next() bool {
+	if e.err != nil || !e.rows.Next() {
+		return false
+	}
+	event := &server.Event{}
+	if e.err = scan(e.rows, event); e.err != nil {
+		return false
+	}
+	e.event = event
+	return true
+}
+
+// Event returns the event scanned by the last call to Next.
+func (e *EventRows) Event() *server.Event {
+	return e.event
+}
+
+// Err returns the error that ended the rows, if any.
+func (e *EventRows) Err() error {
+	if e.err != nil {
+		return e.err
+	}
+	return e.rows.Err()
+}
+
+// Close closes the rows.
+func (e *EventRows) Close() error {
+	return e.rows.Close()
+}
+
+func RowsToEvents(rows *generic.Rows) ([]*server.Event, error) {
+	return rowsToEvents(rows, 0)
+}
+
+// rowsToEvents is like RowsToEvents, with room for capacity events made up
+// front, as when the number of rows is known.
+func rowsToEvents(rows *generic.Rows, capacity int64) ([]*server.Event, error) {
+	events := NewEventRows(rows)
+	defer events.Close()
+
+	var result []*server.Event
+	if capacity > 0 {
+		result = make([]*server.Event, 0, capacity)
+	}
+	for events.Next() {
+		result = append(result, events.Event())
+	}
+	if err := events.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
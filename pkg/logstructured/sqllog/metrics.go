@@ -0,0 +1,108 @@
+package sqllog
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/metrics"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// metricsTimeout bounds how long the database is queried for the revisions
+// reported by the metrics.
+const metricsTimeout = time.Second
+
+// compactStaleIntervals is the number of compaction intervals without a
+// successful compaction after which the compactor warns that it is falling
+// behind.
+const compactStaleIntervals = 3
+
+// compactMetrics are the metrics of the compactions of the log.
+type compactMetrics struct {
+	deleted     prometheus.Counter
+	duration    prometheus.Histogram
+	lastSuccess prometheus.Gauge
+	failures    *prometheus.CounterVec
+}
+
+// newCompactMetrics returns the metrics of compactions registered with the
+// registerer, along with the lag of the compact revision behind the current
+// revision that lag reports.
+func newCompactMetrics(logger logging.Logger, registerer prometheus.Registerer, lag func() float64) *compactMetrics {
+	metrics.Register(logger, registerer, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "compact",
+		Name:      "revision_lag",
+		Help:      "Number of revisions between the current revision and the compact revision.",
+	}, lag))
+	return &compactMetrics{
+		deleted: metrics.Register(logger, registerer, prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "compact",
+			Name:      "rows_deleted_total",
+			Help:      "Number of rows deleted by compactions.",
+		})).(prometheus.Counter),
+		duration: metrics.Register(logger, registerer, prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "compact",
+			Name:      "duration_seconds",
+			Help:      "Duration of compactions, successful or not.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 18),
+		})).(prometheus.Histogram),
+		lastSuccess: metrics.Register(logger, registerer, prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "compact",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Time of the last successful compaction, in seconds since the epoch.",
+		})).(prometheus.Gauge),
+		failures: metrics.Register(logger, registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "compact",
+			Name:      "failures_total",
+			Help:      "Number of compactions that failed, by the reason they failed for.",
+		}, []string{"reason"})).(*prometheus.CounterVec),
+	}
+}
+
+// observe records the compaction that started at start, deleted the rows and
+// ended with err. Compactions of revisions that were compacted already or not
+// written yet did not run, and are not recorded.
+func (m *compactMetrics) observe(start time.Time, deleted int64, err error) {
+	if m == nil || err == server.ErrCompacted || err == server.ErrFutureRev {
+		return
+	}
+	m.duration.Observe(time.Since(start).Seconds())
+	m.deleted.Add(float64(deleted))
+	if err != nil {
+		m.failures.WithLabelValues(compactFailure(err)).Inc()
+		return
+	}
+	m.lastSuccess.SetToCurrentTime()
+}
+
+// compactFailure returns the reason label of a compaction that failed with
+// err.
+func compactFailure(err error) string {
+	switch {
+	case err == server.ErrStatementTimeout || errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	return "database"
+}
+
+// revisionLag reports the number of revisions between the current and the
+// compact revision of the database, or -1 if they cannot be read.
+func (s *SQLLog) revisionLag() float64 {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsTimeout)
+	defer cancel()
+	compact, current, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return -1
+	}
+	return float64(current - compact)
+}
@@ -0,0 +1,140 @@
+package sqllog
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// The log keeps the latest current and compact revisions it has seen, from
+// its own writes, from polling and from the queries that return them, so
+// that serializable reads do not have to query them again. Other instances
+// sharing the database may have written since, so they are only lower
+// bounds, and all other reads still query the database, or a replica that has
+// caught up to the latest revision of the database.
+
+// seenRevision raises the cached current revision to rev.
+func (s *SQLLog) seenRevision(rev int64) {
+	raise(&s.currentRev, rev)
+}
+
+// seenCompactRevision raises the cached compact revision to rev.
+func (s *SQLLog) seenCompactRevision(rev int64) {
+	raise(&s.compactRev, rev)
+}
+
+// forgetRevision drops the cached current revision, so that the next read
+// queries it, as after a write failed because of one made elsewhere.
+func (s *SQLLog) forgetRevision() {
+	atomic.StoreInt64(&s.currentRev, 0)
+}
+
+func raise(addr *int64, rev int64) {
+	for {
+		old := atomic.LoadInt64(addr)
+		if rev <= old || atomic.CompareAndSwapInt64(addr, old, rev) {
+			return
+		}
+	}
+}
+
+// cached reports whether reads made with ctx may be answered with the cached
+// revisions, which is only the case for serializable reads outside of
+// transactions.
+func (s *SQLLog) cached(ctx context.Context) bool {
+	return !inTx(ctx) && server.IsSerializableRead(ctx)
+}
+
+// replicaRead marks reads made with ctx at the revision as answerable by a
+// read replica that has caught up to the revision, and counts the read by its
+// consistency. Serializable reads may be answered by any replica, without
+// confirming the latest revision of the database. Linearizable reads at the
+// current revision must not miss writes made elsewhere, so with replicas they
+// query the current revision of the primary, which is cheaper than the read,
+// and are only answered by a replica that has caught up to it. Reads in
+// transactions, and linearizable reads without replicas, are answered by the
+// primary.
+func (s *SQLLog) replicaRead(ctx context.Context, revision int64) (context.Context, error) {
+	if server.IsSerializableRead(ctx) && !inTx(ctx) {
+		s.countRead(serializableRead)
+		return generic.WithReplicaRead(ctx, revision), nil
+	}
+	s.countRead(linearizableRead)
+	if inTx(ctx) || !s.d.HasReplicas() {
+		return ctx, nil
+	}
+	if revision == 0 {
+		rev, err := s.d.CurrentRevision(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.seenRevision(rev)
+		revision = rev
+	}
+	return generic.WithReplicaRead(ctx, revision), nil
+}
+
+// The consistency labels of the reads counted by countRead.
+const (
+	serializableRead = "serializable"
+	linearizableRead = "linearizable"
+)
+
+// countRead counts a read of the consistency, if the metrics of reads are
+// collected.
+func (s *SQLLog) countRead(consistency string) {
+	if s.reads != nil {
+		s.reads.WithLabelValues(consistency).Inc()
+	}
+}
+
+// inTx reports whether ctx carries a transaction started by Txn.
+func inTx(ctx context.Context) bool {
+	_, ok := ctx.Value(txKey{}).(*generic.Tx)
+	return ok
+}
+
+// currentRevision returns the current revision, cached if ctx allows it and
+// queried through d otherwise.
+func (s *SQLLog) currentRevision(ctx context.Context, d txDialect) (int64, error) {
+	if s.cached(ctx) {
+		if rev := atomic.LoadInt64(&s.currentRev); rev > 0 {
+			return rev, nil
+		}
+	}
+
+	rev, err := d.CurrentRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !inTx(ctx) {
+		// revisions seen inside a transaction may still be rolled back
+		s.seenRevision(rev)
+	}
+	return rev, nil
+}
+
+// revisions returns the compact and current revisions, like
+// GetCompactRevision. They are cached if ctx allows it and cachedCompact is
+// set, which it must not be for reads that check whether the revision they
+// are made at was compacted, as the cached compact revision may lag behind
+// compactions made elsewhere.
+func (s *SQLLog) revisions(ctx context.Context, d txDialect, cachedCompact bool) (int64, int64, error) {
+	if cachedCompact && s.cached(ctx) {
+		if rev := atomic.LoadInt64(&s.currentRev); rev > 0 {
+			return atomic.LoadInt64(&s.compactRev), rev, nil
+		}
+	}
+
+	compact, rev, err := d.GetCompactRevision(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !inTx(ctx) {
+		s.seenCompactRevision(compact)
+		s.seenRevision(rev)
+	}
+	return compact, rev, nil
+}
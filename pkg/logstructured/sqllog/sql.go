@@ -3,55 +3,257 @@ package sqllog
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"io"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/Rican7/retry/jitter"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rancher/kine/pkg/broadcaster"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/metrics"
 	"github.com/rancher/kine/pkg/server"
-	"github.com/sirupsen/logrus"
 )
 
 type SQLLog struct {
+	// currentRev and compactRev are the latest revisions seen, accessed
+	// atomically. They come first so that they are aligned on 32-bit
+	// platforms.
+	currentRev int64
+	compactRev int64
+
 	d           Dialect
 	broadcaster broadcaster.Broadcaster
 	ctx         context.Context
 	notify      chan int64
+	// watchers is the number of watches that keep the database polled, and
+	// wake is signalled when the first of them starts.
+	watchers int32
+	wake     chan struct{}
+	// prevKVWatchers is the number of watches that want the previous values
+	// of keys, which the poll only reads while there are any.
+	prevKVWatchers int32
+	// reads counts the reads of keys by their consistency, if metrics are
+	// collected.
+	reads *prometheus.CounterVec
+	// compactMetrics are the metrics of compactions, or nil if metrics are
+	// not collected.
+	compactMetrics *compactMetrics
+	// revisionClock tells the revisions that were current as of the
+	// compactions since the compactor started, for the prefixes whose
+	// history is kept for a duration. It is only used by the compactor.
+	revisionClock *generic.RevisionClock
+	logger        logging.Logger
 }
 
 func New(d Dialect) *SQLLog {
 	l := &SQLLog{
-		d:      d,
-		notify: make(chan int64, 1024),
+		d:             d,
+		notify:        make(chan int64, 1024),
+		wake:          make(chan struct{}, 1),
+		revisionClock: generic.NewRevisionClock(d.GetPrefixRetention()),
+		logger:        d.GetLogger(),
 	}
+	l.broadcaster.BufferSize = d.GetWatchBufferSize()
 	return l
 }
 
+// GetLogger returns the logger of the dialect.
+func (s *SQLLog) GetLogger() logging.Logger {
+	return s.logger
+}
+
 type Dialect interface {
-	ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted bool) (*sql.Rows, error)
-	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (*sql.Rows, error)
-	Count(ctx context.Context, prefix string) (int64, int64, error)
+	ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted, keysOnly bool, filter server.RevisionFilter) (*generic.Rows, error)
+	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted, keysOnly bool, filter server.RevisionFilter) (*generic.Rows, error)
+	Count(ctx context.Context, prefix, startKey string, revision int64, filter server.RevisionFilter) (int64, int64, error)
 	CurrentRevision(ctx context.Context) (int64, error)
-	AfterPrefix(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error)
-	After(ctx context.Context, rev, limit int64) (*sql.Rows, error)
+	AfterPrefix(ctx context.Context, prefix string, rev, limit int64, prevKV bool) (*generic.Rows, error)
+	After(ctx context.Context, rev, limit int64, prevKV bool) (*generic.Rows, error)
 	Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (int64, error)
-	GetRevision(ctx context.Context, revision int64) (*sql.Rows, error)
+	GetRevision(ctx context.Context, revision int64) (*generic.Rows, error)
 	DeleteRevision(ctx context.Context, revision int64) error
 	GetCompactRevision(ctx context.Context) (int64, int64, error)
 	SetCompactRevision(ctx context.Context, revision int64) error
+	MarkRevision(ctx context.Context, revision int64) error
+	RaiseSequence(ctx context.Context) error
+	Compact(ctx context.Context, compactRev, targetRev int64) (int64, error)
+	Trim(ctx context.Context, prefix string, trimRev, targetRev int64) (int64, error)
+	GetTrimRevisions(ctx context.Context) (generic.TrimRevisions, error)
+	RaiseTrimRevisions(ctx context.Context, raise generic.TrimRevisions, compact int64) (generic.TrimRevisions, error)
+	LeaseKeys(ctx context.Context, lease int64) ([]string, error)
+	Version(ctx context.Context, key string, createRevision, modRevision int64) (int64, error)
+	Versions(ctx context.Context, kvs []*server.KeyValue) error
+	History(ctx context.Context, key string, revision int64, values bool) (*generic.Rows, error)
+	Verify(ctx context.Context, repair bool) ([]server.Inconsistency, error)
+	GC(ctx context.Context, dryRun bool) ([]server.Garbage, error)
+	PrefixStats(ctx context.Context) ([]server.PrefixStat, error)
+	RevokeLease(ctx context.Context, lease int64) (int64, error)
+	ListLeases(ctx context.Context) (*generic.Rows, error)
+	InsertLease(ctx context.Context, id, ttl, grantedAt int64) error
+	KeepAliveLease(ctx context.Context, id, keepAlive int64) error
+	DeleteLease(ctx context.Context, id int64) error
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*generic.Tx, error)
+	Retryable(err error) bool
 	Fill(ctx context.Context, revision int64) error
 	IsFill(key string) bool
 	GetSize(ctx context.Context) (int64, error)
+	GetSizeInUse(ctx context.Context) (int64, error)
+	Defragment(ctx context.Context) error
+	Snapshot(ctx context.Context, w io.Writer) error
+	Restore(ctx context.Context, r io.Reader, force bool) error
+	Quiesce(ctx context.Context) error
+	Resume() error
+	Close() error
 	GetCompactInterval() time.Duration
+	GetCompactMinRetain() int64
+	GetCompactGC() bool
+	GetPrefixRetention() []generic.PrefixRetention
 	GetPollInterval() time.Duration
+	GetPollBatchSize() int64
+	GetWatchBufferSize() int
+	GetMetricsRegisterer() prometheus.Registerer
+	GetLogger() logging.Logger
+	HasReplicas() bool
+	Notifications(ctx context.Context) (<-chan int64, error)
+}
+
+// txDialect is the part of the Dialect that is also available inside a
+// transaction.
+type txDialect interface {
+	ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted, keysOnly bool, filter server.RevisionFilter) (*generic.Rows, error)
+	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted, keysOnly bool, filter server.RevisionFilter) (*generic.Rows, error)
+	CurrentRevision(ctx context.Context) (int64, error)
+	GetCompactRevision(ctx context.Context) (int64, int64, error)
+	Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (int64, error)
+	Version(ctx context.Context, key string, createRevision, modRevision int64) (int64, error)
+	Versions(ctx context.Context, kvs []*server.KeyValue) error
+}
+
+// Transactions that the database aborted are tried maxTxnTries times at
+// most, waiting txnRetryBackoff before the first retry and twice as long
+// before each next one, up to maxTxnRetryBackoff.
+const (
+	maxTxnTries        = 10
+	txnRetryBackoff    = 10 * time.Millisecond
+	maxTxnRetryBackoff = time.Second
+)
+
+// The current revision is recorded as served every revisionMarkInterval,
+// on compaction and on close, so that the id sequence is raised past it on
+// start if its rows are gone. Recording it gives up after
+// markRevisionTimeout.
+const (
+	revisionMarkInterval = time.Minute
+	markRevisionTimeout  = 5 * time.Second
+)
+
+type txKey struct{}
+
+// dialect returns the transaction started by Txn if the context carries
+// one, and the dialect otherwise.
+func (s *SQLLog) dialect(ctx context.Context) txDialect {
+	if tx, ok := ctx.Value(txKey{}).(*generic.Tx); ok {
+		return tx
+	}
+	return s.d
+}
+
+// Txn calls fn with a context in which all reads and writes of keys happen
+// in a single database transaction. The transaction is committed if fn
+// returns nil, and rolled back otherwise. Calls to Txn with a context that
+// already carries a transaction reuse that transaction. Transactions that the
+// database aborts to serialize them with others are run again from the start,
+// so fn may be called more than once.
+func (s *SQLLog) Txn(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(*generic.Tx); ok {
+		return fn(ctx)
+	}
+
+	backoff := txnRetryBackoff
+	for try := 1; ; try++ {
+		err := s.txn(ctx, fn)
+		if try == maxTxnTries || !s.d.Retryable(err) {
+			return err
+		}
+
+		s.logger.Debugf("TXN (try: %d) aborted, retrying in %s: %v", try, backoff, err)
+		timer := time.NewTimer(jitter.Deviation(nil, 0.3)(backoff))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > maxTxnRetryBackoff {
+			backoff = maxTxnRetryBackoff
+		}
+	}
+}
+
+func (s *SQLLog) txn(ctx context.Context, fn func(ctx context.Context) error) error {
+	tx, err := s.d.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(context.WithValue(ctx, txKey{}, tx)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// events written in the transaction only become visible now
+	if rev, err := s.d.CurrentRevision(ctx); err == nil {
+		s.seenRevision(rev)
+		select {
+		case s.notify <- rev:
+		default:
+		}
+	}
+	return nil
 }
 
 func (s *SQLLog) Start(ctx context.Context) (err error) {
 	s.ctx = ctx
+	// revisions are handed out from the id sequence, which must not hand out
+	// any that were served before the rows of the log were compacted. The
+	// served revisions are recorded on the compact_rev_key row, so it is
+	// created right away rather than once watches start.
+	if err := s.d.RaiseSequence(ctx); err != nil {
+		return err
+	}
+	if err := s.compactStart(ctx); err != nil {
+		return err
+	}
+	go s.revisionMarker()
+	if registerer := s.d.GetMetricsRegisterer(); registerer != nil {
+		metrics.Register(s.logger, registerer, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "watch",
+			Name:      "queue_depth",
+			Help:      "Number of event batches queued for watches and not yet read by them.",
+		}, func() float64 {
+			return float64(s.broadcaster.QueueDepth())
+		}))
+		s.reads = metrics.Register(s.logger, registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "sql",
+			Name:      "reads_total",
+			Help:      "Number of reads of keys, by whether they were linearizable or serializable reads that may skip confirming the latest revision.",
+		}, []string{"consistency"})).(*prometheus.CounterVec)
+		s.compactMetrics = newCompactMetrics(s.logger, registerer, s.revisionLag)
+	}
 	return
 }
 
 func (s *SQLLog) compactStart(ctx context.Context) error {
-	rows, err := s.d.AfterPrefix(ctx, "compact_rev_key", 0, 0)
+	rows, err := s.d.AfterPrefix(ctx, "compact_rev_key", 0, 0, false)
 	if err != nil {
 		return err
 	}
@@ -96,14 +298,20 @@ func (s *SQLLog) compactStart(ctx context.Context) error {
 	return nil
 }
 
-func (s *SQLLog) compact() {
+// compactor compacts the log every compact interval, until the log is
+// stopped. It warns once compactions have not succeeded for
+// compactStaleIntervals intervals, as the database grows meanwhile.
+func (s *SQLLog) compactor() {
 	var (
 		nextEnd int64
 	)
-	t := time.NewTicker(s.d.GetCompactInterval())
+	interval := s.d.GetCompactInterval()
+	t := time.NewTicker(interval)
+	defer t.Stop()
 	nextEnd, _ = s.d.CurrentRevision(s.ctx)
+	lastSuccess := time.Now()
+	s.revisionClock.Record(lastSuccess, nextEnd)
 
-outer:
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -111,99 +319,137 @@ outer:
 		case <-t.C:
 		}
 
-		currentRev, err := s.d.CurrentRevision(s.ctx)
-		if err != nil {
-			logrus.Errorf("failed to get current revision: %v", err)
-			continue
+		if err := s.compactOnce(&nextEnd); err == nil {
+			lastSuccess = time.Now()
+		} else if since := time.Since(lastSuccess); since >= compactStaleIntervals*interval {
+			s.logger.Warnf("COMPACT has not succeeded for %v, since %s: err=%v", since.Round(time.Second), lastSuccess.Format(time.RFC3339), err)
 		}
+	}
+}
 
-		end := nextEnd
-		nextEnd = currentRev
+// compactOnce compacts up to the revision that was current on the previous
+// run, leaving the configured number of revisions, records the current
+// revision at nextEnd for the next run, and then trims the prefixes that are
+// retained for less. Finding nothing to compact succeeds.
+func (s *SQLLog) compactOnce(nextEnd *int64) error {
+	currentRev, err := s.d.CurrentRevision(s.ctx)
+	if err != nil {
+		s.logger.Errorf("failed to get current revision: %v", err)
+		return err
+	}
 
-		cursor, _, err := s.d.GetCompactRevision(s.ctx)
-		if err != nil {
-			logrus.Errorf("failed to get compact revision: %v", err)
-			continue
+	end := *nextEnd - s.d.GetCompactMinRetain()
+	*nextEnd = currentRev
+
+	_, err = s.Compact(s.ctx, end)
+	switch {
+	case err == nil:
+		if s.d.GetCompactGC() {
+			if _, err := s.GC(s.ctx, false); err != nil {
+				s.logger.Errorf("failed to collect garbage: %v", err)
+			}
 		}
+	case err != server.ErrCompacted:
+		s.logger.Errorf("failed to compact to revision %d: reason=%s, err=%v", end, compactFailure(err), err)
+		return err
+	}
+	return s.trimPrefixes(s.ctx, currentRev)
+}
 
-		// leave the last 1000
-		end = end - 1000
+// revisionMarker records the current revision as served every
+// revisionMarkInterval, until the log is stopped.
+func (s *SQLLog) revisionMarker() {
+	t := time.NewTicker(revisionMarkInterval)
+	defer t.Stop()
 
-		savedCursor := cursor
-		// Purposefully start at the current and redo the current as
-		// it could have failed before actually compacting
-		for ; cursor <= end; cursor++ {
-			rows, err := s.d.GetRevision(s.ctx, cursor)
-			if err != nil {
-				logrus.Errorf("failed to get revision %d: %v", cursor, err)
-				continue outer
-			}
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		}
+		s.markRevision(s.ctx)
+	}
+}
 
-			events, err := RowsToEvents(rows)
-			if err != nil {
-				logrus.Errorf("failed to convert to events: %v", err)
-				continue outer
-			}
+// markRevision records the current revision as served, within
+// markRevisionTimeout. Failures are only logged, as the revision is recorded
+// again later.
+func (s *SQLLog) markRevision(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, markRevisionTimeout)
+	defer cancel()
 
-			if len(events) == 0 {
-				continue
-			}
+	rev, err := s.d.CurrentRevision(ctx)
+	if err == nil {
+		err = s.d.MarkRevision(ctx, rev)
+	}
+	if err != nil {
+		s.logger.Warnf("failed to record the current revision as served: %v", err)
+	}
+}
 
-			event := events[0]
+// Compact removes all rows that were superseded or deleted at or before the
+// given revision, and then records it as the compact revision. It returns the
+// number of rows removed, or server.ErrCompacted or server.ErrFutureRev if the
+// revision is already compacted or has not been written yet. Compactions are
+// recorded by the metrics of compactions, along with the rows they removed
+// before failing.
+func (s *SQLLog) Compact(ctx context.Context, revision int64) (deleted int64, err error) {
+	start := time.Now()
+	defer func() {
+		s.compactMetrics.observe(start, deleted, err)
+	}()
 
-			if event.KV.Key == "compact_rev_key" {
-				// don't compact the compact key
-				continue
-			}
+	compactRev, _, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
 
-			setRev := false
-			if event.PrevKV != nil && event.PrevKV.ModRevision != 0 {
-				if savedCursor != cursor {
-					if err := s.d.SetCompactRevision(s.ctx, cursor); err != nil {
-						logrus.Errorf("failed to record compact revision: %v", err)
-						continue outer
-					}
-					savedCursor = cursor
-					setRev = true
-				}
+	if revision <= compactRev {
+		return 0, server.ErrCompacted
+	}
 
-				if err := s.d.DeleteRevision(s.ctx, event.PrevKV.ModRevision); err != nil {
-					logrus.Errorf("failed to delete revision %d: %v", event.PrevKV.ModRevision, err)
-					continue outer
-				}
-			}
+	currentRev, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
 
-			if event.Delete {
-				if !setRev && savedCursor != cursor {
-					if err := s.d.SetCompactRevision(s.ctx, cursor); err != nil {
-						logrus.Errorf("failed to record compact revision: %v", err)
-						continue outer
-					}
-					savedCursor = cursor
-				}
+	if revision > currentRev {
+		return 0, server.ErrFutureRev
+	}
 
-				if err := s.d.DeleteRevision(s.ctx, cursor); err != nil {
-					logrus.Errorf("failed to delete current revision %d: %v", cursor, err)
-					continue outer
-				}
-			}
-		}
+	// the rows of the current revision may be compacted away, after which
+	// the id sequence of some databases could hand it out again
+	if err := s.d.MarkRevision(ctx, currentRev); err != nil {
+		return 0, err
+	}
 
-		if savedCursor != cursor {
-			if err := s.d.SetCompactRevision(s.ctx, cursor); err != nil {
-				logrus.Errorf("failed to record compact revision: %v", err)
-				continue outer
-			}
-		}
+	deleted, err = s.d.Compact(ctx, compactRev, revision)
+	if err != nil {
+		return deleted, err
+	}
+
+	// only record the new compact revision once all rows up to it are gone, so
+	// that an interrupted compaction is redone from the previous revision
+	if err := s.d.SetCompactRevision(ctx, revision); err != nil {
+		return deleted, err
 	}
+	s.seenCompactRevision(revision)
+
+	s.logger.Infof("COMPACT revision %d => %d, deleted=%d, duration=%v", compactRev, revision, deleted, time.Since(start))
+	return deleted, nil
 }
 
+// CurrentRevision returns the current revision, which serializable reads
+// outside of transactions get from the cache if it holds one.
 func (s *SQLLog) CurrentRevision(ctx context.Context) (int64, error) {
-	return s.d.CurrentRevision(ctx)
+	return s.currentRevision(ctx, s.dialect(ctx))
 }
 
+// After returns the events of the keys with the given prefix after the
+// revision. Their previous values are only read for watches that want them.
 func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
-	rows, err := s.d.AfterPrefix(ctx, prefix, revision, limit)
+	rows, err := s.d.AfterPrefix(ctx, prefix, revision, limit, server.IsPrevKVWatch(ctx))
 	if err != nil {
 		return 0, nil, err
 	}
@@ -213,57 +459,159 @@ func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64
 		return 0, nil, err
 	}
 
-	compact, rev, err := s.d.GetCompactRevision(ctx)
-
+	compact, rev, err := s.revisions(ctx, s.d, false)
 	if err != nil {
 		return 0, nil, err
 	}
+	if revision > 0 {
+		if compact, err = s.trimmedCompactRevision(ctx, prefix, revision, compact); err != nil {
+			return 0, nil, err
+		}
+	}
 
 	if revision > 0 && revision < compact {
-		return rev, result, server.ErrCompacted
+		return compact, nil, server.ErrCompacted
 	}
 
 	return rev, result, err
 }
 
-func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+// AfterBatches is like After, but reads the events in batches of the poll
+// batch size and passes each batch to fn once it is read, so that the events
+// of a long catch-up are never all held at once. It returns the current
+// revision once all events are passed on, or the compact revision along with
+// server.ErrCompacted if the events after a batch were compacted before they
+// were read.
+func (s *SQLLog) AfterBatches(ctx context.Context, prefix string, revision int64, fn func(events []*server.Event) error) (int64, error) {
+	batchSize := s.d.GetPollBatchSize()
+	start := revision
+	for {
+		rows, err := s.d.AfterPrefix(ctx, prefix, start, batchSize, server.IsPrevKVWatch(ctx))
+		if err != nil {
+			return 0, err
+		}
+
+		events, err := rowsToEvents(rows, batchSize)
+		if err != nil {
+			return 0, err
+		}
+
+		compact, rev, err := s.revisions(ctx, s.d, false)
+		if err != nil {
+			return 0, err
+		}
+		if start > 0 {
+			if compact, err = s.trimmedCompactRevision(ctx, prefix, start, compact); err != nil {
+				return 0, err
+			}
+		}
+
+		// the rows of the batch may have been compacted before they were read
+		// once the compaction passes where the batch starts
+		if start > 0 && start < compact {
+			return compact, server.ErrCompacted
+		}
+
+		full := len(events) > 0 && int64(len(events)) >= batchSize
+		if full {
+			start = events[len(events)-1].KV.ModRevision
+		}
+		if prefix == "" {
+			events = withoutCompactRevKey(events, 0)
+		}
+		if len(events) > 0 {
+			if err := fn(events); err != nil {
+				return 0, err
+			}
+		}
+		if !full {
+			return rev, nil
+		}
+	}
+}
+
+func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted, keysOnly bool, filter server.RevisionFilter) (int64, []*server.Event, error) {
 	var (
-		rows *sql.Rows
+		rows *generic.Rows
 		err  error
 	)
 
-	// It's assumed that when there is a start key that that key exists.
-	if strings.HasSuffix(prefix, "/") {
-		// In the situation of a list start the startKey will not exist so set to ""
-		if prefix == startKey {
-			startKey = ""
+	d := s.dialect(ctx)
+	startKey = listStartKey(prefix, startKey)
+	if startKey != "" && revision == 0 {
+		// a continued list is always read at a revision, so that the
+		// start key can be compared against the keys of that revision
+		revision, err = s.currentRevision(ctx, d)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// lists of whole prefixes without a limit can be huge, so the events
+	// are made room for up front from a count of the keys rather than by
+	// growing them as the rows are read
+	readCtx, err := s.replicaRead(ctx, revision)
+	if err != nil {
+		return 0, nil, err
+	}
+	queryLimit := limit
+	if prefix == "" && limit > 0 {
+		// the row of the compact revision may take the place of a key
+		queryLimit++
+	}
+	var capacity int64
+	if limit == 0 && isRange(prefix) && !inTx(ctx) {
+		if _, count, err := s.d.Count(readCtx, prefix, startKey, revision, filter); err == nil {
+			capacity = count
 		}
-	} else {
-		// Also if this isn't a list there is no reason to pass startKey
-		startKey = ""
 	}
 
 	if revision == 0 {
-		rows, err = s.d.ListCurrent(ctx, prefix, limit, includeDeleted)
+		rows, err = d.ListCurrent(readCtx, prefix, queryLimit, includeDeleted, keysOnly, filter)
 	} else {
-		rows, err = s.d.List(ctx, prefix, startKey, limit, revision, includeDeleted)
+		rows, err = d.List(readCtx, prefix, startKey, queryLimit, revision, includeDeleted, keysOnly, filter)
 	}
 	if err != nil {
 		return 0, nil, err
 	}
 
-	result, err := RowsToEvents(rows)
+	result, err := rowsToEvents(rows, capacity)
 	if err != nil {
 		return 0, nil, err
 	}
+	if prefix == "" {
+		result = withoutCompactRevKey(result, limit)
+	}
 
-	compact, rev, err := s.d.GetCompactRevision(ctx)
+	// only lists at the current revision take the cached revisions, as the
+	// others need the compact revision to be up to date
+	compact, rev, err := s.revisions(ctx, d, revision == 0)
 	if err != nil {
 		return 0, nil, err
 	}
+	if revision > 0 && !inTx(ctx) {
+		if compact, err = s.trimmedCompactRevision(ctx, prefix, revision, compact); err != nil {
+			return 0, nil, err
+		}
+	}
 
+	// a list at a revision that was compacted away returns the compact
+	// revision along with the error
 	if revision > 0 && revision < compact {
-		return rev, result, server.ErrCompacted
+		return compact, nil, server.ErrCompacted
+	}
+	if revision > rev {
+		return rev, nil, server.ErrFutureRev
+	}
+	if revision == 0 && !inTx(ctx) {
+		// the cached revision may lag behind the rows written elsewhere,
+		// which the list is never answered at a revision before
+		for _, event := range result {
+			if event.KV.ModRevision > rev {
+				rev = event.KV.ModRevision
+			}
+		}
+		s.seenRevision(rev)
 	}
 
 	select {
@@ -274,54 +622,85 @@ func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revis
 	return rev, result, err
 }
 
-func RowsToEvents(rows *sql.Rows) ([]*server.Event, error) {
-	var result []*server.Event
-	defer rows.Close()
+func (s *SQLLog) Watch(ctx context.Context, prefix string) <-chan server.WatchEvents {
+	res := make(chan server.WatchEvents, s.d.GetWatchBufferSize())
 
-	for rows.Next() {
-		event := &server.Event{}
-		if err := scan(rows, event); err != nil {
-			return nil, err
-		}
-		result = append(result, event)
+	// counted before subscribing, so that the events of every poll made
+	// after the watch starts carry the previous values
+	prevKV := server.IsPrevKVWatch(ctx)
+	if prevKV {
+		atomic.AddInt32(&s.prevKVWatchers, 1)
 	}
-
-	return result, nil
-}
-
-func (s *SQLLog) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
-	res := make(chan []*server.Event, 100)
 	values, err := s.broadcaster.Subscribe(ctx, s.startWatch)
 	if err != nil {
+		if prevKV {
+			atomic.AddInt32(&s.prevKVWatchers, -1)
+		}
 		return nil
 	}
 
-	checkPrefix := strings.HasSuffix(prefix, "/")
+	checkPrefix := isRange(prefix)
+	polled := !server.IsPassiveWatch(ctx)
+	if polled && atomic.AddInt32(&s.watchers, 1) == 1 {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
 
 	go func() {
 		defer close(res)
+		if polled {
+			defer atomic.AddInt32(&s.watchers, -1)
+		}
+		if prevKV {
+			defer atomic.AddInt32(&s.prevKVWatchers, -1)
+		}
 		for i := range values {
-			events, ok := filter(i, checkPrefix, prefix)
-			if ok {
-				res <- events
+			// batches without matching events are passed on as well, as they
+			// still advance the revision of the watch
+			polled := i.(pollBatch)
+			events := filter(polled.events, checkPrefix, prefix)
+			if prevKV && !polled.prevKV {
+				// a poll that was already running when the watch started
+				events.Events = s.withPrevValues(ctx, events.Events)
 			}
+			res <- events
+		}
+
+		// the broadcaster drops subscribers that fall too far behind
+		if ctx.Err() == nil && s.ctx.Err() == nil {
+			s.logger.Warnf("WATCH %s dropped for falling behind", prefix)
+			res <- server.WatchEvents{Err: server.ErrWatchTooSlow}
 		}
 	}()
 
 	return res
 }
 
-func filter(events interface{}, checkPrefix bool, prefix string) ([]*server.Event, bool) {
-	eventList := events.([]*server.Event)
+// pollBatch is a batch of events broadcast by the poll, and whether their
+// previous values were read.
+type pollBatch struct {
+	events []*server.Event
+	prevKV bool
+}
+
+func filter(eventList []*server.Event, checkPrefix bool, prefix string) server.WatchEvents {
 	filteredEventList := make([]*server.Event, 0, len(eventList))
 
 	for _, event := range eventList {
+		if prefix == "" && event.KV.Key == compactRevKey {
+			continue
+		}
 		if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
 			filteredEventList = append(filteredEventList, event)
 		}
 	}
 
-	return filteredEventList, len(filteredEventList) > 0
+	return server.WatchEvents{
+		Revision: eventList[len(eventList)-1].KV.ModRevision,
+		Events:   filteredEventList,
+	}
 }
 
 func (s *SQLLog) startWatch() (chan interface{}, error) {
@@ -337,8 +716,26 @@ func (s *SQLLog) startWatch() (chan interface{}, error) {
 	c := make(chan interface{})
 	// start compaction and polling at the same time to watch starts
 	// at the oldest revision, but compaction doesn't create gaps
-	go s.compact()
+	if s.d.GetCompactInterval() > 0 {
+		go s.compactor()
+	}
 	go s.poll(c, pollStart)
+
+	// notifications only make the poll run sooner, so it still finds rows
+	// that were inserted while they were not delivered
+	notifications, err := s.d.Notifications(s.ctx)
+	if err != nil {
+		s.logger.Warnf("failed to listen for inserts, falling back to polling: %v", err)
+	} else if notifications != nil {
+		go func() {
+			for rev := range notifications {
+				select {
+				case s.notify <- rev:
+				default:
+				}
+			}
+		}()
+	}
 	return c, nil
 }
 
@@ -350,6 +747,7 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 		waitForMore = true
 	)
 
+	batchSize := s.d.GetPollBatchSize()
 	wait := time.NewTicker(s.d.GetPollInterval())
 	defer wait.Stop()
 	defer close(result)
@@ -364,19 +762,31 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 					continue
 				}
 			case <-wait.C:
+				// writes made through this log are still notified, but those
+				// made elsewhere are only looked for while something watches
+				if atomic.LoadInt32(&s.watchers) == 0 {
+					continue
+				}
+			case <-s.wake:
+				// catch up from the last revision seen before pausing
 			}
 		}
 		waitForMore = true
 
-		rows, err := s.d.After(s.ctx, last, 500)
+		// the previous values are read for the whole batch if any watch
+		// wants them, as the events are shared between all watches
+		prevKV := atomic.LoadInt32(&s.prevKVWatchers) > 0
+		rows, err := s.d.After(s.ctx, last, batchSize, prevKV)
 		if err != nil {
-			logrus.Errorf("fail to list latest changes: %v", err)
+			// the database may be unavailable for now, as when it restarts, so
+			// the poll carries on from the same revision once it is back
+			s.logger.Errorf("fail to list latest changes: %v", err)
 			continue
 		}
 
 		events, err := RowsToEvents(rows)
 		if err != nil {
-			logrus.Errorf("fail to convert rows changes: %v", err)
+			s.logger.Errorf("fail to convert rows changes: %v", err)
 			continue
 		}
 
@@ -384,7 +794,8 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 			continue
 		}
 
-		waitForMore = len(events) < 100
+		// a full batch means there are likely more rows to read right away
+		waitForMore = int64(len(events)) < batchSize
 
 		rev := last
 		var (
@@ -400,7 +811,7 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 				if canSkipRevision(next, skip, skipTime) {
 					// This situation should never happen, but we have it here as a fallback just for unknown reasons
 					// we don't want to pause all watches forever
-					logrus.Errorf("GAP %s, revision=%d, delete=%v, next=%d", event.KV.Key, event.KV.ModRevision, event.Delete, next)
+					s.logger.Errorf("GAP %s, revision=%d, delete=%v, next=%d", event.KV.Key, event.KV.ModRevision, event.Delete, next)
 				} else if skip != next {
 					// This is the first time we have encountered this missing revision, so record time start
 					// and trigger a quick retry for simple out of order events
@@ -413,13 +824,13 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 					break
 				} else {
 					if err := s.d.Fill(s.ctx, next); err == nil {
-						logrus.Debugf("FILL, revision=%d, err=%v", next, err)
+						s.logger.Debugf("FILL, revision=%d, err=%v", next, err)
 						select {
 						case s.notify <- next:
 						default:
 						}
 					} else {
-						logrus.Debugf("FILL FAILED, revision=%d, err=%v", next, err)
+						s.logger.Debugf("FILL FAILED, revision=%d, err=%v", next, err)
 					}
 					break
 				}
@@ -433,28 +844,230 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 			saveLast = true
 			rev = event.KV.ModRevision
 			if s.d.IsFill(event.KV.Key) {
-				logrus.Debugf("NOT TRIGGER FILL %s, revision=%d, delete=%v", event.KV.Key, event.KV.ModRevision, event.Delete)
+				s.logger.Debugf("NOT TRIGGER FILL %s, revision=%d, delete=%v", event.KV.Key, event.KV.ModRevision, event.Delete)
 			} else {
 				sequential = append(sequential, event)
-				logrus.Debugf("TRIGGERED %s, revision=%d, delete=%v", event.KV.Key, event.KV.ModRevision, event.Delete)
+				s.logger.Debugf("TRIGGERED %s, revision=%d, delete=%v", event.KV.Key, event.KV.ModRevision, event.Delete)
 			}
 		}
 
 		if saveLast {
 			last = rev
+			s.seenRevision(rev)
 			if len(sequential) > 0 {
-				result <- sequential
+				result <- pollBatch{events: sequential, prevKV: prevKV}
 			}
 		}
 	}
 }
 
+// withPrevValues returns the events with the previous values of their keys,
+// read from the rows they replaced. The events are shared between watches, so
+// they are copied rather than changed. Previous rows that can no longer be
+// read, as when they were compacted, leave the previous values empty.
+func (s *SQLLog) withPrevValues(ctx context.Context, events []*server.Event) []*server.Event {
+	result := make([]*server.Event, 0, len(events))
+	for _, event := range events {
+		if event.PrevKV == nil || event.PrevKV.ModRevision == 0 {
+			result = append(result, event)
+			continue
+		}
+
+		rows, err := s.d.GetRevision(ctx, event.PrevKV.ModRevision)
+		if err != nil {
+			s.logger.Errorf("fail to read previous value of %s at revision %d: %v", event.KV.Key, event.PrevKV.ModRevision, err)
+			result = append(result, event)
+			continue
+		}
+		prev, err := RowsToEvents(rows)
+		if err != nil || len(prev) == 0 {
+			result = append(result, event)
+			continue
+		}
+
+		withPrev := *event
+		prevKV := *event.PrevKV
+		prevKV.Value = prev[0].KV.Value
+		withPrev.PrevKV = &prevKV
+		result = append(result, &withPrev)
+	}
+	return result
+}
+
 func canSkipRevision(rev, skip int64, skipTime time.Time) bool {
 	return rev == skip && time.Now().Sub(skipTime) > time.Second
 }
 
-func (s *SQLLog) Count(ctx context.Context, prefix string) (int64, int64, error) {
-	return s.d.Count(ctx, prefix)
+func (s *SQLLog) Count(ctx context.Context, prefix, startKey string, revision int64, filter server.RevisionFilter) (int64, int64, error) {
+	startKey = listStartKey(prefix, startKey)
+	if startKey != "" && revision == 0 {
+		rev, err := s.currentRevision(ctx, s.d)
+		if err != nil {
+			return 0, 0, err
+		}
+		revision = rev
+	}
+	readCtx, err := s.replicaRead(ctx, revision)
+	if err != nil {
+		return 0, 0, err
+	}
+	rev, count, err := s.d.Count(readCtx, prefix, startKey, revision, filter)
+	if err != nil || prefix != "" || startKey >= compactRevKey {
+		return rev, count, err
+	}
+
+	// counts of the whole keyspace leave out the row of the compact revision
+	_, compactRows, err := s.d.Count(readCtx, compactRevKey, "", revision, filter)
+	if err != nil {
+		return 0, 0, err
+	}
+	return rev, count - compactRows, nil
+}
+
+// compactRevKey is the name of the row that the compact revision is kept on,
+// which is not a key of the keyspace.
+const compactRevKey = "compact_rev_key"
+
+// withoutCompactRevKey returns the events of a list of the whole keyspace
+// without the row of the compact revision, and at most limit of them if it is
+// set.
+func withoutCompactRevKey(events []*server.Event, limit int64) []*server.Event {
+	for i, event := range events {
+		if event.KV.Key == compactRevKey {
+			events = append(events[:i:i], events[i+1:]...)
+			break
+		}
+	}
+	if limit > 0 && int64(len(events)) > limit {
+		events = events[:limit]
+	}
+	return events
+}
+
+// listStartKey returns the key after which a list of the given prefix
+// continues, or "" if it starts at the beginning of the prefix.
+func listStartKey(prefix, startKey string) string {
+	// In the situation of a list start the startKey is the prefix itself,
+	// and if this isn't a list there is no reason to pass startKey
+	if !isRange(prefix) || prefix == startKey {
+		return ""
+	}
+	return startKey
+}
+
+// isRange returns whether the prefix covers a range of keys, rather than a
+// single one: those below it if it ends with a slash, or all of them if it is
+// empty.
+func isRange(prefix string) bool {
+	return prefix == "" || strings.HasSuffix(prefix, "/")
+}
+
+func (s *SQLLog) Version(ctx context.Context, key string, createRevision, modRevision int64) (int64, error) {
+	return s.dialect(ctx).Version(ctx, key, createRevision, modRevision)
+}
+
+// Versions sets the version of each key value at its revision.
+func (s *SQLLog) Versions(ctx context.Context, kvs []*server.KeyValue) error {
+	return s.dialect(ctx).Versions(ctx, kvs)
+}
+
+// History returns the current and compact revisions, and the rows of the key
+// that the table still holds, or only its row at the revision if it is not
+// zero. Gap rows are never rows of a key, so none are returned.
+func (s *SQLLog) History(ctx context.Context, key string, revision int64, values bool) (int64, int64, []*server.KeyRevision, error) {
+	compact, rev, err := s.revisions(ctx, s.d, false)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	rows, err := s.d.History(ctx, key, revision, values)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*server.KeyRevision
+	for rows.Next() {
+		r := &server.KeyRevision{}
+		if err := rows.Scan(&r.Revision, &r.Create, &r.Delete, &r.CreateRevision, &r.PrevRevision, &r.Lease, &r.ValueSize, &r.Value); err != nil {
+			return 0, 0, nil, err
+		}
+		if r.Create {
+			r.CreateRevision = r.Revision
+		}
+		revisions = append(revisions, r)
+	}
+	return rev, compact, revisions, rows.Err()
+}
+
+// Verify checks the rows of the table on the primary.
+func (s *SQLLog) Verify(ctx context.Context, repair bool) ([]server.Inconsistency, error) {
+	return s.d.Verify(ctx, repair)
+}
+
+// GC collects the garbage rows of the table on the primary.
+func (s *SQLLog) GC(ctx context.Context, dryRun bool) ([]server.Garbage, error) {
+	return s.d.GC(ctx, dryRun)
+}
+
+// PrefixStats groups the rows of the table on the primary by their prefix.
+func (s *SQLLog) PrefixStats(ctx context.Context) ([]server.PrefixStat, error) {
+	return s.d.PrefixStats(ctx)
+}
+
+func (s *SQLLog) LeaseKeys(ctx context.Context, lease int64) ([]string, error) {
+	return s.d.LeaseKeys(ctx, lease)
+}
+
+func (s *SQLLog) RevokeLease(ctx context.Context, lease int64) (int64, error) {
+	deleted, err := s.d.RevokeLease(ctx, lease)
+	if err != nil || deleted == 0 {
+		return deleted, err
+	}
+
+	rev, err := s.currentRevision(ctx, s.d)
+	if err != nil {
+		return deleted, err
+	}
+	select {
+	case s.notify <- rev:
+	default:
+	}
+	return deleted, nil
+}
+
+func (s *SQLLog) Leases(ctx context.Context) ([]*server.Lease, error) {
+	rows, err := s.d.ListLeases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var leases []*server.Lease
+	for rows.Next() {
+		var (
+			lease                = &server.Lease{}
+			grantedAt, keepAlive int64
+		)
+		if err := rows.Scan(&lease.ID, &lease.TTL, &grantedAt, &keepAlive); err != nil {
+			return nil, err
+		}
+		lease.GrantedAt = time.Unix(grantedAt, 0)
+		lease.LastKeepAlive = time.Unix(keepAlive, 0)
+		leases = append(leases, lease)
+	}
+	return leases, rows.Err()
+}
+
+func (s *SQLLog) CreateLease(ctx context.Context, lease *server.Lease) error {
+	return s.d.InsertLease(ctx, lease.ID, lease.TTL, lease.GrantedAt.Unix())
+}
+
+func (s *SQLLog) KeepAliveLease(ctx context.Context, id int64, at time.Time) error {
+	return s.d.KeepAliveLease(ctx, id, at.Unix())
+}
+
+func (s *SQLLog) DeleteLease(ctx context.Context, id int64) error {
+	return s.d.DeleteLease(ctx, id)
 }
 
 func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error) {
@@ -466,7 +1079,7 @@ func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error)
 		e.PrevKV = &server.KeyValue{}
 	}
 
-	rev, err := s.d.Insert(ctx, e.KV.Key,
+	rev, err := s.dialect(ctx).Insert(ctx, e.KV.Key,
 		e.Create,
 		e.Delete,
 		e.KV.CreateRevision,
@@ -476,16 +1089,22 @@ func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error)
 		e.PrevKV.Value,
 	)
 	if err != nil {
+		// the write may have failed on one made elsewhere, so the cached
+		// revision is read again
+		s.forgetRevision()
 		return 0, err
 	}
-	select {
-	case s.notify <- rev:
-	default:
+	if !inTx(ctx) {
+		s.seenRevision(rev)
+		select {
+		case s.notify <- rev:
+		default:
+		}
 	}
 	return rev, nil
 }
 
-func scan(rows *sql.Rows, event *server.Event) error {
+func scan(rows *generic.Rows, event *server.Event) error {
 	event.KV = &server.KeyValue{}
 	event.PrevKV = &server.KeyValue{}
 
@@ -515,3 +1134,73 @@ func scan(rows *sql.Rows, event *server.Event) error {
 func (s *SQLLog) DbSize(ctx context.Context) (int64, error) {
 	return s.d.GetSize(ctx)
 }
+
+func (s *SQLLog) DbSizeInUse(ctx context.Context) (int64, error) {
+	return s.d.GetSizeInUse(ctx)
+}
+
+func (s *SQLLog) Defragment(ctx context.Context) error {
+	return s.d.Defragment(ctx)
+}
+
+func (s *SQLLog) Quiesce(ctx context.Context) error {
+	return s.d.Quiesce(ctx)
+}
+
+func (s *SQLLog) Resume() error {
+	return s.d.Resume()
+}
+
+// Close records the current revision as served and closes the database.
+func (s *SQLLog) Close() error {
+	s.markRevision(context.Background())
+	return s.d.Close()
+}
+
+func (s *SQLLog) Snapshot(ctx context.Context, w io.Writer) error {
+	return s.d.Snapshot(ctx, w)
+}
+
+func (s *SQLLog) Restore(ctx context.Context, r io.Reader, force bool) error {
+	return s.d.Restore(ctx, r, force)
+}
+
+func (s *SQLLog) CompactRevision(ctx context.Context) (int64, error) {
+	compact, _, err := s.d.GetCompactRevision(ctx)
+	return compact, err
+}
+
+// RaiseRevision raises the current revision to the given one if it is lower.
+// The revision is marked as served and the id sequence raised past it, and a
+// gap row is written at it so that it is the current revision right away. The
+// revisions up to it are compacted, so that neither watches nor their polls
+// look for the rows of the revisions that were skipped.
+func (s *SQLLog) RaiseRevision(ctx context.Context, revision int64) (int64, error) {
+	if err := s.compactStart(ctx); err != nil {
+		return 0, err
+	}
+	current, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if current >= revision {
+		return current, nil
+	}
+
+	if err := s.d.MarkRevision(ctx, revision); err != nil {
+		return 0, err
+	}
+	if err := s.d.RaiseSequence(ctx); err != nil {
+		return 0, err
+	}
+	if err := s.d.Fill(ctx, revision); err != nil {
+		return 0, fmt.Errorf("failed to fill revision %d: %w", revision, err)
+	}
+	if err := s.d.SetCompactRevision(ctx, revision); err != nil {
+		return 0, err
+	}
+	s.seenRevision(revision)
+	s.seenCompactRevision(revision)
+	s.logger.Infof("Raised the current revision from %d to %d", current, revision)
+	return revision, nil
+}
@@ -0,0 +1,79 @@
+package sqllog
+
+import (
+	"context"
+	"time"
+
+	"github.com/rancher/kine/pkg/drivers/generic"
+)
+
+// trimPrefixes trims the history of the prefixes that are retained for less
+// than the rest of the keyspace, up to the revision that each keeps at the
+// current revision. The trim revisions are raised before the rows are
+// deleted, so that the watches and lists from the revisions being deleted are
+// answered as compacted; the rows that an interrupted trim leaves are deleted
+// by later compactions.
+func (s *SQLLog) trimPrefixes(ctx context.Context, currentRev int64) error {
+	retention := s.d.GetPrefixRetention()
+	if len(retention) == 0 {
+		return nil
+	}
+	now := time.Now()
+	s.revisionClock.Record(now, currentRev)
+
+	compact, _, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		s.logger.Errorf("failed to get compact revision: %v", err)
+		return err
+	}
+	trims, err := s.d.GetTrimRevisions(ctx)
+	if err != nil {
+		s.logger.Errorf("failed to get trim revisions: %v", err)
+		return err
+	}
+
+	raise, from := generic.TrimTargets(retention, trims, compact, currentRev, s.revisionClock, now)
+	if len(raise) == 0 {
+		return nil
+	}
+	if _, err := s.d.RaiseTrimRevisions(ctx, raise, compact); err != nil {
+		s.logger.Errorf("failed to raise trim revisions: %v", err)
+		return err
+	}
+
+	for _, r := range retention {
+		target, ok := raise[r.Prefix]
+		if !ok {
+			continue
+		}
+		start := time.Now()
+		deleted, err := s.d.Trim(ctx, r.Prefix, from[r.Prefix], target)
+		if err != nil {
+			s.logger.Errorf("failed to trim %s to revision %d: reason=%s, err=%v", r.Prefix, target, compactFailure(err), err)
+			return err
+		}
+		s.logger.Infof("COMPACT %s revision %d => %d, deleted=%d, duration=%v", r.Prefix, from[r.Prefix], target, deleted, time.Since(start))
+	}
+	return nil
+}
+
+// trimmedCompactRevision returns the revision up to which the history of the
+// keys with the prefix, or of the key, may be gone for a read from the
+// revision: the compact revision, or the trim revision of a prefix that the
+// keys overlap if it is later. The trim revisions are only read for the keys
+// that overlap the prefixes with a retention.
+func (s *SQLLog) trimmedCompactRevision(ctx context.Context, prefix string, revision, compact int64) (int64, error) {
+	if revision < compact {
+		return compact, nil
+	}
+	for _, r := range s.d.GetPrefixRetention() {
+		if r.Overlaps(prefix) {
+			trims, err := s.d.GetTrimRevisions(ctx)
+			if err != nil {
+				return 0, err
+			}
+			return trims.CompactRevision(prefix, compact), nil
+		}
+	}
+	return compact, nil
+}
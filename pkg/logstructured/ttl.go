@@ -0,0 +1,273 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/rancher/kine/pkg/server"
+)
+
+// ttlScanInterval is how often the TTL manager looks for expired keys. Each
+// scan is delayed by up to half the interval again so that multiple kine
+// instances sharing a database don't all scan at the same moment.
+var ttlScanInterval = time.Second
+
+// ttlLeaseRefreshInterval is how often a TTL scan refreshes the lease registry
+// for keys whose lease it does not know, which may have been granted by
+// another kine that shares the database.
+var ttlLeaseRefreshInterval = 5 * time.Second
+
+// maxTTL is the largest TTL in seconds that fits in a time.Duration.
+const maxTTL = int64(math.MaxInt64 / int64(time.Second))
+
+// ttlKey tracks the latest revision of a key that is attached to a lease,
+// since when it was tracked and whether it was listed rather than written.
+type ttlKey struct {
+	lease       int64
+	modRevision int64
+	since       time.Time
+	listed      bool
+}
+
+// ttlEvent is an event for the TTL manager. Listed events come from the
+// initial list of existing keys rather than from a write that just happened.
+type ttlEvent struct {
+	*server.Event
+	listed bool
+}
+
+// ttlEvents returns the events of the keys with a lease that exist, followed
+// and interleaved by those of the writes since, until ctx is done. The
+// internal watch is dropped like any other that falls behind, which happens
+// while the TTL manager deletes expired keys, so it is started again along
+// with a new list of the keys that exist; the keys deleted while it was down
+// are forgotten as they fail to expire.
+func (l *LogStructured) ttlEvents(ctx context.Context) chan ttlEvent {
+	result := make(chan ttlEvent)
+	go func() {
+		defer close(result)
+		for {
+			err := l.watchTTLEvents(ctx, result)
+			if ctx.Err() != nil {
+				return
+			}
+			l.logger.Warnf("ttl watch stopped, restarting it: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(ttlScanInterval):
+			}
+		}
+	}()
+	return result
+}
+
+// watchTTLEvents sends the events of the keys with a lease that exist and of
+// the writes since to result, until the watch is closed, and returns the
+// error it was closed with. The watch starts before the list, so that no
+// write falls between them.
+func (l *LogStructured) watchTTLEvents(ctx context.Context, result chan<- ttlEvent) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	send := func(event ttlEvent) bool {
+		select {
+		case result <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// all events are passed on, not just those with a lease, so that keys
+	// which are deleted or rewritten without a lease stop being tracked.
+	// The watch is passive so that an idle kine does not keep polling the
+	// database just for the TTL manager.
+	watch := l.log.Watch(server.WithPassiveWatch(ctx), "/")
+	if watch == nil {
+		return errors.New("the watch could not be started")
+	}
+
+	listed := make(chan struct{})
+	go func() {
+		defer close(listed)
+		rev, events, err := l.log.List(ctx, "/", "", 1000, 0, false, true, server.RevisionFilter{})
+		for len(events) > 0 {
+			if err != nil {
+				l.logger.Errorf("failed to read old events for ttl")
+				return
+			}
+
+			for _, event := range events {
+				if event.KV.Lease > 0 && !send(ttlEvent{Event: event, listed: true}) {
+					return
+				}
+			}
+
+			_, events, err = l.log.List(ctx, "/", events[len(events)-1].KV.Key, 1000, rev, false, true, server.RevisionFilter{})
+		}
+	}()
+	defer func() {
+		// the watch is read to its end, so that it does not block on
+		// sending what it still has once it is canceled
+		cancel()
+		for range watch {
+		}
+		<-listed
+	}()
+
+	err := errors.New("the watch was closed")
+	for events := range watch {
+		if events.Err != nil {
+			err = events.Err
+		}
+		for _, event := range events.Events {
+			if !send(ttlEvent{Event: event}) {
+				return ctx.Err()
+			}
+		}
+	}
+	return err
+}
+
+// ttl tracks keys with a lease and deletes them once the lease's TTL has
+// passed since the key was last written, and the lease has not been kept
+// alive past that point.
+func (l *LogStructured) ttl(ctx context.Context) {
+	var (
+		keys   = map[string]*ttlKey{}
+		events = l.ttlEvents(ctx)
+		timer  = time.NewTimer(jitter(ttlScanInterval))
+	)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			l.trackTTL(keys, event)
+		case <-timer.C:
+			l.expireTTL(ctx, keys)
+			timer.Reset(jitter(ttlScanInterval))
+		}
+	}
+}
+
+// trackTTL records the key in the event. Events older than the tracked
+// revision are ignored, as the initial list and the watch may deliver events
+// for the same key out of order.
+func (l *LogStructured) trackTTL(keys map[string]*ttlKey, event ttlEvent) {
+	key := event.KV.Key
+	if tracked, ok := keys[key]; ok && tracked.modRevision >= event.KV.ModRevision {
+		return
+	}
+
+	if event.Delete || event.KV.Lease <= 0 {
+		delete(keys, key)
+		return
+	}
+
+	keys[key] = &ttlKey{
+		lease:       event.KV.Lease,
+		modRevision: event.KV.ModRevision,
+		since:       time.Now(),
+		listed:      event.listed,
+	}
+}
+
+// ttlKeyDeadline returns the deadline of the tracked key, a TTL of its lease
+// after it was written. For keys that were listed rather than written, the
+// time of the last write is not known, so they expire with their lease if it
+// is known, or a full TTL after they were listed if not. The lease is looked
+// up at every scan rather than once the key is tracked, as leases granted by
+// other kine that share the database are only known once the registry is
+// refreshed.
+func (l *LogStructured) ttlKeyDeadline(tracked *ttlKey) time.Time {
+	lease, ok := l.getLease(tracked.lease)
+	if ok && tracked.listed {
+		return lease.deadline
+	}
+	return ttlDeadline(tracked.since, l.leaseTTL(tracked.lease))
+}
+
+// expireTTL refreshes the lease registry if it is due, deletes all keys whose
+// deadline has passed, unless their lease is still being kept alive, and then
+// forgets expired leases. The delete is
+// conditional on the revision that was tracked, so a key that was written
+// again since it was last seen is left in place; the event for the new
+// revision will start tracking it again.
+func (l *LogStructured) expireTTL(ctx context.Context, keys map[string]*ttlKey) {
+	now := time.Now()
+	if l.leaseRefreshDue(now, keys) {
+		if err := l.loadLeases(ctx); err != nil {
+			l.logger.Errorf("failed to refresh the leases for ttl: %v", err)
+		}
+	}
+
+	inUse := map[int64]bool{}
+	for key, tracked := range keys {
+		if now.Before(l.ttlKeyDeadline(tracked)) {
+			inUse[tracked.lease] = true
+			continue
+		}
+		if lease, ok := l.getLease(tracked.lease); ok && now.Before(lease.deadline) {
+			continue
+		}
+
+		_, kv, deleted, err := l.Delete(ctx, key, tracked.modRevision)
+		if err != nil {
+			l.logger.Errorf("failed to expire key %s with lease %d: %v", key, tracked.lease, err)
+			inUse[tracked.lease] = true
+			continue
+		}
+		if deleted || kv == nil || kv.ModRevision != tracked.modRevision {
+			delete(keys, key)
+		}
+	}
+
+	l.expireLeases(ctx, now, inUse)
+}
+
+// leaseRefreshDue reports whether a TTL scan refreshes the lease registry
+// first: once a tracked key or a lease of the registry has passed its
+// deadline, as another kine that shares the database may have kept the lease
+// alive, or every ttlLeaseRefreshInterval while keys of leases the registry
+// does not know are tracked.
+func (l *LogStructured) leaseRefreshDue(now time.Time, keys map[string]*ttlKey) bool {
+	l.leasesLock.Lock()
+	stale := now.Sub(l.leasesLoaded) >= ttlLeaseRefreshInterval
+	for _, lease := range l.leases {
+		if now.After(lease.deadline) {
+			l.leasesLock.Unlock()
+			return true
+		}
+	}
+	l.leasesLock.Unlock()
+
+	for _, tracked := range keys {
+		if !now.Before(l.ttlKeyDeadline(tracked)) {
+			return true
+		}
+		if _, ok := l.getLease(tracked.lease); !ok && stale {
+			return true
+		}
+	}
+	return false
+}
+
+func ttlDeadline(now time.Time, ttl int64) time.Time {
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return now.Add(time.Duration(ttl) * time.Second)
+}
+
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/logging"
+)
+
+// Namespace is the namespace of the metrics of kine.
+const Namespace = "kine"
+
+// Register registers the collector and returns it. As a registerer may be
+// shared by the kine instances of a process, if a collector of the same
+// metrics was registered before, that one is returned instead. Collectors
+// that fail to register are logged to the logger.
+func Register(logger logging.Logger, registerer prometheus.Registerer, collector prometheus.Collector) prometheus.Collector {
+	if err := registerer.Register(collector); err != nil {
+		var exists prometheus.AlreadyRegisteredError
+		if errors.As(err, &exists) {
+			return exists.ExistingCollector
+		}
+		logger.Errorf("Failed to register metrics: %v", err)
+	}
+	return collector
+}
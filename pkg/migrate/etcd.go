@@ -0,0 +1,364 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/server/v3/lease/leasepb"
+)
+
+// The buckets of the bbolt database of etcd that snapshots hold. The key
+// bucket holds the history of the keys under their revisions, which are the
+// main and the sub revision, big endian and separated by an underscore, and
+// are followed by a t for the tombstones of deleted keys. The lease bucket
+// holds the leases under their IDs.
+var (
+	etcdKeyBucket   = []byte("key")
+	etcdMetaBucket  = []byte("meta")
+	etcdLeaseBucket = []byte("lease")
+
+	etcdConsistentIndexKey    = []byte("consistent_index")
+	etcdFinishedCompactRevKey = []byte("finishedCompactRev")
+)
+
+const (
+	etcdRevisionSize = 17
+	etcdTombstone    = 't'
+)
+
+// ImportConfig is the config of an import of an etcd snapshot.
+type ImportConfig struct {
+	// Snapshot is the path of the snapshot, as etcdctl snapshot save writes
+	// it.
+	Snapshot string
+	// Destination is the config of the empty database that the keys are
+	// imported into.
+	Destination endpoint.Config
+	// Prefix restricts the import to the keys that start with it. All keys
+	// are imported if it is empty.
+	Prefix string
+	// BatchSize and Logger are as in Config.
+	BatchSize int64
+	Logger    logging.Logger
+}
+
+// Import imports the current keys of an etcd snapshot into the destination,
+// which must not hold any keys other than the one kine creates on start.
+// The snapshot is opened read-only, once its checksum is verified if it has
+// one, and must record the consistent index of the etcd member it was taken
+// from. The revisions of the destination are raised above that of the
+// snapshot, and the leases of the keys are granted anew with their TTLs.
+// Lease IDs above the 32 bits that some of the schemas of kine store are
+// replaced with new ones, and keys whose lease the snapshot does not hold are
+// imported without one. The revision of the result is that of the snapshot.
+func Import(ctx context.Context, config ImportConfig) (Result, error) {
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+	snapshot, err := openETCDSnapshot(config.Snapshot)
+	if err != nil {
+		return Result{}, err
+	}
+	defer snapshot.db.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dst, err := endpoint.StartPassiveBackend(ctx, config.Destination)
+	if err != nil {
+		return Result{}, errors.Wrap(err, "opening destination")
+	}
+	defer dst.Close()
+
+	m := &migration{
+		config:  Config{BatchSize: config.BatchSize, Logger: config.Logger},
+		dst:     dst,
+		logger:  logging.OrDefault(config.Logger),
+		granted: map[int64]bool{},
+	}
+	return m.importSnapshot(ctx, snapshot, config.Prefix)
+}
+
+// etcdSnapshot is an etcd snapshot opened read-only.
+type etcdSnapshot struct {
+	db              *bbolt.DB
+	consistentIndex uint64
+	revision        int64
+}
+
+// openETCDSnapshot opens the snapshot at path, once it has checked that it
+// is one.
+func openETCDSnapshot(path string) (_ *etcdSnapshot, err error) {
+	if err := verifySnapshotHash(path); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(path, 0400, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening etcd snapshot %s", path)
+	}
+	defer func() {
+		if err != nil {
+			db.Close()
+		}
+	}()
+
+	snapshot := &etcdSnapshot{db: db}
+	err = db.View(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket(etcdMetaBucket)
+		keys := tx.Bucket(etcdKeyBucket)
+		if meta == nil || keys == nil {
+			return fmt.Errorf("not an etcd snapshot, it has no key or meta bucket")
+		}
+		if index := meta.Get(etcdConsistentIndexKey); len(index) == 8 {
+			snapshot.consistentIndex = binary.BigEndian.Uint64(index)
+		}
+		if snapshot.consistentIndex == 0 {
+			return fmt.Errorf("etcd snapshot has no consistent index")
+		}
+
+		if k, _ := keys.Cursor().Last(); k != nil {
+			if len(k) < etcdRevisionSize {
+				return fmt.Errorf("etcd snapshot has a key of an invalid revision %x", k)
+			}
+			snapshot.revision = etcdMainRevision(k)
+		}
+		if compact := meta.Get(etcdFinishedCompactRevKey); len(compact) >= 8 {
+			snapshot.revision = highestRevision(snapshot.revision, etcdMainRevision(compact))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// verifySnapshotHash verifies the sha256 checksum that etcdctl appends to the
+// database in its snapshots, which are otherwise a whole number of pages.
+// Snapshots without one, such as copies of the database of a member, are
+// taken as they are.
+func verifySnapshotHash(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size%512 != sha256.Size {
+		return nil
+	}
+
+	h := sha256.New()
+	if _, err := io.CopyN(h, f, size-sha256.Size); err != nil {
+		return err
+	}
+	sum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(f, sum); err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, h.Sum(nil)) {
+		return fmt.Errorf("etcd snapshot checksum mismatch, it is truncated or corrupt")
+	}
+	return nil
+}
+
+// etcdMainRevision returns the main revision of a revision of etcd.
+func etcdMainRevision(rev []byte) int64 {
+	return int64(binary.BigEndian.Uint64(rev[:8]))
+}
+
+// etcdKey is the current revision of a key of the snapshot, and its lease.
+type etcdKey struct {
+	revision []byte
+	lease    int64
+}
+
+func (m *migration) importSnapshot(ctx context.Context, snapshot *etcdSnapshot, prefix string) (Result, error) {
+	if err := m.checkEmpty(ctx); err != nil {
+		return m.result, err
+	}
+	m.result.Revision = snapshot.revision
+	if _, err := m.dst.RaiseRevision(ctx, snapshot.revision); err != nil {
+		return m.result, errors.Wrapf(err, "raising the revision of the destination to %d", snapshot.revision)
+	}
+	m.logger.Infof("Importing etcd snapshot at revision %d, with consistent index %d", snapshot.revision, snapshot.consistentIndex)
+
+	err := snapshot.db.View(func(tx *bbolt.Tx) error {
+		current, err := currentETCDKeys(tx, prefix)
+		if err != nil {
+			return err
+		}
+		leases, err := m.grantETCDLeases(ctx, tx, current)
+		if err != nil {
+			return err
+		}
+		return m.importETCDKeys(ctx, tx, current, leases)
+	})
+	if err != nil {
+		return m.result, err
+	}
+
+	m.result.DestinationRevision, err = m.dst.RaiseRevision(ctx, snapshot.revision+1)
+	if err != nil {
+		return m.result, errors.Wrapf(err, "raising the revision of the destination to %d", snapshot.revision+1)
+	}
+	m.logger.Infof("Imported %d keys with %d leases of the etcd snapshot at revision %d; the current revision of the destination is %d",
+		m.result.Keys, m.result.Leases, snapshot.revision, m.result.DestinationRevision)
+	return m.result, nil
+}
+
+// currentETCDKeys returns the current revisions of the keys of the snapshot
+// with the prefix, by their names.
+func currentETCDKeys(tx *bbolt.Tx, prefix string) (map[string]etcdKey, error) {
+	current := map[string]etcdKey{}
+	err := tx.Bucket(etcdKeyBucket).ForEach(func(k, v []byte) error {
+		if len(k) < etcdRevisionSize {
+			return fmt.Errorf("etcd snapshot has a key of an invalid revision %x", k)
+		}
+		var kv mvccpb.KeyValue
+		if err := kv.Unmarshal(v); err != nil {
+			return errors.Wrapf(err, "decoding key at revision %d", etcdMainRevision(k))
+		}
+		name := string(kv.Key)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		if len(k) > etcdRevisionSize && k[etcdRevisionSize] == etcdTombstone {
+			delete(current, name)
+			return nil
+		}
+		current[name] = etcdKey{revision: k, lease: kv.Lease}
+		return nil
+	})
+	return current, err
+}
+
+// grantETCDLeases grants the leases of the snapshot that the keys are
+// attached to, and returns the IDs they were granted with in the
+// destination, by their IDs in the snapshot.
+func (m *migration) grantETCDLeases(ctx context.Context, tx *bbolt.Tx, current map[string]etcdKey) (map[int64]int64, error) {
+	inUse := map[int64]bool{}
+	for _, key := range current {
+		if key.lease != 0 {
+			inUse[key.lease] = true
+		}
+	}
+
+	granted := map[int64]int64{}
+	bucket := tx.Bucket(etcdLeaseBucket)
+	if bucket == nil {
+		return granted, nil
+	}
+	err := bucket.ForEach(func(k, v []byte) error {
+		var lease leasepb.Lease
+		if err := lease.Unmarshal(v); err != nil {
+			return errors.Wrapf(err, "decoding lease %x", k)
+		}
+		if !inUse[lease.ID] {
+			return nil
+		}
+		id := lease.ID
+		if id > math.MaxInt32 {
+			id = 0
+		}
+		id, err := m.dst.LeaseGrant(ctx, id, lease.TTL)
+		if err != nil {
+			return errors.Wrapf(err, "granting lease %d", lease.ID)
+		}
+		granted[lease.ID] = id
+		m.granted[id] = true
+		m.result.Leases++
+		return nil
+	})
+	return granted, err
+}
+
+// importETCDKeys writes the current keys of the snapshot to the destination
+// in batches, with the leases they were granted.
+func (m *migration) importETCDKeys(ctx context.Context, tx *bbolt.Tx, current map[string]etcdKey, leases map[int64]int64) error {
+	var (
+		events       []*server.Event
+		withoutLease int64
+		lastProgress = time.Now()
+	)
+	flush := func() error {
+		if err := m.apply(ctx, events); err != nil {
+			return err
+		}
+		m.result.Keys += int64(len(events))
+		events = events[:0]
+		if time.Since(lastProgress) >= progressInterval {
+			m.logger.Infof("Imported %d of %d keys", m.result.Keys, len(current))
+			lastProgress = time.Now()
+		}
+		return nil
+	}
+
+	err := tx.Bucket(etcdKeyBucket).ForEach(func(k, v []byte) error {
+		var kv mvccpb.KeyValue
+		if err := kv.Unmarshal(v); err != nil {
+			return errors.Wrapf(err, "decoding key at revision %d", etcdMainRevision(k))
+		}
+		key, ok := current[string(kv.Key)]
+		if !ok || !bytes.Equal(key.revision, k) {
+			return nil
+		}
+
+		lease, ok := leases[kv.Lease]
+		if kv.Lease != 0 && !ok {
+			withoutLease++
+		}
+		events = append(events, &server.Event{
+			Create: true,
+			KV: &server.KeyValue{
+				Key:   string(kv.Key),
+				Value: kv.Value,
+				Lease: lease,
+			},
+		})
+		if int64(len(events)) < m.config.BatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	if len(events) > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	if withoutLease > 0 {
+		m.logger.Warnf("Imported %d keys without their leases, which the etcd snapshot does not hold", withoutLease)
+	}
+	return nil
+}
+
+// highestRevision returns the highest of the revisions.
+func highestRevision(revisions ...int64) int64 {
+	var highest int64
+	for _, rev := range revisions {
+		if rev > highest {
+			highest = rev
+		}
+	}
+	return highest
+}
@@ -0,0 +1,360 @@
+// Package migrate copies the keys of one kine storage endpoint into another,
+// such as from sqlite into Postgres or MySQL and back, while the source is
+// served, by connecting to both databases directly rather than to kine.
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// DefaultBatchSize is the number of keys copied together unless the config
+// sets another.
+const DefaultBatchSize = 100
+
+// Progress is logged every progressInterval while keys are copied and writes
+// replayed.
+const progressInterval = 10 * time.Second
+
+// healthKey is the key that kine creates on start, which the destination may
+// hold before the migration.
+const healthKey = "/registry/health"
+
+// Config is the config of a migration.
+type Config struct {
+	// Source is the config of the database that the keys are copied from,
+	// and Destination that of the empty database they are copied into. Only
+	// their storage endpoints and the settings of their databases are used;
+	// the compression of values is that of the destination.
+	Source      endpoint.Config
+	Destination endpoint.Config
+	// BatchSize is the number of keys that are read from the source and
+	// written to the destination together, DefaultBatchSize if zero. The
+	// values of a batch are held in memory at once, so it is best kept small
+	// for keys with large values.
+	BatchSize int64
+	// Follow replays the writes made to the source once its keys are copied,
+	// until none is made for as long as Follow, as once the kine serving the
+	// source is stopped or switched to read-only mode. Writes are not
+	// replayed if it is zero.
+	Follow time.Duration
+	// Logger is the logger that the progress is logged to. The standard
+	// logger of logrus is used if it is nil.
+	Logger logging.Logger
+}
+
+// Result reports what a migration copied.
+type Result struct {
+	// Revision is the revision of the source as of which the destination
+	// holds its keys.
+	Revision int64
+	// DestinationRevision is the current revision of the destination once
+	// the migration is done, which is above every revision of the source.
+	DestinationRevision int64
+	// Keys is the number of keys copied at the revision the copy was pinned
+	// to, and Events the number of writes replayed after it.
+	Keys   int64
+	Events int64
+	// Leases is the number of leases granted in the destination.
+	Leases int64
+}
+
+// Migrate copies the keys of the source into the destination, which must not
+// hold any keys other than the one kine creates on start. The keys are read
+// in batches at the current revision of the source, so that the copy is
+// consistent as of that revision while the source is still written to, and
+// the writes made after it are replayed if the config follows them. The
+// revisions of the destination are raised above those of the source, so
+// that clients that switch over never see a revision go back, and the
+// revisions up to them are compacted in the destination, which holds none of
+// their history. The leases of the keys are granted anew in the destination
+// with the same IDs and TTLs, so that the keys live at least a TTL more.
+func Migrate(ctx context.Context, config Config) (Result, error) {
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+
+	// the backends are started for the watch of the source, but they only
+	// read and write as the migration does, until ctx is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	src, err := endpoint.StartPassiveBackend(ctx, config.Source)
+	if err != nil {
+		return Result{}, errors.Wrap(err, "opening source")
+	}
+	defer src.Close()
+	dst, err := endpoint.StartPassiveBackend(ctx, config.Destination)
+	if err != nil {
+		return Result{}, errors.Wrap(err, "opening destination")
+	}
+	defer dst.Close()
+
+	m := &migration{
+		config:  config,
+		src:     src,
+		dst:     dst,
+		logger:  logging.OrDefault(config.Logger),
+		granted: map[int64]bool{},
+	}
+	return m.run(ctx)
+}
+
+// migration is the state of a migration while it runs.
+type migration struct {
+	config   Config
+	src, dst server.Backend
+	logger   logging.Logger
+
+	// leases are the leases of the source, by ID, and granted the IDs of
+	// those that the keys were copied with so far
+	leases  map[int64]*server.Lease
+	granted map[int64]bool
+	result  Result
+}
+
+func (m *migration) run(ctx context.Context) (Result, error) {
+	if err := m.checkEmpty(ctx); err != nil {
+		return m.result, err
+	}
+
+	revision, err := m.src.CurrentRevision(ctx)
+	if err != nil {
+		return m.result, errors.Wrap(err, "reading the current revision of the source")
+	}
+	m.result.Revision = revision
+	if _, err := m.dst.RaiseRevision(ctx, revision); err != nil {
+		return m.result, errors.Wrapf(err, "raising the revision of the destination to %d", revision)
+	}
+	if err := m.loadLeases(ctx); err != nil {
+		return m.result, err
+	}
+
+	if err := m.copyKeys(ctx, revision); err != nil {
+		return m.result, err
+	}
+	if m.config.Follow > 0 {
+		if err := m.follow(ctx); err != nil {
+			return m.result, err
+		}
+	}
+
+	// the source may have been written to since the last write replayed,
+	// and those revisions must not be handed out again either
+	current, err := m.src.CurrentRevision(ctx)
+	if err != nil {
+		return m.result, errors.Wrap(err, "reading the current revision of the source")
+	}
+	if current < m.result.Revision {
+		current = m.result.Revision
+	}
+	m.result.DestinationRevision, err = m.dst.RaiseRevision(ctx, current+1)
+	if err != nil {
+		return m.result, errors.Wrapf(err, "raising the revision of the destination to %d", current+1)
+	}
+
+	m.logger.Infof("Migrated %d keys at revision %d and %d writes after it, with %d leases; the current revision of the destination is %d",
+		m.result.Keys, revision, m.result.Events, m.result.Leases, m.result.DestinationRevision)
+	return m.result, nil
+}
+
+// checkEmpty returns an error if the destination holds keys other than the
+// one kine creates on start.
+func (m *migration) checkEmpty(ctx context.Context) error {
+	_, kvs, err := m.dst.List(ctx, "/", "", 2, 0, true, server.RevisionFilter{})
+	if err != nil {
+		return errors.Wrap(err, "listing keys of the destination")
+	}
+	for _, kv := range kvs {
+		if kv.Key != healthKey {
+			return fmt.Errorf("destination holds key %s already, keys are only migrated into empty databases", kv.Key)
+		}
+	}
+	return nil
+}
+
+// copyKeys copies the keys of the source at the revision, in batches.
+func (m *migration) copyKeys(ctx context.Context, revision int64) error {
+	_, total, err := m.src.Count(ctx, "/", "", revision, server.RevisionFilter{})
+	if err != nil {
+		return errors.Wrap(err, "counting keys of the source")
+	}
+	m.logger.Infof("Copying %d keys at revision %d of the source", total, revision)
+
+	lastProgress := time.Now()
+	startKey := ""
+	for {
+		_, kvs, err := m.src.List(ctx, "/", startKey, m.config.BatchSize, revision, false, server.RevisionFilter{})
+		if err != nil {
+			return errors.Wrapf(err, "listing keys of the source after %q at revision %d", startKey, revision)
+		}
+		if len(kvs) == 0 {
+			return nil
+		}
+
+		events := make([]*server.Event, 0, len(kvs))
+		for _, kv := range kvs {
+			events = append(events, &server.Event{Create: true, KV: kv})
+		}
+		if err := m.apply(ctx, events); err != nil {
+			return err
+		}
+		m.result.Keys += int64(len(kvs))
+
+		if time.Since(lastProgress) >= progressInterval {
+			m.logger.Infof("Copied %d of %d keys at revision %d of the source", m.result.Keys, total, revision)
+			lastProgress = time.Now()
+		}
+		if int64(len(kvs)) < m.config.BatchSize {
+			return nil
+		}
+		startKey = kvs[len(kvs)-1].Key
+	}
+}
+
+// follow replays the writes made to the source after the revision of the
+// copy, until none is made for as long as the config follows them.
+func (m *migration) follow(ctx context.Context) error {
+	m.logger.Infof("Replaying writes to the source after revision %d, until none is made for %v", m.result.Revision, m.config.Follow)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events := m.src.Watch(ctx, "/", m.result.Revision+1)
+	idle := time.NewTimer(m.config.Follow)
+	defer idle.Stop()
+	progress := time.NewTicker(progressInterval)
+	defer progress.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-idle.C:
+			// a watch of a source that is no longer written to catches up
+			// within a poll, so the revision it saw is that of the source
+			m.logger.Infof("Caught up with the source at revision %d", m.result.Revision)
+			return nil
+		case <-progress.C:
+			if current, err := m.src.CurrentRevision(ctx); err == nil {
+				m.logger.Infof("Replayed %d writes, up to revision %d of the source, %d revisions behind", m.result.Events, m.result.Revision, current-m.result.Revision)
+			}
+		case batch, ok := <-events:
+			if !ok {
+				return fmt.Errorf("watch of the source stopped at revision %d", m.result.Revision)
+			}
+			if batch.CompactRevision > 0 {
+				return fmt.Errorf("source was compacted past revision %d before its writes were replayed", m.result.Revision)
+			}
+			if batch.Err != nil {
+				return errors.Wrapf(batch.Err, "watching the source after revision %d", m.result.Revision)
+			}
+			if len(batch.Events) > 0 {
+				if err := m.apply(ctx, batch.Events); err != nil {
+					return err
+				}
+				m.result.Events += int64(len(batch.Events))
+				if !idle.Stop() {
+					<-idle.C
+				}
+				idle.Reset(m.config.Follow)
+			}
+			if batch.Revision > m.result.Revision {
+				m.result.Revision = batch.Revision
+			}
+		}
+	}
+}
+
+// apply writes the events to the destination in a single transaction, once
+// the leases of their keys are granted.
+func (m *migration) apply(ctx context.Context, events []*server.Event) error {
+	for _, event := range events {
+		if !event.Delete && event.KV.Lease > 0 {
+			if err := m.grant(ctx, event.KV.Lease); err != nil {
+				return err
+			}
+		}
+	}
+
+	err := m.dst.Txn(ctx, func(ctx context.Context) error {
+		for _, event := range events {
+			if event.Delete {
+				if _, _, _, err := m.dst.Delete(ctx, event.KV.Key, 0); err != nil {
+					return errors.Wrapf(err, "deleting %s", event.KV.Key)
+				}
+				continue
+			}
+			if err := m.put(ctx, event.KV); err != nil {
+				return errors.Wrapf(err, "writing %s", event.KV.Key)
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "writing to the destination")
+}
+
+// put creates the key in the destination, or updates it if it exists, as the
+// key kine creates on start does.
+func (m *migration) put(ctx context.Context, kv *server.KeyValue) error {
+	_, err := m.dst.Create(ctx, kv.Key, kv.Value, kv.Lease)
+	if err != server.ErrKeyExists {
+		return err
+	}
+	_, existing, err := m.dst.Get(ctx, kv.Key, "", 1, 0)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return fmt.Errorf("key vanished while it was updated")
+	}
+	_, _, ok, err := m.dst.Update(ctx, kv.Key, kv.Value, existing.ModRevision, kv.Lease)
+	if err == nil && !ok {
+		err = fmt.Errorf("key was written elsewhere while it was updated")
+	}
+	return err
+}
+
+// loadLeases reads the leases of the source.
+func (m *migration) loadLeases(ctx context.Context) error {
+	leases, err := m.src.Leases(ctx)
+	if err != nil {
+		return errors.Wrap(err, "listing leases of the source")
+	}
+	m.leases = make(map[int64]*server.Lease, len(leases))
+	for _, lease := range leases {
+		m.leases[lease.ID] = lease
+	}
+	return nil
+}
+
+// grant grants the lease in the destination with the TTL it has in the
+// source, unless it was granted already. Leases that the source does not
+// hold are not granted, but the keys keep their IDs, which kine takes as
+// their TTLs as it does in the source.
+func (m *migration) grant(ctx context.Context, id int64) error {
+	if m.granted[id] {
+		return nil
+	}
+	lease, ok := m.leases[id]
+	if !ok {
+		// the lease may have been granted since the leases were read
+		if err := m.loadLeases(ctx); err != nil {
+			return err
+		}
+		lease, ok = m.leases[id]
+	}
+	m.granted[id] = true
+	if !ok {
+		return nil
+	}
+	if _, err := m.dst.LeaseGrant(ctx, id, lease.TTL); err != nil && err != server.ErrLeaseExist {
+		return errors.Wrapf(err, "granting lease %d", id)
+	}
+	m.result.Leases++
+	return nil
+}
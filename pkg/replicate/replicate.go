@@ -0,0 +1,431 @@
+// Package replicate replicates the writes of a kine storage endpoint to an
+// etcd-compatible endpoint, such as a kine in another site that stands by to
+// take over, continuously and from where it left off when it is restarted.
+// The database of the source is read directly rather than through kine.
+package replicate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/server"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// DefaultBatchSize is the number of keys read together when the target is
+// resynced, unless the config sets another.
+const DefaultBatchSize = 100
+
+// DefaultCheckpointKey is the key of the source that the checkpoint is kept
+// at, unless the config sets another.
+const DefaultCheckpointKey = "/kine/replication/checkpoint"
+
+// DefaultCheckpointInterval is the interval at which the checkpoint is
+// written, unless the config sets another.
+const DefaultCheckpointInterval = 5 * time.Second
+
+// Progress is logged every progressInterval while writes are replicated, and
+// failed writes to the target are tried again after retryInterval.
+const (
+	progressInterval = time.Minute
+	retryInterval    = time.Second
+)
+
+// writeAttempts is the number of times a key is written to the target when
+// it is written there concurrently, before the replication fails.
+const writeAttempts = 5
+
+// Config is the config of a replication.
+type Config struct {
+	// Source is the config of the database that the writes are replicated
+	// from. Only its storage endpoint and the settings of its database are
+	// used.
+	Source endpoint.Config
+	// Target is the etcd-compatible endpoint that the writes are replicated
+	// to.
+	Target endpoint.ETCDConfig
+	// CheckpointKey is the key of the source that the revision replicated up
+	// to is kept at, DefaultCheckpointKey if empty. It is not replicated
+	// itself. Replications of one source to several targets need keys of
+	// their own.
+	CheckpointKey string
+	// CheckpointInterval is the interval at which the checkpoint is written
+	// while writes are replicated, DefaultCheckpointInterval if zero. A
+	// replication that is restarted replays the writes since the last
+	// checkpoint, which are written to the target idempotently.
+	CheckpointInterval time.Duration
+	// BatchSize is the number of keys that are read together from the source
+	// and the target when the target is resynced, DefaultBatchSize if zero.
+	BatchSize int64
+	// Logger is the logger that the progress is logged to. The standard
+	// logger of logrus is used if it is nil.
+	Logger logging.Logger
+}
+
+// Replicate replicates the keys under / of the source to the target until
+// ctx is done, when it returns its error, or until the replication fails.
+// It watches the source from the revision of its checkpoint on, and writes
+// every event to the target: puts if the key does not yet hold the value, and
+// deletes if the key exists, each in a transaction that compares the mod
+// revision of the key that it read, so that replaying an event is harmless.
+// Keys are written without their leases, as the deletes of the keys whose
+// leases expire in the source are replicated as well.
+//
+// The target is resynced in full when there is no checkpoint yet, or when
+// the source was compacted past it: the keys of the source are copied at its
+// current revision, and the keys of the target that the source does not hold
+// are deleted. Writes made to the target other than by the replication are
+// overwritten or deleted by then.
+func Replicate(ctx context.Context, config Config) error {
+	if config.CheckpointKey == "" {
+		config.CheckpointKey = DefaultCheckpointKey
+	}
+	if config.CheckpointInterval <= 0 {
+		config.CheckpointInterval = DefaultCheckpointInterval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	src, err := endpoint.StartPassiveBackend(ctx, config.Source)
+	if err != nil {
+		return errors.Wrap(err, "opening source")
+	}
+	defer src.Close()
+	tlsConfig, err := config.Target.TLSConfig.ClientConfig()
+	if err != nil {
+		return errors.Wrap(err, "loading the TLS config of the target")
+	}
+	dst, err := clientv3.New(clientv3.Config{
+		Endpoints:   config.Target.Endpoints,
+		DialTimeout: 5 * time.Second,
+		TLS:         tlsConfig,
+		Context:     ctx,
+	})
+	if err != nil {
+		return errors.Wrap(err, "connecting to target")
+	}
+	defer dst.Close()
+
+	r := &replication{
+		config: config,
+		src:    src,
+		dst:    dst,
+		logger: logging.OrDefault(config.Logger),
+	}
+	err = r.run(ctx)
+	if ctx.Err() != nil {
+		// writes cut short by ctx fail with errors of their own
+		return ctx.Err()
+	}
+	return err
+}
+
+// replication is the state of a replication while it runs.
+type replication struct {
+	config Config
+	src    server.Backend
+	dst    *clientv3.Client
+	logger logging.Logger
+
+	// replicated is the revision of the source that the target holds the
+	// writes of, and checkpoint that of the checkpoint stored at the mod
+	// revision checkpointRevision of the source
+	replicated         int64
+	checkpoint         int64
+	checkpointRevision int64
+}
+
+func (r *replication) run(ctx context.Context) error {
+	if err := r.readCheckpoint(ctx); err != nil {
+		return err
+	}
+	r.replicated = r.checkpoint
+	if r.checkpoint == 0 {
+		r.logger.Infof("Replicating to %v without a checkpoint, resyncing the target", r.config.Target.Endpoints)
+		if err := r.resync(ctx); err != nil {
+			return err
+		}
+	} else {
+		r.logger.Infof("Replicating to %v from the checkpoint at revision %d", r.config.Target.Endpoints, r.checkpoint)
+	}
+
+	for {
+		compacted, err := r.follow(ctx)
+		if err != nil {
+			return err
+		}
+		if compacted {
+			r.logger.Warnf("Source was compacted past revision %d before its writes were replicated, resyncing the target", r.replicated)
+			if err := r.resync(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// follow replicates the writes to the source after the revision replicated,
+// writing the checkpoint as it goes, until the watch of the source stops. It
+// reports whether it stopped because the source was compacted past the
+// revision replicated.
+func (r *replication) follow(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events := r.src.Watch(ctx, "/", r.replicated+1)
+	checkpoint := time.NewTicker(r.config.CheckpointInterval)
+	defer checkpoint.Stop()
+	progress := time.NewTicker(progressInterval)
+	defer progress.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-checkpoint.C:
+			if err := r.writeCheckpoint(ctx); err != nil {
+				r.logger.Errorf("Failed to write the replication checkpoint at revision %d: %v", r.replicated, err)
+			}
+		case <-progress.C:
+			if current, err := r.src.CurrentRevision(ctx); err == nil {
+				r.logger.Infof("Replicated up to revision %d of the source, %d revisions behind", r.replicated, current-r.replicated)
+			}
+		case batch, ok := <-events:
+			if !ok {
+				// the watch is started again from the revision replicated
+				return false, ctx.Err()
+			}
+			if batch.CompactRevision > 0 {
+				return true, nil
+			}
+			if batch.Err == server.ErrWatchTooSlow {
+				// the replication fell behind the source as it applied the
+				// events or waited out the target, so the watch is started
+				// again from the revision replicated
+				r.logger.Warnf("Replication fell behind the source, watching it again after revision %d", r.replicated)
+				return false, nil
+			}
+			if batch.Err != nil {
+				return false, errors.Wrapf(batch.Err, "watching the source after revision %d", r.replicated)
+			}
+			for _, event := range batch.Events {
+				if err := r.retry(ctx, func() error {
+					return r.apply(ctx, event)
+				}); err != nil {
+					return false, err
+				}
+				r.replicated = event.KV.ModRevision
+			}
+		}
+	}
+}
+
+// apply writes the event to the target, unless it is a write of the
+// checkpoint.
+func (r *replication) apply(ctx context.Context, event *server.Event) error {
+	if event.KV.Key == r.config.CheckpointKey {
+		return nil
+	}
+	if event.Delete {
+		return errors.Wrapf(r.delete(ctx, event.KV.Key), "deleting %s", event.KV.Key)
+	}
+	return errors.Wrapf(r.put(ctx, event.KV.Key, event.KV.Value), "writing %s", event.KV.Key)
+}
+
+// put writes the value to the key of the target unless it holds it already,
+// in a transaction that compares the mod revision of the key as it was read.
+func (r *replication) put(ctx context.Context, key string, value []byte) error {
+	resp, err := r.dst.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	kvs := resp.Kvs
+	for attempt := 0; attempt < writeAttempts; attempt++ {
+		var modRevision int64
+		if len(kvs) > 0 {
+			if bytes.Equal(kvs[0].Value, value) {
+				return nil
+			}
+			modRevision = kvs[0].ModRevision
+		}
+		txn, err := r.dst.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+			Then(clientv3.OpPut(key, string(value))).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txn.Succeeded {
+			return nil
+		}
+		kvs = txn.Responses[0].GetResponseRange().Kvs
+	}
+	return fmt.Errorf("key was written to the target concurrently %d times", writeAttempts)
+}
+
+// delete deletes the key of the target if it exists, in a transaction that
+// compares the mod revision of the key as it was read.
+func (r *replication) delete(ctx context.Context, key string) error {
+	resp, err := r.dst.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	kvs := resp.Kvs
+	for attempt := 0; attempt < writeAttempts; attempt++ {
+		if len(kvs) == 0 {
+			return nil
+		}
+		txn, err := r.dst.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", kvs[0].ModRevision)).
+			Then(clientv3.OpDelete(key)).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txn.Succeeded {
+			return nil
+		}
+		kvs = txn.Responses[0].GetResponseRange().Kvs
+	}
+	return fmt.Errorf("key was written to the target concurrently %d times", writeAttempts)
+}
+
+// retry runs fn until it succeeds or ctx is done, every retryInterval, as the
+// target may be unavailable for a while.
+func (r *replication) retry(ctx context.Context, fn func() error) error {
+	for {
+		err := fn()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		r.logger.Warnf("Failed to replicate to the target, retrying in %v: %v", retryInterval, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// resync copies the keys of the source at its current revision to the
+// target, and deletes the keys of the target that the source does not hold,
+// replicating the revision.
+func (r *replication) resync(ctx context.Context) error {
+	revision, err := r.src.CurrentRevision(ctx)
+	if err != nil {
+		return errors.Wrap(err, "reading the current revision of the source")
+	}
+
+	keys := map[string]bool{}
+	startKey := ""
+	for {
+		_, kvs, err := r.src.List(ctx, "/", startKey, r.config.BatchSize, revision, false, server.RevisionFilter{})
+		if err != nil {
+			return errors.Wrapf(err, "listing keys of the source after %q at revision %d", startKey, revision)
+		}
+		for _, kv := range kvs {
+			if kv.Key == r.config.CheckpointKey {
+				continue
+			}
+			keys[kv.Key] = true
+			if err := r.retry(ctx, func() error {
+				return errors.Wrapf(r.put(ctx, kv.Key, kv.Value), "writing %s", kv.Key)
+			}); err != nil {
+				return err
+			}
+		}
+		if int64(len(kvs)) < r.config.BatchSize {
+			break
+		}
+		startKey = kvs[len(kvs)-1].Key
+	}
+
+	deleted := 0
+	end := clientv3.GetPrefixRangeEnd("/")
+	startKey = "/"
+	for {
+		var resp *clientv3.GetResponse
+		if err := r.retry(ctx, func() (err error) {
+			resp, err = r.dst.Get(ctx, startKey, clientv3.WithRange(end), clientv3.WithKeysOnly(), clientv3.WithLimit(r.config.BatchSize))
+			return errors.Wrapf(err, "listing keys of the target from %q", startKey)
+		}); err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			key := string(kv.Key)
+			if keys[key] {
+				continue
+			}
+			if err := r.retry(ctx, func() error {
+				return errors.Wrapf(r.delete(ctx, key), "deleting %s", key)
+			}); err != nil {
+				return err
+			}
+			deleted++
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			break
+		}
+		startKey = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+
+	r.replicated = revision
+	r.logger.Infof("Resynced %d keys of the target at revision %d of the source, deleting %d", len(keys), revision, deleted)
+	return r.writeCheckpoint(ctx)
+}
+
+// readCheckpoint reads the checkpoint of the source, which is zero if it has
+// none.
+func (r *replication) readCheckpoint(ctx context.Context) error {
+	_, kv, err := r.src.Get(ctx, r.config.CheckpointKey, "", 1, 0)
+	if err != nil {
+		return errors.Wrap(err, "reading the replication checkpoint")
+	}
+	if kv == nil {
+		return nil
+	}
+	checkpoint, err := strconv.ParseInt(string(kv.Value), 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "parsing the replication checkpoint at %s", r.config.CheckpointKey)
+	}
+	r.checkpoint, r.checkpointRevision = checkpoint, kv.ModRevision
+	return nil
+}
+
+// writeCheckpoint stores the revision replicated as the checkpoint of the
+// source, unless it is stored already. The write of the checkpoint is itself
+// a revision of the source, which raises the revision replicated but not the
+// checkpoint, so that the checkpoint is only written again once other keys
+// were.
+func (r *replication) writeCheckpoint(ctx context.Context) error {
+	if r.replicated <= r.checkpoint || r.replicated == r.checkpointRevision {
+		return nil
+	}
+	value := []byte(strconv.FormatInt(r.replicated, 10))
+	if r.checkpointRevision == 0 {
+		rev, err := r.src.Create(ctx, r.config.CheckpointKey, value, 0)
+		if err != nil {
+			return err
+		}
+		r.checkpoint, r.checkpointRevision = r.replicated, rev
+		return nil
+	}
+	rev, _, ok, err := r.src.Update(ctx, r.config.CheckpointKey, value, r.checkpointRevision, 0)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("checkpoint at %s was written concurrently, by another replication with the same key", r.config.CheckpointKey)
+	}
+	r.checkpoint, r.checkpointRevision = r.replicated, rev
+	return nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rancher/kine/pkg/logging"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// quotaCheckInterval bounds how often the size of the database is measured
+// against the quota, as every measurement is a query.
+const quotaCheckInterval = time.Second
+
+// quota tracks the size of the database against the backend quota, and the
+// NOSPACE alarm that is raised once the database grows over it. While the
+// alarm is raised writes are rejected, but reads, deletes and compactions
+// still go through so that the space can be reclaimed.
+type quota struct {
+	sync.Mutex
+	backend Backend
+	limit   int64
+	checked time.Time
+	alarm   bool
+	logger  logging.Logger
+}
+
+// check returns ErrNoSpace if the NOSPACE alarm is raised, measuring the
+// database first if it was not measured recently.
+func (q *quota) check(ctx context.Context) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.limit > 0 && !q.alarm && time.Since(q.checked) >= quotaCheckInterval {
+		if err := q.measure(ctx); err != nil {
+			// not knowing the size is no reason to refuse writes
+			q.logger.Warnf("failed to check database size against quota: %v", err)
+		}
+	}
+	if q.alarm {
+		return ErrNoSpace
+	}
+	return nil
+}
+
+// measure gets the size of the database and raises the alarm if it is over
+// the quota. It must be called with the lock held.
+func (q *quota) measure(ctx context.Context) error {
+	q.checked = time.Now()
+	size, err := q.backend.DbSize(ctx)
+	if err != nil {
+		return err
+	}
+	if size > q.limit && !q.alarm {
+		q.logger.Warnf("Database size %d exceeds the quota of %d bytes, raising NOSPACE alarm", size, q.limit)
+		q.alarm = true
+	}
+	return nil
+}
+
+// hasPut reports whether a transaction may put a key, and so could grow the
+// database.
+func hasPut(txn *etcdserverpb.TxnRequest) bool {
+	for _, ops := range [][]*etcdserverpb.RequestOp{txn.Success, txn.Failure} {
+		for _, op := range ops {
+			if op.GetRequestPut() != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (q *quota) alarms() []*etcdserverpb.AlarmMember {
+	if !q.alarm {
+		return nil
+	}
+	return []*etcdserverpb.AlarmMember{
+		{Alarm: etcdserverpb.AlarmType_NOSPACE},
+	}
+}
+
+func (s *KVServerBridge) Alarm(ctx context.Context, r *etcdserverpb.AlarmRequest) (*etcdserverpb.AlarmResponse, error) {
+	q := s.limited.quota
+	q.Lock()
+	defer q.Unlock()
+
+	if r.Action != etcdserverpb.AlarmRequest_GET && r.Alarm != etcdserverpb.AlarmType_NOSPACE {
+		return nil, fmt.Errorf("alarm %s is not supported", r.Alarm)
+	}
+
+	var alarms []*etcdserverpb.AlarmMember
+	switch r.Action {
+	case etcdserverpb.AlarmRequest_GET:
+		alarms = q.alarms()
+	case etcdserverpb.AlarmRequest_ACTIVATE:
+		q.alarm = true
+		alarms = q.alarms()
+	case etcdserverpb.AlarmRequest_DEACTIVATE:
+		alarms = q.alarms()
+		if q.alarm && q.limit > 0 {
+			size, err := q.backend.DbSize(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if size > q.limit {
+				return nil, fmt.Errorf("database size %d still exceeds the quota of %d bytes, compact and defragment it first", size, q.limit)
+			}
+		}
+		q.alarm = false
+		q.checked = time.Now()
+	default:
+		return nil, fmt.Errorf("alarm action %s is not supported", r.Action)
+	}
+
+	return &etcdserverpb.AlarmResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+		Alarms: alarms,
+	}, nil
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+var _ etcdserverpb.ClusterServer = (*KVServerBridge)(nil)
+
+// member returns the single member of the cluster kine emulates. Its id is
+// derived from its name and urls, so that it is stable across restarts.
+func (k *KVServerBridge) member() *etcdserverpb.Member {
+	return &etcdserverpb.Member{
+		ID:         memberID(k.config.MemberName, k.config.PeerURLs, k.config.ClientURLs),
+		Name:       k.config.MemberName,
+		PeerURLs:   k.config.PeerURLs,
+		ClientURLs: k.config.ClientURLs,
+	}
+}
+
+func memberID(name string, peerURLs, clientURLs []string) uint64 {
+	h := sha1.New()
+	h.Write([]byte(name))
+	for _, urls := range [][]string{peerURLs, clientURLs} {
+		sorted := append([]string{}, urls...)
+		sort.Strings(sorted)
+		for _, url := range sorted {
+			h.Write([]byte{0})
+			h.Write([]byte(url))
+		}
+	}
+	return binary.BigEndian.Uint64(h.Sum(nil)[:8])
+}
+
+func (k *KVServerBridge) MemberList(ctx context.Context, r *etcdserverpb.MemberListRequest) (*etcdserverpb.MemberListResponse, error) {
+	member := k.member()
+	return &etcdserverpb.MemberListResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			MemberId: member.ID,
+		},
+		Members: []*etcdserverpb.Member{member},
+	}, nil
+}
+
+func (k *KVServerBridge) MemberAdd(context.Context, *etcdserverpb.MemberAddRequest) (*etcdserverpb.MemberAddResponse, error) {
+	return nil, fmt.Errorf("member add is not supported")
+}
+
+func (k *KVServerBridge) MemberRemove(context.Context, *etcdserverpb.MemberRemoveRequest) (*etcdserverpb.MemberRemoveResponse, error) {
+	return nil, fmt.Errorf("member remove is not supported")
+}
+
+func (k *KVServerBridge) MemberUpdate(context.Context, *etcdserverpb.MemberUpdateRequest) (*etcdserverpb.MemberUpdateResponse, error) {
+	return nil, fmt.Errorf("member update is not supported")
+}
+
+func (k *KVServerBridge) MemberPromote(context.Context, *etcdserverpb.MemberPromoteRequest) (*etcdserverpb.MemberPromoteResponse, error) {
+	return nil, fmt.Errorf("member promote is not supported")
+}
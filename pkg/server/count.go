@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// count answers a count only range from the backend's count, without
+// fetching any keys or values. A single key is counted on its own, as the
+// backend would count a key that ends with a slash as a prefix.
+func (l *LimitedServer) count(ctx context.Context, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
+	filter := revisionFilter(r)
+	if len(r.RangeEnd) == 0 {
+		rev, kv, err := l.startKV(ctx, string(r.Key), r.Revision, true, filter)
+		if err != nil {
+			return nil, err
+		}
+		resp := &RangeResponse{
+			Header: txnHeader(rev),
+		}
+		if kv != nil {
+			resp.Count = 1
+		}
+		return resp, nil
+	}
+
+	prefix, start, inclusive := listRange(r)
+	rev, count, err := l.backend.Count(ctx, prefix, start, r.Revision, filter)
+	if err != nil {
+		return nil, err
+	}
+	if inclusive {
+		_, startKV, err := l.startKV(ctx, start, rev, true, filter)
+		if err != nil {
+			return nil, err
+		}
+		if startKV != nil {
+			count++
+		}
+	}
+	return &RangeResponse{
+		Header: txnHeader(rev),
+		Count:  count,
+	}, nil
+}
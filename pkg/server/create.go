@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 )
@@ -24,12 +25,11 @@ func (l *LimitedServer) create(ctx context.Context, put *etcdserverpb.PutRequest
 		return nil, unsupported("ignoreLease")
 	} else if put.IgnoreValue {
 		return nil, unsupported("ignoreValue")
-	} else if put.PrevKv {
-		return nil, unsupported("prevKv")
 	}
 
+	// a key that exists, or that a concurrent create won, fails the compare
 	rev, err := l.backend.Create(ctx, string(put.Key), put.Value, put.Lease)
-	if err == ErrKeyExists {
+	if errors.Is(err, ErrKeyExists) {
 		return &etcdserverpb.TxnResponse{
 			Header:    txnHeader(rev),
 			Succeeded: false,
@@ -5,3 +5,11 @@ import "context"
 func (l *LimitedServer) dbSize(ctx context.Context) (int64, error) {
 	return l.backend.DbSize(ctx)
 }
+
+func (l *LimitedServer) dbSizeInUse(ctx context.Context) (int64, error) {
+	return l.backend.DbSizeInUse(ctx)
+}
+
+func (l *LimitedServer) defragment(ctx context.Context) error {
+	return l.backend.Defragment(ctx)
+}
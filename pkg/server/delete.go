@@ -50,6 +50,9 @@ func (l *LimitedServer) delete(ctx context.Context, key string, revision int64)
 		}, nil
 	}
 
+	// a key that is missing or already deleted is not deleted again, which
+	// still succeeds
+	prevKVs := toKVs(kv)
 	return &etcdserverpb.TxnResponse{
 		Header: txnHeader(rev),
 		Responses: []*etcdserverpb.ResponseOp{
@@ -57,7 +60,8 @@ func (l *LimitedServer) delete(ctx context.Context, key string, revision int64)
 				Response: &etcdserverpb.ResponseOp_ResponseDeleteRange{
 					ResponseDeleteRange: &etcdserverpb.DeleteRangeResponse{
 						Header:  txnHeader(rev),
-						PrevKvs: toKVs(kv),
+						Deleted: int64(len(prevKVs)),
+						PrevKvs: prevKVs,
 					},
 				},
 			},
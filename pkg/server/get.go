@@ -20,7 +20,10 @@ func (l *LimitedServer) get(ctx context.Context, r *etcdserverpb.RangeRequest) (
 	resp := &RangeResponse{
 		Header: txnHeader(rev),
 	}
-	if kv != nil {
+	if kv != nil && revisionFilter(r).matches(kv) {
+		if r.KeysOnly {
+			kv.Value = nil
+		}
 		resp.Kvs = []*KeyValue{kv}
 	}
 	return resp, nil
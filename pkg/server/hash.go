@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// hashPageSize is the number of keys read at a time while hashing.
+const hashPageSize = 1000
+
+// hashKV hashes the keys that were current at the revision, or at the
+// current revision if it is zero. Like etcd, it feeds the bucket name and
+// then the revision and marshalled key-value of each key to a CRC-32C, so
+// that the hash fingerprints the keys with their revisions, versions, values
+// and leases. Unlike etcd, which also hashes the history kept since its
+// compact revision, only the keys current at the revision are hashed, in
+// the order of their names. Keys not under / are not hashed, as kine lists
+// no others.
+func (l *LimitedServer) hashKV(ctx context.Context, revision int64) (int64, int64, uint32, error) {
+	current, err := l.backend.CurrentRevision(ctx)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if revision == 0 {
+		revision = current
+	} else if revision > current {
+		return 0, 0, 0, ErrFutureRev
+	}
+
+	compact, err := l.backend.CompactRevision(ctx)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	h.Write([]byte("key"))
+
+	start := ""
+	for {
+		_, kvs, err := l.backend.List(ctx, "/", start, hashPageSize, revision, false, RevisionFilter{})
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		for _, kv := range kvs {
+			version, err := l.backend.VersionOf(ctx, kv)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			data, err := (&mvccpb.KeyValue{
+				Key:            []byte(kv.Key),
+				CreateRevision: kv.CreateRevision,
+				ModRevision:    kv.ModRevision,
+				Version:        version,
+				Value:          kv.Value,
+				Lease:          kv.Lease,
+			}).Marshal()
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			h.Write(revisionBytes(kv.ModRevision))
+			h.Write(data)
+		}
+		if len(kvs) < hashPageSize {
+			break
+		}
+		start = kvs[len(kvs)-1].Key
+	}
+
+	return revision, compact, h.Sum32(), nil
+}
+
+// revisionBytes encodes a revision the way etcd keys its backend: the main
+// revision, an underscore and the sub revision, which is always zero in kine.
+func revisionBytes(revision int64) []byte {
+	b := make([]byte, 17)
+	binary.BigEndian.PutUint64(b, uint64(revision))
+	b[8] = '_'
+	return b
+}
+
+func (s *KVServerBridge) HashKV(ctx context.Context, r *etcdserverpb.HashKVRequest) (*etcdserverpb.HashKVResponse, error) {
+	rev, compact, hash, err := s.limited.hashKV(ctx, r.Revision)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.HashKVResponse{
+		Header:          txnHeader(rev),
+		Hash:            hash,
+		CompactRevision: compact,
+	}, nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	defaultHealthCheckInterval = 5 * time.Second
+	defaultHealthCheckTimeout  = time.Second
+)
+
+// HealthCheck probes the backend by reading its current revision, and sets
+// the status of the health server to SERVING while the probe succeeds within
+// the timeout and to NOT_SERVING otherwise. It probes once right away and
+// then on every interval until ctx is done.
+func (k *KVServerBridge) HealthCheck(ctx context.Context, hsrv *health.Server) {
+	ticker := time.NewTicker(k.config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	serving := true
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, k.config.HealthCheckTimeout)
+		_, err := k.limited.backend.CurrentRevision(probeCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		status := healthpb.HealthCheckResponse_SERVING
+		if err != nil {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+			if serving {
+				k.config.Logger.Errorf("Health check failed, reporting not serving: %v", err)
+			}
+		} else if !serving {
+			k.config.Logger.Infof("Health check succeeded, reporting serving")
+		}
+		serving = err == nil
+		hsrv.SetServingStatus("", status)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
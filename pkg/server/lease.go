@@ -3,28 +3,95 @@ package server
 import (
 	"context"
 	"fmt"
+	"io"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 )
 
 func (s *KVServerBridge) LeaseGrant(ctx context.Context, req *etcdserverpb.LeaseGrantRequest) (*etcdserverpb.LeaseGrantResponse, error) {
+	end, err := s.limited.readOnly.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	if err := s.limited.quota.check(ctx); err != nil {
+		return nil, err
+	}
+
+	id, err := s.limited.backend.LeaseGrant(ctx, req.ID, req.TTL)
+	if err != nil {
+		return nil, err
+	}
+
 	return &etcdserverpb.LeaseGrantResponse{
 		Header: &etcdserverpb.ResponseHeader{},
-		ID:     req.TTL,
+		ID:     id,
 		TTL:    req.TTL,
 	}, nil
 }
 
-func (s *KVServerBridge) LeaseRevoke(context.Context, *etcdserverpb.LeaseRevokeRequest) (*etcdserverpb.LeaseRevokeResponse, error) {
-	return nil, fmt.Errorf("lease revoke is not supported")
+func (s *KVServerBridge) LeaseRevoke(ctx context.Context, req *etcdserverpb.LeaseRevokeRequest) (*etcdserverpb.LeaseRevokeResponse, error) {
+	end, err := s.limited.readOnly.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	rev, err := s.limited.backend.LeaseRevoke(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.LeaseRevokeResponse{
+		Header: txnHeader(rev),
+	}, nil
 }
 
-func (s *KVServerBridge) LeaseKeepAlive(etcdserverpb.Lease_LeaseKeepAliveServer) error {
-	return fmt.Errorf("lease keep alive is not supported")
+func (s *KVServerBridge) LeaseKeepAlive(stream etcdserverpb.Lease_LeaseKeepAliveServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		ttl, err := s.limited.backend.LeaseKeepAlive(stream.Context(), req.ID)
+		if err != nil {
+			return err
+		}
+
+		// unknown leases are reported with a TTL of -1, which the client
+		// treats as the lease having expired
+		err = stream.Send(&etcdserverpb.LeaseKeepAliveResponse{
+			Header: &etcdserverpb.ResponseHeader{},
+			ID:     req.ID,
+			TTL:    ttl,
+		})
+		if err != nil {
+			return err
+		}
+	}
 }
 
-func (s *KVServerBridge) LeaseTimeToLive(context.Context, *etcdserverpb.LeaseTimeToLiveRequest) (*etcdserverpb.LeaseTimeToLiveResponse, error) {
-	return nil, fmt.Errorf("lease time to live is not supported")
+func (s *KVServerBridge) LeaseTimeToLive(ctx context.Context, req *etcdserverpb.LeaseTimeToLiveRequest) (*etcdserverpb.LeaseTimeToLiveResponse, error) {
+	ttl, grantedTTL, keys, err := s.limited.backend.LeaseTimeToLive(ctx, req.ID, req.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &etcdserverpb.LeaseTimeToLiveResponse{
+		Header:     &etcdserverpb.ResponseHeader{},
+		ID:         req.ID,
+		TTL:        ttl,
+		GrantedTTL: grantedTTL,
+	}
+	for _, key := range keys {
+		resp.Keys = append(resp.Keys, []byte(key))
+	}
+	return resp, nil
 }
 
 func (s *KVServerBridge) LeaseLeases(context.Context, *etcdserverpb.LeaseLeasesRequest) (*etcdserverpb.LeaseLeasesResponse, error) {
@@ -2,19 +2,41 @@ package server
 
 import (
 	"context"
-	"fmt"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type LimitedServer struct {
 	backend Backend
+	quota   *quota
+	// readOnly rejects writes while the server is in read-only mode.
+	readOnly *readOnly
+	// maxRequestBytes is the size of the largest write request accepted, or
+	// negative if sizes are not limited.
+	maxRequestBytes int
+	// tracer starts the spans of requests, if they are traced.
+	tracer trace.Tracer
+	// lists limits the expensive lists that run at once, and the rate at
+	// which clients start them.
+	lists *listLimiter
 }
 
-func (l *LimitedServer) Range(ctx context.Context, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
+func (l *LimitedServer) handleRange(ctx context.Context, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
+	if r.Serializable {
+		ctx = WithSerializableRead(ctx)
+	}
+	if r.CountOnly {
+		return l.count(ctx, r)
+	}
 	if len(r.RangeEnd) == 0 {
 		return l.get(ctx, r)
 	}
+	end, err := l.lists.begin(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
 	return l.list(ctx, r)
 }
 
@@ -24,7 +46,31 @@ func txnHeader(rev int64) *etcdserverpb.ResponseHeader {
 	}
 }
 
-func (l *LimitedServer) Txn(ctx context.Context, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+// checkRequestSize returns ErrRequestTooLarge if a write request of the
+// given size is larger than accepted.
+func (l *LimitedServer) checkRequestSize(size int) error {
+	if l.maxRequestBytes > 0 && size > l.maxRequestBytes {
+		return ErrRequestTooLarge
+	}
+	return nil
+}
+
+func (l *LimitedServer) handleTxn(ctx context.Context, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	if err := l.checkRequestSize(txn.Size()); err != nil {
+		return nil, err
+	}
+	if hasWrite(txn) {
+		end, err := l.readOnly.begin()
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+	}
+	if !isCompact(txn) && hasPut(txn) {
+		if err := l.quota.check(ctx); err != nil {
+			return nil, err
+		}
+	}
 	if put := isCreate(txn); put != nil {
 		return l.create(ctx, put, txn)
 	}
@@ -32,12 +78,12 @@ func (l *LimitedServer) Txn(ctx context.Context, txn *etcdserverpb.TxnRequest) (
 		return l.delete(ctx, key, rev)
 	}
 	if rev, key, value, lease, ok := isUpdate(txn); ok {
-		return l.update(ctx, rev, key, value, lease)
+		return l.update(ctx, rev, key, value, lease, txn.Success[0].GetRequestPut().PrevKv)
 	}
 	if isCompact(txn) {
 		return l.compact(ctx)
 	}
-	return nil, fmt.Errorf("unsupported transaction: %v", txn)
+	return l.txn(ctx, txn)
 }
 
 type ResponseHeader struct {
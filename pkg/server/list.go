@@ -14,32 +14,27 @@ func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest)
 		return nil, fmt.Errorf("invalid range end length of 0")
 	}
 
-	prefix := string(append(r.RangeEnd[:len(r.RangeEnd)-1], r.RangeEnd[len(r.RangeEnd)-1]-1))
-	if !strings.HasSuffix(prefix, "/") {
-		prefix = prefix + "/"
-	}
-	start := string(bytes.TrimRight(r.Key, "\x00"))
-
-	if r.CountOnly {
-		rev, count, err := l.backend.Count(ctx, prefix)
-		if err != nil {
-			return nil, err
-		}
-		return &RangeResponse{
-			Header: txnHeader(rev),
-			Count:  count,
-		}, nil
-	}
+	prefix, start, inclusive := listRange(r)
+	filter := revisionFilter(r)
 
 	limit := r.Limit
 	if limit > 0 {
 		limit++
 	}
 
-	rev, kvs, err := l.backend.List(ctx, prefix, start, limit, r.Revision)
+	rev, kvs, err := l.backend.List(ctx, prefix, start, limit, r.Revision, r.KeysOnly, filter)
 	if err != nil {
 		return nil, err
 	}
+	var startKV *KeyValue
+	if inclusive {
+		if _, startKV, err = l.startKV(ctx, start, rev, r.KeysOnly, filter); err != nil {
+			return nil, err
+		}
+		if startKV != nil {
+			kvs = append([]*KeyValue{startKV}, kvs...)
+		}
+	}
 
 	resp := &RangeResponse{
 		Header: txnHeader(rev),
@@ -50,7 +45,103 @@ func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest)
 	if limit > 0 && resp.Count > r.Limit {
 		resp.More = true
 		resp.Kvs = kvs[0 : limit-1]
+
+		// as in etcd, the count is the number of all keys in the range at
+		// the revision of the list, not just of those returned
+		_, count, err := l.backend.Count(ctx, prefix, start, rev, filter)
+		if err != nil {
+			return nil, err
+		}
+		if startKV != nil {
+			count++
+		}
+		resp.Count = count
 	}
 
 	return resp, nil
 }
+
+// listRange returns the prefix and the start key of the list of a range, and
+// whether the start key is part of the range itself, which the backend lists
+// the keys after. Ranges that end at a NUL byte are from-key ranges, which list
+// every key from their key on, or the whole keyspace if their key is a NUL byte
+// too; they are listed as the empty prefix, which holds all keys.
+func listRange(r *etcdserverpb.RangeRequest) (string, string, bool) {
+	if !isFromKey(r.RangeEnd) {
+		return listPrefix(r.RangeEnd), listStart(r.Key), false
+	}
+	if len(r.Key) == 0 || bytes.Equal(r.Key, fromKeyEnd) {
+		return "", "", false
+	}
+	if bytes.HasSuffix(r.Key, fromKeyEnd) {
+		return "", listStart(r.Key), false
+	}
+	return "", string(r.Key), true
+}
+
+// fromKeyEnd is the range end of from-key ranges.
+var fromKeyEnd = []byte{0}
+
+// isFromKey returns whether the range end is that of a from-key range.
+func isFromKey(rangeEnd []byte) bool {
+	return bytes.Equal(rangeEnd, fromKeyEnd)
+}
+
+// startKV returns the key value of the key a from-key range starts at, or of
+// a single key, as of the revision, or nil if the key does not exist then or
+// is filtered out. The revision of the read is returned along with it.
+func (l *LimitedServer) startKV(ctx context.Context, key string, revision int64, keysOnly bool, filter RevisionFilter) (int64, *KeyValue, error) {
+	rev, kv, err := l.backend.Get(ctx, key, "", 1, revision)
+	if err != nil {
+		return 0, nil, err
+	}
+	// a key that ends with a slash is read as a prefix, whose first key may
+	// be another
+	if kv == nil || kv.Key != key || !filter.matches(kv) {
+		return rev, nil, nil
+	}
+	if keysOnly {
+		kv.Value = nil
+	}
+	return rev, kv, nil
+}
+
+// revisionFilter returns the revision bounds of a range.
+func revisionFilter(r *etcdserverpb.RangeRequest) RevisionFilter {
+	return RevisionFilter{
+		MinModRevision:    r.MinModRevision,
+		MaxModRevision:    r.MaxModRevision,
+		MinCreateRevision: r.MinCreateRevision,
+		MaxCreateRevision: r.MaxCreateRevision,
+	}
+}
+
+// matches returns whether the revisions of a key lie within the bounds of the
+// filter.
+func (f RevisionFilter) matches(kv *KeyValue) bool {
+	return (f.MinModRevision == 0 || kv.ModRevision >= f.MinModRevision) &&
+		(f.MaxModRevision == 0 || kv.ModRevision <= f.MaxModRevision) &&
+		(f.MinCreateRevision == 0 || kv.CreateRevision >= f.MinCreateRevision) &&
+		(f.MaxCreateRevision == 0 || kv.CreateRevision <= f.MaxCreateRevision)
+}
+
+// listStart returns the key after which a list continues. Clients continue
+// a list from the last key they got followed by a NUL byte, the next key
+// after it, which is taken off; only one is, as keys may end with NUL bytes
+// themselves.
+func listStart(key []byte) string {
+	return string(bytes.TrimSuffix(key, []byte("\x00")))
+}
+
+// listPrefix returns the key prefix of a list from the end of its range.
+func listPrefix(rangeEnd []byte) string {
+	end := make([]byte, len(rangeEnd))
+	copy(end, rangeEnd)
+	end[len(end)-1]--
+
+	prefix := string(end)
+	if !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+	return prefix
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/audit"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/metrics"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+const (
+	defaultListQueueTimeout   = 5 * time.Second
+	defaultListLimitThreshold = 500
+	// listBucketSweepInterval is the interval at which the rate limits of
+	// clients that are back to a full burst are forgotten.
+	listBucketSweepInterval = time.Minute
+)
+
+// listLimiter protects the backend from expensive lists: those of whole
+// ranges, or with limits above the threshold, such as the lists of all
+// objects of a resource. It runs a limited number of them at once, queueing
+// those over the limit for up to the queue timeout, and limits the rate at
+// which each client starts them. Point reads, counts and small lists are
+// never limited.
+type listLimiter struct {
+	sync.Mutex
+	// slots holds a token for each expensive list that runs, and is nil if
+	// their concurrency is not limited.
+	slots        chan struct{}
+	queueTimeout time.Duration
+	threshold    int64
+	// rate is the number of expensive lists per second that each client may
+	// start, with bursts of burst, or zero if their rate is not limited.
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	swept   time.Time
+
+	inFlight prometheus.Gauge
+	queued   prometheus.Gauge
+	rejected *prometheus.CounterVec
+}
+
+func newListLimiter(logger logging.Logger, registerer prometheus.Registerer, config Config) *listLimiter {
+	l := &listLimiter{
+		queueTimeout: config.ListQueueTimeout,
+		threshold:    config.ListLimitThreshold,
+		rate:         config.ListRateLimit,
+		burst:        float64(config.ListRateBurst),
+		buckets:      map[string]*tokenBucket{},
+		swept:        time.Now(),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "list",
+			Name:      "in_flight",
+			Help:      "Number of expensive lists running.",
+		}),
+		queued: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "list",
+			Name:      "queued",
+			Help:      "Number of expensive lists waiting for a slot of the limit of concurrent lists.",
+		}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "list",
+			Name:      "rejected_total",
+			Help:      "Number of expensive lists rejected, by whether they were over the concurrency or the rate limit.",
+		}, []string{"reason"}),
+	}
+	if config.MaxConcurrentLists > 0 {
+		l.slots = make(chan struct{}, config.MaxConcurrentLists)
+	}
+	if registerer == nil {
+		return l
+	}
+
+	l.inFlight = metrics.Register(logger, registerer, l.inFlight).(prometheus.Gauge)
+	l.queued = metrics.Register(logger, registerer, l.queued).(prometheus.Gauge)
+	l.rejected = metrics.Register(logger, registerer, l.rejected).(*prometheus.CounterVec)
+	if l.slots != nil {
+		metrics.Register(logger, registerer, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "list",
+			Name:      "max_in_flight",
+			Help:      "Maximum number of expensive lists running at once.",
+		}, func() float64 {
+			return float64(cap(l.slots))
+		}))
+	}
+	return l
+}
+
+// expensive reports whether the range request is a list that is limited.
+func (l *listLimiter) expensive(r *etcdserverpb.RangeRequest) bool {
+	return len(r.RangeEnd) > 0 && !r.CountOnly && (r.Limit <= 0 || r.Limit > l.threshold)
+}
+
+// begin returns ErrListRateLimited if the request is an expensive list of a
+// client over its rate limit, and ErrTooManyLists if it found no slot within
+// the queue timeout. Otherwise it returns the func that ends the list, which
+// must be called once the list is done.
+func (l *listLimiter) begin(ctx context.Context, r *etcdserverpb.RangeRequest) (func(), error) {
+	if !l.expensive(r) {
+		return func() {}, nil
+	}
+	if l.rate > 0 && !l.allow(listClient(ctx), time.Now()) {
+		l.rejected.WithLabelValues("rate").Inc()
+		return nil, ErrListRateLimited
+	}
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if err := l.wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+	l.inFlight.Inc()
+	return func() {
+		l.inFlight.Dec()
+		if l.slots != nil {
+			<-l.slots
+		}
+	}, nil
+}
+
+// wait waits for a slot for up to the queue timeout.
+func (l *listLimiter) wait(ctx context.Context) error {
+	l.queued.Inc()
+	defer l.queued.Dec()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		l.rejected.WithLabelValues("concurrency").Inc()
+		return ErrTooManyLists
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// allow takes a token from the bucket of the client, and reports whether
+// there was one.
+func (l *listLimiter) allow(client string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.swept) >= listBucketSweepInterval {
+		for client, bucket := range l.buckets {
+			if bucket.refill(now, l.rate, l.burst) >= l.burst {
+				delete(l.buckets, client)
+			}
+		}
+		l.swept = now
+	}
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+	if bucket.refill(now, l.rate, l.burst) < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// tokenBucket holds the tokens of a client as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned at the rate since the last refill, up to the
+// burst, and returns the tokens of the bucket.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) float64 {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*rate)
+		b.last = now
+	}
+	return b.tokens
+}
+
+// listClient returns the client that the rate limit of the rpc that ctx
+// belongs to applies to: the common name of its certificate, or else the
+// host of its address, so that the connections of a client share a limit.
+func listClient(ctx context.Context) string {
+	commonName, address := audit.Identity(ctx)
+	if commonName != "" {
+		return "cn:" + commonName
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
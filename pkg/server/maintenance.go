@@ -1,43 +1,95 @@
 package server
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"time"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 )
 
 var _ etcdserverpb.MaintenanceServer = (*KVServerBridge)(nil)
 
-func (s *KVServerBridge) Alarm(context.Context, *etcdserverpb.AlarmRequest) (*etcdserverpb.AlarmResponse, error) {
-	return nil, fmt.Errorf("alarm is not supported")
-}
+// emulatedETCDVersion is the version of etcd whose API kine implements. It is
+// reported as the server version, as clients parse it to decide which
+// features they can rely on.
+const emulatedETCDVersion = "3.5.0"
 
 func (s *KVServerBridge) Status(ctx context.Context, r *etcdserverpb.StatusRequest) (*etcdserverpb.StatusResponse, error) {
+	rev, err := s.limited.backend.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
 	size, err := s.limited.dbSize(ctx)
 	if err != nil {
 		return nil, err
 	}
+	inUse, err := s.limited.dbSizeInUse(ctx)
+	if err != nil {
+		return nil, err
+	}
 	return &etcdserverpb.StatusResponse{
-		Header: &etcdserverpb.ResponseHeader{},
-		DbSize: size,
+		Header:      txnHeader(rev),
+		Version:     emulatedETCDVersion,
+		DbSize:      size,
+		DbSizeInUse: inUse,
 	}, nil
 }
 
-func (s *KVServerBridge) Defragment(context.Context, *etcdserverpb.DefragmentRequest) (*etcdserverpb.DefragmentResponse, error) {
-	return nil, fmt.Errorf("defragment is not supported")
+func (s *KVServerBridge) Defragment(ctx context.Context, r *etcdserverpb.DefragmentRequest) (*etcdserverpb.DefragmentResponse, error) {
+	start := time.Now()
+	if err := s.limited.defragment(ctx); err != nil {
+		s.logRequest("Defragment", nil, 0, start, err)
+		return nil, err
+	}
+	return &etcdserverpb.DefragmentResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+	}, nil
 }
 
 func (s *KVServerBridge) Hash(context.Context, *etcdserverpb.HashRequest) (*etcdserverpb.HashResponse, error) {
 	return nil, fmt.Errorf("hash is not supported")
 }
 
-func (s *KVServerBridge) HashKV(context.Context, *etcdserverpb.HashKVRequest) (*etcdserverpb.HashKVResponse, error) {
-	return nil, fmt.Errorf("hash kv is not supported")
+// Snapshot streams a snapshot of the backend, which is restored with the
+// restore command rather than with etcdutl. The total size of the snapshot
+// is not known while it is streamed, so the remaining bytes are not reported.
+func (s *KVServerBridge) Snapshot(r *etcdserverpb.SnapshotRequest, stream etcdserverpb.Maintenance_SnapshotServer) error {
+	start := time.Now()
+	w := bufio.NewWriterSize(&snapshotWriter{stream: stream}, snapshotChunkSize)
+	if err := s.limited.backend.Snapshot(stream.Context(), w); err != nil {
+		s.logRequest("Snapshot", nil, 0, start, err)
+		return err
+	}
+	return w.Flush()
+}
+
+// snapshotChunkSize is the size of the blobs snapshots are streamed in.
+const snapshotChunkSize = 32 * 1024
+
+// snapshotWriter sends what is written to it as snapshot blobs of at most
+// snapshotChunkSize bytes.
+type snapshotWriter struct {
+	stream etcdserverpb.Maintenance_SnapshotServer
 }
 
-func (s *KVServerBridge) Snapshot(*etcdserverpb.SnapshotRequest, etcdserverpb.Maintenance_SnapshotServer) error {
-	return fmt.Errorf("snapshot is not supported")
+func (w *snapshotWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		end := n + snapshotChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := w.stream.Send(&etcdserverpb.SnapshotResponse{
+			Header: &etcdserverpb.ResponseHeader{},
+			Blob:   p[n:end],
+		}); err != nil {
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
 }
 
 func (s *KVServerBridge) MoveLeader(context.Context, *etcdserverpb.MoveLeaderRequest) (*etcdserverpb.MoveLeaderResponse, error) {
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/rancher/kine/pkg/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// metricsTimeout bounds how long the backend is queried for the revisions
+// reported by the metrics.
+const metricsTimeout = time.Second
+
+// serverMetrics are the metrics of the etcd rpcs served, and of the state of
+// the backend.
+type serverMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	watchers prometheus.Gauge
+}
+
+// newServerMetrics returns the metrics, registered with the registerer if it
+// is not nil.
+func newServerMetrics(logger logging.Logger, registerer prometheus.Registerer, backend Backend) *serverMetrics {
+	m := &serverMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "grpc",
+			Name:      "requests_total",
+			Help:      "Number of etcd rpcs handled, by method and status code.",
+		}, []string{"method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "grpc",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of etcd rpcs, or the lifetime of streams, by method.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"method"}),
+		watchers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "watch",
+			Name:      "watchers",
+			Help:      "Number of active watches.",
+		}),
+	}
+	if registerer == nil {
+		return m
+	}
+
+	m.requests = metrics.Register(logger, registerer, m.requests).(*prometheus.CounterVec)
+	m.duration = metrics.Register(logger, registerer, m.duration).(*prometheus.HistogramVec)
+	m.watchers = metrics.Register(logger, registerer, m.watchers).(prometheus.Gauge)
+	metrics.Register(logger, registerer, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Name:      "current_revision",
+		Help:      "Current revision of the database.",
+	}, backendGaugeFunc(backend.CurrentRevision)))
+	metrics.Register(logger, registerer, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Name:      "compact_revision",
+		Help:      "Revision the database was compacted up to.",
+	}, backendGaugeFunc(backend.CompactRevision)))
+	metrics.Register(logger, registerer, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Name:      "db_size_bytes",
+		Help:      "Size of the database, as reported by status.",
+	}, backendGaugeFunc(backend.DbSize)))
+	metrics.Register(logger, registerer, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Name:      "db_size_in_use_bytes",
+		Help:      "Size of the database without the space that is free for reuse, as reported by status.",
+	}, backendGaugeFunc(backend.DbSizeInUse)))
+	return m
+}
+
+// backendGaugeFunc returns the function of a gauge that reports the value
+// read from the backend, or -1 if it cannot be read.
+func backendGaugeFunc(read func(context.Context) (int64, error)) func() float64 {
+	return func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), metricsTimeout)
+		defer cancel()
+		value, err := read(ctx)
+		if err != nil {
+			return -1
+		}
+		return float64(value)
+	}
+}
+
+func (m *serverMetrics) observe(method string, start time.Time, err error) {
+	m.requests.WithLabelValues(method, status.Code(err).String()).Inc()
+	m.duration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// UnaryServerInterceptor returns an interceptor that collects the metrics of
+// unary rpcs, for the grpc server the bridge is registered with.
+func (k *KVServerBridge) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		k.metrics.observe(info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that collects the metrics of
+// streaming rpcs, for the grpc server the bridge is registered with.
+func (k *KVServerBridge) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		k.metrics.observe(info.FullMethod, start, err)
+		return err
+	}
+}
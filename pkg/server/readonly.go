@@ -0,0 +1,70 @@
+package server
+
+import (
+	"sync"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// readOnly is the read-only mode of the server, in which writes are rejected
+// with ErrReadOnly while reads, watches and lease keep alives are still
+// served. Writes hold the read lock for as long as they run, so switching
+// modes, which takes the write lock, waits for the writes in flight to
+// finish, and writes that arrive meanwhile wait for the switch. A write is
+// thus either rejected before it starts or applied in full.
+type readOnly struct {
+	sync.RWMutex
+	enabled bool
+}
+
+// begin returns ErrReadOnly in read-only mode. Otherwise it returns the func
+// that ends the write, which must be called once the write is done.
+func (r *readOnly) begin() (func(), error) {
+	r.RLock()
+	if r.enabled {
+		r.RUnlock()
+		return nil, ErrReadOnly
+	}
+	return r.RUnlock, nil
+}
+
+func (r *readOnly) set(enabled bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.enabled = enabled
+}
+
+func (r *readOnly) get() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.enabled
+}
+
+// hasWrite reports whether a transaction may put or delete a key.
+func hasWrite(txn *etcdserverpb.TxnRequest) bool {
+	for _, ops := range [][]*etcdserverpb.RequestOp{txn.Success, txn.Failure} {
+		for _, op := range ops {
+			if op.GetRequestRange() == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetReadOnly switches the server in or out of read-only mode. It returns
+// once the writes in flight are done, after which the writes of read-only
+// mode are all rejected.
+func (k *KVServerBridge) SetReadOnly(enabled bool) {
+	k.limited.readOnly.set(enabled)
+	if enabled {
+		k.config.Logger.Warnf("Kine is read-only, writes are rejected")
+	} else {
+		k.config.Logger.Infof("Kine is no longer read-only, writes are accepted")
+	}
+}
+
+// ReadOnly reports whether the server is in read-only mode.
+func (k *KVServerBridge) ReadOnly() bool {
+	return k.limited.readOnly.get()
+}
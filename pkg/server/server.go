@@ -3,13 +3,17 @@ package server
 import (
 	"context"
 	"fmt"
+	"math"
+	"sync"
+	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/logging"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/health"
-	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -17,15 +21,147 @@ var (
 	_ etcdserverpb.WatchServer = (*KVServerBridge)(nil)
 )
 
+const (
+	defaultNotifyInterval   = 5 * time.Second
+	defaultMaxResponseBytes = 1.5 * 1024 * 1024
+	defaultMemberName       = "default"
+)
+
+// DefaultMaxRequestBytes is the size of the largest request accepted when
+// none is configured, which is the default of etcd that the apiserver sizes
+// its writes for.
+const DefaultMaxRequestBytes = 1.5 * 1024 * 1024
+
+// Config holds the settings of the server.
+type Config struct {
+	// NotifyInterval is the interval between progress notifications on
+	// watches that requested them. Defaults to 5 seconds.
+	NotifyInterval time.Duration
+	// MaxResponseBytes is the size above which watch responses are split
+	// into fragments, on watches that allow it. Defaults to 1.5 MiB.
+	MaxResponseBytes int
+	// MaxRequestBytes is the size above which write requests are rejected
+	// with ErrRequestTooLarge. Defaults to DefaultMaxRequestBytes, and sizes
+	// are not limited if it is negative.
+	MaxRequestBytes int
+	// QuotaBackendBytes is the size of the database above which the NOSPACE
+	// alarm is raised and writes are rejected. Zero disables the quota.
+	QuotaBackendBytes int64
+	// ReadOnly starts the server in read-only mode, in which writes are
+	// rejected with ErrReadOnly until SetReadOnly switches it out of it.
+	ReadOnly bool
+	// DisableWatchSharing gives every watch a watch of the backend of its
+	// own, rather than sharing one between the watches of the same key and
+	// filters.
+	DisableWatchSharing bool
+	// MaxConcurrentLists is the number of expensive lists that run at once,
+	// or zero to not limit them. Lists are expensive if they are of whole
+	// ranges, or have limits above ListLimitThreshold, which defaults to 500;
+	// point reads, counts and smaller lists are never limited. Expensive
+	// lists over the limit wait for up to ListQueueTimeout, 5 seconds by
+	// default, before they fail with ErrTooManyLists.
+	MaxConcurrentLists int
+	ListQueueTimeout   time.Duration
+	ListLimitThreshold int64
+	// ListRateLimit is the number of expensive lists per second that each
+	// client, known by the common name of its certificate or else by its
+	// host, may start, in bursts of up to ListRateBurst. Lists over the rate
+	// fail with ErrListRateLimited. Their rate is not limited when it is
+	// zero. ListRateBurst defaults to the rate, and to at least one list.
+	ListRateLimit float64
+	ListRateBurst int
+	// MemberName, PeerURLs and ClientURLs describe the member kine reports
+	// as the only one of its cluster. MemberName defaults to "default".
+	MemberName string
+	PeerURLs   []string
+	ClientURLs []string
+	// HealthCheckInterval is the interval between probes of the backend by
+	// HealthCheck, and HealthCheckTimeout the time a probe may take before
+	// the backend is reported as not serving. They default to 5 seconds and
+	// 1 second.
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	// MetricsRegisterer is the registerer that the metrics of the rpcs and of
+	// the backend are registered with. They are collected by the interceptors
+	// of the bridge. Metrics are not registered when it is nil.
+	MetricsRegisterer prometheus.Registerer
+	// TracerProvider provides the tracer that ranges and transactions are
+	// traced with. They are not traced when it is nil.
+	TracerProvider trace.TracerProvider
+	// Logger is the logger of the server. Defaults to the standard logger
+	// of logrus.
+	Logger logging.Logger
+}
+
 type KVServerBridge struct {
 	limited *LimitedServer
+	config  Config
+	metrics *serverMetrics
+	// watchMux shares the watches of the backend between watch streams.
+	watchMux *watchMux
+
+	stopWatches sync.Once
+	// watchesStopped is closed once watch streams are to be ended.
+	watchesStopped chan struct{}
 }
 
-func New(backend Backend) *KVServerBridge {
+// WithDefaults returns the config with the settings that are not set
+// replaced by their defaults, as the server runs with it.
+func (c Config) WithDefaults() Config {
+	if c.NotifyInterval <= 0 {
+		c.NotifyInterval = defaultNotifyInterval
+	}
+	if c.MaxResponseBytes <= 0 {
+		c.MaxResponseBytes = defaultMaxResponseBytes
+	}
+	if c.MaxRequestBytes == 0 {
+		c.MaxRequestBytes = DefaultMaxRequestBytes
+	}
+	c.Logger = logging.OrDefault(c.Logger)
+	if c.MemberName == "" {
+		c.MemberName = defaultMemberName
+	}
+	if c.HealthCheckInterval <= 0 {
+		c.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if c.HealthCheckTimeout <= 0 {
+		c.HealthCheckTimeout = defaultHealthCheckTimeout
+	}
+	if c.ListQueueTimeout <= 0 {
+		c.ListQueueTimeout = defaultListQueueTimeout
+	}
+	if c.ListLimitThreshold <= 0 {
+		c.ListLimitThreshold = defaultListLimitThreshold
+	}
+	if c.ListRateLimit > 0 && c.ListRateBurst <= 0 {
+		c.ListRateBurst = int(math.Ceil(c.ListRateLimit))
+	}
+	return c
+}
+
+func New(backend Backend, config Config) *KVServerBridge {
+	config = config.WithDefaults()
+	var tracer trace.Tracer
+	if config.TracerProvider != nil {
+		tracer = config.TracerProvider.Tracer(TracerName)
+	}
 	return &KVServerBridge{
 		limited: &LimitedServer{
 			backend: backend,
+			quota: &quota{
+				backend: backend,
+				limit:   config.QuotaBackendBytes,
+				logger:  config.Logger,
+			},
+			readOnly:        &readOnly{enabled: config.ReadOnly},
+			maxRequestBytes: config.MaxRequestBytes,
+			tracer:          tracer,
+			lists:           newListLimiter(config.Logger, config.MetricsRegisterer, config),
 		},
+		config:         config,
+		metrics:        newServerMetrics(config.Logger, config.MetricsRegisterer, backend),
+		watchMux:       newWatchMux(backend, config.DisableWatchSharing),
+		watchesStopped: make(chan struct{}),
 	}
 }
 
@@ -34,67 +170,45 @@ func (k *KVServerBridge) Register(server *grpc.Server) {
 	etcdserverpb.RegisterWatchServer(server, k)
 	etcdserverpb.RegisterKVServer(server, k)
 	etcdserverpb.RegisterMaintenanceServer(server, k)
-
-	hsrv := health.NewServer()
-	hsrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
-	healthpb.RegisterHealthServer(server, hsrv)
+	etcdserverpb.RegisterClusterServer(server, k)
 }
 
 func (k *KVServerBridge) Range(ctx context.Context, r *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
-	if r.KeysOnly {
-		return nil, unsupported("keysOnly")
+	if err := checkRange(r); err != nil {
+		return nil, err
 	}
 
-	if r.MaxCreateRevision != 0 {
-		return nil, unsupported("maxCreateRevision")
+	start := time.Now()
+	resp, err := k.limited.Range(ctx, r)
+	if err != nil {
+		if err != ErrCompacted && err != ErrFutureRev {
+			k.logRequest("Range", r.Key, r.Revision, start, err)
+		}
+		return nil, err
 	}
 
+	return toRangeResponse(resp), nil
+}
+
+func checkRange(r *etcdserverpb.RangeRequest) error {
 	if r.SortOrder != 0 {
-		return nil, unsupported("sortOrder")
+		return unsupported("sortOrder")
 	}
 
 	if r.SortTarget != 0 {
-		return nil, unsupported("sortTarget")
-	}
-
-	if r.Serializable {
-		return nil, unsupported("serializable")
-	}
-
-	if r.KeysOnly {
-		return nil, unsupported("keysOnly")
-	}
-
-	if r.MinModRevision != 0 {
-		return nil, unsupported("minModRevision")
-	}
-
-	if r.MinCreateRevision != 0 {
-		return nil, unsupported("minCreateRevision")
-	}
-
-	if r.MaxCreateRevision != 0 {
-		return nil, unsupported("maxCreateRevision")
-	}
-
-	if r.MaxModRevision != 0 {
-		return nil, unsupported("maxModRevision")
+		return unsupported("sortTarget")
 	}
 
-	resp, err := k.limited.Range(ctx, r)
-	if err != nil {
-		logrus.Errorf("error while range on %s %s: %v", r.Key, r.RangeEnd, err)
-		return nil, err
-	}
+	return nil
+}
 
-	rangeResponse := &etcdserverpb.RangeResponse{
+func toRangeResponse(resp *RangeResponse) *etcdserverpb.RangeResponse {
+	return &etcdserverpb.RangeResponse{
 		More:   resp.More,
 		Count:  resp.Count,
 		Header: resp.Header,
 		Kvs:    toKVs(resp.Kvs...),
 	}
-
-	return rangeResponse, nil
 }
 
 func toKVs(kvs ...*KeyValue) []*mvccpb.KeyValue {
@@ -122,33 +236,125 @@ func toKV(kv *KeyValue) *mvccpb.KeyValue {
 		Lease:          kv.Lease,
 		CreateRevision: kv.CreateRevision,
 		ModRevision:    kv.ModRevision,
+		Version:        kv.Version,
 	}
 }
 
+// Put writes a key, creating it if it does not exist, as a transaction of the
+// put alone.
 func (k *KVServerBridge) Put(ctx context.Context, r *etcdserverpb.PutRequest) (*etcdserverpb.PutResponse, error) {
-	return nil, fmt.Errorf("put is not supported")
+	start := time.Now()
+	res, err := k.limited.Txn(ctx, &etcdserverpb.TxnRequest{
+		Success: []*etcdserverpb.RequestOp{
+			{
+				Request: &etcdserverpb.RequestOp_RequestPut{
+					RequestPut: r,
+				},
+			},
+		},
+	})
+	if err != nil {
+		k.logRequest("Put", r.Key, 0, start, err)
+		return nil, err
+	}
+
+	resp := res.Responses[0].GetResponsePut()
+	resp.Header = res.Header
+	return resp, nil
 }
 
+// DeleteRange deletes a key, or all keys in a range, as a transaction of the
+// delete alone. Deleting keys that do not exist succeeds with none deleted.
 func (k *KVServerBridge) DeleteRange(ctx context.Context, r *etcdserverpb.DeleteRangeRequest) (*etcdserverpb.DeleteRangeResponse, error) {
-	return nil, fmt.Errorf("delete is not supported")
+	start := time.Now()
+	res, err := k.limited.Txn(ctx, &etcdserverpb.TxnRequest{
+		Success: []*etcdserverpb.RequestOp{
+			{
+				Request: &etcdserverpb.RequestOp_RequestDeleteRange{
+					RequestDeleteRange: r,
+				},
+			},
+		},
+	})
+	if err != nil {
+		k.logRequest("DeleteRange", r.Key, 0, start, err)
+		return nil, err
+	}
+
+	resp := res.Responses[0].GetResponseDeleteRange()
+	resp.Header = res.Header
+	return resp, nil
 }
 
 func (k *KVServerBridge) Txn(ctx context.Context, r *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	start := time.Now()
 	res, err := k.limited.Txn(ctx, r)
 	if err != nil {
-		logrus.Errorf("error in txn: %v", err)
+		k.logRequest("Txn", txnKey(r), 0, start, err)
 	}
 	return res, err
 }
 
 func (k *KVServerBridge) Compact(ctx context.Context, r *etcdserverpb.CompactionRequest) (*etcdserverpb.CompactionResponse, error) {
+	end, err := k.limited.readOnly.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	start := time.Now()
+	rev, err := k.limited.backend.Compact(ctx, r.Revision)
+	if err != nil {
+		if err != ErrCompacted && err != ErrFutureRev {
+			k.logRequest("Compact", nil, r.Revision, start, err)
+		}
+		return nil, err
+	}
+
 	return &etcdserverpb.CompactionResponse{
-		Header: &etcdserverpb.ResponseHeader{
-			Revision: r.Revision,
-		},
+		Header: txnHeader(rev),
 	}, nil
 }
 
+// logRequest logs the request to the rpc that failed with err, with the
+// prefix of its key, its revision, how long it took and the code of the
+// error as fields. The values of the keys are never logged.
+func (k *KVServerBridge) logRequest(rpc string, key []byte, revision int64, start time.Time, err error) {
+	fields := logging.Fields{
+		"rpc":      rpc,
+		"duration": time.Since(start).Seconds(),
+		"error":    err,
+		"code":     status.Code(err).String(),
+	}
+	if key != nil {
+		fields["key"] = logging.KeyPrefix(string(key))
+	}
+	if revision != 0 {
+		fields["revision"] = revision
+	}
+	logging.WithFields(k.config.Logger, fields).Errorf("%s request failed", rpc)
+}
+
+// txnKey returns the key of the first comparison or operation of the
+// transaction, which is the key that the transactions of the apiserver are
+// about.
+func txnKey(r *etcdserverpb.TxnRequest) []byte {
+	if len(r.Compare) > 0 {
+		return r.Compare[0].Key
+	}
+	for _, op := range r.Success {
+		switch {
+		case op.GetRequestRange() != nil:
+			return op.GetRequestRange().Key
+		case op.GetRequestPut() != nil:
+			return op.GetRequestPut().Key
+		case op.GetRequestDeleteRange() != nil:
+			return op.GetRequestDeleteRange().Key
+		}
+	}
+	return nil
+}
+
 func unsupported(field string) error {
 	return fmt.Errorf("%s is unsupported", field)
 }
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer of the spans of the server.
+const TracerName = "github.com/rancher/kine/pkg/server"
+
+// The spans are only started when the server has a tracer, so that serving
+// without tracing does not pay for building their attributes.
+
+func (l *LimitedServer) Range(ctx context.Context, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
+	if l.tracer == nil {
+		return l.handleRange(ctx, r)
+	}
+
+	ctx, span := l.tracer.Start(ctx, "Range", trace.WithAttributes(
+		attribute.String("kine.key", string(r.Key)),
+		attribute.String("kine.range_end", string(r.RangeEnd)),
+		attribute.Int64("kine.revision", r.Revision),
+		attribute.Int64("kine.limit", r.Limit),
+		attribute.Bool("kine.count_only", r.CountOnly),
+	))
+	resp, err := l.handleRange(ctx, r)
+	if err == nil {
+		span.SetAttributes(
+			attribute.Int64("kine.response.revision", resp.Header.Revision),
+			attribute.Int("kine.response.kvs", len(resp.Kvs)),
+			attribute.Int64("kine.response.count", resp.Count),
+		)
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+func (l *LimitedServer) Txn(ctx context.Context, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	if l.tracer == nil {
+		return l.handleTxn(ctx, txn)
+	}
+
+	attrs := []attribute.KeyValue{
+		attribute.Int("kine.compares", len(txn.Compare)),
+		attribute.Int("kine.success_ops", len(txn.Success)),
+		attribute.Int("kine.failure_ops", len(txn.Failure)),
+	}
+	if len(txn.Compare) > 0 {
+		attrs = append(attrs, attribute.String("kine.key", string(txn.Compare[0].Key)))
+	}
+	ctx, span := l.tracer.Start(ctx, "Txn", trace.WithAttributes(attrs...))
+	resp, err := l.handleTxn(ctx, txn)
+	if err == nil {
+		span.SetAttributes(
+			attribute.Int64("kine.response.revision", resp.Header.Revision),
+			attribute.Bool("kine.response.succeeded", resp.Succeeded),
+		)
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+// endSpan records the error, if any, on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// txnAttempts is how often a transaction is run before a conflict of its
+// writes with concurrent writes of the same keys is returned. Each run
+// compares against the keys as the concurrent writes left them, so the
+// compares of the next run usually fail instead.
+const txnAttempts = 5
+
+// errConflict is returned by the writes of a transaction to keys that were
+// written concurrently after the compares were evaluated.
+var errConflict = errors.New("modified concurrently")
+
+// unsupportedTxn returns the error for a transaction that uses a feature kine
+// does not implement.
+func unsupportedTxn(format string, args ...interface{}) error {
+	return status.Errorf(codes.Unimplemented, "unsupported transaction: "+format, args...)
+}
+
+// checkTxn verifies that all compares and ops of a transaction are supported
+// before anything is executed.
+func checkTxn(txn *etcdserverpb.TxnRequest) error {
+	for _, cmp := range txn.Compare {
+		if len(cmp.RangeEnd) != 0 {
+			return unsupportedTxn("compare with range end")
+		}
+		switch cmp.Target {
+		case etcdserverpb.Compare_VERSION, etcdserverpb.Compare_CREATE, etcdserverpb.Compare_MOD,
+			etcdserverpb.Compare_VALUE, etcdserverpb.Compare_LEASE:
+		default:
+			return unsupportedTxn("compare target %s", cmp.Target)
+		}
+	}
+
+	for _, ops := range [][]*etcdserverpb.RequestOp{txn.Success, txn.Failure} {
+		puts := map[string]bool{}
+		for _, op := range ops {
+			switch {
+			case op.GetRequestRange() != nil:
+				if err := checkRange(op.GetRequestRange()); err != nil {
+					return unsupportedTxn("range: %v", err)
+				}
+			case op.GetRequestPut() != nil:
+				put := op.GetRequestPut()
+				if put.IgnoreLease {
+					return unsupportedTxn("put with ignoreLease")
+				} else if put.IgnoreValue {
+					return unsupportedTxn("put with ignoreValue")
+				}
+				if puts[string(put.Key)] {
+					return ErrKeyExists
+				}
+				puts[string(put.Key)] = true
+			case op.GetRequestDeleteRange() != nil:
+			case op.GetRequestTxn() != nil:
+				return unsupportedTxn("nested transaction")
+			default:
+				return unsupportedTxn("empty operation")
+			}
+		}
+	}
+
+	return nil
+}
+
+// txn executes a transaction that does not have one of the shapes used by
+// the apiserver. The compares are evaluated and the ops of the success or
+// failure branch are executed in order, all in a single backend transaction, so that every
+// write gets its own consecutive revision and is either applied with the
+// others or not at all. A transaction whose writes conflict with concurrent
+// writes is run again, as if it had been run after them.
+func (l *LimitedServer) txn(ctx context.Context, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	if err := checkTxn(txn); err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := l.runTxn(ctx, txn)
+		if attempt == txnAttempts || !(errors.Is(err, ErrKeyExists) || errors.Is(err, errConflict)) {
+			return resp, err
+		}
+	}
+}
+
+// runTxn runs a checked transaction once in a backend transaction.
+func (l *LimitedServer) runTxn(ctx context.Context, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	var resp *etcdserverpb.TxnResponse
+	err := l.backend.Txn(ctx, func(ctx context.Context) error {
+		rev, succeeded, err := l.compare(ctx, txn.Compare)
+		if err != nil {
+			return err
+		}
+
+		resp = &etcdserverpb.TxnResponse{
+			Succeeded: succeeded,
+		}
+
+		ops := txn.Success
+		if !succeeded {
+			ops = txn.Failure
+		}
+
+		for _, op := range ops {
+			opRev, opResp, err := l.op(ctx, op)
+			if err != nil {
+				return err
+			}
+			if opRev > rev {
+				rev = opRev
+			}
+			resp.Responses = append(resp.Responses, opResp)
+		}
+
+		resp.Header = txnHeader(rev)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// compare evaluates all compares of a transaction against the current state
+// of their keys, returning the current revision and whether all compares
+// succeeded.
+func (l *LimitedServer) compare(ctx context.Context, compares []*etcdserverpb.Compare) (int64, bool, error) {
+	var (
+		rev       int64
+		succeeded = true
+	)
+
+	for _, cmp := range compares {
+		getRev, kv, err := l.backend.Get(ctx, string(cmp.Key), "", 1, 0)
+		if err != nil {
+			return 0, false, err
+		}
+		if getRev > rev {
+			rev = getRev
+		}
+
+		ok, err := l.compareKV(ctx, cmp, kv)
+		if err != nil {
+			return 0, false, err
+		}
+		if !ok {
+			succeeded = false
+		}
+	}
+
+	return rev, succeeded, nil
+}
+
+// compareKV evaluates a single compare against the current value of its key.
+// As in etcd, a missing key has zero version and revisions, and comparing the
+// value of a missing key always fails.
+func (l *LimitedServer) compareKV(ctx context.Context, cmp *etcdserverpb.Compare, kv *KeyValue) (bool, error) {
+	if kv == nil {
+		if cmp.Target == etcdserverpb.Compare_VALUE {
+			return false, nil
+		}
+		kv = &KeyValue{}
+	}
+
+	switch cmp.Target {
+	case etcdserverpb.Compare_VERSION:
+		var version int64
+		if kv.ModRevision != 0 {
+			v, err := l.backend.Version(ctx, kv.Key)
+			if err != nil {
+				return false, err
+			}
+			version = v
+		}
+		return compareInt64(cmp.Result, version, cmp.GetVersion()), nil
+	case etcdserverpb.Compare_CREATE:
+		return compareInt64(cmp.Result, kv.CreateRevision, cmp.GetCreateRevision()), nil
+	case etcdserverpb.Compare_MOD:
+		return compareInt64(cmp.Result, kv.ModRevision, cmp.GetModRevision()), nil
+	case etcdserverpb.Compare_VALUE:
+		return compareInt64(cmp.Result, int64(bytes.Compare(kv.Value, cmp.GetValue())), 0), nil
+	case etcdserverpb.Compare_LEASE:
+		return compareInt64(cmp.Result, kv.Lease, cmp.GetLease()), nil
+	}
+	return false, unsupportedTxn("compare target %s", cmp.Target)
+}
+
+func compareInt64(result etcdserverpb.Compare_CompareResult, actual, expected int64) bool {
+	switch result {
+	case etcdserverpb.Compare_EQUAL:
+		return actual == expected
+	case etcdserverpb.Compare_NOT_EQUAL:
+		return actual != expected
+	case etcdserverpb.Compare_GREATER:
+		return actual > expected
+	case etcdserverpb.Compare_LESS:
+		return actual < expected
+	}
+	return false
+}
+
+// op executes a single op of a transaction, returning the revision after the
+// op and its response.
+func (l *LimitedServer) op(ctx context.Context, op *etcdserverpb.RequestOp) (int64, *etcdserverpb.ResponseOp, error) {
+	switch {
+	case op.GetRequestRange() != nil:
+		resp, err := l.Range(ctx, op.GetRequestRange())
+		if err != nil {
+			return 0, nil, err
+		}
+		return resp.Header.Revision, &etcdserverpb.ResponseOp{
+			Response: &etcdserverpb.ResponseOp_ResponseRange{
+				ResponseRange: toRangeResponse(resp),
+			},
+		}, nil
+	case op.GetRequestPut() != nil:
+		put := op.GetRequestPut()
+		rev, prevKV, err := l.put(ctx, put)
+		if err != nil {
+			return 0, nil, err
+		}
+		resp := &etcdserverpb.PutResponse{
+			Header: txnHeader(rev),
+		}
+		if put.PrevKv {
+			resp.PrevKv = toKV(prevKV)
+		}
+		return rev, &etcdserverpb.ResponseOp{
+			Response: &etcdserverpb.ResponseOp_ResponsePut{
+				ResponsePut: resp,
+			},
+		}, nil
+	case op.GetRequestDeleteRange() != nil:
+		r := op.GetRequestDeleteRange()
+		rev, prevKVs, err := l.deleteRange(ctx, r)
+		if err != nil {
+			return 0, nil, err
+		}
+		resp := &etcdserverpb.DeleteRangeResponse{
+			Header:  txnHeader(rev),
+			Deleted: int64(len(prevKVs)),
+		}
+		if r.PrevKv {
+			resp.PrevKvs = toKVs(prevKVs...)
+		}
+		return rev, &etcdserverpb.ResponseOp{
+			Response: &etcdserverpb.ResponseOp_ResponseDeleteRange{
+				ResponseDeleteRange: resp,
+			},
+		}, nil
+	}
+	return 0, nil, unsupportedTxn("empty operation")
+}
+
+// put writes a key, creating it if it does not exist. The previous value of
+// the key is returned, or nil if the key was created.
+func (l *LimitedServer) put(ctx context.Context, put *etcdserverpb.PutRequest) (int64, *KeyValue, error) {
+	key := string(put.Key)
+	_, kv, err := l.backend.Get(ctx, key, "", 1, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if kv == nil {
+		rev, err := l.backend.Create(ctx, key, put.Value, put.Lease)
+		return rev, nil, err
+	}
+
+	rev, prevKV, ok, err := l.backend.Update(ctx, key, put.Value, kv.ModRevision, put.Lease)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !ok {
+		return 0, nil, fmt.Errorf("key %s was %w", key, errConflict)
+	}
+	return rev, prevKV, nil
+}
+
+// deleteRange deletes a key, or all keys in a range, returning the deleted
+// keys in key order. The keys of a range are deleted by the backend at once,
+// each with a delete event of its own.
+func (l *LimitedServer) deleteRange(ctx context.Context, r *etcdserverpb.DeleteRangeRequest) (int64, []*KeyValue, error) {
+	if len(r.RangeEnd) == 0 {
+		rev, prevKV, err := l.deleteKey(ctx, string(r.Key))
+		if err != nil || prevKV == nil {
+			return rev, nil, err
+		}
+		return rev, []*KeyValue{prevKV}, nil
+	}
+
+	prefix, start, inclusive := listRange(&etcdserverpb.RangeRequest{Key: r.Key, RangeEnd: r.RangeEnd})
+	var (
+		startRev int64
+		prevKVs  []*KeyValue
+	)
+	if inclusive {
+		rev, prevKV, err := l.deleteKey(ctx, start)
+		if err != nil {
+			return 0, nil, err
+		}
+		startRev = rev
+		if prevKV != nil {
+			prevKVs = append(prevKVs, prevKV)
+		}
+	}
+
+	rev, kvs, err := l.backend.DeleteRange(ctx, prefix, start)
+	if err != nil {
+		return 0, nil, err
+	}
+	if startRev > rev {
+		rev = startRev
+	}
+	return rev, append(prevKVs, kvs...), nil
+}
+
+// deleteKey deletes a single key, returning its deleted key value, or nil if
+// it did not exist.
+func (l *LimitedServer) deleteKey(ctx context.Context, key string) (int64, *KeyValue, error) {
+	rev, prevKV, ok, err := l.backend.Delete(ctx, key, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !ok {
+		return 0, nil, fmt.Errorf("key %s was %w", key, errConflict)
+	}
+	return rev, prevKV, nil
+}
@@ -2,13 +2,47 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
 
 	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
-	ErrKeyExists = rpctypes.ErrGRPCDuplicateKey
-	ErrCompacted = rpctypes.ErrGRPCCompacted
+	ErrKeyExists       = rpctypes.ErrGRPCDuplicateKey
+	ErrCompacted       = rpctypes.ErrGRPCCompacted
+	ErrFutureRev       = rpctypes.ErrGRPCFutureRev
+	ErrLeaseExist      = rpctypes.ErrGRPCLeaseExist
+	ErrLeaseNotFound   = rpctypes.ErrGRPCLeaseNotFound
+	ErrNoSpace         = rpctypes.ErrGRPCNoSpace
+	ErrStopped         = rpctypes.ErrGRPCStopped
+	ErrRequestTooLarge = rpctypes.ErrGRPCRequestTooLarge
+
+	// ErrWatchTooSlow is the reason a watch is canceled when it falls too far
+	// behind the events it watches.
+	ErrWatchTooSlow = errors.New("watch canceled: too slow to keep up with events")
+
+	// ErrStatementTimeout is returned when a database statement runs longer
+	// than the timeout of its kind.
+	ErrStatementTimeout = status.Error(codes.DeadlineExceeded, "kine: database statement timed out")
+
+	// ErrReadOnly is returned for writes while kine is in read-only mode.
+	ErrReadOnly = status.Error(codes.FailedPrecondition, "kine: read-only mode, writes are rejected")
+
+	// ErrTooManyLists is returned for expensive lists that found no slot of
+	// the limit of concurrent lists in time, and ErrListRateLimited for those
+	// over the rate limit of their client.
+	ErrTooManyLists    = status.Error(codes.ResourceExhausted, "kine: too many expensive lists in flight")
+	ErrListRateLimited = status.Error(codes.ResourceExhausted, "kine: list rate limit of the client exceeded")
+
+	// ErrQuiesced is returned when writes are quiesced while they already
+	// are, and ErrNotQuiesced when they are resumed while they are not.
+	ErrQuiesced    = status.Error(codes.FailedPrecondition, "kine: writes are quiesced already")
+	ErrNotQuiesced = status.Error(codes.FailedPrecondition, "kine: writes are not quiesced")
 )
 
 type Backend interface {
@@ -16,11 +50,39 @@ type Backend interface {
 	Get(ctx context.Context, key, rangeEnd string, limit, revision int64) (int64, *KeyValue, error)
 	Create(ctx context.Context, key string, value []byte, lease int64) (int64, error)
 	Delete(ctx context.Context, key string, revision int64) (int64, *KeyValue, bool, error)
-	List(ctx context.Context, prefix, startKey string, limit, revision int64) (int64, []*KeyValue, error)
-	Count(ctx context.Context, prefix string) (int64, int64, error)
+	DeleteRange(ctx context.Context, prefix, startKey string) (int64, []*KeyValue, error)
+	List(ctx context.Context, prefix, startKey string, limit, revision int64, keysOnly bool, filter RevisionFilter) (int64, []*KeyValue, error)
+	Count(ctx context.Context, prefix, startKey string, revision int64, filter RevisionFilter) (int64, int64, error)
 	Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *KeyValue, bool, error)
-	Watch(ctx context.Context, key string, revision int64) <-chan []*Event
+	Watch(ctx context.Context, key string, revision int64) <-chan WatchEvents
 	DbSize(ctx context.Context) (int64, error)
+	DbSizeInUse(ctx context.Context) (int64, error)
+	Defragment(ctx context.Context) error
+	Snapshot(ctx context.Context, w io.Writer) error
+	Restore(ctx context.Context, r io.Reader, force bool) error
+	// Quiesce holds all writes, once those in flight have committed and the
+	// database is flushed to its files, until Resume is called or the
+	// quiesce timeout has passed, so that the files can be copied while
+	// reads and watches go on.
+	Quiesce(ctx context.Context) error
+	Resume() error
+	Close() error
+	CurrentRevision(ctx context.Context) (int64, error)
+	CompactRevision(ctx context.Context) (int64, error)
+	Compact(ctx context.Context, revision int64) (int64, error)
+	LeaseGrant(ctx context.Context, id, ttl int64) (int64, error)
+	LeaseKeepAlive(ctx context.Context, id int64) (int64, error)
+	LeaseTimeToLive(ctx context.Context, id int64, keys bool) (int64, int64, []string, error)
+	LeaseRevoke(ctx context.Context, id int64) (int64, error)
+	Leases(ctx context.Context) ([]*Lease, error)
+	RaiseRevision(ctx context.Context, revision int64) (int64, error)
+	History(ctx context.Context, key string, revision int64, values bool) (int64, int64, []*KeyRevision, error)
+	Verify(ctx context.Context, repair bool) ([]Inconsistency, error)
+	GC(ctx context.Context, dryRun bool) ([]Garbage, error)
+	PrefixStats(ctx context.Context) ([]PrefixStat, error)
+	Txn(ctx context.Context, fn func(ctx context.Context) error) error
+	Version(ctx context.Context, key string) (int64, error)
+	VersionOf(ctx context.Context, kv *KeyValue) (int64, error)
 }
 
 type KeyValue struct {
@@ -29,6 +91,252 @@ type KeyValue struct {
 	ModRevision    int64
 	Value          []byte
 	Lease          int64
+	// Version is the number of writes to the key since it was created, as
+	// of ModRevision. It is only set on the key values of gets and lists.
+	Version int64
+}
+
+// KeyRevision is a revision of a key that the backend stores, as History
+// returns it.
+type KeyRevision struct {
+	Revision       int64
+	CreateRevision int64
+	PrevRevision   int64
+	Create         bool
+	Delete         bool
+	Lease          int64
+	// ValueSize is the size of the value as it is stored, which is its
+	// compressed size if it was compressed.
+	ValueSize int64
+	// Value is only set if History is asked for the values.
+	Value []byte
+}
+
+// InconsistencyKind is the kind of an Inconsistency.
+type InconsistencyKind string
+
+const (
+	// InconsistencyMissingPrev is an update or delete of a key that follows
+	// a revision that is not stored, although it is above the compact
+	// revision.
+	InconsistencyMissingPrev InconsistencyKind = "missing-prev-revision"
+	// InconsistencyOrphanedTombstone is a delete of a key that follows a
+	// revision that is not stored, of a key with no earlier revision stored.
+	// The key is missing whether or not the delete is stored, so it is the
+	// one kind that Verify repairs, by deleting the delete.
+	InconsistencyOrphanedTombstone InconsistencyKind = "orphaned-tombstone"
+	// InconsistencyOtherKey is an update or delete that follows a revision
+	// of another key.
+	InconsistencyOtherKey InconsistencyKind = "prev-revision-of-other-key"
+	// InconsistencyAfterDelete is an update or delete that follows a delete.
+	InconsistencyAfterDelete InconsistencyKind = "follows-delete"
+	// InconsistencyCreateOverKey is a create that follows a revision at
+	// which the key exists.
+	InconsistencyCreateOverKey InconsistencyKind = "create-over-existing-key"
+	// InconsistencyCreatedAndDeleted is a revision flagged as both a create
+	// and a delete.
+	InconsistencyCreatedAndDeleted InconsistencyKind = "created-and-deleted"
+	// InconsistencyFork is a revision that follows the same revision as an
+	// earlier one of the key, so that the key has two heads.
+	InconsistencyFork InconsistencyKind = "forked-revisions"
+	// InconsistencyCompactRevision is a compact revision above the current
+	// revision.
+	InconsistencyCompactRevision InconsistencyKind = "compact-revision-ahead"
+)
+
+// Inconsistency is a revision that the backend stores that does not fit the
+// history of its key, as Verify reports it.
+type Inconsistency struct {
+	Kind InconsistencyKind
+	Key  string
+	// Revision is the revision that does not fit, and PrevRevision the
+	// revision it follows. Other is the earlier revision that a fork follows
+	// the same revision as. For a compact revision ahead, Revision is the
+	// compact revision and PrevRevision the current revision.
+	Revision     int64
+	PrevRevision int64
+	Other        int64
+	// Repaired is set once Verify has repaired the inconsistency.
+	Repaired bool
+}
+
+func (i Inconsistency) String() string {
+	var problem string
+	switch i.Kind {
+	case InconsistencyMissingPrev:
+		problem = fmt.Sprintf("revision %d follows revision %d, which is not stored", i.Revision, i.PrevRevision)
+	case InconsistencyOrphanedTombstone:
+		problem = fmt.Sprintf("revision %d deletes the key, which has no earlier revision stored", i.Revision)
+	case InconsistencyOtherKey:
+		problem = fmt.Sprintf("revision %d follows revision %d, which is of another key", i.Revision, i.PrevRevision)
+	case InconsistencyAfterDelete:
+		problem = fmt.Sprintf("revision %d writes the key after its delete at revision %d", i.Revision, i.PrevRevision)
+	case InconsistencyCreateOverKey:
+		problem = fmt.Sprintf("revision %d creates the key, which exists at revision %d", i.Revision, i.PrevRevision)
+	case InconsistencyCreatedAndDeleted:
+		problem = fmt.Sprintf("revision %d is both a create and a delete", i.Revision)
+	case InconsistencyFork:
+		problem = fmt.Sprintf("revisions %d and %d both follow revision %d", i.Other, i.Revision, i.PrevRevision)
+	case InconsistencyCompactRevision:
+		problem = fmt.Sprintf("the compact revision %d is above the current revision %d", i.Revision, i.PrevRevision)
+	default:
+		problem = fmt.Sprintf("revision %d is inconsistent: %s", i.Revision, i.Kind)
+	}
+	if i.Repaired {
+		problem += " (repaired)"
+	}
+	if i.Key == "" {
+		return problem
+	}
+	return fmt.Sprintf("%s: %s", i.Key, problem)
+}
+
+// GarbageKind is the kind of the rows of a Garbage.
+type GarbageKind string
+
+const (
+	// GarbageTombstone is a delete at or below the compact revision.
+	GarbageTombstone GarbageKind = "tombstone"
+	// GarbageSuperseded is a revision at or below the compact revision that
+	// a later revision of its key, also at or below it, supersedes, as when
+	// compaction removed the revision that followed it but not it.
+	GarbageSuperseded GarbageKind = "superseded"
+	// GarbageDeletedKey is a revision of a key whose last revision at or
+	// below the compact revision is a delete, so that its whole history up
+	// to the compact revision was deleted.
+	GarbageDeletedKey GarbageKind = "deleted-key"
+)
+
+// Garbage is the rows of a kind that no read can return any more, which
+// compaction should have removed but that interrupted compactions and
+// crashes may leave behind, as GC reports them.
+type Garbage struct {
+	Kind GarbageKind
+	// Rows is the number of rows, and Bytes an estimate of the space they
+	// take, from the sizes of their keys and values.
+	Rows  int64
+	Bytes int64
+	// Removed is set once GC has removed the rows.
+	Removed bool
+}
+
+func (g Garbage) String() string {
+	s := fmt.Sprintf("%s: %d rows, %d bytes", g.Kind, g.Rows, g.Bytes)
+	if g.Removed {
+		s += " (removed)"
+	}
+	return s
+}
+
+// PrefixStat is the share of the keyspace of a prefix of the first two
+// segments of keys, such as /registry/pods/, as PrefixStats reports it. Keys
+// with fewer segments share the empty prefix.
+type PrefixStat struct {
+	Prefix string `json:"prefix"`
+	// Keys is the number of live keys, and Bytes the size of their values.
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+	// Rows is the number of stored rows, the history and deletes of keys
+	// included, and RowBytes the size of their keys and values.
+	Rows     int64 `json:"rows"`
+	RowBytes int64 `json:"rowBytes"`
+}
+
+// RevisionFilter restricts a list or count to the keys whose revisions lie
+// within the given bounds. A bound of zero is not applied.
+type RevisionFilter struct {
+	MinModRevision    int64
+	MaxModRevision    int64
+	MinCreateRevision int64
+	MaxCreateRevision int64
+}
+
+type Lease struct {
+	ID            int64
+	TTL           int64
+	GrantedAt     time.Time
+	LastKeepAlive time.Time
+}
+
+// WatchEvents is a batch of events of a watch. Revision is the revision up to
+// which the watch has seen every event. It is at least the revision of the
+// last event, and batches without events are sent whenever the watch has
+// caught up with writes to other keys, so that its progress can be reported.
+// A batch with CompactRevision set reports that the revision the watch started
+// from has been compacted, and one with Err set that the watch was stopped.
+// Either is the last batch of the watch.
+type WatchEvents struct {
+	Revision        int64
+	CompactRevision int64
+	Err             error
+	Events          []*Event
+}
+
+type passiveWatchKey struct{}
+
+// WithPassiveWatch marks watches made with the returned context as passive.
+// Passive watches get the events of writes made through the backend, but do
+// not by themselves keep the backend polling for writes made elsewhere, such
+// as by other instances sharing its database.
+func WithPassiveWatch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, passiveWatchKey{}, true)
+}
+
+// IsPassiveWatch reports whether watches made with the context are passive.
+func IsPassiveWatch(ctx context.Context) bool {
+	passive, _ := ctx.Value(passiveWatchKey{}).(bool)
+	return passive
+}
+
+type passiveStartKey struct{}
+
+// WithPassiveStart marks backends started with the returned context as
+// passive. Passive backends do not expire keys or leases, which is left to
+// the kine that serves their database, so that tools such as migrations may
+// open a database while it is served elsewhere.
+func WithPassiveStart(ctx context.Context) context.Context {
+	return context.WithValue(ctx, passiveStartKey{}, true)
+}
+
+// IsPassiveStart reports whether backends started with the context are
+// passive.
+func IsPassiveStart(ctx context.Context) bool {
+	passive, _ := ctx.Value(passiveStartKey{}).(bool)
+	return passive
+}
+
+type prevKVWatchKey struct{}
+
+// WithPrevKVWatch marks watches made with the returned context as wanting the
+// previous values of the keys in their events. The events of other watches
+// may leave the previous values out, so that they are not read.
+func WithPrevKVWatch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, prevKVWatchKey{}, true)
+}
+
+// IsPrevKVWatch reports whether watches made with the context want the
+// previous values of the keys in their events.
+func IsPrevKVWatch(ctx context.Context) bool {
+	prevKV, _ := ctx.Value(prevKVWatchKey{}).(bool)
+	return prevKV
+}
+
+type serializableReadKey struct{}
+
+// WithSerializableRead marks reads made with the returned context as
+// serializable. They may be answered as of the latest revision the backend
+// knows of, which can lag behind writes made elsewhere, such as by other
+// instances sharing its database, rather than the latest revision of the
+// database.
+func WithSerializableRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, serializableReadKey{}, true)
+}
+
+// IsSerializableRead reports whether reads made with the context are
+// serializable.
+func IsSerializableRead(ctx context.Context) bool {
+	serializable, _ := ctx.Value(serializableReadKey{}).(bool)
+	return serializable
 }
 
 type Event struct {
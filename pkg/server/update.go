@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 )
@@ -23,7 +24,7 @@ func isUpdate(txn *etcdserverpb.TxnRequest) (int64, string, []byte, int64, bool)
 	return 0, "", nil, 0, false
 }
 
-func (l *LimitedServer) update(ctx context.Context, rev int64, key string, value []byte, lease int64) (*etcdserverpb.TxnResponse, error) {
+func (l *LimitedServer) update(ctx context.Context, rev int64, key string, value []byte, lease int64, prevKV bool) (*etcdserverpb.TxnResponse, error) {
 	var (
 		kv  *KeyValue
 		ok  bool
@@ -33,6 +34,12 @@ func (l *LimitedServer) update(ctx context.Context, rev int64, key string, value
 	if rev == 0 {
 		rev, err = l.backend.Create(ctx, key, value, lease)
 		ok = true
+		if errors.Is(err, ErrKeyExists) {
+			// the key exists, or a concurrent create won, so the compare
+			// failed and the current value is returned by the failure range
+			rev, kv, err = l.backend.Get(ctx, key, "", 1, 0)
+			ok = false
+		}
 	} else {
 		rev, kv, ok, err = l.backend.Update(ctx, key, value, rev, lease)
 	}
@@ -46,12 +53,16 @@ func (l *LimitedServer) update(ctx context.Context, rev int64, key string, value
 	}
 
 	if ok {
+		putResp := &etcdserverpb.PutResponse{
+			Header: txnHeader(rev),
+		}
+		if prevKV {
+			putResp.PrevKv = toKV(kv)
+		}
 		resp.Responses = []*etcdserverpb.ResponseOp{
 			{
 				Response: &etcdserverpb.ResponseOp_ResponsePut{
-					ResponsePut: &etcdserverpb.PutResponse{
-						Header: txnHeader(rev),
-					},
+					ResponsePut: putResp,
 				},
 			},
 		}
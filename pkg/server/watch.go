@@ -4,10 +4,13 @@ import (
 	"context"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/logging"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
 )
 
 var (
@@ -16,34 +19,95 @@ var (
 
 func (s *KVServerBridge) Watch(ws etcdserverpb.Watch_WatchServer) error {
 	w := watcher{
-		server:  ws,
-		backend: s.limited.backend,
-		watches: map[int64]func(){},
+		server:           ws,
+		mux:              s.watchMux,
+		watchers:         s.metrics.watchers,
+		notifyInterval:   s.config.NotifyInterval,
+		maxResponseBytes: s.config.MaxResponseBytes,
+		watches:          map[int64]*watch{},
+		logger:           s.config.Logger,
 	}
 	defer w.Close()
 
+	// requests are received apart, so that the stream can be ended while a
+	// receive is blocked; returning from the handler ends the receive
+	msgs := make(chan *etcdserverpb.WatchRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := ws.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-ws.Context().Done():
+				return
+			}
+		}
+	}()
+
 	for {
-		msg, err := ws.Recv()
-		if err != nil {
+		var msg *etcdserverpb.WatchRequest
+		select {
+		case msg = <-msgs:
+		case err := <-errs:
 			return err
+		case <-s.watchesStopped:
+			return ErrStopped
 		}
 
 		if msg.GetCreateRequest() != nil {
 			w.Start(ws.Context(), msg.GetCreateRequest())
 		} else if msg.GetCancelRequest() != nil {
-			logrus.Debugf("WATCH CANCEL REQ id=%d", msg.GetCancelRequest().GetWatchId())
-			w.Cancel(msg.GetCancelRequest().WatchId, nil)
+			s.config.Logger.Debugf("WATCH CANCEL REQ id=%d", msg.GetCancelRequest().GetWatchId())
+			w.Cancel(msg.GetCancelRequest().WatchId, 0, 0, nil)
+		} else if msg.GetProgressRequest() != nil {
+			w.Progress()
 		}
 	}
 }
 
+// StopWatches ends every watch stream with ErrStopped, as well as those
+// opened later, so that stopping the server gracefully does not wait on
+// clients to close their watches.
+func (s *KVServerBridge) StopWatches() {
+	s.stopWatches.Do(func() {
+		close(s.watchesStopped)
+	})
+}
+
 type watcher struct {
 	sync.Mutex
 
-	wg      sync.WaitGroup
-	backend Backend
-	server  etcdserverpb.Watch_WatchServer
-	watches map[int64]func()
+	wg               sync.WaitGroup
+	mux              *watchMux
+	server           etcdserverpb.Watch_WatchServer
+	watchers         prometheus.Gauge
+	notifyInterval   time.Duration
+	maxResponseBytes int
+	watches          map[int64]*watch
+	logger           logging.Logger
+}
+
+type watch struct {
+	cancel func()
+	// progress is signalled to have the watch report its revision right away.
+	progress chan struct{}
+	// fragment allows responses to be split into fragments.
+	fragment bool
+	prevKV   bool
+}
+
+// newWatch returns a watch with the options of the request.
+func newWatch(cancel func(), r *etcdserverpb.WatchCreateRequest) *watch {
+	return &watch{
+		cancel:   cancel,
+		progress: make(chan struct{}, 1),
+		fragment: r.Fragment,
+		prevKV:   r.PrevKv,
+	}
 }
 
 func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest) {
@@ -51,63 +115,208 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 	defer w.Unlock()
 
 	ctx, cancel := context.WithCancel(ctx)
+	if r.PrevKv {
+		ctx = WithPrevKVWatch(ctx)
+	}
 
 	id := atomic.AddInt64(&watchID, 1)
-	w.watches[id] = cancel
+	watch := newWatch(cancel, r)
+	w.watches[id] = watch
 	w.wg.Add(1)
 
 	key := string(r.Key)
 
-	logrus.Debugf("WATCH START id=%d, count=%d, key=%s, revision=%d", id, len(w.watches), key, r.StartRevision)
+	logging.WithFields(w.logger, logging.Fields{
+		"rpc":      "Watch",
+		"key":      logging.KeyPrefix(key),
+		"revision": r.StartRevision,
+	}).Debugf("WATCH START id=%d, count=%d, key=%s", id, len(w.watches), key)
 
+	w.watchers.Inc()
 	go func() {
 		defer w.wg.Done()
+		defer w.watchers.Dec()
 		if err := w.server.Send(&etcdserverpb.WatchResponse{
 			Header:  &etcdserverpb.ResponseHeader{},
 			Created: true,
 			WatchId: id,
 		}); err != nil {
-			w.Cancel(id, err)
+			w.Cancel(id, 0, 0, err)
 			return
 		}
 
-		for events := range w.backend.Watch(ctx, key, r.StartRevision) {
-			if len(events) == 0 {
-				continue
-			}
+		var notify <-chan time.Time
+		if r.ProgressNotify {
+			ticker := time.NewTicker(w.notifyInterval)
+			defer ticker.Stop()
+			notify = ticker.C
+		}
 
-			if logrus.IsLevelEnabled(logrus.DebugLevel) {
-				for _, event := range events {
-					logrus.Debugf("WATCH READ id=%d, key=%s, revision=%d", id, event.KV.Key, event.KV.ModRevision)
+		// revision only advances once every event up to it has been sent, so a
+		// progress notification never skips events that are still on their way
+		var revision int64
+		watchCh := w.mux.Watch(ctx, newWatchStreamKey(r), r.StartRevision)
+		for {
+			select {
+			case batch, ok := <-watchCh:
+				if !ok {
+					w.Cancel(id, 0, 0, nil)
+					w.logger.Debugf("WATCH CLOSE id=%d, key=%s", id, key)
+					return
+				}
+				// the rest of the batches of a canceled watch are drained
+				if ctx.Err() != nil {
+					continue
+				}
+				if batch.Err != nil {
+					w.Cancel(id, 0, 0, batch.Err)
+					continue
+				}
+				if batch.CompactRevision != 0 {
+					w.Cancel(id, batch.Revision, batch.CompactRevision, ErrCompacted)
+					continue
+				}
+				if batch.Revision > revision {
+					revision = batch.Revision
+				}
+
+				// responses are only sent for events that pass the filters
+				events := batch.Events
+				if len(events) == 0 {
+					continue
+				}
+
+				if logging.DebugEnabled(w.logger) {
+					for _, event := range events {
+						w.logger.Debugf("WATCH READ id=%d, key=%s, revision=%d", id, event.KV.Key, event.KV.ModRevision)
+					}
 				}
-			}
 
-			if err := w.server.Send(&etcdserverpb.WatchResponse{
-				Header:  txnHeader(events[len(events)-1].KV.ModRevision),
-				WatchId: id,
-				Events:  toEvents(events...),
-			}); err != nil {
-				w.Cancel(id, err)
-				continue
+				resp := &etcdserverpb.WatchResponse{
+					Header:  txnHeader(events[len(events)-1].KV.ModRevision),
+					WatchId: id,
+					Events:  toEvents(watch.prevKV, events...),
+				}
+				if err := w.send(watch, resp); err != nil {
+					w.Cancel(id, 0, 0, err)
+					continue
+				}
+			case <-notify:
+				w.sendProgress(ctx, id, revision)
+			case <-watch.progress:
+				w.sendProgress(ctx, id, revision)
 			}
 		}
-		w.Cancel(id, nil)
-		logrus.Debugf("WATCH CLOSE id=%d, key=%s", id, key)
 	}()
 }
 
-func toEvents(events ...*Event) []*mvccpb.Event {
+// send sends the response, split into fragments when it is too large and the
+// watch allows it.
+func (w *watcher) send(watch *watch, resp *etcdserverpb.WatchResponse) error {
+	if !watch.fragment {
+		return w.server.Send(resp)
+	}
+
+	for _, part := range fragment(resp, w.maxResponseBytes) {
+		if err := w.server.Send(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fragment splits the events of the response into responses of at most
+// maxBytes, marking all but the last as fragments. An event that is larger than
+// maxBytes on its own is sent in a fragment of its own.
+func fragment(resp *etcdserverpb.WatchResponse, maxBytes int) []*etcdserverpb.WatchResponse {
+	size := resp.Size()
+	if size <= maxBytes || len(resp.Events) < 2 {
+		return []*etcdserverpb.WatchResponse{resp}
+	}
+
+	newFragment := func() *etcdserverpb.WatchResponse {
+		return &etcdserverpb.WatchResponse{
+			Header:   resp.Header,
+			WatchId:  resp.WatchId,
+			Fragment: true,
+		}
+	}
+
+	var fragments []*etcdserverpb.WatchResponse
+	current := newFragment()
+	emptySize := current.Size()
+	size = emptySize
+	for _, event := range resp.Events {
+		// each event is encoded with a one byte tag and its length
+		eventSize := event.Size()
+		eventSize += 1 + sovSize(uint64(eventSize))
+		if len(current.Events) > 0 && size+eventSize > maxBytes {
+			fragments = append(fragments, current)
+			current = newFragment()
+			size = emptySize
+		}
+		current.Events = append(current.Events, event)
+		size += eventSize
+	}
+	current.Fragment = false
+	return append(fragments, current)
+}
+
+// sovSize returns the number of bytes of x encoded as a varint.
+func sovSize(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+// sendProgress sends a response without events to report that the watch has
+// seen every event up to revision.
+func (w *watcher) sendProgress(ctx context.Context, id, revision int64) {
+	if revision == 0 || ctx.Err() != nil {
+		return
+	}
+
+	w.logger.Debugf("WATCH PROGRESS id=%d, revision=%d", id, revision)
+	if err := w.server.Send(&etcdserverpb.WatchResponse{
+		Header:  txnHeader(revision),
+		WatchId: id,
+	}); err != nil {
+		w.Cancel(id, 0, 0, err)
+	}
+}
+
+// Progress has every watch report its revision right away.
+func (w *watcher) Progress() {
+	w.Lock()
+	defer w.Unlock()
+
+	for _, watch := range w.watches {
+		select {
+		case watch.progress <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// toEvents returns the events of a watch response. The previous values of
+// the keys are only included if prevKV is set, as in etcd.
+func toEvents(prevKV bool, events ...*Event) []*mvccpb.Event {
 	ret := make([]*mvccpb.Event, 0, len(events))
 	for _, e := range events {
-		ret = append(ret, toEvent(e))
+		ret = append(ret, toEvent(e, prevKV))
 	}
 	return ret
 }
 
-func toEvent(event *Event) *mvccpb.Event {
+func toEvent(event *Event, prevKV bool) *mvccpb.Event {
 	e := &mvccpb.Event{
-		Kv:     toKV(event.KV),
-		PrevKv: toKV(event.PrevKV),
+		Kv: toKV(event.KV),
+	}
+	if prevKV {
+		e.PrevKv = toKV(event.PrevKV)
 	}
 	if event.Delete {
 		e.Type = mvccpb.DELETE
@@ -118,34 +327,52 @@ func toEvent(event *Event) *mvccpb.Event {
 	return e
 }
 
-func (w *watcher) Cancel(watchID int64, err error) {
+// Cancel stops the watch and tells the client it was canceled. A non-zero
+// compactRev reports that the watch was canceled because the revision it
+// started from has been compacted, as of the given revision. Watches that were
+// already canceled are not reported again.
+func (w *watcher) Cancel(watchID, revision, compactRev int64, err error) {
 	w.Lock()
-	if cancel, ok := w.watches[watchID]; ok {
-		cancel()
+	watch, ok := w.watches[watchID]
+	if ok {
+		watch.cancel()
 		delete(w.watches, watchID)
 	}
 	w.Unlock()
+	if !ok {
+		return
+	}
 
 	reason := ""
 	if err != nil {
 		reason = err.Error()
 	}
-	logrus.Debugf("WATCH CANCEL id=%d reason=%s", watchID, reason)
-	serr := w.server.Send(&etcdserverpb.WatchResponse{
+	w.logger.Debugf("WATCH CANCEL id=%d reason=%s", watchID, reason)
+
+	resp := &etcdserverpb.WatchResponse{
 		Header:       &etcdserverpb.ResponseHeader{},
 		Canceled:     true,
 		CancelReason: "watch closed",
 		WatchId:      watchID,
-	})
+	}
+	if err != nil {
+		resp.CancelReason = reason
+	}
+	if compactRev != 0 {
+		resp.Header = txnHeader(revision)
+		resp.CancelReason = rpctypes.ErrCompacted.Error()
+		resp.CompactRevision = compactRev
+	}
+	serr := w.server.Send(resp)
 	if serr != nil && err != nil {
-		logrus.Errorf("WATCH Failed to send cancel response for watchID %d: %v", watchID, serr)
+		w.logger.Errorf("WATCH Failed to send cancel response for watchID %d: %v", watchID, serr)
 	}
 }
 
 func (w *watcher) Close() {
 	w.Lock()
 	for _, v := range w.watches {
-		v()
+		v.cancel()
 	}
 	w.Unlock()
 	w.wg.Wait()
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// watchMuxBufferSize is the number of batches buffered for each watch of a
+// shared stream. A watch that falls further behind is dropped with
+// ErrWatchTooSlow, as the logs drop their slow subscribers, so that it does
+// not hold up the other watches of the stream.
+const watchMuxBufferSize = 100
+
+// watchMuxCatchUpBufferSize is the number of batches of a shared stream held
+// for a watch while it catches up on a watch of its own. A watch whose catch
+// up takes longer than the stream takes to pass on as many is dropped with
+// ErrWatchTooSlow too.
+const watchMuxCatchUpBufferSize = 4 * watchMuxBufferSize
+
+// watchStreamKey identifies the watches that can share a stream of the
+// backend: those of the same key, with the same filters, that either all
+// want the previous values of the keys or none do. The key of a from-key
+// watch is the empty prefix, which holds all keys, and fromKey the first key
+// it watches, if it does not watch the whole keyspace.
+type watchStreamKey struct {
+	key      string
+	fromKey  string
+	noPut    bool
+	noDelete bool
+	prevKV   bool
+}
+
+// newWatchStreamKey returns the key of the stream of the watch request.
+func newWatchStreamKey(r *etcdserverpb.WatchCreateRequest) watchStreamKey {
+	k := watchStreamKey{key: string(r.Key), prevKV: r.PrevKv}
+	if isFromKey(r.RangeEnd) {
+		k.key = ""
+		if !bytes.Equal(r.Key, fromKeyEnd) {
+			k.fromKey = string(r.Key)
+		}
+	}
+	for _, filter := range r.Filters {
+		switch filter {
+		case etcdserverpb.WatchCreateRequest_NOPUT:
+			k.noPut = true
+		case etcdserverpb.WatchCreateRequest_NODELETE:
+			k.noDelete = true
+		}
+	}
+	return k
+}
+
+// filter returns the events that are not dropped by the filters of the key.
+func (k watchStreamKey) filter(events []*Event) []*Event {
+	if !k.noPut && !k.noDelete && k.fromKey == "" {
+		return events
+	}
+
+	filtered := make([]*Event, 0, len(events))
+	for _, event := range events {
+		if event.Delete && k.noDelete || !event.Delete && k.noPut || event.KV.Key < k.fromKey {
+			continue
+		}
+		filtered = append(filtered, event)
+	}
+	return filtered
+}
+
+// watchMux shares a stream of the backend between the watches of each key
+// and filters, so that the events of every poll are filtered, and passed
+// through the backend, once for all of them rather than once for each. The
+// streams start at the current revision. Watches that start at or before the
+// revision their stream has reached catch up on a watch of their own first,
+// and join the stream from there; later events come from the stream alone.
+type watchMux struct {
+	sync.Mutex
+	backend Backend
+	// separate gives every watch a watch of the backend of its own.
+	separate bool
+	streams  map[watchStreamKey]*watchStream
+}
+
+func newWatchMux(backend Backend, separate bool) *watchMux {
+	return &watchMux{
+		backend:  backend,
+		separate: separate,
+		streams:  map[watchStreamKey]*watchStream{},
+	}
+}
+
+// watchStream is a watch of the backend shared by watches. Its revision is
+// the revision up to which its events were passed on.
+type watchStream struct {
+	key      watchStreamKey
+	cancel   func()
+	revision int64
+	subs     map[*watchSub]struct{}
+}
+
+// watchSub is a watch of a shared stream. Its channel is closed once it
+// leaves the stream or the stream ends, and dropped is set if it was closed
+// because the watch fell behind. While catchingUp is set, the batches of the
+// stream are held in pending instead, up to watchMuxCatchUpBufferSize, as the
+// watch only reads them once its catch up is done.
+type watchSub struct {
+	batches    chan WatchEvents
+	pending    []WatchEvents
+	catchingUp bool
+	dropped    bool
+}
+
+// Watch returns the batches of the events of the key from the revision on,
+// as Backend.Watch does, with the filters of the key applied. The channel is
+// closed once ctx is done or the watch ends.
+func (m *watchMux) Watch(ctx context.Context, key watchStreamKey, revision int64) <-chan WatchEvents {
+	if m.separate {
+		return filterBatches(ctx, key, m.backend.Watch(ctx, key.key, revision), 0)
+	}
+
+	m.Lock()
+	stream, ok := m.streams[key]
+	if !ok {
+		// the revision is read with the mux unlocked, so that the watches of
+		// other keys and the streams do not wait on the database
+		m.Unlock()
+		rev, err := m.backend.CurrentRevision(ctx)
+		if err != nil {
+			result := make(chan WatchEvents, 1)
+			result <- WatchEvents{Err: err}
+			close(result)
+			return result
+		}
+		m.Lock()
+		if stream, ok = m.streams[key]; !ok {
+			stream = m.startStream(key, rev)
+		}
+	}
+	joined := stream.revision
+	catchUp := revision <= joined && joined > 0
+	sub := &watchSub{batches: make(chan WatchEvents, watchMuxBufferSize), catchingUp: catchUp}
+	stream.subs[sub] = struct{}{}
+	m.Unlock()
+
+	result := make(chan WatchEvents)
+	go func() {
+		defer close(result)
+		defer m.leave(stream, sub)
+
+		// the events up to the revision the watch joined at are read by a
+		// watch of its own, those after it are held by the stream until then
+		if catchUp {
+			if !m.catchUp(ctx, key, revision, joined, result) {
+				return
+			}
+			for _, batch := range m.caughtUp(sub) {
+				select {
+				case result <- batch:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		for {
+			var batch WatchEvents
+			select {
+			case b, ok := <-sub.batches:
+				if !ok {
+					if sub.dropped {
+						select {
+						case result <- WatchEvents{Err: ErrWatchTooSlow}:
+						case <-ctx.Done():
+						}
+					}
+					return
+				}
+				batch = b
+			case <-ctx.Done():
+				return
+			}
+
+			// a watch that starts after the revision the stream reached
+			// skips the events before its start
+			if revision > joined+1 {
+				for len(batch.Events) > 0 && batch.Events[0].KV.ModRevision < revision {
+					batch.Events = batch.Events[1:]
+				}
+				if len(batch.Events) == 0 && batch.Revision < revision-1 && batch.Err == nil {
+					continue
+				}
+			}
+			select {
+			case result <- batch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return result
+}
+
+// startStream starts the shared stream of the key from the revision after
+// rev on. It is called with the mux locked.
+func (m *watchMux) startStream(key watchStreamKey, rev int64) *watchStream {
+	// the stream outlives the watch that starts it, and is stopped once the
+	// last of its watches leaves
+	ctx, cancel := context.WithCancel(context.Background())
+	if key.prevKV {
+		ctx = WithPrevKVWatch(ctx)
+	}
+	stream := &watchStream{
+		key:      key,
+		cancel:   cancel,
+		revision: rev,
+		subs:     map[*watchSub]struct{}{},
+	}
+	m.streams[key] = stream
+	go m.fanOut(stream, filterBatches(ctx, key, m.backend.Watch(ctx, key.key, rev+1), 0))
+	return stream
+}
+
+// fanOut passes the batches of the stream on to its watches, or holds them
+// for the watches that are still catching up. Watches whose buffer is full
+// are dropped. The stream ends on the first error, and all of its watches
+// with it.
+func (m *watchMux) fanOut(stream *watchStream, batches <-chan WatchEvents) {
+	for batch := range batches {
+		m.Lock()
+		if batch.Err == nil && batch.Revision > stream.revision {
+			stream.revision = batch.Revision
+		}
+		for sub := range stream.subs {
+			if sub.catchingUp {
+				if len(sub.pending) < watchMuxCatchUpBufferSize {
+					sub.pending = append(sub.pending, batch)
+					continue
+				}
+			} else {
+				select {
+				case sub.batches <- batch:
+					continue
+				default:
+				}
+			}
+			sub.dropped = true
+			m.unsub(stream, sub)
+		}
+		if batch.Err != nil || batch.CompactRevision != 0 {
+			m.end(stream)
+		}
+		m.Unlock()
+	}
+
+	m.Lock()
+	m.end(stream)
+	m.Unlock()
+}
+
+// catchUp passes on the events of a watch of the backend of its own from the
+// revision up to the revision the watch joined its stream at. It returns
+// whether the watch caught up, or ended before it did, as when ctx is done or
+// the revision was compacted.
+func (m *watchMux) catchUp(ctx context.Context, key watchStreamKey, revision, joined int64, result chan<- WatchEvents) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	batches := filterBatches(ctx, key, m.backend.Watch(ctx, key.key, revision), joined)
+	defer func() {
+		cancel()
+		for range batches {
+		}
+	}()
+
+	for batch := range batches {
+		select {
+		case result <- batch:
+		case <-ctx.Done():
+			return false
+		}
+		if batch.Err != nil || batch.CompactRevision != 0 {
+			return false
+		}
+		if batch.Revision >= joined {
+			return true
+		}
+	}
+	return false
+}
+
+// caughtUp returns the batches held for the watch while it caught up, and
+// passes those after them on through its channel.
+func (m *watchMux) caughtUp(sub *watchSub) []WatchEvents {
+	m.Lock()
+	defer m.Unlock()
+	pending := sub.pending
+	sub.pending, sub.catchingUp = nil, false
+	return pending
+}
+
+// leave removes the watch from the stream, and stops the stream once no
+// watch is left on it.
+func (m *watchMux) leave(stream *watchStream, sub *watchSub) {
+	m.Lock()
+	defer m.Unlock()
+	m.unsub(stream, sub)
+	if len(stream.subs) == 0 {
+		m.end(stream)
+	}
+}
+
+// unsub closes the channel of the watch and removes it from the stream. It
+// is called with the mux locked.
+func (m *watchMux) unsub(stream *watchStream, sub *watchSub) {
+	if _, ok := stream.subs[sub]; ok {
+		close(sub.batches)
+		delete(stream.subs, sub)
+	}
+}
+
+// end stops the stream and closes the channels of its watches, so that the
+// watches started after it get a stream of their own. It is called with the
+// mux locked.
+func (m *watchMux) end(stream *watchStream) {
+	if m.streams[stream.key] == stream {
+		delete(m.streams, stream.key)
+	}
+	for sub := range stream.subs {
+		m.unsub(stream, sub)
+	}
+	stream.cancel()
+}
+
+// filterBatches passes on the batches with the filters of the key applied to
+// their events. If until is set, the events after it are dropped, along with
+// the revision of the batches past it. The channel is closed once that of the
+// backend is.
+func filterBatches(ctx context.Context, key watchStreamKey, batches <-chan WatchEvents, until int64) <-chan WatchEvents {
+	filtered := make(chan WatchEvents)
+	go func() {
+		defer close(filtered)
+		for batch := range batches {
+			batch.Events = key.filter(batch.Events)
+			if until > 0 {
+				for len(batch.Events) > 0 && batch.Events[len(batch.Events)-1].KV.ModRevision > until {
+					batch.Events = batch.Events[:len(batch.Events)-1]
+				}
+				if batch.Revision > until {
+					batch.Revision = until
+				}
+			}
+			select {
+			case filtered <- batch:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return filtered
+}
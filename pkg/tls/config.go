@@ -2,7 +2,11 @@ package tls
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
 
+	"github.com/rancher/kine/pkg/logging"
 	"go.etcd.io/etcd/client/pkg/v3/transport"
 )
 
@@ -10,17 +14,49 @@ type Config struct {
 	CAFile   string
 	CertFile string
 	KeyFile  string
+	// ClientCAFile is the CA that the certificates of clients are verified
+	// with when serving, and RequireClientCert rejects clients that do not
+	// present one.
+	ClientCAFile      string
+	RequireClientCert bool
+	// SkipVerify encrypts connections as a client without verifying the
+	// certificate of the server.
+	SkipVerify bool
+}
+
+// Enabled reports whether connections as a client are made with TLS.
+func (c Config) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.CAFile != "" || c.SkipVerify
+}
+
+// CheckFiles checks that the files of the config can be read, and that the
+// certificate and key are given together, so that mistakes are reported
+// when starting rather than when connecting.
+func (c Config) CheckFiles() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("both a certificate and a key are needed to present a certificate")
+	}
+	for _, file := range []string{c.CAFile, c.CertFile, c.KeyFile, c.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := ioutil.ReadFile(file); err != nil {
+			return fmt.Errorf("failed to read TLS file: %w", err)
+		}
+	}
+	return nil
 }
 
 func (c Config) ClientConfig() (*tls.Config, error) {
-	if c.CertFile == "" && c.KeyFile == "" && c.CAFile == "" {
+	if !c.Enabled() {
 		return nil, nil
 	}
 
 	info := &transport.TLSInfo{
-		CertFile:      c.CertFile,
-		KeyFile:       c.KeyFile,
-		TrustedCAFile: c.CAFile,
+		CertFile:           c.CertFile,
+		KeyFile:            c.KeyFile,
+		TrustedCAFile:      c.CAFile,
+		InsecureSkipVerify: c.SkipVerify,
 	}
 	tlsConfig, err := info.ClientConfig()
 	if err != nil {
@@ -29,3 +65,60 @@ func (c Config) ClientConfig() (*tls.Config, error) {
 
 	return tlsConfig, nil
 }
+
+// ServerConfig returns the config for serving with the certificate and key.
+// If a client CA is set, the certificates clients present are verified with
+// it, and if client certificates are required, clients without one are
+// rejected at handshake. The certificate, key and client CA are reloaded when
+// their files change, so that they can be rotated without restarting;
+// connections made before keep using the previous ones, and the reloads are
+// logged to the logger, or to the standard logger of logrus if it is nil.
+func (c Config) ServerConfig(logger logging.Logger) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("both a certificate and a key are needed to serve with TLS")
+	}
+	if c.RequireClientCert && c.ClientCAFile == "" {
+		return nil, errors.New("a client CA is needed to require client certificates")
+	}
+
+	info := &transport.TLSInfo{
+		CertFile:       c.CertFile,
+		KeyFile:        c.KeyFile,
+		TrustedCAFile:  c.ClientCAFile,
+		ClientCertAuth: c.RequireClientCert,
+	}
+	tlsConfig, err := info.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c.RequireClientCert:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case c.ClientCAFile != "":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		tlsConfig.ClientAuth = tls.NoClientCert
+	}
+
+	r, err := newReloader(logger, c.CertFile, c.KeyFile, c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.Certificates = nil
+	tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, _ := r.current()
+		return cert, nil
+	}
+	if c.ClientCAFile != "" {
+		base := tlsConfig.Clone()
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			config := base.Clone()
+			config.GetCertificate = nil
+			config.Certificates = []tls.Certificate{*cert}
+			config.ClientCAs = pool
+			return config, nil
+		}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,122 @@
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rancher/kine/pkg/logging"
+)
+
+// fileStamp identifies a version of a file by its modification time and size.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// reloader holds a certificate and CA pool loaded from files, and reloads
+// them when the files change. The files are checked on every handshake, so
+// new connections use the new files right away, while established ones are
+// not affected.
+type reloader struct {
+	sync.Mutex
+	certFile string
+	keyFile  string
+	caFile   string
+	logger   logging.Logger
+
+	stamps []fileStamp
+	cert   *tls.Certificate
+	pool   *x509.CertPool
+}
+
+func newReloader(logger logging.Logger, certFile, keyFile, caFile string) (*reloader, error) {
+	r := &reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		logger:   logging.OrDefault(logger),
+	}
+	stamps, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(stamps); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *reloader) stat() ([]fileStamp, error) {
+	var stamps []fileStamp
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fileStamp{modTime: info.ModTime(), size: info.Size()})
+	}
+	return stamps, nil
+}
+
+func (r *reloader) load(stamps []fileStamp) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.caFile)
+		}
+	}
+
+	r.stamps = stamps
+	r.cert = &cert
+	r.pool = pool
+	return nil
+}
+
+// current returns the certificate and CA pool, reloading them first if the
+// files changed. If the new files cannot be loaded, for instance because only
+// some of them were replaced yet, the previous ones are kept.
+func (r *reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.Lock()
+	defer r.Unlock()
+
+	stamps, err := r.stat()
+	if err == nil && !stampsEqual(stamps, r.stamps) {
+		err = r.load(stamps)
+		if err == nil {
+			r.logger.Infof("Reloaded TLS certificate from %s", r.certFile)
+		}
+	}
+	if err != nil {
+		r.logger.Errorf("Failed to reload TLS certificate from %s, keeping the previous one: %v", r.certFile, err)
+	}
+	return r.cert, r.pool
+}
+
+func stampsEqual(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/audit"
+	"github.com/rancher/kine/pkg/endpoint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestAuditLog is unit testing for recording the writes to keys in the audit log.
+func TestAuditLog(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	out := &syncBuffer{}
+	client, _ := newKineWithConfig(t, endpoint.Config{AuditWriter: out})
+
+	createKey(ctx, g, client, "/testAuditLog/a", "secret-1")
+	resp, err := client.Get(ctx, "/testAuditLog/a")
+	g.Expect(err).To(BeNil())
+	created := resp.Kvs[0].ModRevision
+
+	txn, err := client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision("/testAuditLog/a"), "=", created)).
+		Then(clientv3.OpPut("/testAuditLog/a", "secret-2")).
+		Commit()
+	g.Expect(err).To(BeNil())
+	g.Expect(txn.Succeeded).To(BeTrue())
+	updated := txn.Header.Revision
+
+	deleteKey(ctx, g, client, "/testAuditLog/a")
+
+	// the writes of a transaction are recorded in the order of its ops
+	txn, err = client.Txn(ctx).
+		Then(clientv3.OpPut("/testAuditLog/c", "secret-3"), clientv3.OpPut("/testAuditLog/b", "secret-4")).
+		Commit()
+	g.Expect(err).To(BeNil())
+	g.Expect(txn.Succeeded).To(BeTrue())
+
+	var events []audit.Event
+	g.Eventually(func() []audit.Event {
+		events = auditEvents(g, out.String(), "/testAuditLog/")
+		return events
+	}, 5*time.Second).Should(HaveLen(5))
+
+	g.Expect(events[0].Operation).To(Equal(audit.Create))
+	g.Expect(events[0].Revision).To(Equal(created))
+	g.Expect(events[0].PrevRevision).To(Equal(int64(0)))
+	g.Expect(events[1].Operation).To(Equal(audit.Update))
+	g.Expect(events[1].Revision).To(Equal(updated))
+	g.Expect(events[1].PrevRevision).To(Equal(created))
+	g.Expect(events[2].Operation).To(Equal(audit.Delete))
+	g.Expect(events[2].Revision).To(BeNumerically(">", updated))
+	g.Expect(events[2].PrevRevision).To(Equal(updated))
+	g.Expect(events[3].Key).To(Equal("/testAuditLog/c"))
+	g.Expect(events[4].Key).To(Equal("/testAuditLog/b"))
+	g.Expect(events[4].Revision).To(Equal(events[3].Revision + 1))
+	for i, event := range events {
+		if i < 3 {
+			g.Expect(event.Key).To(Equal("/testAuditLog/a"))
+		}
+		g.Expect(event.Address).NotTo(BeEmpty())
+		g.Expect(event.Time).NotTo(BeZero())
+	}
+
+	// values are never written
+	g.Expect(out.String()).NotTo(ContainSubstring("secret"))
+
+	t.Run("File", func(t *testing.T) {
+		g := NewWithT(t)
+		file := newTestDir(t) + "/audit.log"
+		client, _ := newKineWithConfig(t, endpoint.Config{AuditLogFile: file, AuditLogMaxSize: 1024})
+
+		// once the file grows past the maximum size it is rotated
+		for i := 0; i < 10; i++ {
+			createKey(ctx, g, client, "/testAuditLog/file/"+strings.Repeat("a", 100)+string(rune('a'+i)), "value")
+		}
+		g.Eventually(func() error {
+			_, err := os.Stat(file + ".1")
+			return err
+		}, 5*time.Second).Should(Succeed())
+
+		// and it is reopened on SIGHUP once it was moved away
+		g.Eventually(func() int {
+			data, _ := os.ReadFile(file)
+			return len(auditEvents(g, string(data), "/testAuditLog/file/"))
+		}, 5*time.Second).Should(BeNumerically(">", 0))
+		g.Expect(os.Rename(file, file+".moved")).To(Succeed())
+		g.Expect(syscall.Kill(os.Getpid(), syscall.SIGHUP)).To(Succeed())
+		g.Eventually(func() int {
+			createKey(ctx, g, client, "/testAuditLog/file/"+time.Now().Format(time.RFC3339Nano), "value")
+			data, _ := os.ReadFile(file)
+			return len(auditEvents(g, string(data), "/testAuditLog/file/"))
+		}, 5*time.Second).Should(BeNumerically(">", 0))
+	})
+}
+
+// auditEvents parses the lines of an audit log, returning the events of keys with the prefix.
+func auditEvents(g Gomega, data, prefix string) []audit.Event {
+	var events []audit.Event
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		var event audit.Event
+		g.Expect(json.Unmarshal(scanner.Bytes(), &event)).To(Succeed())
+		if strings.HasPrefix(event.Key, prefix) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// syncBuffer is a buffer that is safe to write to while it is read.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,174 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/backup"
+	"github.com/rancher/kine/pkg/endpoint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestBackup is unit testing for backing up the database of kine while it is served, and
+// restoring the backup into a new database that serves the same ranges. It runs on sqlite, and on
+// the servers at the endpoints in KINE_MYSQL_ENDPOINT and KINE_POSTGRES_ENDPOINT that are set, in
+// new databases of each.
+func TestBackup(t *testing.T) {
+	for _, backend := range []struct {
+		name   string
+		env    string
+		format string
+	}{
+		{name: "SQLite", format: "sqlite"},
+		{name: "MySQL", env: "KINE_MYSQL_ENDPOINT", format: "rows"},
+		{name: "Postgres", env: "KINE_POSTGRES_ENDPOINT", format: "rows"},
+	} {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			newEndpoint := func() string {
+				return fmt.Sprintf("sqlite://%s/data.db", newTestDir(t))
+			}
+			if backend.env != "" {
+				address := os.Getenv(backend.env)
+				if address == "" {
+					t.Skipf("%s is not set", backend.env)
+				}
+				newEndpoint = func() string {
+					return databaseEndpoint(address, newDatabaseName())
+				}
+			}
+			testBackup(t, newEndpoint, backend.format)
+		})
+	}
+}
+
+func testBackup(t *testing.T, newEndpoint func() string, format string) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	config := endpoint.Config{Endpoint: newEndpoint()}
+	client, _ := newKineWithConfig(t, config)
+
+	for i := 0; i < 20; i++ {
+		createKey(ctx, g, client, fmt.Sprintf("/testBackup/%02d", i), fmt.Sprintf("value-%d", i))
+	}
+	for i := 0; i < 20; i += 4 {
+		deleteKey(ctx, g, client, fmt.Sprintf("/testBackup/%02d", i))
+	}
+	resp, err := client.Get(ctx, "/testBackup/", clientv3.WithPrefix())
+	g.Expect(err).To(BeNil())
+	_, err = client.Compact(ctx, resp.Header.Revision-2)
+	g.Expect(err).To(BeNil())
+	for i := 1; i < 20; i += 4 {
+		_, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(fmt.Sprintf("/testBackup/%02d", i)), ">", 0)).
+			Then(clientv3.OpPut(fmt.Sprintf("/testBackup/%02d", i), "updated")).
+			Commit()
+		g.Expect(err).To(BeNil())
+	}
+
+	// kine keeps serving writes while the backup is taken
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		g := NewWithT(t)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			createKey(ctx, g, client, fmt.Sprintf("/testBackup/live/%04d", i), "live")
+		}
+	}()
+	path := filepath.Join(newTestDir(t), "backup.snapshot")
+	err = backup.WriteFile(ctx, config, path)
+	close(stop)
+	wg.Wait()
+	g.Expect(err).To(BeNil())
+
+	// the header is versioned and records the revisions of the snapshot
+	header := readSnapshotHeader(g, path)
+	g.Expect(header.Version).To(Equal(1))
+	g.Expect(header.Format).To(Equal(format))
+	g.Expect(header.CompactRevision).To(Equal(resp.Header.Revision - 2))
+	g.Expect(header.Revision).To(BeNumerically(">", resp.Header.Revision))
+
+	f, err := os.Open(path)
+	g.Expect(err).To(BeNil())
+	defer f.Close()
+	restoredConfig := endpoint.Config{Endpoint: newEndpoint()}
+	g.Expect(endpoint.Restore(ctx, restoredConfig, f, false)).To(Succeed())
+	restored, _ := newKineWithConfig(t, restoredConfig)
+
+	// ranges at the revision of the snapshot, and at the revisions it holds the history of, are
+	// served alike
+	assertSameRanges(ctx, g, client, restored, "/testBackup/", header.Revision, resp.Header.Revision, header.CompactRevision+1)
+
+	// the history before the compact revision is compacted in the backup as well
+	_, err = restored.Get(ctx, "/testBackup/", clientv3.WithPrefix(), clientv3.WithRev(header.CompactRevision-1))
+	g.Expect(err).NotTo(BeNil())
+
+	// a failed backup leaves the previous one in place
+	previous, err := os.ReadFile(path)
+	g.Expect(err).To(BeNil())
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	g.Expect(backup.WriteFile(canceled, config, path)).NotTo(Succeed())
+	current, err := os.ReadFile(path)
+	g.Expect(err).To(BeNil())
+	g.Expect(current).To(Equal(previous))
+	entries, err := os.ReadDir(filepath.Dir(path))
+	g.Expect(err).To(BeNil())
+	g.Expect(entries).To(HaveLen(1))
+}
+
+// snapshotHeader is the header line of a snapshot.
+type snapshotHeader struct {
+	Version         int    `json:"version"`
+	Format          string `json:"format"`
+	Revision        int64  `json:"revision"`
+	CompactRevision int64  `json:"compactRevision"`
+}
+
+// readSnapshotHeader returns the header of the snapshot file at path.
+func readSnapshotHeader(g Gomega, path string) snapshotHeader {
+	f, err := os.Open(path)
+	g.Expect(err).To(BeNil())
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	g.Expect(err).To(BeNil())
+	var header snapshotHeader
+	g.Expect(json.Unmarshal(line, &header)).To(Succeed())
+	return header
+}
+
+// assertSameRanges checks that the ranges of the prefix at each of the revisions, in full, by
+// pages, counted and as keys, are served alike by both clients.
+func assertSameRanges(ctx context.Context, g Gomega, want, got *clientv3.Client, prefix string, revisions ...int64) {
+	for _, rev := range revisions {
+		for _, opts := range [][]clientv3.OpOption{
+			{clientv3.WithPrefix()},
+			{clientv3.WithPrefix(), clientv3.WithLimit(5)},
+			{clientv3.WithPrefix(), clientv3.WithCountOnly()},
+			{clientv3.WithFromKey(), clientv3.WithKeysOnly()},
+		} {
+			opts = append(opts, clientv3.WithRev(rev))
+			wantResp, err := want.Get(ctx, prefix, opts...)
+			g.Expect(err).To(BeNil())
+			gotResp, err := got.Get(ctx, prefix, opts...)
+			g.Expect(err).To(BeNil())
+			g.Expect(gotResp.Kvs).To(Equal(wantResp.Kvs))
+			g.Expect(gotResp.Count).To(Equal(wantResp.Count))
+			g.Expect(gotResp.More).To(Equal(wantResp.More))
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/bench"
+	"github.com/rancher/kine/pkg/endpoint"
+)
+
+// TestBench is unit testing for a short benchmark, which runs every operation of its load and
+// reports each of them.
+func TestBench(t *testing.T) {
+	g := NewWithT(t)
+	result, err := bench.Run(context.Background(), bench.Config{
+		Kine:          endpoint.Config{Endpoint: fmt.Sprintf("sqlite://%s/data.db", newTestDir(t))},
+		Keys:          50,
+		Prefixes:      5,
+		ValueSize:     100,
+		Duration:      2 * time.Second,
+		Concurrency:   5,
+		UpdateRate:    50,
+		Watches:       2,
+		ListInterval:  200 * time.Millisecond,
+		BurstSize:     20,
+		BurstInterval: 500 * time.Millisecond,
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(result.Seconds).To(BeNumerically(">=", 2))
+	g.Expect(result.DBSizeAfter).To(BeNumerically(">", 0))
+
+	g.Expect(result.Operations[bench.OpSeed].Count).To(Equal(int64(50)))
+	for _, op := range []string{bench.OpSeed, bench.OpCreate, bench.OpUpdate, bench.OpList, bench.OpCount, bench.OpWatch} {
+		g.Expect(result.Operations).To(HaveKey(op))
+		g.Expect(result.Operations[op].Count).To(BeNumerically(">", 0), op)
+		g.Expect(result.Operations[op].Errors).To(BeZero(), op)
+		latency := result.Operations[op].Latency
+		g.Expect(latency.P50).To(BeNumerically("<=", latency.P99), op)
+		g.Expect(latency.P99).To(BeNumerically("<=", latency.Max), op)
+	}
+
+	data, err := json.Marshal(result)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(data)).To(ContainSubstring(`"latencyMs":{"p50":`))
+}
+
+// BenchmarkApiserverLoad is a benchmark of the load modeled on the kube-apiserver that the bench
+// command runs, with the defaults of the command but for a shorter duration. The latencies at the
+// 99th percentile are reported.
+func BenchmarkApiserverLoad(b *testing.B) {
+	config := bench.DefaultConfig()
+	config.Duration = 10 * time.Second
+	for i := 0; i < b.N; i++ {
+		config.Kine = endpoint.Config{Endpoint: fmt.Sprintf("sqlite://%s/data.db", newTestDir(b))}
+		result, err := bench.Run(context.Background(), config)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, op := range []string{bench.OpCreate, bench.OpUpdate, bench.OpList, bench.OpWatch} {
+			b.ReportMetric(result.Operations[op].Latency.P99, op+"-p99-ms")
+		}
+	}
+}
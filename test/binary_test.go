@@ -0,0 +1,137 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestBinaryKeys is unit testing for keys and values with NUL bytes and invalid UTF-8, which are
+// listed and paginated in the bytewise order of etcd.
+func TestBinaryKeys(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+	g := NewWithT(t)
+
+	prefix := "/testBinaryKeys/"
+	keys := []string{
+		prefix + "b",
+		prefix + "a\x00\x00",
+		prefix + "\xff\xfe",
+		prefix + "a",
+		prefix + "a\x00",
+		prefix + "a\x01",
+	}
+	for _, key := range keys {
+		createKey(ctx, g, client, key, "\x00"+key+"\xff")
+	}
+	sort.Strings(keys)
+
+	t.Run("Get", func(t *testing.T) {
+		g := NewWithT(t)
+		for _, key := range keys {
+			resp, err := client.Get(ctx, key)
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Kvs).To(HaveLen(1))
+			g.Expect(resp.Kvs[0].Key).To(Equal([]byte(key)))
+			g.Expect(resp.Kvs[0].Value).To(Equal([]byte("\x00" + key + "\xff")))
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, prefix, clientv3.WithPrefix())
+		g.Expect(err).To(BeNil())
+		g.Expect(listedKeys(resp)).To(Equal(keys))
+	})
+
+	// each page continues from the last key followed by a NUL byte, which is the next key for
+	// keys that end with NUL bytes as well
+	t.Run("Paginated", func(t *testing.T) {
+		g := NewWithT(t)
+		var listed []string
+		start := prefix
+		for {
+			resp, err := client.Get(ctx, start, clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix)), clientv3.WithLimit(1))
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Kvs).To(HaveLen(1))
+			listed = append(listed, listedKeys(resp)...)
+			if !resp.More {
+				break
+			}
+			start = string(resp.Kvs[0].Key) + "\x00"
+		}
+		g.Expect(listed).To(Equal(keys))
+	})
+}
+
+// FuzzBinaryKeys is fuzz testing for round-tripping arbitrary keys and values, and for listing
+// them in the bytewise order of etcd.
+func FuzzBinaryKeys(f *testing.F) {
+	for _, seed := range [][2]string{
+		{"key", "value"},
+		{"key\x00", "\x00"},
+		{"\x00key", "\xff\xfe"},
+		{"\xc3\x28", "\xc3\x28"},
+		{"a/b\x00c", ""},
+	} {
+		f.Add([]byte(seed[0]), []byte(seed[1]))
+	}
+
+	ctx := context.Background()
+	client := newKine(f)
+	prefix := "/fuzzBinaryKeys/"
+
+	f.Fuzz(func(t *testing.T, name, value []byte) {
+		// names are limited in length by some of the databases
+		if len(name) == 0 || len(name) > 512 {
+			t.Skip()
+		}
+		g := NewWithT(t)
+		key := prefix + string(name)
+
+		// inputs repeat, so keys that exist already are updated
+		txnResp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, string(value))).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		g.Expect(err).To(BeNil())
+		if !txnResp.Succeeded {
+			modRevision := txnResp.Responses[0].GetResponseRange().Kvs[0].ModRevision
+			txnResp, err = client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+				Then(clientv3.OpPut(key, string(value))).
+				Commit()
+			g.Expect(err).To(BeNil())
+			g.Expect(txnResp.Succeeded).To(BeTrue())
+		}
+
+		resp, err := client.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(1))
+		g.Expect(resp.Kvs[0].Key).To(Equal([]byte(key)))
+		g.Expect(bytes.Equal(resp.Kvs[0].Value, value)).To(BeTrue())
+
+		resp, err = client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+		g.Expect(err).To(BeNil())
+		listed := listedKeys(resp)
+		g.Expect(listed).To(ContainElement(key))
+		g.Expect(sort.SliceIsSorted(listed, func(i, j int) bool {
+			return bytes.Compare([]byte(listed[i]), []byte(listed[j])) < 0
+		})).To(BeTrue())
+	})
+}
+
+// listedKeys returns the keys of a range response.
+func listedKeys(resp *clientv3.GetResponse) []string {
+	keys := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	return keys
+}
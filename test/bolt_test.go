@@ -0,0 +1,231 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/drivers/bolt"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestBoltRestart is unit testing for keeping the keys, leases and revisions of the bolt backend
+// across restarts.
+func TestBoltRestart(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	path := newTestDir(t) + "/data.bolt"
+
+	backend, _, stop := startBoltBackend(t, path)
+	_, err := backend.Create(ctx, "/testBoltRestart/a", []byte("a"), 0)
+	g.Expect(err).To(BeNil())
+	rev, err := backend.Create(ctx, "/testBoltRestart/b", []byte("b"), 0)
+	g.Expect(err).To(BeNil())
+	_, _, updated, err := backend.Update(ctx, "/testBoltRestart/b", []byte("updated"), rev, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(updated).To(BeTrue())
+	lease, err := backend.LeaseGrant(ctx, 100, 60)
+	g.Expect(err).To(BeNil())
+	current, err := backend.CurrentRevision(ctx)
+	g.Expect(err).To(BeNil())
+	stop()
+
+	backend, _, _ = startBoltBackend(t, path)
+	rev, err = backend.CurrentRevision(ctx)
+	g.Expect(err).To(BeNil())
+	g.Expect(rev).To(Equal(current))
+
+	_, kvs, err := backend.List(ctx, "/testBoltRestart/", "", 0, current, false, server.RevisionFilter{})
+	g.Expect(err).To(BeNil())
+	g.Expect(kvs).To(HaveLen(2))
+	g.Expect(kvs[0].Value).To(Equal([]byte("a")))
+	g.Expect(kvs[1].Value).To(Equal([]byte("updated")))
+
+	ttl, _, _, err := backend.LeaseTimeToLive(ctx, lease, false)
+	g.Expect(err).To(BeNil())
+	g.Expect(ttl).To(BeNumerically(">", 0))
+
+	// revisions carry on from where they were
+	rev, err = backend.Create(ctx, "/testBoltRestart/c", []byte("c"), 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(rev).To(BeNumerically(">", current))
+}
+
+// TestBoltCompact is unit testing for compacting the bolt backend.
+func TestBoltCompact(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	backend, log, _ := startBoltBackend(t, newTestDir(t)+"/data.bolt")
+
+	rev, err := backend.Create(ctx, "/testBoltCompact/updated", []byte("0"), 0)
+	g.Expect(err).To(BeNil())
+	for i := 1; i <= 3; i++ {
+		rev, _, _, err = backend.Update(ctx, "/testBoltCompact/updated", []byte(fmt.Sprint(i)), rev, 0)
+		g.Expect(err).To(BeNil())
+	}
+	_, err = backend.Create(ctx, "/testBoltCompact/deleted", []byte("deleted"), 0)
+	g.Expect(err).To(BeNil())
+	_, _, _, err = backend.Delete(ctx, "/testBoltCompact/deleted", 0)
+	g.Expect(err).To(BeNil())
+	current, err := backend.CurrentRevision(ctx)
+	g.Expect(err).To(BeNil())
+
+	_, rows, err := log.After(ctx, "/testBoltCompact/", 0, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(rows).To(HaveLen(6))
+
+	// the superseded rows of the updated key, and both rows of the deleted one are removed
+	_, err = backend.Compact(ctx, current)
+	g.Expect(err).To(BeNil())
+	_, rows, err = log.After(ctx, "/testBoltCompact/", 0, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(rows).To(HaveLen(1))
+	g.Expect(rows[0].KV.Key).To(Equal("/testBoltCompact/updated"))
+	g.Expect(rows[0].KV.Value).To(Equal([]byte("3")))
+
+	_, _, err = backend.List(ctx, "/testBoltCompact/", "", 0, current-1, false, server.RevisionFilter{})
+	g.Expect(err).To(Equal(server.ErrCompacted))
+	_, err = backend.Compact(ctx, current)
+	g.Expect(err).To(Equal(server.ErrCompacted))
+
+	// the key can be created again once it is compacted away
+	_, err = backend.Create(ctx, "/testBoltCompact/deleted", []byte("again"), 0)
+	g.Expect(err).To(BeNil())
+}
+
+// TestBoltSnapshot is unit testing for the snapshot rpc of the bolt backend and restoring its
+// snapshots.
+func TestBoltSnapshot(t *testing.T) {
+	ctx := context.Background()
+	path := newTestDir(t) + "/data.bolt"
+	client, _ := newKineWithConfig(t, endpoint.Config{Endpoint: "bolt://" + path})
+
+	for i := 0; i < 10; i++ {
+		createKey(ctx, NewWithT(t), client, fmt.Sprintf("/testBoltSnapshot/%d", i), fmt.Sprintf("value-%d", i))
+	}
+	deleteKey(ctx, NewWithT(t), client, "/testBoltSnapshot/0")
+
+	var snapshot []byte
+	{
+		g := NewWithT(t)
+		rc, err := client.Snapshot(ctx)
+		g.Expect(err).To(BeNil())
+		snapshot, err = io.ReadAll(rc)
+		g.Expect(err).To(BeNil())
+		g.Expect(rc.Close()).To(Succeed())
+	}
+
+	current, err := client.Get(ctx, "/testBoltSnapshot/", clientv3.WithPrefix())
+	NewWithT(t).Expect(err).To(BeNil())
+
+	restore := func(path string, snapshot []byte) error {
+		return endpoint.Restore(ctx, endpoint.Config{Endpoint: "bolt://" + path}, bytes.NewReader(snapshot), false)
+	}
+
+	t.Run("Restore", func(t *testing.T) {
+		g := NewWithT(t)
+		target := newTestDir(t) + "/data.bolt"
+		g.Expect(restore(target, snapshot)).To(Succeed())
+
+		backend, _, _ := startBoltBackend(t, target)
+		rev, kvs, err := backend.List(ctx, "/testBoltSnapshot/", "", 0, 0, false, server.RevisionFilter{})
+		g.Expect(err).To(BeNil())
+		// the current revision is raised past that of the snapshot
+		g.Expect(rev).To(Equal(current.Header.Revision + 1))
+		g.Expect(kvs).To(HaveLen(len(current.Kvs)))
+		for i, kv := range kvs {
+			g.Expect(kv.Key).To(Equal(string(current.Kvs[i].Key)))
+			g.Expect(kv.Value).To(Equal(current.Kvs[i].Value))
+			g.Expect(kv.ModRevision).To(Equal(current.Kvs[i].ModRevision))
+		}
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		g := NewWithT(t)
+		corrupt := append([]byte{}, snapshot...)
+		corrupt[len(corrupt)/2] ^= 0xff
+
+		target := newTestDir(t) + "/data.bolt"
+		g.Expect(restore(target, corrupt)).NotTo(Succeed())
+		g.Expect(restore(target, snapshot[:len(snapshot)-1])).NotTo(Succeed())
+		g.Expect(restore(target, snapshot)).To(Succeed())
+	})
+
+	t.Run("NotEmpty", func(t *testing.T) {
+		g := NewWithT(t)
+		target := newTestDir(t) + "/data.bolt"
+		g.Expect(restore(target, snapshot)).To(Succeed())
+		g.Expect(restore(target, snapshot)).NotTo(Succeed())
+	})
+}
+
+// TestBoltDefragment is unit testing for the defragment rpc of the bolt backend.
+func TestBoltDefragment(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	client, _ := newKineWithConfig(t, endpoint.Config{Endpoint: "bolt://" + newTestDir(t) + "/data.bolt"})
+	member := client.Endpoints()[0]
+
+	var (
+		keys  = 200
+		value = strings.Repeat("v", 4096)
+	)
+	for i := 0; i < keys; i++ {
+		createKey(ctx, g, client, fmt.Sprintf("/testBoltDefragment/%d", i), value)
+	}
+	for i := 0; i < keys; i++ {
+		deleteKey(ctx, g, client, fmt.Sprintf("/testBoltDefragment/%d", i))
+	}
+	status, err := client.Status(ctx, member)
+	g.Expect(err).To(BeNil())
+	_, err = client.Compact(ctx, status.Header.Revision)
+	g.Expect(err).To(BeNil())
+	compacted, err := client.Status(ctx, member)
+	g.Expect(err).To(BeNil())
+	g.Expect(compacted.DbSizeInUse).To(BeNumerically("<", compacted.DbSize))
+
+	_, err = client.Defragment(ctx, member)
+	g.Expect(err).To(BeNil())
+	defragmented, err := client.Status(ctx, member)
+	g.Expect(err).To(BeNil())
+	g.Expect(defragmented.DbSize).To(BeNumerically("<", compacted.DbSize-int64(keys*len(value))))
+	g.Expect(defragmented.Header.Revision).To(Equal(compacted.Header.Revision))
+
+	createKey(ctx, g, client, "/testBoltDefragment/after", "value")
+	assertKey(ctx, g, client, "/testBoltDefragment/after", "value")
+}
+
+// startBoltBackend is like startBackend, but starts a bolt backend on the database at path. The
+// log of the backend is returned as well, for tests that read it directly.
+//
+// startBoltBackend will panic in case of error
+func startBoltBackend(tb testing.TB, path string) (server.Backend, *bolt.Log, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	log, err := bolt.NewLog(path, generic.Config{})
+	if err != nil {
+		panic(err)
+	}
+	backend := logstructured.New(log)
+	if err := backend.Start(ctx); err != nil {
+		panic(err)
+	}
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			backend.Close()
+		})
+	}
+	tb.Cleanup(stop)
+	return backend, log, stop
+}
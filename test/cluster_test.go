@@ -0,0 +1,61 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+)
+
+// TestMemberList is unit testing for the member list rpc.
+func TestMemberList(t *testing.T) {
+	ctx := context.Background()
+	config := endpoint.Config{
+		Name:       "kine-test",
+		ClientURLs: []string{"https://kine.example:2379"},
+		PeerURLs:   []string{"https://kine.example:2380"},
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		g := NewWithT(t)
+		client := newKine(t)
+		resp, err := client.MemberList(ctx)
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Members).To(HaveLen(1))
+		g.Expect(resp.Members[0].Name).To(Equal("default"))
+		g.Expect(resp.Members[0].ClientURLs).To(Equal(client.Endpoints()))
+		g.Expect(resp.Members[0].PeerURLs).To(Equal(client.Endpoints()))
+	})
+
+	t.Run("Configured", func(t *testing.T) {
+		g := NewWithT(t)
+		client, _ := newKineWithConfig(t, config)
+		resp, err := client.MemberList(ctx)
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Members).To(HaveLen(1))
+		g.Expect(resp.Members[0].Name).To(Equal(config.Name))
+		g.Expect(resp.Members[0].ClientURLs).To(Equal(config.ClientURLs))
+		g.Expect(resp.Members[0].PeerURLs).To(Equal(config.PeerURLs))
+		g.Expect(resp.Header.MemberId).To(Equal(resp.Members[0].ID))
+	})
+
+	t.Run("StableID", func(t *testing.T) {
+		g := NewWithT(t)
+		memberID := func(config endpoint.Config) uint64 {
+			client, _ := newKineWithConfig(t, config)
+			resp, err := client.MemberList(ctx)
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Members).To(HaveLen(1))
+			return resp.Members[0].ID
+		}
+
+		id := memberID(config)
+		g.Expect(id).NotTo(BeZero())
+		g.Expect(memberID(config)).To(Equal(id))
+
+		renamed := config
+		renamed.Name = "kine-other"
+		g.Expect(memberID(renamed)).NotTo(Equal(id))
+	})
+}
@@ -0,0 +1,137 @@
+//go:build cockroach
+// +build cockroach
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// These tests run against a single node CockroachDB, such as one started with
+//
+//	cockroach start-single-node --insecure
+//
+// at the endpoint in KINE_COCKROACH_ENDPOINT, and are built with the cockroach build tag.
+
+// defaultCockroachEndpoint is the endpoint of the CockroachDB node the tests run against, unless
+// KINE_COCKROACH_ENDPOINT is set.
+const defaultCockroachEndpoint = "cockroachdb://root@localhost:26257/?sslmode=disable"
+
+// TestCockroach is unit testing for the operations of the cockroach backend, with each strategy
+// for the ids of rows.
+func TestCockroach(t *testing.T) {
+	for _, idStrategy := range []string{"sequence", "hash-sharded"} {
+		idStrategy := idStrategy
+		t.Run(idStrategy, func(t *testing.T) {
+			g := NewWithT(t)
+			ctx := context.Background()
+			client := newCockroachKine(t, "id-strategy="+idStrategy)
+
+			createKey(ctx, g, client, "/testCockroach/a", "a")
+			createKey(ctx, g, client, "/testCockroach/b", "b")
+			assertKey(ctx, g, client, "/testCockroach/a", "a")
+
+			resp, err := client.Get(ctx, "/testCockroach/a")
+			g.Expect(err).To(BeNil())
+			txn, err := client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision("/testCockroach/a"), "=", resp.Kvs[0].ModRevision)).
+				Then(clientv3.OpPut("/testCockroach/a", "updated")).
+				Commit()
+			g.Expect(err).To(BeNil())
+			g.Expect(txn.Succeeded).To(BeTrue())
+			// revisions are consecutive, as the log needs them to be
+			g.Expect(txn.Header.Revision).To(Equal(resp.Header.Revision + 1))
+			assertKey(ctx, g, client, "/testCockroach/a", "updated")
+
+			list, err := client.Get(ctx, "/testCockroach/", clientv3.WithPrefix())
+			g.Expect(err).To(BeNil())
+			g.Expect(list.Kvs).To(HaveLen(2))
+
+			deleteKey(ctx, g, client, "/testCockroach/b")
+			assertMissingKey(ctx, g, client, "/testCockroach/b")
+		})
+	}
+}
+
+// TestCockroachContention is unit testing for transactions that CockroachDB aborts while they
+// contend for the same keys, which are retried rather than failing.
+func TestCockroachContention(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	client := newCockroachKine(t)
+
+	const (
+		writers = 8
+		writes  = 10
+	)
+	for i := 0; i < writers; i++ {
+		createKey(ctx, g, client, fmt.Sprintf("/testCockroachContention/%d", i), "0")
+	}
+
+	// every transaction writes all keys, so that they all conflict with each other
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, writers*writes)
+	)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				var ops []clientv3.Op
+				for k := 0; k < writers; k++ {
+					ops = append(ops, clientv3.OpPut(fmt.Sprintf("/testCockroachContention/%d", k), fmt.Sprintf("%d-%d", i, j)))
+				}
+				if _, err := client.Txn(ctx).Then(ops...).Commit(); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		g.Expect(err).To(BeNil())
+	}
+
+	// the keys were all written by the same transaction last
+	resp, err := client.Get(ctx, "/testCockroachContention/", clientv3.WithPrefix())
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Kvs).To(HaveLen(writers))
+	for _, kv := range resp.Kvs {
+		g.Expect(kv.Value).To(Equal(resp.Kvs[0].Value))
+	}
+}
+
+// newCockroachKine is like newKine, but starts kine on a new database of the CockroachDB node. The
+// parameters are added to the query of the endpoint.
+//
+// newCockroachKine will panic in case of error
+func newCockroachKine(tb testing.TB, params ...string) *clientv3.Client {
+	address := os.Getenv("KINE_COCKROACH_ENDPOINT")
+	if address == "" {
+		address = defaultCockroachEndpoint
+	}
+
+	// every test gets a database of its own
+	query := ""
+	if i := strings.Index(address, "?"); i >= 0 {
+		address, query = address[:i], address[i+1:]
+	}
+	address = strings.TrimSuffix(address, "/") + fmt.Sprintf("/kine_test_%d", time.Now().UnixNano())
+	params = append(params, query)
+
+	client, _ := newKineWithConfig(tb, endpoint.Config{Endpoint: address + "?" + strings.Trim(strings.Join(params, "&"), "&")})
+	return client
+}
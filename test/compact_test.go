@@ -0,0 +1,363 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/endpoint"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestCompact is unit testing for compaction of old revisions.
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	client, dsn := newKineWithConfig(t, endpoint.Config{})
+	log, dialect := openSQLLog(t, dsn)
+
+	// compact in many small batches to make sure none of the rows are missed
+	dialect.CompactBatchSize = 100
+	dialect.CompactBatchDelay = time.Millisecond
+
+	var (
+		key       = "testKeyCompact"
+		revisions []int64
+	)
+
+	// Create a key and update it a few thousand times
+	{
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "value-0")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		revisions = append(revisions, resp.Header.Revision)
+
+		for i := 1; i < 2000; i++ {
+			resp, err := client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(key), "=", revisions[len(revisions)-1])).
+				Then(clientv3.OpPut(key, fmt.Sprintf("value-%d", i))).
+				Else(clientv3.OpGet(key)).
+				Commit()
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Succeeded).To(BeTrue())
+			revisions = append(revisions, resp.Header.Revision)
+		}
+	}
+
+	compactRev := revisions[1500]
+	rowsBefore := countRows(dialect.DB)
+
+	t.Run("RowsDeleted", func(t *testing.T) {
+		g := NewWithT(t)
+		deleted, err := log.Compact(ctx, compactRev)
+		g.Expect(err).To(BeNil())
+		g.Expect(deleted).To(BeNumerically(">=", int64(1500)))
+		g.Expect(countRows(dialect.DB)).To(Equal(rowsBefore - deleted))
+	})
+
+	t.Run("GetCompactedRevisionFails", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.Get(ctx, key, clientv3.WithRev(revisions[1000]))
+		g.Expect(err).To(Equal(rpctypes.ErrCompacted))
+	})
+
+	t.Run("GetAtCompactRevision", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, key, clientv3.WithRev(compactRev))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(1))
+		g.Expect(resp.Kvs[0].Value).To(Equal([]byte("value-1500")))
+	})
+
+	t.Run("GetLatest", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(1))
+		g.Expect(resp.Kvs[0].Value).To(Equal([]byte("value-1999")))
+		g.Expect(resp.Kvs[0].ModRevision).To(Equal(revisions[len(revisions)-1]))
+	})
+}
+
+// TestCompactRetention verifies that automatic compaction keeps the configured number of revisions.
+func TestCompactRetention(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newKineWithConfig(t, endpoint.Config{
+		CompactInterval:  100 * time.Millisecond,
+		CompactMinRetain: 100,
+	})
+
+	var (
+		key = "testKeyCompactRetention"
+		rev int64
+	)
+
+	// Create a key and update it a few hundred times
+	{
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "value-0")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		rev = resp.Header.Revision
+
+		for i := 1; i < 500; i++ {
+			resp, err := client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+				Then(clientv3.OpPut(key, fmt.Sprintf("value-%d", i))).
+				Else(clientv3.OpGet(key)).
+				Commit()
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Succeeded).To(BeTrue())
+			rev = resp.Header.Revision
+		}
+	}
+
+	t.Run("OlderRevisionsCompacted", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() error {
+			_, err := client.Get(ctx, key, clientv3.WithRev(rev-101))
+			return err
+		}, 5*time.Second, 50*time.Millisecond).Should(Equal(rpctypes.ErrCompacted))
+	})
+
+	t.Run("RetainedRevisionsReadable", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, key, clientv3.WithRev(rev-100))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(1))
+		g.Expect(resp.Kvs[0].Value).To(Equal([]byte("value-399")))
+	})
+}
+
+// TestCompactRPC is unit testing for client-initiated compaction.
+func TestCompactRPC(t *testing.T) {
+	ctx := context.Background()
+	client, dsn := newKineWithConfig(t, endpoint.Config{})
+	_, dialect := openSQLLog(t, dsn)
+
+	var (
+		key       = "testKeyCompactRPC"
+		revisions []int64
+	)
+
+	// Create a key and update it a few hundred times
+	{
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "value-0")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		revisions = append(revisions, resp.Header.Revision)
+
+		for i := 1; i < 500; i++ {
+			resp, err := client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(key), "=", revisions[len(revisions)-1])).
+				Then(clientv3.OpPut(key, fmt.Sprintf("value-%d", i))).
+				Else(clientv3.OpGet(key)).
+				Commit()
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Succeeded).To(BeTrue())
+			revisions = append(revisions, resp.Header.Revision)
+		}
+	}
+
+	compactRev := revisions[400]
+	rowsBefore := countRows(dialect.DB)
+
+	t.Run("CompactFutureRevisionFails", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.Compact(ctx, revisions[len(revisions)-1]+1000)
+		g.Expect(err).To(Equal(rpctypes.ErrFutureRev))
+	})
+
+	t.Run("CompactDeletesRows", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Compact(ctx, compactRev)
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Header.Revision).To(BeNumerically(">=", revisions[len(revisions)-1]))
+		g.Expect(countRows(dialect.DB)).To(BeNumerically("<", rowsBefore))
+	})
+
+	t.Run("CompactAgainFails", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.Compact(ctx, compactRev)
+		g.Expect(err).To(Equal(rpctypes.ErrCompacted))
+	})
+
+	t.Run("GetCompactedRevisionFails", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.Get(ctx, key, clientv3.WithRev(revisions[100]))
+		g.Expect(err).To(Equal(rpctypes.ErrCompacted))
+	})
+
+	t.Run("GetAtCompactRevision", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, key, clientv3.WithRev(compactRev))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(1))
+		g.Expect(resp.Kvs[0].Value).To(Equal([]byte("value-400")))
+	})
+}
+
+// TestCompactMetrics is unit testing for the metrics of compactions: the rows they delete, their
+// duration, the time of the last one that succeeded, the failures and the revisions left to
+// compact.
+func TestCompactMetrics(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	registry := prometheus.NewRegistry()
+	client, dsn := newKineWithConfig(t, endpoint.Config{MetricsRegistry: registry})
+
+	key := "/testCompactMetrics/key"
+	createKey(ctx, g, client, key, "value-0")
+	var rev int64
+	for i := 1; i <= 10; i++ {
+		resp, err := client.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		rev = resp.Header.Revision
+		updated, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(key, fmt.Sprintf("value-%d", i))).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(updated.Succeeded).To(BeTrue())
+	}
+
+	before := time.Now()
+	_, err := client.Compact(ctx, rev)
+	g.Expect(err).To(BeNil())
+	resp, err := client.Get(ctx, key)
+	g.Expect(err).To(BeNil())
+
+	families := gatherMetrics(g, registry)
+	g.Expect(metricValue(families["kine_compact_rows_deleted_total"], nil)).To(BeNumerically(">=", 9))
+	g.Expect(families["kine_compact_duration_seconds"].GetMetric()[0].GetHistogram().GetSampleCount()).To(Equal(uint64(1)))
+	g.Expect(metricValue(families["kine_compact_last_success_timestamp_seconds"], nil)).To(BeNumerically(">=", float64(before.Unix())))
+	g.Expect(metricValue(families["kine_compact_revision_lag"], nil)).To(Equal(float64(resp.Header.Revision - rev)))
+	g.Expect(families).NotTo(HaveKey("kine_compact_failures_total"))
+
+	// compactions of revisions that were compacted already do not run
+	_, err = client.Compact(ctx, rev)
+	g.Expect(err).To(Equal(rpctypes.ErrCompacted))
+	families = gatherMetrics(g, registry)
+	g.Expect(families["kine_compact_duration_seconds"].GetMetric()[0].GetHistogram().GetSampleCount()).To(Equal(uint64(1)))
+
+	// compactions that fail are counted by their reason, on the registry shared with the instance
+	log, dialect := openSQLLogWithConfig(t, dsn, sqlite.Config{DisableUpdateHook: true}, generic.Config{MetricsRegisterer: registry})
+	g.Expect(dialect.DB.Close()).To(Succeed())
+	_, err = log.Compact(ctx, resp.Header.Revision)
+	g.Expect(err).NotTo(BeNil())
+	families = gatherMetrics(g, registry)
+	g.Expect(metricValue(families["kine_compact_failures_total"], map[string]string{"reason": "database"})).To(Equal(1.0))
+	g.Expect(families["kine_compact_duration_seconds"].GetMetric()[0].GetHistogram().GetSampleCount()).To(Equal(uint64(2)))
+}
+
+// TestCompactPrefixRetention verifies that automatic compaction trims the history of a prefix
+// with a retention shorter than that of the rest of the keyspace, and keeps the history of the rest.
+func TestCompactPrefixRetention(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, _ := newKineWithConfig(t, endpoint.Config{
+		CompactInterval: 100 * time.Millisecond,
+		PrefixRetention: []generic.PrefixRetention{{Prefix: "/registry/events/", KeepRevisions: 50}},
+	})
+
+	var (
+		eventKey = "/registry/events/default/event"
+		podKey   = "/registry/pods/default/pod"
+		revs     = map[string][]int64{}
+	)
+
+	// Create an event and a pod and update both a couple hundred times
+	{
+		g := NewWithT(t)
+		for i := 0; i < 200; i++ {
+			for _, key := range []string{eventKey, podKey} {
+				var modRev int64
+				if n := len(revs[key]); n > 0 {
+					modRev = revs[key][n-1]
+				}
+				resp, err := client.Txn(ctx).
+					If(clientv3.Compare(clientv3.ModRevision(key), "=", modRev)).
+					Then(clientv3.OpPut(key, fmt.Sprintf("value-%d", i))).
+					Commit()
+				g.Expect(err).To(BeNil())
+				g.Expect(resp.Succeeded).To(BeTrue())
+				revs[key] = append(revs[key], resp.Header.Revision)
+			}
+		}
+	}
+	eventRevs, podRevs := revs[eventKey], revs[podKey]
+	lastRev := podRevs[len(podRevs)-1]
+
+	t.Run("OlderEventRevisionsTrimmed", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() error {
+			_, err := client.Get(ctx, eventKey, clientv3.WithRev(eventRevs[0]))
+			return err
+		}, 5*time.Second, 50*time.Millisecond).Should(Equal(rpctypes.ErrCompacted))
+
+		_, err := client.Get(ctx, "/registry/events/", clientv3.WithPrefix(), clientv3.WithRev(eventRevs[0]))
+		g.Expect(err).To(Equal(rpctypes.ErrCompacted))
+	})
+
+	t.Run("RetainedEventRevisionsReadable", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, eventKey, clientv3.WithRev(lastRev-10))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(1))
+		g.Expect(resp.Kvs[0].Value).To(Equal([]byte("value-194")))
+	})
+
+	t.Run("OtherPrefixesKeepHistory", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, podKey, clientv3.WithRev(podRevs[0]))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(1))
+		g.Expect(resp.Kvs[0].Value).To(Equal([]byte("value-0")))
+
+		resp, err = client.Get(ctx, "/registry/pods/", clientv3.WithPrefix(), clientv3.WithRev(podRevs[1]))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(1))
+		g.Expect(resp.Kvs[0].Value).To(Equal([]byte("value-1")))
+	})
+
+	t.Run("WatchFromTrimmedRevisionCanceled", func(t *testing.T) {
+		g := NewWithT(t)
+		watchCh := client.Watch(ctx, "/registry/events/", clientv3.WithPrefix(), clientv3.WithRev(eventRevs[0]))
+
+		g.Eventually(watchCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+			g.Expect(v.Canceled).To(BeTrue())
+			g.Expect(v.CompactRevision).To(BeNumerically(">", eventRevs[0]))
+			g.Expect(v.Err()).To(Equal(rpctypes.ErrCompacted))
+			return true
+		})))
+	})
+
+	t.Run("WatchOtherPrefixFromOldRevision", func(t *testing.T) {
+		g := NewWithT(t)
+		watchCh := client.Watch(ctx, "/registry/pods/", clientv3.WithPrefix(), clientv3.WithRev(podRevs[0]))
+
+		g.Eventually(watchCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+			g.Expect(v.Canceled).To(BeFalse())
+			g.Expect(v.Events).NotTo(BeEmpty())
+			g.Expect(v.Events[0].Kv.ModRevision).To(Equal(podRevs[0]))
+			g.Expect(v.Events[0].Kv.Value).To(Equal([]byte("value-0")))
+			return true
+		})))
+	})
+}
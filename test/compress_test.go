@@ -0,0 +1,194 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// compressedValuePrefix is the prefix of the values the backend stores compressed.
+var compressedValuePrefix = []byte("\x00kine-zstd\x00")
+
+// TestValueCompression is unit testing for storing values compressed, and reading them back
+// whether or not compression is still turned on.
+func TestValueCompression(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	dsn := newTestDir(t) + "/data.db"
+	large, small := kubernetesObject(0), []byte("small")
+
+	// values written before compression is turned on stay as they were
+	backend, stop := startCompressedBackend(t, dsn, false)
+	_, err := backend.Create(ctx, "/testValueCompression/legacy", large, 0)
+	g.Expect(err).To(BeNil())
+	stop()
+	g.Expect(storedValue(g, dsn, "/testValueCompression/legacy")).To(Equal(large))
+
+	backend, stop = startCompressedBackend(t, dsn, true)
+	_, kv, err := backend.Get(ctx, "/testValueCompression/legacy", "", 1, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(kv.Value).To(Equal(large))
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rev, err := backend.CurrentRevision(ctx)
+	g.Expect(err).To(BeNil())
+	watchCh := backend.Watch(watchCtx, "/testValueCompression/", rev+1)
+
+	// large values are stored compressed, small ones as they are
+	_, err = backend.Create(ctx, "/testValueCompression/large", large, 0)
+	g.Expect(err).To(BeNil())
+	_, err = backend.Create(ctx, "/testValueCompression/small", small, 0)
+	g.Expect(err).To(BeNil())
+	updated := kubernetesObject(1)
+	_, _, ok, err := backend.Update(ctx, "/testValueCompression/legacy", updated, kv.ModRevision, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(BeTrue())
+
+	stored := storedValue(g, dsn, "/testValueCompression/large")
+	g.Expect(stored).To(HavePrefix(string(compressedValuePrefix)))
+	g.Expect(len(stored)).To(BeNumerically("<", len(large)))
+	g.Expect(storedValue(g, dsn, "/testValueCompression/small")).To(Equal(small))
+
+	// and read back as they were written, in lists and watch events too
+	_, kvs, err := backend.List(ctx, "/testValueCompression/", "", 0, 0, false, server.RevisionFilter{})
+	g.Expect(err).To(BeNil())
+	g.Expect(kvs).To(HaveLen(3))
+	g.Expect(kvs[0].Value).To(Equal(large))
+	g.Expect(kvs[1].Value).To(Equal(updated))
+	g.Expect(kvs[2].Value).To(Equal(small))
+
+	var events []*server.Event
+	g.Eventually(func() []*server.Event {
+		select {
+		case watchEvents := <-watchCh:
+			g.Expect(watchEvents.Err).To(BeNil())
+			events = append(events, watchEvents.Events...)
+		default:
+		}
+		return events
+	}, 5*time.Second).Should(HaveLen(3))
+	g.Expect(events[0].KV.Value).To(Equal(large))
+	g.Expect(events[2].KV.Value).To(Equal(updated))
+	g.Expect(events[2].PrevKV.Value).To(Equal(large))
+	cancel()
+	stop()
+
+	// once compression is turned off again, compressed values are still read
+	backend, stop = startCompressedBackend(t, dsn, false)
+	defer stop()
+	_, kv, err = backend.Get(ctx, "/testValueCompression/large", "", 1, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(kv.Value).To(Equal(large))
+	_, kv, err = backend.Get(ctx, "/testValueCompression/legacy", "", 1, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(kv.Value).To(Equal(updated))
+}
+
+// BenchmarkValueCompression is a benchmark for creating Kubernetes objects with and without value
+// compression. It reports the size of the database per object.
+func BenchmarkValueCompression(b *testing.B) {
+	for _, compressed := range []bool{false, true} {
+		compressed := compressed
+		b.Run(fmt.Sprintf("compressed=%v", compressed), func(b *testing.B) {
+			g := NewWithT(b)
+			ctx := context.Background()
+			backend, stop := startCompressedBackend(b, newTestDir(b)+"/data.db", compressed)
+			defer stop()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := backend.Create(ctx, fmt.Sprintf("/registry/pods/default/bench-%d", i), kubernetesObject(i), 0)
+				g.Expect(err).To(BeNil())
+			}
+			b.StopTimer()
+
+			size, err := backend.DbSize(ctx)
+			g.Expect(err).To(BeNil())
+			b.ReportMetric(float64(size)/float64(b.N), "db-bytes/op")
+		})
+	}
+}
+
+// startCompressedBackend is like startBackend, but stores values compressed if compressed is set.
+// The returned function stops the backend and closes it.
+//
+// startCompressedBackend will panic in case of error
+func startCompressedBackend(tb testing.TB, dsn string, compressed bool) (server.Backend, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	backend, _, err := sqlite.NewVariant(ctx, sqliteDriverName(), dsn, sqlite.Config{}, generic.Config{})
+	if err != nil {
+		panic(err)
+	}
+	backend.(*logstructured.LogStructured).SetCompression(compressed)
+	if err := backend.Start(ctx); err != nil {
+		panic(err)
+	}
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			backend.Close()
+		})
+	}
+	tb.Cleanup(stop)
+	return backend, stop
+}
+
+// storedValue returns the value of the latest row of the key, as it is stored in the database.
+func storedValue(g Gomega, dsn, key string) []byte {
+	db, err := sql.Open(sqliteDriverName(), dsn)
+	g.Expect(err).To(BeNil())
+	defer db.Close()
+
+	var value []byte
+	g.Expect(db.QueryRow("SELECT value FROM kine WHERE name = ? ORDER BY id DESC LIMIT 1", key).Scan(&value)).To(Succeed())
+	return value
+}
+
+// kubernetesObject returns the JSON of a pod like those Kubernetes stores, with the labels,
+// annotations and managed fields that make up most of the size of real objects.
+func kubernetesObject(i int) []byte {
+	var env bytes.Buffer
+	for j := 0; j < 10; j++ {
+		if j > 0 {
+			env.WriteString(",")
+		}
+		fmt.Fprintf(&env, `{"name":"SERVICE_%d_PORT","value":"tcp://10.43.%d.%d:8080"}`, j, i%256, j)
+	}
+	return []byte(fmt.Sprintf(`{"kind":"Pod","apiVersion":"v1","metadata":{"name":"web-%[1]d","generateName":"web-","namespace":"default",`+
+		`"uid":"5f0c6a1e-%[1]d-4c5e-9d3b-1a2b3c4d5e6f","resourceVersion":"%[2]d","creationTimestamp":"2021-07-01T12:00:00Z",`+
+		`"labels":{"app.kubernetes.io/name":"web","app.kubernetes.io/instance":"web-%[1]d","pod-template-hash":"6d4cf56db6"},`+
+		`"annotations":{"kubectl.kubernetes.io/restartedAt":"2021-07-01T11:59:00Z","prometheus.io/scrape":"true","prometheus.io/port":"9102"},`+
+		`"ownerReferences":[{"apiVersion":"apps/v1","kind":"ReplicaSet","name":"web-6d4cf56db6","uid":"1c2d3e4f-5a6b-7c8d-9e0f-a1b2c3d4e5f6","controller":true,"blockOwnerDeletion":true}],`+
+		`"managedFields":[{"manager":"kube-controller-manager","operation":"Update","apiVersion":"v1","time":"2021-07-01T12:00:00Z","fieldsType":"FieldsV1",`+
+		`"fieldsV1":{"f:metadata":{"f:generateName":{},"f:labels":{".":{},"f:app.kubernetes.io/instance":{},"f:app.kubernetes.io/name":{},"f:pod-template-hash":{}},`+
+		`"f:ownerReferences":{".":{},"k:{\"uid\":\"1c2d3e4f-5a6b-7c8d-9e0f-a1b2c3d4e5f6\"}":{}}},"f:spec":{"f:containers":{"k:{\"name\":\"web\"}":{".":{},"f:env":{},"f:image":{},`+
+		`"f:imagePullPolicy":{},"f:name":{},"f:ports":{},"f:resources":{},"f:terminationMessagePath":{},"f:terminationMessagePolicy":{}}},"f:dnsPolicy":{},"f:restartPolicy":{},`+
+		`"f:schedulerName":{},"f:securityContext":{},"f:terminationGracePeriodSeconds":{}}}},{"manager":"kubelet","operation":"Update","apiVersion":"v1","time":"2021-07-01T12:00:05Z",`+
+		`"fieldsType":"FieldsV1","fieldsV1":{"f:status":{"f:conditions":{},"f:containerStatuses":{},"f:hostIP":{},"f:phase":{},"f:podIP":{},"f:podIPs":{},"f:startTime":{}}}}]},`+
+		`"spec":{"volumes":[{"name":"kube-api-access-%[1]d","projected":{"sources":[{"serviceAccountToken":{"expirationSeconds":3607,"path":"token"}},`+
+		`{"configMap":{"name":"kube-root-ca.crt","items":[{"key":"ca.crt","path":"ca.crt"}]}}],"defaultMode":420}}],`+
+		`"containers":[{"name":"web","image":"registry.example.com/web:1.%[3]d","ports":[{"containerPort":8080,"protocol":"TCP"}],"env":[%[4]s],`+
+		`"resources":{"limits":{"cpu":"500m","memory":"256Mi"},"requests":{"cpu":"100m","memory":"128Mi"}},"terminationMessagePath":"/dev/termination-log",`+
+		`"terminationMessagePolicy":"File","imagePullPolicy":"IfNotPresent"}],"restartPolicy":"Always","terminationGracePeriodSeconds":30,"dnsPolicy":"ClusterFirst",`+
+		`"serviceAccountName":"default","nodeName":"node-%[5]d","securityContext":{},"schedulerName":"default-scheduler"},`+
+		`"status":{"phase":"Running","conditions":[{"type":"Initialized","status":"True","lastTransitionTime":"2021-07-01T12:00:00Z"},`+
+		`{"type":"Ready","status":"True","lastTransitionTime":"2021-07-01T12:00:05Z"},{"type":"ContainersReady","status":"True","lastTransitionTime":"2021-07-01T12:00:05Z"},`+
+		`{"type":"PodScheduled","status":"True","lastTransitionTime":"2021-07-01T12:00:00Z"}],"hostIP":"192.168.1.%[5]d","podIP":"10.42.%[6]d.%[7]d",`+
+		`"startTime":"2021-07-01T12:00:00Z","containerStatuses":[{"name":"web","state":{"running":{"startedAt":"2021-07-01T12:00:04Z"}},"ready":true,"restartCount":0,`+
+		`"image":"registry.example.com/web:1.%[3]d","imageID":"registry.example.com/web@sha256:%[8]s","containerID":"containerd://%[8]s","started":true}]}}`,
+		i, 1000+i, i%10, env.String(), i%5, i%256, i/256%256, strings.Repeat(fmt.Sprintf("%08x", i), 8)))
+}
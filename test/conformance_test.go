@@ -0,0 +1,560 @@
+//go:build conformance
+// +build conformance
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// These tests compare the responses of kine with those of etcd, which is embedded in the tests,
+// and are built with the conformance build tag, as in
+//
+//	go test -tags conformance -run TestConformance ./test
+//
+// The steps of each case run against both, under a prefix of the case, and their results must be
+// equal. Revisions are compared relative to the revision that the case starts at, so that the
+// writes of earlier cases do not count. Cases with a divergence document a difference that kine
+// makes on purpose; their results must differ, so that they are revisited if kine starts to
+// behave as etcd does.
+
+// conformanceCases are the cases of TestConformance. New cases are a line of steps, which take
+// keys without the prefix of the case and revisions relative to its start.
+var conformanceCases = []struct {
+	name       string
+	steps      []conformanceStep
+	divergence string
+}{
+	{name: "Create", steps: steps(op.create("a", "1"), op.get("a"))},
+	{name: "CreateExisting", steps: steps(op.create("a", "1"), op.create("a", "2"), op.get("a"))},
+	{name: "Recreate", steps: steps(op.create("a", "1"), op.remove("a", 1), op.create("a", "2"), op.get("a"))},
+	{name: "Update", steps: steps(op.create("a", "1"), op.update("a", "2", 1), op.get("a"))},
+	{name: "UpdateStale", steps: steps(op.create("a", "1"), op.update("a", "2", 1), op.update("a", "3", 1), op.get("a"))},
+	{name: "UpdateMissing", steps: steps(op.update("a", "1", 1), op.get("a"))},
+	{name: "Delete", steps: steps(op.create("a", "1"), op.remove("a", 1), op.get("a"))},
+	{name: "DeleteStale", steps: steps(op.create("a", "1"), op.update("a", "2", 1), op.remove("a", 1), op.get("a"))},
+	{name: "DeleteMissing", steps: steps(op.remove("a", 1), op.deleteRange("a"))},
+	{name: "Put", steps: steps(op.put("a", "1"), op.put("a", "2"), op.get("a"))},
+	{name: "DeleteRange", steps: steps(op.create("a", "1"), op.create("b", "2"), op.create("c", "3"), op.deleteRange("", op.prefix(), op.prevKV()), op.get("", op.prefix()))},
+	{name: "GetMissing", steps: steps(op.get("a"))},
+	{name: "GetRevision", steps: steps(op.create("a", "1"), op.update("a", "2", 1), op.get("a", op.atRev(1)), op.get("a", op.atRev(2)))},
+	{name: "GetRevisionDeleted", steps: steps(op.create("a", "1"), op.remove("a", 1), op.get("a", op.atRev(1)), op.get("a", op.atRev(2)))},
+	{name: "GetCompacted", steps: steps(op.create("a", "1"), op.update("a", "2", 1), op.compact(2), op.get("a", op.atRev(1)), op.get("a", op.atRev(2)))},
+	{name: "GetFuture", steps: steps(op.create("a", "1"), op.get("a", op.atRev(100)))},
+	{name: "CompactTwice", steps: steps(op.create("a", "1"), op.update("a", "2", 1), op.compact(1), op.compact(1))},
+	{name: "CompactFuture", steps: steps(op.create("a", "1"), op.compact(100))},
+	{name: "List", steps: steps(op.create("b", "2"), op.create("a", "1"), op.create("c", "3"), op.get("", op.prefix()))},
+	{name: "ListLimit", steps: steps(op.create("a", "1"), op.create("b", "2"), op.create("c", "3"), op.get("", op.prefix(), op.limit(2)))},
+	{name: "ListRange", steps: steps(op.create("a", "1"), op.create("b", "2"), op.create("c", "3"), op.get("b", op.rangeTo("d")), op.get("a", op.rangeTo("c")))},
+	{name: "ListRevision", steps: steps(op.create("a", "1"), op.create("b", "2"), op.remove("a", 1), op.update("b", "3", 2), op.get("", op.prefix(), op.atRev(2)))},
+	{name: "ListFilter", steps: steps(op.create("a", "1"), op.create("b", "2"), op.update("a", "3", 1), op.get("", op.prefix(), op.minModRev(2)))},
+	{name: "Count", steps: steps(op.create("a", "1"), op.create("b", "2"), op.remove("a", 1), op.get("", op.prefix(), op.countOnly()))},
+	{name: "KeysOnly", steps: steps(op.create("a", "1"), op.create("b", "2"), op.get("", op.prefix(), op.keysOnly()))},
+	{name: "TxnCompareValue", steps: steps(op.create("a", "1"), op.txn(op.value("a", "=", "1"), "a", "2"), op.txn(op.value("a", "=", "1"), "a", "3"), op.get("a"))},
+	{name: "TxnCompareVersion", steps: steps(op.create("a", "1"), op.update("a", "2", 1), op.txn(op.version("a", ">", 1), "a", "3"), op.txn(op.version("a", "<", 2), "a", "4"), op.get("a"))},
+	{name: "TxnCompareCreate", steps: steps(op.create("a", "1"), op.update("a", "2", 1), op.txn(op.createRev("a", "=", 1), "a", "3"), op.txn(op.createRev("a", "=", 2), "a", "4"), op.get("a"))},
+	{name: "TxnPrevKV", steps: steps(op.create("a", "1"), op.txn(op.version("a", ">", 0), "a", "2", op.prevKV()))},
+	{name: "Lease", steps: steps(op.createWithLease("a", "1", 60), op.get("a"))},
+	{name: "Watch", steps: steps(op.create("a", "1"), op.create("b", "2"), op.update("a", "3", 1), op.watch("a", 1, 2))},
+	{name: "WatchPrefix", steps: steps(op.create("a", "1"), op.create("b", "2"), op.update("a", "3", 1), op.watch("", 2, 2, op.prefix()))},
+	{name: "WatchPrevKV", steps: steps(op.create("a", "1"), op.update("a", "2", 1), op.update("a", "3", 2), op.watch("a", 2, 2, op.prevKV()))},
+	{name: "WatchCompacted", steps: steps(op.create("a", "1"), op.update("a", "2", 1), op.update("a", "3", 2), op.compact(2), op.watch("a", 1, 1))},
+
+	{name: "TxnMultipleWrites", steps: steps(op.txnPuts("a", "b"), op.get("", op.prefix())),
+		divergence: "the writes of a transaction get consecutive revisions in kine, rather than that of the transaction"},
+	{name: "SortByKey", steps: steps(op.create("a", "1"), op.get("", op.prefix(), op.sortByKey())),
+		divergence: "kine lists keys in order, but rejects ranges that ask for a sort order"},
+	{name: "WatchDelete", steps: steps(op.create("a", "1"), op.remove("a", 1), op.watch("a", 2, 1)),
+		divergence: "the events of deletes carry the value and the create revision of the deleted key in kine"},
+}
+
+// TestConformance is differential testing for the responses of kine, on the driver of
+// newKine, against those of an etcd embedded in the test.
+func TestConformance(t *testing.T) {
+	etcd := newETCD(t)
+	kine := newKine(t)
+
+	for _, test := range conformanceCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			prefix := fmt.Sprintf("/testConformance/%s/", test.name)
+			want := runConformanceCase(g, etcd, prefix, test.steps)
+			got := runConformanceCase(g, kine, prefix, test.steps)
+			if test.divergence != "" {
+				t.Logf("kine diverges from etcd: %s", test.divergence)
+				g.Expect(got).NotTo(Equal(want), "kine behaves as etcd does, the divergence is gone")
+				return
+			}
+			g.Expect(got).To(Equal(want))
+		})
+	}
+}
+
+// runConformanceCase runs the steps against the client, under the prefix, and returns their
+// results.
+func runConformanceCase(g Gomega, client *clientv3.Client, prefix string, steps []conformanceStep) []conformanceResult {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := client.Get(ctx, prefix, clientv3.WithPrefix())
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Kvs).To(BeEmpty())
+	c := &conformanceClient{client: client, prefix: prefix, base: resp.Header.Revision}
+
+	results := make([]conformanceResult, 0, len(steps))
+	for _, step := range steps {
+		results = append(results, step(ctx, c))
+	}
+	return results
+}
+
+// newETCD starts a single member etcd on free ports, and returns a client of it. Both are
+// stopped once the test is done.
+//
+// newETCD will panic in case of error
+func newETCD(tb testing.TB) *clientv3.Client {
+	g := NewWithT(tb)
+	clientURL := url.URL{Scheme: "http", Host: freeAddress(g)}
+	peerURL := url.URL{Scheme: "http", Host: freeAddress(g)}
+
+	config := embed.NewConfig()
+	config.Dir = newTestDir(tb) + "/etcd"
+	config.LogLevel = "error"
+	config.LCUrls, config.ACUrls = []url.URL{clientURL}, []url.URL{clientURL}
+	config.LPUrls, config.APUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	config.InitialCluster = config.InitialClusterFromName(config.Name)
+	etcd, err := embed.StartEtcd(config)
+	if err != nil {
+		panic(err)
+	}
+	tb.Cleanup(etcd.Close)
+	select {
+	case <-etcd.Server.ReadyNotify():
+	case <-time.After(time.Minute):
+		panic("etcd did not become ready")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{clientURL.String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		panic(err)
+	}
+	tb.Cleanup(func() {
+		client.Close()
+	})
+	return client
+}
+
+// conformanceClient is a client that the steps of a case run with. It names keys under the
+// prefix of the case and translates revisions relative to the revision it started at.
+type conformanceClient struct {
+	client *clientv3.Client
+	prefix string
+	base   int64
+}
+
+func (c *conformanceClient) key(key string) string {
+	return c.prefix + key
+}
+
+// rev returns the revision of the relative revision. Zero is kept as it is, as it stands for no
+// revision.
+func (c *conformanceClient) rev(relative int64) int64 {
+	if relative == 0 {
+		return 0
+	}
+	return c.base + relative
+}
+
+// relative returns the revision relative to the start of the case, as rev takes it.
+func (c *conformanceClient) relative(rev int64) int64 {
+	if rev == 0 {
+		return 0
+	}
+	return rev - c.base
+}
+
+func (c *conformanceClient) options(options []conformanceOption) []clientv3.OpOption {
+	ret := make([]clientv3.OpOption, 0, len(options))
+	for _, option := range options {
+		ret = append(ret, option(c))
+	}
+	return ret
+}
+
+// conformanceResult is the part of a response that must match, with relative revisions and keys
+// without the prefix of the case. Errors are compared by their codes.
+type conformanceResult struct {
+	Code            codes.Code
+	Revision        int64
+	Succeeded       bool
+	Count           int64
+	More            bool
+	Deleted         int64
+	KVs             []conformanceKV
+	PrevKVs         []conformanceKV
+	Responses       []conformanceResult
+	Events          []conformanceEvent
+	Canceled        bool
+	CompactRevision int64
+}
+
+type conformanceKV struct {
+	Key            string
+	Value          string
+	CreateRevision int64
+	ModRevision    int64
+	Version        int64
+	Lease          bool
+}
+
+// conformanceEvent is an event of a watch. The versions of its key values are not compared, as
+// kine leaves them out of events rather than count the rows of each key as it sends them.
+type conformanceEvent struct {
+	Type   mvccpb.Event_EventType
+	KV     conformanceKV
+	PrevKV *conformanceKV
+}
+
+func (c *conformanceClient) errorResult(err error) conformanceResult {
+	if etcdErr, ok := err.(rpctypes.EtcdError); ok {
+		return conformanceResult{Code: etcdErr.Code()}
+	}
+	return conformanceResult{Code: status.Code(err)}
+}
+
+func (c *conformanceClient) kv(kv *mvccpb.KeyValue) conformanceKV {
+	return conformanceKV{
+		Key:            strings.TrimPrefix(string(kv.Key), c.prefix),
+		Value:          string(kv.Value),
+		CreateRevision: c.relative(kv.CreateRevision),
+		ModRevision:    c.relative(kv.ModRevision),
+		Version:        kv.Version,
+		Lease:          kv.Lease != 0,
+	}
+}
+
+// kvs returns the key values, or nil if there are none, as either server may omit them.
+func (c *conformanceClient) kvs(kvs []*mvccpb.KeyValue) []conformanceKV {
+	var ret []conformanceKV
+	for _, kv := range kvs {
+		ret = append(ret, c.kv(kv))
+	}
+	return ret
+}
+
+func (c *conformanceClient) rangeResult(resp *etcdserverpb.RangeResponse) conformanceResult {
+	return conformanceResult{
+		Revision: c.relative(resp.Header.Revision),
+		Count:    resp.Count,
+		More:     resp.More,
+		KVs:      c.kvs(resp.Kvs),
+	}
+}
+
+// txnResult returns the result of the transaction and its ops. The headers of the responses of
+// the ops are not compared, as etcd only fills in that of the transaction.
+func (c *conformanceClient) txnResult(resp *clientv3.TxnResponse) conformanceResult {
+	result := conformanceResult{
+		Revision:  c.relative(resp.Header.Revision),
+		Succeeded: resp.Succeeded,
+	}
+	for _, op := range resp.Responses {
+		var r conformanceResult
+		switch {
+		case op.GetResponseRange() != nil:
+			r = c.rangeResult(op.GetResponseRange())
+		case op.GetResponsePut() != nil:
+			if prev := op.GetResponsePut().PrevKv; prev != nil {
+				r.PrevKVs = []conformanceKV{c.kv(prev)}
+			}
+		case op.GetResponseDeleteRange() != nil:
+			r.Deleted = op.GetResponseDeleteRange().Deleted
+			r.PrevKVs = c.kvs(op.GetResponseDeleteRange().PrevKvs)
+		}
+		r.Revision = 0
+		result.Responses = append(result.Responses, r)
+	}
+	return result
+}
+
+// conformanceStep is an operation of a case, which returns its result.
+type conformanceStep func(ctx context.Context, c *conformanceClient) conformanceResult
+
+// conformanceOption is an option of the requests of a step.
+type conformanceOption func(c *conformanceClient) clientv3.OpOption
+
+func steps(steps ...conformanceStep) []conformanceStep {
+	return steps
+}
+
+// op holds the steps and options of the cases, which write keys in transactions as the
+// apiserver does, unless a step says otherwise.
+var op conformanceOps
+
+type conformanceOps struct{}
+
+// create creates the key if it does not exist, or gets it otherwise.
+func (conformanceOps) create(key, value string) conformanceStep {
+	return func(ctx context.Context, c *conformanceClient) conformanceResult {
+		resp, err := c.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(c.key(key)), "=", 0)).
+			Then(clientv3.OpPut(c.key(key), value)).
+			Else(clientv3.OpGet(c.key(key))).
+			Commit()
+		if err != nil {
+			return c.errorResult(err)
+		}
+		return c.txnResult(resp)
+	}
+}
+
+// createWithLease creates the key with a lease of the TTL.
+func (conformanceOps) createWithLease(key, value string, ttl int64) conformanceStep {
+	return func(ctx context.Context, c *conformanceClient) conformanceResult {
+		lease, err := c.client.Grant(ctx, ttl)
+		if err != nil {
+			return c.errorResult(err)
+		}
+		resp, err := c.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(c.key(key)), "=", 0)).
+			Then(clientv3.OpPut(c.key(key), value, clientv3.WithLease(lease.ID))).
+			Commit()
+		if err != nil {
+			return c.errorResult(err)
+		}
+		return c.txnResult(resp)
+	}
+}
+
+// update updates the key if it was last modified at the revision, or gets it otherwise.
+func (conformanceOps) update(key, value string, modRevision int64) conformanceStep {
+	return func(ctx context.Context, c *conformanceClient) conformanceResult {
+		resp, err := c.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(c.key(key)), "=", c.rev(modRevision))).
+			Then(clientv3.OpPut(c.key(key), value)).
+			Else(clientv3.OpGet(c.key(key))).
+			Commit()
+		if err != nil {
+			return c.errorResult(err)
+		}
+		return c.txnResult(resp)
+	}
+}
+
+// remove deletes the key if it was last modified at the revision, or gets it otherwise.
+func (conformanceOps) remove(key string, modRevision int64) conformanceStep {
+	return func(ctx context.Context, c *conformanceClient) conformanceResult {
+		resp, err := c.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(c.key(key)), "=", c.rev(modRevision))).
+			Then(clientv3.OpDelete(c.key(key))).
+			Else(clientv3.OpGet(c.key(key))).
+			Commit()
+		if err != nil {
+			return c.errorResult(err)
+		}
+		return c.txnResult(resp)
+	}
+}
+
+// txn puts the value if the compare succeeds, or gets the key otherwise.
+func (conformanceOps) txn(cmp func(c *conformanceClient) clientv3.Cmp, key, value string, options ...conformanceOption) conformanceStep {
+	return func(ctx context.Context, c *conformanceClient) conformanceResult {
+		resp, err := c.client.Txn(ctx).
+			If(cmp(c)).
+			Then(clientv3.OpPut(c.key(key), value, c.options(options)...)).
+			Else(clientv3.OpGet(c.key(key))).
+			Commit()
+		if err != nil {
+			return c.errorResult(err)
+		}
+		return c.txnResult(resp)
+	}
+}
+
+// txnPuts puts the keys, with their names as values, in a single transaction.
+func (conformanceOps) txnPuts(keys ...string) conformanceStep {
+	return func(ctx context.Context, c *conformanceClient) conformanceResult {
+		ops := make([]clientv3.Op, 0, len(keys))
+		for _, key := range keys {
+			ops = append(ops, clientv3.OpPut(c.key(key), key))
+		}
+		resp, err := c.client.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return c.errorResult(err)
+		}
+		return c.txnResult(resp)
+	}
+}
+
+// put puts the key outside of a transaction.
+func (conformanceOps) put(key, value string) conformanceStep {
+	return func(ctx context.Context, c *conformanceClient) conformanceResult {
+		resp, err := c.client.Put(ctx, c.key(key), value)
+		if err != nil {
+			return c.errorResult(err)
+		}
+		return conformanceResult{Revision: c.relative(resp.Header.Revision)}
+	}
+}
+
+func (conformanceOps) get(key string, options ...conformanceOption) conformanceStep {
+	return func(ctx context.Context, c *conformanceClient) conformanceResult {
+		resp, err := c.client.Get(ctx, c.key(key), c.options(options)...)
+		if err != nil {
+			return c.errorResult(err)
+		}
+		return c.rangeResult((*etcdserverpb.RangeResponse)(resp))
+	}
+}
+
+// deleteRange deletes the key, or the keys of its range, outside of a transaction.
+func (conformanceOps) deleteRange(key string, options ...conformanceOption) conformanceStep {
+	return func(ctx context.Context, c *conformanceClient) conformanceResult {
+		resp, err := c.client.Delete(ctx, c.key(key), c.options(options)...)
+		if err != nil {
+			return c.errorResult(err)
+		}
+		return conformanceResult{
+			Revision: c.relative(resp.Header.Revision),
+			Deleted:  resp.Deleted,
+			PrevKVs:  c.kvs(resp.PrevKvs),
+		}
+	}
+}
+
+func (conformanceOps) compact(revision int64) conformanceStep {
+	return func(ctx context.Context, c *conformanceClient) conformanceResult {
+		// only errors are compared, as compaction is not observed in the
+		// response but in the requests after it
+		if _, err := c.client.Compact(ctx, c.rev(revision), clientv3.WithCompactPhysical()); err != nil {
+			return c.errorResult(err)
+		}
+		return conformanceResult{}
+	}
+}
+
+// watch watches the key from the revision until it receives the number of events, or the watch is
+// canceled.
+func (conformanceOps) watch(key string, revision int64, events int, options ...conformanceOption) conformanceStep {
+	return func(ctx context.Context, c *conformanceClient) conformanceResult {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		var result conformanceResult
+		opts := append(c.options(options), clientv3.WithRev(c.rev(revision)))
+		for resp := range c.client.Watch(ctx, c.key(key), opts...) {
+			for _, event := range resp.Events {
+				e := conformanceEvent{Type: event.Type, KV: c.kv(event.Kv)}
+				e.KV.Version = 0
+				if event.PrevKv != nil {
+					prev := c.kv(event.PrevKv)
+					prev.Version = 0
+					e.PrevKV = &prev
+				}
+				result.Events = append(result.Events, e)
+			}
+			if resp.Canceled {
+				result.Canceled = true
+				result.CompactRevision = c.relative(resp.CompactRevision)
+				return result
+			}
+			if len(result.Events) >= events {
+				return result
+			}
+		}
+		result.Code = codes.DeadlineExceeded
+		return result
+	}
+}
+
+func (conformanceOps) prefix() conformanceOption {
+	return func(*conformanceClient) clientv3.OpOption {
+		return clientv3.WithPrefix()
+	}
+}
+
+// rangeTo ends the range before the key.
+func (conformanceOps) rangeTo(key string) conformanceOption {
+	return func(c *conformanceClient) clientv3.OpOption {
+		return clientv3.WithRange(c.key(key))
+	}
+}
+
+func (conformanceOps) atRev(revision int64) conformanceOption {
+	return func(c *conformanceClient) clientv3.OpOption {
+		return clientv3.WithRev(c.rev(revision))
+	}
+}
+
+func (conformanceOps) minModRev(revision int64) conformanceOption {
+	return func(c *conformanceClient) clientv3.OpOption {
+		return clientv3.WithMinModRev(c.rev(revision))
+	}
+}
+
+func (conformanceOps) limit(limit int64) conformanceOption {
+	return func(*conformanceClient) clientv3.OpOption {
+		return clientv3.WithLimit(limit)
+	}
+}
+
+func (conformanceOps) countOnly() conformanceOption {
+	return func(*conformanceClient) clientv3.OpOption {
+		return clientv3.WithCountOnly()
+	}
+}
+
+func (conformanceOps) keysOnly() conformanceOption {
+	return func(*conformanceClient) clientv3.OpOption {
+		return clientv3.WithKeysOnly()
+	}
+}
+
+func (conformanceOps) prevKV() conformanceOption {
+	return func(*conformanceClient) clientv3.OpOption {
+		return clientv3.WithPrevKV()
+	}
+}
+
+func (conformanceOps) sortByKey() conformanceOption {
+	return func(*conformanceClient) clientv3.OpOption {
+		return clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend)
+	}
+}
+
+// value, version and createRev compare the value, the version or the create revision of the key.
+func (conformanceOps) value(key, result, value string) func(c *conformanceClient) clientv3.Cmp {
+	return func(c *conformanceClient) clientv3.Cmp {
+		return clientv3.Compare(clientv3.Value(c.key(key)), result, value)
+	}
+}
+
+func (conformanceOps) version(key, result string, version int64) func(c *conformanceClient) clientv3.Cmp {
+	return func(c *conformanceClient) clientv3.Cmp {
+		return clientv3.Compare(clientv3.Version(c.key(key)), result, version)
+	}
+}
+
+func (conformanceOps) createRev(key, result string, revision int64) func(c *conformanceClient) clientv3.Cmp {
+	return func(c *conformanceClient) clientv3.Cmp {
+		return clientv3.Compare(clientv3.CreateRevision(c.key(key)), result, c.rev(revision))
+	}
+}
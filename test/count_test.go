@@ -0,0 +1,76 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestCount is unit testing for counting the current keys of a prefix, of which some were updated
+// or deleted, now and at past revisions.
+func TestCount(t *testing.T) {
+	ctx := context.Background()
+	dsn := fmt.Sprintf("%s/data.db", newTestDir(t))
+	prefix := "/testCount/"
+
+	t.Run("Exact", func(t *testing.T) {
+		g := NewWithT(t)
+		client, _ := newKineWithConfig(t, endpoint.Config{Endpoint: "sqlite://" + dsn})
+		for i := 0; i < 10; i++ {
+			createKey(ctx, g, client, fmt.Sprintf("%skey-%d", prefix, i), "first")
+		}
+		createKey(ctx, g, client, "/testCountOther/key", "other")
+		resp, err := client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Count).To(Equal(int64(10)))
+		created := resp.Header.Revision
+
+		// updates are not counted again, and deleted keys are no longer counted
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("%skey-%d", prefix, i)
+			resp, err := client.Get(ctx, key)
+			g.Expect(err).To(BeNil())
+			txn, err := client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)).
+				Then(clientv3.OpPut(key, "second")).
+				Commit()
+			g.Expect(err).To(BeNil())
+			g.Expect(txn.Succeeded).To(BeTrue())
+		}
+		for i := 0; i < 3; i++ {
+			deleteKey(ctx, g, client, fmt.Sprintf("%skey-%d", prefix, i))
+		}
+		resp, err = client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Count).To(Equal(int64(7)))
+
+		resp, err = client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly(), clientv3.WithRev(created))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Count).To(Equal(int64(10)))
+
+		// the count of a paginated list covers the keys after the start key
+		resp, err = client.Get(ctx, prefix+"key-5\x00", clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix)), clientv3.WithLimit(1))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Count).To(Equal(int64(4)))
+	})
+
+	// the statistics are gathered on start, so the counts of the keys written before are estimated,
+	// from the 23 rows of the prefix
+	t.Run("Estimated", func(t *testing.T) {
+		g := NewWithT(t)
+		client, _ := newKineWithConfig(t, endpoint.Config{Endpoint: "sqlite://" + dsn, EstimateCounts: true})
+		resp, err := client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Count).To(BeNumerically(">", 0))
+		g.Expect(resp.Count).To(BeNumerically("<", 23))
+
+		// counts at a revision are exact
+		resp, err = client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly(), clientv3.WithRev(resp.Header.Revision))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Count).To(Equal(int64(7)))
+	})
+}
@@ -3,6 +3,7 @@ package test
 import (
 	"context"
 	"fmt"
+	"sync"
 	"testing"
 
 	. "github.com/onsi/gomega"
@@ -35,6 +36,51 @@ func TestCreate(t *testing.T) {
 		g.Expect(err).To(BeNil())
 		g.Expect(resp.Succeeded).To(BeFalse())
 	})
+
+	t.Run("RecreateDeleted", func(t *testing.T) {
+		g := NewWithT(t)
+		key := "/testCreate/recreate"
+		createKey(ctx, g, client, key, "first")
+		resp, err := client.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		rev := resp.Kvs[0].ModRevision
+		txn, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+			Then(clientv3.OpPut(key, "second")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(txn.Succeeded).To(BeTrue())
+		deleteKey(ctx, g, client, key)
+
+		// the key is created anew, as if it never existed
+		createKey(ctx, g, client, key, "third")
+		createKey(ctx, g, client, "/testCreate/other", "other")
+		resp, err = client.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(1))
+		kv := resp.Kvs[0]
+		g.Expect(kv.Value).To(Equal([]byte("third")))
+		g.Expect(kv.ModRevision).To(BeNumerically(">", rev))
+		g.Expect(kv.CreateRevision).To(Equal(kv.ModRevision))
+		g.Expect(kv.Version).To(Equal(int64(1)))
+
+		txn, err = client.Txn(ctx).
+			If(clientv3.Compare(clientv3.Version(key), "=", 1)).
+			Then(clientv3.OpPut(key, "fourth")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(txn.Succeeded).To(BeTrue())
+
+		// lists count the versions of all keys at once
+		resp, err = client.Get(ctx, "/testCreate/", clientv3.WithPrefix())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(2))
+		g.Expect(string(resp.Kvs[1].Key)).To(Equal(key))
+		g.Expect(resp.Kvs[1].CreateRevision).To(Equal(kv.CreateRevision))
+		g.Expect(resp.Kvs[1].ModRevision).To(BeNumerically(">", kv.ModRevision))
+		g.Expect(resp.Kvs[1].Version).To(Equal(int64(2)))
+		g.Expect(resp.Kvs[0].Version).To(Equal(int64(1)))
+	})
 }
 
 // BenchmarkCreate is a benchmark for the Create operation.
@@ -55,3 +101,92 @@ func BenchmarkCreate(b *testing.B) {
 		g.Expect(resp.Succeeded).To(BeTrue())
 	}
 }
+
+// TestCreateRace is unit testing for creates of the same key racing each other, of which one
+// succeeds and the others fail their compare rather than the request.
+func TestCreateRace(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+	const creates = 50
+
+	for _, tt := range []struct {
+		name string
+		txn  func(key, value string) clientv3.Txn
+		// failure is the number of responses of a failed create
+		failure int
+	}{
+		{
+			name: "Create",
+			txn: func(key, value string) clientv3.Txn {
+				return client.Txn(ctx).
+					If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+					Then(clientv3.OpPut(key, value))
+			},
+		},
+		{
+			name: "CreateOrGet",
+			txn: func(key, value string) clientv3.Txn {
+				return client.Txn(ctx).
+					If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+					Then(clientv3.OpPut(key, value)).
+					Else(clientv3.OpGet(key))
+			},
+			failure: 1,
+		},
+		{
+			name: "Txn",
+			txn: func(key, value string) clientv3.Txn {
+				return client.Txn(ctx).
+					If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+					Then(clientv3.OpPut(key, value), clientv3.OpPut(key+"/"+value, value)).
+					Else(clientv3.OpGet(key))
+			},
+			failure: 1,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			key := "/testCreateRace/" + tt.name
+
+			var (
+				wg    sync.WaitGroup
+				resps = make([]*clientv3.TxnResponse, creates)
+				errs  = make([]error, creates)
+			)
+			for i := 0; i < creates; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					resps[i], errs[i] = tt.txn(key, fmt.Sprintf("value-%d", i)).Commit()
+				}(i)
+			}
+			wg.Wait()
+
+			winner := -1
+			for i := 0; i < creates; i++ {
+				g.Expect(errs[i]).To(BeNil())
+				if resps[i].Succeeded {
+					g.Expect(winner).To(Equal(-1))
+					winner = i
+				}
+			}
+			g.Expect(winner).NotTo(Equal(-1))
+			value := fmt.Sprintf("value-%d", winner)
+			assertKey(ctx, g, client, key, value)
+
+			// failed creates return the value of the winner from their failure range
+			for i := 0; i < creates; i++ {
+				if i == winner {
+					continue
+				}
+				g.Expect(resps[i].Responses).To(HaveLen(tt.failure))
+				if tt.failure > 0 {
+					kvs := resps[i].Responses[0].GetResponseRange().Kvs
+					g.Expect(kvs).To(HaveLen(1))
+					g.Expect(string(kvs[0].Value)).To(Equal(value))
+				}
+			}
+		})
+	}
+}
@@ -14,20 +14,71 @@ func TestDelete(t *testing.T) {
 	ctx := context.Background()
 	client := newKine(t)
 
-	// Calling the delete method outside a transaction should fail in kine
-	t.Run("DeleteNotSupportedFails", func(t *testing.T) {
+	// Deleting keys that do not exist succeeds without deleting any, at the current revision
+	t.Run("DeleteMissingKey", func(t *testing.T) {
 		g := NewWithT(t)
+		createKey(ctx, g, client, "/testDeleteMissing/other", "value")
+		get, err := client.Get(ctx, "/testDeleteMissing/other")
+		g.Expect(err).To(BeNil())
+
 		resp, err := client.Delete(ctx, "missingKey")
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Deleted).To(Equal(int64(0)))
+		g.Expect(resp.Header.Revision).To(Equal(get.Header.Revision))
+
+		resp, err = client.Delete(ctx, "/testDeleteMissing/none/", clientv3.WithPrefix())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Deleted).To(Equal(int64(0)))
+		g.Expect(resp.Header.Revision).To(Equal(get.Header.Revision))
+	})
 
-		g.Expect(err).NotTo(BeNil())
-		g.Expect(err.Error()).To(ContainSubstring("delete is not supported"))
-		g.Expect(resp).To(BeNil())
+	// Deleting a key that was deleted before succeeds without deleting it again
+	t.Run("DeleteDeletedKey", func(t *testing.T) {
+		g := NewWithT(t)
+		createKey(ctx, g, client, "/testDeleteDeleted/key", "value")
+
+		resp, err := client.Delete(ctx, "/testDeleteDeleted/key", clientv3.WithPrevKV())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Deleted).To(Equal(int64(1)))
+		g.Expect(resp.PrevKvs).To(HaveLen(1))
+		g.Expect(resp.PrevKvs[0].Value).To(Equal([]byte("value")))
+		rev := resp.Header.Revision
+
+		resp, err = client.Delete(ctx, "/testDeleteDeleted/key")
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Deleted).To(Equal(int64(0)))
+		g.Expect(resp.Header.Revision).To(Equal(rev))
+		assertMissingKey(ctx, g, client, "/testDeleteDeleted/key")
+	})
+
+	// Only the keys of a range that exist are deleted
+	t.Run("DeleteRangeSomeMissing", func(t *testing.T) {
+		g := NewWithT(t)
+		createKey(ctx, g, client, "/testDeleteRange/a", "a")
+		createKey(ctx, g, client, "/testDeleteRange/b", "b")
+		createKey(ctx, g, client, "/testDeleteRange/c", "c")
+		deleteKey(ctx, g, client, "/testDeleteRange/b")
+
+		resp, err := client.Delete(ctx, "/testDeleteRange/", clientv3.WithPrefix())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Deleted).To(Equal(int64(2)))
+
+		list, err := client.Get(ctx, "/testDeleteRange/", clientv3.WithPrefix())
+		g.Expect(err).To(BeNil())
+		g.Expect(list.Kvs).To(BeEmpty())
+		g.Expect(list.Header.Revision).To(Equal(resp.Header.Revision))
 	})
 
 	// Delete a key that does not exist
 	t.Run("DeleteNonExistentKeys", func(t *testing.T) {
 		g := NewWithT(t)
 		deleteKey(ctx, g, client, "alsoNonExistentKey")
+
+		resp, err := client.Txn(ctx).
+			Then(clientv3.OpGet("alsoNonExistentKey"), clientv3.OpDelete("alsoNonExistentKey")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Responses[1].GetResponseDeleteRange().Deleted).To(Equal(int64(0)))
 	})
 
 	// Add a key, make sure it exists, then delete it, make sure it got deleted,
@@ -46,6 +97,83 @@ func TestDelete(t *testing.T) {
 	})
 }
 
+// TestDeleteRangePrefix is unit testing for deleting all keys of a prefix at once, which deletes
+// each of them with an event of its own and leaves the keys outside of the prefix untouched.
+func TestDeleteRangePrefix(t *testing.T) {
+	const keys = 1000
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newKine(t)
+	g := NewWithT(t)
+
+	prefix := "/testDeleteRangePrefix/namespace/"
+	outside := []string{"/testDeleteRangePrefix/namespace", "/testDeleteRangePrefix/namespace0", "/testDeleteRangePrefix/other/key"}
+	for _, key := range outside {
+		createKey(ctx, g, client, key, "outside")
+	}
+	for i := 0; i < keys; i += 100 {
+		ops := make([]clientv3.Op, 0, 100)
+		for j := i; j < i+100; j++ {
+			ops = append(ops, clientv3.OpPut(fmt.Sprintf("%skey-%04d", prefix, j), fmt.Sprintf("value-%d", j)))
+		}
+		resp, err := client.Txn(ctx).Then(ops...).Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+	}
+	getResp, err := client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	g.Expect(err).To(BeNil())
+	g.Expect(getResp.Count).To(Equal(int64(keys)))
+	watchCh := client.Watch(ctx, "/testDeleteRangePrefix/", clientv3.WithPrefix(), clientv3.WithRev(getResp.Header.Revision+1))
+
+	resp, err := client.Delete(ctx, prefix, clientv3.WithPrefix(), clientv3.WithPrevKV())
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Deleted).To(Equal(int64(keys)))
+	g.Expect(resp.PrevKvs).To(HaveLen(keys))
+	for i, kv := range resp.PrevKvs {
+		g.Expect(string(kv.Key)).To(Equal(fmt.Sprintf("%skey-%04d", prefix, i)))
+		g.Expect(string(kv.Value)).To(Equal(fmt.Sprintf("value-%d", i)))
+	}
+	g.Expect(resp.Header.Revision).To(Equal(getResp.Header.Revision + keys))
+
+	t.Run("Events", func(t *testing.T) {
+		g := NewWithT(t)
+		var deleted []string
+		for len(deleted) < keys {
+			g.Eventually(watchCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+				for _, event := range v.Events {
+					g.Expect(event.Type).To(Equal(clientv3.EventTypeDelete))
+					deleted = append(deleted, string(event.Kv.Key))
+				}
+				return true
+			})))
+		}
+		g.Expect(deleted).To(HaveLen(keys))
+		for i, key := range deleted {
+			g.Expect(key).To(Equal(fmt.Sprintf("%skey-%04d", prefix, i)))
+		}
+		g.Consistently(watchCh, testWatchEventIdleTimeout).ShouldNot(Receive())
+	})
+
+	t.Run("Untouched", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Count).To(BeZero())
+		for _, key := range outside {
+			assertKey(ctx, g, client, key, "outside")
+		}
+	})
+
+	t.Run("Again", func(t *testing.T) {
+		g := NewWithT(t)
+		again, err := client.Delete(ctx, prefix, clientv3.WithPrefix())
+		g.Expect(err).To(BeNil())
+		g.Expect(again.Deleted).To(BeZero())
+		g.Expect(again.Header.Revision).To(Equal(resp.Header.Revision))
+	})
+}
+
 // BenchmarkDelete is a benchmark for the delete operation.
 func BenchmarkDelete(b *testing.B) {
 	ctx := context.Background()
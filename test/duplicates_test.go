@@ -0,0 +1,81 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+)
+
+// TestDuplicateRevisions is unit testing for starting on a database that old versions of kine
+// left with rows replacing the same revision of a key, which the unique index over the names and
+// previous revisions rejects. The latest row of each race is kept and the index is created.
+func TestDuplicateRevisions(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	dsn := fmt.Sprintf("%s/data.db", newTestDir(t))
+	newDuplicateRevisionsFixture(g, dsn)
+
+	client, _ := newKineWithConfig(t, endpoint.Config{Endpoint: "sqlite://" + dsn})
+	assertKey(ctx, g, client, "/testDuplicateRevisions/a", "a3")
+	assertKey(ctx, g, client, "/testDuplicateRevisions/b", "b2")
+
+	db, err := sql.Open(sqliteDriverName(), dsn)
+	g.Expect(err).To(BeNil())
+	defer db.Close()
+
+	var ids []int64
+	rows, err := db.Query("SELECT id FROM kine WHERE name LIKE '/testDuplicateRevisions/%' ORDER BY id")
+	g.Expect(err).To(BeNil())
+	for rows.Next() {
+		var id int64
+		g.Expect(rows.Scan(&id)).To(Succeed())
+		ids = append(ids, id)
+	}
+	g.Expect(rows.Close()).To(Succeed())
+	g.Expect(ids).To(Equal([]int64{1, 3, 5}))
+
+	var indexes int
+	g.Expect(db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'kine_prev_revision_name_uindex'").Scan(&indexes)).To(Succeed())
+	g.Expect(indexes).To(Equal(1))
+
+	// the index now rejects a second update of the same revision
+	_, err = db.Exec("INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value) VALUES ('/testDuplicateRevisions/a', 0, 0, 1, 1, 0, 'a4', 'a1')")
+	g.Expect(err).NotTo(BeNil())
+}
+
+// newDuplicateRevisionsFixture creates the database of a kine that raced writes without the
+// unique index: two updates of /testDuplicateRevisions/a replacing its first revision, and two
+// creates of /testDuplicateRevisions/b.
+func newDuplicateRevisionsFixture(g Gomega, dsn string) {
+	db, err := sql.Open(sqliteDriverName(), dsn)
+	g.Expect(err).To(BeNil())
+	defer db.Close()
+
+	for _, stmt := range []string{
+		`CREATE TABLE kine
+			(
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				created INTEGER,
+				deleted INTEGER,
+				create_revision INTEGER NOT NULL,
+				prev_revision INTEGER,
+				lease INTEGER,
+				value BLOB,
+				old_value BLOB
+			)`,
+		`INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value) VALUES
+			('/testDuplicateRevisions/a', 1, 0, 0, 0, 0, 'a1', NULL),
+			('/testDuplicateRevisions/a', 0, 0, 1, 1, 0, 'a2', 'a1'),
+			('/testDuplicateRevisions/a', 0, 0, 1, 1, 0, 'a3', 'a1'),
+			('/testDuplicateRevisions/b', 1, 0, 0, 0, 0, 'b1', NULL),
+			('/testDuplicateRevisions/b', 1, 0, 0, 0, 0, 'b2', NULL)`,
+	} {
+		_, err := db.Exec(stmt)
+		g.Expect(err).To(BeNil())
+	}
+}
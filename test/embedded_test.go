@@ -0,0 +1,55 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+)
+
+// TestEmbedded runs the tests of the operations that all backends share against kine embedded
+// in-process, whose client calls the server without gRPC.
+func TestEmbedded(t *testing.T) {
+	defer func(embedded bool) {
+		testEmbedded = embedded
+	}(testEmbedded)
+	testEmbedded = true
+
+	runSharedTests(t, testDriver)
+}
+
+// TestNewBackend is unit testing for using the backend of an endpoint directly, which is started
+// and closed by the caller.
+func TestNewBackend(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	config := endpoint.Config{Endpoint: fmt.Sprintf("sqlite://%s/data.db", newTestDir(t))}
+
+	// the backend is stopped by canceling the context it was started with
+	backend, err := endpoint.NewBackend(ctx, config)
+	g.Expect(err).To(BeNil())
+	startCtx, cancel := context.WithCancel(ctx)
+	g.Expect(backend.Start(startCtx)).To(Succeed())
+	rev, err := backend.Create(ctx, "/testNewBackend/key", []byte("value"), 0)
+	g.Expect(err).To(BeNil())
+	cancel()
+	g.Expect(backend.Close()).To(Succeed())
+
+	// the keys are kept once the backend is started again
+	backend, err = endpoint.NewBackend(ctx, config)
+	g.Expect(err).To(BeNil())
+	startCtx, cancel = context.WithCancel(ctx)
+	g.Expect(backend.Start(startCtx)).To(Succeed())
+	defer backend.Close()
+	defer cancel()
+	_, kv, err := backend.Get(ctx, "/testNewBackend/key", "", 1, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(kv).NotTo(BeNil())
+	g.Expect(kv.ModRevision).To(Equal(rev))
+	g.Expect(kv.Value).To(Equal([]byte("value")))
+
+	_, err = endpoint.NewBackend(ctx, endpoint.Config{Endpoint: "https://localhost:2379"})
+	g.Expect(err).NotTo(BeNil())
+}
@@ -0,0 +1,201 @@
+package test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/migrate"
+	"go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/lease/leasepb"
+)
+
+// TestImport is unit testing for importing the current keys of etcd snapshots, with their leases,
+// into kine at revisions above that of the snapshot.
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	const largeLease = 0x694d7a1b2c3d4e5f
+
+	path := writeETCDSnapshot(t, 42, []etcdSnapshotWrite{
+		{key: "/registry/a", value: "v1"},
+		{key: "/registry/b", value: "b", lease: largeLease},
+		{key: "/registry/a", value: "v2"},
+		{key: "/other/c", value: "c"},
+		{key: "/registry/d", value: "d"},
+		{key: "/registry/d", tombstone: true},
+		{key: "/registry/e", value: "e", lease: 1234},
+		{key: "/registry/f", value: "f", lease: 999},
+	}, []*leasepb.Lease{
+		{ID: largeLease, TTL: 600},
+		{ID: 1234, TTL: 60},
+		{ID: 5678, TTL: 60},
+	})
+
+	t.Run("Prefix", func(t *testing.T) {
+		g := NewWithT(t)
+		config := endpoint.Config{Endpoint: fmt.Sprintf("sqlite://%s/data.db", newTestDir(t))}
+		result, err := migrate.Import(ctx, migrate.ImportConfig{
+			Snapshot:    path,
+			Destination: config,
+			Prefix:      "/registry/",
+			BatchSize:   2,
+		})
+		g.Expect(err).To(BeNil())
+		g.Expect(result.Revision).To(Equal(int64(9)))
+		g.Expect(result.Keys).To(Equal(int64(4)))
+		g.Expect(result.Leases).To(Equal(int64(2)))
+
+		embedded, err := endpoint.NewEmbedded(ctx, config)
+		g.Expect(err).To(BeNil())
+		defer embedded.Close()
+		client := embedded.Client()
+
+		resp, err := client.Get(ctx, "/registry/", clientv3.WithPrefix())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Header.Revision).To(BeNumerically(">", 9))
+		var keys []string
+		for _, kv := range resp.Kvs {
+			keys = append(keys, string(kv.Key))
+			if string(kv.Key) != "/registry/health" {
+				g.Expect(kv.ModRevision).To(BeNumerically(">", 9))
+			}
+		}
+		g.Expect(keys).To(Equal([]string{"/registry/a", "/registry/b", "/registry/e", "/registry/f", "/registry/health"}))
+		assertKey(ctx, g, client, "/registry/a", "v2")
+		assertMissingKey(ctx, g, client, "/registry/d")
+		assertMissingKey(ctx, g, client, "/other/c")
+
+		// leases keep their IDs where the schemas allow it, and their TTLs
+		ttl, err := client.TimeToLive(ctx, 1234, clientv3.WithAttachedKeys())
+		g.Expect(err).To(BeNil())
+		g.Expect(ttl.GrantedTTL).To(Equal(int64(60)))
+		g.Expect(ttl.Keys).To(Equal([][]byte{[]byte("/registry/e")}))
+		b := resp.Kvs[1]
+		g.Expect(b.Lease).NotTo(BeZero())
+		g.Expect(b.Lease).NotTo(Equal(int64(largeLease)))
+		ttl, err = client.TimeToLive(ctx, clientv3.LeaseID(b.Lease))
+		g.Expect(err).To(BeNil())
+		g.Expect(ttl.GrantedTTL).To(Equal(int64(600)))
+		g.Expect(resp.Kvs[3].Lease).To(BeZero())
+		_, err = client.TimeToLive(ctx, 5678)
+		g.Expect(err).NotTo(BeNil())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		g := NewWithT(t)
+		importSnapshot := func(path string) error {
+			_, err := migrate.Import(ctx, migrate.ImportConfig{
+				Snapshot:    path,
+				Destination: endpoint.Config{Endpoint: fmt.Sprintf("sqlite://%s/data.db", newTestDir(t))},
+			})
+			return err
+		}
+
+		// snapshots without a consistent index, or with a wrong checksum, are not imported
+		g.Expect(importSnapshot(writeETCDSnapshot(t, 0, nil, nil))).NotTo(Succeed())
+		snapshot, err := os.ReadFile(path)
+		g.Expect(err).To(BeNil())
+		snapshot[len(snapshot)-1] ^= 0xff
+		corrupt := filepath.Join(newTestDir(t), "corrupt.db")
+		g.Expect(os.WriteFile(corrupt, snapshot, 0600)).To(Succeed())
+		g.Expect(importSnapshot(corrupt)).NotTo(Succeed())
+	})
+}
+
+// etcdSnapshotWrite is a write to a key of an etcd snapshot.
+type etcdSnapshotWrite struct {
+	key, value string
+	lease      int64
+	tombstone  bool
+}
+
+// writeETCDSnapshot writes an etcd snapshot with the consistent index, the writes at the revisions
+// from 2 on and the leases, followed by its checksum as etcdctl writes it, and returns its path.
+func writeETCDSnapshot(tb testing.TB, consistentIndex uint64, writes []etcdSnapshotWrite, leases []*leasepb.Lease) string {
+	path := filepath.Join(newTestDir(tb), "snapshot.db")
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		panic(err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		buckets := map[string]*bbolt.Bucket{}
+		for _, name := range []string{"key", "meta", "lease"} {
+			bucket, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			buckets[name] = bucket
+		}
+		if consistentIndex > 0 {
+			index := make([]byte, 8)
+			binary.BigEndian.PutUint64(index, consistentIndex)
+			if err := buckets["meta"].Put([]byte("consistent_index"), index); err != nil {
+				return err
+			}
+		}
+
+		created := map[string]int64{}
+		for i, write := range writes {
+			rev := int64(i + 2)
+			revision := make([]byte, 17, 18)
+			binary.BigEndian.PutUint64(revision, uint64(rev))
+			revision[8] = '_'
+			kv := &mvccpb.KeyValue{Key: []byte(write.key), ModRevision: rev}
+			if write.tombstone {
+				revision = append(revision, 't')
+				delete(created, write.key)
+			} else {
+				if created[write.key] == 0 {
+					created[write.key] = rev
+				}
+				kv.CreateRevision = created[write.key]
+				kv.Value = []byte(write.value)
+				kv.Lease = write.lease
+			}
+			value, err := kv.Marshal()
+			if err != nil {
+				return err
+			}
+			if err := buckets["key"].Put(revision, value); err != nil {
+				return err
+			}
+		}
+
+		for _, lease := range leases {
+			id := make([]byte, 8)
+			binary.BigEndian.PutUint64(id, uint64(lease.ID))
+			value, err := lease.Marshal()
+			if err != nil {
+				return err
+			}
+			if err := buckets["lease"].Put(id, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Close(); err != nil {
+		panic(err)
+	}
+
+	snapshot, err := os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(snapshot)
+	if err := os.WriteFile(path, append(snapshot, sum[:]...), 0600); err != nil {
+		panic(err)
+	}
+	return path
+}
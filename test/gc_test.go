@@ -0,0 +1,202 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+// TestGC is unit testing for collecting the rows of a sqlite database that no read can return,
+// left behind as if compactions were interrupted, which GC only counts on a dry run, and removes
+// without touching any other row otherwise.
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	dsn := newTestDir(t) + "/data.db"
+	config := endpoint.Config{Endpoint: "sqlite://" + dsn}
+	garbage := newGarbageFixture(t, dsn)
+
+	db, err := sql.Open(sqliteDriverName(), dsn)
+	g.Expect(err).To(BeNil())
+	defer db.Close()
+	ids := func() []int64 {
+		rows, err := db.Query("SELECT id FROM kine ORDER BY id")
+		g.Expect(err).To(BeNil())
+		defer rows.Close()
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			g.Expect(rows.Scan(&id)).To(Succeed())
+			ids = append(ids, id)
+		}
+		g.Expect(rows.Err()).To(BeNil())
+		return ids
+	}
+	before := ids()
+	var kept []int64
+	for _, id := range before {
+		if _, ok := garbage[id]; !ok {
+			kept = append(kept, id)
+		}
+	}
+
+	// a dry run only counts the rows of each kind
+	counts := map[server.GarbageKind]int64{}
+	for _, kind := range garbage {
+		counts[kind]++
+	}
+	found, err := endpoint.GC(ctx, config, true)
+	g.Expect(err).To(BeNil())
+	g.Expect(found).To(HaveLen(3))
+	for _, garbage := range found {
+		g.Expect(garbage.Rows).To(Equal(counts[garbage.Kind]), string(garbage.Kind))
+		g.Expect(garbage.Bytes).To(BeNumerically(">", 0), string(garbage.Kind))
+		g.Expect(garbage.Removed).To(BeFalse())
+	}
+	g.Expect(ids()).To(Equal(before))
+
+	removed, err := endpoint.GC(ctx, config, false)
+	g.Expect(err).To(BeNil())
+	for i := range found {
+		found[i].Removed = true
+	}
+	g.Expect(removed).To(Equal(found))
+	g.Expect(ids()).To(Equal(kept))
+
+	inconsistencies, err := endpoint.Verify(ctx, config, false)
+	g.Expect(err).To(BeNil())
+	g.Expect(inconsistencies).To(BeEmpty())
+
+	// nothing is left to collect, and every key reads as before
+	again, err := endpoint.GC(ctx, config, false)
+	g.Expect(err).To(BeNil())
+	for _, garbage := range again {
+		g.Expect(garbage.Rows).To(BeZero(), string(garbage.Kind))
+		g.Expect(garbage.Removed).To(BeFalse())
+	}
+
+	client, _ := newKineWithConfig(t, config)
+	assertKey(ctx, g, client, "/testGC/superseded", "v3")
+	assertKey(ctx, g, client, "/testGC/successor", "v3")
+	assertKey(ctx, g, client, "/testGC/recreated", "v2")
+	assertKey(ctx, g, client, "/testGC/later", "v2")
+	assertMissingKey(ctx, g, client, "/testGC/deleted")
+}
+
+// TestGCBolt is unit testing for collecting the rows of a bolt database that no read can return.
+func TestGCBolt(t *testing.T) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	path := newTestDir(t) + "/data.bolt"
+	backend, _, stop := startBoltBackend(t, path)
+	rev, err := backend.Create(ctx, "/testGCBolt/a", []byte("v1"), 0)
+	g.Expect(err).To(BeNil())
+	_, _, _, err = backend.Update(ctx, "/testGCBolt/a", []byte("v2"), rev, 0)
+	g.Expect(err).To(BeNil())
+	rev, err = backend.Create(ctx, "/testGCBolt/deleted", []byte("v1"), 0)
+	g.Expect(err).To(BeNil())
+	compact, _, _, err := backend.Delete(ctx, "/testGCBolt/deleted", rev)
+	g.Expect(err).To(BeNil())
+	stop()
+
+	// the compact revision is recorded without any of the rows up to it removed
+	db, err := bbolt.Open(path, 0600, nil)
+	g.Expect(err).To(BeNil())
+	g.Expect(db.Update(func(tx *bbolt.Tx) error {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(compact))
+		return tx.Bucket([]byte("meta")).Put([]byte("compactRevision"), value)
+	})).To(Succeed())
+	g.Expect(db.Close()).To(Succeed())
+
+	config := endpoint.Config{Endpoint: "bolt://" + path}
+	garbage, err := endpoint.GC(ctx, config, false)
+	g.Expect(err).To(BeNil())
+	rows := map[server.GarbageKind]int64{}
+	for _, garbage := range garbage {
+		rows[garbage.Kind] = garbage.Rows
+	}
+	g.Expect(rows).To(Equal(map[server.GarbageKind]int64{
+		server.GarbageTombstone:  1,
+		server.GarbageSuperseded: 1,
+		server.GarbageDeletedKey: 1,
+	}))
+
+	backend, _, _ = startBoltBackend(t, path)
+	_, kv, err := backend.Get(ctx, "/testGCBolt/a", "", 0, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(kv).NotTo(BeNil())
+	g.Expect(kv.Value).To(Equal([]byte("v2")))
+}
+
+// newGarbageFixture writes keys to a new sqlite database through kine, and then records a compact
+// revision without removing the rows up to it, as an interrupted compaction could leave them. It
+// returns the rows that no read can return any more, by their ids, with their kind.
+func newGarbageFixture(t *testing.T, dsn string) map[int64]server.GarbageKind {
+	ctx := context.Background()
+	g := NewWithT(t)
+	backend, stop := startBackend(t, dsn)
+	create := func(key string) int64 {
+		rev, err := backend.Create(ctx, key, []byte("v1"), 0)
+		g.Expect(err).To(BeNil())
+		return rev
+	}
+	update := func(key, value string, revision int64) int64 {
+		rev, _, ok, err := backend.Update(ctx, key, []byte(value), revision, 0)
+		g.Expect(err).To(BeNil())
+		g.Expect(ok).To(BeTrue())
+		return rev
+	}
+	remove := func(key string, revision int64) int64 {
+		rev, _, ok, err := backend.Delete(ctx, key, revision)
+		g.Expect(err).To(BeNil())
+		g.Expect(ok).To(BeTrue())
+		return rev
+	}
+
+	superseded := create("/testGC/superseded")
+	supersededUpdate := update("/testGC/superseded", "v2", superseded)
+	update("/testGC/superseded", "v3", supersededUpdate)
+	successor := create("/testGC/successor")
+	successorUpdate := update("/testGC/successor", "v2", successor)
+	update("/testGC/successor", "v3", successorUpdate)
+	deleted := create("/testGC/deleted")
+	deletedUpdate := update("/testGC/deleted", "v2", deleted)
+	deletedDelete := remove("/testGC/deleted", deletedUpdate)
+	recreated := create("/testGC/recreated")
+	recreatedDelete := remove("/testGC/recreated", recreated)
+	later := create("/testGC/later")
+	compact, err := backend.CurrentRevision(ctx)
+	g.Expect(err).To(BeNil())
+
+	// the rows after the compact revision are all kept
+	update("/testGC/recreated", "v2", create("/testGC/recreated"))
+	update("/testGC/later", "v2", later)
+	stop()
+
+	db, err := sql.Open(sqliteDriverName(), dsn)
+	g.Expect(err).To(BeNil())
+	defer db.Close()
+	_, err = db.Exec("UPDATE kine SET prev_revision = ? WHERE name = 'compact_rev_key'", compact)
+	g.Expect(err).To(BeNil())
+	// the revision that followed the first one of the key was compacted away on its own
+	_, err = db.Exec("DELETE FROM kine WHERE id = ?", successorUpdate)
+	g.Expect(err).To(BeNil())
+
+	return map[int64]server.GarbageKind{
+		superseded:       server.GarbageSuperseded,
+		supersededUpdate: server.GarbageSuperseded,
+		successor:        server.GarbageSuperseded,
+		deleted:          server.GarbageDeletedKey,
+		deletedUpdate:    server.GarbageDeletedKey,
+		deletedDelete:    server.GarbageTombstone,
+		recreated:        server.GarbageDeletedKey,
+		recreatedDelete:  server.GarbageTombstone,
+	}
+}
@@ -2,9 +2,13 @@ package test
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
 
 	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
@@ -82,11 +86,12 @@ func TestGet(t *testing.T) {
 			lastModRev = resp.Responses[0].GetResponsePut().Header.Revision
 		}
 
-		// Get the key's version
+		// Count the key
 		{
 			resp, err := client.Get(ctx, key, clientv3.WithCountOnly())
 			g.Expect(err).To(BeNil())
-			g.Expect(resp.Count).To(Equal(int64(0)))
+			g.Expect(resp.Count).To(Equal(int64(1)))
+			g.Expect(resp.Kvs).To(BeEmpty())
 		}
 
 		// Update the key
@@ -102,7 +107,7 @@ func TestGet(t *testing.T) {
 
 		// Get the updated key
 		{
-			resp, err := client.Get(ctx, key, clientv3.WithCountOnly())
+			resp, err := client.Get(ctx, key)
 			g.Expect(err).To(BeNil())
 			g.Expect(resp.Kvs[0].Value).To(Equal([]byte("testValue2")))
 			g.Expect(resp.Kvs[0].ModRevision).To(BeNumerically(">", resp.Kvs[0].CreateRevision))
@@ -142,6 +147,81 @@ func TestGet(t *testing.T) {
 		}
 	})
 
+	t.Run("KeysOnlyWithPrefix", func(t *testing.T) {
+		g := NewWithT(t)
+		var createRev, modRev int64
+
+		// Create a key and update it, so that its revisions differ
+		{
+			resp, err := client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision("keysonly/testKey"), "=", 0)).
+				Then(clientv3.OpPut("keysonly/testKey", "testValue1")).
+				Commit()
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Succeeded).To(BeTrue())
+			createRev = resp.Header.Revision
+
+			resp, err = client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision("keysonly/testKey"), "=", createRev)).
+				Then(clientv3.OpPut("keysonly/testKey", "testValue2")).
+				Else(clientv3.OpGet("keysonly/testKey")).
+				Commit()
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Succeeded).To(BeTrue())
+			modRev = resp.Header.Revision
+		}
+
+		// List the keys without values
+		{
+			resp, err := client.Get(ctx, "keysonly/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Kvs).To(HaveLen(1))
+			g.Expect(resp.Kvs[0].Key).To(Equal([]byte("keysonly/testKey")))
+			g.Expect(resp.Kvs[0].Value).To(BeEmpty())
+			g.Expect(resp.Kvs[0].CreateRevision).To(Equal(createRev))
+			g.Expect(resp.Kvs[0].ModRevision).To(Equal(modRev))
+		}
+
+		// Get a single key without its value
+		{
+			resp, err := client.Get(ctx, "keysonly/testKey", clientv3.WithKeysOnly())
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Kvs).To(HaveLen(1))
+			g.Expect(resp.Kvs[0].Value).To(BeEmpty())
+			g.Expect(resp.Kvs[0].ModRevision).To(Equal(modRev))
+		}
+	})
+
+	t.Run("CountOnlyWithPrefix", func(t *testing.T) {
+		g := NewWithT(t)
+
+		// Count the keys created above
+		resp, err := client.Get(ctx, "prefix", clientv3.WithPrefix(), clientv3.WithCountOnly())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Count).To(Equal(int64(2)))
+		g.Expect(resp.Kvs).To(BeEmpty())
+		g.Expect(resp.Header.Revision).To(BeNumerically(">", 0))
+	})
+
+	t.Run("CountOnlyKeyWithSlash", func(t *testing.T) {
+		g := NewWithT(t)
+		key := "/testCountOnlyKeyWithSlash/"
+
+		// Keys under the key are not counted as the key
+		createKey(ctx, g, client, key+"a", "a")
+		createKey(ctx, g, client, key+"b", "b")
+		resp, err := client.Get(ctx, key, clientv3.WithCountOnly())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Count).To(Equal(int64(0)))
+		g.Expect(resp.Header.Revision).To(BeNumerically(">", 0))
+
+		createKey(ctx, g, client, key, "dir")
+		resp, err = client.Get(ctx, key, clientv3.WithCountOnly())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Count).To(Equal(int64(1)))
+		g.Expect(resp.Kvs).To(BeEmpty())
+	})
+
 	t.Run("FailNotFound", func(t *testing.T) {
 		g := NewWithT(t)
 		key := "testKeyFailNotFound"
@@ -167,6 +247,98 @@ func TestGet(t *testing.T) {
 	})
 }
 
+// TestGetRevision is unit testing for the Get operation at past revisions.
+func TestGetRevision(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+
+	var (
+		key       = "/revision/testKey"
+		revisions []int64
+	)
+
+	// Create a key and update it five times
+	g := NewWithT(t)
+	resp, err := client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, "value-0")).
+		Commit()
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Succeeded).To(BeTrue())
+	revisions = append(revisions, resp.Header.Revision)
+
+	for i := 1; i <= 5; i++ {
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", revisions[len(revisions)-1])).
+			Then(clientv3.OpPut(key, fmt.Sprintf("value-%d", i))).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		revisions = append(revisions, resp.Header.Revision)
+	}
+
+	// create another key, so that the latest revision is not one of the key
+	createKey(ctx, g, client, "/revision/otherKey", "value")
+
+	t.Run("GetAtRevision", func(t *testing.T) {
+		g := NewWithT(t)
+		for i, rev := range revisions {
+			resp, err := client.Get(ctx, key, clientv3.WithRev(rev))
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Header.Revision).To(Equal(rev))
+			g.Expect(resp.Kvs).To(HaveLen(1))
+			g.Expect(resp.Kvs[0].Value).To(Equal([]byte(fmt.Sprintf("value-%d", i))))
+			g.Expect(resp.Kvs[0].ModRevision).To(Equal(rev))
+			g.Expect(resp.Kvs[0].CreateRevision).To(Equal(revisions[0]))
+		}
+	})
+
+	t.Run("ListAtRevision", func(t *testing.T) {
+		g := NewWithT(t)
+		for i, rev := range revisions {
+			resp, err := client.Get(ctx, "/revision/", clientv3.WithPrefix(), clientv3.WithRev(rev))
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Kvs).To(HaveLen(1))
+			g.Expect(resp.Kvs[0].Value).To(Equal([]byte(fmt.Sprintf("value-%d", i))))
+		}
+	})
+
+	t.Run("BeforeCreate", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, key, clientv3.WithRev(revisions[0]-1))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(BeEmpty())
+	})
+
+	t.Run("FutureRevisionFails", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.Get(ctx, key, clientv3.WithRev(revisions[len(revisions)-1]+100))
+		g.Expect(err).To(Equal(rpctypes.ErrFutureRev))
+
+		_, err = client.Get(ctx, "/revision/", clientv3.WithPrefix(), clientv3.WithRev(revisions[len(revisions)-1]+100))
+		g.Expect(err).To(Equal(rpctypes.ErrFutureRev))
+	})
+
+	t.Run("CompactedRevisionFails", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.Compact(ctx, revisions[3])
+		g.Expect(err).To(BeNil())
+
+		_, err = client.Get(ctx, key, clientv3.WithRev(revisions[2]))
+		g.Expect(err).To(Equal(rpctypes.ErrCompacted))
+
+		_, err = client.Get(ctx, "/revision/", clientv3.WithPrefix(), clientv3.WithRev(revisions[2]))
+		g.Expect(err).To(Equal(rpctypes.ErrCompacted))
+
+		// the compact revision itself and later ones can still be read
+		resp, err := client.Get(ctx, key, clientv3.WithRev(revisions[3]))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(1))
+		g.Expect(resp.Kvs[0].Value).To(Equal([]byte("value-3")))
+	})
+}
+
 // BenchmarkGet is a benchmark for the Get operation.
 func BenchmarkGet(b *testing.B) {
 	ctx := context.Background()
@@ -192,3 +364,50 @@ func BenchmarkGet(b *testing.B) {
 		}
 	})
 }
+
+// BenchmarkCount is a benchmark for counting a large prefix, exactly and from the statistics of
+// the database. The values are large, so the allocations per count show whether any values are
+// fetched.
+func BenchmarkCount(b *testing.B) {
+	ctx := context.Background()
+	dsn := fmt.Sprintf("%s/data.db", newTestDir(b))
+	client, _ := newKineWithConfig(b, endpoint.Config{Endpoint: "sqlite://" + dsn})
+	g := NewWithT(b)
+
+	const (
+		keys      = 50000
+		batchSize = 500
+	)
+	value := strings.Repeat("v", 1024)
+	for i := 0; i < keys; i += batchSize {
+		ops := make([]clientv3.Op, 0, batchSize)
+		for j := i; j < i+batchSize; j++ {
+			ops = append(ops, clientv3.OpPut(fmt.Sprintf("/count/key-%05d", j), value))
+		}
+		_, err := client.Txn(ctx).Then(ops...).Commit()
+		g.Expect(err).To(BeNil())
+	}
+
+	b.Run("Exact", func(b *testing.B) {
+		g := NewWithT(b)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			resp, err := client.Get(ctx, "/count/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Count).To(Equal(int64(keys)))
+		}
+	})
+
+	// the statistics are gathered when kine starts on the keys
+	b.Run("Estimated", func(b *testing.B) {
+		g := NewWithT(b)
+		client, _ := newKineWithConfig(b, endpoint.Config{Endpoint: "sqlite://" + dsn, EstimateCounts: true})
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			resp, err := client.Get(ctx, "/count/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Count).To(BeNumerically("~", keys, keys/100))
+		}
+	})
+}
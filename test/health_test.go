@@ -0,0 +1,55 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/server"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// TestHealth is unit testing for the grpc health service.
+func TestHealth(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Serving", func(t *testing.T) {
+		g := NewWithT(t)
+		client, _ := newKineWithConfig(t, endpoint.Config{HealthCheckInterval: 50 * time.Millisecond})
+		healthClient := healthpb.NewHealthClient(client.ActiveConnection())
+		g.Eventually(func() (healthpb.HealthCheckResponse_ServingStatus, error) {
+			resp, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{})
+			if err != nil {
+				return healthpb.HealthCheckResponse_UNKNOWN, err
+			}
+			return resp.Status, nil
+		}, time.Second, 10*time.Millisecond).Should(Equal(healthpb.HealthCheckResponse_SERVING))
+	})
+
+	t.Run("BrokenDatabase", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		backend, stop := startBackend(t, newTestDir(t)+"/data.db")
+		hsrv := health.NewServer()
+		b := server.New(backend, server.Config{HealthCheckInterval: 50 * time.Millisecond})
+		go b.HealthCheck(ctx, hsrv)
+
+		status := func() (healthpb.HealthCheckResponse_ServingStatus, error) {
+			resp, err := hsrv.Check(ctx, &healthpb.HealthCheckRequest{})
+			if err != nil {
+				return healthpb.HealthCheckResponse_UNKNOWN, err
+			}
+			return resp.Status, nil
+		}
+		g.Eventually(status, time.Second, 10*time.Millisecond).Should(Equal(healthpb.HealthCheckResponse_SERVING))
+
+		// closing the database makes every probe fail
+		stop()
+		g.Eventually(status, time.Second, 10*time.Millisecond).Should(Equal(healthpb.HealthCheckResponse_NOT_SERVING))
+	})
+}
@@ -0,0 +1,99 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/inspect"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// TestHistory is unit testing for inspecting the stored revisions of a key that was created,
+// updated, deleted and created again, with and without their values, in sqlite and bolt.
+func TestHistory(t *testing.T) {
+	for _, target := range []struct {
+		name  string
+		start func(t *testing.T, path string) (server.Backend, func())
+		path  string
+		dsn   string
+	}{
+		{
+			name: "SQLite",
+			start: func(t *testing.T, path string) (server.Backend, func()) {
+				return startBackend(t, path)
+			},
+			path: "data.db",
+			dsn:  "sqlite://",
+		},
+		{
+			name: "Bolt",
+			start: func(t *testing.T, path string) (server.Backend, func()) {
+				backend, _, stop := startBoltBackend(t, path)
+				return backend, stop
+			},
+			path: "data.bolt",
+			dsn:  "bolt://",
+		},
+	} {
+		target := target
+		t.Run(target.name, func(t *testing.T) {
+			path := newTestDir(t) + "/" + target.path
+			backend, stop := target.start(t, path)
+			testHistory(t, backend, stop, endpoint.Config{Endpoint: target.dsn + path})
+		})
+	}
+}
+
+func testHistory(t *testing.T, backend server.Backend, stop func(), config endpoint.Config) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	const key = "/testHistory/key"
+
+	created, err := backend.Create(ctx, key, []byte("v1"), 0)
+	g.Expect(err).To(BeNil())
+	updated, _, ok, err := backend.Update(ctx, key, []byte("value2"), created, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(BeTrue())
+	deleted, _, ok, err := backend.Delete(ctx, key, updated)
+	g.Expect(err).To(BeNil())
+	g.Expect(ok).To(BeTrue())
+	recreated, err := backend.Create(ctx, key, []byte("v3"), 0)
+	g.Expect(err).To(BeNil())
+	_, err = backend.Create(ctx, "/testHistory/other", []byte("other"), 0)
+	g.Expect(err).To(BeNil())
+	stop()
+
+	// all revisions of the key are returned, oldest first, without their values unless asked for
+	history, err := inspect.KeyHistory(ctx, config, key, 0, false)
+	g.Expect(err).To(BeNil())
+	g.Expect(history.Key).To(Equal(key))
+	g.Expect(history.Revision).To(BeNumerically(">", recreated))
+	g.Expect(history.Revisions).NotTo(BeEmpty())
+	// the first create records the revision that the key was missing at
+	g.Expect(history.Revisions[0].PrevRevision).To(BeNumerically("<", created))
+	history.Revisions[0].PrevRevision = 0
+	g.Expect(history.Revisions).To(Equal([]inspect.Revision{
+		{Revision: created, CreateRevision: created, Create: true, ValueSize: 2},
+		{Revision: updated, CreateRevision: created, PrevRevision: created, ValueSize: 6},
+		{Revision: deleted, CreateRevision: created, PrevRevision: updated, Delete: true, ValueSize: 6},
+		{Revision: recreated, CreateRevision: recreated, PrevRevision: deleted, Create: true, ValueSize: 2},
+	}))
+
+	history, err = inspect.KeyHistory(ctx, config, key, 0, true)
+	g.Expect(err).To(BeNil())
+	g.Expect(history.Revisions).To(HaveLen(4))
+	g.Expect(history.Revisions[0].Value).To(Equal([]byte("v1")))
+	g.Expect(history.Revisions[1].Value).To(Equal([]byte("value2")))
+	g.Expect(history.Revisions[3].Value).To(Equal([]byte("v3")))
+
+	// the value at a revision is returned on its own, and revisions of other keys are not
+	history, err = inspect.KeyHistory(ctx, config, key, updated, true)
+	g.Expect(err).To(BeNil())
+	g.Expect(history.Revisions).To(HaveLen(1))
+	g.Expect(history.Revisions[0].Revision).To(Equal(updated))
+	g.Expect(history.Revisions[0].Value).To(Equal([]byte("value2")))
+	_, err = inspect.KeyHistory(ctx, config, key, recreated+1, true)
+	g.Expect(err).NotTo(BeNil())
+}
@@ -0,0 +1,132 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// hookCall is a call of the hooks, with an empty value for deletes.
+type hookCall struct {
+	key    string
+	value  string
+	delete bool
+}
+
+// recordingHooks records the calls of the hooks by revision, once unblocked if it has a channel
+// to wait on.
+type recordingHooks struct {
+	unblock chan struct{}
+
+	lock  sync.Mutex
+	calls map[int64]hookCall
+}
+
+func newRecordingHooks(unblock chan struct{}) *recordingHooks {
+	return &recordingHooks{unblock: unblock, calls: map[int64]hookCall{}}
+}
+
+func (h *recordingHooks) OnPut(key string, value []byte, revision int64) {
+	h.record(revision, hookCall{key: key, value: string(value)})
+}
+
+func (h *recordingHooks) OnDelete(key string, revision int64) {
+	h.record(revision, hookCall{key: key, delete: true})
+}
+
+func (h *recordingHooks) record(revision int64, call hookCall) {
+	if h.unblock != nil {
+		<-h.unblock
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.calls[revision] = call
+}
+
+// call returns the call recorded at the revision, or the zero call if there is none.
+func (h *recordingHooks) call(revision int64) hookCall {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.calls[revision]
+}
+
+// TestHooks is unit testing for the hooks that writes are passed to after they commit.
+func TestHooks(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Revisions", func(t *testing.T) {
+		g := NewWithT(t)
+		hooks := newRecordingHooks(nil)
+		client, _ := newKineWithConfig(t, endpoint.Config{Hooks: hooks})
+		key := "/hooks/key"
+
+		create, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "created")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(create.Succeeded).To(BeTrue())
+
+		update, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", create.Header.Revision)).
+			Then(clientv3.OpPut(key, "updated")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(update.Succeeded).To(BeTrue())
+
+		del, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", update.Header.Revision)).
+			Then(clientv3.OpDelete(key)).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(del.Succeeded).To(BeTrue())
+
+		for revision, expected := range map[int64]hookCall{
+			create.Header.Revision: {key: key, value: "created"},
+			update.Header.Revision: {key: key, value: "updated"},
+			del.Header.Revision:    {key: key, delete: true},
+		} {
+			revision, expected := revision, expected
+			g.Eventually(func() hookCall {
+				return hooks.call(revision)
+			}, 5*time.Second, 10*time.Millisecond).Should(Equal(expected))
+		}
+	})
+
+	t.Run("BlockingHook", func(t *testing.T) {
+		g := NewWithT(t)
+		unblock := make(chan struct{})
+		hooks := newRecordingHooks(unblock)
+		client, _ := newKineWithConfig(t, endpoint.Config{Hooks: hooks, HookBufferSize: 10})
+
+		// blocked hooks hold up neither the writes that fit the buffer nor those that do not
+		writeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		revisions := map[string]int64{}
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("/hooks/blocking/%d", i)
+			resp, err := client.Txn(writeCtx).
+				If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+				Then(clientv3.OpPut(key, key)).
+				Commit()
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Succeeded).To(BeTrue())
+			revisions[key] = resp.Header.Revision
+		}
+
+		// once unblocked, the writes that did not fit the buffer are replayed from the log
+		close(unblock)
+		for key, revision := range revisions {
+			key, revision := key, revision
+			g.Eventually(func() hookCall {
+				return hooks.call(revision)
+			}, 5*time.Second, 10*time.Millisecond).Should(Equal(hookCall{key: key, value: key}))
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/kinetest"
+)
+
+// TestKinetest is unit testing for starting kine for tests with each listener, with and without
+// TLS and embedded, and using both its client and its backend.
+func TestKinetest(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name      string
+		options   kinetest.Options
+		endpoints string
+	}{
+		{name: "Unix", endpoints: "unix://"},
+		{name: "TCP", options: kinetest.Options{TCP: true}, endpoints: "http://127.0.0.1:"},
+		{name: "TLS", options: kinetest.Options{TLS: true}, endpoints: "https://127.0.0.1:"},
+		{name: "Embedded", options: kinetest.Options{Embedded: true}},
+		{name: "Bolt", options: kinetest.Options{Driver: kinetest.Bolt, TCP: true}, endpoints: "http://127.0.0.1:"},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			if test.options.Driver == "" {
+				test.options.Driver = kinetest.SQLite
+			}
+			k := kinetest.Start(t, test.options)
+			g.Expect(k.Driver).To(Equal(test.options.Driver))
+			if test.endpoints == "" {
+				g.Expect(k.Endpoints).To(BeEmpty())
+			} else {
+				g.Expect(k.Endpoints).To(HaveLen(1))
+				g.Expect(k.Endpoints[0]).To(HavePrefix(test.endpoints))
+			}
+
+			createKey(ctx, g, k.Client, "/testKinetest/a", "a")
+			rev, kv, err := k.Backend.Get(ctx, "/testKinetest/a", "", 1, 0)
+			g.Expect(err).To(BeNil())
+			g.Expect(rev).To(BeNumerically(">", 0))
+			g.Expect(kv).NotTo(BeNil())
+			g.Expect(kv.Value).To(Equal([]byte("a")))
+		})
+	}
+}
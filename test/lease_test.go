@@ -0,0 +1,438 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestLeaseExpire is unit testing for the expiry of keys attached to a lease.
+func TestLeaseExpire(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+
+	t.Run("KeyDeletedAfterTTL", func(t *testing.T) {
+		g := NewWithT(t)
+		key := "/lease/testKeyExpire"
+		watchCh := client.Watch(ctx, key, clientv3.WithPrevKV())
+
+		lease, err := client.Grant(ctx, 1)
+		g.Expect(err).To(BeNil())
+
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "testValue", clientv3.WithLease(lease.ID))).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		createRev := resp.Header.Revision
+
+		g.Eventually(watchCh, 5*time.Second).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+			for _, event := range v.Events {
+				if event.Type != clientv3.EventTypeDelete {
+					continue
+				}
+				g.Expect(event.Kv.Key).To(Equal([]byte(key)))
+				g.Expect(event.PrevKv).NotTo(BeNil())
+				g.Expect(event.PrevKv.Value).To(Equal([]byte("testValue")))
+				g.Expect(event.PrevKv.ModRevision).To(Equal(createRev))
+				return true
+			}
+			return false
+		})))
+
+		getResp, err := client.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		g.Expect(getResp.Kvs).To(BeEmpty())
+	})
+
+	t.Run("RefreshedKeyNotDeleted", func(t *testing.T) {
+		g := NewWithT(t)
+		key := "/lease/testKeyRefresh"
+
+		lease, err := client.Grant(ctx, 2)
+		g.Expect(err).To(BeNil())
+
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "testValue", clientv3.WithLease(lease.ID))).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		rev := resp.Header.Revision
+
+		// write the key again with the same lease shortly before it would expire
+		time.Sleep(1500 * time.Millisecond)
+		resp, err = client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+			Then(clientv3.OpPut(key, "testValueRefreshed", clientv3.WithLease(lease.ID))).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+
+		// the original deadline passes, but the key must still be there
+		time.Sleep(1500 * time.Millisecond)
+		getResp, err := client.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		g.Expect(getResp.Kvs).To(HaveLen(1))
+		g.Expect(getResp.Kvs[0].Value).To(Equal([]byte("testValueRefreshed")))
+
+		g.Eventually(func() int {
+			getResp, err := client.Get(ctx, key)
+			g.Expect(err).To(BeNil())
+			return len(getResp.Kvs)
+		}, 5*time.Second, 100*time.Millisecond).Should(Equal(0))
+	})
+}
+
+// TestLeaseExpireAfterWatchOverflow is unit testing for the expiry of keys with a lease once the
+// internal watch of the TTL manager fell behind and was dropped, as it is while it deletes many
+// expired keys at once.
+func TestLeaseExpireAfterWatchOverflow(t *testing.T) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	out := &syncBuffer{}
+	logger := logrus.New()
+	logger.SetOutput(out)
+	client, _ := newKineWithConfig(t, endpoint.Config{WatchBufferSize: 1, Logger: logger})
+
+	// each expired key is deleted on its own, so the deletes of a scan overflow the buffer of the
+	// watch that the TTL manager does not read meanwhile
+	lease, err := client.Grant(ctx, 1)
+	g.Expect(err).To(BeNil())
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("/lease/overflow/%03d", i)
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "testValue", clientv3.WithLease(lease.ID))).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+	}
+	g.Eventually(func() int64 {
+		resp, err := client.Get(ctx, "/lease/overflow/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+		g.Expect(err).To(BeNil())
+		return resp.Count
+	}, 10*time.Second, 100*time.Millisecond).Should(BeZero())
+	g.Eventually(out.String, 5*time.Second, 100*time.Millisecond).Should(ContainSubstring("ttl watch stopped"))
+
+	// the keys written once the watch was dropped expire too
+	key := "/lease/overflow/after"
+	lease, err = client.Grant(ctx, 1)
+	g.Expect(err).To(BeNil())
+	resp, err := client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, "testValue", clientv3.WithLease(lease.ID))).
+		Commit()
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Succeeded).To(BeTrue())
+	g.Eventually(func() int {
+		getResp, err := client.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		return len(getResp.Kvs)
+	}, 10*time.Second, 100*time.Millisecond).Should(Equal(0))
+}
+
+// TestLeaseKeepAlive is unit testing for extending leases with keepalives.
+func TestLeaseKeepAlive(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+
+	t.Run("KeyKeptWhileAlive", func(t *testing.T) {
+		g := NewWithT(t)
+		key := "/lease/testKeyKeepAlive"
+
+		lease, err := client.Grant(ctx, 2)
+		g.Expect(err).To(BeNil())
+
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "testValue", clientv3.WithLease(lease.ID))).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+
+		keepAliveCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		keepAliveCh, err := client.KeepAlive(keepAliveCtx, lease.ID)
+		g.Expect(err).To(BeNil())
+		go func() {
+			for range keepAliveCh {
+			}
+		}()
+
+		g.Consistently(func() int {
+			getResp, err := client.Get(ctx, key)
+			g.Expect(err).To(BeNil())
+			return len(getResp.Kvs)
+		}, 10*time.Second, 500*time.Millisecond).Should(Equal(1))
+
+		// stop the keepalives and wait for the key to expire
+		cancel()
+		g.Eventually(func() int {
+			getResp, err := client.Get(ctx, key)
+			g.Expect(err).To(BeNil())
+			return len(getResp.Kvs)
+		}, 5*time.Second, 100*time.Millisecond).Should(Equal(0))
+	})
+
+	t.Run("UnknownLease", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.KeepAliveOnce(ctx, clientv3.LeaseID(12345))
+		g.Expect(err).To(Equal(rpctypes.ErrLeaseNotFound))
+	})
+}
+
+// TestLeaseTimeToLive is unit testing for the LeaseTimeToLive operation.
+func TestLeaseTimeToLive(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+
+	g := NewWithT(t)
+	lease, err := client.Grant(ctx, 60)
+	g.Expect(err).To(BeNil())
+
+	// attach three keys to the lease, delete one of them again, and create one without a lease
+	for _, key := range []string{"/ttl/b", "/ttl/a", "/ttl/c"} {
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "testValue", clientv3.WithLease(lease.ID))).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+	}
+	{
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision("/ttl/d"), "=", 0)).
+			Then(clientv3.OpPut("/ttl/d", "testValue")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+
+		getResp, err := client.Get(ctx, "/ttl/c")
+		g.Expect(err).To(BeNil())
+		resp, err = client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision("/ttl/c"), "=", getResp.Kvs[0].ModRevision)).
+			Then(clientv3.OpDelete("/ttl/c")).
+			Else(clientv3.OpGet("/ttl/c")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+	}
+
+	t.Run("WithAttachedKeys", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.TimeToLive(ctx, lease.ID, clientv3.WithAttachedKeys())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.ID).To(Equal(lease.ID))
+		g.Expect(resp.GrantedTTL).To(Equal(int64(60)))
+		g.Expect(resp.TTL).To(BeNumerically(">", 50))
+		g.Expect(resp.TTL).To(BeNumerically("<=", 60))
+		g.Expect(resp.Keys).To(Equal([][]byte{[]byte("/ttl/a"), []byte("/ttl/b")}))
+	})
+
+	t.Run("WithoutAttachedKeys", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.TimeToLive(ctx, lease.ID)
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.GrantedTTL).To(Equal(int64(60)))
+		g.Expect(resp.Keys).To(BeEmpty())
+	})
+
+	t.Run("UnknownLease", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.TimeToLive(ctx, clientv3.LeaseID(12345))
+		g.Expect(err).To(Equal(rpctypes.ErrLeaseNotFound))
+	})
+}
+
+// TestLeaseRevoke is unit testing for the LeaseRevoke operation.
+func TestLeaseRevoke(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+
+	g := NewWithT(t)
+	prefix := "/revoke/"
+	lease, err := client.Grant(ctx, 60)
+	g.Expect(err).To(BeNil())
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("%skey-%d", prefix, i)
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "testValue", clientv3.WithLease(lease.ID))).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+	}
+
+	watchCh := client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithPrevKV())
+
+	t.Run("Revoke", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.Revoke(ctx, lease.ID)
+		g.Expect(err).To(BeNil())
+	})
+
+	t.Run("ReceiveDeletes", func(t *testing.T) {
+		g := NewWithT(t)
+		deletes := map[string]int64{}
+		g.Eventually(func() int {
+			select {
+			case v := <-watchCh:
+				for _, event := range v.Events {
+					g.Expect(event.Type).To(Equal(clientv3.EventTypeDelete))
+					g.Expect(event.PrevKv).NotTo(BeNil())
+					g.Expect(event.Kv.ModRevision).To(BeNumerically(">", event.PrevKv.ModRevision))
+					deletes[string(event.Kv.Key)] = event.Kv.ModRevision
+				}
+			default:
+			}
+			return len(deletes)
+		}, 5*time.Second, 10*time.Millisecond).Should(Equal(10))
+		g.Consistently(watchCh, testWatchEventIdleTimeout).ShouldNot(Receive())
+	})
+
+	t.Run("KeysGone", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, prefix, clientv3.WithPrefix())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(BeEmpty())
+	})
+
+	t.Run("RevokeAgainFails", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.Revoke(ctx, lease.ID)
+		g.Expect(err).To(Equal(rpctypes.ErrLeaseNotFound))
+	})
+}
+
+// TestLeaseRestart is unit testing for leases surviving a restart of the backend.
+func TestLeaseRestart(t *testing.T) {
+	ctx := context.Background()
+	dsn := fmt.Sprintf("%s/data.db", newTestDir(t))
+
+	var (
+		shortLease int64
+		longLease  int64
+		shortKey   = "/restart/testKeyShort"
+		longKey    = "/restart/testKeyLong"
+	)
+
+	// grant a short and a long lease with a key each, and stop the backend right away
+	{
+		g := NewWithT(t)
+		backend, stop := startBackend(t, dsn)
+
+		var err error
+		shortLease, err = backend.LeaseGrant(ctx, 0, 1)
+		g.Expect(err).To(BeNil())
+		longLease, err = backend.LeaseGrant(ctx, 0, 60)
+		g.Expect(err).To(BeNil())
+
+		_, err = backend.Create(ctx, shortKey, []byte("testValue"), shortLease)
+		g.Expect(err).To(BeNil())
+		_, err = backend.Create(ctx, longKey, []byte("testValue"), longLease)
+		g.Expect(err).To(BeNil())
+
+		stop()
+	}
+
+	// let the short lease expire while the backend is down
+	time.Sleep(2 * time.Second)
+
+	backend, _ := startBackend(t, dsn)
+
+	t.Run("ExpiredLeaseKeyDeleted", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_, kv, err := backend.Get(ctx, shortKey, "", 1, 0)
+			g.Expect(err).To(BeNil())
+			return kv == nil
+		}, 5*time.Second, 100*time.Millisecond).Should(BeTrue())
+	})
+
+	t.Run("LiveLeaseKept", func(t *testing.T) {
+		g := NewWithT(t)
+		ttl, grantedTTL, keys, err := backend.LeaseTimeToLive(ctx, longLease, true)
+		g.Expect(err).To(BeNil())
+		g.Expect(grantedTTL).To(Equal(int64(60)))
+		g.Expect(ttl).To(BeNumerically(">", 50))
+		g.Expect(keys).To(Equal([]string{longKey}))
+
+		_, kv, err := backend.Get(ctx, longKey, "", 1, 0)
+		g.Expect(err).To(BeNil())
+		g.Expect(kv).NotTo(BeNil())
+	})
+}
+
+// TestLeaseSharedDatabase is unit testing for leases granted by one of the backends that share a
+// database, as seen by another that was started before they were granted.
+func TestLeaseSharedDatabase(t *testing.T) {
+	ctx := context.Background()
+	dsn := fmt.Sprintf("%s/data.db", newTestDir(t))
+	granting, stop := startBackend(t, dsn)
+	other, _ := startBackend(t, dsn)
+
+	t.Run("TimeToLive", func(t *testing.T) {
+		g := NewWithT(t)
+		id, err := granting.LeaseGrant(ctx, 0, 60)
+		g.Expect(err).To(BeNil())
+
+		ttl, grantedTTL, _, err := other.LeaseTimeToLive(ctx, id, false)
+		g.Expect(err).To(BeNil())
+		g.Expect(grantedTTL).To(Equal(int64(60)))
+		g.Expect(ttl).To(BeNumerically(">", 50))
+	})
+
+	t.Run("KeepAlive", func(t *testing.T) {
+		g := NewWithT(t)
+		id, err := granting.LeaseGrant(ctx, 0, 60)
+		g.Expect(err).To(BeNil())
+
+		ttl, err := other.LeaseKeepAlive(ctx, id)
+		g.Expect(err).To(BeNil())
+		g.Expect(ttl).To(Equal(int64(60)))
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		g := NewWithT(t)
+		id, err := granting.LeaseGrant(ctx, 0, 60)
+		g.Expect(err).To(BeNil())
+
+		_, err = other.LeaseRevoke(ctx, id)
+		g.Expect(err).To(BeNil())
+
+		// the granting backend forgets the lease once it refreshes its leases
+		g.Eventually(func() error {
+			_, _, _, err := granting.LeaseTimeToLive(ctx, id, false)
+			return err
+		}, 5*time.Second, 100*time.Millisecond).Should(Equal(server.ErrLeaseNotFound))
+	})
+
+	// the keys of the leases of a backend that stopped are expired by the others
+	t.Run("ExpireAfterGrantingStopped", func(t *testing.T) {
+		g := NewWithT(t)
+		key := "/shared/testKeyExpire"
+		id, err := granting.LeaseGrant(ctx, 0, 1)
+		g.Expect(err).To(BeNil())
+		_, err = granting.Create(ctx, key, []byte("testValue"), id)
+		g.Expect(err).To(BeNil())
+		stop()
+
+		g.Eventually(func() bool {
+			_, kv, err := other.Get(ctx, key, "", 1, 0)
+			g.Expect(err).To(BeNil())
+			return kv == nil
+		}, 10*time.Second, 100*time.Millisecond).Should(BeTrue())
+	})
+}
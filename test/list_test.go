@@ -0,0 +1,362 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestList is unit testing for the list operation.
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+
+	prefix := "/list/"
+	rangeEnd := clientv3.GetPrefixRangeEnd(prefix)
+
+	g := NewWithT(t)
+	for i := 0; i < 5; i++ {
+		createKey(ctx, g, client, fmt.Sprintf("%skey-%d", prefix, i), fmt.Sprintf("value-%d", i))
+	}
+
+	t.Run("KeyOrder", func(t *testing.T) {
+		g := NewWithT(t)
+
+		// update the first key, so that it is no longer the oldest row
+		resp, err := client.Get(ctx, prefix+"key-0")
+		g.Expect(err).To(BeNil())
+		updateResp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(prefix+"key-0"), "=", resp.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(prefix+"key-0", "value-0")).
+			Else(clientv3.OpGet(prefix + "key-0")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(updateResp.Succeeded).To(BeTrue())
+
+		resp, err = client.Get(ctx, prefix, clientv3.WithPrefix())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(5))
+		for i, kv := range resp.Kvs {
+			g.Expect(string(kv.Key)).To(Equal(fmt.Sprintf("%skey-%d", prefix, i)))
+		}
+	})
+
+	t.Run("Paginated", func(t *testing.T) {
+		g := NewWithT(t)
+
+		resp, err := client.Get(ctx, prefix, clientv3.WithRange(rangeEnd), clientv3.WithLimit(2))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.More).To(BeTrue())
+		g.Expect(resp.Count).To(Equal(int64(5)))
+		g.Expect(resp.Kvs).To(HaveLen(2))
+		g.Expect(string(resp.Kvs[0].Key)).To(Equal(prefix + "key-0"))
+		g.Expect(string(resp.Kvs[1].Key)).To(Equal(prefix + "key-1"))
+		rev := resp.Header.Revision
+
+		// write between the pages, the following pages must not see this
+		createKey(ctx, g, client, prefix+"key-1a", "value-1a")
+		deleteKey(ctx, g, client, prefix+"key-3")
+		writeRev, err := client.Get(ctx, prefix+"key-1a")
+		g.Expect(err).To(BeNil())
+		g.Expect(writeRev.Header.Revision).To(BeNumerically(">", rev))
+
+		var (
+			keys      []string
+			remaining = int64(3)
+		)
+		for resp.More {
+			continueKey := string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+			resp, err = client.Get(ctx, continueKey, clientv3.WithRange(rangeEnd), clientv3.WithLimit(2), clientv3.WithRev(rev))
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Header.Revision).To(Equal(rev))
+			for _, kv := range resp.Kvs {
+				keys = append(keys, string(kv.Key))
+				g.Expect(kv.ModRevision).To(BeNumerically("<=", rev))
+			}
+			if resp.More {
+				g.Expect(resp.Count).To(Equal(remaining))
+			}
+			remaining -= int64(len(resp.Kvs))
+		}
+		g.Expect(keys).To(Equal([]string{prefix + "key-2", prefix + "key-3", prefix + "key-4"}))
+	})
+
+	t.Run("LimitNotExceeded", func(t *testing.T) {
+		g := NewWithT(t)
+
+		resp, err := client.Get(ctx, prefix, clientv3.WithRange(rangeEnd), clientv3.WithLimit(10))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.More).To(BeFalse())
+		g.Expect(resp.Count).To(Equal(int64(5)))
+		g.Expect(resp.Kvs).To(HaveLen(5))
+	})
+}
+
+// TestListFromKey is unit testing for lists of the keys from a key on, and of the whole keyspace.
+func TestListFromKey(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+
+	prefix := "/testListFromKey/"
+	g := NewWithT(t)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		createKey(ctx, g, client, prefix+key, key)
+	}
+	keysOf := func(resp *clientv3.GetResponse) []string {
+		keys := make([]string, 0, len(resp.Kvs))
+		for _, kv := range resp.Kvs {
+			keys = append(keys, strings.TrimPrefix(string(kv.Key), prefix))
+		}
+		return keys
+	}
+
+	t.Run("Midpoint", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, prefix+"c", clientv3.WithFromKey())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.More).To(BeFalse())
+		g.Expect(resp.Count).To(Equal(int64(3)))
+		g.Expect(keysOf(resp)).To(Equal([]string{"c", "d", "e"}))
+	})
+
+	t.Run("MidpointMissing", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, prefix+"bb", clientv3.WithFromKey())
+		g.Expect(err).To(BeNil())
+		g.Expect(keysOf(resp)).To(Equal([]string{"c", "d", "e"}))
+	})
+
+	t.Run("Paginated", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, prefix+"b", clientv3.WithFromKey(), clientv3.WithLimit(2))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.More).To(BeTrue())
+		g.Expect(resp.Count).To(Equal(int64(4)))
+		g.Expect(keysOf(resp)).To(Equal([]string{"b", "c"}))
+
+		resp, err = client.Get(ctx, prefix+"c\x00", clientv3.WithFromKey(), clientv3.WithLimit(2), clientv3.WithRev(resp.Header.Revision))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.More).To(BeFalse())
+		g.Expect(keysOf(resp)).To(Equal([]string{"d", "e"}))
+	})
+
+	t.Run("Count", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, prefix+"c", clientv3.WithFromKey(), clientv3.WithCountOnly())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Count).To(Equal(int64(3)))
+		g.Expect(resp.Kvs).To(BeEmpty())
+	})
+
+	t.Run("Keyspace", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, "\x00", clientv3.WithFromKey())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(6))
+		g.Expect(string(resp.Kvs[0].Key)).To(Equal("/registry/health"))
+		g.Expect(keysOf(resp)[1:]).To(Equal([]string{"a", "b", "c", "d", "e"}))
+
+		countResp, err := client.Get(ctx, "\x00", clientv3.WithFromKey(), clientv3.WithCountOnly())
+		g.Expect(err).To(BeNil())
+		g.Expect(countResp.Count).To(Equal(int64(6)))
+
+		limitResp, err := client.Get(ctx, "\x00", clientv3.WithFromKey(), clientv3.WithLimit(3), clientv3.WithKeysOnly())
+		g.Expect(err).To(BeNil())
+		g.Expect(limitResp.More).To(BeTrue())
+		g.Expect(limitResp.Count).To(Equal(int64(6)))
+		g.Expect(keysOf(limitResp)[1:]).To(Equal([]string{"a", "b"}))
+		g.Expect(limitResp.Kvs[1].Value).To(BeEmpty())
+	})
+}
+
+// TestListRevisionFilter is unit testing for lists restricted to a range of revisions.
+func TestListRevisionFilter(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+
+	prefix := "/filter/"
+	created := map[string]int64{}
+
+	g := NewWithT(t)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		createKey(ctx, g, client, prefix+name, "value")
+		resp, err := client.Get(ctx, prefix+name)
+		g.Expect(err).To(BeNil())
+		created[name] = resp.Kvs[0].ModRevision
+	}
+
+	// update b, so that its mod revision is after the creation of d
+	resp, err := client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(prefix+"b"), "=", created["b"])).
+		Then(clientv3.OpPut(prefix+"b", "updated")).
+		Else(clientv3.OpGet(prefix + "b")).
+		Commit()
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Succeeded).To(BeTrue())
+
+	keys := func(g Gomega, opts ...clientv3.OpOption) []string {
+		resp, err := client.Get(ctx, prefix, append(opts, clientv3.WithPrefix())...)
+		g.Expect(err).To(BeNil())
+		var names []string
+		for _, kv := range resp.Kvs {
+			names = append(names, string(kv.Key)[len(prefix):])
+		}
+		return names
+	}
+
+	tests := []struct {
+		name string
+		opt  clientv3.OpOption
+		keys []string
+	}{
+		{"MinModRevision", clientv3.WithMinModRev(created["c"]), []string{"b", "c", "d"}},
+		{"MaxModRevision", clientv3.WithMaxModRev(created["b"]), []string{"a"}},
+		{"MinCreateRevision", clientv3.WithMinCreateRev(created["b"]), []string{"b", "c", "d"}},
+		{"MaxCreateRevision", clientv3.WithMaxCreateRev(created["b"]), []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(keys(g, tt.opt)).To(Equal(tt.keys))
+		})
+	}
+
+	t.Run("LimitCountsFilteredKeys", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithMinModRev(created["c"]), clientv3.WithLimit(2))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(2))
+		g.Expect(string(resp.Kvs[0].Key)).To(Equal(prefix + "b"))
+		g.Expect(string(resp.Kvs[1].Key)).To(Equal(prefix + "c"))
+		g.Expect(resp.More).To(BeTrue())
+		g.Expect(resp.Count).To(Equal(int64(3)))
+	})
+
+	t.Run("CountOnly", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithMaxCreateRev(created["b"]), clientv3.WithCountOnly())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Count).To(Equal(int64(2)))
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Get(ctx, prefix+"a", clientv3.WithMinModRev(created["b"]))
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(BeEmpty())
+	})
+}
+
+// TestListPlan is unit testing for the query plan of the list queries on sqlite, which filter the
+// current rows of a range from the (name, id) index alone, in the order of the names, and read
+// only the rows that are listed from the table.
+func TestListPlan(t *testing.T) {
+	g := NewWithT(t)
+	_, dialect := openSQLLog(t, fmt.Sprintf("%s/data.db", newTestDir(t)))
+
+	for _, query := range []string{dialect.GetCurrentSQL, dialect.ListRevisionStartSQL, dialect.GetRevisionAfterSQL} {
+		// the plan does not depend on the arguments, which only have to be bound
+		rows, err := dialect.DB.Query("EXPLAIN QUERY PLAN "+query, make([]interface{}, strings.Count(query, "?"))...)
+		g.Expect(err).To(BeNil())
+		var plan []string
+		for rows.Next() {
+			var (
+				id, parent, notUsed int
+				detail              string
+			)
+			g.Expect(rows.Scan(&id, &parent, &notUsed, &detail)).To(Succeed())
+			plan = append(plan, detail)
+		}
+		g.Expect(rows.Close()).To(Succeed())
+
+		g.Expect(plan).To(HaveLen(3), "%v", plan)
+		g.Expect(plan[0]).To(HavePrefix("SEARCH mkv USING COVERING INDEX"))
+		g.Expect(plan[1]).To(HavePrefix("SEARCH mkv2 USING COVERING INDEX"))
+		g.Expect(plan[2]).To(HavePrefix("SEARCH kv USING INTEGER PRIMARY KEY"))
+	}
+}
+
+// BenchmarkList is a benchmark for listing a large prefix of keys, of which some were updated,
+// in full and by pages. It runs on sqlite, and on the servers at the endpoints in
+// KINE_MYSQL_ENDPOINT and KINE_POSTGRES_ENDPOINT that are set, in a new database of each.
+func BenchmarkList(b *testing.B) {
+	for _, backend := range []struct {
+		name string
+		env  string
+	}{
+		{name: "SQLite"},
+		{name: "MySQL", env: "KINE_MYSQL_ENDPOINT"},
+		{name: "Postgres", env: "KINE_POSTGRES_ENDPOINT"},
+	} {
+		backend := backend
+		b.Run(backend.name, func(b *testing.B) {
+			config := endpoint.Config{Endpoint: "sqlite://" + fmt.Sprintf("%s/data.db", newTestDir(b))}
+			if backend.env != "" {
+				address := os.Getenv(backend.env)
+				if address == "" {
+					b.Skipf("%s is not set", backend.env)
+				}
+				config.Endpoint = databaseEndpoint(address, newDatabaseName())
+			}
+			benchmarkList(b, config)
+		})
+	}
+}
+
+func benchmarkList(b *testing.B, config endpoint.Config) {
+	ctx := context.Background()
+	client, _ := newKineWithConfig(b, config)
+	g := NewWithT(b)
+
+	const (
+		keys      = 200000
+		batchSize = 500
+		pageSize  = 500
+	)
+	value := strings.Repeat("v", 1024)
+	for i := 0; i < keys; i += batchSize {
+		ops := make([]clientv3.Op, 0, batchSize)
+		for j := i; j < i+batchSize; j++ {
+			ops = append(ops, clientv3.OpPut(fmt.Sprintf("/list/key-%06d", j), value))
+		}
+		_, err := client.Txn(ctx).Then(ops...).Commit()
+		g.Expect(err).To(BeNil())
+	}
+	// every fifth key is updated, so that the rows it replaced are left to skip
+	for i := 0; i < keys; i += 5 * batchSize {
+		ops := make([]clientv3.Op, 0, batchSize)
+		for j := i; j < i+5*batchSize; j += 5 {
+			ops = append(ops, clientv3.OpPut(fmt.Sprintf("/list/key-%06d", j), value))
+		}
+		_, err := client.Txn(ctx).Then(ops...).Commit()
+		g.Expect(err).To(BeNil())
+	}
+
+	b.Run("Full", func(b *testing.B) {
+		g := NewWithT(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			resp, err := client.Get(ctx, "/list/", clientv3.WithPrefix())
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Kvs).To(HaveLen(keys))
+		}
+	})
+
+	b.Run("Paginated", func(b *testing.B) {
+		g := NewWithT(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			start := fmt.Sprintf("/list/key-%06d", (i*pageSize)%keys)
+			resp, err := client.Get(ctx, start, clientv3.WithRange(clientv3.GetPrefixRangeEnd("/list/")), clientv3.WithLimit(pageSize))
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Kvs).NotTo(BeEmpty())
+		}
+	})
+}
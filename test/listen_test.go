@@ -0,0 +1,137 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestMultipleListeners is unit testing for serving on several listeners at once.
+func TestMultipleListeners(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := newTestDir(t)
+	socket := dir + "/listen.sock"
+	etcdConfig, err := endpoint.Listen(ctx, endpoint.Config{
+		Listener: fmt.Sprintf("unix://%s,http://127.0.0.1:0", socket),
+		Endpoint: fmt.Sprintf("sqlite://%s/data.db", dir),
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(etcdConfig.Endpoints).To(HaveLen(2))
+	g.Expect(etcdConfig.Endpoints[0]).To(Equal("unix://" + socket))
+	g.Expect(etcdConfig.Endpoints[1]).To(HavePrefix("http://127.0.0.1:"))
+	g.Expect(etcdConfig.Endpoints[1]).NotTo(HaveSuffix(":0"))
+
+	clients := make([]*clientv3.Client, len(etcdConfig.Endpoints))
+	for i, endpoint := range etcdConfig.Endpoints {
+		client, err := clientv3.New(clientv3.Config{
+			Endpoints:   []string{endpoint},
+			DialTimeout: 5 * time.Second,
+		})
+		g.Expect(err).To(BeNil())
+		defer client.Close()
+		clients[i] = client
+	}
+
+	t.Run("Concurrent", func(t *testing.T) {
+		g := NewWithT(t)
+		var wg sync.WaitGroup
+		errs := make([]error, len(clients))
+		for i, client := range clients {
+			wg.Add(1)
+			go func(i int, client *clientv3.Client) {
+				defer wg.Done()
+				for j := 0; j < 50 && errs[i] == nil; j++ {
+					key := fmt.Sprintf("/testMultipleListeners/%d/%d", i, j)
+					_, errs[i] = client.Txn(ctx).
+						If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+						Then(clientv3.OpPut(key, "value")).
+						Commit()
+				}
+			}(i, client)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			g.Expect(err).To(BeNil())
+		}
+
+		// every listener serves the keys written through the others
+		for _, client := range clients {
+			resp, err := client.Get(ctx, "/testMultipleListeners/", clientv3.WithPrefix())
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Kvs).To(HaveLen(50 * len(clients)))
+		}
+	})
+
+	t.Run("Shutdown", func(t *testing.T) {
+		g := NewWithT(t)
+		cancel()
+
+		g.Eventually(func() bool {
+			_, err := os.Stat(socket)
+			return os.IsNotExist(err)
+		}, 5*time.Second, 10*time.Millisecond).Should(BeTrue())
+
+		address := strings.TrimPrefix(etcdConfig.Endpoints[1], "http://")
+		g.Eventually(func() error {
+			conn, err := net.Dial("tcp", address)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}, 5*time.Second, 10*time.Millisecond).ShouldNot(Succeed())
+	})
+}
+
+// TestShutdown is unit testing for shutting kine down while clients are still connected.
+func TestShutdown(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	dir := newTestDir(t)
+	socket := dir + "/listen.sock"
+	etcdConfig, err := endpoint.Listen(ctx, endpoint.Config{
+		Listener: "unix://" + socket,
+		Endpoint: fmt.Sprintf("sqlite://%s/data.db", dir),
+	})
+	g.Expect(err).To(BeNil())
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   etcdConfig.Endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	g.Expect(err).To(BeNil())
+	defer client.Close()
+
+	// an open watch does not hold up the shutdown
+	watchCtx, cancelWatch := context.WithCancel(ctx)
+	defer cancelWatch()
+	watchCh := client.Watch(watchCtx, "/testShutdown", clientv3.WithCreatedNotify())
+	g.Eventually(watchCh, 5*time.Second).Should(Receive())
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	g.Expect(etcdConfig.Shutdown(shutdownCtx)).To(Succeed())
+	g.Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	g.Expect(etcdConfig.Shutdown(shutdownCtx)).To(Succeed())
+
+	_, err = os.Stat(socket)
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+
+	getCtx, cancelGet := context.WithTimeout(ctx, time.Second)
+	defer cancelGet()
+	_, err = client.Get(getCtx, "/testShutdown")
+	g.Expect(err).NotTo(BeNil())
+}
@@ -0,0 +1,151 @@
+package test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// TestListLimit is unit testing for the limit of concurrent expensive lists, which rejects the
+// lists over it once they waited for the queue timeout, while point reads, counts and small lists
+// keep flowing.
+func TestListLimit(t *testing.T) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	backend, _ := startBackend(t, newTestDir(t)+"/data.db")
+	for _, key := range []string{"/testListLimit/a", "/testListLimit/b", "/testListLimit/blocked/a"} {
+		_, err := backend.Create(ctx, key, []byte("value"), 0)
+		g.Expect(err).To(BeNil())
+	}
+	blocking := &blockingListBackend{
+		Backend: backend,
+		prefix:  "/testListLimit/blocked/",
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	registry := prometheus.NewRegistry()
+	b := server.New(blocking, server.Config{
+		MaxConcurrentLists: 1,
+		ListQueueTimeout:   500 * time.Millisecond,
+		MetricsRegisterer:  registry,
+	})
+
+	// the list that holds the only slot blocks in the backend
+	blockedErr := make(chan error, 1)
+	go func() {
+		_, err := b.Range(ctx, prefixRange("/testListLimit/blocked/", 0))
+		blockedErr <- err
+	}()
+	g.Eventually(blocking.entered, time.Second).Should(BeClosed())
+	families := gatherMetrics(g, registry)
+	g.Expect(metricValue(families["kine_list_in_flight"], nil)).To(Equal(1.0))
+	g.Expect(metricValue(families["kine_list_max_in_flight"], nil)).To(Equal(1.0))
+
+	// other expensive lists wait for the queue timeout and are rejected
+	for _, r := range []*etcdserverpb.RangeRequest{prefixRange("/testListLimit/", 0), prefixRange("/testListLimit/", 1000)} {
+		start := time.Now()
+		_, err := b.Range(ctx, r)
+		g.Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+		g.Expect(err).To(Equal(server.ErrTooManyLists))
+		g.Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+	}
+	g.Expect(metricValue(gatherMetrics(g, registry)["kine_list_rejected_total"], map[string]string{"reason": "concurrency"})).To(Equal(2.0))
+
+	// point reads, counts and small lists are not limited
+	resp, err := b.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("/testListLimit/a")})
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Kvs).To(HaveLen(1))
+	countReq := prefixRange("/testListLimit/", 0)
+	countReq.CountOnly = true
+	resp, err = b.Range(ctx, countReq)
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Count).To(Equal(int64(3)))
+	resp, err = b.Range(ctx, prefixRange("/testListLimit/", 1))
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Kvs).To(HaveLen(1))
+
+	// a list that waits gets the slot once it is free
+	queuedErr := make(chan error, 1)
+	go func() {
+		_, err := b.Range(ctx, prefixRange("/testListLimit/", 0))
+		queuedErr <- err
+	}()
+	g.Eventually(func() float64 {
+		return metricValue(gatherMetrics(g, registry)["kine_list_queued"], nil)
+	}, time.Second, 5*time.Millisecond).Should(Equal(1.0))
+	close(blocking.release)
+	g.Eventually(blockedErr, time.Second).Should(Receive(BeNil()))
+	g.Eventually(queuedErr, time.Second).Should(Receive(BeNil()))
+	families = gatherMetrics(g, registry)
+	g.Expect(metricValue(families["kine_list_in_flight"], nil)).To(Equal(0.0))
+	g.Expect(metricValue(families["kine_list_queued"], nil)).To(Equal(0.0))
+}
+
+// TestListRateLimit is unit testing for the rate limit of expensive lists, which each client is
+// held to on its own, and which point reads are not held to.
+func TestListRateLimit(t *testing.T) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	backend, _ := startBackend(t, newTestDir(t)+"/data.db")
+	_, err := backend.Create(ctx, "/testListRateLimit/a", []byte("value"), 0)
+	g.Expect(err).To(BeNil())
+	registry := prometheus.NewRegistry()
+	b := server.New(backend, server.Config{
+		ListRateLimit:     0.5,
+		ListRateBurst:     2,
+		MetricsRegisterer: registry,
+	})
+	client := func(host string) context.Context {
+		return peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(host), Port: 40000}})
+	}
+
+	// the connections of a client share its burst
+	for i := 0; i < 2; i++ {
+		ctx := peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000 + i}})
+		_, err := b.Range(ctx, prefixRange("/testListRateLimit/", 0))
+		g.Expect(err).To(BeNil())
+	}
+	_, err = b.Range(client("10.0.0.1"), prefixRange("/testListRateLimit/", 0))
+	g.Expect(err).To(Equal(server.ErrListRateLimited))
+	g.Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+	g.Expect(metricValue(gatherMetrics(g, registry)["kine_list_rejected_total"], map[string]string{"reason": "rate"})).To(Equal(1.0))
+
+	resp, err := b.Range(client("10.0.0.1"), &etcdserverpb.RangeRequest{Key: []byte("/testListRateLimit/a")})
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Kvs).To(HaveLen(1))
+	_, err = b.Range(client("10.0.0.2"), prefixRange("/testListRateLimit/", 0))
+	g.Expect(err).To(BeNil())
+}
+
+// prefixRange returns the request of the list of the keys under the prefix, with the limit.
+func prefixRange(prefix string, limit int64) *etcdserverpb.RangeRequest {
+	end := []byte(prefix)
+	end[len(end)-1]++
+	return &etcdserverpb.RangeRequest{Key: []byte(prefix), RangeEnd: end, Limit: limit}
+}
+
+// blockingListBackend blocks the lists of its prefix until release is closed, once it has closed
+// entered.
+type blockingListBackend struct {
+	server.Backend
+	prefix  string
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingListBackend) List(ctx context.Context, prefix, startKey string, limit, revision int64, keysOnly bool, filter server.RevisionFilter) (int64, []*server.KeyValue, error) {
+	if prefix == b.prefix {
+		close(b.entered)
+		<-b.release
+	}
+	return b.Backend.List(ctx, prefix, startKey, limit, revision, keysOnly, filter)
+}
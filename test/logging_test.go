@@ -0,0 +1,48 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/sirupsen/logrus"
+)
+
+// TestLogger is unit testing for logging kine instances that run at the same time to loggers of
+// their own, from their servers and backends alike.
+func TestLogger(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	names := []string{"a", "b"}
+	logs := make([]*syncBuffer, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		logs[i] = &syncBuffer{}
+		logger := logrus.New()
+		logger.SetOutput(logs[i])
+		logger.SetLevel(logrus.DebugLevel)
+		client, _ := newKineWithConfig(t, endpoint.Config{Logger: logger})
+
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			g := NewWithT(t)
+			for j := 0; j < 10; j++ {
+				createKey(ctx, g, client, fmt.Sprintf("/testLogger/%s/%d", name, j), "value")
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		other := names[len(names)-1-i]
+		g.Expect(logs[i].String()).To(ContainSubstring("Kine listening on unix://"))
+		g.Expect(logs[i].String()).To(ContainSubstring("Configured database connection pool"))
+		g.Expect(logs[i].String()).To(ContainSubstring("CREATE /testLogger/" + name + "/9"))
+		g.Expect(logs[i].String()).NotTo(ContainSubstring("/testLogger/" + other + "/"))
+	}
+}
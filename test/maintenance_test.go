@@ -0,0 +1,420 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestStatus is unit testing for the status rpc.
+func TestStatus(t *testing.T) {
+	ctx := context.Background()
+	client, dsn := newKineWithConfig(t, endpoint.Config{})
+	_, dialect := openSQLLog(t, dsn)
+
+	var (
+		keys  = 200
+		value = strings.Repeat("v", 4096)
+	)
+
+	status := func(g Gomega) *clientv3.StatusResponse {
+		resp, err := client.Status(ctx, client.Endpoints()[0])
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.DbSizeInUse).To(BeNumerically("<=", resp.DbSize))
+		return resp
+	}
+
+	initial := status(NewWithT(t))
+
+	t.Run("Version", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Expect(initial.Version).To(MatchRegexp(`^\d+\.\d+\.\d+$`))
+	})
+
+	var written *clientv3.StatusResponse
+	t.Run("AfterWrite", func(t *testing.T) {
+		g := NewWithT(t)
+		for i := 0; i < keys; i++ {
+			createKey(ctx, g, client, fmt.Sprintf("/testStatus/%d", i), value)
+		}
+
+		written = status(g)
+		g.Expect(written.Header.Revision).To(BeNumerically(">=", initial.Header.Revision+int64(keys)))
+		g.Expect(written.DbSize).To(BeNumerically(">", initial.DbSize))
+		g.Expect(written.DbSizeInUse).To(BeNumerically(">", initial.DbSizeInUse))
+	})
+
+	var compacted *clientv3.StatusResponse
+	t.Run("AfterCompact", func(t *testing.T) {
+		g := NewWithT(t)
+		for i := 0; i < keys; i++ {
+			deleteKey(ctx, g, client, fmt.Sprintf("/testStatus/%d", i))
+		}
+
+		_, err := client.Compact(ctx, status(g).Header.Revision)
+		g.Expect(err).To(BeNil())
+
+		compacted = status(g)
+		g.Expect(compacted.Header.Revision).To(BeNumerically(">", written.Header.Revision))
+		g.Expect(compacted.DbSizeInUse).To(BeNumerically("<", written.DbSizeInUse))
+	})
+
+	t.Run("AfterVacuum", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := dialect.DB.ExecContext(ctx, "VACUUM")
+		g.Expect(err).To(BeNil())
+
+		vacuumed := status(g)
+		g.Expect(vacuumed.Header.Revision).To(Equal(compacted.Header.Revision))
+		g.Expect(vacuumed.DbSize).To(BeNumerically("<", compacted.DbSize))
+		g.Expect(vacuumed.DbSize).To(Equal(vacuumed.DbSizeInUse))
+	})
+}
+
+// TestDefragment is unit testing for the defragment rpc.
+func TestDefragment(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+	member := client.Endpoints()[0]
+
+	var (
+		keys  = 200
+		value = strings.Repeat("v", 4096)
+	)
+
+	status := func(g Gomega) *clientv3.StatusResponse {
+		resp, err := client.Status(ctx, member)
+		g.Expect(err).To(BeNil())
+		return resp
+	}
+
+	initial := status(NewWithT(t))
+
+	var compacted *clientv3.StatusResponse
+	{
+		g := NewWithT(t)
+		for i := 0; i < keys; i++ {
+			createKey(ctx, g, client, fmt.Sprintf("/testDefragment/%d", i), value)
+		}
+		g.Expect(status(g).DbSize).To(BeNumerically(">", initial.DbSize+int64(keys*len(value))))
+
+		for i := 0; i < keys; i++ {
+			deleteKey(ctx, g, client, fmt.Sprintf("/testDefragment/%d", i))
+		}
+		_, err := client.Compact(ctx, status(g).Header.Revision)
+		g.Expect(err).To(BeNil())
+
+		compacted = status(g)
+		g.Expect(compacted.DbSizeInUse).To(BeNumerically("<", compacted.DbSize))
+	}
+
+	t.Run("Shrinks", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.Defragment(ctx, member)
+		g.Expect(err).To(BeNil())
+
+		defragmented := status(g)
+		g.Expect(defragmented.DbSize).To(BeNumerically("<", compacted.DbSize-int64(keys*len(value))))
+		g.Expect(defragmented.DbSize).To(Equal(defragmented.DbSizeInUse))
+		g.Expect(defragmented.Header.Revision).To(Equal(compacted.Header.Revision))
+	})
+
+	t.Run("KeysReadable", func(t *testing.T) {
+		g := NewWithT(t)
+		createKey(ctx, g, client, "/testDefragment/after", "value")
+
+		resp, err := client.Get(ctx, "/testDefragment/", clientv3.WithPrefix())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(1))
+		g.Expect(resp.Kvs[0].Value).To(Equal([]byte("value")))
+	})
+}
+
+// TestQuota is unit testing for the backend quota and its NOSPACE alarm.
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newKineWithConfig(t, endpoint.Config{QuotaBackendBytes: 1024 * 1024})
+	member := client.Endpoints()[0]
+	value := strings.Repeat("v", 4096)
+	noSpace := &clientv3.AlarmMember{Alarm: etcdserverpb.AlarmType_NOSPACE}
+
+	// Write until the quota is exceeded; the size is checked at most once a second
+	var keys int
+	{
+		g := NewWithT(t)
+		deadline := time.Now().Add(10 * time.Second)
+		for ; time.Now().Before(deadline); keys++ {
+			key := fmt.Sprintf("/testQuota/%d", keys)
+			_, err := client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+				Then(clientv3.OpPut(key, value)).
+				Commit()
+			if err != nil {
+				g.Expect(err).To(Equal(rpctypes.ErrNoSpace))
+				break
+			}
+		}
+		g.Expect(time.Now()).To(BeTemporally("<", deadline))
+	}
+
+	t.Run("AlarmListed", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.AlarmList(ctx)
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Alarms).To(HaveLen(1))
+		g.Expect(resp.Alarms[0].Alarm).To(Equal(etcdserverpb.AlarmType_NOSPACE))
+	})
+
+	t.Run("WritesRejected", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision("/testQuota/0"), "!=", 0)).
+			Then(clientv3.OpPut("/testQuota/0", "updated")).
+			Commit()
+		g.Expect(err).To(Equal(rpctypes.ErrNoSpace))
+
+		_, err = client.Grant(ctx, 60)
+		g.Expect(err).To(Equal(rpctypes.ErrNoSpace))
+	})
+
+	t.Run("ReadsAllowed", func(t *testing.T) {
+		g := NewWithT(t)
+		assertKey(ctx, g, client, "/testQuota/0", value)
+	})
+
+	t.Run("DisarmOverQuotaFails", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.AlarmDisarm(ctx, noSpace)
+		g.Expect(err).NotTo(BeNil())
+
+		resp, err := client.AlarmList(ctx)
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Alarms).To(HaveLen(1))
+	})
+
+	t.Run("Recover", func(t *testing.T) {
+		g := NewWithT(t)
+		for i := 0; i < keys; i++ {
+			deleteKey(ctx, g, client, fmt.Sprintf("/testQuota/%d", i))
+		}
+		status, err := client.Status(ctx, member)
+		g.Expect(err).To(BeNil())
+		_, err = client.Compact(ctx, status.Header.Revision)
+		g.Expect(err).To(BeNil())
+		_, err = client.Defragment(ctx, member)
+		g.Expect(err).To(BeNil())
+
+		_, err = client.AlarmDisarm(ctx, noSpace)
+		g.Expect(err).To(BeNil())
+
+		resp, err := client.AlarmList(ctx)
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Alarms).To(BeEmpty())
+
+		createKey(ctx, g, client, "/testQuota/after", "value")
+	})
+}
+
+// TestHashKV is unit testing for the hash kv rpc.
+func TestHashKV(t *testing.T) {
+	ctx := context.Background()
+	client, dsn := newKineWithConfig(t, endpoint.Config{})
+	member := client.Endpoints()[0]
+
+	for i := 0; i < 10; i++ {
+		createKey(ctx, NewWithT(t), client, fmt.Sprintf("/testHashKV/%d", i), fmt.Sprintf("value-%d", i))
+	}
+
+	hash := func(g Gomega, revision int64) *clientv3.HashKVResponse {
+		resp, err := client.HashKV(ctx, member, revision)
+		g.Expect(err).To(BeNil())
+		return resp
+	}
+
+	initial := hash(NewWithT(t), 0)
+
+	t.Run("Stable", func(t *testing.T) {
+		g := NewWithT(t)
+		resp := hash(g, 0)
+		g.Expect(resp.Header.Revision).To(Equal(initial.Header.Revision))
+		g.Expect(resp.Hash).To(Equal(initial.Hash))
+	})
+
+	t.Run("StableAcrossRestart", func(t *testing.T) {
+		g := NewWithT(t)
+		backend, _ := startBackend(t, dsn)
+		resp, err := server.New(backend, server.Config{}).HashKV(ctx, &etcdserverpb.HashKVRequest{})
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Header.Revision).To(Equal(initial.Header.Revision))
+		g.Expect(resp.Hash).To(Equal(initial.Hash))
+	})
+
+	t.Run("ChangesAfterUpdate", func(t *testing.T) {
+		g := NewWithT(t)
+		key := "/testHashKV/0"
+		get, err := client.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", get.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(key, "updated")).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+
+		updated := hash(g, 0)
+		g.Expect(updated.Header.Revision).To(BeNumerically(">", initial.Header.Revision))
+		g.Expect(updated.Hash).NotTo(Equal(initial.Hash))
+	})
+
+	t.Run("ChangesAfterDelete", func(t *testing.T) {
+		g := NewWithT(t)
+		before := hash(g, 0)
+		deleteKey(ctx, g, client, "/testHashKV/1")
+		g.Expect(hash(g, 0).Hash).NotTo(Equal(before.Hash))
+	})
+
+	t.Run("AtRevision", func(t *testing.T) {
+		g := NewWithT(t)
+		resp := hash(g, initial.Header.Revision)
+		g.Expect(resp.Header.Revision).To(Equal(initial.Header.Revision))
+		g.Expect(resp.Hash).To(Equal(initial.Hash))
+	})
+
+	t.Run("FutureRevision", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.HashKV(ctx, member, initial.Header.Revision+1000)
+		g.Expect(err).To(Equal(rpctypes.ErrFutureRev))
+	})
+}
+
+// TestSnapshot is unit testing for the snapshot rpc and restoring its snapshots.
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	client, dsn := newKineWithConfig(t, endpoint.Config{})
+
+	for i := 0; i < 10; i++ {
+		createKey(ctx, NewWithT(t), client, fmt.Sprintf("/testSnapshot/%d", i), fmt.Sprintf("value-%d", i))
+	}
+	deleteKey(ctx, NewWithT(t), client, "/testSnapshot/0")
+
+	var snapshot []byte
+	{
+		g := NewWithT(t)
+		rc, err := client.Snapshot(ctx)
+		g.Expect(err).To(BeNil())
+		snapshot, err = io.ReadAll(rc)
+		g.Expect(err).To(BeNil())
+		g.Expect(rc.Close()).To(Succeed())
+	}
+
+	current, err := client.Get(ctx, "/testSnapshot/", clientv3.WithPrefix())
+	NewWithT(t).Expect(err).To(BeNil())
+
+	// restored checks that the database holds the keys of the kine instance
+	// with their revisions
+	restored := func(g Gomega, dsn string) {
+		backend, _ := startBackend(t, dsn)
+		rev, kvs, err := backend.List(ctx, "/testSnapshot/", "", 0, 0, false, server.RevisionFilter{})
+		g.Expect(err).To(BeNil())
+		// the current revision is raised past that of the snapshot
+		g.Expect(rev).To(Equal(current.Header.Revision + 1))
+		g.Expect(kvs).To(HaveLen(len(current.Kvs)))
+		for i, kv := range kvs {
+			g.Expect(kv.Key).To(Equal(string(current.Kvs[i].Key)))
+			g.Expect(kv.Value).To(Equal(current.Kvs[i].Value))
+			g.Expect(kv.CreateRevision).To(Equal(current.Kvs[i].CreateRevision))
+			g.Expect(kv.ModRevision).To(Equal(current.Kvs[i].ModRevision))
+		}
+	}
+
+	restore := func(dsn string, snapshot []byte) error {
+		return endpoint.Restore(ctx, endpoint.Config{Endpoint: "sqlite://" + dsn}, bytes.NewReader(snapshot), false)
+	}
+
+	t.Run("Restore", func(t *testing.T) {
+		g := NewWithT(t)
+		target := newTestDir(t) + "/data.db"
+		g.Expect(restore(target, snapshot)).To(Succeed())
+		restored(g, target)
+	})
+
+	t.Run("RestoreRows", func(t *testing.T) {
+		g := NewWithT(t)
+		_, dialect := openSQLLog(t, dsn)
+		dialect.SnapshotFile = nil
+		var buf bytes.Buffer
+		g.Expect(dialect.Snapshot(ctx, &buf)).To(Succeed())
+
+		target := newTestDir(t) + "/data.db"
+		g.Expect(restore(target, buf.Bytes())).To(Succeed())
+		restored(g, target)
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		g := NewWithT(t)
+		corrupt := append([]byte{}, snapshot...)
+		corrupt[len(corrupt)/2] ^= 0xff
+
+		target := newTestDir(t) + "/data.db"
+		g.Expect(restore(target, corrupt)).NotTo(Succeed())
+		g.Expect(restore(target, snapshot[:len(snapshot)-1])).NotTo(Succeed())
+
+		// nothing was written, so the snapshot still restores
+		g.Expect(restore(target, snapshot)).To(Succeed())
+		restored(g, target)
+	})
+
+	t.Run("NotEmpty", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Expect(restore(dsn, snapshot)).NotTo(Succeed())
+	})
+}
+
+// TestDbSize is unit testing for the size of the database, and of the part of it in use, that
+// every backend reports through the status rpc, and that grow as keys are written in bulk.
+func TestDbSize(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+	g := NewWithT(t)
+
+	status := func() *clientv3.StatusResponse {
+		resp, err := client.Status(ctx, client.Endpoints()[0])
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.DbSizeInUse).To(BeNumerically("<=", resp.DbSize))
+		return resp
+	}
+	initial := status()
+	g.Expect(initial.DbSize).To(BeNumerically(">", 0))
+	g.Expect(initial.DbSizeInUse).To(BeNumerically(">", 0))
+
+	value := strings.Repeat("v", 4096)
+	for i := 0; i < 1000; i += 100 {
+		ops := make([]clientv3.Op, 0, 100)
+		for j := i; j < i+100; j++ {
+			ops = append(ops, clientv3.OpPut(fmt.Sprintf("/testDbSize/%04d", j), value))
+		}
+		resp, err := client.Txn(ctx).Then(ops...).Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+	}
+
+	// some databases report sizes from statistics that are only updated a while after the writes
+	g.Eventually(func() int64 {
+		return status().DbSize
+	}, 30*time.Second, 500*time.Millisecond).Should(BeNumerically(">", initial.DbSize))
+	g.Eventually(func() int64 {
+		return status().DbSizeInUse
+	}, 30*time.Second, 500*time.Millisecond).Should(BeNumerically(">", initial.DbSizeInUse))
+}
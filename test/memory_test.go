@@ -0,0 +1,140 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/server"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestWatchCatchUpBatches is unit testing for watches that catch up on more events than are read
+// from the database at once.
+func TestWatchCatchUpBatches(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, _ := newKineWithConfig(t, endpoint.Config{PollBatchSize: 3})
+
+	const keys = 10
+	for i := 0; i < keys; i++ {
+		createKey(ctx, g, client, fmt.Sprintf("/testWatchCatchUpBatches/%02d", i), "value")
+	}
+	resp, err := client.Get(ctx, "/testWatchCatchUpBatches/", clientv3.WithPrefix())
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Kvs).To(HaveLen(keys))
+
+	// the events of every batch arrive, in order
+	watchCh := client.Watch(ctx, "/testWatchCatchUpBatches/", clientv3.WithPrefix(), clientv3.WithRev(resp.Kvs[0].ModRevision))
+	var events []*clientv3.Event
+	g.Eventually(func() []*clientv3.Event {
+		select {
+		case resp := <-watchCh:
+			g.Expect(resp.Err()).To(BeNil())
+			events = append(events, resp.Events...)
+		default:
+		}
+		return events
+	}, 5*time.Second).Should(HaveLen(keys))
+	for i, event := range events {
+		g.Expect(event.Kv.Key).To(Equal([]byte(fmt.Sprintf("/testWatchCatchUpBatches/%02d", i))))
+		g.Expect(event.Kv.ModRevision).To(Equal(resp.Kvs[i].ModRevision))
+	}
+}
+
+// BenchmarkListMemory is a benchmark for listing 100k small keys, and for catching up on their
+// events all at once as watches did before and in batches as they do now. It reports the peak
+// heap in use per operation.
+func BenchmarkListMemory(b *testing.B) {
+	const keys = 100000
+
+	g := NewWithT(b)
+	ctx := context.Background()
+	log, dialect := openSQLLog(b, newTestDir(b)+"/data.db")
+
+	tx, err := dialect.DB.Begin()
+	g.Expect(err).To(BeNil())
+	for i := 0; i < keys; i++ {
+		_, err := tx.Exec(`INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+			VALUES(?, 1, 0, 0, 0, 0, ?, NULL)`, fmt.Sprintf("/benchListMemory/%06d", i), []byte("value"))
+		g.Expect(err).To(BeNil())
+	}
+	g.Expect(tx.Commit()).To(Succeed())
+
+	ops := map[string]func(){
+		"List": func() {
+			_, events, err := log.List(ctx, "/benchListMemory/", "", 0, 0, false, false, server.RevisionFilter{})
+			g.Expect(err).To(BeNil())
+			g.Expect(events).To(HaveLen(keys))
+		},
+		"WatchCatchUp/All": func() {
+			_, events, err := log.After(ctx, "/benchListMemory/", 0, 0)
+			g.Expect(err).To(BeNil())
+			g.Expect(events).To(HaveLen(keys))
+		},
+		"WatchCatchUp/Batches": func() {
+			var count int
+			_, err := log.AfterBatches(ctx, "/benchListMemory/", 0, func(events []*server.Event) error {
+				count += len(events)
+				return nil
+			})
+			g.Expect(err).To(BeNil())
+			g.Expect(count).To(Equal(keys))
+		},
+	}
+
+	for _, name := range []string{"List", "WatchCatchUp/All", "WatchCatchUp/Batches"} {
+		op := ops[name]
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			var peak uint64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				peak += peakHeap(op)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(peak)/float64(b.N), "peak-heap-bytes/op")
+		})
+	}
+}
+
+// peakHeap runs fn, and returns the most heap it had in use at once above what was in use
+// before, sampled every millisecond.
+func peakHeap(fn func()) uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	base := stats.HeapAlloc
+
+	done := make(chan struct{})
+	result := make(chan uint64)
+	go func() {
+		var (
+			peak   uint64
+			stats  runtime.MemStats
+			ticker = time.NewTicker(time.Millisecond)
+		)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > base && stats.HeapAlloc-base > peak {
+				peak = stats.HeapAlloc - base
+			}
+			select {
+			case <-done:
+				result <- peak
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	fn()
+	close(done)
+	return <-result
+}
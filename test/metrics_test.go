@@ -0,0 +1,116 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rancher/kine/pkg/endpoint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestMetrics is unit testing for the metrics of the rpcs, the SQL statements and the watches.
+func TestMetrics(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	registry := prometheus.NewRegistry()
+	client, _ := newKineWithConfig(t, endpoint.Config{MetricsRegistry: registry})
+
+	createKey(ctx, g, client, "/testMetrics/a", "a")
+	_, err := client.Get(ctx, "/testMetrics/a")
+	g.Expect(err).To(BeNil())
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchCh := client.Watch(watchCtx, "/testMetrics/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	g.Eventually(watchCh, 5*time.Second).Should(Receive())
+
+	families := gatherMetrics(g, registry)
+	g.Expect(families).To(HaveKey("kine_sql_duration_seconds"))
+	g.Expect(families).To(HaveKey("kine_watch_queue_depth"))
+	g.Expect(metricValue(families["kine_grpc_requests_total"], map[string]string{"method": "/etcdserverpb.KV/Range", "code": "OK"})).To(BeNumerically(">=", 1))
+	g.Expect(metricValue(families["kine_grpc_requests_total"], map[string]string{"method": "/etcdserverpb.KV/Txn", "code": "OK"})).To(BeNumerically(">=", 1))
+	g.Expect(metricValue(families["kine_watch_watchers"], nil)).To(Equal(1.0))
+
+	resp, err := client.Get(ctx, "/testMetrics/a")
+	g.Expect(err).To(BeNil())
+	g.Expect(metricValue(families["kine_current_revision"], nil)).To(BeNumerically(">=", float64(resp.Header.Revision)))
+	g.Expect(families).To(HaveKey("kine_compact_revision"))
+	g.Expect(metricValue(families["kine_db_size_bytes"], nil)).To(BeNumerically(">", 0))
+	g.Expect(metricValue(families["kine_db_size_in_use_bytes"], nil)).To(BeNumerically(">", 0))
+
+	t.Run("SharedRegistry", func(t *testing.T) {
+		g := NewWithT(t)
+		// a second instance registering with the same registry does not fail
+		client, _ := newKineWithConfig(t, endpoint.Config{MetricsRegistry: registry})
+		_, err := client.Get(ctx, "/testMetrics/a")
+		g.Expect(err).To(BeNil())
+		g.Expect(gatherMetrics(g, registry)).To(HaveKey("kine_grpc_requests_total"))
+	})
+
+	t.Run("Listener", func(t *testing.T) {
+		g := NewWithT(t)
+		address := freeAddress(g)
+		newKineWithConfig(t, endpoint.Config{MetricsListener: address})
+
+		httpClient := newHTTPClient()
+		var body []byte
+		g.Eventually(func() error {
+			resp, err := httpClient.Get(fmt.Sprintf("http://%s/metrics", address))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			body, err = io.ReadAll(resp.Body)
+			return err
+		}, 5*time.Second, 10*time.Millisecond).Should(Succeed())
+		g.Expect(string(body)).To(ContainSubstring("kine_current_revision"))
+		g.Expect(string(body)).To(ContainSubstring("go_goroutines"))
+	})
+}
+
+// gatherMetrics returns the metric families of the registry by name.
+func gatherMetrics(g Gomega, registry *prometheus.Registry) map[string]*dto.MetricFamily {
+	families, err := registry.Gather()
+	g.Expect(err).To(BeNil())
+	byName := map[string]*dto.MetricFamily{}
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	return byName
+}
+
+// metricValue returns the value of the counter or gauge of the family with the labels, or -1 if there is none.
+func metricValue(family *dto.MetricFamily, labels map[string]string) float64 {
+	for _, metric := range family.GetMetric() {
+		matches := 0
+		for _, label := range metric.GetLabel() {
+			if labels[label.GetName()] == label.GetValue() {
+				matches++
+			}
+		}
+		if matches != len(labels) {
+			continue
+		}
+		if metric.Counter != nil {
+			return metric.Counter.GetValue()
+		}
+		return metric.Gauge.GetValue()
+	}
+	return -1
+}
+
+// freeAddress returns an address on the loopback interface with a port that is not in use.
+func freeAddress(g Gomega) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).To(BeNil())
+	defer listener.Close()
+	return listener.Addr().String()
+}
@@ -0,0 +1,58 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestMigrate is unit testing for copying the keys of the key_value table of old versions of kine
+// into the kine table on start.
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Fresh", func(t *testing.T) {
+		g := NewWithT(t)
+		client := newKine(t)
+		createKey(ctx, g, client, "/testMigrate/fresh", "value")
+		assertKey(ctx, g, client, "/testMigrate/fresh", "value")
+	})
+
+	t.Run("KeyValue", func(t *testing.T) {
+		dsn := fmt.Sprintf("%s/data.db", newTestDir(t))
+		func() {
+			g := NewWithT(t)
+			db, err := sql.Open(sqliteDriverName(), dsn)
+			g.Expect(err).To(BeNil())
+			defer db.Close()
+			for _, stmt := range []string{
+				`CREATE TABLE key_value (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, value BLOB, ttl INTEGER)`,
+				`INSERT INTO key_value (name, value, ttl) VALUES ('/testMigrate/a', 'old', 0)`,
+				`INSERT INTO key_value (name, value, ttl) VALUES ('/testMigrate/a', 'new', 0)`,
+				`INSERT INTO key_value (name, value, ttl) VALUES ('/testMigrate/b', 'b', 0)`,
+			} {
+				_, err := db.Exec(stmt)
+				g.Expect(err).To(BeNil())
+			}
+		}()
+
+		// the keys are only copied once, however often kine starts
+		for i := 0; i < 2; i++ {
+			t.Run(fmt.Sprintf("Start%d", i), func(t *testing.T) {
+				g := NewWithT(t)
+				client, _ := newKineWithConfig(t, endpoint.Config{Endpoint: "sqlite://" + dsn})
+				assertKey(ctx, g, client, "/testMigrate/a", "new")
+				assertKey(ctx, g, client, "/testMigrate/b", "b")
+
+				resp, err := client.Get(ctx, "/testMigrate/", clientv3.WithPrefix())
+				g.Expect(err).To(BeNil())
+				g.Expect(resp.Kvs).To(HaveLen(2))
+			})
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/migrate"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestMigration is unit testing for migrating the keys of a served sqlite database into another,
+// which serves the same ranges, leases and watches at revisions above those of the source.
+func TestMigration(t *testing.T) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	source := endpoint.Config{
+		Endpoint:     fmt.Sprintf("sqlite://%s/data.db", newTestDir(t)),
+		PollInterval: 50 * time.Millisecond,
+	}
+	client, _ := newKineWithConfig(t, source)
+
+	for i := 0; i < 25; i++ {
+		createKey(ctx, g, client, fmt.Sprintf("/testMigration/%02d", i), fmt.Sprintf("value-%d", i))
+	}
+	for i := 0; i < 25; i += 7 {
+		deleteKey(ctx, g, client, fmt.Sprintf("/testMigration/%02d", i))
+	}
+	large := strings.Repeat("large", 200*1024)
+	createKey(ctx, g, client, "/testMigration/large", large)
+	lease, err := client.Grant(ctx, 60)
+	g.Expect(err).To(BeNil())
+	_, err = client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision("/testMigration/leased"), "=", 0)).
+		Then(clientv3.OpPut("/testMigration/leased", "value", clientv3.WithLease(lease.ID))).
+		Commit()
+	g.Expect(err).To(BeNil())
+
+	// the source keeps serving writes while it is migrated, which are replayed
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		g := NewWithT(t)
+		for i := 0; i < 20; i++ {
+			createKey(ctx, g, client, fmt.Sprintf("/testMigration/live/%02d", i), "live")
+			if i%4 == 0 {
+				deleteKey(ctx, g, client, fmt.Sprintf("/testMigration/%02d", i+1))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	destination := endpoint.Config{Endpoint: fmt.Sprintf("sqlite://%s/data.db", newTestDir(t))}
+	result, err := migrate.Migrate(ctx, migrate.Config{
+		Source:      source,
+		Destination: destination,
+		BatchSize:   10,
+		Follow:      time.Second,
+	})
+	wg.Wait()
+	g.Expect(err).To(BeNil())
+	g.Expect(result.Leases).To(Equal(int64(1)))
+
+	embedded, err := endpoint.NewEmbedded(ctx, destination)
+	g.Expect(err).To(BeNil())
+	defer embedded.Close()
+	migrated := embedded.Client()
+
+	// the destination holds the keys, values and leases of the source, at higher revisions
+	want, err := client.Get(ctx, "/testMigration/", clientv3.WithPrefix())
+	g.Expect(err).To(BeNil())
+	got, err := migrated.Get(ctx, "/testMigration/", clientv3.WithPrefix())
+	g.Expect(err).To(BeNil())
+	g.Expect(got.Header.Revision).To(BeNumerically(">", want.Header.Revision))
+	g.Expect(got.Kvs).To(HaveLen(len(want.Kvs)))
+	for i, kv := range got.Kvs {
+		g.Expect(string(kv.Key)).To(Equal(string(want.Kvs[i].Key)))
+		g.Expect(kv.Value).To(Equal(want.Kvs[i].Value))
+		g.Expect(kv.Lease).To(Equal(want.Kvs[i].Lease))
+	}
+	assertKey(ctx, g, migrated, "/testMigration/large", large)
+	ttl, err := migrated.TimeToLive(ctx, lease.ID, clientv3.WithAttachedKeys())
+	g.Expect(err).To(BeNil())
+	g.Expect(ttl.GrantedTTL).To(Equal(int64(60)))
+	g.Expect(ttl.Keys).To(Equal([][]byte{[]byte("/testMigration/leased")}))
+
+	// pages are served alike
+	wantPage, err := client.Get(ctx, "/testMigration/", clientv3.WithPrefix(), clientv3.WithLimit(5), clientv3.WithKeysOnly())
+	g.Expect(err).To(BeNil())
+	gotPage, err := migrated.Get(ctx, "/testMigration/", clientv3.WithPrefix(), clientv3.WithLimit(5), clientv3.WithKeysOnly())
+	g.Expect(err).To(BeNil())
+	g.Expect(gotPage.Count).To(Equal(wantPage.Count))
+	g.Expect(gotPage.More).To(Equal(wantPage.More))
+
+	// watches of the destination see its writes, at revisions above those of the source
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wch := migrated.Watch(watchCtx, "/testMigration/", clientv3.WithPrefix(), clientv3.WithRev(got.Header.Revision+1))
+	createKey(ctx, g, migrated, "/testMigration/after", "value")
+	var wresp clientv3.WatchResponse
+	g.Eventually(wch, time.Second).Should(Receive(&wresp))
+	g.Expect(wresp.Events).To(HaveLen(1))
+	g.Expect(string(wresp.Events[0].Kv.Key)).To(Equal("/testMigration/after"))
+	g.Expect(wresp.Events[0].Kv.ModRevision).To(BeNumerically(">", want.Header.Revision))
+
+	// keys are only migrated into empty databases
+	_, err = migrate.Migrate(ctx, migrate.Config{Source: source, Destination: destination})
+	g.Expect(err).NotTo(BeNil())
+}
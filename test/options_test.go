@@ -0,0 +1,141 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/tls"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestNew is unit testing for starting kine with options, which override the settings of the
+// config and of the options before them.
+func TestNew(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	dir := newTestDir(t)
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+	registry := prometheus.NewRegistry()
+	etcdConfig, err := endpoint.New(ctx,
+		endpoint.WithConfig(endpoint.Config{Listener: "http://127.0.0.1:0", CompactInterval: time.Hour}),
+		endpoint.WithListener(fmt.Sprintf("unix://%s/listen.sock", dir)),
+		endpoint.WithEndpoint(fmt.Sprintf("sqlite://%s/data.db", dir)),
+		endpoint.WithCompaction(0, 100),
+		endpoint.WithMetricsRegistry(registry),
+		endpoint.WithLogger(logger),
+	)
+	g.Expect(err).To(BeNil())
+	g.Expect(etcdConfig.Endpoints).To(Equal([]string{fmt.Sprintf("unix://%s/listen.sock", dir)}))
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   etcdConfig.Endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	g.Expect(err).To(BeNil())
+	createKey(ctx, g, client, "/testNew/key", "value")
+	assertKey(ctx, g, client, "/testNew/key", "value")
+	g.Expect(client.Close()).To(Succeed())
+
+	families, err := registry.Gather()
+	g.Expect(err).To(BeNil())
+	g.Expect(families).NotTo(BeEmpty())
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	g.Expect(etcdConfig.Shutdown(shutdownCtx)).To(Succeed())
+	g.Expect(logs.String()).To(ContainSubstring("Kine listening on unix://" + dir))
+}
+
+// TestValidate is unit testing for validating configs, which reports all of their problems at once
+// before anything is started.
+func TestValidate(t *testing.T) {
+	dir := newTestDir(t)
+	sqliteEndpoint := fmt.Sprintf("sqlite://%s/data.db", dir)
+	for _, test := range []struct {
+		name     string
+		config   endpoint.Config
+		problems []string
+	}{
+		{
+			name:   "Valid",
+			config: endpoint.Config{Listener: "unix://kine.sock,http://127.0.0.1:0", Endpoint: sqliteEndpoint},
+		},
+		{
+			name:     "UnknownBackend",
+			config:   endpoint.Config{Endpoint: "oracle://localhost/kine"},
+			problems: []string{`endpoint "oracle://localhost/kine" is of the unknown storage backend oracle`},
+		},
+		{
+			name:     "ReadEndpoints",
+			config:   endpoint.Config{Endpoint: "bolt://data.bolt", ReadEndpoints: []string{"postgres://localhost/"}},
+			problems: []string{"the bolt backend does not support read endpoints", `read endpoint "postgres://localhost/" is not of the bolt backend of the endpoint`},
+		},
+		{
+			name:     "Listeners",
+			config:   endpoint.Config{Listener: "https://127.0.0.1:0, 127.0.0.1:2379", Endpoint: sqliteEndpoint},
+			problems: []string{"listener https://127.0.0.1:0 is served with TLS, which needs the certificate and key of the server TLS config", `listener "127.0.0.1:2379" is not a unix, tcp, http or https address`},
+		},
+		{
+			name: "PrefixRetention",
+			config: endpoint.Config{
+				Endpoint: sqliteEndpoint,
+				PrefixRetention: []generic.PrefixRetention{
+					{Prefix: "/registry/events/", KeepRevisions: 1000},
+					{Prefix: "/registry/events/", KeepDuration: time.Hour},
+					{KeepRevisions: 10},
+				},
+			},
+			problems: []string{
+				"prefix /registry/events/ has more than one retention",
+				"prefix retention =10 has no prefix",
+				"prefix retention is applied by automatic compaction, which is disabled",
+			},
+		},
+		{
+			name: "All",
+			config: endpoint.Config{
+				Listener:        "https://127.0.0.1:0",
+				Endpoint:        sqliteEndpoint,
+				ServerTLSConfig: tls.Config{CertFile: "server.crt"},
+				PasswordFunc: func(context.Context) (string, error) {
+					return "", nil
+				},
+				AuditLogMaxSize: -1,
+			},
+			problems: []string{
+				"the sqlite backend does not support a password func",
+				"listener https://127.0.0.1:0 is served with TLS, which needs the certificate and key of the server TLS config",
+				"the audit log max size is negative",
+			},
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := test.config.Validate()
+			if len(test.problems) == 0 {
+				g.Expect(err).To(BeNil())
+				return
+			}
+			var validationErr *endpoint.ValidationError
+			g.Expect(errors.As(err, &validationErr)).To(BeTrue())
+			g.Expect(validationErr.Problems).To(Equal(test.problems))
+
+			// kine is not started on an invalid config
+			_, err = endpoint.New(context.Background(), endpoint.WithConfig(test.config))
+			g.Expect(err).To(Equal(error(validationErr)))
+		})
+	}
+}
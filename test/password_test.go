@@ -0,0 +1,125 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/endpoint"
+)
+
+// TestPasswordFunc is unit testing for connecting with passwords that expire, as the tokens of
+// AWS RDS IAM authentication do. The password func rotates the password of the database user on
+// every call, so that only new connections authenticated with a fresh password succeed. The tests
+// run against the servers at the endpoints in KINE_MYSQL_ENDPOINT and KINE_POSTGRES_ENDPOINT,
+// with a user that may create other users, and are skipped for the ones that are not set.
+func TestPasswordFunc(t *testing.T) {
+	for _, backend := range []struct {
+		name       string
+		env        string
+		driver     string
+		dsn        func(endpoint string) string
+		endpoint   func(endpoint, user string) string
+		createUser string
+		rotate     string
+	}{
+		{
+			name:   "MySQL",
+			env:    "KINE_MYSQL_ENDPOINT",
+			driver: "mysql",
+			dsn:    func(endpoint string) string { return strings.TrimPrefix(endpoint, "mysql://") },
+			endpoint: func(endpoint, user string) string {
+				address := strings.TrimPrefix(endpoint, "mysql://")
+				return "mysql://" + user + address[strings.Index(address, "@"):]
+			},
+			createUser: "CREATE USER '%[1]s'@'%%' IDENTIFIED BY '%[2]s'; GRANT ALL ON *.* TO '%[1]s'@'%%'",
+			rotate:     "ALTER USER '%s'@'%%' IDENTIFIED BY '%s'",
+		},
+		{
+			name:   "Postgres",
+			env:    "KINE_POSTGRES_ENDPOINT",
+			driver: "postgres",
+			dsn:    func(endpoint string) string { return endpoint },
+			endpoint: func(endpoint, user string) string {
+				u, _ := url.Parse(endpoint)
+				u.User = url.User(user)
+				return u.String()
+			},
+			createUser: "CREATE ROLE %s LOGIN CREATEDB PASSWORD '%s'",
+			rotate:     "ALTER ROLE %s PASSWORD '%s'",
+		},
+	} {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			address := os.Getenv(backend.env)
+			if address == "" {
+				t.Skipf("%s is not set", backend.env)
+			}
+			g := NewWithT(t)
+			ctx := context.Background()
+
+			admin, err := sql.Open(backend.driver, backend.dsn(address))
+			g.Expect(err).To(BeNil())
+			defer admin.Close()
+			user := newDatabaseName()
+			for _, stmt := range strings.Split(fmt.Sprintf(backend.createUser, user, "initial"), "; ") {
+				_, err := admin.ExecContext(ctx, stmt)
+				g.Expect(err).To(BeNil())
+			}
+
+			var (
+				mu    sync.Mutex
+				calls int
+			)
+			rotate := func(ctx context.Context) (string, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				calls++
+				password := fmt.Sprintf("password%d", calls)
+				if _, err := admin.ExecContext(ctx, fmt.Sprintf(backend.rotate, user, password)); err != nil {
+					return "", err
+				}
+				return password, nil
+			}
+
+			// connections are closed quickly, so that the pool keeps opening new ones
+			client, _ := newKineWithConfig(t, endpoint.Config{
+				Endpoint:             databaseEndpoint(backend.endpoint(address, user), newDatabaseName()),
+				PasswordFunc:         rotate,
+				ConnectionPoolConfig: generic.ConnectionPoolConfig{MaxLifetime: 100 * time.Millisecond},
+			})
+			createKey(ctx, g, client, "/testPasswordFunc/a", "a")
+			time.Sleep(time.Second)
+			createKey(ctx, g, client, "/testPasswordFunc/b", "b")
+			assertKey(ctx, g, client, "/testPasswordFunc/a", "a")
+
+			mu.Lock()
+			defer mu.Unlock()
+			g.Expect(calls).To(BeNumerically(">", 2))
+		})
+	}
+}
+
+// TestPasswordFuncUnsupported is unit testing for rejecting a password func for backends that do
+// not connect with passwords.
+func TestPasswordFuncUnsupported(t *testing.T) {
+	g := NewWithT(t)
+	dir := newTestDir(t)
+	_, err := endpoint.Listen(context.Background(), endpoint.Config{
+		Listener: fmt.Sprintf("unix://%s/listen.sock", dir),
+		Endpoint: fmt.Sprintf("sqlite://%s/data.db", dir),
+		PasswordFunc: func(context.Context) (string, error) {
+			return "", errors.New("not called")
+		},
+	})
+	g.Expect(err).To(MatchError(ContainSubstring("password func")))
+}
@@ -0,0 +1,58 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
+)
+
+// TestConnectionPool is unit testing for configuring the pool of connections to the database.
+func TestConnectionPool(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Default", func(t *testing.T) {
+		g := NewWithT(t)
+		_, dialect := openSQLLog(t, newTestDir(t)+"/data.db")
+		g.Expect(dialect.DB.Stats().MaxOpenConnections).To(Equal(5))
+	})
+
+	t.Run("Configured", func(t *testing.T) {
+		g := NewWithT(t)
+		registry := prometheus.NewRegistry()
+		// the log is not started, so that no statements but those of the test use the pool
+		_, dialect, err := sqlite.NewVariant(ctx, sqliteDriverName(), newTestDir(t)+"/data.db", sqlite.Config{}, generic.Config{
+			MetricsRegisterer: registry,
+			ConnectionPoolConfig: generic.ConnectionPoolConfig{
+				MaxOpen: 2,
+				MaxIdle: 1,
+			},
+		})
+		g.Expect(err).To(BeNil())
+		defer dialect.DB.Close()
+		g.Expect(dialect.DB.Stats().MaxOpenConnections).To(Equal(2))
+
+		// with both connections in use, the one released last is closed rather than kept idle
+		var rows []interface{ Close() error }
+		for i := 0; i < 2; i++ {
+			r, err := dialect.DB.QueryContext(ctx, "SELECT id FROM kine")
+			g.Expect(err).To(BeNil())
+			rows = append(rows, r)
+		}
+		g.Expect(dialect.DB.Stats().InUse).To(Equal(2))
+		for _, r := range rows {
+			g.Expect(r.Close()).To(Succeed())
+		}
+		stats := dialect.DB.Stats()
+		g.Expect(stats.Idle).To(Equal(1))
+		g.Expect(stats.MaxIdleClosed).To(BeNumerically(">=", 1))
+
+		families := gatherMetrics(g, registry)
+		g.Expect(metricValue(families["kine_sql_max_open_connections"], nil)).To(Equal(2.0))
+		g.Expect(metricValue(families["kine_sql_max_idle_connections"], nil)).To(Equal(1.0))
+		g.Expect(metricValue(families["kine_sql_connections"], map[string]string{"state": "idle"})).To(Equal(1.0))
+	})
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/server"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestPrefixStats is unit testing for the stats of key prefixes served with the metrics.
+func TestPrefixStats(t *testing.T) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	address := freeAddress(g)
+	client, _ := newKineWithConfig(t, endpoint.Config{MetricsListener: address})
+
+	createKey(ctx, g, client, "/registry/pods/default/a", "aaaa")
+	createKey(ctx, g, client, "/registry/pods/default/b", "bb")
+	resp, err := client.Get(ctx, "/registry/pods/default/a")
+	g.Expect(err).To(BeNil())
+	txn, err := client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision("/registry/pods/default/a"), "=", resp.Kvs[0].ModRevision)).
+		Then(clientv3.OpPut("/registry/pods/default/a", "aaaaaa")).
+		Commit()
+	g.Expect(err).To(BeNil())
+	g.Expect(txn.Succeeded).To(BeTrue())
+	createKey(ctx, g, client, "/registry/secrets/kube-system/s", "sss")
+	deleteKey(ctx, g, client, "/registry/secrets/kube-system/s")
+	createKey(ctx, g, client, "/registry/configmaps/c", "c")
+	createKey(ctx, g, client, "/prefixstats", "x")
+
+	httpClient := newHTTPClient()
+	get := func(g Gomega) map[string]server.PrefixStat {
+		var stats []server.PrefixStat
+		g.Eventually(func() error {
+			resp, err := httpClient.Get(fmt.Sprintf("http://%s/debug/prefixes", address))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("status %s", resp.Status)
+			}
+			return json.NewDecoder(resp.Body).Decode(&stats)
+		}, 5*time.Second, 10*time.Millisecond).Should(Succeed())
+
+		byPrefix := map[string]server.PrefixStat{}
+		for _, stat := range stats {
+			g.Expect(byPrefix).NotTo(HaveKey(stat.Prefix))
+			byPrefix[stat.Prefix] = stat
+		}
+		return byPrefix
+	}
+
+	stats := get(g)
+	g.Expect(stats).To(HaveKey("/registry/pods/"))
+	pods := stats["/registry/pods/"]
+	g.Expect(pods.Keys).To(Equal(int64(2)))
+	g.Expect(pods.Bytes).To(Equal(int64(len("aaaaaa") + len("bb"))))
+	g.Expect(pods.Rows).To(Equal(int64(3)))
+	g.Expect(pods.RowBytes).To(BeNumerically(">=", 3*len("/registry/pods/default/a")+len("aaaa")+len("bb")+len("aaaaaa")))
+
+	// the history of deleted keys is counted, but not the keys
+	g.Expect(stats).To(HaveKey("/registry/secrets/"))
+	secrets := stats["/registry/secrets/"]
+	g.Expect(secrets.Keys).To(BeZero())
+	g.Expect(secrets.Bytes).To(BeZero())
+	g.Expect(secrets.Rows).To(Equal(int64(2)))
+	g.Expect(secrets.RowBytes).To(BeNumerically(">=", 2*len("/registry/secrets/kube-system/s")))
+
+	g.Expect(stats).To(HaveKey("/registry/configmaps/"))
+	configMaps := stats["/registry/configmaps/"]
+	g.Expect(configMaps.Keys).To(Equal(int64(1)))
+	g.Expect(configMaps.Bytes).To(Equal(int64(1)))
+	g.Expect(configMaps.Rows).To(Equal(int64(1)))
+	g.Expect(configMaps.RowBytes).To(BeNumerically(">=", len("/registry/configmaps/c")+1))
+
+	// keys with fewer segments, such as the health key that kine writes, share the empty prefix
+	g.Expect(stats).To(HaveKey(""))
+	g.Expect(stats[""].Keys).To(BeNumerically(">=", 2))
+
+	// the stats are cached, so keys written since are not counted yet
+	createKey(ctx, g, client, "/registry/pods/default/c", "c")
+	g.Expect(get(g)["/registry/pods/"].Keys).To(Equal(int64(2)))
+}
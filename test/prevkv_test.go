@@ -0,0 +1,116 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/logstructured/sqllog"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestWatchPrevKV is unit testing for returning the previous values of keys only to the watches
+// that ask for them.
+func TestWatchPrevKV(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newKine(t)
+
+	withPrevKV := client.Watch(ctx, "/testWatchPrevKV/", clientv3.WithPrefix(), clientv3.WithPrevKV())
+	withoutPrevKV := client.Watch(ctx, "/testWatchPrevKV/", clientv3.WithPrefix())
+
+	createKey(ctx, g, client, "/testWatchPrevKV/a", "old")
+	resp, err := client.Get(ctx, "/testWatchPrevKV/a")
+	g.Expect(err).To(BeNil())
+	_, err = client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision("/testWatchPrevKV/a"), "=", resp.Kvs[0].ModRevision)).
+		Then(clientv3.OpPut("/testWatchPrevKV/a", "new")).
+		Commit()
+	g.Expect(err).To(BeNil())
+
+	updated := func(watchCh clientv3.WatchChan) *mvccpb.Event {
+		var events []*clientv3.Event
+		g.Eventually(func() []*clientv3.Event {
+			select {
+			case resp := <-watchCh:
+				g.Expect(resp.Err()).To(BeNil())
+				events = append(events, resp.Events...)
+			default:
+			}
+			return events
+		}, 5*time.Second).Should(HaveLen(2))
+		g.Expect(events[1].IsModify()).To(BeTrue())
+		g.Expect(events[1].Kv.Value).To(Equal([]byte("new")))
+		return (*mvccpb.Event)(events[1])
+	}
+
+	event := updated(withPrevKV)
+	g.Expect(event.PrevKv).NotTo(BeNil())
+	g.Expect(event.PrevKv.Value).To(Equal([]byte("old")))
+	g.Expect(event.PrevKv.ModRevision).To(Equal(resp.Kvs[0].ModRevision))
+
+	event = updated(withoutPrevKV)
+	g.Expect(event.PrevKv).To(BeNil())
+}
+
+// BenchmarkWatchPrevKV is a benchmark for reading the events of watches with and without the
+// previous values of keys, on a table of 1 MiB values. It reports the bytes of values read per
+// batch of events.
+func BenchmarkWatchPrevKV(b *testing.B) {
+	const (
+		keys      = 4
+		updates   = 4
+		valueSize = 1024 * 1024
+	)
+
+	g := NewWithT(b)
+	ctx := context.Background()
+	log, dialect := openSQLLog(b, newTestDir(b)+"/data.db")
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("/benchWatchPrevKV/%d", i)
+		value := []byte(strings.Repeat("v", valueSize))
+		rev, err := log.Append(ctx, &server.Event{
+			Create: true,
+			KV:     &server.KeyValue{Key: key, Value: value},
+		})
+		g.Expect(err).To(BeNil())
+		for j := 0; j < updates; j++ {
+			prev := &server.KeyValue{Key: key, ModRevision: rev, Value: value}
+			value = []byte(strings.Repeat(fmt.Sprintf("%d", j), valueSize))
+			rev, err = log.Append(ctx, &server.Event{
+				KV:     &server.KeyValue{Key: key, Value: value},
+				PrevKV: prev,
+			})
+			g.Expect(err).To(BeNil())
+		}
+	}
+
+	for _, prevKV := range []bool{false, true} {
+		prevKV := prevKV
+		b.Run(fmt.Sprintf("prevKV=%v", prevKV), func(b *testing.B) {
+			g := NewWithT(b)
+			var read int
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rows, err := dialect.After(ctx, 0, 0, prevKV)
+				g.Expect(err).To(BeNil())
+				events, err := sqllog.RowsToEvents(rows)
+				g.Expect(err).To(BeNil())
+				for _, event := range events {
+					read += len(event.KV.Value)
+					if event.PrevKV != nil {
+						read += len(event.PrevKV.Value)
+					}
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(read)/float64(b.N), "value-bytes/op")
+		})
+	}
+}
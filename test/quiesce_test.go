@@ -0,0 +1,169 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/kinetest"
+	"github.com/rancher/kine/pkg/server"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestQuiesce is unit testing for holding the writes of kine at /debug/quiesce of the metrics
+// listener, so that a copy of its database file taken meanwhile holds all acknowledged writes.
+func TestQuiesce(t *testing.T) {
+	if testDriver != kinetest.SQLite && testDriver != kinetest.Bolt {
+		t.Skipf("the %s backend keeps no local database file", testDriver)
+	}
+	ctx := context.Background()
+
+	httpClient := newHTTPClient()
+	post := func(g Gomega, address, path string) int {
+		var status int
+		g.Eventually(func() error {
+			resp, err := httpClient.Post(fmt.Sprintf("http://%s%s", address, path), "", nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			status = resp.StatusCode
+			return nil
+		}, 5*time.Second, 10*time.Millisecond).Should(Succeed())
+		return status
+	}
+	start := func(t *testing.T, config endpoint.Config) (*kinetest.Kine, string) {
+		k := kinetest.Start(t, kinetest.Options{
+			Driver:        testDriver,
+			Dir:           newTestDir(t),
+			Config:        config,
+			SkipLeakCheck: true,
+		})
+		return k, k.Endpoint[strings.Index(k.Endpoint, "://")+len("://"):]
+	}
+
+	t.Run("CopyWhileQuiesced", func(t *testing.T) {
+		g := NewWithT(t)
+		address := freeAddress(g)
+		k, file := start(t, endpoint.Config{MetricsListener: address})
+		for i := 0; i < 20; i++ {
+			createKey(ctx, g, k.Client, fmt.Sprintf("/quiesce/%02d", i), fmt.Sprintf("value-%d", i))
+		}
+
+		g.Expect(post(g, address, "/debug/quiesce")).To(Equal(http.StatusNoContent))
+		g.Expect(post(g, address, "/debug/quiesce")).To(Equal(http.StatusConflict))
+
+		// writes wait while reads are served
+		held := make(chan error, 1)
+		go func() {
+			_, err := k.Client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision("/quiesce/held"), "=", 0)).
+				Then(clientv3.OpPut("/quiesce/held", "held")).
+				Commit()
+			held <- err
+		}()
+		g.Consistently(held, 500*time.Millisecond).ShouldNot(Receive())
+		readCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		resp, err := k.Client.Get(readCtx, "/quiesce/", clientv3.WithPrefix())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(20))
+
+		// the write-ahead log of sqlite was checkpointed into the database file
+		if info, err := os.Stat(file + "-wal"); err == nil {
+			g.Expect(info.Size()).To(BeZero())
+		} else {
+			g.Expect(os.IsNotExist(err)).To(BeTrue())
+		}
+		dir := newTestDir(t)
+		copied := filepath.Join(dir, filepath.Base(file))
+		copyFile(g, file, copied)
+
+		g.Expect(post(g, address, "/debug/resume")).To(Equal(http.StatusNoContent))
+		g.Eventually(held, 5*time.Second).Should(Receive(BeNil()))
+		g.Expect(post(g, address, "/debug/resume")).To(Equal(http.StatusConflict))
+
+		restored := kinetest.Start(t, kinetest.Options{
+			Driver:        testDriver,
+			Endpoint:      fmt.Sprintf("%s://%s", testDriver, copied),
+			Dir:           dir,
+			SkipLeakCheck: true,
+		})
+		for i := 0; i < 20; i++ {
+			assertKey(ctx, g, restored.Client, fmt.Sprintf("/quiesce/%02d", i), fmt.Sprintf("value-%d", i))
+		}
+		assertMissingKey(ctx, g, restored.Client, "/quiesce/held")
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		g := NewWithT(t)
+		k, _ := start(t, endpoint.Config{QuiesceTimeout: 200 * time.Millisecond})
+		g.Expect(k.Backend.Quiesce(ctx)).To(Succeed())
+
+		// writes are resumed once the quiesce times out, without Resume
+		writeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		createKey(writeCtx, g, k.Client, "/quiesce/timeout", "timeout")
+		g.Expect(k.Backend.Resume()).To(Equal(server.ErrNotQuiesced))
+	})
+
+	t.Run("WaitForWrites", func(t *testing.T) {
+		g := NewWithT(t)
+		k, _ := start(t, endpoint.Config{})
+
+		// a write in flight holds up quiesce
+		release := make(chan struct{})
+		inFlight := make(chan struct{})
+		written := make(chan error, 1)
+		go func() {
+			written <- k.Backend.Txn(ctx, func(ctx context.Context) error {
+				close(inFlight)
+				<-release
+				return nil
+			})
+		}()
+		g.Eventually(inFlight, 5*time.Second).Should(BeClosed())
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		err := k.Backend.Quiesce(timeoutCtx)
+		g.Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue(), "%v", err)
+
+		// quiesce and resume do not wait on a quiesce that waits for the write
+		quiesced := make(chan error, 1)
+		go func() {
+			quiesced <- k.Backend.Quiesce(ctx)
+		}()
+		g.Consistently(quiesced, 100*time.Millisecond).ShouldNot(Receive())
+		timeoutCtx, cancel = context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		g.Expect(k.Backend.Quiesce(timeoutCtx)).To(Equal(server.ErrQuiesced))
+		g.Expect(k.Backend.Resume()).To(Equal(server.ErrNotQuiesced))
+
+		close(release)
+		g.Eventually(written, 5*time.Second).Should(Receive(BeNil()))
+		g.Eventually(quiesced, 5*time.Second).Should(Receive(BeNil()))
+		g.Expect(k.Backend.Resume()).To(Succeed())
+	})
+}
+
+// copyFile copies the file at src to dst.
+func copyFile(g Gomega, src, dst string) {
+	in, err := os.Open(src)
+	g.Expect(err).To(BeNil())
+	defer in.Close()
+	out, err := os.Create(dst)
+	g.Expect(err).To(BeNil())
+	_, err = io.Copy(out, in)
+	g.Expect(err).To(BeNil())
+	g.Expect(out.Close()).To(Succeed())
+}
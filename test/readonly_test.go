@@ -0,0 +1,193 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestReadOnly is unit testing for read-only mode, which rejects writes while reads, watches and
+// lease keep alives are still served.
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Config", func(t *testing.T) {
+		g := NewWithT(t)
+		client, _ := newKineWithConfig(t, endpoint.Config{ReadOnly: true})
+
+		_, err := client.Put(ctx, "/testReadOnly/config", "value")
+		g.Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+		_, err = client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision("/testReadOnly/config"), "=", 0)).
+			Then(clientv3.OpPut("/testReadOnly/config", "value")).
+			Commit()
+		g.Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+		_, err = client.Grant(ctx, 60)
+		g.Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+
+		assertMissingKey(ctx, g, client, "/testReadOnly/config")
+	})
+
+	t.Run("Toggle", func(t *testing.T) {
+		g := NewWithT(t)
+		embedded, err := endpoint.NewEmbedded(ctx, endpoint.Config{
+			Endpoint: fmt.Sprintf("sqlite://%s/data.db", newTestDir(t)),
+		})
+		g.Expect(err).To(BeNil())
+		t.Cleanup(func() {
+			embedded.Close()
+		})
+		client := embedded.Client()
+
+		createKey(ctx, g, client, "/testReadOnly/toggle/a", "a")
+		createKey(ctx, g, client, "/testReadOnly/toggle/b", "b")
+		lease, err := client.Grant(ctx, 60)
+		g.Expect(err).To(BeNil())
+		watchCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		wch := client.Watch(watchCtx, "/testReadOnly/toggle/", clientv3.WithPrefix())
+
+		embedded.SetReadOnly(true)
+		g.Expect(embedded.ReadOnly()).To(BeTrue())
+
+		// a transaction of several writes is rejected as a whole
+		_, err = client.Txn(ctx).
+			If(clientv3.Compare(clientv3.Value("/testReadOnly/toggle/a"), "=", "a")).
+			Then(
+				clientv3.OpPut("/testReadOnly/toggle/a", "updated"),
+				clientv3.OpDelete("/testReadOnly/toggle/b"),
+			).
+			Commit()
+		g.Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+		_, err = client.Delete(ctx, "/testReadOnly/toggle/b")
+		g.Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+		_, err = client.Grant(ctx, 60)
+		g.Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+		_, err = client.Revoke(ctx, lease.ID)
+		g.Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+		_, err = client.Compact(ctx, 1)
+		g.Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+
+		// reads, transactions of reads alone and keep alives are still served
+		assertKey(ctx, g, client, "/testReadOnly/toggle/a", "a")
+		assertKey(ctx, g, client, "/testReadOnly/toggle/b", "b")
+		txnResp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.Value("/testReadOnly/toggle/a"), "=", "a")).
+			Then(clientv3.OpGet("/testReadOnly/toggle/b")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(txnResp.Succeeded).To(BeTrue())
+		_, err = client.KeepAliveOnce(ctx, lease.ID)
+		g.Expect(err).To(BeNil())
+		g.Consistently(wch, testWatchEventIdleTimeout).ShouldNot(Receive())
+
+		embedded.SetReadOnly(false)
+		g.Expect(embedded.ReadOnly()).To(BeFalse())
+		txnResp, err = client.Txn(ctx).
+			If(clientv3.Compare(clientv3.Value("/testReadOnly/toggle/a"), "=", "a")).
+			Then(clientv3.OpPut("/testReadOnly/toggle/a", "updated")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(txnResp.Succeeded).To(BeTrue())
+		var wresp clientv3.WatchResponse
+		g.Eventually(wch, time.Second).Should(Receive(&wresp))
+		g.Expect(wresp.Events).To(HaveLen(1))
+		g.Expect(string(wresp.Events[0].Kv.Value)).To(Equal("updated"))
+	})
+
+	t.Run("InFlight", func(t *testing.T) {
+		g := NewWithT(t)
+		backend, _ := startBackend(t, newTestDir(t)+"/data.db")
+		blocking := &blockingBackend{
+			Backend: backend,
+			key:     "/testReadOnly/inflight/blocked",
+			entered: make(chan struct{}),
+			release: make(chan struct{}),
+		}
+		b := server.New(blocking, server.Config{})
+
+		// the write in flight holds up the switch to read-only mode, and is applied in full
+		blockedErr := make(chan error, 1)
+		go func() {
+			_, err := b.Txn(ctx, createTxn("/testReadOnly/inflight/blocked", "value"))
+			blockedErr <- err
+		}()
+		g.Eventually(blocking.entered, time.Second).Should(BeClosed())
+
+		switched := make(chan struct{})
+		go func() {
+			b.SetReadOnly(true)
+			close(switched)
+		}()
+		g.Consistently(switched, testWatchEventIdleTimeout).ShouldNot(BeClosed())
+
+		// a write that arrives while the switch waits is rejected once it is done, without
+		// reaching the backend
+		queuedErr := make(chan error, 1)
+		go func() {
+			_, err := b.Txn(ctx, createTxn("/testReadOnly/inflight/queued", "value"))
+			queuedErr <- err
+		}()
+		g.Consistently(queuedErr, testWatchEventIdleTimeout).ShouldNot(Receive())
+
+		close(blocking.release)
+		g.Eventually(blockedErr, time.Second).Should(Receive(BeNil()))
+		g.Eventually(switched, time.Second).Should(BeClosed())
+		g.Eventually(queuedErr, time.Second).Should(Receive(Equal(server.ErrReadOnly)))
+
+		_, kv, err := backend.Get(ctx, "/testReadOnly/inflight/blocked", "", 1, 0)
+		g.Expect(err).To(BeNil())
+		g.Expect(kv).NotTo(BeNil())
+		g.Expect(string(kv.Value)).To(Equal("value"))
+		_, kv, err = backend.Get(ctx, "/testReadOnly/inflight/queued", "", 1, 0)
+		g.Expect(err).To(BeNil())
+		g.Expect(kv).To(BeNil())
+	})
+}
+
+// blockingBackend blocks the create of its key until release is closed, once it has closed
+// entered.
+type blockingBackend struct {
+	server.Backend
+	key     string
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBackend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	if key == b.key {
+		close(b.entered)
+		<-b.release
+	}
+	return b.Backend.Create(ctx, key, value, lease)
+}
+
+// createTxn returns the transaction that the apiserver creates the key with.
+func createTxn(key, value string) *etcdserverpb.TxnRequest {
+	return &etcdserverpb.TxnRequest{
+		Compare: []*etcdserverpb.Compare{
+			{
+				Key:         []byte(key),
+				Target:      etcdserverpb.Compare_MOD,
+				Result:      etcdserverpb.Compare_EQUAL,
+				TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: 0},
+			},
+		},
+		Success: []*etcdserverpb.RequestOp{
+			{
+				Request: &etcdserverpb.RequestOp_RequestPut{
+					RequestPut: &etcdserverpb.PutRequest{Key: []byte(key), Value: []byte(value)},
+				},
+			},
+		},
+	}
+}
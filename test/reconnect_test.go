@@ -0,0 +1,150 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
+)
+
+const dropDriverName = "drop-sqlite"
+
+var (
+	registerDropDriver sync.Once
+	// dropDriverDown makes the drop driver refuse new connections, and
+	// dropDriverEpoch is increased to drop the connections made before.
+	dropDriverDown  int32
+	dropDriverEpoch int32
+)
+
+// dropDriver wraps the sqlite driver as a proxy to a database that can go away, dropping the
+// connections it made and refusing new ones, until it comes back.
+type dropDriver struct {
+	driver.Driver
+}
+
+type dropConn struct {
+	driver.Conn
+	epoch int32
+}
+
+type dropStmt struct {
+	driver.Stmt
+	conn dropConn
+}
+
+func (d dropDriver) Open(name string) (driver.Conn, error) {
+	if atomic.LoadInt32(&dropDriverDown) != 0 {
+		return nil, fmt.Errorf("dial: %w", syscall.ECONNREFUSED)
+	}
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return dropConn{Conn: conn, epoch: atomic.LoadInt32(&dropDriverEpoch)}, nil
+}
+
+func (c dropConn) dropped() bool {
+	return c.epoch != atomic.LoadInt32(&dropDriverEpoch)
+}
+
+func (c dropConn) Prepare(query string) (driver.Stmt, error) {
+	if c.dropped() {
+		return nil, driver.ErrBadConn
+	}
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return dropStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c dropConn) Begin() (driver.Tx, error) {
+	if c.dropped() {
+		return nil, driver.ErrBadConn
+	}
+	return c.Conn.Begin()
+}
+
+func (s dropStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.conn.dropped() {
+		return nil, driver.ErrBadConn
+	}
+	return s.Stmt.Exec(args)
+}
+
+func (s dropStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.conn.dropped() {
+		return nil, driver.ErrBadConn
+	}
+	return s.Stmt.Query(args)
+}
+
+// TestReconnect is unit testing for retrying statements and watching on once the database is
+// back from losing its connections.
+func TestReconnect(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registerDropDriver.Do(func() {
+		db, err := sql.Open(sqliteDriverName(), "")
+		g.Expect(err).To(BeNil())
+		sql.Register(dropDriverName, dropDriver{db.Driver()})
+		db.Close()
+	})
+
+	// without the update hook, watches only see writes through notifications and polls
+	backend, dialect, err := sqlite.NewVariant(ctx, dropDriverName, newTestDir(t)+"/data.db", sqlite.Config{DisableUpdateHook: true}, generic.Config{
+		PollInterval: 100 * time.Millisecond,
+	})
+	g.Expect(err).To(BeNil())
+	defer dialect.DB.Close()
+	g.Expect(backend.Start(ctx)).To(Succeed())
+
+	rev, err := backend.Create(ctx, "/testReconnect/a", []byte("a"), 0)
+	g.Expect(err).To(BeNil())
+	watchCh := backend.Watch(ctx, "/testReconnect/", rev+1)
+
+	// the database goes away for a while, taking the open connections with it
+	const downtime = 500 * time.Millisecond
+	atomic.StoreInt32(&dropDriverDown, 1)
+	atomic.AddInt32(&dropDriverEpoch, 1)
+	go func() {
+		time.Sleep(downtime)
+		atomic.StoreInt32(&dropDriverDown, 0)
+	}()
+
+	start := time.Now()
+	rev, err = backend.Create(ctx, "/testReconnect/b", []byte("b"), 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(time.Since(start)).To(BeNumerically(">=", downtime))
+
+	_, kv, err := backend.Get(ctx, "/testReconnect/b", "", 1, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(kv).NotTo(BeNil())
+	g.Expect(kv.ModRevision).To(Equal(rev))
+
+	// and the watch carries on once it is back
+	var events []string
+	g.Eventually(func() []string {
+		select {
+		case watchEvents := <-watchCh:
+			g.Expect(watchEvents.Err).To(BeNil())
+			for _, event := range watchEvents.Events {
+				events = append(events, event.KV.Key)
+			}
+		default:
+		}
+		return events
+	}, 5*time.Second).Should(ContainElement("/testReconnect/b"))
+}
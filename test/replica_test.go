@@ -0,0 +1,84 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/endpoint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestReadReplica is unit testing for reading from a read replica, simulated by a second sqlite
+// database that holds other values for the same keys, so that the values read show which database
+// answered.
+func TestReadReplica(t *testing.T) {
+	ctx := context.Background()
+	dir := newTestDir(t)
+	replica := fmt.Sprintf("%s/replica.db", dir)
+
+	// the replica lags behind the primary, with a single write
+	t.Run("Seed", func(t *testing.T) {
+		g := NewWithT(t)
+		client, _ := newKineWithConfig(t, endpoint.Config{Endpoint: "sqlite://" + replica})
+		createKey(ctx, g, client, "/testReadReplica/key", "replica")
+	})
+
+	// connections are closed quickly, so that the removal of the replica is noticed
+	client, _ := newKineWithConfig(t, endpoint.Config{
+		Endpoint:             fmt.Sprintf("sqlite://%s/primary.db", dir),
+		ReadEndpoints:        []string{"sqlite://" + replica},
+		ConnectionPoolConfig: generic.ConnectionPoolConfig{MaxLifetime: 100 * time.Millisecond},
+	})
+	g := NewWithT(t)
+	createKey(ctx, g, client, "/testReadReplica/key", "primary")
+	createKey(ctx, g, client, "/testReadReplica/other", "primary")
+	createKey(ctx, g, client, "/testReadReplica/another", "primary")
+
+	// serializable reads are answered by the replica however far it lags behind
+	resp, err := client.Get(ctx, "/testReadReplica/key", clientv3.WithSerializable())
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Kvs).To(HaveLen(1))
+	g.Expect(resp.Kvs[0].Value).To(Equal([]byte("replica")))
+
+	resp, err = client.Get(ctx, "/testReadReplica/", clientv3.WithPrefix(), clientv3.WithSerializable())
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Kvs).To(HaveLen(1))
+
+	// linearizable reads are answered by the primary, as the replica has not caught up
+	assertKey(ctx, g, client, "/testReadReplica/key", "primary")
+	resp, err = client.Get(ctx, "/testReadReplica/", clientv3.WithPrefix())
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Kvs).To(HaveLen(3))
+
+	// reads fall back to the primary once the replica is gone
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(replica + suffix); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	}
+	g.Eventually(func() string {
+		resp, err := client.Get(ctx, "/testReadReplica/key", clientv3.WithSerializable())
+		if err != nil || len(resp.Kvs) != 1 {
+			return ""
+		}
+		return string(resp.Kvs[0].Value)
+	}, 5*time.Second).Should(Equal("primary"))
+}
+
+// TestReadReplicaOtherBackend is unit testing for rejecting read endpoints of a backend other than
+// that of the endpoint.
+func TestReadReplicaOtherBackend(t *testing.T) {
+	g := NewWithT(t)
+	dir := newTestDir(t)
+	_, err := endpoint.Listen(context.Background(), endpoint.Config{
+		Listener:      fmt.Sprintf("unix://%s/listen.sock", dir),
+		Endpoint:      fmt.Sprintf("sqlite://%s/data.db", dir),
+		ReadEndpoints: []string{"postgres://localhost/"},
+	})
+	g.Expect(err).To(MatchError(ContainSubstring("read endpoint")))
+}
@@ -0,0 +1,164 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/kinetest"
+	"github.com/rancher/kine/pkg/replicate"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestReplication is unit testing for replicating the writes of a served sqlite database to
+// another kine, which resumes from its checkpoint and resyncs once the source is compacted past it.
+func TestReplication(t *testing.T) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	source := endpoint.Config{
+		Endpoint:     fmt.Sprintf("sqlite://%s/data.db", newTestDir(t)),
+		PollInterval: 50 * time.Millisecond,
+	}
+	client, _ := newKineWithConfig(t, source)
+	target := kinetest.Start(t, kinetest.Options{
+		Driver:        kinetest.SQLite,
+		Dir:           newTestDir(t),
+		TCP:           true,
+		SkipLeakCheck: true,
+	})
+
+	for i := 0; i < 25; i++ {
+		createKey(ctx, g, client, fmt.Sprintf("/testReplication/%02d", i), fmt.Sprintf("value-%d", i))
+	}
+	// the target is resynced in full at first, which deletes the keys the source does not hold
+	createKey(ctx, g, target.Client, "/testReplication/stale", "stale")
+
+	replicatingFrom := func(t *testing.T, source endpoint.Config) (stop func()) {
+		ctx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() {
+			done <- replicate.Replicate(ctx, replicate.Config{
+				Source:             source,
+				Target:             endpoint.ETCDConfig{Endpoints: target.Endpoints},
+				CheckpointInterval: 50 * time.Millisecond,
+				BatchSize:          10,
+			})
+		}()
+		return func() {
+			cancel()
+			NewWithT(t).Expect(<-done).To(Equal(context.Canceled))
+		}
+	}
+	replicating := func(t *testing.T) (stop func()) {
+		return replicatingFrom(t, source)
+	}
+	replicated := func(g Gomega) {
+		g.Eventually(func(g Gomega) {
+			want, err := client.Get(ctx, "/testReplication/", clientv3.WithPrefix())
+			g.Expect(err).To(BeNil())
+			got, err := target.Client.Get(ctx, "/testReplication/", clientv3.WithPrefix())
+			g.Expect(err).To(BeNil())
+			g.Expect(got.Kvs).To(HaveLen(len(want.Kvs)))
+			for i, kv := range got.Kvs {
+				g.Expect(string(kv.Key)).To(Equal(string(want.Kvs[i].Key)))
+				g.Expect(kv.Value).To(Equal(want.Kvs[i].Value))
+			}
+		}, 10*time.Second, 50*time.Millisecond).Should(Succeed())
+	}
+	checkpoint := func(g Gomega) int64 {
+		var revision int64
+		g.Eventually(func(g Gomega) {
+			resp, err := client.Get(ctx, replicate.DefaultCheckpointKey)
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Kvs).To(HaveLen(1))
+			_, err = fmt.Sscan(string(resp.Kvs[0].Value), &revision)
+			g.Expect(err).To(BeNil())
+		}, 5*time.Second, 50*time.Millisecond).Should(Succeed())
+		return revision
+	}
+	update := func(g Gomega, key, value string) {
+		resp, err := client.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(HaveLen(1))
+		txn, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(key, value)).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(txn.Succeeded).To(BeTrue())
+	}
+
+	t.Run("Resync", func(t *testing.T) {
+		g := NewWithT(t)
+		stop := replicating(t)
+		defer stop()
+		replicated(g)
+		g.Expect(checkpoint(g)).To(BeNumerically(">", 0))
+
+		// the checkpoint itself is not replicated
+		resp, err := target.Client.Get(ctx, replicate.DefaultCheckpointKey)
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(BeEmpty())
+	})
+
+	t.Run("Follow", func(t *testing.T) {
+		g := NewWithT(t)
+		stop := replicating(t)
+		defer stop()
+		for i := 0; i < 25; i += 5 {
+			update(g, fmt.Sprintf("/testReplication/%02d", i), "updated")
+			deleteKey(ctx, g, client, fmt.Sprintf("/testReplication/%02d", i+1))
+		}
+		createKey(ctx, g, client, "/testReplication/followed", "followed")
+		replicated(g)
+	})
+
+	t.Run("ResumeFromCheckpoint", func(t *testing.T) {
+		g := NewWithT(t)
+		before := checkpoint(g)
+
+		// writes made while the replication is stopped are replicated once it is restarted
+		createKey(ctx, g, client, "/testReplication/resumed", "resumed")
+		deleteKey(ctx, g, client, "/testReplication/followed")
+		stop := replicating(t)
+		defer stop()
+		replicated(g)
+		g.Eventually(func() int64 {
+			return checkpoint(g)
+		}, 5*time.Second, 50*time.Millisecond).Should(BeNumerically(">", before))
+	})
+
+	t.Run("ResyncAfterCompaction", func(t *testing.T) {
+		g := NewWithT(t)
+		createKey(ctx, g, client, "/testReplication/compacted", "compacted")
+		update(g, "/testReplication/02", "compacted")
+		deleteKey(ctx, g, client, "/testReplication/03")
+		resp, err := client.Get(ctx, "/testReplication/compacted")
+		g.Expect(err).To(BeNil())
+		_, err = client.Compact(ctx, resp.Header.Revision)
+		g.Expect(err).To(BeNil())
+
+		stop := replicating(t)
+		defer stop()
+		replicated(g)
+		g.Expect(checkpoint(g)).To(BeNumerically(">=", resp.Header.Revision))
+	})
+
+	t.Run("FallBehind", func(t *testing.T) {
+		g := NewWithT(t)
+		// with a buffer of a single batch, the watch of the source is dropped as soon as the
+		// replication falls behind, and is started again from the revision replicated
+		slow := source
+		slow.WatchBufferSize = 1
+		stop := replicatingFrom(t, slow)
+		defer stop()
+		for i := 0; i < 50; i++ {
+			createKey(ctx, g, client, fmt.Sprintf("/testReplication/behind/%02d", i), "behind")
+		}
+		replicated(g)
+	})
+}
@@ -0,0 +1,76 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestMaxRequestBytes is unit testing for rejecting write requests larger than the limit.
+func TestMaxRequestBytes(t *testing.T) {
+	ctx := context.Background()
+	const maxRequestBytes = 64 * 1024
+
+	t.Run("Configured", func(t *testing.T) {
+		g := NewWithT(t)
+		client, _ := newKineWithConfig(t, endpoint.Config{MaxRequestBytes: maxRequestBytes})
+
+		// the size is that of the whole request, so the largest value accepted leaves room for the
+		// rest of it
+		size := maxRequestBytes
+		for createRequestSize("/testMaxRequestBytes/a", size) > maxRequestBytes {
+			size--
+		}
+
+		createKey(ctx, g, client, "/testMaxRequestBytes/a", strings.Repeat("v", size))
+
+		_, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision("/testMaxRequestBytes/b"), "=", 0)).
+			Then(clientv3.OpPut("/testMaxRequestBytes/b", strings.Repeat("v", size+1))).
+			Commit()
+		g.Expect(err).To(Equal(rpctypes.ErrRequestTooLarge))
+
+		resp, err := client.Get(ctx, "/testMaxRequestBytes/b")
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Kvs).To(BeEmpty())
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		g := NewWithT(t)
+		client := newKine(t)
+
+		// the default is the 1.5 MiB of etcd, which values of a megabyte stay under
+		createKey(ctx, g, client, "/testMaxRequestBytes/default", strings.Repeat("v", 1024*1024))
+		_, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision("/testMaxRequestBytes/default/over"), "=", 0)).
+			Then(clientv3.OpPut("/testMaxRequestBytes/default/over", strings.Repeat("v", 1536*1024))).
+			Commit()
+		g.Expect(err).To(Equal(rpctypes.ErrRequestTooLarge))
+	})
+}
+
+// createRequestSize returns the size of the transaction createKey sends to create the key with a
+// value of the given size.
+func createRequestSize(key string, valueSize int) int {
+	txn := &etcdserverpb.TxnRequest{
+		Compare: []*etcdserverpb.Compare{{
+			Key:         []byte(key),
+			Target:      etcdserverpb.Compare_MOD,
+			Result:      etcdserverpb.Compare_EQUAL,
+			TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: 0},
+		}},
+		Success: []*etcdserverpb.RequestOp{{
+			Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{
+				Key:   []byte(key),
+				Value: make([]byte, valueSize),
+			}},
+		}},
+	}
+	return txn.Size()
+}
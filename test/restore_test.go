@@ -0,0 +1,120 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/backup"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/endpoint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestRestore is unit testing for restoring backups of sqlite into new databases, which serve the
+// ranges of the backup at revisions strictly above it, and into databases that hold keys already
+// only when forced. It restores into sqlite, and into a new database of the server at the
+// endpoint in KINE_POSTGRES_ENDPOINT if it is set.
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	config := endpoint.Config{Endpoint: fmt.Sprintf("sqlite://%s/data.db", newTestDir(t))}
+	client, _ := newKineWithConfig(t, config)
+
+	for i := 0; i < 20; i++ {
+		createKey(ctx, g, client, fmt.Sprintf("/testRestore/%02d", i), fmt.Sprintf("value-%d", i))
+	}
+	for i := 0; i < 20; i += 3 {
+		deleteKey(ctx, g, client, fmt.Sprintf("/testRestore/%02d", i))
+	}
+
+	dir := newTestDir(t)
+	path := filepath.Join(dir, "backup.snapshot")
+	g.Expect(backup.WriteFile(ctx, config, path)).To(Succeed())
+	portablePath := filepath.Join(dir, "portable.snapshot")
+	portableConfig := config
+	portableConfig.SQLite = sqlite.Config{PortableSnapshots: true}
+	g.Expect(backup.WriteFile(ctx, portableConfig, portablePath)).To(Succeed())
+
+	for _, target := range []struct {
+		name string
+		env  string
+		path string
+	}{
+		{name: "SQLite", path: path},
+		{name: "SQLitePortable", path: portablePath},
+		{name: "Postgres", env: "KINE_POSTGRES_ENDPOINT", path: portablePath},
+	} {
+		target := target
+		t.Run(target.name, func(t *testing.T) {
+			restoreConfig := endpoint.Config{Endpoint: fmt.Sprintf("sqlite://%s/data.db", newTestDir(t))}
+			if target.env != "" {
+				address := os.Getenv(target.env)
+				if address == "" {
+					t.Skipf("%s is not set", target.env)
+				}
+				restoreConfig.Endpoint = databaseEndpoint(address, newDatabaseName())
+			}
+			testRestore(t, client, restoreConfig, target.path)
+		})
+	}
+}
+
+func testRestore(t *testing.T, source *clientv3.Client, config endpoint.Config, path string) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	header := readSnapshotHeader(g, path)
+	snapshot, err := os.ReadFile(path)
+	g.Expect(err).To(BeNil())
+	restore := func(snapshot []byte, force bool) error {
+		return endpoint.Restore(ctx, config, bytes.NewReader(snapshot), force)
+	}
+	// serve starts kine on the restored database, until the returned func is called
+	serve := func() (*clientv3.Client, func()) {
+		embedded, err := endpoint.NewEmbedded(ctx, config)
+		g.Expect(err).To(BeNil())
+		return embedded.Client(), func() {
+			g.Expect(embedded.Close()).To(Succeed())
+		}
+	}
+
+	g.Expect(restore(snapshot, false)).To(Succeed())
+	client, stop := serve()
+	assertSameRanges(ctx, g, source, client, "/testRestore/", header.Revision)
+
+	// the current revision is above those of the snapshot, and so are the revisions of writes
+	resp, err := client.Get(ctx, "/testRestore/", clientv3.WithPrefix())
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Header.Revision).To(BeNumerically(">", header.Revision))
+	createKey(ctx, g, client, "/testRestore/after", "value")
+	resp, err = client.Get(ctx, "/testRestore/after")
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Kvs).To(HaveLen(1))
+	g.Expect(resp.Kvs[0].ModRevision).To(BeNumerically(">", header.Revision+1))
+	served := resp.Header.Revision
+	stop()
+
+	// a database that holds keys is only restored into when forced, and not at all from a corrupt
+	// snapshot
+	g.Expect(restore(snapshot, false)).NotTo(Succeed())
+	corrupt := append([]byte{}, snapshot...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	g.Expect(restore(corrupt, true)).NotTo(Succeed())
+	client, stop = serve()
+	assertKey(ctx, g, client, "/testRestore/after", "value")
+	stop()
+
+	// a forced restore replaces the keys, and raises the current revision above those served before
+	g.Expect(restore(snapshot, true)).To(Succeed())
+	client, stop = serve()
+	defer stop()
+	assertSameRanges(ctx, g, source, client, "/testRestore/", header.Revision)
+	assertMissingKey(ctx, g, client, "/testRestore/after")
+	resp, err = client.Get(ctx, "/testRestore/", clientv3.WithPrefix())
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Header.Revision).To(BeNumerically(">", served))
+}
@@ -0,0 +1,206 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/server"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestRevisionCache is unit testing for answering serializable reads with the latest revision
+// kine knows of, and linearizable ones with the latest revision of the database.
+func TestRevisionCache(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	registry := prometheus.NewRegistry()
+	client, dsn := newKineWithConfig(t, endpoint.Config{MetricsRegistry: registry})
+
+	createKey(ctx, g, client, "/testRevisionCache/a", "a")
+	resp, err := client.Get(ctx, "/testRevisionCache/a")
+	g.Expect(err).To(BeNil())
+	rev := resp.Header.Revision
+	waitForStatements(g, registry)
+
+	// serializable reads skip the query for the revision that linearizable ones make
+	before := sqlStatements(g, registry)
+	resp, err = client.Get(ctx, "/testRevisionCache/a", clientv3.WithSerializable())
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Header.Revision).To(Equal(rev))
+	g.Expect(resp.Kvs).To(HaveLen(1))
+	serializable := sqlStatements(g, registry) - before
+
+	before = sqlStatements(g, registry)
+	_, err = client.Get(ctx, "/testRevisionCache/a")
+	g.Expect(err).To(BeNil())
+	linearizable := sqlStatements(g, registry) - before
+	g.Expect(serializable).To(BeNumerically("<", linearizable))
+
+	// writes made elsewhere are seen by linearizable reads right away, and by serializable ones
+	// once kine has seen their revision
+	log, _ := openSQLLog(t, dsn)
+	written, err := log.Append(ctx, &server.Event{
+		Create: true,
+		KV:     &server.KeyValue{Key: "/testRevisionCache/b", Value: []byte("b")},
+	})
+	g.Expect(err).To(BeNil())
+
+	resp, err = client.Get(ctx, "/testRevisionCache/a", clientv3.WithSerializable())
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Header.Revision).To(BeNumerically(">=", rev))
+	g.Expect(resp.Header.Revision).To(BeNumerically("<=", written))
+
+	resp, err = client.Get(ctx, "/testRevisionCache/b")
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Header.Revision).To(Equal(written))
+	g.Expect(resp.Kvs).To(HaveLen(1))
+
+	resp, err = client.Get(ctx, "/testRevisionCache/a", clientv3.WithSerializable())
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Header.Revision).To(Equal(written))
+}
+
+// TestReadConsistency is unit testing for linearizable reads confirming the latest revision of the
+// database, and serializable ones skipping it, with two kine instances over one sqlite file that
+// only see the writes of each other through the database.
+func TestReadConsistency(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	client, dsn := newKineWithConfig(t, endpoint.Config{})
+	registry := prometheus.NewRegistry()
+	other, _ := newKineWithConfig(t, endpoint.Config{Endpoint: "sqlite://" + dsn, MetricsRegistry: registry})
+
+	createKey(ctx, g, client, "/testReadConsistency/a", "a")
+	resp, err := other.Get(ctx, "/testReadConsistency/a")
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Kvs).To(HaveLen(1))
+	rev := resp.Header.Revision
+
+	createKey(ctx, g, client, "/testReadConsistency/b", "b")
+	resp, err = client.Get(ctx, "/testReadConsistency/b")
+	g.Expect(err).To(BeNil())
+	written := resp.Header.Revision
+
+	// serializable reads may be answered at the revision the instance has seen, but never at one
+	// before the keys they return
+	serializable, err := other.Get(ctx, "/testReadConsistency/a", clientv3.WithSerializable())
+	g.Expect(err).To(BeNil())
+	g.Expect(serializable.Header.Revision).To(BeNumerically(">=", rev))
+	g.Expect(serializable.Header.Revision).To(BeNumerically("<=", written))
+
+	serializable, err = other.Get(ctx, "/testReadConsistency/", clientv3.WithPrefix(), clientv3.WithSerializable())
+	g.Expect(err).To(BeNil())
+	g.Expect(serializable.Kvs).To(HaveLen(2))
+	g.Expect(serializable.Header.Revision).To(Equal(written))
+
+	// linearizable reads see the writes of the other instance right away
+	createKey(ctx, g, client, "/testReadConsistency/c", "c")
+	resp, err = client.Get(ctx, "/testReadConsistency/c")
+	g.Expect(err).To(BeNil())
+	written = resp.Header.Revision
+	linearizable, err := other.Get(ctx, "/testReadConsistency/a")
+	g.Expect(err).To(BeNil())
+	g.Expect(linearizable.Header.Revision).To(Equal(written))
+
+	families := gatherMetrics(g, registry)
+	g.Expect(metricValue(families["kine_sql_reads_total"], map[string]string{"consistency": "serializable"})).To(BeNumerically(">=", 2))
+	g.Expect(metricValue(families["kine_sql_reads_total"], map[string]string{"consistency": "linearizable"})).To(BeNumerically(">=", 2))
+}
+
+// TestRevisionMark is unit testing for handing out revisions above all served ones after a
+// restart, once compaction removed their rows and the id sequence fell back to the highest id
+// left, as the auto increment counter of MySQL before 8.0 does.
+func TestRevisionMark(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	dsn := fmt.Sprintf("%s/data.db", newTestDir(t))
+
+	backend, stop := startBackend(t, dsn)
+	var served int64
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("/testRevisionMark/%d", i)
+		rev, err := backend.Create(ctx, key, []byte("value"), 0)
+		g.Expect(err).To(BeNil())
+		rev, _, deleted, err := backend.Delete(ctx, key, rev)
+		g.Expect(err).To(BeNil())
+		g.Expect(deleted).To(BeTrue())
+		served = rev
+	}
+	_, err := backend.Compact(ctx, served)
+	g.Expect(err).To(BeNil())
+	stop()
+
+	db, err := sql.Open(sqliteDriverName(), dsn)
+	g.Expect(err).To(BeNil())
+	defer db.Close()
+	var maxID int64
+	g.Expect(db.QueryRow("SELECT MAX(id) FROM kine").Scan(&maxID)).To(Succeed())
+	g.Expect(maxID).To(BeNumerically("<", served))
+	_, err = db.Exec("UPDATE sqlite_sequence SET seq = ? WHERE name = 'kine'", maxID)
+	g.Expect(err).To(BeNil())
+
+	backend, _ = startBackend(t, dsn)
+	rev, err := backend.Create(ctx, "/testRevisionMark/after", []byte("value"), 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(rev).To(BeNumerically(">", served))
+
+	current, err := backend.CurrentRevision(ctx)
+	g.Expect(err).To(BeNil())
+	g.Expect(current).To(BeNumerically(">", served))
+}
+
+// BenchmarkRange is a benchmark for linearizable and serializable gets. It reports the number of
+// SQL statements run per get.
+func BenchmarkRange(b *testing.B) {
+	for _, serializable := range []bool{false, true} {
+		serializable := serializable
+		b.Run(fmt.Sprintf("serializable=%v", serializable), func(b *testing.B) {
+			g := NewWithT(b)
+			ctx := context.Background()
+			registry := prometheus.NewRegistry()
+			client, _ := newKineWithConfig(b, endpoint.Config{MetricsRegistry: registry})
+			createKey(ctx, g, client, "/benchRange/key", "value")
+			waitForStatements(g, registry)
+
+			var opts []clientv3.OpOption
+			if serializable {
+				opts = append(opts, clientv3.WithSerializable())
+			}
+			before := sqlStatements(g, registry)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := client.Get(ctx, "/benchRange/key", opts...)
+				g.Expect(err).To(BeNil())
+			}
+			b.StopTimer()
+			b.ReportMetric((sqlStatements(g, registry)-before)/float64(b.N), "queries/op")
+		})
+	}
+}
+
+// sqlStatements returns the number of SQL statements run, from the metrics in the registry.
+func sqlStatements(g Gomega, registry *prometheus.Registry) float64 {
+	var count uint64
+	for _, metric := range gatherMetrics(g, registry)["kine_sql_duration_seconds"].GetMetric() {
+		count += metric.GetHistogram().GetSampleCount()
+	}
+	return float64(count)
+}
+
+// waitForStatements waits until the statements that kine runs in the background after writes,
+// such as polling for their events, are done.
+func waitForStatements(g Gomega, registry *prometheus.Registry) {
+	last := -1.0
+	g.Eventually(func() bool {
+		count := sqlStatements(g, registry)
+		done := count == last
+		last = count
+		return done
+	}, 5*time.Second, 100*time.Millisecond).Should(BeTrue())
+}
@@ -0,0 +1,37 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/endpoint"
+)
+
+// TestSetupPermanentError is unit testing for giving up on creating the tables right away when
+// the database has a kine table that the schema cannot be created on, rather than retrying until
+// the setup timeout.
+func TestSetupPermanentError(t *testing.T) {
+	g := NewWithT(t)
+	dir := newTestDir(t)
+	dsn := fmt.Sprintf("%s/data.db", dir)
+
+	db, err := sql.Open(sqliteDriverName(), dsn)
+	g.Expect(err).To(BeNil())
+	_, err = db.Exec(`CREATE TABLE kine (id INTEGER PRIMARY KEY AUTOINCREMENT)`)
+	g.Expect(err).To(BeNil())
+	g.Expect(db.Close()).To(Succeed())
+
+	start := time.Now()
+	_, err = endpoint.Listen(context.Background(), endpoint.Config{
+		Listener: fmt.Sprintf("unix://%s/listen.sock", dir),
+		Endpoint: "sqlite://" + dsn,
+		SQLite:   sqlite.Config{SetupTimeout: time.Minute},
+	})
+	g.Expect(err).To(MatchError(ContainSubstring("setup db")))
+	g.Expect(time.Since(start)).To(BeNumerically("<", 10*time.Second))
+}
@@ -0,0 +1,201 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/logging"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+const (
+	slowDriverName  = "slow-sqlite"
+	slowDriverDelay = 50 * time.Millisecond
+)
+
+var (
+	registerSlowDriver sync.Once
+	// slowDriverEnabled makes the statements of the slow driver sleep before they run.
+	slowDriverEnabled int32
+)
+
+// slowDriver wraps the sqlite driver with statements that are slow while slowDriverEnabled is set.
+type slowDriver struct {
+	driver.Driver
+}
+
+type slowConn struct {
+	driver.Conn
+}
+
+type slowStmt struct {
+	driver.Stmt
+}
+
+func (d slowDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return slowConn{conn}, nil
+}
+
+func (c slowConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return slowStmt{stmt}, nil
+}
+
+func (s slowStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if atomic.LoadInt32(&slowDriverEnabled) != 0 {
+		time.Sleep(slowDriverDelay)
+	}
+	return s.Stmt.Exec(args)
+}
+
+func (s slowStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if atomic.LoadInt32(&slowDriverEnabled) != 0 {
+		time.Sleep(slowDriverDelay)
+	}
+	return s.Stmt.Query(args)
+}
+
+// TestSlowQuery is unit testing for logging slow SQL statements.
+func TestSlowQuery(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registerSlowSQLite(g)
+	backend, dialect, err := sqlite.NewVariant(ctx, slowDriverName, newTestDir(t)+"/data.db", sqlite.Config{}, generic.Config{
+		SlowQueryThreshold: slowDriverDelay / 2,
+	})
+	g.Expect(err).To(BeNil())
+	defer dialect.DB.Close()
+	g.Expect(backend.Start(ctx)).To(Succeed())
+
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	hook := logtest.NewGlobal()
+	defer func() {
+		logrus.SetLevel(level)
+		logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	}()
+
+	t.Run("Fast", func(t *testing.T) {
+		g := NewWithT(t)
+		hook.Reset()
+		_, err := backend.Create(ctx, "/testSlowQuery/fast", []byte("fast-value"), 0)
+		g.Expect(err).To(BeNil())
+		g.Expect(slowEntries(hook)).To(BeEmpty())
+	})
+
+	t.Run("Slow", func(t *testing.T) {
+		g := NewWithT(t)
+		hook.Reset()
+		atomic.StoreInt32(&slowDriverEnabled, 1)
+		defer atomic.StoreInt32(&slowDriverEnabled, 0)
+
+		_, err := backend.Create(ctx, "/testSlowQuery/slow", []byte("secret-value"), 0)
+		g.Expect(err).To(BeNil())
+
+		entries := slowEntries(hook)
+		g.Expect(entries).NotTo(BeEmpty())
+		var insert *logrus.Entry
+		for i, entry := range entries {
+			g.Expect(entry.Level).To(Equal(logrus.WarnLevel))
+			g.Expect(entry.Message).NotTo(ContainSubstring("secret-value"))
+			g.Expect(fmt.Sprint(entry.Data)).NotTo(ContainSubstring("secret-value"))
+			if entry.Data["statement"] == "InsertLastInsertIDSQL" {
+				insert = &entries[i]
+			}
+		}
+		g.Expect(insert).NotTo(BeNil())
+		g.Expect(insert.Message).To(ContainSubstring("InsertLastInsertIDSQL"))
+		g.Expect(fmt.Sprint(insert.Data["args"])).To(ContainSubstring("/testSlowQuery/slow"))
+		g.Expect(fmt.Sprint(insert.Data["args"])).To(ContainSubstring("<12 bytes>"))
+		g.Expect(insert.Data).To(HaveKeyWithValue("key", "/testSlowQuery/"))
+		g.Expect(insert.Data).To(HaveKeyWithValue("rows", int64(1)))
+	})
+}
+
+// TestSlowQueryJSON is unit testing for the fields of slow SQL statements in the logs of a logger
+// with the JSON formatter, which are keys of each entry of their own.
+func TestSlowQueryJSON(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out := &syncBuffer{}
+	logger := logrus.New()
+	logger.SetOutput(out)
+	logger.SetLevel(logrus.WarnLevel)
+	g.Expect(logging.SetFormat(logger, logging.FormatJSON)).To(Succeed())
+
+	registerSlowSQLite(g)
+	backend, dialect, err := sqlite.NewVariant(ctx, slowDriverName, newTestDir(t)+"/data.db", sqlite.Config{}, generic.Config{
+		SlowQueryThreshold: slowDriverDelay / 2,
+		Logger:             logger,
+	})
+	g.Expect(err).To(BeNil())
+	defer dialect.DB.Close()
+	g.Expect(backend.Start(ctx)).To(Succeed())
+
+	atomic.StoreInt32(&slowDriverEnabled, 1)
+	_, err = backend.Create(ctx, "/testSlowQueryJSON/slow", []byte("secret-value"), 0)
+	atomic.StoreInt32(&slowDriverEnabled, 0)
+	g.Expect(err).To(BeNil())
+
+	g.Expect(out.String()).NotTo(ContainSubstring("secret-value"))
+	var insert map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		g.Expect(json.Unmarshal([]byte(line), &entry)).To(Succeed(), line)
+		if entry["statement"] == "InsertLastInsertIDSQL" {
+			insert = entry
+		}
+	}
+	g.Expect(insert).NotTo(BeNil())
+	g.Expect(insert).To(HaveKeyWithValue("level", "warning"))
+	g.Expect(insert["msg"]).To(HavePrefix("Slow SQL statement InsertLastInsertIDSQL"))
+	g.Expect(insert).To(HaveKeyWithValue("key", "/testSlowQueryJSON/"))
+	g.Expect(insert).To(HaveKeyWithValue("rows", float64(1)))
+	g.Expect(insert["duration"]).To(BeNumerically(">=", (slowDriverDelay / 2).Seconds()))
+	g.Expect(insert["args"]).To(ContainElement("/testSlowQueryJSON/slow"))
+	g.Expect(insert["args"]).To(ContainElement("<12 bytes>"))
+}
+
+// registerSlowSQLite registers the slow driver, once.
+func registerSlowSQLite(g Gomega) {
+	registerSlowDriver.Do(func() {
+		db, err := sql.Open(sqliteDriverName(), "")
+		g.Expect(err).To(BeNil())
+		sql.Register(slowDriverName, slowDriver{db.Driver()})
+		db.Close()
+	})
+}
+
+// slowEntries returns the entries of the hook that report slow statements.
+func slowEntries(hook *logtest.Hook) []logrus.Entry {
+	var entries []logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, "Slow SQL statement") {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,168 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/server"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	sleepDriverName  = "sleep-sqlite"
+	sleepDriverDelay = 200 * time.Millisecond
+)
+
+var (
+	registerSleepDriver sync.Once
+	// sleepDriverEnabled makes the statements of the sleep driver sleep before they run, until
+	// they are done or their context is.
+	sleepDriverEnabled int32
+)
+
+// sleepDriver wraps the sqlite driver with statements that sleep while sleepDriverEnabled is
+// set, giving up when their context is done.
+type sleepDriver struct {
+	driver.Driver
+}
+
+type sleepConn struct {
+	driver.Conn
+}
+
+type sleepStmt struct {
+	driver.Stmt
+}
+
+func (d sleepDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return sleepConn{conn}, nil
+}
+
+func (c sleepConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return sleepStmt{stmt}, nil
+}
+
+func (s sleepStmt) sleep(ctx context.Context) error {
+	if atomic.LoadInt32(&sleepDriverEnabled) == 0 {
+		return nil
+	}
+	timer := time.NewTimer(sleepDriverDelay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (s sleepStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := s.sleep(ctx); err != nil {
+		return nil, err
+	}
+	return s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+}
+
+func (s sleepStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := s.sleep(ctx); err != nil {
+		return nil, err
+	}
+	return s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+}
+
+// TestStatementTimeouts is unit testing for timing out the statements of each kind of operation
+// after its own timeout.
+func TestStatementTimeouts(t *testing.T) {
+	ctx := context.Background()
+
+	registerSleepDriver.Do(func() {
+		db, err := sql.Open(sqliteDriverName(), "")
+		NewWithT(t).Expect(err).To(BeNil())
+		sql.Register(sleepDriverName, sleepDriver{db.Driver()})
+		db.Close()
+	})
+
+	const (
+		short = 50 * time.Millisecond
+		long  = 5 * time.Second
+	)
+	ops := map[string]func(d *generic.Generic) error{
+		"Read": func(d *generic.Generic) error {
+			_, err := d.CurrentRevision(ctx)
+			return err
+		},
+		"List": func(d *generic.Generic) error {
+			rows, err := d.After(ctx, 0, 0, true)
+			if err != nil {
+				return err
+			}
+			return rows.Close()
+		},
+		"Write": func(d *generic.Generic) error {
+			_, err := d.Insert(ctx, "/testStatementTimeouts/"+time.Now().Format(time.RFC3339Nano), true, false, 0, 0, 0, []byte("a"), nil)
+			return err
+		},
+		"Compact": func(d *generic.Generic) error {
+			_, err := d.Compact(ctx, 0, 1)
+			return err
+		},
+	}
+
+	for _, kind := range []string{"Read", "List", "Write", "Compact"} {
+		kind := kind
+		t.Run(kind, func(t *testing.T) {
+			g := NewWithT(t)
+			timeouts := generic.StatementTimeouts{Read: long, List: long, Write: long, Compact: long}
+			switch kind {
+			case "Read":
+				timeouts.Read = short
+			case "List":
+				timeouts.List = short
+			case "Write":
+				timeouts.Write = short
+			case "Compact":
+				timeouts.Compact = short
+			}
+			_, dialect, err := sqlite.NewVariant(ctx, sleepDriverName, newTestDir(t)+"/data.db", sqlite.Config{}, generic.Config{
+				StatementTimeouts: timeouts,
+			})
+			g.Expect(err).To(BeNil())
+			defer dialect.DB.Close()
+
+			atomic.StoreInt32(&sleepDriverEnabled, 1)
+			defer atomic.StoreInt32(&sleepDriverEnabled, 0)
+
+			// only the operations of the kind are timed out, with an error that clients see
+			// as their deadline being exceeded
+			for name, op := range ops {
+				start := time.Now()
+				err := op(dialect)
+				if name != kind {
+					g.Expect(err).To(BeNil(), name)
+					g.Expect(time.Since(start)).To(BeNumerically(">=", sleepDriverDelay), name)
+					continue
+				}
+				g.Expect(err).To(Equal(server.ErrStatementTimeout), name)
+				g.Expect(status.Code(err)).To(Equal(codes.DeadlineExceeded), name)
+				g.Expect(time.Since(start)).To(BeNumerically("<", sleepDriverDelay), name)
+			}
+		})
+	}
+}
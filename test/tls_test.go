@@ -0,0 +1,227 @@
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	kinetls "github.com/rancher/kine/pkg/tls"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestCertificateReload is unit testing for serving rotated certificates without restarting.
+func TestCertificateReload(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := newTestDir(t)
+	ca, caKey := newTestCA(g)
+	writeTestCert(g, dir+"/ca.crt", ca, nil)
+	certFile, keyFile := dir+"/server.crt", dir+"/server.key"
+	writeTestServerCert(g, certFile, keyFile, ca, caKey, 1)
+
+	etcdConfig, err := endpoint.Listen(ctx, endpoint.Config{
+		Listener: "https://127.0.0.1:0",
+		Endpoint: fmt.Sprintf("sqlite://%s/data.db", dir),
+		ServerTLSConfig: kinetls.Config{
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		},
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(etcdConfig.Endpoints).To(HaveLen(1))
+	address := strings.TrimPrefix(etcdConfig.Endpoints[0], "https://")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientTLS := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   etcdConfig.Endpoints,
+		DialTimeout: 5 * time.Second,
+		TLS:         clientTLS,
+	})
+	g.Expect(err).To(BeNil())
+	defer client.Close()
+	_, err = client.Get(ctx, "/testCertificateReload")
+	g.Expect(err).To(BeNil())
+	g.Expect(serverSerial(g, address, clientTLS)).To(Equal(int64(1)))
+
+	t.Run("Rotated", func(t *testing.T) {
+		g := NewWithT(t)
+		writeTestServerCert(g, certFile, keyFile, ca, caKey, 2)
+
+		// new connections are served the new certificate
+		g.Expect(serverSerial(g, address, clientTLS)).To(Equal(int64(2)))
+
+		// and the connection made before keeps working
+		_, err := client.Get(ctx, "/testCertificateReload")
+		g.Expect(err).To(BeNil())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Expect(os.WriteFile(certFile, []byte("not a certificate"), 0600)).To(Succeed())
+		future := time.Now().Add(time.Minute)
+		g.Expect(os.Chtimes(certFile, future, future)).To(Succeed())
+
+		// the previous certificate is kept
+		g.Expect(serverSerial(g, address, clientTLS)).To(Equal(int64(2)))
+	})
+}
+
+// TestClientCertificate is unit testing for requiring clients to present certificates signed by the client CA.
+func TestClientCertificate(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := newTestDir(t)
+	ca, caKey := newTestCA(g)
+	writeTestCert(g, dir+"/ca.crt", ca, nil)
+	certFile, keyFile := dir+"/server.crt", dir+"/server.key"
+	writeTestServerCert(g, certFile, keyFile, ca, caKey, 1)
+
+	etcdConfig, err := endpoint.Listen(ctx, endpoint.Config{
+		Listener: "https://127.0.0.1:0",
+		Endpoint: fmt.Sprintf("sqlite://%s/data.db", dir),
+		ServerTLSConfig: kinetls.Config{
+			CAFile:            dir + "/ca.crt",
+			CertFile:          certFile,
+			KeyFile:           keyFile,
+			ClientCAFile:      dir + "/ca.crt",
+			RequireClientCert: true,
+		},
+	})
+	g.Expect(err).To(BeNil())
+	address := strings.TrimPrefix(etcdConfig.Endpoints[0], "https://")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	t.Run("Accept", func(t *testing.T) {
+		g := NewWithT(t)
+		tlsConfig, err := etcdConfig.TLSConfig.ClientConfig()
+		g.Expect(err).To(BeNil())
+		client, err := clientv3.New(clientv3.Config{
+			Endpoints:   etcdConfig.Endpoints,
+			DialTimeout: 5 * time.Second,
+			TLS:         tlsConfig,
+		})
+		g.Expect(err).To(BeNil())
+		defer client.Close()
+		_, err = client.Get(ctx, "/testClientCertificate")
+		g.Expect(err).To(BeNil())
+	})
+
+	t.Run("NoCertificate", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Expect(handshake(address, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})).NotTo(Succeed())
+	})
+
+	t.Run("UntrustedCertificate", func(t *testing.T) {
+		g := NewWithT(t)
+		otherCA, otherKey := newTestCA(g)
+		writeTestServerCert(g, dir+"/other.crt", dir+"/other.key", otherCA, otherKey, 3)
+		cert, err := tls.LoadX509KeyPair(dir+"/other.crt", dir+"/other.key")
+		g.Expect(err).To(BeNil())
+		g.Expect(handshake(address, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1", Certificates: []tls.Certificate{cert}})).NotTo(Succeed())
+	})
+}
+
+// handshake makes a new connection and returns the error the server rejected it with, if any. With TLS 1.3
+// the client finishes its handshake before the server verifies its certificate, so the rejection is read.
+func handshake(address string, config *tls.Config) error {
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil
+	}
+	return err
+}
+
+// serverSerial makes a new connection and returns the serial number of the certificate the server presents.
+func serverSerial(g Gomega, address string, config *tls.Config) int64 {
+	conn, err := tls.Dial("tcp", address, config)
+	g.Expect(err).To(BeNil())
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func newTestCA(g Gomega) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).To(BeNil())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1000),
+		Subject:               pkix.Name{CommonName: "kine-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	g.Expect(err).To(BeNil())
+	cert, err := x509.ParseCertificate(der)
+	g.Expect(err).To(BeNil())
+	return cert, key
+}
+
+// writeTestServerCert writes a certificate for 127.0.0.1 with the serial number, signed by the CA, and its key.
+// The modification times are moved forward so that the files are seen to change even on a coarse clock.
+func writeTestServerCert(g Gomega, certFile, keyFile string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).To(BeNil())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "kine"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	g.Expect(err).To(BeNil())
+	cert, err := x509.ParseCertificate(der)
+	g.Expect(err).To(BeNil())
+	writeTestCert(g, certFile, cert, nil)
+	writeTestCert(g, keyFile, nil, key)
+
+	modTime := time.Now().Add(time.Duration(serial) * time.Second)
+	g.Expect(os.Chtimes(certFile, modTime, modTime)).To(Succeed())
+	g.Expect(os.Chtimes(keyFile, modTime, modTime)).To(Succeed())
+}
+
+// writeTestCert writes either the certificate or the key to the file as PEM.
+func writeTestCert(g Gomega, file string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	block := &pem.Block{}
+	if cert != nil {
+		block.Type, block.Bytes = "CERTIFICATE", cert.Raw
+	} else {
+		der, err := x509.MarshalECPrivateKey(key)
+		g.Expect(err).To(BeNil())
+		block.Type, block.Bytes = "EC PRIVATE KEY", der
+	}
+	g.Expect(os.WriteFile(file, pem.EncodeToMemory(block), 0600)).To(Succeed())
+}
@@ -0,0 +1,69 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/oteltest"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/grpc"
+)
+
+// TestTracing is unit testing for the spans of rpcs, ranges and SQL statements.
+func TestTracing(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	recorder := new(oteltest.StandardSpanRecorder)
+	provider := oteltest.NewTracerProvider(oteltest.WithSpanRecorder(recorder))
+	kine, _ := newKineWithConfig(t, endpoint.Config{TracerProvider: provider})
+	createKey(ctx, g, kine, "/testTracing/a", "a")
+
+	// the client sends its trace context along with its requests
+	opts := []otelgrpc.Option{
+		otelgrpc.WithTracerProvider(provider),
+		otelgrpc.WithPropagators(propagation.TraceContext{}),
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   kine.Endpoints(),
+		DialTimeout: 5 * time.Second,
+		DialOptions: []grpc.DialOption{
+			grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor(opts...)),
+		},
+	})
+	g.Expect(err).To(BeNil())
+	defer client.Close()
+
+	parentCtx, parent := provider.Tracer("test").Start(ctx, "parent")
+	_, err = client.Get(parentCtx, "/testTracing/", clientv3.WithPrefix())
+	g.Expect(err).To(BeNil())
+	parent.End()
+
+	traceID := parent.SpanContext().TraceID()
+	find := func(name string) *oteltest.Span {
+		for _, span := range recorder.Completed() {
+			if span.SpanContext().TraceID() == traceID && strings.HasPrefix(span.Name(), name) {
+				return span
+			}
+		}
+		return nil
+	}
+
+	rangeSpan := find("Range")
+	g.Expect(rangeSpan).NotTo(BeNil())
+	g.Expect(rangeSpan.Attributes()).To(HaveKeyWithValue(attribute.Key("kine.key"), attribute.StringValue("/testTracing/")))
+	g.Expect(rangeSpan.Attributes()).To(HaveKeyWithValue(attribute.Key("kine.response.kvs"), attribute.IntValue(1)))
+
+	// the range was served by the rpc the client traced, and ran SQL
+	g.Expect(find("etcdserverpb.KV/Range")).NotTo(BeNil())
+	sqlSpan := find("SQL ")
+	g.Expect(sqlSpan).NotTo(BeNil())
+	g.Expect(sqlSpan.Attributes()).To(HaveKey(attribute.Key("kine.sql.statement")))
+}
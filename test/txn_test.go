@@ -0,0 +1,398 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestTxn is unit testing for transactions with multiple operations.
+func TestTxn(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+
+	var revAfterPut int64
+
+	t.Run("MultiplePuts", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			Then(
+				clientv3.OpPut("/txn/a", "valueA"),
+				clientv3.OpPut("/txn/b", "valueB"),
+				clientv3.OpGet("/txn/a"),
+			).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		g.Expect(resp.Responses).To(HaveLen(3))
+
+		putA := resp.Responses[0].GetResponsePut()
+		putB := resp.Responses[1].GetResponsePut()
+		g.Expect(putA).NotTo(BeNil())
+		g.Expect(putB).NotTo(BeNil())
+		g.Expect(putB.Header.Revision).To(Equal(putA.Header.Revision + 1))
+		g.Expect(resp.Header.Revision).To(Equal(putB.Header.Revision))
+
+		get := resp.Responses[2].GetResponseRange()
+		g.Expect(get).NotTo(BeNil())
+		g.Expect(get.Kvs).To(HaveLen(1))
+		g.Expect(get.Kvs[0].Value).To(Equal([]byte("valueA")))
+		g.Expect(get.Kvs[0].ModRevision).To(Equal(putA.Header.Revision))
+
+		revAfterPut = resp.Header.Revision
+	})
+
+	t.Run("CompareThenPutAndDelete", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision("/txn/b"), "=", revAfterPut)).
+			Then(
+				clientv3.OpPut("/txn/a", "updatedA"),
+				clientv3.OpDelete("/txn/b"),
+			).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		g.Expect(resp.Responses).To(HaveLen(2))
+		g.Expect(resp.Responses[1].GetResponseDeleteRange().Deleted).To(Equal(int64(1)))
+
+		getResp, err := client.Get(ctx, "/txn/a")
+		g.Expect(err).To(BeNil())
+		g.Expect(getResp.Kvs).To(HaveLen(1))
+		g.Expect(getResp.Kvs[0].Value).To(Equal([]byte("updatedA")))
+
+		getResp, err = client.Get(ctx, "/txn/b")
+		g.Expect(err).To(BeNil())
+		g.Expect(getResp.Kvs).To(BeEmpty())
+	})
+
+	t.Run("CompareFails", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision("/txn/a"), "<", revAfterPut)).
+			Then(clientv3.OpPut("/txn/c", "valueC")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeFalse())
+
+		getResp, err := client.Get(ctx, "/txn/c")
+		g.Expect(err).To(BeNil())
+		g.Expect(getResp.Kvs).To(BeEmpty())
+	})
+
+	t.Run("DuplicateKeyFails", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.Txn(ctx).
+			Then(
+				clientv3.OpPut("/txn/d", "value1"),
+				clientv3.OpPut("/txn/d", "value2"),
+			).
+			Commit()
+		g.Expect(err).To(Equal(rpctypes.ErrDuplicateKey))
+
+		getResp, err := client.Get(ctx, "/txn/d")
+		g.Expect(err).To(BeNil())
+		g.Expect(getResp.Kvs).To(BeEmpty())
+	})
+
+	t.Run("UnsupportedFails", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := client.Txn(ctx).
+			Then(
+				clientv3.OpPut("/txn/e", "value"),
+				clientv3.OpTxn(nil, []clientv3.Op{clientv3.OpPut("/txn/f", "value")}, nil),
+			).
+			Commit()
+		g.Expect(status.Code(err)).To(Equal(codes.Unimplemented))
+		g.Expect(err.Error()).To(ContainSubstring("nested transaction"))
+	})
+}
+
+// TestTxnCompare is unit testing for the compare targets of transactions.
+func TestTxnCompare(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+
+	var (
+		present = "/cmp/present"
+		absent  = "/cmp/absent"
+	)
+
+	// create a key with a lease and update it once
+	g := NewWithT(t)
+	lease, err := client.Grant(ctx, 60)
+	g.Expect(err).To(BeNil())
+
+	resp, err := client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(present), "=", 0)).
+		Then(clientv3.OpPut(present, "value1", clientv3.WithLease(lease.ID))).
+		Commit()
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Succeeded).To(BeTrue())
+	createRev := resp.Header.Revision
+
+	resp, err = client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(present), "=", createRev)).
+		Then(clientv3.OpPut(present, "value2", clientv3.WithLease(lease.ID))).
+		Else(clientv3.OpGet(present)).
+		Commit()
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.Succeeded).To(BeTrue())
+	modRev := resp.Header.Revision
+
+	tests := []struct {
+		name      string
+		cmp       clientv3.Cmp
+		succeeded bool
+	}{
+		{"ValueEqual", clientv3.Compare(clientv3.Value(present), "=", "value2"), true},
+		{"ValueEqualFails", clientv3.Compare(clientv3.Value(present), "=", "value1"), false},
+		{"ValueNotEqual", clientv3.Compare(clientv3.Value(present), "!=", "value1"), true},
+		{"ValueGreater", clientv3.Compare(clientv3.Value(present), ">", "value1"), true},
+		{"ValueLess", clientv3.Compare(clientv3.Value(present), "<", "value3"), true},
+		{"ValueAbsentFails", clientv3.Compare(clientv3.Value(absent), "=", ""), false},
+		{"ValueAbsentNotEqualFails", clientv3.Compare(clientv3.Value(absent), "!=", "value"), false},
+
+		{"VersionEqual", clientv3.Compare(clientv3.Version(present), "=", 2), true},
+		{"VersionGreater", clientv3.Compare(clientv3.Version(present), ">", 1), true},
+		{"VersionLessFails", clientv3.Compare(clientv3.Version(present), "<", 2), false},
+		{"VersionAbsent", clientv3.Compare(clientv3.Version(absent), "=", 0), true},
+		{"VersionAbsentGreaterFails", clientv3.Compare(clientv3.Version(absent), ">", 0), false},
+
+		{"CreateEqual", clientv3.Compare(clientv3.CreateRevision(present), "=", createRev), true},
+		{"CreateLess", clientv3.Compare(clientv3.CreateRevision(present), "<", modRev), true},
+		{"CreateNotEqualFails", clientv3.Compare(clientv3.CreateRevision(present), "!=", createRev), false},
+		{"CreateAbsent", clientv3.Compare(clientv3.CreateRevision(absent), "=", 0), true},
+
+		{"ModEqual", clientv3.Compare(clientv3.ModRevision(present), "=", modRev), true},
+		{"ModGreater", clientv3.Compare(clientv3.ModRevision(present), ">", createRev), true},
+		{"ModEqualFails", clientv3.Compare(clientv3.ModRevision(present), "=", createRev), false},
+		{"ModAbsent", clientv3.Compare(clientv3.ModRevision(absent), "=", 0), true},
+		{"ModAbsentLessFails", clientv3.Compare(clientv3.ModRevision(absent), "<", 0), false},
+
+		{"LeaseEqual", clientv3.Compare(clientv3.LeaseValue(present), "=", lease.ID), true},
+		{"LeaseNotEqualFails", clientv3.Compare(clientv3.LeaseValue(present), "!=", lease.ID), false},
+		{"LeaseAbsent", clientv3.Compare(clientv3.LeaseValue(absent), "=", clientv3.NoLease), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			resp, err := client.Txn(ctx).
+				If(tt.cmp).
+				Then(clientv3.OpGet(present)).
+				Commit()
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Succeeded).To(Equal(tt.succeeded))
+		})
+	}
+}
+
+// TestTxnElse is unit testing for the operations executed when the compares of a transaction fail.
+func TestTxnElse(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+
+	var (
+		key = "/else/testKey"
+		rev int64
+	)
+
+	t.Run("PutIfAbsent", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "value1")).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		g.Expect(resp.Responses).To(HaveLen(1))
+		g.Expect(resp.Responses[0].GetResponsePut()).NotTo(BeNil())
+		rev = resp.Header.Revision
+	})
+
+	t.Run("PutIfAbsentReturnsExisting", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "value2")).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeFalse())
+		g.Expect(resp.Header.Revision).To(BeNumerically(">=", rev))
+		g.Expect(resp.Responses).To(HaveLen(1))
+
+		get := resp.Responses[0].GetResponseRange()
+		g.Expect(get).NotTo(BeNil())
+		g.Expect(get.Kvs).To(HaveLen(1))
+		g.Expect(get.Kvs[0].Value).To(Equal([]byte("value1")))
+		g.Expect(get.Kvs[0].ModRevision).To(Equal(rev))
+	})
+
+	t.Run("ElseWrites", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.Value(key), "=", "other")).
+			Then(clientv3.OpGet(key)).
+			Else(
+				clientv3.OpPut("/else/otherKey", "value"),
+				clientv3.OpDelete(key),
+			).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeFalse())
+		g.Expect(resp.Responses).To(HaveLen(2))
+		g.Expect(resp.Responses[0].GetResponsePut()).NotTo(BeNil())
+		g.Expect(resp.Responses[1].GetResponseDeleteRange().Deleted).To(Equal(int64(1)))
+		g.Expect(resp.Header.Revision).To(Equal(resp.Responses[1].GetResponseDeleteRange().Header.Revision))
+
+		getResp, err := client.Get(ctx, key)
+		g.Expect(err).To(BeNil())
+		g.Expect(getResp.Kvs).To(BeEmpty())
+	})
+
+	// the apiserver's optimistic update: compare the mod revision it last saw, and read the
+	// current value when that fails
+	t.Run("OptimisticUpdateConflict", func(t *testing.T) {
+		g := NewWithT(t)
+		updateKey := "/else/updateKey"
+
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(updateKey), "=", 0)).
+			Then(clientv3.OpPut(updateKey, "value1")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		staleRev := resp.Header.Revision
+
+		resp, err = client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(updateKey), "=", staleRev)).
+			Then(clientv3.OpPut(updateKey, "value2")).
+			Else(clientv3.OpGet(updateKey)).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		currentRev := resp.Header.Revision
+
+		resp, err = client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(updateKey), "=", staleRev)).
+			Then(clientv3.OpPut(updateKey, "value3")).
+			Else(clientv3.OpGet(updateKey)).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeFalse())
+		g.Expect(resp.Header.Revision).To(BeNumerically(">=", currentRev))
+		g.Expect(resp.Responses).To(HaveLen(1))
+
+		get := resp.Responses[0].GetResponseRange()
+		g.Expect(get).NotTo(BeNil())
+		g.Expect(get.Kvs).To(HaveLen(1))
+		g.Expect(get.Kvs[0].Value).To(Equal([]byte("value2")))
+		g.Expect(get.Kvs[0].ModRevision).To(Equal(currentRev))
+	})
+}
+
+// TestTxnPrevKV is unit testing for returning the previous values of keys written by a transaction.
+func TestTxnPrevKV(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+
+	var rev int64
+
+	t.Run("PutAbsentOmitsPrevKV", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			Then(
+				clientv3.OpPut("/prev/a", "valueA", clientv3.WithPrevKV()),
+				clientv3.OpPut("/prev/b", "valueB", clientv3.WithPrevKV()),
+			).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Responses).To(HaveLen(2))
+		g.Expect(resp.Responses[0].GetResponsePut().PrevKv).To(BeNil())
+		g.Expect(resp.Responses[1].GetResponsePut().PrevKv).To(BeNil())
+		rev = resp.Header.Revision
+	})
+
+	t.Run("PutReturnsPrevKV", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			Then(clientv3.OpPut("/prev/b", "updatedB", clientv3.WithPrevKV())).
+			Commit()
+		g.Expect(err).To(BeNil())
+
+		prevKV := resp.Responses[0].GetResponsePut().PrevKv
+		g.Expect(prevKV).NotTo(BeNil())
+		g.Expect(prevKV.Key).To(Equal([]byte("/prev/b")))
+		g.Expect(prevKV.Value).To(Equal([]byte("valueB")))
+		g.Expect(prevKV.ModRevision).To(Equal(rev))
+	})
+
+	t.Run("OptimisticUpdateReturnsPrevKV", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision("/prev/b"), "=", rev+1)).
+			Then(clientv3.OpPut("/prev/b", "valueB3", clientv3.WithPrevKV())).
+			Else(clientv3.OpGet("/prev/b")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+
+		prevKV := resp.Responses[0].GetResponsePut().PrevKv
+		g.Expect(prevKV).NotTo(BeNil())
+		g.Expect(prevKV.Value).To(Equal([]byte("updatedB")))
+		g.Expect(prevKV.ModRevision).To(Equal(rev + 1))
+	})
+
+	t.Run("DeleteRangeReturnsPrevKVsInKeyOrder", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			Then(clientv3.OpDelete("/prev/", clientv3.WithPrefix(), clientv3.WithPrevKV())).
+			Commit()
+		g.Expect(err).To(BeNil())
+
+		del := resp.Responses[0].GetResponseDeleteRange()
+		g.Expect(del.Deleted).To(Equal(int64(2)))
+		g.Expect(del.PrevKvs).To(HaveLen(2))
+		g.Expect(del.PrevKvs[0].Key).To(Equal([]byte("/prev/a")))
+		g.Expect(del.PrevKvs[0].Value).To(Equal([]byte("valueA")))
+		g.Expect(del.PrevKvs[1].Key).To(Equal([]byte("/prev/b")))
+		g.Expect(del.PrevKvs[1].Value).To(Equal([]byte("valueB3")))
+	})
+
+	t.Run("DeleteAbsentOmitsPrevKVs", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Txn(ctx).
+			Then(clientv3.OpDelete("/prev/a", clientv3.WithPrevKV())).
+			Commit()
+		g.Expect(err).To(BeNil())
+
+		del := resp.Responses[0].GetResponseDeleteRange()
+		g.Expect(del.Deleted).To(Equal(int64(0)))
+		g.Expect(del.PrevKvs).To(BeEmpty())
+	})
+
+	t.Run("PlainPutReturnsPrevKV", func(t *testing.T) {
+		g := NewWithT(t)
+		resp, err := client.Put(ctx, "/prev/plain", "value1", clientv3.WithPrevKV())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.PrevKv).To(BeNil())
+		created := resp.Header.Revision
+
+		resp, err = client.Put(ctx, "/prev/plain", "value2", clientv3.WithPrevKV())
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Header.Revision).To(BeNumerically(">", created))
+		g.Expect(resp.PrevKv).NotTo(BeNil())
+		g.Expect(resp.PrevKv.Value).To(Equal([]byte("value1")))
+		g.Expect(resp.PrevKv.ModRevision).To(Equal(created))
+
+		assertKey(ctx, g, client, "/prev/plain", "value2")
+	})
+}
@@ -2,14 +2,23 @@ package test
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
+	"net/http"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
 	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/kinetest"
+	"github.com/rancher/kine/pkg/logstructured/sqllog"
+	"github.com/rancher/kine/pkg/server"
 	"github.com/sirupsen/logrus"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/goleak"
 )
 
 var (
@@ -19,45 +28,149 @@ var (
 	// testWatchEventIdleTimeout is the amount of time to wait to ensure that no events
 	// are received when they should not.
 	testWatchEventIdleTimeout = 100 * time.Millisecond
+
+	// testDriver is the driver that newKineWithConfig starts kine on when the config sets no
+	// endpoint, which kinetest defaults to the driver in KINE_TEST_DRIVER or to sqlite.
+	// TestDrivers points it at each driver in turn to run the tests shared by all of them.
+	testDriver = ""
+
+	// testEmbedded starts kine in-process with endpoint.NewEmbedded in newKineWithConfig, rather
+	// than serving it on a listener. TestEmbedded sets it to run the tests shared by all backends
+	// against the in-process path.
+	testEmbedded = false
 )
 
+// TestMain verifies that the goroutines the tests start, in kine and in its clients, are all
+// stopped once the tests are done.
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, goleak.IgnoreCurrent())
+}
+
 // newKine spins up a new instance of kine. it also registers cleanup functions for temporary data
 //
-// newKine is currently hardcoded to using sqlite and a unix socket listener, but might be extended in the future
+// newKine uses a unix socket listener, unless testEmbedded is set, and a new database of
+// testDriver, which is sqlite unless a test points it at another driver
 //
-// newKine will panic in case of error
+// newKine will fail the test in case of error
 //
 // newKine will return a context as well as a configured etcd client for the kine instance
 func newKine(tb testing.TB) *clientv3.Client {
+	client, _ := newKineWithConfig(tb, endpoint.Config{})
+	return client
+}
+
+// newKineWithConfig is like newKine, but starts kine with the given config through kinetest.
+// The listener is filled in with a unix socket in a temporary directory, and the endpoint, unless
+// it is set, with a new database of testDriver. The sqlite data source name in the directory is
+// returned alongside the client so that tests can inspect the database directly. The goroutines
+// are checked by TestMain once all tests are done, rather than after each of them.
+func newKineWithConfig(tb testing.TB, config endpoint.Config) (*clientv3.Client, string) {
 	logrus.SetLevel(logrus.ErrorLevel)
 
-	dir, err := os.MkdirTemp("testdata", "dir-*")
+	dir := newTestDir(tb)
+	k := kinetest.Start(tb, kinetest.Options{
+		Driver:        testDriver,
+		Dir:           dir,
+		Embedded:      testEmbedded,
+		Config:        config,
+		SkipLeakCheck: true,
+	})
+	return k.Client, fmt.Sprintf("%s/data.db", dir)
+}
+
+// openSQLLog opens a second handle on the sqlite database behind a running kine instance,
+// for tests that need to drive the log directly or count rows. The handle does not hook into
+// its connections, so kine only finds writes made through it by polling.
+//
+// openSQLLog will panic in case of error
+func openSQLLog(tb testing.TB, dsn string) (*sqllog.SQLLog, *generic.Generic) {
+	return openSQLLogWithConfig(tb, dsn, sqlite.Config{DisableUpdateHook: true}, generic.Config{})
+}
+
+// openSQLLogWithConfig is like openSQLLog, but opens the log with the given config.
+func openSQLLogWithConfig(tb testing.TB, dsn string, config sqlite.Config, genericConfig generic.Config) (*sqllog.SQLLog, *generic.Generic) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tb.Cleanup(cancel)
+
+	_, dialect, err := sqlite.NewVariant(ctx, sqliteDriverName(), dsn, config, genericConfig)
 	if err != nil {
 		panic(err)
 	}
 	tb.Cleanup(func() {
-		os.RemoveAll(dir)
-	})
-	listener := fmt.Sprintf("unix://%s/listen.sock", dir)
-	ep := fmt.Sprintf("sqlite://%s/data.db", dir)
-	config, err := endpoint.Listen(context.Background(), endpoint.Config{
-		Listener: listener,
-		Endpoint: ep,
+		dialect.DB.Close()
 	})
-	if err != nil {
+
+	log := sqllog.New(dialect)
+	if err := log.Start(ctx); err != nil {
 		panic(err)
 	}
-	tlsConfig, err := config.TLSConfig.ClientConfig()
+	return log, dialect
+}
+
+// newTestDir creates a new temporary directory for test data, and registers its removal.
+//
+// newTestDir will panic in case of error
+func newTestDir(tb testing.TB) string {
+	dir, err := os.MkdirTemp("testdata", "dir-*")
 	if err != nil {
 		panic(err)
 	}
-	client, err := clientv3.New(clientv3.Config{
-		Endpoints:   []string{listener},
-		DialTimeout: 5 * time.Second,
-		TLS:         tlsConfig,
+	tb.Cleanup(func() {
+		os.RemoveAll(dir)
 	})
+	return dir
+}
+
+// newHTTPClient returns a client for the endpoints that kine serves over http. Its connections
+// are not kept alive, so that none is left open after the test.
+func newHTTPClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+}
+
+// startBackend starts a sqlite backend on the given data source name without a server in
+// front of it. The returned function stops the backend and closes the database, so that
+// tests can start another backend on the same database to simulate a restart.
+//
+// startBackend will panic in case of error
+func startBackend(tb testing.TB, dsn string) (server.Backend, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	backend, dialect, err := sqlite.NewVariant(ctx, sqliteDriverName(), dsn, sqlite.Config{}, generic.Config{})
 	if err != nil {
 		panic(err)
 	}
-	return client
+	if err := backend.Start(ctx); err != nil {
+		panic(err)
+	}
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			dialect.DB.Close()
+		})
+	}
+	tb.Cleanup(stop)
+	return backend, stop
+}
+
+// countRows returns the number of rows in the kine table.
+//
+// countRows will panic in case of error
+func countRows(db *sql.DB) int64 {
+	var count int64
+	if err := db.QueryRow("SELECT COUNT(*) FROM kine").Scan(&count); err != nil {
+		panic(err)
+	}
+	return count
+}
+
+// sqliteDriverName returns the name of the database/sql driver used by the sqlite backend,
+// which depends on whether kine was built with cgo.
+func sqliteDriverName() string {
+	for _, name := range sql.Drivers() {
+		if name == "sqlite3" || name == "sqlite" {
+			return name
+		}
+	}
+	panic("no sqlite driver registered")
 }
@@ -0,0 +1,167 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// TestVerify is unit testing for verifying a sqlite database in which rows were lost or corrupted,
+// which kine refuses to start on when asked to verify it first, and for repairing its orphaned
+// tombstone.
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	dsn := newTestDir(t) + "/data.db"
+	config := endpoint.Config{Endpoint: "sqlite://" + dsn}
+	orphaned, want := newInconsistentFixture(t, dsn)
+
+	inconsistencies, err := endpoint.Verify(ctx, config, false)
+	g.Expect(err).To(BeNil())
+	g.Expect(inconsistencies).To(ConsistOf(append(want, orphaned)))
+
+	verified := config
+	verified.VerifyOnStart = true
+	_, err = endpoint.NewEmbedded(ctx, verified)
+	g.Expect(err).NotTo(BeNil())
+
+	// only the orphaned tombstone is repaired, and the key it deleted stays missing
+	orphaned.Repaired = true
+	inconsistencies, err = endpoint.Verify(ctx, config, true)
+	g.Expect(err).To(BeNil())
+	g.Expect(inconsistencies).To(ConsistOf(append(want, orphaned)))
+	inconsistencies, err = endpoint.Verify(ctx, config, false)
+	g.Expect(err).To(BeNil())
+	g.Expect(inconsistencies).To(ConsistOf(want))
+
+	client, _ := newKineWithConfig(t, config)
+	assertMissingKey(ctx, g, client, "/testVerify/orphaned")
+	assertKey(ctx, g, client, "/testVerify/valid", "v2")
+}
+
+// TestVerifyCompactRevision is unit testing for verifying databases whose compact revision is above
+// their current revision.
+func TestVerifyCompactRevision(t *testing.T) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	dsn := newTestDir(t) + "/data.db"
+	backend, stop := startBackend(t, dsn)
+	_, err := backend.Create(ctx, "/testVerifyCompactRevision/a", []byte("a"), 0)
+	g.Expect(err).To(BeNil())
+	current, err := backend.CurrentRevision(ctx)
+	g.Expect(err).To(BeNil())
+	stop()
+
+	config := endpoint.Config{Endpoint: "sqlite://" + dsn}
+	inconsistencies, err := endpoint.Verify(ctx, config, false)
+	g.Expect(err).To(BeNil())
+	g.Expect(inconsistencies).To(BeEmpty())
+
+	db, err := sql.Open(sqliteDriverName(), dsn)
+	g.Expect(err).To(BeNil())
+	defer db.Close()
+	_, err = db.Exec("UPDATE kine SET prev_revision = ? WHERE name = 'compact_rev_key'", current+100)
+	g.Expect(err).To(BeNil())
+
+	inconsistencies, err = endpoint.Verify(ctx, config, true)
+	g.Expect(err).To(BeNil())
+	g.Expect(inconsistencies).To(Equal([]server.Inconsistency{{
+		Kind:         server.InconsistencyCompactRevision,
+		Revision:     current + 100,
+		PrevRevision: current,
+	}}))
+}
+
+// TestVerifyBolt is unit testing for verifying bolt databases, whose rows kine keeps consistent.
+func TestVerifyBolt(t *testing.T) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	path := newTestDir(t) + "/data.bolt"
+	backend, _, stop := startBoltBackend(t, path)
+	rev, err := backend.Create(ctx, "/testVerifyBolt/a", []byte("a"), 0)
+	g.Expect(err).To(BeNil())
+	rev, _, _, err = backend.Update(ctx, "/testVerifyBolt/a", []byte("b"), rev, 0)
+	g.Expect(err).To(BeNil())
+	_, _, _, err = backend.Delete(ctx, "/testVerifyBolt/a", rev)
+	g.Expect(err).To(BeNil())
+	_, err = backend.Create(ctx, "/testVerifyBolt/a", []byte("c"), 0)
+	g.Expect(err).To(BeNil())
+	stop()
+
+	inconsistencies, err := endpoint.Verify(ctx, endpoint.Config{Endpoint: "bolt://" + path}, true)
+	g.Expect(err).To(BeNil())
+	g.Expect(inconsistencies).To(BeEmpty())
+}
+
+// newInconsistentFixture writes keys to a new sqlite database through kine, and then corrupts their
+// rows as lost writes could. It returns the orphaned tombstone it leaves, and the other
+// inconsistencies, one of each kind that is checked row by row.
+func newInconsistentFixture(t *testing.T, dsn string) (server.Inconsistency, []server.Inconsistency) {
+	ctx := context.Background()
+	g := NewWithT(t)
+	backend, stop := startBackend(t, dsn)
+	create := func(key string) int64 {
+		rev, err := backend.Create(ctx, key, []byte("v1"), 0)
+		g.Expect(err).To(BeNil())
+		return rev
+	}
+	update := func(key, value string, revision int64) int64 {
+		rev, _, ok, err := backend.Update(ctx, key, []byte(value), revision, 0)
+		g.Expect(err).To(BeNil())
+		g.Expect(ok).To(BeTrue())
+		return rev
+	}
+	remove := func(key string, revision int64) int64 {
+		rev, _, ok, err := backend.Delete(ctx, key, revision)
+		g.Expect(err).To(BeNil())
+		g.Expect(ok).To(BeTrue())
+		return rev
+	}
+
+	valid := update("/testVerify/valid", "v2", create("/testVerify/valid"))
+	other := update("/testVerify/other", "v2", create("/testVerify/other"))
+	orphanedCreate := create("/testVerify/orphaned")
+	orphanedDelete := remove("/testVerify/orphaned", orphanedCreate)
+	lost := update("/testVerify/lost", "v2", create("/testVerify/lost"))
+	afterLost := update("/testVerify/lost", "v3", lost)
+	flagged := create("/testVerify/flagged")
+	deleted := create("/testVerify/deleted")
+	deletedDelete := remove("/testVerify/deleted", deleted)
+	existing := create("/testVerify/existing")
+	stop()
+
+	db, err := sql.Open(sqliteDriverName(), dsn)
+	g.Expect(err).To(BeNil())
+	defer db.Close()
+	exec := func(stmt string, args ...interface{}) sql.Result {
+		result, err := db.Exec(stmt, args...)
+		g.Expect(err).To(BeNil())
+		return result
+	}
+	insert := func(stmt string, args ...interface{}) int64 {
+		id, err := exec(stmt, args...).LastInsertId()
+		g.Expect(err).To(BeNil())
+		return id
+	}
+	var flaggedPrev int64
+	g.Expect(db.QueryRow("SELECT prev_revision FROM kine WHERE id = ?", flagged).Scan(&flaggedPrev)).To(Succeed())
+
+	exec("UPDATE kine SET prev_revision = ? WHERE id = ?", valid, other)
+	exec("DELETE FROM kine WHERE id IN (?, ?)", orphanedCreate, lost)
+	exec("UPDATE kine SET deleted = 1 WHERE id = ?", flagged)
+	afterDelete := insert("INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value) VALUES ('/testVerify/deleted', 0, 0, ?, ?, 0, 'v2', 'v1')", deleted, deletedDelete)
+	createOverKey := insert("INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value) VALUES ('/testVerify/existing', 1, 0, 0, ?, 0, 'v2', NULL)", existing)
+
+	orphaned := server.Inconsistency{Kind: server.InconsistencyOrphanedTombstone, Key: "/testVerify/orphaned", Revision: orphanedDelete, PrevRevision: orphanedCreate}
+	return orphaned, []server.Inconsistency{
+		{Kind: server.InconsistencyOtherKey, Key: "/testVerify/other", Revision: other, PrevRevision: valid},
+		{Kind: server.InconsistencyMissingPrev, Key: "/testVerify/lost", Revision: afterLost, PrevRevision: lost},
+		{Kind: server.InconsistencyCreatedAndDeleted, Key: "/testVerify/flagged", Revision: flagged, PrevRevision: flaggedPrev},
+		{Kind: server.InconsistencyAfterDelete, Key: "/testVerify/deleted", Revision: afterDelete, PrevRevision: deletedDelete},
+		{Kind: server.InconsistencyCreateOverKey, Key: "/testVerify/existing", Revision: createOverKey, PrevRevision: existing},
+	}
+}
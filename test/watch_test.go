@@ -2,12 +2,26 @@ package test
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/onsi/gomega"
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
 )
 
+// testWatchProgressNotifyInterval is the progress notification interval of kine in watch
+// progress tests.
+var testWatchProgressNotifyInterval = 50 * time.Millisecond
+
 // TestWatch is unit testing for the Watch operation.
 func TestWatch(t *testing.T) {
 	ctx := context.Background()
@@ -198,3 +212,801 @@ func TestWatch(t *testing.T) {
 		})
 	})
 }
+
+// TestWatchProgressNotify is unit testing for progress notifications on the Watch operation.
+func TestWatchProgressNotify(t *testing.T) {
+	ctx := context.Background()
+
+	// put writes a key outside of the watched prefix and returns the revision it was written at
+	put := func(g Gomega, client *clientv3.Client, key string) int64 {
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "value")).
+			Commit()
+
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		return resp.Header.Revision
+	}
+
+	// receiveProgress waits for a progress notification at the given revision
+	receiveProgress := func(g Gomega, watchCh clientv3.WatchChan, revision int64, timeout time.Duration) {
+		g.Eventually(watchCh, timeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+			return v.IsProgressNotify() && v.Header.Revision == revision
+		})))
+	}
+
+	t.Run("Interval", func(t *testing.T) {
+		g := NewWithT(t)
+		client, _ := newKineWithConfig(t, endpoint.Config{
+			NotifyInterval: testWatchProgressNotifyInterval,
+		})
+
+		revision := put(g, client, "/other/first")
+		watchCh := client.Watch(ctx, "/idle/", clientv3.WithPrefix(), clientv3.WithProgressNotify())
+
+		// progress is reported on the idle prefix, with the revision advancing as other keys are
+		// written
+		receiveProgress(g, watchCh, revision, 10*testWatchProgressNotifyInterval)
+
+		nextRevision := put(g, client, "/other/second")
+		g.Expect(nextRevision).To(BeNumerically(">", revision))
+		receiveProgress(g, watchCh, nextRevision, 10*testWatchProgressNotifyInterval)
+	})
+
+	t.Run("NotRequested", func(t *testing.T) {
+		g := NewWithT(t)
+		client, _ := newKineWithConfig(t, endpoint.Config{
+			NotifyInterval: testWatchProgressNotifyInterval,
+		})
+
+		put(g, client, "/other/first")
+		watchCh := client.Watch(ctx, "/idle/", clientv3.WithPrefix())
+		g.Consistently(watchCh, 4*testWatchProgressNotifyInterval).ShouldNot(Receive())
+	})
+
+	t.Run("ProgressRequest", func(t *testing.T) {
+		g := NewWithT(t)
+		client, _ := newKineWithConfig(t, endpoint.Config{
+			NotifyInterval: time.Hour,
+		})
+
+		revision := put(g, client, "/other/first")
+		watchCh := client.Watch(ctx, "/idle/", clientv3.WithPrefix())
+
+		// wait for the watch to be created before asking for progress
+		g.Eventually(func() int64 {
+			g.Expect(client.RequestProgress(ctx)).To(Succeed())
+			select {
+			case v := <-watchCh:
+				if v.IsProgressNotify() {
+					return v.Header.Revision
+				}
+			case <-time.After(testWatchEventPollTimeout):
+			}
+			return 0
+		}, time.Second).Should(Equal(revision))
+	})
+}
+
+// TestWatchFilters is unit testing for event type filters on the Watch operation.
+func TestWatchFilters(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+
+	// write creates, updates and deletes key, and returns the revisions of the three writes
+	write := func(g Gomega, key string) (int64, int64, int64) {
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "value")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		revAfterCreate := resp.Header.Revision
+
+		resp, err = client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", revAfterCreate)).
+			Then(clientv3.OpPut(key, "updatedValue")).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		revAfterUpdate := resp.Header.Revision
+
+		resp, err = client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", revAfterUpdate)).
+			Then(clientv3.OpDelete(key)).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		return revAfterCreate, revAfterUpdate, resp.Header.Revision
+	}
+
+	t.Run("FilterPut", func(t *testing.T) {
+		g := NewWithT(t)
+		key := "/filterPut/key"
+		watchCh := client.Watch(ctx, key, clientv3.WithFilterPut())
+
+		_, _, revAfterDelete := write(g, key)
+
+		// the puts are dropped without sending empty responses
+		g.Eventually(watchCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+			g.Expect(v.Events).To(HaveLen(1))
+			g.Expect(v.Events[0].Type).To(Equal(clientv3.EventTypeDelete))
+			g.Expect(v.Events[0].Kv.ModRevision).To(Equal(revAfterDelete))
+			return true
+		})))
+		g.Consistently(watchCh, testWatchEventIdleTimeout).ShouldNot(Receive())
+	})
+
+	t.Run("FilterDelete", func(t *testing.T) {
+		g := NewWithT(t)
+		key := "/filterDelete/key"
+		watchCh := client.Watch(ctx, key, clientv3.WithFilterDelete())
+
+		revAfterCreate, revAfterUpdate, _ := write(g, key)
+
+		var revisions []int64
+		g.Eventually(func() []int64 {
+			select {
+			case v := <-watchCh:
+				for _, event := range v.Events {
+					g.Expect(event.Type).To(Equal(clientv3.EventTypePut))
+					revisions = append(revisions, event.Kv.ModRevision)
+				}
+			default:
+			}
+			return revisions
+		}, testWatchEventPollTimeout).Should(Equal([]int64{revAfterCreate, revAfterUpdate}))
+		g.Consistently(watchCh, testWatchEventIdleTimeout).ShouldNot(Receive())
+	})
+
+	t.Run("FilterPutWithPrevKV", func(t *testing.T) {
+		g := NewWithT(t)
+		key := "/filterPutWithPrevKV/key"
+		watchCh := client.Watch(ctx, key, clientv3.WithFilterPut(), clientv3.WithPrevKV())
+
+		_, revAfterUpdate, revAfterDelete := write(g, key)
+
+		g.Eventually(watchCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+			g.Expect(v.Events).To(HaveLen(1))
+			g.Expect(v.Events[0].Type).To(Equal(clientv3.EventTypeDelete))
+			g.Expect(v.Events[0].Kv.ModRevision).To(Equal(revAfterDelete))
+			g.Expect(v.Events[0].PrevKv).NotTo(BeNil())
+			g.Expect(v.Events[0].PrevKv.Value).To(Equal([]byte("updatedValue")))
+			g.Expect(v.Events[0].PrevKv.ModRevision).To(Equal(revAfterUpdate))
+			return true
+		})))
+		g.Consistently(watchCh, testWatchEventIdleTimeout).ShouldNot(Receive())
+	})
+}
+
+// TestWatchCompacted is unit testing for the Watch operation from a compacted revision.
+func TestWatchCompacted(t *testing.T) {
+	ctx := context.Background()
+	client := newKine(t)
+	key := "/compacted/key"
+
+	// create the key and update it a few times
+	var revisions []int64
+	for i := 0; i < 4; i++ {
+		g := NewWithT(t)
+		cmp := clientv3.Compare(clientv3.ModRevision(key), "=", 0)
+		if len(revisions) > 0 {
+			cmp = clientv3.Compare(clientv3.ModRevision(key), "=", revisions[len(revisions)-1])
+		}
+		resp, err := client.Txn(ctx).
+			If(cmp).
+			Then(clientv3.OpPut(key, fmt.Sprintf("value-%d", i))).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		revisions = append(revisions, resp.Header.Revision)
+	}
+
+	g := NewWithT(t)
+	_, err := client.Compact(ctx, revisions[2])
+	g.Expect(err).To(BeNil())
+
+	t.Run("Canceled", func(t *testing.T) {
+		g := NewWithT(t)
+		watchCh := client.Watch(ctx, key, clientv3.WithRev(revisions[0]))
+
+		g.Eventually(watchCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+			g.Expect(v.Canceled).To(BeTrue())
+			g.Expect(v.Events).To(BeEmpty())
+			g.Expect(v.CompactRevision).To(Equal(revisions[2]))
+			g.Expect(v.Err()).To(Equal(rpctypes.ErrCompacted))
+			return true
+		})))
+
+		// the client closes the channel of a canceled watch
+		g.Eventually(watchCh, testWatchEventPollTimeout).Should(BeClosed())
+	})
+
+	t.Run("AfterCompactRevision", func(t *testing.T) {
+		g := NewWithT(t)
+		watchCh := client.Watch(ctx, key, clientv3.WithRev(revisions[3]))
+
+		g.Eventually(watchCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+			g.Expect(v.Canceled).To(BeFalse())
+			g.Expect(v.Events).To(HaveLen(1))
+			g.Expect(v.Events[0].Kv.ModRevision).To(Equal(revisions[3]))
+			return true
+		})))
+	})
+}
+
+// TestWatchFragment is unit testing for fragmented responses of the Watch operation.
+func TestWatchFragment(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	maxResponseBytes := 4096
+	client, _ := newKineWithConfig(t, endpoint.Config{
+		MaxResponseBytes: maxResponseBytes,
+	})
+
+	// write enough large values that replaying them does not fit in one response
+	var revisions []int64
+	value := strings.Repeat("v", 1024)
+	for i := 0; i < 10; i++ {
+		g := NewWithT(t)
+		key := fmt.Sprintf("/fragment/key-%d", i)
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, value)).
+			Commit()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Succeeded).To(BeTrue())
+		revisions = append(revisions, resp.Header.Revision)
+	}
+
+	t.Run("Split", func(t *testing.T) {
+		g := NewWithT(t)
+
+		// the raw stream shows the fragments that clientv3 would put back together
+		stream, err := etcdserverpb.NewWatchClient(client.ActiveConnection()).Watch(ctx)
+		g.Expect(err).To(BeNil())
+		g.Expect(stream.Send(&etcdserverpb.WatchRequest{
+			RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+				CreateRequest: &etcdserverpb.WatchCreateRequest{
+					Key:           []byte("/fragment/"),
+					RangeEnd:      []byte("/fragment0"),
+					StartRevision: revisions[0],
+					Fragment:      true,
+				},
+			},
+		})).To(Succeed())
+
+		resp, err := stream.Recv()
+		g.Expect(err).To(BeNil())
+		g.Expect(resp.Created).To(BeTrue())
+
+		var fragments []*etcdserverpb.WatchResponse
+		for {
+			resp, err := stream.Recv()
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Size()).To(BeNumerically("<=", maxResponseBytes))
+			fragments = append(fragments, resp)
+			if !resp.Fragment {
+				break
+			}
+		}
+		g.Expect(len(fragments)).To(BeNumerically(">", 1))
+
+		var received []int64
+		for _, fragment := range fragments {
+			for _, event := range fragment.Events {
+				received = append(received, event.Kv.ModRevision)
+			}
+		}
+		g.Expect(received).To(Equal(revisions))
+	})
+
+	t.Run("Reassembled", func(t *testing.T) {
+		g := NewWithT(t)
+		watchCh := client.Watch(ctx, "/fragment/", clientv3.WithPrefix(), clientv3.WithRev(revisions[0]), clientv3.WithFragment())
+
+		g.Eventually(watchCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+			g.Expect(v.Events).To(HaveLen(len(revisions)))
+			return true
+		})))
+	})
+
+	t.Run("NotRequested", func(t *testing.T) {
+		g := NewWithT(t)
+		watchCh := client.Watch(ctx, "/fragment/", clientv3.WithPrefix(), clientv3.WithRev(revisions[0]))
+
+		g.Eventually(watchCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+			g.Expect(v.Events).To(HaveLen(len(revisions)))
+			return true
+		})))
+	})
+}
+
+// TestWatchSlowConsumer is unit testing for watches that fall behind the events they watch.
+func TestWatchSlowConsumer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watchBufferSize := 2
+	_, dsn := newKineWithConfig(t, endpoint.Config{})
+	log, _ := openSQLLogWithConfig(t, dsn, sqlite.Config{DisableUpdateHook: true}, generic.Config{
+		WatchBufferSize: watchBufferSize,
+	})
+
+	// the slow watcher never reads, until the end of the test
+	slowCh := log.Watch(ctx, "/slow/")
+	fastCh := log.Watch(ctx, "/slow/")
+
+	t.Run("FastKeepsReceiving", func(t *testing.T) {
+		g := NewWithT(t)
+
+		// write well past what the slow watcher can buffer, one poll at a time
+		for i := 0; i < 10*watchBufferSize; i++ {
+			rev, err := log.Append(ctx, &server.Event{
+				Create: true,
+				KV: &server.KeyValue{
+					Key:   fmt.Sprintf("/slow/key-%d", i),
+					Value: []byte("value"),
+				},
+			})
+			g.Expect(err).To(BeNil())
+
+			g.Eventually(fastCh, time.Second).Should(Receive(Satisfy(func(v server.WatchEvents) bool {
+				return len(v.Events) == 1 && v.Events[0].KV.ModRevision == rev
+			})))
+		}
+	})
+
+	t.Run("SlowCanceled", func(t *testing.T) {
+		g := NewWithT(t)
+
+		// the slow watcher gets what it buffered, then the reason it was dropped
+		var last server.WatchEvents
+		for v := range slowCh {
+			last = v
+		}
+		g.Expect(last.Err).To(Equal(server.ErrWatchTooSlow))
+	})
+}
+
+// TestWatchPollInterval is unit testing for the latency of the Watch operation on writes that
+// kine is not told of, which are only found by polling.
+func TestWatchPollInterval(t *testing.T) {
+	for _, pollInterval := range []time.Duration{100 * time.Millisecond, 500 * time.Millisecond} {
+		pollInterval := pollInterval
+		t.Run(pollInterval.String(), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			client, dsn := newKineWithConfig(t, endpoint.Config{
+				PollInterval: pollInterval,
+			})
+
+			// writes through a second handle on the database are not notified to kine
+			log, _ := openSQLLog(t, dsn)
+			watchCh := client.Watch(ctx, "/poll/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+			NewWithT(t).Eventually(watchCh, time.Second).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+				return v.Created
+			})))
+
+			for i := 0; i < 4; i++ {
+				g := NewWithT(t)
+				rev, err := log.Append(ctx, &server.Event{
+					Create: true,
+					KV: &server.KeyValue{
+						Key:   fmt.Sprintf("/poll/key-%d", i),
+						Value: []byte("value"),
+					},
+				})
+				g.Expect(err).To(BeNil())
+
+				start := time.Now()
+				g.Eventually(watchCh, 2*pollInterval+time.Second).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+					return len(v.Events) == 1 && v.Events[0].Kv.ModRevision == rev
+				})))
+				latency := time.Since(start)
+
+				// the first write lines the writes up with the polls, so that later ones are
+				// made right after a poll and have to wait for the next
+				g.Expect(latency).To(BeNumerically("<=", pollInterval+250*time.Millisecond))
+				if i > 0 {
+					g.Expect(latency).To(BeNumerically(">=", pollInterval/2))
+				}
+			}
+		})
+	}
+
+	t.Run("InvalidParameters", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		dsn := newTestDir(t) + "/data.db"
+
+		for _, params := range []string{"poll-interval=0s", "poll-interval=-1s", "poll-batch-size=0", "poll-batch-size=-1"} {
+			g := NewWithT(t)
+			_, _, err := sqlite.NewVariant(ctx, sqliteDriverName(), dsn+"?"+params, sqlite.Config{}, generic.Config{})
+			g.Expect(err).NotTo(BeNil(), params)
+		}
+	})
+}
+
+// TestWatchPollPaused is unit testing for watches that start while kine has no watchers, and so
+// is not polling for writes it is not told of.
+func TestWatchPollPaused(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pollInterval := 100 * time.Millisecond
+	client, dsn := newKineWithConfig(t, endpoint.Config{
+		PollInterval: pollInterval,
+	})
+
+	// writes through a second handle on the database are not notified to kine
+	log, _ := openSQLLog(t, dsn)
+	appendKey := func(g Gomega, i int) int64 {
+		rev, err := log.Append(ctx, &server.Event{
+			Create: true,
+			KV: &server.KeyValue{
+				Key:   fmt.Sprintf("/paused/key-%d", i),
+				Value: []byte("value"),
+			},
+		})
+		g.Expect(err).To(BeNil())
+		return rev
+	}
+
+	// receive collects the revisions of the events received until it has the given number
+	receive := func(g Gomega, watchCh clientv3.WatchChan, count int) []int64 {
+		var revisions []int64
+		g.Eventually(func() []int64 {
+			select {
+			case v := <-watchCh:
+				for _, event := range v.Events {
+					revisions = append(revisions, event.Kv.ModRevision)
+				}
+			default:
+			}
+			return revisions
+		}, 2*pollInterval+time.Second).Should(HaveLen(count))
+		return revisions
+	}
+
+	// start polling with a watch, then stop it again
+	{
+		g := NewWithT(t)
+		watchCtx, watchCancel := context.WithCancel(ctx)
+		watchCh := client.Watch(watchCtx, "/paused/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+		g.Eventually(watchCh, time.Second).Should(Receive())
+		watchCancel()
+		time.Sleep(2 * pollInterval)
+	}
+
+	t.Run("HistoryWithoutGaps", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var written []int64
+		for i := 0; i < 3; i++ {
+			written = append(written, appendKey(g, i))
+		}
+
+		watchCh := client.Watch(ctx, "/paused/", clientv3.WithPrefix(), clientv3.WithRev(written[0]))
+		g.Expect(receive(g, watchCh, len(written))).To(Equal(written))
+
+		// polling is resumed for the new watch
+		rev := appendKey(g, len(written))
+		g.Expect(receive(g, watchCh, 1)).To(Equal([]int64{rev}))
+		g.Consistently(watchCh, testWatchEventIdleTimeout).ShouldNot(Receive())
+	})
+}
+
+// TestWatchUpdateHook is unit testing for the latency of the Watch operation on writes made by
+// another kine in the same process, which are found by update hooks instead of polling.
+func TestWatchUpdateHook(t *testing.T) {
+	if sqliteDriverName() != "sqlite3" {
+		t.Skip("update hooks require the cgo sqlite driver")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pollInterval := 5 * time.Second
+	client, dsn := newKineWithConfig(t, endpoint.Config{
+		PollInterval: pollInterval,
+	})
+	log, _ := openSQLLogWithConfig(t, dsn, sqlite.Config{}, generic.Config{})
+
+	watchCh := client.Watch(ctx, "/hook/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	NewWithT(t).Eventually(watchCh, time.Second).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+		return v.Created
+	})))
+
+	for i := 0; i < 3; i++ {
+		g := NewWithT(t)
+		rev, err := log.Append(ctx, &server.Event{
+			Create: true,
+			KV: &server.KeyValue{
+				Key:   fmt.Sprintf("/hook/key-%d", i),
+				Value: []byte("value"),
+			},
+		})
+		g.Expect(err).To(BeNil())
+
+		// well before the next poll would have found the write
+		g.Eventually(watchCh, pollInterval/5).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+			return len(v.Events) == 1 && v.Events[0].Kv.ModRevision == rev
+		})))
+	}
+}
+
+// TestWatchFutureRevision is unit testing for watches that start at a revision the store has not
+// reached yet, which wait for it rather than failing or starting from the current revision.
+func TestWatchFutureRevision(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newKine(t)
+	g := NewWithT(t)
+
+	createKey(ctx, g, client, "/testWatchFutureRevision/0", "0")
+	getResp, err := client.Get(ctx, "/testWatchFutureRevision/0")
+	g.Expect(err).To(BeNil())
+	rev := getResp.Header.Revision
+
+	watchCh := client.Watch(ctx, "/testWatchFutureRevision/", clientv3.WithPrefix(), clientv3.WithRev(rev+5))
+	for i := 1; i < 5; i++ {
+		createKey(ctx, g, client, fmt.Sprintf("/testWatchFutureRevision/%d", i), "value")
+	}
+	g.Consistently(watchCh, testWatchEventIdleTimeout).ShouldNot(Receive())
+
+	createKey(ctx, g, client, "/testWatchFutureRevision/5", "value")
+	g.Eventually(watchCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+		g.Expect(v.Canceled).To(BeFalse())
+		g.Expect(v.Events).To(HaveLen(1))
+		g.Expect(string(v.Events[0].Kv.Key)).To(Equal("/testWatchFutureRevision/5"))
+		g.Expect(v.Events[0].Kv.ModRevision).To(Equal(rev + 5))
+		return true
+	})))
+
+	createKey(ctx, g, client, "/testWatchFutureRevision/6", "value")
+	g.Eventually(watchCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+		g.Expect(v.Events).To(HaveLen(1))
+		g.Expect(v.Events[0].Kv.ModRevision).To(Equal(rev + 6))
+		return true
+	})))
+}
+
+// TestWatchFromKey is unit testing for watches of the keys from a key on, and of the whole
+// keyspace, which receive the events of keys of any prefix.
+func TestWatchFromKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newKine(t)
+	g := NewWithT(t)
+
+	createKey(ctx, g, client, "/testWatchFromKey/a/0", "0")
+	getResp, err := client.Get(ctx, "/testWatchFromKey/a/0")
+	g.Expect(err).To(BeNil())
+	rev := getResp.Header.Revision + 1
+
+	keyspaceCh := client.Watch(ctx, "\x00", clientv3.WithFromKey(), clientv3.WithRev(rev))
+	fromKeyCh := client.Watch(ctx, "/testWatchFromKey/b", clientv3.WithFromKey(), clientv3.WithRev(rev))
+	createKey(ctx, g, client, "/testWatchFromKey/a/1", "1")
+	createKey(ctx, g, client, "/testWatchFromKey/b/1", "1")
+	createKey(ctx, g, client, "/testWatchFromKeyOther", "1")
+
+	for _, test := range []struct {
+		name    string
+		watchCh clientv3.WatchChan
+		keys    []string
+	}{
+		{name: "Keyspace", watchCh: keyspaceCh, keys: []string{"/testWatchFromKey/a/1", "/testWatchFromKey/b/1", "/testWatchFromKeyOther"}},
+		{name: "Midpoint", watchCh: fromKeyCh, keys: []string{"/testWatchFromKey/b/1", "/testWatchFromKeyOther"}},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			var keys []string
+			for len(keys) < len(test.keys) {
+				g.Eventually(test.watchCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+					for _, event := range v.Events {
+						keys = append(keys, string(event.Kv.Key))
+					}
+					return true
+				})))
+			}
+			g.Expect(keys).To(Equal(test.keys))
+			g.Consistently(test.watchCh, testWatchEventIdleTimeout).ShouldNot(Receive())
+		})
+	}
+}
+
+// TestWatchSharing is unit testing for watches of the same key and filters, which share a watch
+// of the backend unless DisableWatchSharing is set, started both at and before the revision that
+// the shared watch is at.
+func TestWatchSharing(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		disable := disable
+		t.Run(fmt.Sprintf("DisableWatchSharing=%v", disable), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client, _ := newKineWithConfig(t, endpoint.Config{DisableWatchSharing: disable})
+			g := NewWithT(t)
+
+			createKey(ctx, g, client, "/testWatchSharing/a", "a")
+			getResp, err := client.Get(ctx, "/testWatchSharing/a")
+			g.Expect(err).To(BeNil())
+			rev := getResp.Header.Revision
+
+			liveCh := client.Watch(ctx, "/testWatchSharing/", clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+			g.Consistently(liveCh, testWatchEventIdleTimeout).ShouldNot(Receive())
+			catchUpCh := client.Watch(ctx, "/testWatchSharing/", clientv3.WithPrefix(), clientv3.WithRev(rev))
+			g.Eventually(catchUpCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+				g.Expect(v.Events).To(HaveLen(1))
+				g.Expect(string(v.Events[0].Kv.Key)).To(Equal("/testWatchSharing/a"))
+				return true
+			})))
+
+			createKey(ctx, g, client, "/testWatchSharing/b", "b")
+			for _, watchCh := range []clientv3.WatchChan{liveCh, catchUpCh} {
+				g.Eventually(watchCh, testWatchEventPollTimeout).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+					g.Expect(v.Events).To(HaveLen(1))
+					g.Expect(string(v.Events[0].Kv.Key)).To(Equal("/testWatchSharing/b"))
+					g.Expect(v.Events[0].Kv.ModRevision).To(Equal(rev + 1))
+					return true
+				})))
+				g.Consistently(watchCh, testWatchEventIdleTimeout).ShouldNot(Receive())
+			}
+		})
+	}
+}
+
+// TestWatchSharingSlowCatchUp is unit testing for a watch that joins a shared watch of the
+// backend and catches up for longer than the shared watch takes to receive more batches than a
+// watch buffers. The batches are held for it while it catches up, up to a limit past which it is
+// dropped for falling behind.
+func TestWatchSharingSlowCatchUp(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		writes  int
+		dropped bool
+	}{
+		{name: "CaughtUp", writes: 200},
+		// past the batches held for a watch that catches up
+		{name: "FellBehind", writes: 600, dropped: true},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			g := NewWithT(t)
+			client, _ := newKineWithConfig(t, endpoint.Config{})
+
+			var revisions []int64
+			put := func(key, value string) int64 {
+				resp, err := client.Txn(ctx).
+					If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+					Then(clientv3.OpPut(key, value)).
+					Commit()
+				g.Expect(err).To(BeNil())
+				g.Expect(resp.Succeeded).To(BeTrue())
+				revisions = append(revisions, resp.Header.Revision)
+				return resp.Header.Revision
+			}
+
+			// the history is well past the flow control window of the slow client, so that its
+			// watch is held up catching up until the test reads it
+			value := strings.Repeat("v", 8*1024)
+			for i := 0; i < 40; i++ {
+				put(fmt.Sprintf("/testWatchSharingSlow/history-%d", i), value)
+			}
+
+			liveCh := client.Watch(ctx, "/testWatchSharingSlow/", clientv3.WithPrefix(), clientv3.WithRev(revisions[len(revisions)-1]+1))
+			live := func(key string) {
+				rev := put(key, "live")
+				g.Eventually(liveCh, time.Second).Should(Receive(Satisfy(func(v clientv3.WatchResponse) bool {
+					return len(v.Events) == 1 && v.Events[0].Kv.ModRevision == rev
+				})))
+			}
+			live("/testWatchSharingSlow/started")
+
+			slow, err := clientv3.New(clientv3.Config{
+				Endpoints:   client.Endpoints(),
+				DialTimeout: 5 * time.Second,
+				DialOptions: []grpc.DialOption{
+					grpc.WithInitialWindowSize(64 * 1024),
+					grpc.WithInitialConnWindowSize(64 * 1024),
+				},
+			})
+			g.Expect(err).To(BeNil())
+			defer slow.Close()
+			streamCtx, streamCancel := context.WithTimeout(ctx, 30*time.Second)
+			defer streamCancel()
+			stream, err := etcdserverpb.NewWatchClient(slow.ActiveConnection()).Watch(streamCtx)
+			g.Expect(err).To(BeNil())
+			g.Expect(stream.Send(&etcdserverpb.WatchRequest{
+				RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+					CreateRequest: &etcdserverpb.WatchCreateRequest{
+						Key:           []byte("/testWatchSharingSlow/"),
+						RangeEnd:      []byte("/testWatchSharingSlow0"),
+						StartRevision: revisions[0],
+					},
+				},
+			})).To(Succeed())
+			resp, err := stream.Recv()
+			g.Expect(err).To(BeNil())
+			g.Expect(resp.Created).To(BeTrue())
+
+			// the shared watch receives one batch for each write, while the slow watch is not read
+			for i := 0; i < test.writes; i++ {
+				live(fmt.Sprintf("/testWatchSharingSlow/live-%d", i))
+			}
+
+			var received []int64
+			for len(received) < len(revisions) {
+				resp, err := stream.Recv()
+				g.Expect(err).To(BeNil())
+				if test.dropped && resp.Canceled {
+					g.Expect(resp.CancelReason).To(Equal(server.ErrWatchTooSlow.Error()))
+					g.Expect(received).To(Equal(revisions[:len(received)]))
+					return
+				}
+				g.Expect(resp.Canceled).To(BeFalse(), resp.CancelReason)
+				for _, event := range resp.Events {
+					received = append(received, event.Kv.ModRevision)
+				}
+			}
+			g.Expect(test.dropped).To(BeFalse(), "the watch was not dropped")
+			g.Expect(received).To(Equal(revisions))
+		})
+	}
+}
+
+// BenchmarkWatchers is a benchmark for delivering each write to 500 watches of the same prefix,
+// with and without sharing a watch of the backend between them. It reports the time spent per
+// event received by a watch.
+func BenchmarkWatchers(b *testing.B) {
+	const watchers = 500
+
+	for _, disable := range []bool{false, true} {
+		disable := disable
+		b.Run(fmt.Sprintf("DisableWatchSharing=%v", disable), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client, _ := newKineWithConfig(b, endpoint.Config{DisableWatchSharing: disable})
+			g := NewWithT(b)
+
+			createKey(ctx, g, client, "/benchWatchers/key", "0")
+			getResp, err := client.Get(ctx, "/benchWatchers/key")
+			g.Expect(err).To(BeNil())
+			rev := getResp.Header.Revision
+			modRev := getResp.Kvs[0].ModRevision
+
+			watchChs := make([]clientv3.WatchChan, watchers)
+			for i := range watchChs {
+				watchChs[i] = client.Watch(ctx, "/benchWatchers/", clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+			}
+
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				resp, err := client.Txn(ctx).
+					If(clientv3.Compare(clientv3.ModRevision("/benchWatchers/key"), "=", modRev)).
+					Then(clientv3.OpPut("/benchWatchers/key", fmt.Sprintf("%d", i+1))).
+					Commit()
+				g.Expect(err).To(BeNil())
+				g.Expect(resp.Succeeded).To(BeTrue())
+				modRev = resp.Header.Revision
+				for j, watchCh := range watchChs {
+					select {
+					case v := <-watchCh:
+						g.Expect(v.Events).To(HaveLen(1))
+					case <-time.After(5 * time.Second):
+						b.Fatalf("watch %d received no event for revision %d", j, modRev)
+					}
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*watchers), "ns/event")
+		})
+	}
+}